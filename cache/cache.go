@@ -0,0 +1,295 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/afero"
+)
+
+const (
+	// formatVersion is part of every key, bump it when the snapshot layout changes
+	formatVersion  = 1
+	layerExtension = ".tar.zst"
+)
+
+// KeyInputs are everything the cached steps depend on, any change produces a new key.
+type KeyInputs struct {
+	BaseImageHash     string                 `json:"baseImageHash"`
+	Packages          []string               `json:"packages"`
+	Repos             []configure.Deb822Repo `json:"repos"`
+	KubernetesVersion string                 `json:"kubernetesVersion"`
+	CriCtlVersion     string                 `json:"criCtlVersion"`
+	CNIVersion        string                 `json:"cniVersion"`
+	ContainerdPackage string                 `json:"containerdPackage"`
+	PreloadImages     []string               `json:"preloadImages"`
+	// PackagePins are the versions replayed from a previous manifest, a pinned build can't reuse an unpinned layer.
+	PackagePins map[string]string `json:"packagePins,omitempty"`
+	// KernelPin are the pinned kernel package versions.
+	KernelPin map[string]string `json:"kernelPin,omitempty"`
+	// Purge and Mask are what the packages step removes from the base image.
+	Purge []string `json:"purge,omitempty"`
+	Mask  []string `json:"mask,omitempty"`
+	// CgroupMode picks the driver the packages and kubernetes steps configure containerd and the kubelet with.
+	CgroupMode configure.CgroupMode `json:"cgroupMode"`
+	// FileOverrides are the hashes of embedded files replaced with --overrides-dir, see configure.OverrideHashes.
+	FileOverrides map[string]string `json:"fileOverrides,omitempty"`
+}
+
+// Key hashes the inputs, package and image lists are sorted first since their order doesn't change the result.
+func Key(inputs KeyInputs) (string, error) {
+	normalized := inputs
+	normalized.Packages = sortedCopy(inputs.Packages)
+	normalized.PreloadImages = sortedCopy(inputs.PreloadImages)
+	normalized.Purge = sortedCopy(inputs.Purge)
+	normalized.Mask = sortedCopy(inputs.Mask)
+
+	encoded, marshalErr := json.Marshal(struct {
+		Version int       `json:"version"`
+		Inputs  KeyInputs `json:"inputs"`
+	}{Version: formatVersion, Inputs: normalized})
+	if marshalErr != nil {
+		return "", marshalErr
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func sortedCopy(values []string) []string {
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// Store keeps layer snapshots in a directory, one archive per key.
+type Store struct {
+	fs  afero.Fs
+	dir string
+}
+
+func NewStore(fs afero.Fs, dir string) *Store {
+	return &Store{fs: fs, dir: dir}
+}
+
+func (s *Store) layerPath(key string) string {
+	return filepath.Join(s.dir, key+layerExtension)
+}
+
+func (s *Store) Has(key string) (bool, error) {
+	return afero.Exists(s.fs, s.layerPath(key))
+}
+
+// Save snapshots root into the store, writing to a temporary file first so an interrupted build never leaves a
+// partial layer behind under a valid key.
+func (s *Store) Save(ctx context.Context, root afero.Fs, key string) error {
+	ctx, span := telemetry.Start(ctx, "save layer cache")
+	defer span.End()
+
+	if err := s.fs.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	temporary := s.layerPath(key) + ".tmp"
+	file, createErr := s.fs.Create(temporary)
+	if createErr != nil {
+		return createErr
+	}
+
+	if err := errors.Join(Snapshot(ctx, root, file), file.Close()); err != nil {
+		_ = s.fs.Remove(temporary)
+		return err
+	}
+
+	return s.fs.Rename(temporary, s.layerPath(key))
+}
+
+func (s *Store) Restore(ctx context.Context, root afero.Fs, key string) error {
+	ctx, span := telemetry.Start(ctx, "restore layer cache")
+	defer span.End()
+
+	file, openErr := s.fs.Open(s.layerPath(key))
+	if openErr != nil {
+		return openErr
+	}
+	defer utility.WrappedClose(file)
+
+	return Restore(ctx, root, file)
+}
+
+// Snapshot writes every directory, regular file, symlink, and hard link under root to w as a zstd compressed tarball.
+func Snapshot(ctx context.Context, root afero.Fs, w io.Writer) error {
+	_, span := telemetry.Start(ctx, "snapshot root")
+	defer span.End()
+
+	compressor, compressorErr := zstd.NewWriter(w)
+	if compressorErr != nil {
+		return compressorErr
+	}
+	tarWriter := tar.NewWriter(compressor)
+
+	walkErr := utility.WriteTree(root, tarWriter, utility.TreeOptions{Skipped: func(name string) {
+		span.AddEvent(fmt.Sprintf("skipping special file: %s", name))
+	}})
+	if walkErr != nil {
+		return walkErr
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return compressor.Close()
+}
+
+// Restore replaces the contents of root with the snapshot read from r. Mount points under root (e.g. the boot
+// partition) are emptied rather than removed.
+func Restore(ctx context.Context, root afero.Fs, r io.Reader) error {
+	_, span := telemetry.Start(ctx, "restore root")
+	defer span.End()
+
+	if err := clearDirectory(root, "/"); err != nil {
+		return err
+	}
+
+	decompressor, decompressorErr := zstd.NewReader(r)
+	if decompressorErr != nil {
+		return decompressorErr
+	}
+	defer decompressor.Close()
+
+	isRoot := os.Geteuid() == 0
+	tarReader := tar.NewReader(decompressor)
+	for {
+		header, headerErr := tarReader.Next()
+		if errors.Is(headerErr, io.EOF) {
+			return nil
+		}
+		if headerErr != nil {
+			return headerErr
+		}
+
+		name := path.Join("/", header.Name)
+		mode := header.FileInfo().Mode()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := root.MkdirAll(name, mode.Perm()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := utility.Symlink(root, header.Linkname, name); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeLink:
+			if err := utility.Link(root, path.Join("/", header.Linkname), name); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeReg:
+			file, openErr := root.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+			if openErr != nil {
+				return openErr
+			}
+			_, copyErr := io.Copy(file, tarReader) //nolint:gosec
+			if err := errors.Join(copyErr, file.Close()); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+
+		if err := applyAttributes(root, name, header, isRoot); err != nil {
+			return err
+		}
+	}
+}
+
+// applyAttributes restores ownership, mode, extended attributes, and modification time, in that order: chown clears
+// setuid, setgid, and file capabilities, so the mode and attributes go on after it.
+func applyAttributes(root afero.Fs, name string, header *tar.Header, isRoot bool) error {
+	if isRoot {
+		if err := root.Chown(name, header.Uid, header.Gid); ignorePermission(err) != nil {
+			return err
+		}
+	}
+	// chmod again since the umask applies on create and setuid bits need to survive
+	if err := root.Chmod(name, header.FileInfo().Mode()); ignorePermission(err) != nil {
+		return err
+	}
+	if err := utility.ApplyXattrs(root, name, header); err != nil {
+		return err
+	}
+	return root.Chtimes(name, header.ModTime, header.ModTime)
+}
+
+// ignorePermission drops EPERM, the vfat boot partition can't represent unix modes or ownership.
+func ignorePermission(err error) error {
+	if errors.Is(err, fs.ErrPermission) {
+		return nil
+	}
+	return err
+}
+
+func clearDirectory(root afero.Fs, dir string) error {
+	parent, statErr := root.Stat(dir)
+	if statErr != nil {
+		return statErr
+	}
+	entries, readErr := afero.ReadDir(root, dir)
+	if readErr != nil {
+		return readErr
+	}
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		if entry.IsDir() && isMountPoint(parent, entry) {
+			if err := clearDirectory(root, name); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := root.RemoveAll(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isMountPoint(parent fs.FileInfo, child fs.FileInfo) bool {
+	parentStat, parentOk := parent.Sys().(*syscall.Stat_t)
+	childStat, childOk := child.Sys().(*syscall.Stat_t)
+	if !parentOk || !childOk {
+		return false
+	}
+	return parentStat.Dev != childStat.Dev
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func baseInputs() KeyInputs {
+	return KeyInputs{
+		BaseImageHash:     "abc123",
+		Packages:          []string{"curl", "sudo"},
+		Repos:             []configure.Deb822Repo{{Types: "deb", URIs: "https://example.com", Suites: "focal", Components: "stable", Arch: "arm64"}},
+		KubernetesVersion: "v1.25.3",
+		CriCtlVersion:     "v1.25.0",
+		CNIVersion:        "v1.1.1",
+		ContainerdPackage: "containerd.io",
+	}
+}
+
+func TestKeyStable(t *testing.T) {
+	first, firstErr := Key(baseInputs())
+	second, secondErr := Key(baseInputs())
+	assert.NoError(t, firstErr)
+	assert.NoError(t, secondErr)
+	assert.Equal(t, first, second)
+
+	reordered := baseInputs()
+	reordered.Packages = []string{"sudo", "curl"}
+	reorderedKey, _ := Key(reordered)
+	assert.Equal(t, first, reorderedKey)
+}
+
+func TestKeyChangesWithInputs(t *testing.T) {
+	original, _ := Key(baseInputs())
+	mutations := []func(inputs *KeyInputs){
+		func(inputs *KeyInputs) { inputs.BaseImageHash = "def456" },
+		func(inputs *KeyInputs) { inputs.Packages = append(inputs.Packages, "htop") },
+		func(inputs *KeyInputs) { inputs.Repos[0].Suites = "jammy" },
+		func(inputs *KeyInputs) { inputs.KubernetesVersion = "v1.25.4" },
+		func(inputs *KeyInputs) { inputs.CriCtlVersion = "v1.25.1" },
+		func(inputs *KeyInputs) { inputs.CNIVersion = "v1.1.2" },
+		func(inputs *KeyInputs) { inputs.ContainerdPackage = "containerd" },
+		func(inputs *KeyInputs) { inputs.PreloadImages = []string{"docker.io/library/busybox:latest"} },
+		func(inputs *KeyInputs) { inputs.CgroupMode = configure.CgroupLegacy },
+		func(inputs *KeyInputs) {
+			inputs.FileOverrides = map[string]string{"containerd-config.toml.template": "0123456789abcdef"}
+		},
+	}
+	for index, mutate := range mutations {
+		inputs := baseInputs()
+		mutate(&inputs)
+		key, err := Key(inputs)
+		assert.NoError(t, err)
+		assert.NotEqual(t, original, key, "mutation %d", index)
+	}
+}
+
+func TestSaveAndRestore(t *testing.T) {
+	ctx := context.Background()
+	root := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(root, "/etc/containerd/config.toml", []byte("version = 2"), 0644))
+	assert.NoError(t, afero.WriteFile(root, "/usr/local/bin/kubelet", []byte("binary"), 0755))
+	assert.NoError(t, root.MkdirAll("/var/lib/empty", 0700))
+
+	store := NewStore(afero.NewMemMapFs(), "/cache")
+	hit, hasErr := store.Has("key")
+	assert.NoError(t, hasErr)
+	assert.False(t, hit)
+
+	assert.NoError(t, store.Save(ctx, root, "key"))
+	hit, hasErr = store.Has("key")
+	assert.NoError(t, hasErr)
+	assert.True(t, hit)
+
+	// simulate a fresh base image that has different contents from the configured one
+	fresh := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fresh, "/snap/core/current", []byte("stale"), 0644))
+	assert.NoError(t, afero.WriteFile(fresh, "/etc/containerd/config.toml", []byte("old"), 0644))
+
+	assert.NoError(t, store.Restore(ctx, fresh, "key"))
+
+	config, configErr := afero.ReadFile(fresh, "/etc/containerd/config.toml")
+	assert.NoError(t, configErr)
+	assert.Equal(t, []byte("version = 2"), config)
+
+	kubelet, statErr := fresh.Stat("/usr/local/bin/kubelet")
+	assert.NoError(t, statErr)
+	assert.Equal(t, "-rwxr-xr-x", kubelet.Mode().String())
+
+	empty, emptyErr := fresh.Stat("/var/lib/empty")
+	assert.NoError(t, emptyErr)
+	assert.True(t, empty.IsDir())
+
+	stale, staleErr := afero.Exists(fresh, "/snap/core/current")
+	assert.NoError(t, staleErr)
+	assert.False(t, stale)
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	root := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(root, "/boot/firmware/cmdline.txt", []byte("root=/dev/rootvg/rootlv"), 0755))
+
+	var buffer bytes.Buffer
+	assert.NoError(t, Snapshot(ctx, root, &buffer))
+
+	restored := afero.NewMemMapFs()
+	assert.NoError(t, Restore(ctx, restored, &buffer))
+	cmdline, err := afero.ReadFile(restored, "/boot/firmware/cmdline.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("root=/dev/rootvg/rootlv"), cmdline)
+}
+
+func TestSnapshotHardLinks(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	root := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	assert.NoError(t, root.MkdirAll("/usr/bin", 0755))
+	assert.NoError(t, afero.WriteFile(root, "/usr/bin/ping", []byte("binary"), 0755))
+	assert.NoError(t, os.Link(filepath.Join(dir, "usr/bin/ping"), filepath.Join(dir, "usr/bin/ping6")))
+
+	var buffer bytes.Buffer
+	assert.NoError(t, Snapshot(ctx, root, &buffer))
+
+	restored := afero.NewMemMapFs()
+	assert.NoError(t, Restore(ctx, restored, &buffer))
+	ping6, err := afero.ReadFile(restored, "/usr/bin/ping6")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("binary"), ping6)
+}
+
+func TestRestoreKeepsSetuidAndCapabilities(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("restoring ownership, setuid bits, and file capabilities needs root")
+	}
+	ctx := context.Background()
+	dir := t.TempDir()
+	root := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	assert.NoError(t, root.MkdirAll("/usr/bin", 0755))
+	assert.NoError(t, afero.WriteFile(root, "/usr/bin/sudo", []byte("binary"), 0755))
+	assert.NoError(t, root.Chmod("/usr/bin/sudo", 0755|os.ModeSetuid))
+	assert.NoError(t, afero.WriteFile(root, "/usr/bin/ping", []byte("binary"), 0755))
+	// cap_net_raw+ep, a version 2 vfs capability
+	capability := []byte{0x01, 0x00, 0x00, 0x02, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	if err := syscall.Setxattr(filepath.Join(dir, "usr/bin/ping"), "security.capability", capability, 0); err != nil {
+		t.Skipf("temp dir doesn't support file capabilities: %v", err)
+	}
+
+	var buffer bytes.Buffer
+	assert.NoError(t, Snapshot(ctx, root, &buffer))
+
+	restoredDir := t.TempDir()
+	restored := afero.NewBasePathFs(afero.NewOsFs(), restoredDir)
+	assert.NoError(t, Restore(ctx, restored, &buffer))
+
+	sudo, statErr := os.Stat(filepath.Join(restoredDir, "usr/bin/sudo"))
+	assert.NoError(t, statErr)
+	assert.Equal(t, "urwxr-xr-x", sudo.Mode().String())
+
+	value := make([]byte, 64)
+	size, getErr := syscall.Getxattr(filepath.Join(restoredDir, "usr/bin/ping"), "security.capability", value)
+	assert.NoError(t, getErr)
+	assert.Equal(t, capability, value[:size])
+}
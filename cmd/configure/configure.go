@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/config"
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/distro"
+	"github.com/LadySerena/pi-image-builder/manifest"
+	"github.com/LadySerena/pi-image-builder/pipeline"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	flag "github.com/spf13/pflag"
+)
+
+// cleanupTimeout bounds removing the qemu interpreter again, it runs on a context of its own so an interrupted run
+// doesn't leave it in the root.
+const cleanupTimeout = time.Minute
+
+// configureFlags are the parsed command line flags.
+type configureFlags struct {
+	root             string
+	configPath       string
+	profile          string
+	steps            []string
+	listSteps        bool
+	downloadCacheDir string
+	filesDir         string
+}
+
+func main() {
+	root := flag.String("root", "", "root filesystem directory to configure, e.g. one debootstrap or another image tool produced")
+	configPath := flag.StringP("config", "c", "", "path to a yaml build config, defaults are used when empty")
+	profile := flag.String("profile", "", "image variant to configure the root as, defaults to the config file's profile or "+config.DefaultProfile)
+	steps := flag.StringSlice("steps", nil, "configure steps to run against the root, repeat or comma separate for several, nothing runs unless it's named")
+	listSteps := flag.Bool("list-steps", false, "print the steps that can be run against a root directory, then exit")
+	downloadCacheDir := flag.String("download-cache-dir", "", "directory to keep verified kubernetes artifacts in")
+	filesDir := flag.String("files-dir", "", "directory the config's extra files are copied into the root from")
+	logOptions := telemetry.LogFlags(flag.CommandLine)
+	flag.BoolVar(&configure.ForceEmulation, "force-emulation", false, "run the root's binaries through qemu even on an arm64 host, for testing the emulated path")
+	flag.Parse()
+
+	logger, logErr := logOptions.NewLogger(os.Stderr)
+	if logErr != nil {
+		fmt.Fprintln(os.Stderr, logErr)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	flags := configureFlags{
+		root:             *root,
+		configPath:       *configPath,
+		profile:          *profile,
+		steps:            *steps,
+		listSteps:        *listSteps,
+		downloadCacheDir: *downloadCacheDir,
+		filesDir:         *filesDir,
+	}
+
+	// an interrupt stops between commands, the qemu interpreter is still removed on the way out
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, flags); err != nil {
+		logger.Error("configure failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, flags configureFlags) (err error) {
+	deps := &configureDeps{}
+	steps := configureSteps(deps)
+	if flags.listSteps {
+		for _, step := range steps {
+			fmt.Println(step.Name())
+		}
+		for alias, step := range stepAliases {
+			fmt.Printf("%s (alias for %s)\n", alias, step)
+		}
+		return nil
+	}
+
+	if len(flags.steps) == 0 {
+		return errors.New("name the steps to run with --steps, --list-steps prints them")
+	}
+	selected, onlyErr := pipeline.Only(steps, resolveStepNames(flags.steps))
+	if onlyErr != nil {
+		return onlyErr
+	}
+
+	localFs := afero.NewOsFs()
+	if flags.root == "" {
+		return errors.New("you must name the root filesystem directory to configure with --root")
+	}
+	if isDir, statErr := afero.IsDir(localFs, flags.root); statErr != nil || !isDir {
+		return fmt.Errorf("root %s is not a directory", flags.root)
+	}
+
+	cfg, configErr := config.Load(localFs, flags.configPath)
+	if configErr != nil {
+		return fmt.Errorf("error loading config: %w", configErr)
+	}
+	profile, profileErr := cfg.LookupProfile(flags.profile)
+	if profileErr != nil {
+		return profileErr
+	}
+	for _, step := range selected {
+		if profile.Skipped()[step.Name()] {
+			return fmt.Errorf("profile %s doesn't include the %s step", profile.Name, step.Name())
+		}
+	}
+	cfg = cfg.WithProfile(profile)
+	baseImage, distroErr := distro.Lookup(cfg.Distro)
+	if distroErr != nil {
+		return fmt.Errorf("error loading config: %w", distroErr)
+	}
+	versions, versionErr := cfg.Kubernetes.Resolve(ctx)
+	if versionErr != nil {
+		return fmt.Errorf("error picking kubernetes versions: %w", versionErr)
+	}
+	cfg.Kubernetes = versions
+
+	target, targetErr := configure.NewTarget(localFs, flags.root, cfg.Chroot, utility.ExecRunner{})
+	if targetErr != nil {
+		return fmt.Errorf("error picking how to run commands in the root: %w", targetErr)
+	}
+
+	// steps that only write files don't need the root's binaries to run on this host
+	if pipeline.NeedsChroot(selected) {
+		defer func() {
+			cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+			defer cancel()
+			if removeErr := configure.RemoveBinfmt(cleanupCtx, target.Fs); removeErr != nil {
+				err = errors.Join(err, fmt.Errorf("could not remove qemu interpreter from the root: %w", removeErr))
+			}
+		}()
+		if err := configure.EnsureBinfmt(ctx, target.Fs); err != nil {
+			return err
+		}
+	}
+
+	deps.localFs = localFs
+	deps.target = target
+	deps.cfg = cfg
+	deps.distro = baseImage
+	deps.profile = profile
+	deps.downloadCacheDir = flags.downloadCacheDir
+	deps.filesDir = flags.filesDir
+
+	state := &pipeline.BuildState{Manifest: manifest.New()}
+	if err := pipeline.Run(ctx, selected, pipeline.Selection{}, state); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(selected))
+	for _, step := range selected {
+		names = append(names, step.Name())
+	}
+	slog.Info("configured root", "root", target.Root, "steps", strings.Join(names, ","))
+	return nil
+}
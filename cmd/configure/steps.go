@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+
+	"github.com/LadySerena/pi-image-builder/config"
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/distro"
+	"github.com/LadySerena/pi-image-builder/pipeline"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+// configureDeps is what the configure steps need, it's filled in once the root is checked.
+type configureDeps struct {
+	localFs afero.Fs
+	// target is the root filesystem directory being configured
+	target  configure.Target
+	cfg     config.Config
+	distro  distro.Distro
+	profile config.Profile
+	// downloadCacheDir is where verified kubernetes artifacts are kept, empty downloads them every time
+	downloadCacheDir string
+	// filesDir holds the sources of the config's extra files
+	filesDir string
+}
+
+// stepAliases name a step by what it configures when setup's name for it says something else, e.g. the modules step
+// is also the one that writes the sysctls.
+var stepAliases = map[string]string{"sysctls": "modules"}
+
+// resolveStepNames swaps aliases for the step names they stand for.
+func resolveStepNames(names []string) []string {
+	resolved := make([]string, 0, len(names))
+	for _, name := range names {
+		if step, ok := stepAliases[name]; ok {
+			name = step
+		}
+		resolved = append(resolved, name)
+	}
+	return resolved
+}
+
+// configureSteps are the configure steps that can run against a root filesystem directory, with the same names setup
+// gives them. Steps that need the image's block devices, like fstab, encryption, or growing volumes, aren't offered.
+func configureSteps(deps *configureDeps) []pipeline.Step {
+	return []pipeline.Step{
+		pipeline.Func{StepName: "kernel", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.KernelSettings(ctx, deps.target.Fs, deps.distro, deps.cfg.Kernel, deps.cfg.CgroupMode)
+		}},
+		pipeline.Func{StepName: "modules", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.KernelModules(ctx, deps.target.Fs, deps.cfg.Sysctls)
+		}},
+		pipeline.Func{StepName: "journald", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Journald(ctx, deps.target.Fs, deps.cfg.Journald)
+		}},
+		pipeline.Func{StepName: "packages", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			packages := configure.PackageSet{Extra: deps.cfg.Packages, Containerd: deps.profile.KubernetesEnabled(), Kernel: deps.cfg.Kernel.Pin, Removal: deps.cfg.Removal}
+			return configure.Packages(ctx, deps.target.Chroot, deps.target.Fs, deps.distro, deps.cfg.CgroupMode, packages, configure.PackagePins{})
+		}},
+		pipeline.Func{StepName: "hardware", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Hardware(ctx, deps.target.Chroot, deps.target.Fs, deps.localFs, deps.cfg.Hardware, deps.cfg.Kernel.Pin)
+		}},
+		pipeline.Func{StepName: "serial-console", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.SerialConsole(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Kernel.Serial)
+		}},
+		pipeline.Func{StepName: "watchdog", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Watchdog(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Watchdog)
+		}},
+		pipeline.Func{StepName: "registration", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Registration(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Registration)
+		}},
+		pipeline.Func{StepName: "extra-files", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			_, err := configure.ExtraFiles(ctx, deps.target.Chroot, deps.target.Fs, deps.localFs, deps.filesDir, deps.cfg.ExtraFiles)
+			return err
+		}},
+		pipeline.Func{StepName: "kubernetes", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.InstallKubernetes(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Kubernetes, deps.cfg.CgroupMode, deps.downloadCacheDir)
+		}},
+		pipeline.Func{StepName: "preload-images", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.PreloadImages(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.PreloadImages)
+		}},
+		pipeline.Func{StepName: "kubelet-config", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.KubeletConfiguration(ctx, deps.target.Fs, deps.cfg.Kubelet, deps.cfg.CgroupMode)
+		}},
+		pipeline.Func{StepName: "registry-credentials", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.RegistryCredentials(ctx, deps.target.Fs, deps.cfg.RegistryCredentials)
+		}},
+		pipeline.Func{StepName: "helm", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			if deps.cfg.Helm.Version == "" {
+				return nil
+			}
+			if err := configure.InstallHelm(ctx, deps.target.Fs, deps.cfg.Helm.Version); err != nil {
+				return err
+			}
+			return configure.VendorHelmCharts(ctx, utility.ExecRunner{}, deps.target.Fs, deps.cfg.Helm.Charts)
+		}},
+		pipeline.Func{StepName: "node-exporter", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.NodeExporter(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.NodeExporter)
+		}},
+		pipeline.Func{StepName: "longhorn", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Longhorn(ctx, deps.target.Chroot, deps.target.Fs)
+		}},
+		pipeline.Func{StepName: "zram", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Zram(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Zram)
+		}},
+		pipeline.Func{StepName: "upgrades", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.UnattendedUpgrades(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Upgrades)
+		}},
+		pipeline.Func{StepName: "kubeadm", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.KubeadmBootstrap(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Kubeadm)
+		}},
+		pipeline.Func{StepName: "cloudinit", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.CloudInit(ctx, deps.target.Fs, deps.cfg.CloudInit)
+		}},
+		pipeline.Func{StepName: "ssh", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.SSHHardening(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.SSH)
+		}},
+		pipeline.Func{StepName: "firewall", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Firewall(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Firewall.ForKubeadmMode(deps.cfg.Kubeadm.Mode))
+		}},
+		pipeline.Func{StepName: "system", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.SystemSettings(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.System)
+		}},
+		pipeline.Func{StepName: "wifi", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.WiFi(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.WiFi)
+		}},
+	}
+}
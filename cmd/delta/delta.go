@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"cloud.google.com/go/storage"
+	"github.com/LadySerena/pi-image-builder/delta"
+	"github.com/LadySerena/pi-image-builder/media"
+	"github.com/LadySerena/pi-image-builder/store"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	flag "github.com/spf13/pflag"
+)
+
+// deltaFlags are the parsed command line flags.
+type deltaFlags struct {
+	source     string
+	target     string
+	sourceName string
+	targetName string
+	upload     bool
+}
+
+func main() {
+	source := flag.String("source", "", "previous raw image, the one remote sites already have")
+	target := flag.String("target", "", "new raw image to patch the previous one into")
+	sourceName := flag.String("source-name", "", "published artifact name of the previous image, defaults to the source file's name")
+	targetName := flag.String("target-name", "", "published artifact name of the new image, defaults to the target file's name")
+	upload := flag.Bool("upload", true, "upload the patch and its metadata to the image bucket")
+	logOptions := telemetry.LogFlags(flag.CommandLine)
+	flag.Parse()
+
+	logger, logErr := logOptions.NewLogger(os.Stderr)
+	if logErr != nil {
+		fmt.Fprintln(os.Stderr, logErr)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	flags := deltaFlags{
+		source:     *source,
+		target:     *target,
+		sourceName: *sourceName,
+		targetName: *targetName,
+		upload:     *upload,
+	}
+
+	if err := run(context.Background(), flags); err != nil {
+		logger.Error("delta failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, flags deltaFlags) error {
+	if flags.source == "" || flags.target == "" {
+		return errors.New("you must specify both a source and a target raw image")
+	}
+	if media.IsQcow2(flags.source) || media.IsQcow2(flags.target) {
+		return errors.New("deltas are made between raw images, not qcow2")
+	}
+	if flags.sourceName == "" {
+		flags.sourceName = filepath.Base(flags.source)
+	}
+	if flags.targetName == "" {
+		flags.targetName = filepath.Base(flags.target)
+	}
+
+	localFs := afero.NewOsFs()
+
+	metadata, createErr := delta.Create(ctx, localFs, flags.source, flags.sourceName, flags.target, flags.targetName)
+	if createErr != nil {
+		return createErr
+	}
+	if info, statErr := localFs.Stat(metadata.Patch); statErr == nil {
+		slog.Info("created delta", "patch", metadata.Patch, "patch_bytes", info.Size(), "target_bytes", metadata.Target.Size)
+	}
+
+	if !flags.upload {
+		return nil
+	}
+
+	gcsClient, gcsErr := storage.NewClient(ctx)
+	if gcsErr != nil {
+		return fmt.Errorf("error creating cloud storage client: %w", gcsErr)
+	}
+	defer gcsClient.Close()
+	objects := store.NewGCS(gcsClient, utility.BucketName)
+
+	for _, name := range []string{metadata.Patch, delta.MetadataName(metadata.Patch)} {
+		if err := media.UploadImage(ctx, localFs, name, objects, nil); err != nil {
+			return fmt.Errorf("error uploading %s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/LadySerena/pi-image-builder/imagediff"
+	"github.com/LadySerena/pi-image-builder/media"
+	"github.com/LadySerena/pi-image-builder/store"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	flag "github.com/spf13/pflag"
+)
+
+// diffFlags are the parsed command line flags.
+type diffFlags struct {
+	old         string
+	new         string
+	dirs        []string
+	json        bool
+	workDir     string
+	keepWorkdir bool
+}
+
+func main() {
+	old := flag.String("old", "", "known good image, a local .img or .img.zstd artifact or a gs://bucket/name uri")
+	updated := flag.String("new", "", "image to compare against the known good one, a local artifact or a gs:// uri")
+	dirs := flag.StringSlice("dir", imagediff.DefaultDirs, "directories in the images compared file by file, repeat or comma separate for several")
+	asJSON := flag.Bool("json", false, "print the differences as json for tooling instead of text")
+	workDir := flag.String("work-dir", "", "directory for downloads, decompressed images, and mount points, defaults to a new timestamped directory under "+media.WorkspaceRoot)
+	keepWorkdir := flag.Bool("keep-workdir", false, "keep the work dir afterwards instead of removing it")
+	logOptions := telemetry.LogFlags(flag.CommandLine)
+	flag.Parse()
+
+	logger, logErr := logOptions.NewLogger(os.Stderr)
+	if logErr != nil {
+		fmt.Fprintln(os.Stderr, logErr)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	flags := diffFlags{
+		old:         *old,
+		new:         *updated,
+		dirs:        *dirs,
+		json:        *asJSON,
+		workDir:     *workDir,
+		keepWorkdir: *keepWorkdir,
+	}
+
+	// an interrupt stops the diff, both images are still unmounted and detached on the way out
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, flags); err != nil {
+		logger.Error("diff failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, flags diffFlags) (err error) {
+	if flags.old == "" || flags.new == "" {
+		return errors.New("you must specify both an old and a new image")
+	}
+	if err := utility.CheckHostDependencies(utility.DiffCommands); err != nil {
+		return err
+	}
+
+	localFs := afero.NewOsFs()
+	workspace := media.Workspace{Dir: flags.workDir}
+	if flags.workDir == "" {
+		workspace = media.NewWorkspace(time.Now())
+	}
+	if err := workspace.Create(); err != nil {
+		return err
+	}
+	defer func() {
+		if flags.keepWorkdir || err != nil {
+			return
+		}
+		if removeErr := workspace.Remove(); removeErr != nil {
+			slog.Warn("could not remove work dir", "work_dir", workspace.Dir, "error", removeErr)
+		}
+	}()
+
+	oldContents, oldErr := readImage(ctx, localFs, media.Workspace{Dir: workspace.Path("old")}, flags.old, flags.dirs)
+	if oldErr != nil {
+		return fmt.Errorf("could not read %s: %w", flags.old, oldErr)
+	}
+	newContents, newErr := readImage(ctx, localFs, media.Workspace{Dir: workspace.Path("new")}, flags.new, flags.dirs)
+	if newErr != nil {
+		return fmt.Errorf("could not read %s: %w", flags.new, newErr)
+	}
+
+	report := imagediff.Compare(oldContents, newContents)
+	if flags.json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	return report.WriteText(os.Stdout)
+}
+
+// readImage fetches artifact into workspace, mounts it read only, and reads what's compared. The image is always
+// unmounted and detached again, even when reading it failed or the diff was interrupted.
+func readImage(ctx context.Context, localFs afero.Fs, workspace media.Workspace, artifact string, dirs []string) (_ imagediff.Contents, err error) {
+	if err := workspace.Create(); err != nil {
+		return imagediff.Contents{}, err
+	}
+	imageFile, fetchErr := media.FetchArtifact(ctx, localFs, workspace, artifact, openBucket)
+	if fetchErr != nil {
+		return imagediff.Contents{}, fetchErr
+	}
+
+	image, mountErr := media.MountReadOnly(ctx, localFs, workspace, imageFile)
+	if mountErr != nil {
+		return imagediff.Contents{}, mountErr
+	}
+	defer func() {
+		err = errors.Join(err, image.Close(ctx, localFs))
+	}()
+
+	return imagediff.Read(image.Root(localFs), dirs)
+}
+
+// openBucket opens a bucket named in an artifact uri with the default credentials.
+func openBucket(ctx context.Context, bucket string) (store.ObjectStore, error) {
+	gcsClient, gcsErr := storage.NewClient(ctx)
+	if gcsErr != nil {
+		return nil, fmt.Errorf("error creating cloud storage client: %w", gcsErr)
+	}
+	return store.NewGCS(gcsClient, bucket), nil
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"github.com/LadySerena/pi-image-builder/delta"
+	"github.com/LadySerena/pi-image-builder/media"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+// objectOpener reads files from the workspace when they're already there and from the image bucket otherwise.
+type objectOpener struct {
+	fs        afero.Fs
+	workspace media.Workspace
+	client    *storage.Client
+}
+
+func (o *objectOpener) open(ctx context.Context, name string) (io.ReadCloser, error) {
+	local := o.workspace.Path(name)
+	if exists, _ := afero.Exists(o.fs, local); exists {
+		return o.fs.Open(local)
+	}
+	if o.client == nil {
+		client, gcsErr := storage.NewClient(ctx)
+		if gcsErr != nil {
+			return nil, fmt.Errorf("error creating cloud storage client: %w", gcsErr)
+		}
+		o.client = client
+	}
+	reader, readerErr := o.client.Bucket(utility.BucketName).Object(name).NewReader(ctx)
+	if readerErr != nil {
+		return nil, fmt.Errorf("error creating reader for %s: %w", name, readerErr)
+	}
+	telemetry.AddBytesDownloaded(ctx, reader.Attrs.Size)
+	return struct {
+		io.Reader
+		io.Closer
+	}{utility.NewProgressReader(ctx, reader, "download "+name, reader.Attrs.Size), reader}, nil
+}
+
+// applyDelta rebuilds imageName as the decompressed image from base and the delta described by metadataName. Any
+// error means the full image has to be downloaded instead.
+func applyDelta(ctx context.Context, localFs afero.Fs, workspace media.Workspace, metadataName string, base string, imageName string) error {
+	opener := &objectOpener{fs: localFs, workspace: workspace}
+
+	encoded, openErr := opener.open(ctx, metadataName)
+	if openErr != nil {
+		return openErr
+	}
+	defer utility.WrappedClose(encoded)
+	metadata, metadataErr := delta.ReadMetadata(encoded)
+	if metadataErr != nil {
+		return metadataErr
+	}
+	if metadata.Target.Name != imageName {
+		return fmt.Errorf("delta builds %s, not %s", metadata.Target.Name, imageName)
+	}
+
+	patch, patchErr := opener.open(ctx, metadata.Patch)
+	if patchErr != nil {
+		return patchErr
+	}
+	defer utility.WrappedClose(patch)
+
+	return delta.Reconstruct(ctx, localFs, metadata, base, patch, workspace.Path(decompressedImageFileName))
+}
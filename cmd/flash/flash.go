@@ -18,128 +18,443 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/LadySerena/pi-image-builder/config"
 	"github.com/LadySerena/pi-image-builder/media"
 	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/LadySerena/pi-image-builder/telemetry"
 	"github.com/LadySerena/pi-image-builder/utility"
 	"github.com/klauspost/compress/zstd"
 	"github.com/spf13/afero"
 	flag "github.com/spf13/pflag"
 )
 
+// cleanupTimeout bounds unmounting a card and detaching the image, it runs on a context of its own so an interrupted
+// flash still tears them down.
+const cleanupTimeout = 5 * time.Minute
+
+// flashOptions are the settings shared by every device in a batch.
+type flashOptions struct {
+	cfg        config.Config
+	table      partition.TableType
+	force      bool
+	yes        bool
+	luksKeyDir string
+	image      media.Entry
+	workspace  media.Workspace
+}
+
+// flashDevice partitions, formats, and copies the mounted image onto one device. The media is unmounted and its
+// volume group deactivated before returning, whether or not the flash worked, so the next card can use the same names.
+func flashDevice(ctx context.Context, runner utility.Runner, fileSystem afero.Fs, opts flashOptions, device string, injection media.Injection) (err error) {
+	volumes := media.VolumeMounts(opts.cfg.Mounts, opts.cfg.VolumeLayout)
+	cryptNames := make([]string, 0)
+	for _, volume := range opts.cfg.VolumeLayout.Encrypted() {
+		cryptNames = append(cryptNames, utility.CryptName(volume.Name))
+	}
+	// keys are generated per card, keep each card's copy apart
+	keyDir := filepath.Join(opts.luksKeyDir, filepath.Base(device))
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while flashing: %v", r)
+		}
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+		defer cancel()
+		cleanup := media.MediaCleanup{Device: device, Volumes: volumes, CryptNames: cryptNames}
+		if cleanupErr := media.CleanupMedia(cleanupCtx, runner, opts.workspace, cleanup); cleanupErr != nil && err == nil {
+			err = fmt.Errorf("could not clean up media: %w", cleanupErr)
+		}
+
+		// the host copy of the keys is only needed until they're on the card, a failed flash mustn't leave them behind
+		if removeErr := fileSystem.RemoveAll(keyDir); removeErr != nil && err == nil {
+			err = fmt.Errorf("could not remove volume keys from the host: %w", removeErr)
+		}
+	}()
+
+	existingTable, existingErr := partition.GetPartitionTable(ctx, runner, device)
+	if existingErr != nil {
+		return fmt.Errorf("could not read partition table: %w", existingErr)
+	}
+
+	if len(existingTable.Disk.Partitions) != 0 && opts.force {
+		fmt.Printf("%s already has partitions:\n%s", device, partition.DescribeTable(existingTable))
+		if !opts.yes && !utility.ConfirmDialog("are you sure you want to wipe every partition on %s: [Y/n]: ", device) {
+			return errors.New("wipe was not confirmed")
+		}
+		// --force flashes a mounted card, vgchange and wipefs fail on busy partitions or pull them out from under a mount
+		target, inspectErr := partition.InspectDevice(ctx, runner, device)
+		if inspectErr != nil {
+			return inspectErr
+		}
+		if err := media.UnmountDevice(ctx, runner, target); err != nil {
+			return fmt.Errorf("could not unmount device before wiping it: %w", err)
+		}
+		if err := partition.WipeDevice(ctx, runner, device, existingTable); err != nil {
+			return fmt.Errorf("could not wipe device: %w", err)
+		}
+	}
+
+	if err := partition.CreateTable(ctx, runner, device, opts.table); err != nil {
+		return fmt.Errorf("could not create partitions: %w", err)
+	}
+
+	if err := partition.CreateLogicalVolumes(ctx, runner, device, opts.cfg.VolumeLayout); err != nil {
+		return fmt.Errorf("could not create logical volumes: %w", err)
+	}
+
+	if err := partition.EncryptVolumes(ctx, runner, fileSystem, opts.cfg.VolumeLayout, keyDir); err != nil {
+		return fmt.Errorf("could not encrypt logical volumes: %w", err)
+	}
+
+	if err := partition.CreateFileSystems(ctx, runner, device, opts.cfg.VolumeLayout); err != nil {
+		return fmt.Errorf("could not create filesystems: %w", err)
+	}
+
+	if err := media.MountMedia(ctx, runner, fileSystem, opts.workspace, device, volumes); err != nil {
+		return fmt.Errorf("could not mount media: %w", err)
+	}
+
+	if err := media.Flash(ctx, runner, opts.workspace, device, opts.image); err != nil {
+		return fmt.Errorf("could not rsync data from image to media: %w", err)
+	}
+
+	if err := media.FixupBoot(ctx, runner, fileSystem, opts.workspace, device, opts.cfg.Mounts, opts.cfg.VolumeLayout); err != nil {
+		return fmt.Errorf("could not point boot configuration at the new layout: %w", err)
+	}
+
+	if err := media.Inject(ctx, fileSystem, opts.workspace, injection); err != nil {
+		return fmt.Errorf("could not inject device settings: %w", err)
+	}
+
+	if err := partition.InstallKeys(fileSystem, opts.cfg.VolumeLayout, keyDir, opts.workspace.MediaRoot()); err != nil {
+		return fmt.Errorf("could not install volume keys: %w", err)
+	}
+
+	return nil
+}
+
+// flashFlags are the parsed command line flags.
+type flashFlags struct {
+	imageName       string
+	devices         []string
+	configPath      string
+	force           bool
+	tableType       string
+	allowFixed      bool
+	allowSystemDisk bool
+	maxSizeGB       uint64
+	yes             bool
+	removeImage     bool
+	delta           string
+	deltaBase       string
+	workDir         string
+	wait            bool
+	injection       media.Injection
+}
+
 func main() {
 	// todo local or gsutil path for image
 
-	decompressFlag := false
-	const decompressedImageFileName = "image-to-be-flashed.img"
-
 	imageName := flag.StringP("image", "i", "", "specify your desired image")
-	outputDevice := flag.StringP("device", "d", "", "specify which target device to flash the image")
+	outputDevices := flag.StringSliceP("device", "d", nil, "target device to flash, repeat or comma separate to flash a batch of cards")
+	configPath := flag.StringP("config", "c", "", "path to a yaml build config, defaults are used when empty")
+	force := flag.Bool("force", false, "wipe an existing partition table and volume group on the device before flashing, unmounting it first if it is mounted")
+	tableType := flag.String("table", string(partition.TableMSDOS), "partition table type, msdos or gpt (for usb and nvme boot)")
+	allowFixed := flag.Bool("allow-fixed", false, "flash a device the kernel doesn't report as removable")
+	allowSystemDisk := flag.Bool("allow-system-disk", false, "flash a device hosting this machine's root, boot, or swap")
+	maxSizeGB := flag.Uint64("max-size-gb", partition.DefaultMaxDeviceSize/1000/1000/1000, "refuse devices larger than this many gigabytes, 0 disables the check")
+	yes := flag.BoolP("yes", "y", false, "skip confirmation prompts so flashing can be scripted")
+	removeImage := flag.Bool("remove-image", false, "delete the decompressed image after a successful flash")
+	deltaName := flag.String("delta", "", "delta metadata to rebuild --image from the previous raw image instead of downloading it, falls back to the full image")
+	deltaBase := flag.String("delta-base", "", "previous raw image the delta applies to, defaults to the last image flashed from --work-dir")
+	wait := flag.Bool("wait", false, "wait for another flash of the same device to finish instead of failing")
+	workDir := flag.String("work-dir", ".", "directory holding the image and media mount points and the generated volume keys")
+	hostname := flag.String("hostname", "", "hostname written to each card, "+media.IndexPlaceholder+" is replaced with the card's position starting at 1")
+	kubeadmToken := flag.String("kubeadm-token", "", "kubeadm bootstrap token written to each card's boot partition, may use "+media.IndexPlaceholder)
+	registrationToken := flag.String("registration-token", "", "bearer token the node registers with on first boot, written to each card's boot partition, may use "+media.IndexPlaceholder)
+	nodeConfig := flag.String("node-config", "", "cloud-init seed written to each card's boot partition, may use "+media.IndexPlaceholder+" to pick a file per card")
+	logOptions := telemetry.LogFlags(flag.CommandLine)
+	flag.BoolVar(&media.LazyUnmount, "lazy-unmount", media.LazyUnmount, "lazily unmount the media if it's still busy after retrying, instead of failing cleanup")
+	flag.DurationVar(&utility.ProgressInterval, "progress-interval", utility.ProgressInterval, "how often downloads and decompression report progress")
 
 	flag.Parse()
 
-	if *imageName == "" {
-		panic("you must specify a valid disk image")
+	logger, logErr := logOptions.NewLogger(os.Stderr)
+	if logErr != nil {
+		fmt.Fprintln(os.Stderr, logErr)
+		os.Exit(2)
 	}
+	slog.SetDefault(logger)
 
-	if *outputDevice == "" || !strings.Contains(*outputDevice, "/dev") {
-		panic("you must specify a valid block device")
+	flags := flashFlags{
+		imageName:       *imageName,
+		devices:         *outputDevices,
+		configPath:      *configPath,
+		force:           *force,
+		tableType:       *tableType,
+		allowFixed:      *allowFixed,
+		allowSystemDisk: *allowSystemDisk,
+		maxSizeGB:       *maxSizeGB,
+		yes:             *yes,
+		removeImage:     *removeImage,
+		delta:           *deltaName,
+		deltaBase:       *deltaBase,
+		workDir:         *workDir,
+		wait:            *wait,
+		injection:       media.Injection{Hostname: *hostname, KubeadmToken: *kubeadmToken, RegistrationToken: *registrationToken, NodeConfig: *nodeConfig},
 	}
 
-	answer := utility.ConfirmDialog("are you sure you want to flash the image to %s: [Y/n]: ", *outputDevice)
-	if !answer {
-		fmt.Println("nope")
-		return
+	// an interrupt stops between commands, the card is still unmounted and the loop device detached on the way out
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, flags); err != nil {
+		logger.Error("flash failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// decompressedImageFileName is the raw image flashed to each card, it's kept in the workspace between runs so the next
+// image can be patched from it.
+const decompressedImageFileName = "image-to-be-flashed.img"
+
+func run(ctx context.Context, flags flashFlags) (err error) {
+	if flags.imageName == "" {
+		return errors.New("you must specify a valid disk image")
+	}
+	if media.IsQcow2(flags.imageName) {
+		return fmt.Errorf("%s is a qcow2 image for booting in a vm, flash the raw .img.zstd artifact from the same build instead", flags.imageName)
 	}
 
-	ctx := context.TODO()
+	if len(flags.devices) == 0 {
+		return errors.New("you must specify a valid block device")
+	}
+	seen := map[string]bool{}
+	for _, device := range flags.devices {
+		if !strings.Contains(device, "/dev") || seen[device] {
+			return fmt.Errorf("you must specify each block device once, got: %q", device)
+		}
+		seen[device] = true
+	}
+
+	if err := utility.CheckHostDependencies(utility.FlashCommands); err != nil {
+		return err
+	}
 
 	localFs := afero.NewOsFs()
-	downloadExists, statErr := afero.Exists(localFs, *imageName)
+
+	if err := flags.injection.Validate(localFs, len(flags.devices)); err != nil {
+		return err
+	}
+
+	runner := utility.ExecRunner{}
+	workspace := media.Workspace{Dir: flags.workDir}
+	if err := workspace.Create(); err != nil {
+		return err
+	}
+	workingImage := workspace.Path(decompressedImageFileName)
+	deltaBase := flags.deltaBase
+	if deltaBase == "" {
+		deltaBase = workingImage
+	}
+
+	// two flashes writing the same card would interleave their partitioning and copies
+	for _, device := range flags.devices {
+		lock, lockErr := utility.AcquireLock(ctx, utility.DeviceLockPath(device), flags.wait)
+		if lockErr != nil {
+			return fmt.Errorf("could not lock %s for flashing: %w", device, lockErr)
+		}
+		defer func(device string) {
+			if releaseErr := lock.Release(); releaseErr != nil {
+				slog.Warn("could not release device lock", "device", device, "error", releaseErr)
+			}
+		}(device)
+	}
+
+	policy := partition.SafetyPolicy{
+		AllowFixed:      flags.allowFixed,
+		AllowSystemDisk: flags.allowSystemDisk,
+		AllowMounted:    flags.force,
+		MaxSize:         flags.maxSizeGB * 1000 * 1000 * 1000,
+	}
+	for _, device := range flags.devices {
+		target, inspectErr := partition.InspectDevice(ctx, runner, device)
+		if inspectErr != nil {
+			return fmt.Errorf("could not inspect target device: %w", inspectErr)
+		}
+		if err := policy.Check(target); err != nil {
+			return err
+		}
+		fmt.Print(partition.DescribeDevice(target))
+	}
+
+	if !flags.yes && !utility.ConfirmDialog("are you sure you want to flash the image to %s: [Y/n]: ", strings.Join(flags.devices, ", ")) {
+		fmt.Println("nope")
+		return nil
+	}
+
+	cfg, configErr := config.Load(localFs, flags.configPath)
+	if configErr != nil {
+		return fmt.Errorf("error loading config: %w", configErr)
+	}
+
+	patched := false
+	if flags.delta != "" {
+		if err := applyDelta(ctx, localFs, workspace, flags.delta, deltaBase, flags.imageName); err != nil {
+			slog.Warn("could not patch the previous image, downloading the full image instead", "delta", flags.delta, "error", err)
+		} else {
+			patched = true
+		}
+	}
+	if !patched {
+		if err := fetchImage(ctx, localFs, workspace, flags.imageName); err != nil {
+			return err
+		}
+	}
+
+	if err := partition.CheckFilesystemTools(cfg.VolumeLayout); err != nil {
+		return fmt.Errorf("host is not ready to flash: %w", err)
+	}
+
+	var entry media.Entry
+
+	defer func(fileSystem afero.Fs) {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while flashing: %v", r)
+		}
+		removed := ""
+		if err != nil {
+			slog.Info("cleaning up resources after failed flash")
+		} else if flags.removeImage {
+			removed = workingImage
+		}
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+		defer cancel()
+		if cleanupErr := media.CleanupImage(cleanupCtx, runner, fileSystem, workspace, entry, removed); cleanupErr != nil {
+			err = errors.Join(err, fmt.Errorf("error cleaning up resources: %w", cleanupErr))
+		}
+	}(localFs)
+
+	var loopErr error
+	entry, loopErr = media.MountImageToDevice(ctx, workingImage)
+	if loopErr != nil {
+		return fmt.Errorf("could not create loop device for image: %w", loopErr)
+	}
+
+	if err := media.AttachToMountPoint(ctx, localFs, workspace, entry, false); err != nil {
+		return fmt.Errorf("could not attach loop device: %s to mount points: %w", entry.Name, err)
+	}
+
+	// luks-keys holds freshly generated volume keys until they're copied onto the flashed root
+	opts := flashOptions{
+		cfg:        cfg,
+		table:      partition.TableType(flags.tableType),
+		force:      flags.force,
+		yes:        flags.yes,
+		luksKeyDir: workspace.Path("luks-keys"),
+		image:      entry,
+		workspace:  workspace,
+	}
+
+	// cards are flashed one at a time, they all get the same volume group name and media mount points so two can't be
+	// set up at once
+	failures := make(map[string]error)
+	for i, device := range flags.devices {
+		logger := slog.With("device", device)
+		logger.Info("flashing device", "position", i+1, "total", len(flags.devices))
+		if err := flashDevice(telemetry.WithLogger(ctx, logger), runner, localFs, opts, device, flags.injection.ForDevice(i+1)); err != nil {
+			logger.Error("could not flash device", "error", err)
+			failures[device] = err
+		}
+	}
+
+	for _, device := range flags.devices {
+		if err, failed := failures[device]; failed {
+			fmt.Printf("%s: failed: %v\n", device, err)
+		} else {
+			fmt.Printf("%s: flashed\n", device)
+		}
+	}
+
+	if len(failures) != 0 {
+		return fmt.Errorf("%d of %d devices failed to flash", len(failures), len(flags.devices))
+	}
+	return nil
+}
+
+// fetchImage downloads imageName into the workspace unless it's already there and decompresses it for flashing.
+func fetchImage(ctx context.Context, localFs afero.Fs, workspace media.Workspace, imageName string) (err error) {
+	decompressFlag := false
+	downloaded := workspace.Path(imageName)
+	decompressed := workspace.Path(decompressedImageFileName)
+
+	downloadExists, statErr := afero.Exists(localFs, downloaded)
 	if statErr != nil {
-		log.Panicf("could not verify file: %v", statErr)
+		return fmt.Errorf("could not verify file: %w", statErr)
 	}
 
 	// if image is downloaded skip downloading it
 	if !downloadExists {
 		gcsClient, gcsErr := storage.NewClient(ctx)
 		if gcsErr != nil {
-			log.Panicf("error creating cloud storage client: %v", gcsErr)
+			return fmt.Errorf("error creating cloud storage client: %w", gcsErr)
 		}
 
-		reader, readerCreateErr := gcsClient.Bucket(utility.BucketName).Object(*imageName).NewReader(ctx)
+		reader, readerCreateErr := gcsClient.Bucket(utility.BucketName).Object(imageName).NewReader(ctx)
 		if readerCreateErr != nil {
-			log.Panicf("error creating reader for image: %s error: %v", *imageName, readerCreateErr)
+			return fmt.Errorf("error creating reader for image: %s error: %w", imageName, readerCreateErr)
 		}
 		defer utility.WrappedClose(reader)
 
-		if writeErr := afero.WriteReader(localFs, *imageName, reader); writeErr != nil {
-			log.Panicf("error writing file: %v", writeErr)
+		download := utility.NewProgressReader(ctx, reader, "download "+imageName, reader.Attrs.Size)
+		if writeErr := afero.WriteReader(localFs, downloaded, download); writeErr != nil {
+			return fmt.Errorf("error writing file: %w", writeErr)
 		}
+		telemetry.AddBytesDownloaded(ctx, reader.Attrs.Size)
 		decompressFlag = true
 	}
 
-	decompressExists, decompressStatErr := afero.Exists(localFs, decompressedImageFileName)
+	decompressExists, decompressStatErr := afero.Exists(localFs, decompressed)
 	if decompressStatErr != nil {
-		log.Panic(decompressStatErr)
+		return decompressStatErr
 	}
 
 	// if image is decompressed then skip it unless we just decompressed a new image
 	if !decompressExists || decompressFlag {
-		image, openErr := localFs.Open(*imageName)
+		image, openErr := localFs.Open(downloaded)
 		if openErr != nil {
-			log.Panicf("could not open image file: %v", openErr)
+			return fmt.Errorf("could not open image file: %w", openErr)
 		}
 		defer utility.WrappedClose(image)
 		decompress, decompressErr := zstd.NewReader(image)
 		if decompressErr != nil {
-			log.Panicf("could not decompress image: %v", decompressErr)
+			return fmt.Errorf("could not decompress image: %w", decompressErr)
 		}
 		defer decompress.Close()
 
-		decompressedOutput, outputErr := localFs.Create(decompressedImageFileName)
+		decompressedOutput, outputErr := localFs.Create(decompressed)
 		if outputErr != nil {
-			log.Panicf("could not open file handle for decompressed file: %v", outputErr)
+			return fmt.Errorf("could not open file handle for decompressed file: %w", outputErr)
 		}
-		defer utility.WrappedClose(decompressedOutput)
+		defer utility.CloseWithErr(decompressedOutput, &err)
 
-		if _, err := decompress.WriteTo(decompressedOutput); err != nil {
-			log.Panicf("error during image decompression: %v", err)
+		// the decompressed size isn't known up front, progress only reports bytes written
+		output := utility.NewProgressWriter(ctx, decompressedOutput, "decompress "+imageName, 0)
+		if _, err := decompress.WriteTo(output); err != nil {
+			return fmt.Errorf("error during image decompression: %w", err)
 		}
+		output.Finish()
 	}
-
-	if err := partition.CreateTable(*outputDevice); err != nil {
-		log.Panicf("could not create partitions: %v", err)
-	}
-
-	if err := partition.CreateLogicalVolumes(*outputDevice); err != nil {
-		log.Panicf("could not create logical volumes: %v", err)
-	}
-
-	if err := partition.CreateFileSystems(*outputDevice); err != nil {
-		log.Panicf("could not create filesystems: %v", err)
-	}
-
-	entry, loopErr := media.MountImageToDevice(ctx, decompressedImageFileName)
-	if loopErr != nil {
-		log.Panicf("could not create loop device for image: %v", loopErr)
-	}
-
-	if err := media.AttachToMountPoint(ctx, localFs, entry, false); err != nil {
-		log.Panicf("could not attach loop device: %s to mount points: %v", entry.Name, err)
-	}
-
-	if err := media.MountMedia(ctx, localFs, *outputDevice); err != nil {
-		log.Panicf("could not mount media: %v", err)
-	}
-
-	if err := media.Flash(ctx, *outputDevice, entry); err != nil {
-		log.Panicf("could not rsync data from image to media: %v", err)
-	}
-
-	// todo add cleanup code
+	return nil
 }
@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/config"
+	"github.com/LadySerena/pi-image-builder/media"
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlashDeviceRemovesKeysOnFailure(t *testing.T) {
+	fileSystem := afero.NewMemMapFs()
+	keyDir := filepath.Join("/work/luks-keys", "sdz")
+	assert.NoError(t, afero.WriteFile(fileSystem, filepath.Join(keyDir, "csilv.key"), make([]byte, 512), 0400))
+
+	// formatting fails after the volumes were encrypted, so the keys never make it onto the card
+	vgs := strings.Join(partition.LVMCommand("/dev/sdz", "vgs", utility.VolumeGroupName, "--reportformat", "json", "--units", "B").Args, " ")
+	runner := &utility.FakeRunner{
+		Outputs: map[string][]byte{
+			"parted -j /dev/sdz unit MiB print": []byte(`{"disk": {"path": "/dev/sdz"}}`),
+			vgs:                                 []byte(`{"report": [{"vg": [{"vg_name": "rootvg", "vg_free": "64000000000B"}]}]}`),
+		},
+		Errors: map[string]error{"mkfs.vfat -F 32 -n system-boot /dev/sdz1": errors.New("device busy")},
+	}
+	opts := flashOptions{cfg: config.Default(), table: partition.TableMSDOS, luksKeyDir: "/work/luks-keys", workspace: media.Workspace{Dir: "/work"}}
+	err := flashDevice(context.Background(), runner, fileSystem, opts, "/dev/sdz", media.Injection{})
+	assert.ErrorContains(t, err, "could not create filesystems")
+
+	exists, existsErr := afero.DirExists(fileSystem, keyDir)
+	assert.NoError(t, existsErr)
+	assert.False(t, exists)
+}
+
+func TestFlashDeviceUnmountsBeforeWiping(t *testing.T) {
+	lsblk := "lsblk --json --bytes --output NAME,MODEL,RM,SIZE,MOUNTPOINT,TYPE,TRAN /dev/sdz"
+	runner := &utility.FakeRunner{
+		Outputs: map[string][]byte{
+			"parted -j /dev/sdz unit MiB print": []byte(`{"disk": {"path": "/dev/sdz", "partitions": [{"number": 1, "filesystem": "fat32"}]}}`),
+			lsblk:                               []byte(`{"blockdevices": [{"name": "sdz", "type": "disk", "children": [{"name": "sdz1", "mountpoint": "/media/kat/system-boot"}]}]}`),
+		},
+		// stop once the wipe is done
+		Errors: map[string]error{"parted -s /dev/sdz mktable msdos": errors.New("stop")},
+	}
+	opts := flashOptions{cfg: config.Default(), table: partition.TableMSDOS, force: true, yes: true, luksKeyDir: "/work/luks-keys", workspace: media.Workspace{Dir: "/work"}}
+	err := flashDevice(context.Background(), runner, afero.NewMemMapFs(), opts, "/dev/sdz", media.Injection{})
+	assert.ErrorContains(t, err, "could not create partitions")
+
+	unmounted, wiped := -1, -1
+	for i, command := range runner.Commands {
+		switch command {
+		case "umount /media/kat/system-boot":
+			unmounted = i
+		case "wipefs -a /dev/sdz1":
+			wiped = i
+		}
+	}
+	assert.NotEqual(t, -1, unmounted)
+	assert.Less(t, unmounted, wiped)
+}
+
+func TestFetchImageUsesWorkspace(t *testing.T) {
+	fileSystem := afero.NewMemMapFs()
+	workspace := media.Workspace{Dir: "/var/tmp/pi-image-builder/flash-1"}
+	var compressed bytes.Buffer
+	encoder, encoderErr := zstd.NewWriter(&compressed)
+	assert.NoError(t, encoderErr)
+	_, writeErr := encoder.Write([]byte("raw image"))
+	assert.NoError(t, writeErr)
+	assert.NoError(t, encoder.Close())
+	assert.NoError(t, afero.WriteFile(fileSystem, workspace.Path("ubuntu-arm64.img.zstd"), compressed.Bytes(), 0644))
+
+	// the compressed image is already in the workspace, so nothing is downloaded
+	assert.NoError(t, fetchImage(context.Background(), fileSystem, workspace, "ubuntu-arm64.img.zstd"))
+	raw, readErr := afero.ReadFile(fileSystem, workspace.Path(decompressedImageFileName))
+	assert.NoError(t, readErr)
+	assert.Equal(t, "raw image", string(raw))
+
+	inWorkingDirectory, _ := afero.Exists(fileSystem, decompressedImageFileName)
+	assert.False(t, inWorkingDirectory)
+}
+
+// contextRunner records the commands that were handed a context that's already done.
+type contextRunner struct {
+	utility.FakeRunner
+	done []string
+}
+
+func (c *contextRunner) Run(ctx context.Context, cmd *exec.Cmd) error {
+	if ctx.Err() != nil {
+		c.done = append(c.done, strings.Join(cmd.Args, " "))
+	}
+	return c.FakeRunner.Run(ctx, cmd)
+}
+
+func TestFlashDeviceCleansUpAfterInterrupt(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	runner := &contextRunner{}
+	opts := flashOptions{cfg: config.Default(), table: partition.TableMSDOS, luksKeyDir: "/work/luks-keys", workspace: media.Workspace{Dir: "/work"}}
+	assert.Error(t, flashDevice(ctx, runner, afero.NewMemMapFs(), opts, "/dev/sdz", media.Injection{}))
+
+	assert.Contains(t, runner.Commands, "umount /work/media-mnt")
+	assert.Empty(t, runner.done)
+}
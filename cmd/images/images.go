@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/LadySerena/pi-image-builder/retention"
+	"github.com/LadySerena/pi-image-builder/store"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/c2h5oh/datasize"
+	flag "github.com/spf13/pflag"
+)
+
+const usage = "usage: images list|prune [flags]"
+
+// imagesFlags are the parsed command line flags.
+type imagesFlags struct {
+	command   string
+	prefix    string
+	keep      int
+	olderThan string
+	yes       bool
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	command := os.Args[1]
+	flags := flag.NewFlagSet("images "+command, flag.ExitOnError)
+	prefix := flags.String("prefix", "", "only look at images whose name starts with this, e.g. ubuntu-22.04")
+	keep := flags.Int("keep", 0, "prune: how many of the newest builds of each distro to keep")
+	olderThan := flags.String("older-than", "", "prune: only prune builds older than this, e.g. 90d or 72h")
+	yes := flags.BoolP("yes", "y", false, "prune: skip the confirmation prompt")
+	logOptions := telemetry.LogFlags(flags)
+	_ = flags.Parse(os.Args[2:])
+
+	logger, logErr := logOptions.NewLogger(os.Stderr)
+	if logErr != nil {
+		fmt.Fprintln(os.Stderr, logErr)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	opts := imagesFlags{command: command, prefix: *prefix, keep: *keep, olderThan: *olderThan, yes: *yes}
+	if err := run(context.Background(), opts); err != nil {
+		logger.Error("images failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, opts imagesFlags) error {
+	if opts.command != "list" && opts.command != "prune" {
+		return errors.New(usage)
+	}
+
+	gcsClient, gcsErr := storage.NewClient(ctx)
+	if gcsErr != nil {
+		return fmt.Errorf("error creating cloud storage client: %w", gcsErr)
+	}
+	defer gcsClient.Close()
+	objects := store.NewGCS(gcsClient, utility.BucketName)
+
+	builds, listErr := retention.List(ctx, objects, opts.prefix)
+	if listErr != nil {
+		return listErr
+	}
+
+	if opts.command == "list" {
+		return printBuilds(os.Stdout, builds)
+	}
+
+	policy := retention.Policy{Keep: opts.keep, Now: time.Now()}
+	if opts.olderThan != "" {
+		age, ageErr := retention.ParseAge(opts.olderThan)
+		if ageErr != nil {
+			return ageErr
+		}
+		policy.OlderThan = age
+	}
+	pruned, planErr := retention.Plan(builds, policy)
+	if planErr != nil {
+		return planErr
+	}
+	if len(pruned) == 0 {
+		fmt.Println("nothing to prune")
+		return nil
+	}
+
+	if err := printBuilds(os.Stdout, pruned); err != nil {
+		return err
+	}
+	if !opts.yes && !utility.ConfirmDialog("are you sure you want to delete these %d builds and everything published with them: [Y/n]: ", len(pruned)) {
+		fmt.Println("nope")
+		return nil
+	}
+	return retention.Prune(ctx, objects, pruned)
+}
+
+func printBuilds(w io.Writer, builds []retention.Build) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "BUILD\tBUILT\tKUBERNETES\tSIZE\tOBJECTS\tSTATUS")
+	for _, build := range builds {
+		kubernetes, status := "unknown", "incomplete"
+		if build.Manifest != nil && build.Manifest.Kubernetes != "" {
+			kubernetes = build.Manifest.Kubernetes
+		}
+		if build.Successful() {
+			status = "ok"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%d\t%s\n", build.Stem, build.Created.Format(time.RFC3339), kubernetes,
+			datasize.ByteSize(build.Size()).HR(), len(build.Objects), status)
+	}
+	return table.Flush()
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/LadySerena/pi-image-builder/inspect"
+	"github.com/LadySerena/pi-image-builder/manifest"
+	"github.com/LadySerena/pi-image-builder/media"
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/LadySerena/pi-image-builder/store"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	flag "github.com/spf13/pflag"
+)
+
+// inspectFlags are the parsed command line flags.
+type inspectFlags struct {
+	image       string
+	cat         string
+	ls          string
+	workDir     string
+	keepWorkdir bool
+}
+
+func main() {
+	cat := flag.String("cat", "", "print this file from the image and exit instead of waiting with the image mounted")
+	ls := flag.String("ls", "", "list this directory in the image and exit instead of waiting with the image mounted")
+	workDir := flag.String("work-dir", "", "directory for downloads, decompressed images, and mount points, defaults to a new timestamped directory under "+media.WorkspaceRoot)
+	keepWorkdir := flag.Bool("keep-workdir", false, "keep the work dir afterwards instead of removing it")
+	logOptions := telemetry.LogFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] <image>\n\nimage is a local .img or .img.zstd artifact or a gs://bucket/name uri\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	logger, logErr := logOptions.NewLogger(os.Stderr)
+	if logErr != nil {
+		fmt.Fprintln(os.Stderr, logErr)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	flags := inspectFlags{
+		image:       flag.Arg(0),
+		cat:         *cat,
+		ls:          *ls,
+		workDir:     *workDir,
+		keepWorkdir: *keepWorkdir,
+	}
+
+	// signals are caught until run returns, so ctrl-c while the image is mounted, even more than once, only stops
+	// waiting and the image is still unmounted and detached on the way out
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, flags); err != nil {
+		logger.Error("inspect failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, flags inspectFlags) (err error) {
+	if flags.cat != "" && flags.ls != "" {
+		return errors.New("--cat and --ls can't be used together")
+	}
+	if err := utility.CheckHostDependencies(utility.InspectCommands); err != nil {
+		return err
+	}
+
+	localFs := afero.NewOsFs()
+	workspace := media.Workspace{Dir: flags.workDir}
+	if flags.workDir == "" {
+		workspace = media.NewWorkspace(time.Now())
+	}
+	if err := workspace.Create(); err != nil {
+		return err
+	}
+	defer func() {
+		if flags.keepWorkdir || err != nil {
+			return
+		}
+		if removeErr := workspace.Remove(); removeErr != nil {
+			slog.Warn("could not remove work dir", "work_dir", workspace.Dir, "error", removeErr)
+		}
+	}()
+
+	imageFile, fetchErr := media.FetchArtifact(ctx, localFs, workspace, flags.image, openBucket)
+	if fetchErr != nil {
+		return fetchErr
+	}
+	image, mountErr := media.MountReadOnly(ctx, localFs, workspace, imageFile)
+	if mountErr != nil {
+		return mountErr
+	}
+	defer func() {
+		err = errors.Join(err, image.Close(ctx, localFs))
+	}()
+	root := image.Root(localFs)
+
+	switch {
+	case flags.cat != "":
+		return inspect.Cat(root, flags.cat, os.Stdout)
+	case flags.ls != "":
+		return inspect.List(root, flags.ls, os.Stdout)
+	}
+
+	summary, readErr := inspect.Read(root, inspect.DefaultComponents)
+	if readErr != nil {
+		return readErr
+	}
+	summary.Manifest = readManifest(ctx, localFs, workspace, flags.image)
+	device, inspectErr := partition.InspectDevice(ctx, utility.ExecRunner{}, image.Device.Name)
+	if inspectErr != nil {
+		slog.Warn("could not read the image's layout", "error", inspectErr)
+	} else {
+		summary.Layout = partition.DescribeLayout(device)
+	}
+	if err := summary.Write(os.Stdout); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nmounted at %s, press enter to clean up\n", workspace.RootMount())
+	waitForEnter(ctx)
+	return nil
+}
+
+// waitForEnter returns once a line is read from stdin, stdin is closed, or ctx is cancelled by an interrupt.
+func waitForEnter(ctx context.Context) {
+	entered := make(chan struct{})
+	go func() {
+		_, _ = bufio.NewReader(os.Stdin).ReadString('\n')
+		close(entered)
+	}()
+	select {
+	case <-entered:
+	case <-ctx.Done():
+		fmt.Println()
+	}
+}
+
+// readManifest reads the manifest published next to artifact. Only the first artifact of a build has one and older
+// builds have none, so a missing manifest is left out of the summary rather than failing.
+func readManifest(ctx context.Context, localFs afero.Fs, workspace media.Workspace, artifact string) *manifest.Manifest {
+	name := manifest.FileName(artifact)
+	if bucket, object, remote := media.ParseBucketURI(artifact); remote {
+		name = workspace.Path(path.Base(manifest.FileName(object)))
+		uri := fmt.Sprintf("%s%s/%s", media.BucketScheme, bucket, manifest.FileName(object))
+		if err := media.FetchObject(ctx, localFs, uri, name, openBucket); err != nil {
+			slog.Debug("no manifest for image", "manifest", uri, "error", err)
+			return nil
+		}
+	}
+
+	file, openErr := localFs.Open(name)
+	if openErr != nil {
+		slog.Debug("no manifest for image", "manifest", name, "error", openErr)
+		return nil
+	}
+	defer utility.WrappedClose(file)
+	read, readErr := manifest.Read(file)
+	if readErr != nil {
+		slog.Warn("could not read manifest", "manifest", name, "error", readErr)
+		return nil
+	}
+	return read
+}
+
+// openBucket opens a bucket named in an artifact uri with the default credentials.
+func openBucket(ctx context.Context, bucket string) (store.ObjectStore, error) {
+	gcsClient, gcsErr := storage.NewClient(ctx)
+	if gcsErr != nil {
+		return nil, fmt.Errorf("error creating cloud storage client: %w", gcsErr)
+	}
+	return store.NewGCS(gcsClient, bucket), nil
+}
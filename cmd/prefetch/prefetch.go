@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/LadySerena/pi-image-builder/config"
+	"github.com/LadySerena/pi-image-builder/distro"
+	"github.com/LadySerena/pi-image-builder/media"
+	"github.com/LadySerena/pi-image-builder/offline"
+	"github.com/LadySerena/pi-image-builder/preflight"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	flag "github.com/spf13/pflag"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// prefetchFlags are the parsed command line flags.
+type prefetchFlags struct {
+	configPath  string
+	artifactDir string
+	debPool     string
+}
+
+func main() {
+	configPath := flag.StringP("config", "c", "", "path to the yaml build config the offline build will use, defaults are used when empty")
+	artifactDir := flag.String("artifact-dir", "", "directory to populate, pass it to setup's --artifact-dir on the offline machine")
+	debPool := flag.String("deb-pool", "", "flat apt repository to copy into the artifact directory, e.g. apt-get download output for every package the image installs")
+	flag.DurationVar(&media.DownloadTimeout, "download-timeout", 0, "give up on a stalled download after this long, 0 waits as long as the http client allows")
+	logOptions := telemetry.LogFlags(flag.CommandLine)
+	flag.Parse()
+
+	logger, logErr := logOptions.NewLogger(os.Stderr)
+	if logErr != nil {
+		fmt.Fprintln(os.Stderr, logErr)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	flags := prefetchFlags{configPath: *configPath, artifactDir: *artifactDir, debPool: *debPool}
+	if err := run(context.Background(), flags); err != nil {
+		logger.Error("prefetch failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, flags prefetchFlags) error {
+	if flags.artifactDir == "" {
+		return errors.New("you must specify an artifact directory to populate")
+	}
+
+	localFs := afero.NewOsFs()
+
+	cfg, configErr := config.Load(localFs, flags.configPath)
+	if configErr != nil {
+		return fmt.Errorf("error loading config: %w", configErr)
+	}
+	baseImage, distroErr := distro.Lookup(cfg.Distro)
+	if distroErr != nil {
+		return fmt.Errorf("error loading config: %w", distroErr)
+	}
+
+	client, clientErr := utility.NewHTTPClient(cfg.HTTP)
+	if clientErr != nil {
+		return fmt.Errorf("error loading config: %w", clientErr)
+	}
+	otelhttp.DefaultClient = client
+
+	source, sourceErr := media.NewSource(cfg.Source, baseImage, media.Workspace{}, nil, nil, cfg.HTTP.Proxies())
+	if sourceErr != nil {
+		return fmt.Errorf("error loading config: %w", sourceErr)
+	}
+	if err := offline.Supported(cfg, source); err != nil {
+		return err
+	}
+
+	// the offline build resolves a stable-x.y marker from the copy taken here, so it installs the same release
+	var urls []string
+	if marker := cfg.Kubernetes.MarkerURL(); marker != "" {
+		urls = append(urls, marker)
+	}
+	versions, versionErr := cfg.Kubernetes.Resolve(ctx)
+	if versionErr != nil {
+		return fmt.Errorf("error picking kubernetes versions: %w", versionErr)
+	}
+	cfg.Kubernetes = versions
+	urls = append(urls, preflight.ConfigURLs(cfg, source, baseImage)...)
+
+	if err := offline.Prefetch(ctx, localFs, flags.artifactDir, urls, flags.debPool, utility.ExecRunner{}); err != nil {
+		return err
+	}
+	slog.Info("artifact directory is ready", "dir", flags.artifactDir, "artifacts", len(urls))
+	return nil
+}
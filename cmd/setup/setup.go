@@ -18,13 +18,34 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/LadySerena/pi-image-builder/cache"
+	"github.com/LadySerena/pi-image-builder/config"
 	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/distro"
+	"github.com/LadySerena/pi-image-builder/lockfile"
+	"github.com/LadySerena/pi-image-builder/manifest"
 	"github.com/LadySerena/pi-image-builder/media"
+	"github.com/LadySerena/pi-image-builder/offline"
+	"github.com/LadySerena/pi-image-builder/pipeline"
+	"github.com/LadySerena/pi-image-builder/preflight"
+	"github.com/LadySerena/pi-image-builder/report"
+	"github.com/LadySerena/pi-image-builder/store"
 	"github.com/LadySerena/pi-image-builder/telemetry"
 	"github.com/LadySerena/pi-image-builder/utility"
 	"github.com/spf13/afero"
@@ -38,29 +59,248 @@ import (
 	"google.golang.org/grpc"
 )
 
+// cleanupTimeout bounds unmounting and detaching the image after a failed build, publishTimeout bounds packaging and
+// uploading a finished one. Both run on a context of their own so an interrupted build still cleans up after itself.
+const (
+	cleanupTimeout = 5 * time.Minute
+	publishTimeout = 2 * time.Hour
+)
+
+// setupOptions are the parsed command line flags.
+type setupOptions struct {
+	enableTracing bool
+	trace         telemetry.TraceOptions
+	configPath    string
+	layerCacheDir string
+	downloadCache string
+	// artifactDir builds offline from a directory populated by prefetch, empty downloads from the network
+	artifactDir string
+	// lockfilePath is written after a successful build, and enforced instead when locked is set
+	lockfilePath string
+	// reportPath is where each build's timing report is written, whether it succeeds or fails
+	reportPath string
+	locked     bool
+	// pinManifest is a previous build's manifest whose package versions are installed instead of the latest
+	pinManifest string
+	// strictPins fails the build when a pinned package version has left the archive
+	strictPins bool
+	// kubernetes overrides the versions from the config file, empty fields keep them
+	kubernetes    configure.KubernetesVersions
+	resume        bool
+	skipPreflight bool
+	// channel overrides the config file's channel when set
+	channel string
+	// outputs overrides the config file's output formats when set
+	outputs   []media.OutputFormat
+	selection pipeline.Selection
+	// overridesDir holds files that replace the embedded ones with the same name
+	overridesDir string
+	// filesDir holds the sources of the config's extra files
+	filesDir string
+	// validateOnly checks the config and the files rendered into the image, then exits without building
+	validateOnly bool
+	// profiles are the image variants to build, empty builds the config file's or config.DefaultProfile. Several
+	// share one base image download and are published with the profile name in their file names.
+	profiles []string
+	// listProfiles prints every profile and what it includes, then exits without building
+	listProfiles bool
+	// workDir is the build's workspace, empty picks a fresh timestamped one under media.WorkspaceRoot
+	workDir string
+	// keepWorkdir leaves the workspace behind after a successful build, failed builds always keep it
+	keepWorkdir bool
+	// waitForLock blocks until another build using the same workspace finishes instead of failing
+	waitForLock bool
+	// export writes the configured root filesystem out for running it as a container, the zero value skips it
+	export media.RootfsExport
+}
+
+// validateBuild catches config and template mistakes before anything is downloaded or mounted, so they don't first
+// show up as a device that won't boot.
+func validateBuild(ctx context.Context, cfg config.Config, filesDir string) error {
+	if err := cfg.Helm.Validate(); err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	if err := cfg.Kubelet.Validate(); err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	if err := cfg.RegistryCredentials.Validate(); err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	if err := cfg.Assertions.Validate(); err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	if err := cfg.Kernel.Pin.Validate(); err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	if err := cfg.Hardware.Validate(); err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	if err := cfg.Watchdog.Validate(); err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	if err := cfg.Registration.Validate(); err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	if err := cfg.Removal.Validate(); err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	if err := cfg.ExtraFiles.Validate(); err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	if err := cfg.ExtraFiles.CheckSources(afero.NewOsFs(), filesDir); err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	// the command line is checked against the cgroup mode up front so a mismatch can't leave a half configured image
+	if err := cfg.Kernel.CommandLine.WithCgroupMode(cfg.CgroupMode).WithSerial(cfg.Kernel.Serial).Validate(); err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	if err := configure.ValidateFiles(ctx, cfg.Mounts, cfg.VolumeLayout); err != nil {
+		return fmt.Errorf("error validating image files: %w", err)
+	}
+	return nil
+}
+
 func main() {
 
 	enableTracing := flag.BoolP("trace-enabled", "t", false, "enable tracing")
+	configPath := flag.StringP("config", "c", "", "path to a yaml build config, defaults are used when empty")
+	fromStep := flag.String("from-step", "", "first configure step to run")
+	untilStep := flag.String("until-step", "", "last configure step to run")
+	layerCacheDir := flag.String("layer-cache-dir", "", "directory to keep configured rootfs layers in, empty disables the layer cache")
+	downloadCacheDir := flag.String("download-cache-dir", "", "directory to keep verified kubernetes artifacts in, they're prefetched alongside the base image when set")
+	defaultVersions := configure.DefaultKubernetesVersions()
+	kubernetesVersion := flag.String("kubernetes-version", defaultVersions.Kubernetes, "kubernetes release to install, e.g. v1.25.3 or stable-1.25 for its latest patch release")
+	criCtlVersion := flag.String("crictl-version", defaultVersions.CriCtl, "crictl release to install")
+	cniVersion := flag.String("cni-version", defaultVersions.CNI, "cni plugins release to install")
+	artifactDir := flag.String("artifact-dir", "", "build offline from a directory populated by prefetch, nothing is downloaded from the network")
+	lockfilePath := flag.String("lockfile", lockfile.DefaultPath, "lockfile written after a successful build with the hash of every download")
+	reportPath := flag.String("report", report.DefaultPath, "build report written when the build finishes or fails, with each phase's duration and the published artifacts")
+	locked := flag.Bool("locked", false, "fail the build if a download doesn't match the hash in --lockfile, the lockfile is left as is")
+	pinManifest := flag.String("pin-packages", "", "manifest from a previous build, its apt package versions are installed instead of the archive's latest")
+	strictPins := flag.Bool("strict-pins", false, "fail the build when a version pinned by --pin-packages is no longer in the archive instead of installing the current one")
+	skipPreflight := flag.Bool("skip-preflight", false, "don't check every download exists before starting, for offline or cached builds")
+	channel := flag.String("channel", "", "label stamped into the image's release file, overrides the config file's channel")
+	outputFormats := flag.StringSlice("output-format", nil, "artifacts to publish, raw for flashing and qcow2 for booting in a vm, repeat or comma separate for both")
+	overridesDir := flag.String("overrides-dir", "", "directory of files that replace the embedded config files and templates with the same name")
+	workDir := flag.String("work-dir", "", "directory for the build's downloads, images, and mount points, defaults to a new timestamped directory under "+media.WorkspaceRoot)
+	keepWorkdir := flag.Bool("keep-workdir", false, "keep the work dir after a successful build, failed builds always keep it for debugging")
+	waitForLock := flag.Bool("wait", false, "wait for another build using the same work dir to finish instead of failing")
+	filesDir := flag.String("files-dir", "", "directory the config's extra files are copied into the image from")
+	validateOnly := flag.Bool("validate-only", false, "check the config and every file rendered into the image, then exit without building")
+	profileNames := flag.StringSlice("profile", nil, "image variant to build, repeat or comma separate to build several from one base image download, defaults to the config file's profile or "+config.DefaultProfile)
+	listProfiles := flag.Bool("list-profiles", false, "print every profile with the steps and settings it includes, then exit")
+	exportPath := flag.String("export-rootfs", "", "also write the configured root filesystem to this file, for testing the image as a container in ci")
+	exportFormat := flag.String("export-format", string(media.ExportOCI), "format of --export-rootfs, oci for ctr images import or docker load, tar for docker import")
+	resume := flag.Bool("resume", false, "skip steps a previous failed build of the same base image completed")
+	logOptions := telemetry.LogFlags(flag.CommandLine)
+	traceOptions := telemetry.TraceFlags(flag.CommandLine)
+	flag.BoolVar(&configure.ForceEmulation, "force-emulation", false, "run the image's binaries through qemu even on an arm64 host, for testing the emulated path")
+	flag.BoolVar(&media.LazyUnmount, "lazy-unmount", media.LazyUnmount, "lazily unmount the image if it's still busy after retrying, instead of failing cleanup and leaving the loop device attached")
+	flag.BoolVar(&media.ForceDownload, "force-download", false, "download and extract the base image again even if it's already on disk")
+	flag.DurationVar(&media.DownloadTimeout, "download-timeout", 0, "give up on a stalled base image download after this long, 0 waits as long as the http client allows")
+	flag.DurationVar(&utility.ProgressInterval, "progress-interval", utility.ProgressInterval, "how often downloads, compression, and uploads report progress")
+
+	steps := buildSteps(&buildDeps{})
+	skipFlags := pipeline.SkipFlags(flag.CommandLine, steps)
 	flag.Parse()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	logger, logErr := logOptions.NewLogger(os.Stderr)
+	if logErr != nil {
+		fmt.Fprintln(os.Stderr, logErr)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	// flags only win over the config file when they're passed
+	var versionOverrides configure.KubernetesVersions
+	if flag.CommandLine.Changed("kubernetes-version") {
+		versionOverrides.Kubernetes = *kubernetesVersion
+	}
+	if flag.CommandLine.Changed("crictl-version") {
+		versionOverrides.CriCtl = *criCtlVersion
+	}
+	if flag.CommandLine.Changed("cni-version") {
+		versionOverrides.CNI = *cniVersion
+	}
+
+	var outputs []media.OutputFormat
+	for _, format := range *outputFormats {
+		outputs = append(outputs, media.OutputFormat(format))
+	}
+
+	opts := setupOptions{
+		enableTracing: *enableTracing,
+		trace:         *traceOptions,
+		configPath:    *configPath,
+		layerCacheDir: *layerCacheDir,
+		downloadCache: *downloadCacheDir,
+		artifactDir:   *artifactDir,
+		lockfilePath:  *lockfilePath,
+		reportPath:    *reportPath,
+		locked:        *locked,
+		pinManifest:   *pinManifest,
+		strictPins:    *strictPins,
+		kubernetes:    versionOverrides,
+		resume:        *resume,
+		validateOnly:  *validateOnly,
+		profiles:      *profileNames,
+		listProfiles:  *listProfiles,
+		workDir:       *workDir,
+		keepWorkdir:   *keepWorkdir,
+		waitForLock:   *waitForLock,
+		export:        media.RootfsExport{Path: *exportPath, Format: media.ExportFormat(*exportFormat)},
+		overridesDir:  *overridesDir,
+		filesDir:      *filesDir,
+		skipPreflight: *skipPreflight,
+		outputs:       outputs,
+		channel:       *channel,
+		selection:     pipeline.Selection{From: *fromStep, Until: *untilStep, Skip: pipeline.SkipSet(skipFlags)},
+	}
+
+	// an interrupt cancels the build, the image is still unmounted and detached on the way out
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, opts, steps); err != nil {
+		logger.Error("image build failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// run builds, configures, and publishes each profile's image. Once an image is mounted it's always cleaned up, and
+// it's only compressed and uploaded when configuration succeeded. steps are the full step registry, each profile
+// builds its own.
+func run(ctx context.Context, opts setupOptions, steps []pipeline.Step) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	if !*enableTracing {
-		tp, traceErr := telemetry.NewExporter("http://localhost:14268/api/traces")
+	if !opts.enableTracing {
+		tp, traceErr := telemetry.NewTracerProvider(ctx, opts.trace)
 		if traceErr != nil {
-			log.Panicf("error creating tracer: %v", traceErr)
+			return fmt.Errorf("error creating tracer: %w", traceErr)
 		}
 
 		otel.SetTracerProvider(tp)
 		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
 
 		defer func(ctx context.Context) {
-			log.Println("beginning graceful shutdown")
-			ctx, cancel = context.WithTimeout(ctx, time.Minute*5)
+			slog.Info("beginning graceful shutdown")
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute*5)
+			defer cancel()
+			if shutdownErr := tp.Shutdown(ctx); shutdownErr != nil {
+				slog.Error("could not shutdown trace provider", "error", shutdownErr)
+			}
+		}(ctx)
+
+		stopMetrics, metricsErr := telemetry.StartMetrics(ctx, opts.trace)
+		if metricsErr != nil {
+			return fmt.Errorf("error creating metrics exporter: %w", metricsErr)
+		}
+		defer func(ctx context.Context) {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
 			defer cancel()
-			if err := tp.Shutdown(ctx); err != nil {
-				log.Panicf("could not shutdown trace provider: %v", err)
+			if stopErr := stopMetrics(ctx); stopErr != nil {
+				slog.Error("could not flush metrics", "error", stopErr)
 			}
 		}(ctx)
 
@@ -69,101 +309,656 @@ func main() {
 		var span trace.Span
 		ctx, span = tr.Start(ctx, "begin")
 		defer span.End()
+		span.SetAttributes(telemetry.HostArchKey.String(configure.HostArch()), telemetry.EmulatedKey.Bool(configure.Emulated()))
+	}
+
+	// overrides are in place before validation so it covers them too
+	if opts.overridesDir != "" {
+		unknown, overrideErr := configure.UseOverrides(os.DirFS(opts.overridesDir))
+		if overrideErr != nil {
+			return fmt.Errorf("error reading overrides: %w", overrideErr)
+		}
+		if len(unknown) != 0 {
+			slog.Warn("overrides don't match any embedded file and are ignored", "files", unknown)
+		}
+	}
+
+	if opts.listProfiles {
+		cfg, configErr := config.Load(afero.NewOsFs(), opts.configPath)
+		if configErr != nil {
+			return fmt.Errorf("error loading config: %w", configErr)
+		}
+		return describeProfiles(os.Stdout, cfg, steps)
+	}
+
+	if opts.validateOnly {
+		cfg, configErr := config.Load(afero.NewOsFs(), opts.configPath)
+		if configErr != nil {
+			return fmt.Errorf("error loading config: %w", configErr)
+		}
+		for _, name := range profileNames(opts.profiles) {
+			profileCfg, _, _, profileErr := applyProfile(cfg, name, steps)
+			if profileErr != nil {
+				return profileErr
+			}
+			if err := validateBuild(ctx, profileCfg, opts.filesDir); err != nil {
+				return err
+			}
+		}
+		slog.Info("config and image files are valid")
+		return nil
 	}
 
-	client := http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport), Timeout: time.Minute * 10}
-	otelhttp.DefaultClient = &client
+	if err := utility.CheckHostDependencies(utility.SetupCommands); err != nil {
+		return err
+	}
+	if opts.export.Enabled() {
+		if err := opts.export.Validate(); err != nil {
+			return err
+		}
+	}
+	batch := len(opts.profiles) > 1
+	if batch {
+		if opts.locked {
+			return errors.New("--locked can't be used when building several profiles, build them one at a time")
+		}
+		if err := utility.CheckHostDependencies(utility.BatchCommands); err != nil {
+			return err
+		}
+	}
+
+	workspace := media.Workspace{Dir: opts.workDir}
+	if opts.workDir == "" {
+		if opts.resume {
+			return errors.New("--resume needs --work-dir pointing at the failed build's work dir")
+		}
+		workspace = media.NewWorkspace(time.Now())
+	}
+	if err := workspace.Create(); err != nil {
+		return err
+	}
+	// released after every other deferred cleanup, so the next build can't mount over this one's leftovers
+	workspaceLock, lockErr := workspace.Lock(ctx, opts.waitForLock)
+	if lockErr != nil {
+		return lockErr
+	}
+	defer func() {
+		if releaseErr := workspaceLock.Release(); releaseErr != nil {
+			slog.Warn("could not release work dir lock", "error", releaseErr)
+		}
+	}()
+	slog.Info("building in work dir", "dir", workspace.Dir)
 
 	gcsClient, gcsErr := storage.NewClient(ctx,
 		option.WithGRPCDialOption(grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor())),
 		option.WithGRPCDialOption(grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor())))
 	if gcsErr != nil {
-		log.Panicf("error creating cloud storage client: %v", gcsErr)
+		return fmt.Errorf("error creating cloud storage client: %w", gcsErr)
 	}
 
 	localFS := afero.NewOsFs()
-	mountedFs := afero.NewBasePathFs(localFS, "./mnt")
 
-	if err := media.DownloadAndVerifyMedia(ctx, localFS, false); err != nil {
-		log.Panicf("error with downloading media: %v", err)
+	cfg, configErr := config.Load(localFS, opts.configPath)
+	if configErr != nil {
+		return fmt.Errorf("error loading config: %w", configErr)
+	}
+
+	var pinned *lockfile.Lock
+	if opts.locked {
+		lock, lockErr := lockfile.Read(localFS, opts.lockfilePath)
+		if lockErr != nil {
+			return fmt.Errorf("error reading lockfile, build once without --locked to create it: %w", lockErr)
+		}
+		pinned = &lock
 	}
 
-	log.Print("media successfully downloaded")
+	var pins configure.PackagePins
+	if opts.pinManifest != "" {
+		packages, pinErr := readPinnedPackages(localFS, opts.pinManifest)
+		if pinErr != nil {
+			return pinErr
+		}
+		pins = configure.NewPackagePins(packages, opts.strictPins)
+	}
 
-	_, decompressErr := media.ExtractImage(ctx)
-	if decompressErr != nil {
-		log.Panicf("error decompressing image: %s", decompressErr)
+	var artifacts *offline.Dir
+	if opts.artifactDir != "" {
+		dir, openErr := offline.Open(localFS, opts.artifactDir)
+		if openErr != nil {
+			return fmt.Errorf("error opening artifact directory: %w", openErr)
+		}
+		artifacts = dir
+		otelhttp.DefaultClient = &http.Client{Transport: otelhttp.NewTransport(artifacts.Transport())}
+	} else {
+		client, clientErr := utility.NewHTTPClient(cfg.HTTP)
+		if clientErr != nil {
+			return fmt.Errorf("error loading config: %w", clientErr)
+		}
+		client.Timeout = time.Minute * 10
+		otelhttp.DefaultClient = client
 	}
-	truncateErr := media.ExpandSize(ctx)
-	if truncateErr != nil {
-		log.Panicf("error expanding image size: %s", truncateErr)
+	recorder := lockfile.NewRecorder(otelhttp.DefaultClient.Transport, pinned)
+	otelhttp.DefaultClient.Transport = recorder
+
+	env := buildEnv{
+		opts:      opts,
+		localFS:   localFS,
+		objects:   store.NewGCS(gcsClient, utility.BucketName),
+		cfg:       cfg,
+		pins:      pins,
+		artifacts: artifacts,
+		recorder:  recorder,
+		batch:     batch,
 	}
 
-	device, mountFileErr := media.MountImageToDevice(ctx, utility.ExtractName)
-	if mountFileErr != nil {
-		log.Panicf("error mounting image: %s", mountFileErr)
+	if batch {
+		results, batchErr := buildBatch(ctx, env, opts.profiles, workspace)
+		printSummary(os.Stdout, results)
+		if batchErr != nil {
+			return batchErr
+		}
+	} else if err := buildProfile(ctx, env, profileNames(opts.profiles)[0], workspace, nil); err != nil {
+		return err
 	}
 
-	defer func(fileSystem afero.Fs, device media.Entry) {
-		if r := recover(); r != nil {
-			log.Print("cleaning up resources after failed image build")
-			err := media.CleanUp(ctx, fileSystem, device)
-			if err != nil {
-				log.Fatalf("error cleaning up resources: %v", err)
-			}
-		} else {
-			log.Print("configuration finished, cleaning up resources and uploading")
-			if err := media.CleanUp(ctx, fileSystem, device); err != nil {
-				log.Fatalf("error cleaning up resources: %v", err)
-			}
+	if opts.keepWorkdir {
+		slog.Info("keeping work dir", "dir", workspace.Dir)
+		return nil
+	}
+	if removeErr := workspace.Remove(); removeErr != nil {
+		slog.Warn("could not remove work dir", "dir", workspace.Dir, "error", removeErr)
+	}
+	return nil
+}
 
-			imageName, compressErr := media.CompressImage(ctx, fileSystem, gcsClient)
-			if compressErr != nil {
-				log.Fatalf("error compressing image: %v", compressErr)
-			}
+// buildEnv is what every profile built by one run shares.
+type buildEnv struct {
+	opts      setupOptions
+	localFS   afero.Fs
+	objects   store.ObjectStore
+	cfg       config.Config
+	pins      configure.PackagePins
+	artifacts *offline.Dir
+	recorder  *lockfile.Recorder
+	// batch is set when several profiles are built, their artifacts and lockfiles get the profile name
+	batch bool
+}
 
-			if err := media.UploadImage(ctx, fileSystem, imageName, gcsClient); err != nil {
-				log.Fatalf("error uploading image: %v", err)
-			}
-			log.Print("finished all image operations")
+// profileNames are the profiles to build, an empty list builds the config's default.
+func profileNames(profiles []string) []string {
+	if len(profiles) == 0 {
+		return []string{""}
+	}
+	return profiles
+}
+
+// profileResult is how one profile of a batch went.
+type profileResult struct {
+	profile  string
+	duration time.Duration
+	err      error
+}
+
+// buildBatch downloads and extracts the base image once into workspace, then builds every profile from its own copy
+// in a workspace of its own. A profile failing doesn't stop the others.
+func buildBatch(ctx context.Context, env buildEnv, profiles []string, workspace media.Workspace) ([]profileResult, error) {
+	seen := map[string]bool{}
+	for _, name := range profiles {
+		if name == "" || seen[name] || filepath.Base(name) != name {
+			return nil, fmt.Errorf("each profile must be named once and can't contain a path separator, got: %q", name)
 		}
+		seen[name] = true
+	}
 
-	}(localFS, device)
+	base, baseErr := prepareBase(ctx, env, workspace)
+	if baseErr != nil {
+		return nil, fmt.Errorf("error preparing the shared base image: %w", baseErr)
+	}
 
-	if err := media.FileSystemExpansion(ctx, device); err != nil {
-		log.Panicf("error expanding file system: %v", err)
+	results := make([]profileResult, 0, len(profiles))
+	failed := 0
+	for i, name := range profiles {
+		logger := slog.With("profile", name)
+		logger.Info("building profile", "position", i+1, "total", len(profiles))
+		started := time.Now()
+		profileWorkspace := media.Workspace{Dir: workspace.Path(name)}
+		err := profileWorkspace.Create()
+		if err == nil {
+			err = buildProfile(telemetry.WithLogger(ctx, logger), env, name, profileWorkspace, &base)
+		}
+		if err != nil {
+			logger.Error("profile failed", "error", err)
+			failed++
+		}
+		results = append(results, profileResult{profile: name, duration: time.Since(started), err: err})
 	}
 
-	if err := media.AttachToMountPoint(ctx, localFS, device, true); err != nil {
-		log.Panicf("error mounting image: %v", err)
+	if failed != 0 {
+		return results, fmt.Errorf("%d of %d profiles failed", failed, len(profiles))
 	}
+	return results, nil
+}
 
-	log.Print("media size expanded and mounted beginning configuration")
+// prepareBase downloads, verifies, and extracts the base image into workspace for a batch's profiles to copy.
+func prepareBase(ctx context.Context, env buildEnv, workspace media.Workspace) (media.VendorImage, error) {
+	baseImage, distroErr := distro.Lookup(env.cfg.Distro)
+	if distroErr != nil {
+		return media.VendorImage{}, fmt.Errorf("error loading config: %w", distroErr)
+	}
+	source, sourceErr := media.NewSource(env.cfg.Source, baseImage, workspace, utility.ExecRunner{}, nil, env.cfg.HTTP.Proxies())
+	if sourceErr != nil {
+		return media.VendorImage{}, fmt.Errorf("error loading config: %w", sourceErr)
+	}
+	vendor, ok := source.(media.VendorImage)
+	if !ok {
+		return media.VendorImage{}, errors.New("several profiles can only share a vendor image, a debootstrapped image is built per profile")
+	}
 
-	if err := configure.KernelSettings(ctx, mountedFs); err != nil {
-		log.Panicf("error configuring kernel settings: %v", err)
+	if err := vendor.Fetch(ctx, env.localFS); err != nil {
+		return vendor, err
+	}
+	deps := &buildDeps{localFs: env.localFS, source: vendor, recorder: env.recorder}
+	if err := deps.recordCached(); err != nil {
+		return vendor, err
 	}
+	return vendor, vendor.Extract(ctx)
+}
 
-	if err := configure.KernelModules(ctx, mountedFs); err != nil {
-		log.Panicf("error configuring modules and sysctls: %v", err)
+// printSummary reports each profile of a batch with how long it took.
+func printSummary(w io.Writer, results []profileResult) {
+	if len(results) == 0 {
+		return
 	}
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "PROFILE\tSTATUS\tDURATION")
+	for _, result := range results {
+		status := "ok"
+		if result.err != nil {
+			status = "failed: " + result.err.Error()
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\n", result.profile, status, result.duration.Round(time.Second))
+	}
+	_ = table.Flush()
+}
 
-	if err := configure.Packages(ctx, mountedFs); err != nil {
-		log.Panicf("error installing packages: %v", err)
+// buildProfile configures and publishes one profile's image in workspace. With base set the image is copied from a
+// batch's shared download instead of being fetched.
+func buildProfile(ctx context.Context, env buildEnv, name string, workspace media.Workspace, base *media.VendorImage) (err error) {
+	opts := env.opts
+	localFS := env.localFS
+	buildManifest := manifest.New()
+	deps := &buildDeps{}
+	steps := buildSteps(deps)
+
+	cfg, profile, steps, profileErr := applyProfile(env.cfg, name, steps)
+	if profileErr != nil {
+		return profileErr
 	}
+	slog.Info("building profile", "profile", profile.Name)
+	buildManifest.Profile = profile.Name
+	buildManifest.HostArch = configure.HostArch()
+
+	// deferred first so it runs last, once publishing or cleanup has decided how the build went
+	buildReport := report.New(profile.Name)
+	reportPath := opts.reportPath
+	if env.batch {
+		reportPath = withProfile(reportPath, profile.Name)
+	}
+	defer func() {
+		buildReport.Finish(err)
+		if summaryErr := buildReport.WriteSummary(os.Stdout); summaryErr != nil {
+			slog.Warn("could not print build summary", "error", summaryErr)
+		}
+		if writeErr := buildReport.Write(localFS, reportPath); writeErr != nil {
+			slog.Warn("could not write build report", "path", reportPath, "error", writeErr)
+		}
+	}()
 
-	if err := configure.InstallKubernetes(ctx, mountedFs, "v1.25.3", "v1.25.0", "v1.1.1"); err != nil {
-		log.Panicf("error installing Kubernetes: %s", err)
+	baseImage, distroErr := distro.Lookup(cfg.Distro)
+	if distroErr != nil {
+		return fmt.Errorf("error loading config: %w", distroErr)
+	}
+	lockfilePath := opts.lockfilePath
+	export := opts.export
+	if env.batch {
+		// every profile of a batch is published side by side, the profile name keeps them apart
+		baseImage.OutputPrefix += "-" + profile.Name
+		lockfilePath = withProfile(lockfilePath, profile.Name)
+		if export.Enabled() {
+			export.Path = withProfile(export.Path, profile.Name)
+		}
+	}
+	if opts.channel != "" {
+		cfg.Channel = opts.channel
+	}
+	if len(opts.outputs) != 0 {
+		cfg.Outputs = opts.outputs
+	}
+	if err := media.ValidateOutputFormats(cfg.Outputs); err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	if err := validateBuild(ctx, cfg, opts.filesDir); err != nil {
+		return err
 	}
 
-	if err := configure.CloudInit(ctx, mountedFs); err != nil {
-		log.Panicf("error configuring cloudinit drop in files: %v", err)
+	cfg.Kubernetes = overrideVersions(cfg.Kubernetes, opts.kubernetes)
+	deps.markerURL = cfg.Kubernetes.MarkerURL()
+	versions, versionErr := cfg.Kubernetes.Resolve(ctx)
+	if versionErr != nil {
+		return fmt.Errorf("error picking kubernetes versions: %w", versionErr)
 	}
+	cfg.Kubernetes = versions
+	buildManifest.Kubernetes = versions.Kubernetes
 
-	if err := configure.Fstab(ctx, mountedFs); err != nil {
-		log.Panicf("error configuring fstab: %v", err)
+	imageTarget, targetErr := configure.NewTarget(localFS, workspace.RootMount(), cfg.Chroot, utility.ExecRunner{})
+	if targetErr != nil {
+		return fmt.Errorf("error picking how to run commands in the image: %w", targetErr)
 	}
 
-	log.Print("image has been configured")
+	var source media.Source
+	if base != nil {
+		source = media.NewImageCopy(*base, workspace)
+	} else {
+		created, sourceErr := media.NewSource(cfg.Source, baseImage, workspace, utility.ExecRunner{}, imageTarget.Chroot, cfg.HTTP.Proxies())
+		if sourceErr != nil {
+			return fmt.Errorf("error loading config: %w", sourceErr)
+		}
+		source = created
+	}
+	if _, bootstrapping := source.(media.Debootstrap); bootstrapping {
+		if err := utility.CheckHostDependencies(utility.DebootstrapCommands); err != nil {
+			return err
+		}
+	}
+	if cfg.Compact {
+		if err := utility.CheckHostDependencies(utility.CompactCommands); err != nil {
+			return err
+		}
+	}
+	if cfg.Shrink {
+		if err := utility.CheckHostDependencies(utility.ShrinkCommands); err != nil {
+			return err
+		}
+	}
+	if len(cfg.Helm.Charts) != 0 {
+		if err := utility.CheckHostDependencies(utility.HelmCommands); err != nil {
+			return err
+		}
+	}
+	if slices.Contains(cfg.Outputs, media.OutputQcow2) {
+		if err := utility.CheckHostDependencies(utility.Qcow2Commands); err != nil {
+			return err
+		}
+	}
 
+	if artifacts := env.artifacts; artifacts != nil {
+		// offline there's nothing to reach, instead everything has to be on disk before the image is touched
+		if err := offline.Supported(cfg, source); err != nil {
+			return err
+		}
+		if err := artifacts.Verify(ctx, preflight.ConfigURLs(cfg, source, baseImage)); err != nil {
+			return fmt.Errorf("artifact directory %s can't be used:\n%w", opts.artifactDir, err)
+		}
+	} else if !opts.skipPreflight {
+		if err := preflight.Check(ctx, otelhttp.DefaultClient, cfg.Kubernetes, preflight.ConfigURLs(cfg, source, baseImage)); err != nil {
+			return fmt.Errorf("preflight checks failed, pass --skip-preflight to build anyway:\n%w", err)
+		}
+	}
+
+	// progress is keyed by the base image, so a resumed build never picks up steps run against a different release
+	checkpoints, checkpointErr := pipeline.OpenCheckpoints(localFS, workspace.Path(pipeline.StateFile), func() (string, error) {
+		return source.Checksum(localFS)
+	}, opts.resume)
+	if checkpointErr != nil {
+		return fmt.Errorf("error reading build state: %w", checkpointErr)
+	}
+
+	deps.localFs = localFS
+	deps.target = imageTarget
+	deps.cfg = cfg
+	deps.distro = baseImage
+	deps.source = source
+	deps.workspace = workspace
+	deps.pins = env.pins
+	deps.profile = profile
+	deps.export = export
+	deps.downloadCacheDir = opts.downloadCache
+	deps.filesDir = opts.filesDir
+	deps.artifacts = env.artifacts
+	deps.recorder = env.recorder
+	selection := opts.selection
+	selection.Skip = make(map[string]bool, len(opts.selection.Skip))
+	for step := range opts.selection.Skip {
+		// the profile already leaves these out, skipping them again isn't a partial build
+		if !profile.Skipped()[step] {
+			selection.Skip[step] = true
+		}
+	}
+	selection.Completed = checkpoints.Completed()
+	if opts.layerCacheDir != "" {
+		deps.layerStore = cache.NewStore(localFS, opts.layerCacheDir)
+		// only a build that ran every step in one go is trusted as a cache layer
+		deps.saveLayer = selection.Full() && !opts.resume
+	}
+
+	defer func() {
+		// the build's context may be what failed it, cleanup keeps its values but not its cancellation
+		cleanupCtx, cancelCleanup := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+		defer cancelCleanup()
+
+		// a panic is logged with its stack and raised again once the image is cleaned up
+		recovered := recover()
+		if recovered != nil {
+			slog.Error("panic while configuring image", "panic", recovered, "stack", string(debug.Stack()))
+			defer panic(recovered)
+		}
+
+		if removeErr := configure.RemoveBinfmt(cleanupCtx, imageTarget.Fs); removeErr != nil {
+			slog.Warn("could not remove qemu interpreter from image", "error", removeErr)
+		}
+		// nothing to clean up or publish if the image never made it onto a loop device
+		if deps.device.Name == "" {
+			return
+		}
+		if err != nil || recovered != nil {
+			slog.Info("cleaning up resources after failed image build, rerun with --resume and this --work-dir to continue", "work_dir", workspace.Dir)
+			if cleanupErr := media.CleanUp(cleanupCtx, localFS, workspace, deps.device); cleanupErr != nil {
+				slog.Error("error cleaning up resources", "error", cleanupErr)
+			}
+			return
+		}
+		slog.Info("configuration finished, cleaning up resources and uploading")
+		release, releaseErr := deps.buildRelease()
+		if releaseErr != nil {
+			err = fmt.Errorf("error describing release: %w", releaseErr)
+			if cleanupErr := media.CleanUp(cleanupCtx, localFS, workspace, deps.device); cleanupErr != nil {
+				slog.Error("error cleaning up resources", "error", cleanupErr)
+			}
+			return
+		}
+		publishCtx, cancelPublish := context.WithTimeout(context.WithoutCancel(ctx), publishTimeout)
+		defer cancelPublish()
+		if err = publish(publishCtx, localFS, env.objects, workspace, deps.distro, deps.source, deps.device, deps.cfg, release, buildManifest, buildReport); err != nil {
+			return
+		}
+		if clearErr := checkpoints.Clear(); clearErr != nil {
+			slog.Warn("could not clear build state", "error", clearErr)
+		}
+		if !opts.locked {
+			if lockErr := env.recorder.Lock(deps.lockVersions(), deps.packages).Write(localFS, lockfilePath); lockErr != nil {
+				err = fmt.Errorf("error writing lockfile: %w", lockErr)
+			}
+		}
+	}()
+
+	state := &pipeline.BuildState{Manifest: buildManifest, Checkpoints: checkpoints, Report: buildReport}
+	if err := pipeline.Run(ctx, steps, selection, state); err != nil {
+		return fmt.Errorf("error building image: %w", err)
+	}
+
+	slog.Info("image has been configured")
+	return nil
+}
+
+// withProfile adds the profile name to name, before its extension.
+func withProfile(name string, profile string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + "-" + profile + filepath.Ext(name)
+}
+
+// publish unmounts the configured image, then packages it in each output format and uploads the artifacts along
+// with the manifest. Each part is timed in buildReport.
+func publish(ctx context.Context, fileSystem afero.Fs, objects store.ObjectStore, workspace media.Workspace, d distro.Distro, source media.Source, device media.Entry, cfg config.Config, release configure.Release, buildManifest *manifest.Manifest, buildReport *report.Report) error {
+	if err := buildReport.Time("unmount", func() error {
+		return media.Unmount(ctx, fileSystem, workspace)
+	}); err != nil {
+		return fmt.Errorf("error cleaning up resources: %w", err)
+	}
+	// the filesystem has to be unmounted to shrink it but the partition is only reachable while the loop is attached
+	var shrunkSize int64
+	if cfg.Shrink {
+		if err := buildReport.Time("shrink", func() error {
+			size, shrinkErr := media.ShrinkImage(ctx, utility.ExecRunner{}, device)
+			shrunkSize = size
+			return shrinkErr
+		}); err != nil {
+			return errors.Join(fmt.Errorf("error shrinking image: %w", err), media.Detach(ctx, device))
+		}
+	}
+	if err := media.Detach(ctx, device); err != nil {
+		return fmt.Errorf("error cleaning up resources: %w", err)
+	}
+	if cfg.Shrink {
+		if err := os.Truncate(source.ImageFile(), shrunkSize); err != nil {
+			return fmt.Errorf("error truncating image: %w", err)
+		}
+	}
+
+	before, statErr := media.StatImage(source.ImageFile())
+	if statErr != nil {
+		return fmt.Errorf("error reading image size: %w", statErr)
+	}
+	if cfg.Compact {
+		if err := buildReport.Time("compact", func() error {
+			return media.DigHoles(ctx, utility.ExecRunner{}, source.ImageFile())
+		}); err != nil {
+			return fmt.Errorf("error making image sparse: %w", err)
+		}
+		after, afterErr := media.StatImage(source.ImageFile())
+		if afterErr != nil {
+			return fmt.Errorf("error reading image size: %w", afterErr)
+		}
+		slog.Info("made image sparse", "logical_bytes", after.Logical, "allocated_bytes_before", before.Allocated, "allocated_bytes_after", after.Allocated)
+		before = after
+	}
+
+	var artifacts []media.Artifact
+	if err := buildReport.Time("compress", func() error {
+		packaged, packageErr := media.PackageImage(ctx, fileSystem, utility.ExecRunner{}, source.ImageFile(), workspace.Path(d.OutputPrefix), cfg.Outputs)
+		artifacts = packaged
+		return packageErr
+	}); err != nil {
+		return fmt.Errorf("error compressing image: %w", err)
+	}
+	for _, artifact := range artifacts {
+		var size int64
+		if compressed, compressedErr := media.StatImage(artifact.Name); compressedErr == nil {
+			slog.Info("compressed image", "format", artifact.Format, "logical_bytes", before.Logical, "allocated_bytes", before.Allocated, "compressed_bytes", compressed.Logical)
+			size = compressed.Logical
+		}
+		buildReport.AddArtifact(filepath.Base(artifact.Name), string(artifact.Format), size)
+	}
+
+	if err := buildReport.Time("upload", func() error {
+		for _, artifact := range artifacts {
+			if err := media.UploadImage(ctx, fileSystem, artifact.Name, objects, release.Metadata()); err != nil {
+				return fmt.Errorf("error uploading %s image: %w", artifact.Format, err)
+			}
+			buildManifest.AddArtifact(filepath.Base(artifact.Name), string(artifact.Format))
+		}
+
+		manifestName := workspace.Path(manifest.FileName(buildManifest.Image))
+		if err := buildManifest.Write(fileSystem, manifestName); err != nil {
+			return fmt.Errorf("error writing manifest: %w", err)
+		}
+
+		if err := media.UploadImage(ctx, fileSystem, manifestName, objects, release.Metadata()); err != nil {
+			return fmt.Errorf("error uploading manifest: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	slog.Info("finished all image operations")
+	return nil
+}
+
+// applyProfile looks up the named profile, layers its settings into cfg, and drops the steps it leaves out.
+func applyProfile(cfg config.Config, name string, steps []pipeline.Step) (config.Config, config.Profile, []pipeline.Step, error) {
+	profile, lookupErr := cfg.LookupProfile(name)
+	if lookupErr != nil {
+		return cfg, profile, nil, lookupErr
+	}
+	kept, withoutErr := pipeline.Without(steps, profile.Skipped())
+	if withoutErr != nil {
+		return cfg, profile, nil, fmt.Errorf("profile %s: %w", profile.Name, withoutErr)
+	}
+	return cfg.WithProfile(profile), profile, kept, nil
+}
+
+// describeProfiles prints each profile with the steps it runs and the settings it changes.
+func describeProfiles(w io.Writer, cfg config.Config, steps []pipeline.Step) error {
+	selected, lookupErr := cfg.LookupProfile("")
+	if lookupErr != nil {
+		return lookupErr
+	}
+	for _, profile := range cfg.AvailableProfiles() {
+		_, _, kept, err := applyProfile(cfg, profile.Name, steps)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(kept))
+		for _, step := range kept {
+			names = append(names, step.Name())
+		}
+		marker := ""
+		if profile.Name == selected.Name {
+			marker = " (default)"
+		}
+		fmt.Fprintf(w, "%s%s: %s\n", profile.Name, marker, profile.Description)
+		fmt.Fprintf(w, "  steps: %s\n", strings.Join(names, ", "))
+		for _, setting := range profile.Settings() {
+			fmt.Fprintf(w, "  %s\n", setting)
+		}
+	}
+	return nil
+}
+
+// readPinnedPackages loads the package versions recorded in a previous build's manifest.
+func readPinnedPackages(fileSystem afero.Fs, manifestPath string) (_ []manifest.Package, err error) {
+	file, openErr := fileSystem.Open(manifestPath)
+	if openErr != nil {
+		return nil, fmt.Errorf("error opening manifest to pin packages from: %w", openErr)
+	}
+	defer utility.CloseWithErr(file, &err)
+	previous, readErr := manifest.Read(file)
+	if readErr != nil {
+		return nil, readErr
+	}
+	if len(previous.Packages) == 0 {
+		return nil, fmt.Errorf("manifest %s has no package versions to pin, it was built before they were recorded", manifestPath)
+	}
+	return previous.Packages, nil
+}
+
+func overrideVersions(versions configure.KubernetesVersions, overrides configure.KubernetesVersions) configure.KubernetesVersions {
+	if overrides.Kubernetes != "" {
+		versions.Kubernetes = overrides.Kubernetes
+	}
+	if overrides.CriCtl != "" {
+		versions.CriCtl = overrides.CriCtl
+	}
+	if overrides.CNI != "" {
+		versions.CNI = overrides.CNI
+	}
+	return versions
 }
@@ -0,0 +1,493 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/cache"
+	"github.com/LadySerena/pi-image-builder/config"
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/distro"
+	"github.com/LadySerena/pi-image-builder/lockfile"
+	"github.com/LadySerena/pi-image-builder/media"
+	"github.com/LadySerena/pi-image-builder/offline"
+	"github.com/LadySerena/pi-image-builder/pipeline"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	"golang.org/x/sync/errgroup"
+)
+
+// buildDeps is filled in after flags are parsed and by the steps that attach the image, later steps read it when they
+// run.
+type buildDeps struct {
+	localFs afero.Fs
+	// target is the mounted image's root volume
+	target configure.Target
+	cfg    config.Config
+	distro distro.Distro
+	source media.Source
+	device media.Entry
+	// workspace holds the build's downloads, images, and mount points
+	workspace media.Workspace
+	// layerStore is nil when the layer cache is disabled
+	layerStore *cache.Store
+	layerKey   string
+	saveLayer  bool
+	// downloadCacheDir is where kubernetes artifacts are prefetched to, empty disables the prefetch
+	downloadCacheDir string
+	// filesDir holds the sources of the config's extra files
+	filesDir string
+	// artifacts is the offline build's artifact directory, nil when building online
+	artifacts *offline.Dir
+	// recorder hashes every download for the lockfile, markerURL is the stable-x.y marker the kubernetes version was
+	// resolved from, if any
+	recorder  *lockfile.Recorder
+	markerURL string
+	// packages are the debs installed in the image, read once configuring is done
+	packages []lockfile.Package
+	// profile is the image variant being built, its settings are already layered into cfg
+	profile config.Profile
+	// export is where the configured root filesystem is written for running it as a container, if anywhere
+	export media.RootfsExport
+	// pins replays the package versions from a previous build's manifest, the zero value installs the latest
+	pins configure.PackagePins
+	// release is filled in the first time it's needed, see buildRelease
+	release configure.Release
+}
+
+// buildRelease describes the image being built, the same values are stamped into the image and set on the uploaded
+// objects. It's worked out once, after the base image is downloaded so its checksum can be read.
+func (d *buildDeps) buildRelease() (configure.Release, error) {
+	if !d.release.BuiltAt.IsZero() {
+		return d.release, nil
+	}
+	checksum, checksumErr := d.source.Checksum(d.localFs)
+	if checksumErr != nil {
+		return configure.Release{}, fmt.Errorf("could not read base image checksum: %w", checksumErr)
+	}
+	version, commit := configure.BuilderVersion()
+	d.release = configure.Release{
+		Version:         version,
+		Commit:          commit,
+		BuiltAt:         time.Now().UTC(),
+		BaseImage:       d.source.Name(),
+		BaseImageSHA256: checksum,
+		Kubernetes:      d.cfg.Kubernetes.Kubernetes,
+		Channel:         d.cfg.Channel,
+	}
+	return d.release, nil
+}
+
+// lockVersions labels each download in the lockfile with the release it belongs to.
+func (d *buildDeps) lockVersions() map[string]string {
+	versions := map[string]string{}
+	for _, url := range d.source.URLs() {
+		versions[url] = d.source.Name()
+	}
+	artifacts := configure.KubernetesArtifacts(d.cfg.Kubernetes)
+	artifacts = append(artifacts, configure.HelmArtifacts(d.cfg.Helm)...)
+	artifacts = append(artifacts, configure.NodeExporterArtifacts(d.cfg.NodeExporter)...)
+	for _, artifact := range artifacts {
+		versions[artifact.URL] = artifact.Version
+		versions[artifact.ChecksumURL] = artifact.Version
+	}
+	if d.markerURL != "" {
+		versions[d.markerURL] = d.cfg.Kubernetes.Kubernetes
+	}
+	return versions
+}
+
+// recordCached adds the base image and kubernetes artifacts reused from disk instead of downloaded to the lockfile,
+// they're checked against a pinned lockfile the same as a download.
+func (d *buildDeps) recordCached() error {
+	cached := map[string]string{}
+	source := d.source
+	if copied, ok := source.(media.ImageCopy); ok {
+		// a batch profile's image came from the shared download
+		source = copied.Base
+	}
+	if vendor, ok := source.(media.VendorImage); ok {
+		cached[vendor.Distro.ImageURL()] = vendor.Workspace.Path(vendor.Distro.ImageName)
+		cached[vendor.Distro.ChecksumURL()] = vendor.Workspace.Path(vendor.Distro.ChecksumName)
+	}
+	if d.downloadCacheDir != "" {
+		for _, artifact := range configure.KubernetesArtifacts(d.cfg.Kubernetes) {
+			cached[artifact.URL] = path.Join(d.downloadCacheDir, artifact.Name)
+		}
+	}
+	for url, name := range cached {
+		if d.recorder.Recorded(url) {
+			continue
+		}
+		file, openErr := d.localFs.Open(name)
+		if openErr != nil {
+			return openErr
+		}
+		recordErr := d.recorder.RecordFile(url, file)
+		utility.WrappedClose(file)
+		if recordErr != nil {
+			return recordErr
+		}
+	}
+	return nil
+}
+
+func (d *buildDeps) cacheKey() (string, error) {
+	if d.layerKey == "" {
+		key, err := layerCacheKey(d.localFs, d.distro, d.source, d.cfg, d.packageSet(), d.pins)
+		if err != nil {
+			return "", err
+		}
+		d.layerKey = key
+	}
+	return d.layerKey, nil
+}
+
+// download fetches the base image, and when there's a download cache the kubernetes artifacts alongside it. Either
+// failing cancels the other.
+func download(ctx context.Context, deps *buildDeps) error {
+	if deps.downloadCacheDir == "" {
+		return deps.source.Fetch(ctx, deps.localFs)
+	}
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.Go(func() error {
+		return deps.source.Fetch(groupCtx, deps.localFs)
+	})
+	group.Go(func() error {
+		return configure.FetchArtifacts(groupCtx, deps.localFs, deps.downloadCacheDir, configure.KubernetesArtifacts(deps.cfg.Kubernetes))
+	})
+	return group.Wait()
+}
+
+// buildSteps is the step registry, the order here is the order steps run in.
+func buildSteps(deps *buildDeps) []pipeline.Step {
+	steps := []pipeline.Step{
+		pipeline.Func{StepName: "download", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			if err := download(ctx, deps); err != nil {
+				return err
+			}
+			return deps.recordCached()
+		}},
+		pipeline.Func{StepName: "extract", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return deps.source.Extract(ctx)
+		}},
+		pipeline.Func{StepName: "expand", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return deps.source.Expand(ctx)
+		}},
+		pipeline.Func{StepName: "map", Host: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			device, err := media.MountImageToDevice(ctx, deps.source.ImageFile())
+			if err != nil {
+				return err
+			}
+			deps.device = device
+			return nil
+		}},
+		pipeline.Func{StepName: "grow", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return deps.source.Prepare(ctx, deps.device)
+		}},
+		pipeline.Func{StepName: "mount", Host: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return media.AttachToMountPoint(ctx, deps.localFs, deps.workspace, deps.device, true)
+		}},
+		pipeline.Func{StepName: "emulation", Host: true, ChrootSetup: true, Fn: func(ctx context.Context, state *pipeline.BuildState) error {
+			if err := configure.EnsureBinfmt(ctx, deps.target.Fs); err != nil {
+				return err
+			}
+			state.Manifest.Emulated = configure.Emulated()
+			return nil
+		}},
+		pipeline.Func{StepName: "layer-restore", Fn: func(ctx context.Context, state *pipeline.BuildState) error {
+			if deps.layerStore == nil {
+				return nil
+			}
+			key, keyErr := deps.cacheKey()
+			if keyErr != nil {
+				return fmt.Errorf("error computing layer cache key: %w", keyErr)
+			}
+			state.Manifest.LayerCache = key
+
+			hit, lookupErr := deps.layerStore.Has(key)
+			if lookupErr != nil {
+				return fmt.Errorf("error looking up layer cache: %w", lookupErr)
+			}
+			if !hit {
+				return nil
+			}
+			telemetry.Logger(ctx).Info("restoring layer from cache", "layer", key)
+			if err := deps.layerStore.Restore(ctx, deps.target.Fs, key); err != nil {
+				return fmt.Errorf("error restoring layer cache: %w", err)
+			}
+			state.RestoredLayer = key
+			return nil
+		}},
+	}
+	// the layer is saved right after the last cacheable step, everything later writes this build's settings and
+	// secrets, like the bootstrap token, registry credentials, and wifi psk, which a build restoring it mustn't inherit
+	configuring := configureSteps(deps)
+	last := pipeline.LastCacheable(configuring)
+	steps = append(steps, configuring[:last+1]...)
+	steps = append(steps, pipeline.Func{StepName: "layer-save", Fn: func(ctx context.Context, state *pipeline.BuildState) error {
+		if deps.layerStore == nil || !deps.saveLayer || state.RestoredLayer != "" {
+			return nil
+		}
+		key, keyErr := deps.cacheKey()
+		if keyErr != nil {
+			return fmt.Errorf("error computing layer cache key: %w", keyErr)
+		}
+		state.Manifest.LayerCache = key
+		telemetry.Logger(ctx).Info("saving layer to cache", "layer", key)
+		return deps.layerStore.Save(ctx, deps.target.Fs, key)
+	}})
+	steps = append(steps, configuring[last+1:]...)
+	// sanitize runs last so nothing configure leaves behind ends up in the published image, or in the exported rootfs
+	return append(steps,
+		pipeline.Func{StepName: "sanitize", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Sanitize(ctx, deps.target.Fs, deps.cfg.Sanitize)
+		}},
+		// a failed assertion fails the build, so the image is cleaned up without ever being compressed or uploaded
+		pipeline.Func{StepName: "assert", Fn: func(ctx context.Context, state *pipeline.BuildState) error {
+			state.Manifest.Purged, state.Manifest.Masked = configure.Removals(deps.target.Fs, deps.cfg.Removal)
+			assertions := append(configure.DefaultAssertions(deps.profile.KubernetesEnabled()), deps.cfg.Assertions...)
+			return configure.AssertImage(ctx, deps.target.Fs, configure.ImageExpectations{
+				Assertions: assertions,
+				Mounts:     deps.cfg.Mounts,
+				Layout:     deps.cfg.VolumeLayout,
+				Packages:   deps.packageSet().Required(),
+			})
+		}},
+		pipeline.Func{StepName: "export-rootfs", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			if !deps.export.Enabled() {
+				return nil
+			}
+			release, err := deps.buildRelease()
+			if err != nil {
+				return err
+			}
+			export := deps.export
+			export.Reference = deps.distro.OutputPrefix + ":" + imageTag(release.Version)
+			return media.ExportRootfs(ctx, deps.localFs, deps.target.Fs, export)
+		}},
+		pipeline.Func{StepName: "trim", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			if !deps.cfg.Compact {
+				return nil
+			}
+			return media.TrimFilesystems(ctx, utility.ExecRunner{}, deps.workspace)
+		}},
+	)
+}
+
+// configureSteps change the mounted image.
+func configureSteps(deps *buildDeps) []pipeline.Step {
+	return []pipeline.Step{
+		pipeline.Func{StepName: "apt-proxy", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.AptProxy(ctx, deps.target.Fs, deps.cfg.HTTP.Proxies())
+		}},
+		pipeline.Func{StepName: "local-apt-repo", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			if deps.artifacts == nil {
+				return nil
+			}
+			return configure.LocalAptRepo(ctx, deps.target.Fs, deps.artifacts.Pool())
+		}},
+		pipeline.Func{StepName: "kernel", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.KernelSettings(ctx, deps.target.Fs, deps.distro, deps.cfg.Kernel, deps.cfg.CgroupMode)
+		}},
+		pipeline.Func{StepName: "modules", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.KernelModules(ctx, deps.target.Fs, deps.cfg.Sysctls)
+		}},
+		pipeline.Func{StepName: "journald", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Journald(ctx, deps.target.Fs, deps.cfg.Journald)
+		}},
+		pipeline.Func{StepName: "packages", Cacheable: true, Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Packages(ctx, deps.target.Chroot, deps.target.Fs, deps.distro, deps.cfg.CgroupMode, deps.packageSet(), deps.pins)
+		}},
+		// not cacheable, a restored layer is checked against the pin as well
+		pipeline.Func{StepName: "kernel-verify", Chroot: true, Fn: func(ctx context.Context, state *pipeline.BuildState) error {
+			pin := deps.cfg.Kernel.Pin
+			if !pin.Enabled() {
+				return nil
+			}
+			if err := configure.VerifyKernel(ctx, deps.target.Fs, pin); err != nil {
+				return err
+			}
+			installed, err := configure.InstalledPackages(ctx, deps.target.Chroot)
+			if err != nil {
+				return err
+			}
+			state.Manifest.KernelPackages = configure.KernelPackages(installed, pin)
+			return nil
+		}},
+		// not cacheable, the overlays are read from the host and aren't part of the layer key
+		pipeline.Func{StepName: "hardware", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Hardware(ctx, deps.target.Chroot, deps.target.Fs, deps.localFs, deps.cfg.Hardware, deps.cfg.Kernel.Pin)
+		}},
+		pipeline.Func{StepName: "serial-console", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.SerialConsole(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Kernel.Serial)
+		}},
+		pipeline.Func{StepName: "watchdog", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Watchdog(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Watchdog)
+		}},
+		pipeline.Func{StepName: "registration", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Registration(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Registration)
+		}},
+		pipeline.Func{StepName: "package-versions", Chroot: true, Fn: func(ctx context.Context, state *pipeline.BuildState) error {
+			packages, err := configure.InstalledPackages(ctx, deps.target.Chroot)
+			if err != nil {
+				return err
+			}
+			state.Manifest.Packages = packages
+			return nil
+		}},
+		pipeline.Func{StepName: "kubernetes", Cacheable: true, Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.InstallKubernetes(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Kubernetes, deps.cfg.CgroupMode, deps.downloadCacheDir)
+		}},
+		pipeline.Func{StepName: "preload-images", Cacheable: true, Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.PreloadImages(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.PreloadImages)
+		}},
+		// not cacheable, the files are read from the host. It runs after the layer is saved so a build that drops a
+		// file doesn't get it back from the cache
+		pipeline.Func{StepName: "extra-files", Chroot: true, Fn: func(ctx context.Context, state *pipeline.BuildState) error {
+			files, err := configure.ExtraFiles(ctx, deps.target.Chroot, deps.target.Fs, deps.localFs, deps.filesDir, deps.cfg.ExtraFiles)
+			if err != nil {
+				return err
+			}
+			state.Manifest.Files = files
+			return nil
+		}},
+		pipeline.Func{StepName: "kubelet-config", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.KubeletConfiguration(ctx, deps.target.Fs, deps.cfg.Kubelet, deps.cfg.CgroupMode)
+		}},
+		pipeline.Func{StepName: "registry-credentials", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.RegistryCredentials(ctx, deps.target.Fs, deps.cfg.RegistryCredentials)
+		}},
+		pipeline.Func{StepName: "helm", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			if deps.cfg.Helm.Version == "" {
+				return nil
+			}
+			if err := configure.InstallHelm(ctx, deps.target.Fs, deps.cfg.Helm.Version); err != nil {
+				return err
+			}
+			return configure.VendorHelmCharts(ctx, utility.ExecRunner{}, deps.target.Fs, deps.cfg.Helm.Charts)
+		}},
+		pipeline.Func{StepName: "node-exporter", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.NodeExporter(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.NodeExporter)
+		}},
+		pipeline.Func{StepName: "longhorn", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Longhorn(ctx, deps.target.Chroot, deps.target.Fs)
+		}},
+		pipeline.Func{StepName: "zram", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Zram(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Zram)
+		}},
+		pipeline.Func{StepName: "upgrades", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.UnattendedUpgrades(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Upgrades)
+		}},
+		pipeline.Func{StepName: "kubeadm", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.KubeadmBootstrap(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Kubeadm)
+		}},
+		pipeline.Func{StepName: "cloudinit-install", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.InstallCloudInit(ctx, deps.target.Chroot, deps.target.Fs, deps.distro)
+		}},
+		pipeline.Func{StepName: "cloudinit", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.CloudInit(ctx, deps.target.Fs, deps.cfg.CloudInit)
+		}},
+		pipeline.Func{StepName: "ssh", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.SSHHardening(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.SSH)
+		}},
+		pipeline.Func{StepName: "firewall", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Firewall(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Firewall.ForKubeadmMode(deps.cfg.Kubeadm.Mode))
+		}},
+		pipeline.Func{StepName: "system", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.SystemSettings(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.System)
+		}},
+		pipeline.Func{StepName: "hostname", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Hostname(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.HostnamePattern)
+		}},
+		pipeline.Func{StepName: "wifi", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.WiFi(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.WiFi)
+		}},
+		pipeline.Func{StepName: "encryption", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.EncryptionPackages(ctx, deps.target.Chroot, deps.cfg.VolumeLayout)
+		}},
+		pipeline.Func{StepName: "fstab", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Fstab(ctx, deps.target.Fs, deps.cfg.Mounts, deps.cfg.VolumeLayout)
+		}},
+		pipeline.Func{StepName: "expand-volume", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.ExpandVolume(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Expand, deps.cfg.VolumeLayout)
+		}},
+		pipeline.Func{StepName: "release", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			release, err := deps.buildRelease()
+			if err != nil {
+				return err
+			}
+			return configure.StampRelease(ctx, deps.target.Fs, release)
+		}},
+		pipeline.Func{StepName: "record-packages", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			packages, err := lockfile.InstalledPackages(deps.target.Fs)
+			if err != nil {
+				return fmt.Errorf("error reading installed packages: %w", err)
+			}
+			deps.packages = packages
+			return nil
+		}},
+	}
+}
+
+// imageTag makes version usable as an image tag, which can't hold the + of a go module version.
+func imageTag(version string) string {
+	return strings.ReplaceAll(version, "+", "-")
+}
+
+// packageSet is what the packages step installs beyond the base packages.
+func (d *buildDeps) packageSet() configure.PackageSet {
+	return configure.PackageSet{Extra: d.cfg.Packages, Containerd: d.profile.KubernetesEnabled(), Kernel: d.cfg.Kernel.Pin, Removal: d.cfg.Removal}
+}
+
+func layerCacheKey(fileSystem afero.Fs, d distro.Distro, source media.Source, cfg config.Config, packages configure.PackageSet, pins configure.PackagePins) (string, error) {
+	baseImageHash, hashErr := source.Checksum(fileSystem)
+	if hashErr != nil {
+		return "", hashErr
+	}
+	overrides, overridesErr := configure.OverrideHashes()
+	if overridesErr != nil {
+		return "", overridesErr
+	}
+	containerdPackage := ""
+	if packages.Containerd {
+		containerdPackage = configure.ContainerdPackage
+	}
+	return cache.Key(cache.KeyInputs{
+		BaseImageHash:     baseImageHash,
+		Packages:          append(append([]string(nil), configure.BasePackages...), packages.Extra...),
+		Repos:             []configure.Deb822Repo{configure.DockerRepo(d)},
+		KubernetesVersion: cfg.Kubernetes.Kubernetes,
+		CriCtlVersion:     cfg.Kubernetes.CriCtl,
+		CNIVersion:        cfg.Kubernetes.CNI,
+		ContainerdPackage: containerdPackage,
+		PreloadImages:     cfg.PreloadImages,
+		PackagePins:       pins.Versions,
+		KernelPin:         packages.Kernel.Versions(),
+		Purge:             packages.Removal.Packages(),
+		Mask:              packages.Removal.Units(),
+		CgroupMode:        cfg.CgroupMode,
+		FileOverrides:     overrides,
+	})
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/cache"
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/manifest"
+	"github.com/LadySerena/pi-image-builder/pipeline"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func stepIndex(steps []pipeline.Step, name string) int {
+	for i, step := range steps {
+		if step.Name() == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestLayerSavedAfterLastCacheableStep(t *testing.T) {
+	steps := buildSteps(&buildDeps{})
+	save := stepIndex(steps, "layer-save")
+	assert.Equal(t, stepIndex(steps, "preload-images")+1, save)
+	for _, name := range []string{"extra-files", "kubelet-config", "registry-credentials", "kubeadm", "cloudinit", "wifi", "release"} {
+		assert.Greater(t, stepIndex(steps, name), save, name)
+	}
+}
+
+func TestRestoredLayerLeavesOutLaterSteps(t *testing.T) {
+	ctx := context.Background()
+	root := afero.NewMemMapFs()
+	// stands in for what the cacheable steps installed
+	assert.NoError(t, afero.WriteFile(root, "/etc/containerd/config.toml", []byte("version = 2\n"), 0644))
+
+	deps := &buildDeps{
+		target:     configure.Target{Fs: root},
+		layerStore: cache.NewStore(afero.NewMemMapFs(), "/layers"),
+		layerKey:   "layer",
+		saveLayer:  true,
+	}
+	deps.cfg.RegistryCredentials.Auths = map[string]configure.RegistryAuth{"registry.lan:5000": {Username: "kat", Password: "s3cret"}}
+	steps, onlyErr := pipeline.Only(buildSteps(deps), []string{"layer-save", "registry-credentials"})
+	assert.NoError(t, onlyErr)
+	assert.NoError(t, pipeline.Run(ctx, steps, pipeline.Selection{}, &pipeline.BuildState{Manifest: manifest.New()}))
+	written, _ := afero.Exists(root, "/var/lib/kubelet/config.json")
+	assert.True(t, written)
+
+	restored := afero.NewMemMapFs()
+	assert.NoError(t, deps.layerStore.Restore(ctx, restored, "layer"))
+	cached, _ := afero.Exists(restored, "/etc/containerd/config.toml")
+	assert.True(t, cached)
+	credentials, _ := afero.Exists(restored, "/var/lib/kubelet/config.json")
+	assert.False(t, credentials)
+}
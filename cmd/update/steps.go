@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+
+	"github.com/LadySerena/pi-image-builder/config"
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/distro"
+	"github.com/LadySerena/pi-image-builder/media"
+	"github.com/LadySerena/pi-image-builder/pipeline"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+// updateDeps is what the update steps need, it's filled in once the device is mounted.
+type updateDeps struct {
+	localFs afero.Fs
+	// target is the device's root volume with the rest of its volumes mounted underneath
+	target    configure.Target
+	cfg       config.Config
+	distro    distro.Distro
+	profile   config.Profile
+	workspace media.Workspace
+	device    string
+	// filesDir holds the sources of the config's extra files
+	filesDir string
+	// downloadCacheDir is where verified kubernetes artifacts are kept, empty downloads them every time
+	downloadCacheDir string
+}
+
+// fixupBoot points cmdline.txt and fstab back at the device's own volumes after a step rewrote them from the image's
+// defaults, the same way flashing does.
+func (d *updateDeps) fixupBoot(ctx context.Context) error {
+	return media.FixupBoot(ctx, utility.ExecRunner{}, d.localFs, d.workspace, d.device, d.cfg.Mounts, d.cfg.VolumeLayout)
+}
+
+// updateSteps are the configure steps that can be run again on a flashed device, with the same names setup gives
+// them. Steps that only make sense while building, like the layer cache or stamping the release, and the hostname
+// flash writes per card, aren't offered.
+func updateSteps(deps *updateDeps) []pipeline.Step {
+	return []pipeline.Step{
+		pipeline.Func{StepName: "kernel", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			if err := configure.KernelSettings(ctx, deps.target.Fs, deps.distro, deps.cfg.Kernel, deps.cfg.CgroupMode); err != nil {
+				return err
+			}
+			return deps.fixupBoot(ctx)
+		}},
+		pipeline.Func{StepName: "modules", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.KernelModules(ctx, deps.target.Fs, deps.cfg.Sysctls)
+		}},
+		pipeline.Func{StepName: "journald", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Journald(ctx, deps.target.Fs, deps.cfg.Journald)
+		}},
+		pipeline.Func{StepName: "packages", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			packages := configure.PackageSet{Extra: deps.cfg.Packages, Containerd: deps.profile.KubernetesEnabled(), Kernel: deps.cfg.Kernel.Pin, Removal: deps.cfg.Removal}
+			return configure.Packages(ctx, deps.target.Chroot, deps.target.Fs, deps.distro, deps.cfg.CgroupMode, packages, configure.PackagePins{})
+		}},
+		pipeline.Func{StepName: "kernel-verify", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.VerifyKernel(ctx, deps.target.Fs, deps.cfg.Kernel.Pin)
+		}},
+		pipeline.Func{StepName: "hardware", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Hardware(ctx, deps.target.Chroot, deps.target.Fs, deps.localFs, deps.cfg.Hardware, deps.cfg.Kernel.Pin)
+		}},
+		pipeline.Func{StepName: "serial-console", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.SerialConsole(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Kernel.Serial)
+		}},
+		pipeline.Func{StepName: "watchdog", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Watchdog(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Watchdog)
+		}},
+		pipeline.Func{StepName: "registration", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Registration(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Registration)
+		}},
+		pipeline.Func{StepName: "extra-files", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			_, err := configure.ExtraFiles(ctx, deps.target.Chroot, deps.target.Fs, deps.localFs, deps.filesDir, deps.cfg.ExtraFiles)
+			return err
+		}},
+		pipeline.Func{StepName: "kubernetes", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.InstallKubernetes(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Kubernetes, deps.cfg.CgroupMode, deps.downloadCacheDir)
+		}},
+		pipeline.Func{StepName: "preload-images", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.PreloadImages(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.PreloadImages)
+		}},
+		pipeline.Func{StepName: "kubelet-config", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.KubeletConfiguration(ctx, deps.target.Fs, deps.cfg.Kubelet, deps.cfg.CgroupMode)
+		}},
+		pipeline.Func{StepName: "registry-credentials", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.RegistryCredentials(ctx, deps.target.Fs, deps.cfg.RegistryCredentials)
+		}},
+		pipeline.Func{StepName: "helm", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			if deps.cfg.Helm.Version == "" {
+				return nil
+			}
+			if err := configure.InstallHelm(ctx, deps.target.Fs, deps.cfg.Helm.Version); err != nil {
+				return err
+			}
+			return configure.VendorHelmCharts(ctx, utility.ExecRunner{}, deps.target.Fs, deps.cfg.Helm.Charts)
+		}},
+		pipeline.Func{StepName: "node-exporter", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.NodeExporter(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.NodeExporter)
+		}},
+		pipeline.Func{StepName: "longhorn", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Longhorn(ctx, deps.target.Chroot, deps.target.Fs)
+		}},
+		pipeline.Func{StepName: "zram", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Zram(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Zram)
+		}},
+		pipeline.Func{StepName: "upgrades", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.UnattendedUpgrades(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Upgrades)
+		}},
+		pipeline.Func{StepName: "kubeadm", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.KubeadmBootstrap(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Kubeadm)
+		}},
+		pipeline.Func{StepName: "cloudinit", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.CloudInit(ctx, deps.target.Fs, deps.cfg.CloudInit)
+		}},
+		pipeline.Func{StepName: "ssh", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.SSHHardening(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.SSH)
+		}},
+		pipeline.Func{StepName: "firewall", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.Firewall(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.Firewall.ForKubeadmMode(deps.cfg.Kubeadm.Mode))
+		}},
+		pipeline.Func{StepName: "system", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.SystemSettings(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.System)
+		}},
+		pipeline.Func{StepName: "wifi", Chroot: true, Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			return configure.WiFi(ctx, deps.target.Chroot, deps.target.Fs, deps.cfg.WiFi)
+		}},
+		pipeline.Func{StepName: "fstab", Fn: func(ctx context.Context, _ *pipeline.BuildState) error {
+			if err := configure.Fstab(ctx, deps.target.Fs, deps.cfg.Mounts, deps.cfg.VolumeLayout); err != nil {
+				return err
+			}
+			return deps.fixupBoot(ctx)
+		}},
+	}
+}
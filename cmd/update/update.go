@@ -0,0 +1,289 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/config"
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/distro"
+	"github.com/LadySerena/pi-image-builder/manifest"
+	"github.com/LadySerena/pi-image-builder/media"
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/LadySerena/pi-image-builder/pipeline"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	flag "github.com/spf13/pflag"
+)
+
+// cleanupTimeout bounds unmounting the device, it runs on a context of its own so an interrupted update still leaves
+// the card safe to pull.
+const cleanupTimeout = 5 * time.Minute
+
+// updateFlags are the parsed command line flags.
+type updateFlags struct {
+	device           string
+	configPath       string
+	profile          string
+	steps            []string
+	listSteps        bool
+	kubernetes       configure.KubernetesVersions
+	downloadCacheDir string
+	filesDir         string
+	allowFixed       bool
+	yes              bool
+	wait             bool
+	workDir          string
+}
+
+func main() {
+	device := flag.StringP("device", "d", "", "flashed device to update in place")
+	configPath := flag.StringP("config", "c", "", "path to a yaml build config, defaults are used when empty")
+	profile := flag.String("profile", "", "image variant the device was built as, defaults to the config file's profile or "+config.DefaultProfile)
+	steps := flag.StringSlice("step", nil, "configure step to run on the device, repeat or comma separate for several, nothing runs unless it's named")
+	listSteps := flag.Bool("list-steps", false, "print the steps that can be run on a flashed device, then exit")
+	kubernetesVersion := flag.String("kubernetes-version", "", "kubernetes release to install, overrides the config file's, e.g. v1.25.3 or stable-1.25")
+	criCtlVersion := flag.String("crictl-version", "", "crictl release to install, overrides the config file's")
+	cniVersion := flag.String("cni-version", "", "cni plugins release to install, overrides the config file's")
+	downloadCacheDir := flag.String("download-cache-dir", "", "directory to keep verified kubernetes artifacts in")
+	filesDir := flag.String("files-dir", "", "directory the config's extra files are copied onto the device from")
+	allowFixed := flag.Bool("allow-fixed", false, "update a device the kernel doesn't report as removable")
+	yes := flag.BoolP("yes", "y", false, "skip the confirmation prompt so updates can be scripted")
+	wait := flag.Bool("wait", false, "wait for a flash or update of the same device to finish instead of failing")
+	workDir := flag.String("work-dir", "", "directory for the device's mount points, defaults to a new timestamped directory under "+media.WorkspaceRoot)
+	logOptions := telemetry.LogFlags(flag.CommandLine)
+	flag.BoolVar(&configure.ForceEmulation, "force-emulation", false, "run the device's binaries through qemu even on an arm64 host, for testing the emulated path")
+	flag.BoolVar(&media.LazyUnmount, "lazy-unmount", media.LazyUnmount, "lazily unmount the device if it's still busy after retrying, instead of failing cleanup")
+	flag.Parse()
+
+	logger, logErr := logOptions.NewLogger(os.Stderr)
+	if logErr != nil {
+		fmt.Fprintln(os.Stderr, logErr)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	flags := updateFlags{
+		device:           *device,
+		configPath:       *configPath,
+		profile:          *profile,
+		steps:            *steps,
+		listSteps:        *listSteps,
+		kubernetes:       configure.KubernetesVersions{Kubernetes: *kubernetesVersion, CriCtl: *criCtlVersion, CNI: *cniVersion},
+		downloadCacheDir: *downloadCacheDir,
+		filesDir:         *filesDir,
+		allowFixed:       *allowFixed,
+		yes:              *yes,
+		wait:             *wait,
+		workDir:          *workDir,
+	}
+
+	// an interrupt stops the update between commands, the device is still unmounted on the way out
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, flags); err != nil {
+		logger.Error("update failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, flags updateFlags) (err error) {
+	deps := &updateDeps{}
+	steps := updateSteps(deps)
+	if flags.listSteps {
+		for _, step := range steps {
+			fmt.Println(step.Name())
+		}
+		return nil
+	}
+
+	// re-running everything would be a rebuild, with none of the checks a build has, so steps are only ever run by name
+	if len(flags.steps) == 0 {
+		return errors.New("name the steps to run with --step, --list-steps prints them")
+	}
+	selected, onlyErr := pipeline.Only(steps, flags.steps)
+	if onlyErr != nil {
+		return onlyErr
+	}
+	if !strings.HasPrefix(flags.device, "/dev") {
+		return fmt.Errorf("you must specify a valid block device, got: %q", flags.device)
+	}
+
+	localFs := afero.NewOsFs()
+	cfg, configErr := config.Load(localFs, flags.configPath)
+	if configErr != nil {
+		return fmt.Errorf("error loading config: %w", configErr)
+	}
+	profile, profileErr := cfg.LookupProfile(flags.profile)
+	if profileErr != nil {
+		return profileErr
+	}
+	for _, step := range selected {
+		if profile.Skipped()[step.Name()] {
+			return fmt.Errorf("profile %s doesn't include the %s step", profile.Name, step.Name())
+		}
+	}
+	cfg = cfg.WithProfile(profile)
+	baseImage, distroErr := distro.Lookup(cfg.Distro)
+	if distroErr != nil {
+		return fmt.Errorf("error loading config: %w", distroErr)
+	}
+
+	commands := append([]string(nil), utility.UpdateCommands...)
+	if len(cfg.VolumeLayout.Encrypted()) != 0 {
+		commands = append(commands, "cryptsetup")
+	}
+	if err := utility.CheckHostDependencies(commands); err != nil {
+		return err
+	}
+
+	cfg.Kubernetes = overrideVersions(cfg.Kubernetes, flags.kubernetes)
+	versions, versionErr := cfg.Kubernetes.Resolve(ctx)
+	if versionErr != nil {
+		return fmt.Errorf("error picking kubernetes versions: %w", versionErr)
+	}
+	cfg.Kubernetes = versions
+
+	runner := utility.ExecRunner{}
+	// a flash or another update of the same card would be writing to it underneath this one
+	lock, lockErr := utility.AcquireLock(ctx, utility.DeviceLockPath(flags.device), flags.wait)
+	if lockErr != nil {
+		return fmt.Errorf("could not lock %s for updating: %w", flags.device, lockErr)
+	}
+	defer func() {
+		if releaseErr := lock.Release(); releaseErr != nil {
+			slog.Warn("could not release device lock", "device", flags.device, "error", releaseErr)
+		}
+	}()
+
+	// the device is mounted here, so anything already mounting it would see its files change underneath it
+	policy := partition.SafetyPolicy{AllowFixed: flags.allowFixed, MaxSize: partition.DefaultMaxDeviceSize}
+	target, inspectErr := partition.InspectDevice(ctx, runner, flags.device)
+	if inspectErr != nil {
+		return fmt.Errorf("could not inspect target device: %w", inspectErr)
+	}
+	if err := policy.Check(target); err != nil {
+		return err
+	}
+	fmt.Print(partition.DescribeDevice(target))
+	names := make([]string, 0, len(selected))
+	for _, step := range selected {
+		names = append(names, step.Name())
+	}
+	if !flags.yes && !utility.ConfirmDialog("are you sure you want to run %s on %s: [Y/n]: ", strings.Join(names, ", "), flags.device) {
+		fmt.Println("nope")
+		return nil
+	}
+
+	workspace := media.Workspace{Dir: flags.workDir}
+	if flags.workDir == "" {
+		workspace = media.NewWorkspace(time.Now())
+	}
+	if err := workspace.Create(); err != nil {
+		return err
+	}
+
+	deviceTarget, targetErr := configure.NewTarget(localFs, workspace.MediaRoot(), cfg.Chroot, runner)
+	if targetErr != nil {
+		return fmt.Errorf("error picking how to run commands on the device: %w", targetErr)
+	}
+	volumes := media.VolumeMounts(cfg.Mounts, cfg.VolumeLayout)
+	cryptNames := make([]string, 0)
+	for _, volume := range cfg.VolumeLayout.Encrypted() {
+		cryptNames = append(cryptNames, utility.CryptName(volume.Name))
+	}
+
+	resolvReplaced := false
+	defer func() {
+		// the update's context may be what failed it, cleanup keeps its values but not its cancellation
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+		defer cancel()
+
+		if removeErr := configure.RemoveBinfmt(cleanupCtx, deviceTarget.Fs); removeErr != nil {
+			slog.Warn("could not remove qemu interpreter from device", "error", removeErr)
+		}
+		if resolvReplaced {
+			if restoreErr := media.RestoreResolvConf(localFs, workspace); restoreErr != nil {
+				err = errors.Join(err, fmt.Errorf("could not restore the device's resolv.conf: %w", restoreErr))
+			}
+		}
+		cleanup := media.MediaCleanup{Device: flags.device, Volumes: volumes, CryptNames: cryptNames}
+		if cleanupErr := media.CleanupMedia(cleanupCtx, runner, workspace, cleanup); cleanupErr != nil {
+			err = errors.Join(err, fmt.Errorf("could not clean up, unmount %s by hand before pulling the device: %w", workspace.MediaRoot(), cleanupErr))
+			return
+		}
+		if removeErr := workspace.Remove(); removeErr != nil {
+			slog.Warn("could not remove work dir", "work_dir", workspace.Dir, "error", removeErr)
+		}
+	}()
+
+	if err := media.MountFlashed(ctx, runner, localFs, workspace, flags.device, cfg.VolumeLayout, volumes); err != nil {
+		return fmt.Errorf("could not mount device: %w", err)
+	}
+	if err := media.UseHostResolvConf(localFs, workspace); err != nil {
+		return fmt.Errorf("could not configure name resolution on the device: %w", err)
+	}
+	resolvReplaced = true
+	// steps that only write files don't need the device's binaries to run on this host
+	if pipeline.NeedsChroot(selected) {
+		if err := configure.EnsureBinfmt(ctx, deviceTarget.Fs); err != nil {
+			return err
+		}
+	}
+
+	deps.localFs = localFs
+	deps.target = deviceTarget
+	deps.cfg = cfg
+	deps.distro = baseImage
+	deps.profile = profile
+	deps.workspace = workspace
+	deps.device = flags.device
+	deps.downloadCacheDir = flags.downloadCacheDir
+	deps.filesDir = flags.filesDir
+
+	state := &pipeline.BuildState{Manifest: manifest.New()}
+	if err := pipeline.Run(ctx, selected, pipeline.Selection{}, state); err != nil {
+		return err
+	}
+	slog.Info("updated device", "device", flags.device, "steps", strings.Join(names, ","))
+	return nil
+}
+
+// overrideVersions replaces the configured kubernetes versions with the ones set on the command line.
+func overrideVersions(versions configure.KubernetesVersions, overrides configure.KubernetesVersions) configure.KubernetesVersions {
+	if overrides.Kubernetes != "" {
+		versions.Kubernetes = overrides.Kubernetes
+	}
+	if overrides.CriCtl != "" {
+		versions.CriCtl = overrides.CriCtl
+	}
+	if overrides.CNI != "" {
+		versions.CNI = overrides.CNI
+	}
+	return versions
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/LadySerena/pi-image-builder/media"
+	"github.com/LadySerena/pi-image-builder/smoke"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	flag "github.com/spf13/pflag"
+)
+
+func main() {
+	defaults := smoke.DefaultConfig()
+
+	imagePath := flag.StringP("image", "i", "", "raw image built by setup to boot")
+	workDir := flag.String("work-dir", "./smoke-work", "directory for the extracted kernel and the disk overlay")
+	consoleLog := flag.String("console-log", "./smoke-console.log", "where the captured serial console is written")
+	timeout := flag.Duration("timeout", defaults.Timeout, "how long to wait for cloud-init and the kubelet")
+	machine := flag.String("machine", defaults.Machine, "qemu machine model")
+	dtb := flag.String("dtb", defaults.DTB, "device tree on the image's boot partition matching the machine model")
+	memory := flag.String("memory", defaults.Memory, "guest memory")
+	logOptions := telemetry.LogFlags(flag.CommandLine)
+
+	flag.Parse()
+
+	logger, logErr := logOptions.NewLogger(os.Stderr)
+	if logErr != nil {
+		fmt.Fprintln(os.Stderr, logErr)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	cfg := defaults
+	cfg.Timeout = *timeout
+	cfg.Machine = *machine
+	cfg.DTB = *dtb
+	cfg.Memory = *memory
+
+	if err := run(context.Background(), cfg, *imagePath, *workDir, *consoleLog); err != nil {
+		logger.Error("smoke test failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, cfg smoke.Config, imagePath string, workDir string, consoleLog string) (err error) {
+	if imagePath == "" {
+		return errors.New("you must specify a valid disk image")
+	}
+
+	localFs := afero.NewOsFs()
+	runner := utility.ExecRunner{}
+	workspace := media.Workspace{Dir: workDir}
+
+	image, absErr := filepath.Abs(imagePath)
+	if absErr != nil {
+		return fmt.Errorf("could not resolve image path: %w", absErr)
+	}
+	info, statErr := localFs.Stat(image)
+	if statErr != nil {
+		return fmt.Errorf("could not stat image: %w", statErr)
+	}
+
+	entry, loopErr := media.MountImageToDevice(ctx, image)
+	if loopErr != nil {
+		return fmt.Errorf("could not create loop device for image: %w", loopErr)
+	}
+	if err := media.AttachToMountPoint(ctx, localFs, workspace, entry, false); err != nil {
+		return fmt.Errorf("could not attach loop device: %s to mount points: %w", entry.Name, err)
+	}
+	files, extractErr := smoke.ExtractBootFiles(localFs, workspace.BootMount(), workDir, cfg)
+	// qemu opens the image through the overlay, it can't stay mounted here
+	if err := media.CleanupImage(ctx, runner, localFs, workspace, entry, ""); err != nil {
+		return fmt.Errorf("could not unmount image: %w", err)
+	}
+	if extractErr != nil {
+		return fmt.Errorf("could not extract boot files: %w", extractErr)
+	}
+
+	overlay := filepath.Join(workDir, "overlay.qcow2")
+	if err := localFs.Remove(overlay); err != nil && !errors.Is(err, afero.ErrFileNotFound) {
+		return fmt.Errorf("could not remove old overlay: %w", err)
+	}
+	if err := runner.Run(ctx, exec.Command("qemu-img", smoke.OverlayArgs(image, overlay, info.Size())...)); err != nil { //nolint:gosec
+		return fmt.Errorf("could not create disk overlay: %w", err)
+	}
+
+	logFile, logErr := localFs.Create(consoleLog)
+	if logErr != nil {
+		return fmt.Errorf("could not create console log: %w", logErr)
+	}
+	defer utility.CloseWithErr(logFile, &err)
+
+	bootCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	qemu := exec.CommandContext(bootCtx, cfg.Binary, smoke.Args(cfg, files, overlay)...) //nolint:gosec
+	console, pipeErr := qemu.StdoutPipe()
+	if pipeErr != nil {
+		return fmt.Errorf("could not capture serial console: %w", pipeErr)
+	}
+	if err := qemu.Start(); err != nil {
+		return fmt.Errorf("could not start qemu: %w", err)
+	}
+
+	result := smoke.Watch(bootCtx, console, logFile, smoke.DefaultMarkers(), smoke.DefaultFailures())
+	cancel()
+	_ = qemu.Wait()
+
+	if !result.Passed {
+		if result.Line != "" {
+			slog.Error("last console line before failing", "line", result.Line)
+		}
+		return fmt.Errorf("%s, full console log in %s", result.Reason, consoleLog)
+	}
+	fmt.Printf("smoke test passed, console log in %s\n", consoleLog)
+	return nil
+}
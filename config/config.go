@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/media"
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the on disk build configuration. Anything not set in the file keeps the value from Default.
+type Config struct {
+	// Distro is the base image, ubuntu or raspios. Empty is ubuntu.
+	Distro string `yaml:"distro"`
+	// PreloadImages are fully qualified image references pulled at build time and imported into containerd on
+	// first boot. An empty list skips the step.
+	PreloadImages []string `yaml:"preloadImages"`
+	// Kubeadm configures the first boot kubeadm join/init, leaving the mode empty skips it.
+	Kubeadm configure.KubeadmConfig `yaml:"kubeadm"`
+	// CloudInit is rendered into the cloud-init user drop in.
+	CloudInit configure.CloudInitConfig `yaml:"cloudInit"`
+	// WiFi enables a wireless interface, an empty ssid keeps the image wired only.
+	WiFi configure.WiFiConfig `yaml:"wifi"`
+	// HostnamePattern names each device on first boot, e.g. pi-{serial8}. Empty keeps cloud-init's hostname.
+	HostnamePattern string `yaml:"hostnamePattern"`
+	// System sets timezone, locale, and ntp servers, unset fields keep the distro defaults.
+	System configure.SystemConfig `yaml:"system"`
+	// SSH hardens sshd, the zero value is key only auth with per device host keys.
+	SSH configure.SSHConfig `yaml:"ssh"`
+	// Firewall renders the nftables ruleset, set disabled to rely on an external firewall instead.
+	Firewall configure.FirewallConfig `yaml:"firewall"`
+	// Upgrades configures unattended-upgrades, kernel and containerd packages are held back by default.
+	Upgrades configure.UpgradesConfig `yaml:"upgrades"`
+	// Journald caps journal size, logs are kept in memory unless storage is persistent.
+	Journald configure.JournaldConfig `yaml:"journald"`
+	// Zram adds compressed swap, off by default so kubeadm's swap preflight check is untouched.
+	Zram configure.ZramConfig `yaml:"zram"`
+	// Registration announces each node to a provisioning api on first boot, off unless a url is set.
+	Registration configure.RegistrationConfig `yaml:"registration"`
+	// Watchdog reboots a hung node through the hardware watchdog, off by default.
+	Watchdog configure.WatchdogConfig `yaml:"watchdog"`
+	// Sysctls are merged into the kubernetes and cilium defaults, these values win on conflict.
+	Sysctls configure.Sysctl `yaml:"sysctls"`
+	// CgroupMode is unified for cgroup v2 with the systemd driver or legacy for v1 with cgroupfs. It sets the kernel
+	// command line, containerd, and the kubelet together.
+	CgroupMode configure.CgroupMode `yaml:"cgroupMode"`
+	// Kernel builds cmdline.txt and usercfg.txt, anything unset keeps the stock values.
+	Kernel configure.KernelConfig `yaml:"kernel"`
+	// Hardware installs overlays and dkms modules for hats the stock image doesn't support.
+	Hardware configure.HardwareConfig `yaml:"hardware"`
+	// ExtraFiles are copied into the image from --files-dir, with commands to run once they're in place.
+	ExtraFiles configure.ExtraFilesConfig `yaml:"extraFiles"`
+	// Mounts replace the default fstab entries when set.
+	Mounts []configure.Mount `yaml:"mounts"`
+	// VolumeLayout sizes the logical volumes created when flashing, keep it in sync with Mounts.
+	VolumeLayout partition.VolumeLayout `yaml:"volumeLayout"`
+	// Expand grows the csi volume into whatever space a bigger card leaves free on first boot, set disabled to skip it.
+	Expand configure.ExpandConfig `yaml:"expand"`
+	// Source is where the image comes from, the distro's published image unless it's debootstrapped from scratch.
+	Source media.SourceConfig `yaml:"source"`
+	// Kubernetes pins the kubeadm, kubelet, kubectl, crictl, and cni releases installed in the image.
+	Kubernetes configure.KubernetesVersions `yaml:"kubernetes"`
+	// Kubelet is rendered into the kubelet's config file, unset fields get defaults sized for a pi.
+	Kubelet configure.KubeletConfig `yaml:"kubelet"`
+	// RegistryCredentials are baked in for pulling from private registries, nothing is written without any.
+	RegistryCredentials configure.RegistryCredentialsConfig `yaml:"registryCredentials"`
+	// Helm installs the helm binary and vendors charts for installing right after kubeadm init, an empty version skips
+	// it.
+	Helm configure.HelmConfig `yaml:"helm"`
+	// NodeExporter runs prometheus' node_exporter on every node, set disabled to skip it.
+	NodeExporter configure.NodeExporterConfig `yaml:"nodeExporter"`
+	// Sanitize removes build leftovers before the image is compressed, each clean up can be kept individually.
+	Sanitize configure.SanitizeConfig `yaml:"sanitize"`
+	// Compact trims the image's free space and makes the image file sparse before it's compressed.
+	Compact bool `yaml:"compact"`
+	// Shrink resizes the root filesystem and its partition to their minimum and truncates the image file to match.
+	// First boot grows them back to fill the disk.
+	Shrink bool `yaml:"shrink"`
+	// Outputs are the artifacts published from the image, raw for flashing and qcow2 for booting in a vm.
+	Outputs []media.OutputFormat `yaml:"outputs"`
+	// Channel labels the build, e.g. stable or canary. It's stamped into /etc/pi-image-builder-release.
+	Channel string `yaml:"channel"`
+	// HTTP configures proxies and extra certificate authorities for every download.
+	HTTP utility.HTTPConfig `yaml:"http"`
+	// Chroot is how commands run inside the image: nspawn, chroot, or auto to use nspawn when the host has it.
+	Chroot string `yaml:"chroot"`
+	// Packages are installed alongside the base packages, a profile's packages are added to them.
+	Packages []string `yaml:"packages"`
+	// Removal purges packages from the base image and masks units that can't be purged.
+	Removal configure.RemovalConfig `yaml:"removal"`
+	// Profile is the image variant built when --profile isn't given, empty is DefaultProfile.
+	Profile string `yaml:"profile"`
+	// Profiles define variants beyond the built in ones, or replace a built in one with the same name.
+	Profiles []Profile `yaml:"profiles"`
+	// Assertions are checked against the configured image on top of the default ones, a failure stops it from being
+	// published.
+	Assertions configure.Assertions `yaml:"assertions"`
+}
+
+func Default() Config {
+	return Config{
+		CloudInit:    configure.DefaultCloudInitConfig(),
+		Upgrades:     configure.DefaultUpgradesConfig(),
+		VolumeLayout: partition.DefaultVolumeLayout(),
+		Kubernetes:   configure.DefaultKubernetesVersions(),
+		Outputs:      []media.OutputFormat{media.OutputRaw},
+	}
+}
+
+// Load reads the yaml config at path on top of Default. An empty path returns the defaults.
+func Load(fileSystem afero.Fs, path string) (Config, error) {
+	cfg := Default()
+	if path == "" {
+		return cfg, nil
+	}
+
+	raw, readErr := afero.ReadFile(fileSystem, path)
+	if readErr != nil {
+		return cfg, readErr
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, fmt.Errorf("could not parse config %s: %w", path, err)
+	}
+
+	if cfg.SSH.PasswordAuthentication == nil {
+		passwordAuth := cfg.CloudInit.PasswordAuth
+		cfg.SSH.PasswordAuthentication = &passwordAuth
+	}
+
+	if cfg.Zram.Enabled {
+		cfg.Kubeadm.AllowSwap = true
+	}
+
+	if cfg.Watchdog.Daemon.Enabled && cfg.Watchdog.Daemon.Ping == nil && cfg.CloudInit.Network != nil && cfg.CloudInit.Network.Gateway4 != "" {
+		cfg.Watchdog.Daemon.Ping = []string{cfg.CloudInit.Network.Gateway4}
+	}
+
+	if cfg.Firewall.SSHPort == 0 {
+		cfg.Firewall.SSHPort = cfg.SSH.Port
+	}
+
+	// sanitizing would delete the host keys pregenerate just baked in
+	if cfg.SSH.HostKeys == configure.HostKeysPregenerate {
+		cfg.Sanitize.KeepSSHHostKeys = true
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"context"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadKeepsPregeneratedHostKeys(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "pregenerate.yaml", []byte("ssh:\n  hostKeys: pregenerate\n"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, "regenerate.yaml", []byte("ssh:\n  hostKeys: regenerate\n"), 0644))
+
+	pregenerate, err := Load(fs, "pregenerate.yaml")
+	assert.NoError(t, err)
+	assert.True(t, pregenerate.Sanitize.KeepSSHHostKeys)
+	regenerate, err := Load(fs, "regenerate.yaml")
+	assert.NoError(t, err)
+	assert.False(t, regenerate.Sanitize.KeepSSHHostKeys)
+
+	// the keys ssh-keygen -A baked in are still there once the image is sanitized
+	image := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(image, "/etc/ssh/ssh_host_ed25519_key", []byte("private"), 0600))
+	assert.NoError(t, configure.Sanitize(context.Background(), image, pregenerate.Sanitize))
+	exists, err := afero.Exists(image, "/etc/ssh/ssh_host_ed25519_key")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
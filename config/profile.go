@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/configure"
+)
+
+// DefaultProfile is built when neither --profile nor the config file picks one, it's the image this builder has
+// always made.
+const DefaultProfile = "k8s-worker"
+
+// KubernetesSteps are left out of profiles with kubernetes turned off.
+var KubernetesSteps = []string{"kubernetes", "preload-images", "kubelet-config", "registry-credentials", "helm", "longhorn", "kubeadm"}
+
+// Profile is a named image variant, the configure steps it leaves out and the settings it layers over the config
+// file.
+type Profile struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	// Kubernetes installs containerd and the kubernetes steps, nil is on.
+	Kubernetes *bool `yaml:"kubernetes"`
+	// Skip are more steps the profile leaves out, every other step runs in the usual order.
+	Skip []string `yaml:"skip"`
+	// Packages are installed alongside the base packages.
+	Packages []string `yaml:"packages"`
+	// KubeadmMode replaces the config file's kubeadm mode when set, e.g. init for a control plane.
+	KubeadmMode string `yaml:"kubeadmMode"`
+	// CloudInit replaces the config file's cloud-init values when set.
+	CloudInit *configure.CloudInitConfig `yaml:"cloudInit"`
+	// Sysctls are merged over the config file's, the profile wins on conflict.
+	Sysctls configure.Sysctl `yaml:"sysctls"`
+	// Assertions are checked alongside the config file's.
+	Assertions configure.Assertions `yaml:"assertions"`
+}
+
+// BuiltinProfiles are available without defining them in the config file.
+func BuiltinProfiles() []Profile {
+	disabled := false
+	return []Profile{
+		{
+			Name:        DefaultProfile,
+			Description: "kubernetes node that joins an existing cluster with kubeadm",
+		},
+		{
+			Name:        "k8s-control-plane",
+			Description: "kubernetes node that runs kubeadm init on first boot",
+			KubeadmMode: configure.KubeadmInit,
+		},
+		{
+			Name:        "hardened",
+			Description: "the base image with ssh, firewall, and upgrade hardening, without containerd or kubernetes",
+			Kubernetes:  &disabled,
+		},
+	}
+}
+
+// KubernetesEnabled reports whether the profile builds a kubernetes node.
+func (p Profile) KubernetesEnabled() bool {
+	return p.Kubernetes == nil || *p.Kubernetes
+}
+
+// Skipped are the steps the profile leaves out.
+func (p Profile) Skipped() map[string]bool {
+	skipped := make(map[string]bool, len(p.Skip)+len(KubernetesSteps))
+	for _, step := range p.Skip {
+		skipped[step] = true
+	}
+	if !p.KubernetesEnabled() {
+		for _, step := range KubernetesSteps {
+			skipped[step] = true
+		}
+	}
+	return skipped
+}
+
+// Settings describes what the profile changes from the config file, one line per setting.
+func (p Profile) Settings() []string {
+	settings := make([]string, 0)
+	if !p.KubernetesEnabled() {
+		settings = append(settings, "kubernetes: off")
+	}
+	if len(p.Packages) != 0 {
+		settings = append(settings, "packages: "+strings.Join(p.Packages, ", "))
+	}
+	if p.KubeadmMode != "" {
+		settings = append(settings, "kubeadm mode: "+p.KubeadmMode)
+	}
+	if p.CloudInit != nil {
+		settings = append(settings, "cloud-init: user "+p.CloudInit.Username)
+	}
+	if len(p.Sysctls) != 0 {
+		keys := make([]string, 0, len(p.Sysctls))
+		for key := range p.Sysctls {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		settings = append(settings, "sysctls: "+strings.Join(keys, ", "))
+	}
+	if len(p.Assertions) != 0 {
+		paths := make([]string, 0, len(p.Assertions))
+		for _, assertion := range p.Assertions {
+			paths = append(paths, assertion.Path)
+		}
+		settings = append(settings, "assertions: "+strings.Join(paths, ", "))
+	}
+	return settings
+}
+
+// AvailableProfiles are the built in profiles followed by the config file's, a config profile with a built in's name
+// replaces it.
+func (c Config) AvailableProfiles() []Profile {
+	profiles := BuiltinProfiles()
+	for _, defined := range c.Profiles {
+		replaced := false
+		for i := range profiles {
+			if profiles[i].Name == defined.Name {
+				profiles[i] = defined
+				replaced = true
+			}
+		}
+		if !replaced {
+			profiles = append(profiles, defined)
+		}
+	}
+	return profiles
+}
+
+// LookupProfile finds the named profile, empty picks the config file's profile or DefaultProfile.
+func (c Config) LookupProfile(name string) (Profile, error) {
+	if name == "" {
+		name = c.Profile
+	}
+	if name == "" {
+		name = DefaultProfile
+	}
+	names := make([]string, 0)
+	for _, profile := range c.AvailableProfiles() {
+		if profile.Name == name {
+			return profile, nil
+		}
+		names = append(names, profile.Name)
+	}
+	return Profile{}, fmt.Errorf("unknown profile %q, pick one of: %s", name, strings.Join(names, ", "))
+}
+
+// WithProfile layers the profile's settings over the config.
+func (c Config) WithProfile(p Profile) Config {
+	c.Packages = append(append([]string(nil), c.Packages...), p.Packages...)
+	c.Assertions = append(append(configure.Assertions(nil), c.Assertions...), p.Assertions...)
+	if p.KubeadmMode != "" {
+		c.Kubeadm.Mode = p.KubeadmMode
+	}
+	if p.CloudInit != nil {
+		c.CloudInit = *p.CloudInit
+	}
+	if len(p.Sysctls) != 0 {
+		merged := make(configure.Sysctl, len(c.Sysctls)+len(p.Sysctls))
+		for key, value := range c.Sysctls {
+			merged[key] = value
+		}
+		for key, value := range p.Sysctls {
+			merged[key] = value
+		}
+		c.Sysctls = merged
+	}
+	return c
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupProfile(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "config.yaml", []byte(`profile: edge
+packages: [jq]
+sysctls:
+  vm.swappiness: "10"
+profiles:
+  - name: edge
+    description: worker with monitoring tools
+    skip: [helm]
+    packages: [iotop]
+    sysctls:
+      vm.swappiness: "1"
+      fs.inotify.max_user_watches: "524288"
+  - name: hardened
+    description: hardened with wifi left out
+    kubernetes: false
+    skip: [wifi]
+`), 0644))
+	cfg, err := Load(fs, "config.yaml")
+	assert.NoError(t, err)
+
+	edge, edgeErr := cfg.LookupProfile("")
+	assert.NoError(t, edgeErr)
+	assert.Equal(t, "edge", edge.Name)
+	assert.Equal(t, map[string]bool{"helm": true}, edge.Skipped())
+
+	built := cfg.WithProfile(edge)
+	assert.Equal(t, []string{"jq", "iotop"}, built.Packages)
+	assert.Equal(t, configure.Sysctl{"vm.swappiness": "1", "fs.inotify.max_user_watches": "524288"}, built.Sysctls)
+	assert.Equal(t, []string{"jq"}, cfg.Packages, "the loaded config isn't modified")
+
+	hardened, hardenedErr := cfg.LookupProfile("hardened")
+	assert.NoError(t, hardenedErr)
+	assert.Equal(t, "hardened with wifi left out", hardened.Description, "a config profile replaces the built in one")
+	assert.False(t, hardened.KubernetesEnabled())
+	assert.True(t, hardened.Skipped()["kubeadm"])
+	assert.True(t, hardened.Skipped()["wifi"])
+	assert.Len(t, cfg.AvailableProfiles(), 4)
+
+	_, unknownErr := cfg.LookupProfile("gpu")
+	assert.ErrorContains(t, unknownErr, "pick one of: k8s-worker, k8s-control-plane, hardened, edge")
+}
+
+func TestDefaultProfile(t *testing.T) {
+	cfg := Default()
+	profile, err := cfg.LookupProfile("")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultProfile, profile.Name)
+	assert.True(t, profile.KubernetesEnabled())
+	assert.Empty(t, profile.Skipped())
+	assert.Equal(t, cfg, cfg.WithProfile(profile))
+
+	controlPlane, controlErr := cfg.LookupProfile("k8s-control-plane")
+	assert.NoError(t, controlErr)
+	assert.Equal(t, configure.KubeadmInit, cfg.WithProfile(controlPlane).Kubeadm.Mode)
+	assert.Equal(t, []string{"kubeadm mode: init"}, controlPlane.Settings())
+}
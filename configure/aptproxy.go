@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/spf13/afero"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// aptProxyPath only exists while the image is being built, Sanitize removes it so flashed nodes don't keep using the
+// build machine's proxy.
+const aptProxyPath = "/etc/apt/apt.conf.d/00pi-image-builder-proxy"
+
+// AptProxy points apt inside the image at the build machine's proxies. systemd-nspawn doesn't pass the host's
+// environment through, so apt would otherwise try to reach the mirrors directly. Without any proxy the file is removed.
+func AptProxy(ctx context.Context, fs afero.Fs, proxies httpproxy.Config) error {
+	ctx, span := telemetry.Start(ctx, "apt proxy")
+	defer span.End()
+
+	conf := renderAptProxy(proxies)
+	if conf == "" {
+		return removeAptProxy(fs)
+	}
+	_, err := IdempotentWrite(ctx, fs, strings.NewReader(conf), aptProxyPath, 0644)
+	return err
+}
+
+func renderAptProxy(proxies httpproxy.Config) string {
+	var conf strings.Builder
+	if proxies.HTTPProxy != "" {
+		fmt.Fprintf(&conf, "Acquire::http::Proxy \"%s\";\n", proxies.HTTPProxy)
+	}
+	if proxies.HTTPSProxy != "" {
+		fmt.Fprintf(&conf, "Acquire::https::Proxy \"%s\";\n", proxies.HTTPSProxy)
+	}
+	if conf.Len() == 0 {
+		return ""
+	}
+	// apt only bypasses exact host names, domain suffixes, wildcards, and cidrs can't be expressed
+	for _, host := range strings.Split(proxies.NoProxy, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" || strings.ContainsAny(host, "*/:") || strings.HasPrefix(host, ".") {
+			continue
+		}
+		fmt.Fprintf(&conf, "Acquire::http::Proxy::%s \"DIRECT\";\nAcquire::https::Proxy::%s \"DIRECT\";\n", host, host)
+	}
+	return conf.String()
+}
+
+func removeAptProxy(fs afero.Fs) error {
+	if err := fs.Remove(aptProxyPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
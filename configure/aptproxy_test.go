@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http/httpproxy"
+)
+
+func TestAptProxy(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	proxies := httpproxy.Config{
+		HTTPProxy:  "http://proxy.lan:3128",
+		HTTPSProxy: "http://proxy.lan:3129",
+		NoProxy:    "mirror.lan, .internal,10.0.0.0/8",
+	}
+	assert.NoError(t, AptProxy(context.Background(), fs, proxies))
+
+	content, err := afero.ReadFile(fs, aptProxyPath)
+	assert.NoError(t, err)
+	assert.Equal(t, `Acquire::http::Proxy "http://proxy.lan:3128";
+Acquire::https::Proxy "http://proxy.lan:3129";
+Acquire::http::Proxy::mirror.lan "DIRECT";
+Acquire::https::Proxy::mirror.lan "DIRECT";
+`, string(content))
+
+	assert.NoError(t, AptProxy(context.Background(), fs, httpproxy.Config{NoProxy: "mirror.lan"}))
+	exists, existsErr := afero.Exists(fs, aptProxyPath)
+	assert.NoError(t, existsErr)
+	assert.False(t, exists, "without a proxy apt goes direct")
+
+	assert.NoError(t, AptProxy(context.Background(), fs, httpproxy.Config{}), "nothing to remove is fine")
+}
+
+func TestSanitizeRemovesAptProxy(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, AptProxy(context.Background(), fs, httpproxy.Config{HTTPProxy: "http://proxy.lan:3128"}))
+	assert.NoError(t, Sanitize(context.Background(), fs, SanitizeConfig{KeepAptCache: true}))
+	exists, err := afero.Exists(fs, aptProxyPath)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/c2h5oh/datasize"
+	"github.com/spf13/afero"
+)
+
+// DefaultMaxArchiveSize bounds how much a downloaded tarball may decompress to, the cni plugins are well under it.
+const DefaultMaxArchiveSize = 1 * datasize.GB
+
+// effectiveUID is overridden in tests, archive ownership is only kept when extracting as root.
+var effectiveUID = os.Geteuid
+
+// ErrUnsafeArchiveEntry is an archive entry that would be written outside the extraction root.
+type ErrUnsafeArchiveEntry struct {
+	Name   string
+	Reason string
+}
+
+func (e *ErrUnsafeArchiveEntry) Error() string {
+	return fmt.Sprintf("unsafe archive entry %q: %s", e.Name, e.Reason)
+}
+
+// ErrArchiveTooLarge is returned when a tarball decompresses to more than the allowed size.
+type ErrArchiveTooLarge struct {
+	Limit datasize.ByteSize
+}
+
+func (e *ErrArchiveTooLarge) Error() string {
+	return fmt.Sprintf("archive decompresses to more than %s", e.Limit.HR())
+}
+
+// limitedReader fails once more than remaining bytes are read, unlike io.LimitReader which quietly stops.
+type limitedReader struct {
+	reader    io.Reader
+	remaining int64
+	limit     datasize.ByteSize
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// one byte past the limit tells a stream that's exactly at it apart from one that's over
+		var probe [1]byte
+		if n, _ := l.reader.Read(probe[:]); n > 0 {
+			return 0, &ErrArchiveTooLarge{Limit: l.limit}
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.reader.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// ExtractTarGz extracts a gzipped tarball into fs, keeping directories, symlinks, hard links, modes, and when running
+// as root, ownership. Absolute entries and entries that would land outside fs, directly or through a symlink from the
+// same archive, fail with ErrUnsafeArchiveEntry. Extraction stops with ErrArchiveTooLarge once more than maxSize has
+// been decompressed.
+func ExtractTarGz(ctx context.Context, fs afero.Fs, r io.Reader, maxSize datasize.ByteSize) error {
+
+	_, span := telemetry.Start(ctx, "Extract tar.gz")
+	defer span.End()
+
+	uncompressedStream, gzipErr := gzip.NewReader(r)
+	if gzipErr != nil {
+		return gzipErr
+	}
+	defer utility.WrappedClose(uncompressedStream)
+
+	chown := effectiveUID() == 0
+	symlinks := make(map[string]bool)
+	tarReader := tar.NewReader(&limitedReader{reader: uncompressedStream, remaining: int64(maxSize.Bytes()), limit: maxSize})
+	for {
+		header, headerErr := tarReader.Next()
+		if errors.Is(headerErr, io.EOF) {
+			return nil
+		}
+		if headerErr != nil {
+			return headerErr
+		}
+
+		name, nameErr := archivePath(header.Name, symlinks)
+		if nameErr != nil {
+			return nameErr
+		}
+		span.AddEvent(fmt.Sprintf("extracting: %s", name))
+
+		if err := fs.MkdirAll(path.Dir(name), 0755); err != nil {
+			return err
+		}
+
+		// a symlink already at name would otherwise be written, chmodded, and chowned through
+		if header.Typeflag == tar.TypeDir || header.Typeflag == tar.TypeReg {
+			if err := removeSymlink(fs, name); err != nil {
+				return err
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := fs.MkdirAll(name, entryMode(header)); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := extractFile(fs, name, header, tarReader); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := replace(fs, name); err != nil {
+				return err
+			}
+			if err := utility.Symlink(fs, header.Linkname, name); err != nil {
+				return err
+			}
+			symlinks[name] = true
+			// chown would follow the link, and a link's own owner doesn't matter
+			continue
+		case tar.TypeLink:
+			target, targetErr := archivePath(header.Linkname, symlinks)
+			if targetErr != nil {
+				return targetErr
+			}
+			if err := replace(fs, name); err != nil {
+				return err
+			}
+			if err := utility.Link(fs, target, name); err != nil {
+				return err
+			}
+			continue
+		default:
+			span.AddEvent(fmt.Sprintf("skipping unsupported entry: %s", name))
+			continue
+		}
+
+		if chown {
+			if err := fs.Chown(name, header.Uid, header.Gid); err != nil {
+				return err
+			}
+		}
+		// chmod after chown, which clears setuid and setgid, and because existing files and directories keep their
+		// old mode otherwise
+		if err := fs.Chmod(name, entryMode(header)); err != nil {
+			return err
+		}
+	}
+}
+
+// archivePath cleans an entry's name into a path rooted at the extraction root. Absolute names, names that climb out
+// of the root, and names that are or are beneath a symlink an earlier entry created are rejected.
+func archivePath(name string, symlinks map[string]bool) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", &ErrUnsafeArchiveEntry{Name: name, Reason: "absolute path"}
+	}
+	cleaned := filepath.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", &ErrUnsafeArchiveEntry{Name: name, Reason: "escapes the extraction directory"}
+	}
+	rooted := filepath.Join("/", cleaned)
+	if symlinks[rooted] {
+		return "", &ErrUnsafeArchiveEntry{Name: name, Reason: "overwrites symlink " + rooted}
+	}
+	for parent := filepath.Dir(rooted); parent != "/"; parent = filepath.Dir(parent) {
+		if symlinks[parent] {
+			return "", &ErrUnsafeArchiveEntry{Name: name, Reason: "beneath symlink " + parent}
+		}
+	}
+	return rooted, nil
+}
+
+func extractFile(fs afero.Fs, name string, header *tar.Header, r io.Reader) error {
+	file, fileErr := fs.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, entryMode(header))
+	if fileErr != nil {
+		return fileErr
+	}
+	if _, err := io.Copy(file, r); err != nil { //nolint:gosec
+		return errors.Join(err, file.Close())
+	}
+	return file.Close()
+}
+
+// entryMode is the header's permission and special bits, without the file type.
+func entryMode(header *tar.Header) os.FileMode {
+	return header.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+// removeSymlink removes name when it's a symlink, without following it, so the entry is created in its place.
+func removeSymlink(fs afero.Fs, name string) error {
+	lstater, ok := fs.(afero.Lstater)
+	if !ok {
+		return nil
+	}
+	info, _, err := lstater.LstatIfPossible(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	return fs.Remove(name)
+}
+
+// replace removes whatever is at name so a link can be created there, extracting over an earlier install is normal.
+func replace(fs afero.Fs, name string) error {
+	if err := fs.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+type tarEntry struct {
+	header tar.Header
+	body   string
+}
+
+func tarball(t *testing.T, entries ...tarEntry) []byte {
+	var buffer bytes.Buffer
+	compressor := gzip.NewWriter(&buffer)
+	writer := tar.NewWriter(compressor)
+	for _, entry := range entries {
+		header := entry.header
+		header.Size = int64(len(entry.body))
+		assert.NoError(t, writer.WriteHeader(&header))
+		_, err := writer.Write([]byte(entry.body))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, writer.Close())
+	assert.NoError(t, compressor.Close())
+	return buffer.Bytes()
+}
+
+func TestExtractTarGz(t *testing.T) {
+	previousUID := effectiveUID
+	effectiveUID = func() int { return 0 }
+	t.Cleanup(func() { effectiveUID = previousUID })
+
+	uid, gid := os.Getuid(), os.Getgid()
+	archive := tarball(t,
+		tarEntry{header: tar.Header{Typeflag: tar.TypeDir, Name: "bin/", Mode: 0750, Uid: uid, Gid: gid}},
+		tarEntry{header: tar.Header{Typeflag: tar.TypeReg, Name: "bin/crictl", Mode: 0755, Uid: uid, Gid: gid}, body: "binary"},
+		tarEntry{header: tar.Header{Typeflag: tar.TypeSymlink, Name: "bin/crictl-latest", Linkname: "crictl"}},
+		tarEntry{header: tar.Header{Typeflag: tar.TypeLink, Name: "bin/crictl-hard", Linkname: "bin/crictl"}},
+		tarEntry{header: tar.Header{Typeflag: tar.TypeReg, Name: "share/doc/README", Mode: 0644, Uid: uid, Gid: gid}, body: "docs"},
+	)
+
+	root := t.TempDir()
+	fs := afero.NewBasePathFs(afero.NewOsFs(), root)
+	// extracting over an earlier install replaces it
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, ExtractTarGz(context.Background(), fs, bytes.NewReader(archive), DefaultMaxArchiveSize))
+	}
+
+	dir, dirErr := os.Stat(filepath.Join(root, "bin"))
+	assert.NoError(t, dirErr)
+	assert.Equal(t, os.FileMode(0750)|os.ModeDir, dir.Mode())
+
+	binary, binaryErr := os.Stat(filepath.Join(root, "bin/crictl"))
+	assert.NoError(t, binaryErr)
+	assert.Equal(t, os.FileMode(0755), binary.Mode())
+	stat := binary.Sys().(*syscall.Stat_t)
+	assert.Equal(t, uint32(uid), stat.Uid)
+	assert.Equal(t, uint32(gid), stat.Gid)
+
+	link, linkErr := os.Readlink(filepath.Join(root, "bin/crictl-latest"))
+	assert.NoError(t, linkErr)
+	assert.Equal(t, "crictl", link)
+
+	hard, hardErr := os.Stat(filepath.Join(root, "bin/crictl-hard"))
+	assert.NoError(t, hardErr)
+	assert.True(t, os.SameFile(binary, hard))
+
+	docs, docsErr := os.ReadFile(filepath.Join(root, "share/doc/README"))
+	assert.NoError(t, docsErr)
+	assert.Equal(t, "docs", string(docs))
+}
+
+func TestExtractTarGzRejectsTraversal(t *testing.T) {
+	cases := map[string]struct {
+		entries []tarEntry
+		message string
+	}{
+		"absolute path": {entries: []tarEntry{
+			{header: tar.Header{Typeflag: tar.TypeReg, Name: "/etc/passwd", Mode: 0644}, body: "x"},
+		}, message: "absolute path"},
+		"nested parent directory": {entries: []tarEntry{
+			{header: tar.Header{Typeflag: tar.TypeReg, Name: "bin/../../escaped", Mode: 0644}, body: "x"},
+		}, message: "escapes the extraction directory"},
+		"parent directory": {entries: []tarEntry{
+			{header: tar.Header{Typeflag: tar.TypeReg, Name: "../escaped", Mode: 0644}, body: "x"},
+		}, message: "escapes the extraction directory"},
+		"hard link out": {entries: []tarEntry{
+			{header: tar.Header{Typeflag: tar.TypeLink, Name: "passwd", Linkname: "../../etc/passwd"}},
+		}, message: "escapes the extraction directory"},
+		"through a symlink": {entries: []tarEntry{
+			{header: tar.Header{Typeflag: tar.TypeSymlink, Name: "etc", Linkname: "/etc"}},
+			{header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/escaped", Mode: 0644}, body: "x"},
+		}, message: "beneath symlink /etc"},
+		"over a symlink": {entries: []tarEntry{
+			{header: tar.Header{Typeflag: tar.TypeSymlink, Name: "crictl", Linkname: "../escaped"}},
+			{header: tar.Header{Typeflag: tar.TypeReg, Name: "crictl", Mode: 0644}, body: "x"},
+		}, message: "overwrites symlink /crictl"},
+		"directory over a symlink": {entries: []tarEntry{
+			{header: tar.Header{Typeflag: tar.TypeSymlink, Name: "bin", Linkname: "../escaped"}},
+			{header: tar.Header{Typeflag: tar.TypeDir, Name: "bin/", Mode: 0755}},
+		}, message: "overwrites symlink /bin"},
+	}
+	for name, testCase := range cases {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			fs := afero.NewBasePathFs(afero.NewOsFs(), filepath.Join(root, "cni"))
+			archive := bytes.NewReader(tarball(t, testCase.entries...))
+			err := ExtractTarGz(context.Background(), fs, archive, DefaultMaxArchiveSize)
+			var unsafe *ErrUnsafeArchiveEntry
+			assert.ErrorAs(t, err, &unsafe)
+			assert.ErrorContains(t, err, testCase.message)
+			_, statErr := os.Stat(filepath.Join(root, "escaped"))
+			assert.ErrorIs(t, statErr, os.ErrNotExist)
+		})
+	}
+}
+
+func TestExtractTarGzReplacesExistingSymlinks(t *testing.T) {
+	root := t.TempDir()
+	outside := filepath.Join(root, "outside")
+	assert.NoError(t, os.WriteFile(outside, []byte("host file"), 0600))
+	assert.NoError(t, os.Mkdir(filepath.Join(root, "cni"), 0755))
+	assert.NoError(t, os.Symlink(outside, filepath.Join(root, "cni", "crictl")))
+
+	fs := afero.NewBasePathFs(afero.NewOsFs(), filepath.Join(root, "cni"))
+	archive := bytes.NewReader(tarball(t, tarEntry{header: tar.Header{Typeflag: tar.TypeReg, Name: "crictl", Mode: 0755}, body: "binary"}))
+	assert.NoError(t, ExtractTarGz(context.Background(), fs, archive, DefaultMaxArchiveSize))
+
+	contents, err := os.ReadFile(outside)
+	assert.NoError(t, err)
+	assert.Equal(t, "host file", string(contents))
+	info, err := os.Stat(outside)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	extracted, err := os.Lstat(filepath.Join(root, "cni", "crictl"))
+	assert.NoError(t, err)
+	assert.True(t, extracted.Mode().IsRegular())
+}
+
+func TestExtractTarGzRejectsBombs(t *testing.T) {
+	// zeros compress to almost nothing, the same trick a decompression bomb uses
+	archive := tarball(t, tarEntry{header: tar.Header{Typeflag: tar.TypeReg, Name: "bomb", Mode: 0644}, body: string(make([]byte, 64*1024))})
+	assert.Less(t, len(archive), 1024)
+
+	fs := afero.NewBasePathFs(afero.NewOsFs(), t.TempDir())
+	err := ExtractTarGz(context.Background(), fs, bytes.NewReader(archive), 16*datasize.KB)
+	var tooLarge *ErrArchiveTooLarge
+	assert.ErrorAs(t, err, &tooLarge)
+
+	assert.NoError(t, ExtractTarGz(context.Background(), fs, bytes.NewReader(archive), 128*datasize.KB))
+}
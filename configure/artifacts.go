@@ -0,0 +1,299 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/sync/errgroup"
+)
+
+// maxConcurrentDownloads bounds how many artifacts are fetched at once.
+const maxConcurrentDownloads = 4
+
+const kubernetesArch = "arm64"
+
+var (
+	releaseVersionPattern = regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+(-[0-9A-Za-z.-]+)?$`)
+	releaseMarkerPattern  = regexp.MustCompile(`^stable-[0-9]+\.[0-9]+$`)
+)
+
+// kubernetesReleaseURL is the release bucket binaries and stable-x.y markers are read from.
+var kubernetesReleaseURL = "https://storage.googleapis.com/kubernetes-release/release"
+
+// cniReleaseURL and criCtlReleaseURL are the github release downloads for the cni plugins and crictl.
+var (
+	cniReleaseURL    = "https://github.com/containernetworking/plugins/releases/download"
+	criCtlReleaseURL = "https://github.com/kubernetes-sigs/cri-tools/releases/download"
+)
+
+// KubernetesVersions pin the release artifacts InstallKubernetes installs.
+type KubernetesVersions struct {
+	// Kubernetes is a release like v1.25.3, or a stable-1.25 marker resolved to the latest patch release.
+	Kubernetes string `yaml:"version"`
+	CriCtl     string `yaml:"crictlVersion"`
+	CNI        string `yaml:"cniVersion"`
+}
+
+func DefaultKubernetesVersions() KubernetesVersions {
+	return KubernetesVersions{
+		Kubernetes: "v1.25.3",
+		CriCtl:     "v1.25.0",
+		CNI:        "v1.1.1",
+	}
+}
+
+func (v KubernetesVersions) Validate() error {
+	if !releaseVersionPattern.MatchString(v.Kubernetes) && !releaseMarkerPattern.MatchString(v.Kubernetes) {
+		return fmt.Errorf("invalid kubernetes version: %q, expected vX.Y.Z or stable-X.Y", v.Kubernetes)
+	}
+	if !releaseVersionPattern.MatchString(v.CriCtl) {
+		return fmt.Errorf("invalid crictl version: %q, expected vX.Y.Z", v.CriCtl)
+	}
+	if !releaseVersionPattern.MatchString(v.CNI) {
+		return fmt.Errorf("invalid cni version: %q, expected vX.Y.Z", v.CNI)
+	}
+	return nil
+}
+
+func minorVersion(version string) string {
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	if len(parts) < 2 {
+		return version
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// Compatible checks crictl is from the same minor release as kubernetes, which is what cri-tools supports. The
+// kubernetes version must already be resolved.
+func (v KubernetesVersions) Compatible() error {
+	if kubernetes, criCtl := minorVersion(v.Kubernetes), minorVersion(v.CriCtl); kubernetes != criCtl {
+		return fmt.Errorf("crictl %s doesn't match kubernetes %s, use a crictl v%s.x release", v.CriCtl, v.Kubernetes, kubernetes)
+	}
+	return nil
+}
+
+// MarkerURL is the release marker Resolve reads, empty when the kubernetes version is already a release.
+func (v KubernetesVersions) MarkerURL() string {
+	if !releaseMarkerPattern.MatchString(v.Kubernetes) {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s.txt", kubernetesReleaseURL, v.Kubernetes)
+}
+
+// Resolve replaces a stable-x.y kubernetes version with the patch release its marker on the release bucket points to.
+func (v KubernetesVersions) Resolve(ctx context.Context) (KubernetesVersions, error) {
+	if err := v.Validate(); err != nil {
+		return v, err
+	}
+	if !releaseMarkerPattern.MatchString(v.Kubernetes) {
+		return v, nil
+	}
+
+	marker := v.MarkerURL()
+	response, err := get(ctx, marker)
+	if err != nil {
+		return v, fmt.Errorf("could not resolve kubernetes version %s: %w", v.Kubernetes, err)
+	}
+	defer utility.WrappedClose(response.Body)
+
+	content, readErr := io.ReadAll(io.LimitReader(response.Body, 256))
+	if readErr != nil {
+		return v, readErr
+	}
+	release := strings.TrimSpace(string(content))
+	if !releaseVersionPattern.MatchString(release) {
+		return v, fmt.Errorf("release marker %s points to %q, which isn't a release", marker, release)
+	}
+	v.Kubernetes = release
+	return v, nil
+}
+
+// Artifact is a release file that's only used once it matches the sha256 published next to it.
+type Artifact struct {
+	// Name is the file name in the download directory.
+	Name        string
+	URL         string
+	ChecksumURL string
+	// Version is the release the artifact belongs to.
+	Version string
+}
+
+func kubernetesBinary(name string, versions KubernetesVersions) Artifact {
+	url := NewKubernetesDownload(name, versions.Kubernetes, kubernetesArch).URL()
+	return Artifact{Name: name, URL: url, ChecksumURL: url + ".sha256", Version: versions.Kubernetes}
+}
+
+func cniArtifact(versions KubernetesVersions) Artifact {
+	name := fmt.Sprintf("cni-plugins-linux-%s-%s.tgz", kubernetesArch, versions.CNI)
+	url := fmt.Sprintf("%s/%s/%s", cniReleaseURL, versions.CNI, name)
+	return Artifact{Name: name, URL: url, ChecksumURL: url + ".sha256", Version: versions.CNI}
+}
+
+func criCtlArtifact(versions KubernetesVersions) Artifact {
+	name := fmt.Sprintf("crictl-%s-linux-%s.tar.gz", versions.CriCtl, kubernetesArch)
+	url := fmt.Sprintf("%s/%s/%s", criCtlReleaseURL, versions.CriCtl, name)
+	return Artifact{Name: name, URL: url, ChecksumURL: url + ".sha256", Version: versions.CriCtl}
+}
+
+// KubernetesArtifacts are everything InstallKubernetes downloads.
+func KubernetesArtifacts(versions KubernetesVersions) []Artifact {
+	return []Artifact{
+		kubernetesBinary("kubeadm", versions),
+		kubernetesBinary("kubelet", versions),
+		kubernetesBinary("kubectl", versions),
+		cniArtifact(versions),
+		criCtlArtifact(versions),
+	}
+}
+
+func get(ctx context.Context, url string) (*http.Response, error) {
+	request, requestErr := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	response, err := otelhttp.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckResponse(response, url); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// publishedChecksum reads the hash of name from a checksum file. That's either a .sha256 file with the bare hash or a
+// single sha256sum line, or a sha256sums file covering a whole release where the line for name is picked.
+func publishedChecksum(ctx context.Context, url string, name string) (string, error) {
+	response, err := get(ctx, url)
+	if err != nil {
+		return "", fmt.Errorf("could not fetch checksum %s: %w", url, err)
+	}
+	defer utility.WrappedClose(response.Body)
+
+	content, readErr := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if readErr != nil {
+		return "", readErr
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) > 1 {
+		for _, line := range lines {
+			// sha256sum marks binary mode files with a * before the name
+			if fields := strings.Fields(line); len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+				return strings.ToLower(fields[0]), nil
+			}
+		}
+		return "", fmt.Errorf("checksum %s doesn't list %s", url, name)
+	}
+	fields := strings.Fields(lines[0])
+	if len(fields) == 0 {
+		return "", fmt.Errorf("checksum %s is empty", url)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// fetchArtifact downloads artifact into dir. It's written to a temporary file and only renamed into place once the
+// checksum matches, so anything already in dir under its name was verified and is reused.
+func fetchArtifact(ctx context.Context, fs afero.Fs, dir string, artifact Artifact) (err error) {
+	destination := path.Join(dir, artifact.Name)
+	if exists, existsErr := afero.Exists(fs, destination); existsErr != nil || exists {
+		return existsErr
+	}
+
+	expected, checksumErr := publishedChecksum(ctx, artifact.ChecksumURL, path.Base(artifact.URL))
+	if checksumErr != nil {
+		return checksumErr
+	}
+
+	response, getErr := get(ctx, artifact.URL)
+	if getErr != nil {
+		return fmt.Errorf("could not download %s: %w", artifact.URL, getErr)
+	}
+	defer utility.WrappedClose(response.Body)
+
+	partial, tempErr := afero.TempFile(fs, dir, artifact.Name+".partial-")
+	if tempErr != nil {
+		return tempErr
+	}
+	defer func() {
+		if err != nil {
+			_ = fs.Remove(partial.Name())
+		}
+	}()
+
+	hash := sha256.New()
+	body := utility.NewProgressReader(ctx, response.Body, artifact.Name, response.ContentLength)
+	written, copyErr := io.Copy(io.MultiWriter(partial, hash), body)
+	telemetry.AddBytesDownloaded(ctx, written)
+	if closeErr := partial.Close(); copyErr == nil {
+		copyErr = closeErr
+	}
+	if copyErr != nil {
+		return copyErr
+	}
+
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+		return fmt.Errorf("checksum of %s is %s, expected %s", artifact.Name, actual, expected)
+	}
+	return fs.Rename(partial.Name(), destination)
+}
+
+// FetchArtifacts downloads artifacts into dir on fs a few at a time. The first failure cancels the downloads still
+// running.
+func FetchArtifacts(ctx context.Context, fs afero.Fs, dir string, artifacts []Artifact) error {
+	ctx, span := telemetry.Start(ctx, "fetch artifacts")
+	defer span.End()
+
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(maxConcurrentDownloads)
+	for _, artifact := range artifacts {
+		artifact := artifact
+		group.Go(func() error {
+			return fetchArtifact(groupCtx, fs, dir, artifact)
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// openArtifact opens a fetched artifact, failing clearly if FetchArtifacts wasn't run first.
+func openArtifact(fs afero.Fs, dir string, artifact Artifact) (afero.File, error) {
+	file, err := fs.Open(path.Join(dir, artifact.Name))
+	if errors.Is(err, afero.ErrFileNotFound) {
+		return nil, fmt.Errorf("artifact %s was not downloaded", artifact.Name)
+	}
+	return file, err
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func artifactServer(t *testing.T, content string, checksum string, hits *int32) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		switch r.URL.Path {
+		case "/kubeadm":
+			_, _ = w.Write([]byte(content))
+		case "/kubeadm.sha256":
+			_, _ = w.Write([]byte(checksum + "  kubeadm\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestFetchArtifacts(t *testing.T) {
+	var hits int32
+	server := artifactServer(t, "kubeadm binary", sha256Hex("kubeadm binary"), &hits)
+	artifacts := []Artifact{{Name: "kubeadm", URL: server.URL + "/kubeadm", ChecksumURL: server.URL + "/kubeadm.sha256"}}
+	fs := afero.NewMemMapFs()
+
+	assert.NoError(t, FetchArtifacts(context.TODO(), fs, "/cache", artifacts))
+	content, readErr := afero.ReadFile(fs, "/cache/kubeadm")
+	assert.NoError(t, readErr)
+	assert.Equal(t, "kubeadm binary", string(content))
+
+	fetched := atomic.LoadInt32(&hits)
+	assert.NoError(t, FetchArtifacts(context.TODO(), fs, "/cache", artifacts))
+	assert.Equal(t, fetched, atomic.LoadInt32(&hits), "verified artifacts are reused")
+}
+
+func TestFetchArtifactsChecksumMismatch(t *testing.T) {
+	var hits int32
+	server := artifactServer(t, "tampered binary", sha256Hex("kubeadm binary"), &hits)
+	artifacts := []Artifact{{Name: "kubeadm", URL: server.URL + "/kubeadm", ChecksumURL: server.URL + "/kubeadm.sha256"}}
+	fs := afero.NewMemMapFs()
+
+	assert.ErrorContains(t, FetchArtifacts(context.TODO(), fs, "/cache", artifacts), "checksum of kubeadm")
+	entries, readErr := afero.ReadDir(fs, "/cache")
+	assert.NoError(t, readErr)
+	assert.Empty(t, entries)
+}
+
+func TestFetchArtifactsMissing(t *testing.T) {
+	var hits int32
+	server := artifactServer(t, "kubeadm binary", sha256Hex("kubeadm binary"), &hits)
+	artifacts := []Artifact{
+		{Name: "missing", URL: server.URL + "/missing", ChecksumURL: server.URL + "/missing.sha256"},
+		{Name: "kubeadm", URL: server.URL + "/kubeadm", ChecksumURL: server.URL + "/kubeadm.sha256"},
+	}
+
+	err := FetchArtifacts(context.TODO(), afero.NewMemMapFs(), "/cache", artifacts)
+	assert.ErrorContains(t, err, "got 404")
+}
+
+func TestKubernetesVersionsValidate(t *testing.T) {
+	assert.NoError(t, DefaultKubernetesVersions().Validate())
+
+	marker := DefaultKubernetesVersions()
+	marker.Kubernetes = "stable-1.28"
+	assert.NoError(t, marker.Validate())
+
+	for _, versions := range []KubernetesVersions{
+		{Kubernetes: "1.25.3", CriCtl: "v1.25.0", CNI: "v1.1.1"},
+		{Kubernetes: "v1.25", CriCtl: "v1.25.0", CNI: "v1.1.1"},
+		{Kubernetes: "v1.25.3", CriCtl: "stable-1.25", CNI: "v1.1.1"},
+		{Kubernetes: "v1.25.3", CriCtl: "v1.25.0", CNI: ""},
+	} {
+		assert.Error(t, versions.Validate(), versions)
+	}
+}
+
+func TestKubernetesVersionsResolve(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stable-1.28.txt" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("v1.28.4\n"))
+	}))
+	t.Cleanup(server.Close)
+
+	previous := kubernetesReleaseURL
+	kubernetesReleaseURL = server.URL
+	t.Cleanup(func() { kubernetesReleaseURL = previous })
+
+	versions := DefaultKubernetesVersions()
+	versions.Kubernetes = "stable-1.28"
+	resolved, err := versions.Resolve(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.28.4", resolved.Kubernetes)
+	assert.Equal(t, versions.CriCtl, resolved.CriCtl)
+
+	exact, exactErr := DefaultKubernetesVersions().Resolve(context.TODO())
+	assert.NoError(t, exactErr)
+	assert.Equal(t, DefaultKubernetesVersions(), exact)
+
+	versions.Kubernetes = "stable-1.99"
+	_, missingErr := versions.Resolve(context.TODO())
+	assert.Error(t, missingErr)
+}
@@ -0,0 +1,479 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/lockfile"
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+// AssertionKind is what's checked about a file beyond it existing.
+type AssertionKind string
+
+const (
+	// AssertFile requires a non-empty regular file.
+	AssertFile AssertionKind = "file"
+	// AssertUnit requires a systemd unit or drop-in that parses, with every binary it executes present and arm64.
+	AssertUnit AssertionKind = "unit"
+	// AssertYAML requires a file of one or more yaml documents.
+	AssertYAML AssertionKind = "yaml"
+	// AssertExecutable requires an arm64 ELF binary, or a script whose interpreter is one.
+	AssertExecutable AssertionKind = "executable"
+)
+
+// searchPath is where systemd looks for an Exec command that isn't an absolute path.
+var searchPath = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+// Assertion is one check of the configured image. Path may be a glob, every file it matches is checked.
+type Assertion struct {
+	Path string        `yaml:"path"`
+	Kind AssertionKind `yaml:"kind"`
+	// Mode is the exact permission bits in octal, e.g. 0644, empty doesn't check them.
+	Mode string `yaml:"mode"`
+	// Optional passes when nothing matches Path, whatever does match is still checked.
+	Optional bool `yaml:"optional"`
+}
+
+// Assertions are checked against the image once it's configured, profiles add theirs to the config file's.
+type Assertions []Assertion
+
+func (a Assertion) mode() (fs.FileMode, error) {
+	mode, err := strconv.ParseUint(a.Mode, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, fmt.Errorf("assertion for %s has an invalid mode %q, use octal like 0644", a.Path, a.Mode)
+	}
+	return fs.FileMode(mode), nil
+}
+
+func (a Assertions) Validate() error {
+	for _, assertion := range a {
+		if !path.IsAbs(assertion.Path) {
+			return fmt.Errorf("assertion path must be absolute, got: %q", assertion.Path)
+		}
+		if _, err := path.Match(assertion.Path, ""); err != nil {
+			return fmt.Errorf("assertion path %s isn't a valid glob: %w", assertion.Path, err)
+		}
+		switch assertion.Kind {
+		case AssertFile, AssertUnit, AssertYAML, AssertExecutable:
+		default:
+			return fmt.Errorf("assertion for %s has unknown kind %q, use %s, %s, %s, or %s", assertion.Path, assertion.Kind, AssertFile, AssertUnit, AssertYAML, AssertExecutable)
+		}
+		if assertion.Mode != "" {
+			if _, err := assertion.mode(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DefaultAssertions cover the files every image needs to boot and be reached, plus the kubernetes ones when it's
+// installed.
+func DefaultAssertions(kubernetes bool) Assertions {
+	assertions := Assertions{
+		{Path: "/etc/fstab", Kind: AssertFile, Mode: "0644"},
+		{Path: commandLinePath, Kind: AssertFile},
+		{Path: "/etc/systemd/system/*.service", Kind: AssertUnit, Optional: true},
+		{Path: "/etc/systemd/system/*.service.d/*.conf", Kind: AssertUnit, Optional: true},
+		{Path: path.Join(cloudInitDropInDir, "*.cfg"), Kind: AssertYAML, Optional: true},
+	}
+	if kubernetes {
+		assertions = append(assertions,
+			Assertion{Path: "/etc/systemd/system/kubelet.service", Kind: AssertUnit, Mode: "0644"},
+			Assertion{Path: "/etc/containerd/config.toml", Kind: AssertFile, Mode: "0644"},
+			Assertion{Path: "/usr/local/bin/kubelet", Kind: AssertExecutable, Mode: "0755"},
+			Assertion{Path: "/usr/local/bin/kubeadm", Kind: AssertExecutable, Mode: "0755"},
+		)
+	}
+	return assertions
+}
+
+// ImageExpectations is what AssertImage checks the configured image against.
+type ImageExpectations struct {
+	Assertions Assertions
+	// Mounts and Layout are what fstab was rendered from, nil mounts are DefaultMounts
+	Mounts []Mount
+	Layout partition.VolumeLayout
+	// Packages have to be installed, so a purge can't take out something another step relies on.
+	Packages []string
+}
+
+// ErrAssertions lists every way the configured image doesn't look like it should.
+type ErrAssertions struct {
+	Violations []string
+}
+
+func (e *ErrAssertions) Error() string {
+	return fmt.Sprintf("image failed %d assertions:\n  %s", len(e.Violations), strings.Join(e.Violations, "\n  "))
+}
+
+// AssertImage checks the mounted image against expected: each assertion, fstab only naming logical volumes the image
+// has, cmdline.txt being a single line booting from the root volume, the expected packages being installed, and no
+// enabled unit being masked. Every violation is reported, not just the first.
+func AssertImage(ctx context.Context, fs afero.Fs, expected ImageExpectations) error {
+	_, span := telemetry.Start(ctx, "assert image")
+	defer span.End()
+
+	var violations []string
+	reported := make(map[string]bool)
+	for _, assertion := range expected.Assertions {
+		// a file matched by several assertions, e.g. a glob and its own, only reports each problem once
+		for _, violation := range checkAssertion(fs, assertion) {
+			if !reported[violation] {
+				reported[violation] = true
+				violations = append(violations, violation)
+			}
+		}
+	}
+	for _, err := range checkFstabDevices(fs, expected.Mounts, expected.Layout) {
+		violations = append(violations, fmt.Sprintf("/etc/fstab: %s", err))
+	}
+	if err := checkCommandLine(fs); err != nil {
+		violations = append(violations, fmt.Sprintf("%s: %s", commandLinePath, err))
+	}
+	violations = append(violations, checkPackages(fs, expected.Packages)...)
+	violations = append(violations, maskedButEnabled(fs)...)
+	if len(violations) != 0 {
+		return &ErrAssertions{Violations: violations}
+	}
+	return nil
+}
+
+func checkAssertion(fs afero.Fs, assertion Assertion) []string {
+	matches, globErr := afero.Glob(fs, assertion.Path)
+	if globErr != nil {
+		return []string{fmt.Sprintf("%s: %s", assertion.Path, globErr)}
+	}
+	if len(matches) == 0 {
+		if assertion.Optional {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s: doesn't exist", assertion.Path)}
+	}
+	sort.Strings(matches)
+
+	var violations []string
+	for _, name := range matches {
+		for _, err := range checkFile(fs, name, assertion) {
+			violations = append(violations, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+	return violations
+}
+
+func checkFile(fs afero.Fs, name string, assertion Assertion) []error {
+	info, statErr := lstatIfPossible(fs, name)
+	if statErr != nil {
+		return []error{statErr}
+	}
+	// masked units are links to /dev/null, there's nothing to check
+	if info.Mode()&os.ModeSymlink != 0 && assertion.Kind == AssertUnit {
+		return nil
+	}
+	resolved, resolveErr := utility.ResolveInRoot(fs, name)
+	if resolveErr != nil {
+		return []error{resolveErr}
+	}
+	info, statErr = fs.Stat(resolved)
+	if statErr != nil {
+		return []error{statErr}
+	}
+	if !info.Mode().IsRegular() {
+		return []error{fmt.Errorf("is a %s, not a regular file", info.Mode().Type())}
+	}
+
+	var problems []error
+	if assertion.Mode != "" {
+		mode, _ := assertion.mode()
+		if actual := unixMode(info.Mode()); actual != mode {
+			problems = append(problems, fmt.Errorf("has mode %04o instead of %04o", actual, mode))
+		}
+	}
+	if info.Size() == 0 {
+		return append(problems, errors.New("is empty"))
+	}
+
+	switch assertion.Kind {
+	case AssertUnit:
+		problems = append(problems, checkUnit(fs, resolved)...)
+	case AssertYAML:
+		data, readErr := afero.ReadFile(fs, resolved)
+		if readErr != nil {
+			return append(problems, readErr)
+		}
+		if err := validateYAMLDocuments(data); err != nil {
+			problems = append(problems, fmt.Errorf("isn't valid yaml: %w", err))
+		}
+	case AssertExecutable:
+		if err := checkExecutable(fs, resolved); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	return problems
+}
+
+// unixMode converts go's mode bits to the octal ones chmod takes.
+func unixMode(mode fs.FileMode) fs.FileMode {
+	converted := mode.Perm()
+	if mode&fs.ModeSetuid != 0 {
+		converted |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		converted |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		converted |= 01000
+	}
+	return converted
+}
+
+// checkUnit parses a unit or drop-in and checks every binary its Exec lines run.
+func checkUnit(fs afero.Fs, name string) []error {
+	data, readErr := afero.ReadFile(fs, name)
+	if readErr != nil {
+		return []error{readErr}
+	}
+	required := []string{"[Service]"}
+	if strings.HasSuffix(name, ".conf") {
+		// drop-ins only carry the sections they override
+		required = nil
+	}
+	if err := checkINI(required...)(data); err != nil {
+		return []error{fmt.Errorf("isn't a valid unit: %w", err)}
+	}
+
+	var problems []error
+	for _, command := range unitCommands(data) {
+		binary, findErr := findCommand(fs, command)
+		if findErr != nil {
+			problems = append(problems, findErr)
+			continue
+		}
+		if err := checkExecutable(fs, binary); err != nil {
+			problems = append(problems, fmt.Errorf("runs %s which %w", command, err))
+		}
+	}
+	return problems
+}
+
+// unitCommands returns the program each Exec line of a unit runs, in order. An empty ExecStart= only resets the list.
+func unitCommands(data []byte) []string {
+	var commands []string
+	var line strings.Builder
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if continued, found := strings.CutSuffix(text, "\\"); found {
+			line.WriteString(continued + " ")
+			continue
+		}
+		line.WriteString(text)
+		key, value, found := strings.Cut(line.String(), "=")
+		line.Reset()
+		if !found || !strings.HasPrefix(strings.TrimSpace(key), "Exec") {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		// the prefixes change how failures and privileges are handled, not what runs
+		if program := strings.TrimLeft(fields[0], "-@:+!"); program != "" {
+			commands = append(commands, program)
+		}
+	}
+	return commands
+}
+
+// findCommand resolves an Exec command to its file in the image, bare names are looked up like systemd does.
+func findCommand(fs afero.Fs, command string) (string, error) {
+	candidates := []string{command}
+	if !path.IsAbs(command) {
+		candidates = candidates[:0]
+		for _, dir := range searchPath {
+			candidates = append(candidates, path.Join(dir, command))
+		}
+	}
+	for _, candidate := range candidates {
+		resolved, err := utility.ResolveInRoot(fs, candidate)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return resolved, nil
+	}
+	return "", fmt.Errorf("runs %s which isn't in the image", command)
+}
+
+// checkExecutable requires an arm64 ELF binary with an execute bit, or a script whose interpreter is one.
+func checkExecutable(fs afero.Fs, name string) error {
+	info, statErr := fs.Stat(name)
+	if statErr != nil {
+		return statErr
+	}
+	if info.Mode().Perm()&0111 == 0 {
+		return errors.New("isn't executable")
+	}
+
+	file, openErr := fs.Open(name)
+	if openErr != nil {
+		return openErr
+	}
+	defer utility.WrappedClose(file)
+
+	header := make([]byte, 256)
+	read, _ := file.ReadAt(header, 0)
+	header = header[:read]
+	if interpreter, found := bytes.CutPrefix(header, []byte("#!")); found {
+		line, _, _ := bytes.Cut(interpreter, []byte("\n"))
+		fields := strings.Fields(string(line))
+		if len(fields) == 0 {
+			return errors.New("has an empty shebang")
+		}
+		resolved, resolveErr := utility.ResolveInRoot(fs, fields[0])
+		if resolveErr != nil {
+			return fmt.Errorf("has interpreter %s which isn't in the image", fields[0])
+		}
+		if err := checkELF(fs, resolved); err != nil {
+			return fmt.Errorf("has interpreter %s which %w", fields[0], err)
+		}
+		return nil
+	}
+	return checkELF(fs, name)
+}
+
+func checkELF(fs afero.Fs, name string) error {
+	file, openErr := fs.Open(name)
+	if openErr != nil {
+		return openErr
+	}
+	defer utility.WrappedClose(file)
+
+	binary, elfErr := elf.NewFile(file)
+	if elfErr != nil {
+		return errors.New("isn't an ELF binary or a script")
+	}
+	if binary.Machine != elf.EM_AARCH64 {
+		return fmt.Errorf("is built for %s instead of arm64", binary.Machine)
+	}
+	return nil
+}
+
+// checkFstabDevices requires every logical volume device in fstab to be one the image's volume layout creates, and
+// every mount the config asked for to be there.
+func checkFstabDevices(fs afero.Fs, mounts []Mount, layout partition.VolumeLayout) []error {
+	data, readErr := afero.ReadFile(fs, "/etc/fstab")
+	if readErr != nil {
+		return []error{readErr}
+	}
+
+	devices := make(map[string]bool, len(layout))
+	for _, volume := range layout {
+		devices[volume.Device()] = true
+		devices[path.Join("/dev", utility.VolumeGroupName, volume.Name)] = true
+	}
+	mounted := make(map[string]string)
+	var problems []error
+	for number, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			problems = append(problems, fmt.Errorf("line %d has no mount point: %q", number+1, line))
+			continue
+		}
+		device := fields[0]
+		mounted[fields[1]] = device
+		lvm := strings.HasPrefix(device, "/dev/mapper/") || strings.HasPrefix(device, path.Join("/dev", utility.VolumeGroupName)+"/")
+		if lvm && !devices[device] {
+			problems = append(problems, fmt.Errorf("line %d mounts %s which isn't a volume in the layout", number+1, device))
+		}
+	}
+	for _, mount := range ResolveMounts(mounts, layout) {
+		if device, ok := mounted[mount.MountPoint]; !ok {
+			problems = append(problems, fmt.Errorf("%s isn't mounted", mount.MountPoint))
+		} else if device != mount.Device {
+			problems = append(problems, fmt.Errorf("%s is mounted from %s instead of %s", mount.MountPoint, device, mount.Device))
+		}
+	}
+	return problems
+}
+
+// checkCommandLine requires cmdline.txt to be one line booting from the root logical volume, the firmware ignores
+// every line after the first.
+func checkCommandLine(fs afero.Fs) error {
+	data, readErr := afero.ReadFile(fs, commandLinePath)
+	if readErr != nil {
+		return readErr
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) != 1 {
+		return fmt.Errorf("has %d lines instead of 1", len(lines))
+	}
+	expected := rootParams()[0]
+	var roots []string
+	for _, param := range strings.Fields(lines[0]) {
+		if strings.HasPrefix(param, "root=") {
+			roots = append(roots, param)
+		}
+	}
+	if len(roots) != 1 || roots[0] != expected {
+		return fmt.Errorf("boots from %s instead of %s", strings.Join(roots, " "), expected)
+	}
+	return nil
+}
+
+// checkPackages reads dpkg's status in the image for every package in names.
+func checkPackages(fs afero.Fs, names []string) []string {
+	if len(names) == 0 {
+		return nil
+	}
+	packages, err := lockfile.InstalledPackages(fs)
+	if err != nil {
+		return []string{fmt.Sprintf("could not read installed packages: %s", err)}
+	}
+	installed := make(map[string]bool, len(packages))
+	for _, pkg := range packages {
+		installed[pkg.Name] = true
+	}
+	var violations []string
+	for _, name := range names {
+		if !installed[name] {
+			violations = append(violations, fmt.Sprintf("package %s isn't installed", name))
+		}
+	}
+	return violations
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// elfBinary is the smallest file debug/elf accepts as an executable for machine.
+func elfBinary(t *testing.T, machine elf.Machine) []byte {
+	t.Helper()
+	header := elf.Header64{
+		Type:    uint16(elf.ET_EXEC),
+		Machine: uint16(machine),
+		Version: uint32(elf.EV_CURRENT),
+		Ehsize:  64,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	var buffer bytes.Buffer
+	assert.NoError(t, binary.Write(&buffer, binary.LittleEndian, header))
+	return buffer.Bytes()
+}
+
+func assertFixture(t *testing.T) afero.Fs {
+	t.Helper()
+	fs := afero.NewMemMapFs()
+	fstab, err := RenderFstab(DefaultMounts(), partition.DefaultVolumeLayout())
+	assert.NoError(t, err)
+	files := map[string][]byte{
+		"/etc/fstab":                          fstab,
+		commandLinePath:                       []byte(CommandLine{}.WithCgroupMode(CgroupUnified).String()),
+		"/etc/systemd/system/kubelet.service": []byte("[Unit]\nDescription=kubelet\n[Service]\nExecStart=/usr/local/bin/kubelet\n[Install]\nWantedBy=multi-user.target\n"),
+		"/etc/systemd/system/kubelet.service.d/10-kubeadm.conf": []byte("[Service]\nExecStart=\nExecStart=-/usr/local/bin/kubelet \\\n  $KUBELET_ARGS\n"),
+		"/etc/containerd/config.toml":                           []byte("version = 2"),
+		"/etc/cloud/cloud.cfg.d/06_user.cfg":                    []byte("users:\n  - name: kat\n"),
+		"/usr/local/bin/kubeadm":                                elfBinary(t, elf.EM_AARCH64),
+		"/usr/local/bin/kubelet":                                elfBinary(t, elf.EM_AARCH64),
+	}
+	for name, content := range files {
+		mode := os.FileMode(0644)
+		if filepath.Dir(name) == "/usr/local/bin" {
+			mode = 0755
+		}
+		assert.NoError(t, afero.WriteFile(fs, name, content, mode))
+	}
+	return fs
+}
+
+func assertFixtureExpectations() ImageExpectations {
+	return ImageExpectations{Assertions: DefaultAssertions(true), Layout: partition.DefaultVolumeLayout()}
+}
+
+func TestAssertImage(t *testing.T) {
+	assert.NoError(t, AssertImage(context.Background(), assertFixture(t), assertFixtureExpectations()))
+}
+
+func TestAssertImageListsEveryViolation(t *testing.T) {
+	fs := assertFixture(t)
+	assert.NoError(t, afero.WriteFile(fs, "/etc/systemd/system/kubelet.service", nil, 0644))
+	assert.NoError(t, afero.WriteFile(fs, "/usr/local/bin/kubeadm", elfBinary(t, elf.EM_X86_64), 0755))
+	assert.NoError(t, fs.Remove("/etc/containerd/config.toml"))
+	assert.NoError(t, afero.WriteFile(fs, "/etc/cloud/cloud.cfg.d/06_user.cfg", []byte("users: [kat"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, commandLinePath, []byte("root=/dev/mmcblk0p2 quiet\nsplash\n"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, "/etc/fstab", []byte("/dev/rootvg/datalv /data ext4 defaults 0 1\n"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, "/etc/systemd/system/promisc.service", []byte("[Service]\nExecStart=/usr/local/bin/promisc.sh\n"), 0644))
+
+	err := AssertImage(context.Background(), fs, assertFixtureExpectations())
+	var failed *ErrAssertions
+	assert.ErrorAs(t, err, &failed)
+	assert.Equal(t, []string{
+		"/etc/systemd/system/kubelet.service: is empty",
+		"/etc/systemd/system/promisc.service: runs /usr/local/bin/promisc.sh which isn't in the image",
+		"/etc/cloud/cloud.cfg.d/06_user.cfg: isn't valid yaml: yaml: line 1: did not find expected ',' or ']'",
+		"/etc/containerd/config.toml: doesn't exist",
+		"/usr/local/bin/kubeadm: is built for EM_X86_64 instead of arm64",
+		"/etc/fstab: line 1 mounts /dev/rootvg/datalv which isn't a volume in the layout",
+		"/etc/fstab: /boot/firmware isn't mounted",
+		"/etc/fstab: / isn't mounted",
+		"/etc/fstab: /var/lib/longhorn isn't mounted",
+		"/etc/fstab: /var/lib/containerd isn't mounted",
+		"/boot/firmware/cmdline.txt: has 2 lines instead of 1",
+	}, failed.Violations)
+}
+
+func TestAssertImagePackages(t *testing.T) {
+	fs := assertFixture(t)
+	assert.NoError(t, afero.WriteFile(fs, "/var/lib/dpkg/status", []byte(
+		"Package: curl\nStatus: install ok installed\nVersion: 7.81.0-1ubuntu1.15\n\n"+
+			"Package: apport\nStatus: deinstall ok config-files\nVersion: 2.20.11-0ubuntu82\n"), 0644))
+	expected := assertFixtureExpectations()
+
+	expected.Packages = []string{"curl"}
+	assert.NoError(t, AssertImage(context.Background(), fs, expected))
+
+	expected.Packages = []string{"curl", "apport", "open-iscsi"}
+	var assertionErr *ErrAssertions
+	assert.ErrorAs(t, AssertImage(context.Background(), fs, expected), &assertionErr)
+	assert.Equal(t, []string{"package apport isn't installed", "package open-iscsi isn't installed"}, assertionErr.Violations)
+}
+
+func TestCheckExecutableScript(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "/usr/bin/bash", elfBinary(t, elf.EM_AARCH64), 0755))
+	assert.NoError(t, afero.WriteFile(fs, "/usr/local/bin/promisc.sh", []byte("#!/usr/bin/bash\nip link set eth0 promisc on\n"), 0755))
+	assert.NoError(t, checkExecutable(fs, "/usr/local/bin/promisc.sh"))
+
+	assert.NoError(t, afero.WriteFile(fs, "/usr/local/bin/expand.sh", []byte("#!/bin/zsh\n"), 0755))
+	assert.EqualError(t, checkExecutable(fs, "/usr/local/bin/expand.sh"), "has interpreter /bin/zsh which isn't in the image")
+
+	assert.NoError(t, afero.WriteFile(fs, "/usr/local/bin/notes", []byte("#!/usr/bin/bash\n"), 0644))
+	assert.EqualError(t, checkExecutable(fs, "/usr/local/bin/notes"), "isn't executable")
+}
+
+func TestAssertionsValidate(t *testing.T) {
+	assert.NoError(t, DefaultAssertions(true).Validate())
+	assert.ErrorContains(t, Assertions{{Path: "etc/fstab", Kind: AssertFile}}.Validate(), "must be absolute")
+	assert.ErrorContains(t, Assertions{{Path: "/etc/fstab", Kind: "json"}}.Validate(), `unknown kind "json"`)
+	assert.ErrorContains(t, Assertions{{Path: "/etc/fstab", Kind: AssertFile, Mode: "rw-r--r--"}}.Validate(), "invalid mode")
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/spf13/afero"
+)
+
+const (
+	qemuStatic = "qemu-aarch64-static"
+	// imageQemuPath is where binfmt_misc looks for the interpreter when an arm64 binary runs inside the container
+	imageQemuPath = "/usr/bin/qemu-aarch64-static"
+	binfmtEntry   = "qemu-aarch64"
+	// aarch64Magic and aarch64Mask match arm64 ELF headers, copied from qemu's scripts/qemu-binfmt-conf.sh
+	aarch64Magic = `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00`
+	aarch64Mask  = `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`
+)
+
+// these are swapped out in tests, the real ones touch the host
+var (
+	hostArch  = runtime.GOARCH
+	hostFs    = afero.NewOsFs()
+	binfmtDir = "/proc/sys/fs/binfmt_misc"
+	lookPath  = exec.LookPath
+)
+
+// ForceEmulation runs the image's binaries through qemu even on an arm64 host, for testing the emulated path there.
+var ForceEmulation bool
+
+// forcedRegistration is set when EnsureBinfmt registered qemu on an arm64 host, where leaving it registered would run
+// every arm64 binary on the host through qemu.
+var forcedRegistration bool
+
+// HostArch is the build host's architecture as Go names it, e.g. amd64 or arm64.
+func HostArch() string {
+	return hostArch
+}
+
+// Emulated reports whether the image's arm64 binaries run through qemu instead of natively.
+func Emulated() bool {
+	return hostArch != "arm64" || ForceEmulation
+}
+
+// binfmtRegistration registers interpreter for arm64 binaries. The F flag opens the interpreter at registration so
+// it's found even where the container has no copy.
+func binfmtRegistration(interpreter string) string {
+	return fmt.Sprintf(":%s:M::%s:%s:%s:F", binfmtEntry, aarch64Magic, aarch64Mask, interpreter)
+}
+
+// EnsureBinfmt lets an x86_64 host run the image's arm64 binaries: it registers qemu-aarch64-static with binfmt_misc
+// when nothing handles arm64 yet and copies the interpreter into the image. On an arm64 host it does nothing unless
+// ForceEmulation is set.
+func EnsureBinfmt(ctx context.Context, fs afero.Fs) error {
+	_, span := telemetry.Start(ctx, "ensure binfmt")
+	defer span.End()
+	span.SetAttributes(telemetry.HostArchKey.String(hostArch), telemetry.EmulatedKey.Bool(Emulated()))
+
+	if !Emulated() {
+		return nil
+	}
+
+	interpreter, lookErr := lookPath(qemuStatic)
+	if lookErr != nil {
+		return fmt.Errorf("building on %s needs %s, install qemu-user-static: %w", hostArch, qemuStatic, lookErr)
+	}
+
+	registered, statErr := afero.Exists(hostFs, path.Join(binfmtDir, binfmtEntry))
+	if statErr != nil {
+		return statErr
+	}
+	if !registered {
+		register := path.Join(binfmtDir, "register")
+		if available, _ := afero.Exists(hostFs, register); !available {
+			return errors.New("binfmt_misc is not mounted, mount it at " + binfmtDir)
+		}
+		registerFile, openErr := hostFs.OpenFile(register, os.O_WRONLY, 0)
+		if openErr != nil {
+			return openErr
+		}
+		if _, err := registerFile.WriteString(binfmtRegistration(interpreter)); err != nil {
+			_ = registerFile.Close()
+			return fmt.Errorf("could not register %s with binfmt_misc: %w", qemuStatic, err)
+		}
+		if err := registerFile.Close(); err != nil {
+			return err
+		}
+		forcedRegistration = hostArch == "arm64"
+	}
+
+	binary, readErr := afero.ReadFile(hostFs, interpreter)
+	if readErr != nil {
+		return readErr
+	}
+	if err := fs.MkdirAll(path.Dir(imageQemuPath), 0755); err != nil {
+		return err
+	}
+	return afero.WriteFile(fs, imageQemuPath, binary, 0755)
+}
+
+// EmulationFiles are the paths inside the image that only exist while it's being configured, RemoveBinfmt deletes
+// them again.
+func EmulationFiles() []string {
+	if !Emulated() {
+		return nil
+	}
+	return []string{imageQemuPath}
+}
+
+// RemoveBinfmt deletes the interpreter EnsureBinfmt copied so it doesn't ship in the image. A registration forced on
+// an arm64 host is removed too, an x86_64 host keeps its registration for the next build.
+func RemoveBinfmt(ctx context.Context, fs afero.Fs) error {
+	if !Emulated() {
+		return nil
+	}
+
+	_, span := telemetry.Start(ctx, "remove binfmt")
+	defer span.End()
+
+	if err := fs.Remove(imageQemuPath); err != nil && !errors.Is(err, afero.ErrFileNotFound) {
+		return err
+	}
+	if !forcedRegistration {
+		return nil
+	}
+	entry, openErr := hostFs.OpenFile(path.Join(binfmtDir, binfmtEntry), os.O_WRONLY, 0)
+	if openErr != nil {
+		return openErr
+	}
+	// writing -1 to an entry removes it
+	if _, err := entry.WriteString("-1"); err != nil {
+		_ = entry.Close()
+		return fmt.Errorf("could not remove the forced %s registration: %w", qemuStatic, err)
+	}
+	if err := entry.Close(); err != nil {
+		return err
+	}
+	forcedRegistration = false
+	return nil
+}
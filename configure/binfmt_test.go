@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBinfmtHost swaps the host hooks for an in memory x86_64 host with qemu-user-static installed.
+func fakeBinfmtHost(t *testing.T, arch string) afero.Fs {
+	host := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(host, "/usr/bin/qemu-aarch64-static", []byte("qemu"), 0755))
+	assert.NoError(t, afero.WriteFile(host, "/proc/sys/fs/binfmt_misc/register", nil, 0200))
+
+	originalArch, originalFs, originalLookPath := hostArch, hostFs, lookPath
+	hostArch, hostFs = arch, host
+	lookPath = func(file string) (string, error) { return "/usr/bin/" + file, nil }
+	t.Cleanup(func() {
+		hostArch, hostFs, lookPath = originalArch, originalFs, originalLookPath
+	})
+	return host
+}
+
+func TestEnsureBinfmt(t *testing.T) {
+	host := fakeBinfmtHost(t, "amd64")
+	image := afero.NewMemMapFs()
+
+	assert.NoError(t, EnsureBinfmt(context.Background(), image))
+
+	registration, err := afero.ReadFile(host, "/proc/sys/fs/binfmt_misc/register")
+	assert.NoError(t, err)
+	assert.Equal(t, `:qemu-aarch64:M::\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00:\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff:/usr/bin/qemu-aarch64-static:F`, string(registration))
+
+	interpreter, err := afero.ReadFile(image, "/usr/bin/qemu-aarch64-static")
+	assert.NoError(t, err)
+	assert.Equal(t, "qemu", string(interpreter))
+
+	assert.NoError(t, RemoveBinfmt(context.Background(), image))
+	exists, err := afero.Exists(image, "/usr/bin/qemu-aarch64-static")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.NoError(t, RemoveBinfmt(context.Background(), image))
+}
+
+func TestEnsureBinfmtAlreadyRegistered(t *testing.T) {
+	host := fakeBinfmtHost(t, "amd64")
+	assert.NoError(t, afero.WriteFile(host, "/proc/sys/fs/binfmt_misc/qemu-aarch64", []byte("enabled\n"), 0644))
+
+	assert.NoError(t, EnsureBinfmt(context.Background(), afero.NewMemMapFs()))
+	registration, err := afero.ReadFile(host, "/proc/sys/fs/binfmt_misc/register")
+	assert.NoError(t, err)
+	assert.Empty(t, registration)
+}
+
+func TestEnsureBinfmtMissing(t *testing.T) {
+	host := fakeBinfmtHost(t, "amd64")
+	assert.NoError(t, host.Remove("/proc/sys/fs/binfmt_misc/register"))
+	assert.ErrorContains(t, EnsureBinfmt(context.Background(), afero.NewMemMapFs()), "binfmt_misc is not mounted")
+
+	lookPath = func(string) (string, error) { return "", errors.New("executable file not found in $PATH") }
+	assert.ErrorContains(t, EnsureBinfmt(context.Background(), afero.NewMemMapFs()), "install qemu-user-static")
+}
+
+func TestEnsureBinfmtArm64(t *testing.T) {
+	fakeBinfmtHost(t, "arm64")
+	assert.False(t, Emulated())
+	assert.Empty(t, EmulationFiles())
+	lookPath = func(string) (string, error) { return "", errors.New("should not be called") }
+	image := afero.NewMemMapFs()
+
+	assert.NoError(t, EnsureBinfmt(context.Background(), image))
+	exists, err := afero.Exists(image, "/usr/bin/qemu-aarch64-static")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestEnsureBinfmtForced(t *testing.T) {
+	host := fakeBinfmtHost(t, "arm64")
+	ForceEmulation = true
+	t.Cleanup(func() { ForceEmulation = false })
+	assert.True(t, Emulated())
+	assert.Equal(t, "arm64", HostArch())
+	image := afero.NewMemMapFs()
+
+	assert.NoError(t, EnsureBinfmt(context.Background(), image))
+	registration, err := afero.ReadFile(host, "/proc/sys/fs/binfmt_misc/register")
+	assert.NoError(t, err)
+	assert.Contains(t, string(registration), ":qemu-aarch64:M::")
+	exists, err := afero.Exists(image, "/usr/bin/qemu-aarch64-static")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, []string{"/usr/bin/qemu-aarch64-static"}, EmulationFiles())
+
+	// the kernel adds the entry once it's registered, the host must not keep running its own binaries through qemu
+	assert.NoError(t, afero.WriteFile(host, "/proc/sys/fs/binfmt_misc/qemu-aarch64", nil, 0644))
+	assert.NoError(t, RemoveBinfmt(context.Background(), image))
+	entry, err := afero.ReadFile(host, "/proc/sys/fs/binfmt_misc/qemu-aarch64")
+	assert.NoError(t, err)
+	assert.Equal(t, "-1", string(entry))
+	assert.False(t, forcedRegistration)
+}
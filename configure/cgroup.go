@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import "fmt"
+
+// CgroupMode picks the cgroup hierarchy the node boots with. The kernel command line, containerd, and the kubelet are
+// all configured from the one mode, a node whose runtime and kubelet disagree on the driver joins and then flaps.
+type CgroupMode string
+
+const (
+	// CgroupUnified boots cgroup v2 with the systemd driver, it's the default.
+	CgroupUnified CgroupMode = "unified"
+	// CgroupLegacy boots the v1 hierarchy with the cgroupfs driver.
+	CgroupLegacy CgroupMode = "legacy"
+)
+
+func (m CgroupMode) withDefault() CgroupMode {
+	if m == "" {
+		return CgroupUnified
+	}
+	return m
+}
+
+func (m CgroupMode) Validate() error {
+	switch m.withDefault() {
+	case CgroupUnified, CgroupLegacy:
+		return nil
+	default:
+		return fmt.Errorf("cgroup mode must be %s or %s, got: %q", CgroupUnified, CgroupLegacy, m)
+	}
+}
+
+// Driver is the cgroup driver containerd and the kubelet both use.
+func (m CgroupMode) Driver() string {
+	if m.withDefault() == CgroupLegacy {
+		return "cgroupfs"
+	}
+	return "systemd"
+}
+
+// SystemdCgroup is containerd's runc option for the systemd driver.
+func (m CgroupMode) SystemdCgroup() bool {
+	return m.Driver() == "systemd"
+}
+
+// hierarchyParam is always on the command line so the mode doesn't depend on what the distro's systemd defaults to.
+func (m CgroupMode) hierarchyParam() string {
+	if m.withDefault() == CgroupLegacy {
+		return "systemd.unified_cgroup_hierarchy=0"
+	}
+	return "systemd.unified_cgroup_hierarchy=1"
+}
+
+// defaultParams enable the memory and cpuset controllers the raspberry pi kernels leave off, swap accounting is a
+// v1 only parameter.
+func (m CgroupMode) defaultParams() []string {
+	if m.withDefault() == CgroupLegacy {
+		return []string{"cgroup_enable=memory", "swapaccount=1", "cgroup_memory=1", "cgroup_enable=cpuset"}
+	}
+	return []string{"cgroup_enable=memory", "cgroup_memory=1", "cgroup_enable=cpuset"}
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/stretchr/testify/assert"
+)
+
+// every component has to agree on the driver, so each mode is checked across all three
+func TestCgroupModesAgree(t *testing.T) {
+	for _, tc := range []struct {
+		mode          CgroupMode
+		hierarchy     string
+		systemdCgroup string
+		driver        string
+	}{
+		{mode: "", hierarchy: "systemd.unified_cgroup_hierarchy=1", systemdCgroup: "SystemdCgroup = true", driver: "--cgroup-driver=systemd"},
+		{mode: CgroupUnified, hierarchy: "systemd.unified_cgroup_hierarchy=1", systemdCgroup: "SystemdCgroup = true", driver: "--cgroup-driver=systemd"},
+		{mode: CgroupLegacy, hierarchy: "systemd.unified_cgroup_hierarchy=0", systemdCgroup: "SystemdCgroup = false", driver: "--cgroup-driver=cgroupfs"},
+	} {
+		assert.NoError(t, tc.mode.Validate(), tc.mode)
+		assert.Contains(t, CommandLine{}.WithCgroupMode(tc.mode).String(), tc.hierarchy, tc.mode)
+
+		containerd, containerdErr := renderContainerdConfig(context.Background(), tc.mode)
+		assert.NoError(t, containerdErr)
+		assert.Contains(t, string(containerd), tc.systemdCgroup, tc.mode)
+
+		dropIn, dropInErr := utility.RenderTemplate(context.Background(), configFiles, "files/kubeadm-drop-in.template",
+			KubernetesSystemd{KubeletPath: "/usr/local/bin/kubelet", CgroupDriver: tc.mode.Driver()})
+		assert.NoError(t, dropInErr)
+		assert.Contains(t, dropIn.String(), tc.driver, tc.mode)
+		assert.Contains(t, dropIn.String(), "$KUBELET_CGROUP_ARGS")
+	}
+}
+
+func TestCgroupModeInvalid(t *testing.T) {
+	assert.Error(t, CgroupMode("v2").Validate())
+	_, err := renderContainerdConfig(context.Background(), "v2")
+	assert.Error(t, err)
+}
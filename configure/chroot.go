@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+)
+
+const (
+	ChrootAuto   = "auto"
+	ChrootNspawn = "nspawn"
+	ChrootPlain  = "chroot"
+)
+
+// ChrootRunner runs a command inside the image root so it uses the image's own binaries and package database.
+type ChrootRunner interface {
+	Run(ctx context.Context, timeout time.Duration, args ...string) error
+	// Stream is Run for long commands like apt-get install, their output is logged as it's printed.
+	Stream(ctx context.Context, timeout time.Duration, args ...string) error
+	// Output is Run for commands whose stdout is parsed, like dpkg-query.
+	Output(ctx context.Context, timeout time.Duration, args ...string) ([]byte, error)
+}
+
+// NspawnRunner runs commands in a systemd-nspawn container over Root.
+type NspawnRunner struct {
+	Root string
+}
+
+func (n NspawnRunner) Run(ctx context.Context, timeout time.Duration, args ...string) error {
+	_, err := utility.Run(ctx, utility.RunOptions{Timeout: timeout}, "systemd-nspawn", nspawnArgs(n.Root, args...)...)
+	return err
+}
+
+func (n NspawnRunner) Stream(ctx context.Context, timeout time.Duration, args ...string) error {
+	_, err := utility.Run(ctx, utility.RunOptions{Timeout: timeout, Stream: true}, "systemd-nspawn", nspawnArgs(n.Root, args...)...)
+	return err
+}
+
+func (n NspawnRunner) Output(ctx context.Context, timeout time.Duration, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	// quiet keeps nspawn's own status lines out of the parsed output
+	return utility.ExecRunner{}.Output(ctx, exec.Command("systemd-nspawn", append([]string{"--quiet"}, nspawnArgs(n.Root, args...)...)...)) //nolint:gosec
+}
+
+// nspawnArgs boots nothing, it just runs args in a container over root with apt kept non interactive.
+func nspawnArgs(root string, args ...string) []string {
+	return append([]string{"--setenv=DEBIAN_FRONTEND=noninteractive", "-D", root}, args...)
+}
+
+// chrootBinds are mounted into the root for every command, in order, and unmounted in reverse.
+var chrootBinds = []string{"/proc", "/sys", "/dev", "/dev/pts"}
+
+// BindChrootRunner is for hosts without systemd-nspawn, like minimal ci containers. It bind mounts the kernel
+// filesystems into Root around each command.
+type BindChrootRunner struct {
+	Root   string
+	Runner utility.Runner
+}
+
+func (b BindChrootRunner) Run(ctx context.Context, timeout time.Duration, args ...string) error {
+	return b.run(ctx, timeout, b.Runner.Run, args...)
+}
+
+func (b BindChrootRunner) Stream(ctx context.Context, timeout time.Duration, args ...string) error {
+	return b.run(ctx, timeout, b.Runner.Stream, args...)
+}
+
+func (b BindChrootRunner) Output(ctx context.Context, timeout time.Duration, args ...string) ([]byte, error) {
+	var output []byte
+	err := b.run(ctx, timeout, func(ctx context.Context, cmd *exec.Cmd) error {
+		var outputErr error
+		output, outputErr = b.Runner.Output(ctx, cmd)
+		return outputErr
+	}, args...)
+	return output, err
+}
+
+// run mounts the binds, runs the chroot command through execute, and unmounts them again.
+func (b BindChrootRunner) run(ctx context.Context, timeout time.Duration, execute func(context.Context, *exec.Cmd) error, args ...string) (err error) {
+	mounted := make([]string, 0, len(chrootBinds))
+	defer func() {
+		// the binds come down even when the command timed out or the build was interrupted
+		unmountCtx := context.WithoutCancel(ctx)
+		for i := len(mounted) - 1; i >= 0; i-- {
+			if unmountErr := b.Runner.Run(unmountCtx, exec.Command("umount", mounted[i])); unmountErr != nil && err == nil { //nolint:gosec
+				err = fmt.Errorf("could not unmount %s from the chroot: %w", mounted[i], unmountErr)
+			}
+		}
+	}()
+
+	for _, source := range chrootBinds {
+		target := filepath.Join(b.Root, source)
+		if err := b.Runner.Run(ctx, exec.Command("mount", "--bind", source, target)); err != nil { //nolint:gosec
+			return err
+		}
+		mounted = append(mounted, target)
+	}
+
+	commandCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	chrootArgs := append([]string{b.Root, "/usr/bin/env", "DEBIAN_FRONTEND=noninteractive"}, args...)
+	return execute(commandCtx, exec.Command("chroot", chrootArgs...)) //nolint:gosec
+}
+
+// NewChrootRunner picks how commands run inside root. Auto uses systemd-nspawn when the host has it and falls back to
+// a plain chroot.
+func NewChrootRunner(mode string, root string, runner utility.Runner) (ChrootRunner, error) {
+	switch mode {
+	case "", ChrootAuto:
+		if _, err := lookPath("systemd-nspawn"); err != nil {
+			return BindChrootRunner{Root: root, Runner: runner}, nil
+		}
+		return NspawnRunner{Root: root}, nil
+	case ChrootNspawn:
+		return NspawnRunner{Root: root}, nil
+	case ChrootPlain:
+		return BindChrootRunner{Root: root, Runner: runner}, nil
+	default:
+		return nil, fmt.Errorf("chroot must be %s, %s, or %s, got: %q", ChrootAuto, ChrootNspawn, ChrootPlain, mode)
+	}
+}
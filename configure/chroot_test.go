@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingChroot is a ChrootRunner that records commands instead of running them.
+type recordingChroot struct {
+	commands []string
+	// outputs is what Output returns for each command
+	outputs map[string][]byte
+}
+
+func (r *recordingChroot) Run(_ context.Context, _ time.Duration, args ...string) error {
+	r.commands = append(r.commands, strings.Join(args, " "))
+	return nil
+}
+
+func (r *recordingChroot) Stream(ctx context.Context, timeout time.Duration, args ...string) error {
+	return r.Run(ctx, timeout, args...)
+}
+
+func (r *recordingChroot) Output(ctx context.Context, timeout time.Duration, args ...string) ([]byte, error) {
+	_ = r.Run(ctx, timeout, args...)
+	return r.outputs[strings.Join(args, " ")], nil
+}
+
+// unitFs returns an on disk fs rooted at a temp dir, along with the root, with the systemd unit dir in place. Enabling
+// a unit symlinks it, which the in memory fs can't do.
+func unitFs(t *testing.T) (afero.Fs, string) {
+	t.Helper()
+	root := t.TempDir()
+	fs := afero.NewBasePathFs(afero.NewOsFs(), root)
+	assert.NoError(t, fs.MkdirAll("/etc/systemd/system", 0755))
+	return fs, root
+}
+
+func TestBindChrootRunner(t *testing.T) {
+	runner := &utility.FakeRunner{}
+	chroot := BindChrootRunner{Root: "./mnt", Runner: runner}
+
+	assert.NoError(t, chroot.Run(context.Background(), time.Minute, "apt-get", "update"))
+	assert.Equal(t, []string{
+		"mount --bind /proc mnt/proc",
+		"mount --bind /sys mnt/sys",
+		"mount --bind /dev mnt/dev",
+		"mount --bind /dev/pts mnt/dev/pts",
+		"chroot ./mnt /usr/bin/env DEBIAN_FRONTEND=noninteractive apt-get update",
+		"umount mnt/dev/pts",
+		"umount mnt/dev",
+		"umount mnt/sys",
+		"umount mnt/proc",
+	}, runner.Commands)
+}
+
+func TestBindChrootRunnerFailure(t *testing.T) {
+	// binds are torn down even when the command or a later bind fails
+	failing := &utility.FakeRunner{Errors: map[string]error{
+		"chroot ./mnt /usr/bin/env DEBIAN_FRONTEND=noninteractive false": errors.New("exit status 1"),
+	}}
+	assert.ErrorContains(t, BindChrootRunner{Root: "./mnt", Runner: failing}.Run(context.Background(), time.Minute, "false"), "exit status 1")
+	assert.Equal(t, "umount mnt/proc", failing.Commands[len(failing.Commands)-1])
+
+	partial := &utility.FakeRunner{Errors: map[string]error{"mount --bind /dev mnt/dev": errors.New("permission denied")}}
+	assert.Error(t, BindChrootRunner{Root: "./mnt", Runner: partial}.Run(context.Background(), time.Minute, "true"))
+	assert.Equal(t, []string{
+		"mount --bind /proc mnt/proc",
+		"mount --bind /sys mnt/sys",
+		"mount --bind /dev mnt/dev",
+		"umount mnt/sys",
+		"umount mnt/proc",
+	}, partial.Commands)
+
+	stuck := &utility.FakeRunner{Errors: map[string]error{"umount mnt/dev": errors.New("target is busy")}}
+	assert.ErrorContains(t, BindChrootRunner{Root: "./mnt", Runner: stuck}.Run(context.Background(), time.Minute, "true"), "could not unmount mnt/dev")
+}
+
+// contextRunner records the commands that were handed a context that's already done.
+type contextRunner struct {
+	utility.FakeRunner
+	done []string
+}
+
+func (c *contextRunner) Run(ctx context.Context, cmd *exec.Cmd) error {
+	if ctx.Err() != nil {
+		c.done = append(c.done, strings.Join(cmd.Args, " "))
+	}
+	return c.FakeRunner.Run(ctx, cmd)
+}
+
+func TestBindChrootRunnerUnmountsAfterCancel(t *testing.T) {
+	// the command's timeout is over by the time the binds come down
+	runner := &contextRunner{}
+	assert.NoError(t, BindChrootRunner{Root: "./mnt", Runner: runner}.Run(context.Background(), time.Minute, "true"))
+	assert.Empty(t, runner.done)
+
+	// an interrupted build still unmounts
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	interrupted := &contextRunner{}
+	assert.NoError(t, BindChrootRunner{Root: "./mnt", Runner: interrupted}.Run(ctx, time.Minute, "true"))
+	for _, command := range interrupted.done {
+		assert.False(t, strings.HasPrefix(command, "umount"), command)
+	}
+	assert.Equal(t, "umount mnt/proc", interrupted.Commands[len(interrupted.Commands)-1])
+}
+
+func TestNewChrootRunner(t *testing.T) {
+	original := lookPath
+	t.Cleanup(func() { lookPath = original })
+
+	lookPath = func(file string) (string, error) { return "/usr/bin/" + file, nil }
+	auto, err := NewChrootRunner("", "./mnt", utility.ExecRunner{})
+	assert.NoError(t, err)
+	assert.Equal(t, NspawnRunner{Root: "./mnt"}, auto)
+
+	lookPath = func(string) (string, error) { return "", errors.New("not found") }
+	auto, err = NewChrootRunner(ChrootAuto, "./mnt", utility.ExecRunner{})
+	assert.NoError(t, err)
+	assert.IsType(t, BindChrootRunner{}, auto)
+
+	forced, err := NewChrootRunner(ChrootNspawn, "./mnt", utility.ExecRunner{})
+	assert.NoError(t, err)
+	assert.Equal(t, NspawnRunner{Root: "./mnt"}, forced)
+
+	_, err = NewChrootRunner("docker", "./mnt", utility.ExecRunner{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/distro"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const (
+	cloudInitDropInDir = "/etc/cloud/cloud.cfg.d/"
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+// keyProviders maps an authorized key reference prefix to the url format its public keys are published at.
+var keyProviders = map[string]string{
+	"github": "https://github.com/%s.keys",
+	"gitlab": "https://gitlab.com/%s.keys",
+}
+
+// keyProviderUsernames are each provider's username rules, neither matches the linux usernamePattern.
+var keyProviderUsernames = map[string]*regexp.Regexp{
+	// alphanumerics and single hyphens, never at either end
+	"github": regexp.MustCompile(`^[a-zA-Z0-9](?:-?[a-zA-Z0-9]){0,38}$`),
+	// alphanumerics, underscores, hyphens, and dots, without a leading hyphen or a trailing dot
+	"gitlab": regexp.MustCompile(`^[a-zA-Z0-9_](?:[a-zA-Z0-9_.-]*[a-zA-Z0-9_-])?$`),
+}
+
+const (
+	keyFetchAttempts = 3
+)
+
+var keyFetchBackoff = 2 * time.Second
+
+type CloudInitConfig struct {
+	Username string   `yaml:"username"`
+	Gecos    string   `yaml:"gecos"`
+	Groups   []string `yaml:"groups"`
+	// SSHAuthorizedKeys must not be empty unless PasswordAuth is enabled. Entries are either literal public keys or
+	// github:<user> / gitlab:<user> references resolved at build time.
+	SSHAuthorizedKeys []string `yaml:"sshAuthorizedKeys"`
+	PasswordAuth      bool     `yaml:"passwordAuth"`
+	// PasswordHash is a crypt(3) hash as produced by mkpasswd, required when PasswordAuth is enabled.
+	PasswordHash string `yaml:"passwordHash"`
+	SudoRule     string `yaml:"sudoRule"`
+	// Hostname is left to cloud-init's default when empty.
+	Hostname string `yaml:"hostname"`
+	// LockDefaultUser drops the distro default (ubuntu) user from the users list so it's never created.
+	LockDefaultUser bool `yaml:"lockDefaultUser"`
+	// Network replaces the default dhcp on eth0 network config when set.
+	Network *NetworkConfig `yaml:"network"`
+}
+
+func DefaultCloudInitConfig() CloudInitConfig {
+	return CloudInitConfig{
+		Username: "kat",
+		Gecos:    "my user",
+		Groups:   []string{"adm", "audio", "cdrom", "dialout", "dip", "floppy", "lxd", "netdev", "plugdev", "sudo", "video"},
+		SSHAuthorizedKeys: []string{
+			"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHRGGe84zs3TxJ8BTbsiVDAsctSf2JF5AS6g/5CyGD2l kat@local-pis",
+			"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIMuS8Kd79MsGzWd68K7WrEIbtBM8WnsqTn0nNz1s+1V7 pi-key-mac",
+		},
+		SudoRule:        "ALL=(ALL) NOPASSWD:ALL",
+		LockDefaultUser: true,
+	}
+}
+
+func (c CloudInitConfig) Validate() error {
+	if !usernamePattern.MatchString(c.Username) {
+		return fmt.Errorf("invalid username: %q", c.Username)
+	}
+	if !c.PasswordAuth && len(c.SSHAuthorizedKeys) == 0 {
+		return errors.New("at least one ssh authorized key is required when password auth is disabled")
+	}
+	if c.PasswordAuth && !strings.HasPrefix(c.PasswordHash, "$") {
+		return errors.New("password auth requires a crypt formatted password hash")
+	}
+	for _, value := range append([]string{c.Gecos, c.SudoRule, c.Hostname, c.PasswordHash}, c.SSHAuthorizedKeys...) {
+		if strings.ContainsAny(value, "\"\n") {
+			return fmt.Errorf("cloud-init values can not contain quotes or newlines: %q", value)
+		}
+	}
+	return nil
+}
+
+// noCloudDatasource makes cloud-init installed after the fact run its modules from the drop ins without waiting on a
+// metadata service.
+const noCloudDatasource = "# managed by pi-image-builder\ndatasource_list: [NoCloud, None]\n"
+
+// InstallCloudInit installs cloud-init on images that don't ship it, so CloudInit's drop ins apply on every distro.
+func InstallCloudInit(ctx context.Context, chroot ChrootRunner, fs afero.Fs, d distro.Distro) error {
+	if d.CloudInit {
+		return nil
+	}
+
+	ctx, span := telemetry.Start(ctx, "install cloudinit")
+	defer span.End()
+
+	if err := chroot.Stream(ctx, 20*time.Minute, "apt-get", "install", "-y", "cloud-init"); err != nil {
+		return err
+	}
+
+	if err := fs.MkdirAll(cloudInitDropInDir, 0755); err != nil {
+		return err
+	}
+
+	_, writeErr := IdempotentWrite(ctx, fs, strings.NewReader(noCloudDatasource), path.Join(cloudInitDropInDir, "05_datasource.cfg"), 0644)
+	return writeErr
+}
+
+func CloudInit(ctx context.Context, fs afero.Fs, cfg CloudInitConfig) error {
+
+	ctx, span := telemetry.Start(ctx, "configure cloudinit")
+	defer span.End()
+
+	resolvedKeys, resolveErr := ResolveAuthorizedKeys(ctx, cfg.SSHAuthorizedKeys)
+	if resolveErr != nil {
+		return resolveErr
+	}
+	cfg.SSHAuthorizedKeys = resolvedKeys
+
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	user, userErr := utility.RenderTemplate(ctx, configFiles, "files/06_user.cfg.yml.template", cfg)
+	if userErr != nil {
+		return userErr
+	}
+
+	// a broken user-data file means nobody can log in, so refuse to write anything that isn't yaml
+	if err := validateYAMLDocuments(user.Bytes()); err != nil {
+		return fmt.Errorf("rendered cloud-init user config is invalid: %w", err)
+	}
+
+	if _, err := IdempotentWrite(ctx, fs, &user, path.Join(cloudInitDropInDir, "06_user.cfg"), 0644); err != nil {
+		return err
+	}
+
+	network, networkErr := renderNetwork(ctx, cfg.Network)
+	if networkErr != nil {
+		return networkErr
+	}
+
+	if _, err := IdempotentWrite(ctx, fs, bytes.NewReader(network), path.Join(cloudInitDropInDir, "07_network.cfg"), 0644); err != nil {
+		return err
+	}
+
+	promisc, promiscErr := configFiles.Open("files/promisc.sh")
+	if promiscErr != nil {
+		return promiscErr
+	}
+
+	if _, err := IdempotentWrite(ctx, fs, promisc, "/etc/networkd-dispatcher/routable.d/promisc.sh", 0644); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ResolveAuthorizedKeys replaces github:<user> and gitlab:<user> references with the keys published for that user.
+// Literal keys pass through untouched. Any reference that can't be resolved fails the whole call since an image
+// without working keys can't be logged into.
+func ResolveAuthorizedKeys(ctx context.Context, entries []string) ([]string, error) {
+	resolved := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		url, reference, urlErr := keyURL(entry)
+		if urlErr != nil {
+			return nil, urlErr
+		}
+		if !reference {
+			resolved = append(resolved, entry)
+			continue
+		}
+
+		keys, fetchErr := fetchKeys(ctx, url)
+		if fetchErr != nil {
+			return nil, fmt.Errorf("could not resolve ssh keys for %s: %w", entry, fetchErr)
+		}
+		resolved = append(resolved, keys...)
+	}
+	return resolved, nil
+}
+
+// AuthorizedKeyURLs are the urls ResolveAuthorizedKeys fetches for entries, invalid references are left out.
+func AuthorizedKeyURLs(entries []string) []string {
+	var urls []string
+	for _, entry := range entries {
+		if url, reference, err := keyURL(entry); err == nil && reference {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// keyURL is where a github:<user> or gitlab:<user> reference's keys are published, reference is false for a literal
+// key.
+func keyURL(entry string) (string, bool, error) {
+	provider, user, found := strings.Cut(entry, ":")
+	urlFormat, known := keyProviders[provider]
+	if !found || !known {
+		return "", false, nil
+	}
+	if pattern, ok := keyProviderUsernames[provider]; ok && !pattern.MatchString(user) {
+		return "", true, fmt.Errorf("invalid %s username in key reference: %q", provider, entry)
+	}
+	return fmt.Sprintf(urlFormat, user), true, nil
+}
+
+func fetchKeys(ctx context.Context, url string) ([]string, error) {
+	ctx, span := telemetry.GetTracer().Start(ctx, fmt.Sprintf("fetch ssh keys: %s", url))
+	defer span.End()
+
+	var lastErr error
+	for attempt := 0; attempt < keyFetchAttempts; attempt++ {
+		if attempt > 0 {
+			telemetry.AddRetry(ctx, "fetch ssh keys")
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(keyFetchBackoff * time.Duration(attempt)):
+			}
+		}
+
+		keys, err := fetchKeysOnce(ctx, url)
+		if err == nil {
+			return keys, nil
+		}
+		span.AddEvent(fmt.Sprintf("attempt %d failed: %v", attempt+1, err))
+		// a user without keys doesn't start having them a few seconds later
+		if errors.Is(err, &ErrStatusCode{StatusCode: http.StatusNotFound}) {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func fetchKeysOnce(ctx context.Context, url string) ([]string, error) {
+	response, requestErr := get(ctx, url)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	defer utility.WrappedClose(response.Body)
+
+	body, readErr := io.ReadAll(response.Body)
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	var keys []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if key := strings.TrimSpace(line); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys published")
+	}
+	return keys, nil
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/distro"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestCloudInitValidate(t *testing.T) {
+	noKeys := DefaultCloudInitConfig()
+	noKeys.SSHAuthorizedKeys = nil
+
+	passwordWithoutKeys := noKeys
+	passwordWithoutKeys.PasswordAuth = true
+	passwordWithoutKeys.PasswordHash = "$6$salt$hash"
+
+	passwordWithoutHash := noKeys
+	passwordWithoutHash.PasswordAuth = true
+
+	badUser := DefaultCloudInitConfig()
+	badUser.Username = "Kat Root"
+
+	quoted := DefaultCloudInitConfig()
+	quoted.Gecos = `my "user"`
+
+	cases := []struct {
+		name   string
+		config CloudInitConfig
+		valid  bool
+	}{
+		{name: "default", config: DefaultCloudInitConfig(), valid: true},
+		{name: "no keys", config: noKeys, valid: false},
+		{name: "password without keys", config: passwordWithoutKeys, valid: true},
+		{name: "password without hash", config: passwordWithoutHash, valid: false},
+		{name: "bad username", config: badUser, valid: false},
+		{name: "quoted value", config: quoted, valid: false},
+	}
+	for _, tt := range cases {
+		err := tt.config.Validate()
+		if tt.valid {
+			assert.NoError(t, err, tt.name)
+		} else {
+			assert.Error(t, err, tt.name)
+		}
+	}
+}
+
+func TestCloudInitRendersUser(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	cfg := DefaultCloudInitConfig()
+	cfg.Username = "serena"
+	cfg.Hostname = "pi-node"
+	assert.NoError(t, CloudInit(context.Background(), fs, cfg))
+
+	raw, readErr := afero.ReadFile(fs, "/etc/cloud/cloud.cfg.d/06_user.cfg")
+	assert.NoError(t, readErr)
+
+	var parsed struct {
+		Hostname  string `yaml:"hostname"`
+		SSHPwauth bool   `yaml:"ssh_pwauth"`
+		Users     []struct {
+			Name              string   `yaml:"name"`
+			Sudo              []string `yaml:"sudo"`
+			LockPasswd        bool     `yaml:"lock_passwd"`
+			SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys"`
+		} `yaml:"users"`
+	}
+	assert.NoError(t, yaml.Unmarshal(raw, &parsed))
+	assert.Equal(t, "pi-node", parsed.Hostname)
+	assert.False(t, parsed.SSHPwauth)
+	assert.Len(t, parsed.Users, 1)
+	assert.Equal(t, "serena", parsed.Users[0].Name)
+	assert.True(t, parsed.Users[0].LockPasswd)
+	assert.Equal(t, []string{"ALL=(ALL) NOPASSWD:ALL"}, parsed.Users[0].Sudo)
+	assert.Equal(t, cfg.SSHAuthorizedKeys, parsed.Users[0].SSHAuthorizedKeys)
+}
+
+func TestResolveAuthorizedKeys(t *testing.T) {
+	attempts, missingAttempts := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/ladyserena.keys":
+			_, _ = fmt.Fprint(writer, "ssh-ed25519 AAAA first\n\nssh-ed25519 BBBB second\n")
+		case "/flaky.keys":
+			attempts++
+			if attempts < 2 {
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = fmt.Fprint(writer, "ssh-ed25519 CCCC flaky\n")
+		case "/empty.keys":
+		default:
+			missingAttempts++
+			writer.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	originalProviders := keyProviders
+	originalBackoff := keyFetchBackoff
+	keyProviders = map[string]string{"github": server.URL + "/%s.keys"}
+	keyFetchBackoff = 0
+	defer func() {
+		keyProviders = originalProviders
+		keyFetchBackoff = originalBackoff
+	}()
+
+	ctx := context.Background()
+	keys, err := ResolveAuthorizedKeys(ctx, []string{"ssh-ed25519 LITERAL literal", "github:ladyserena", "github:flaky"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ssh-ed25519 LITERAL literal", "ssh-ed25519 AAAA first", "ssh-ed25519 BBBB second", "ssh-ed25519 CCCC flaky"}, keys)
+
+	_, emptyErr := ResolveAuthorizedKeys(ctx, []string{"github:empty"})
+	assert.Error(t, emptyErr)
+
+	_, missingErr := ResolveAuthorizedKeys(ctx, []string{"github:missing"})
+	assert.ErrorIs(t, missingErr, &ErrStatusCode{StatusCode: http.StatusNotFound})
+	// a 404 isn't retried
+	assert.Equal(t, 1, missingAttempts)
+}
+
+func TestAuthorizedKeyURLs(t *testing.T) {
+	urls := AuthorizedKeyURLs([]string{
+		"ssh-ed25519 LITERAL literal",
+		"github:LadySerena",
+		"github:42bytes",
+		"gitlab:serena.tiede",
+		"gitlab:_bot",
+		"github:serena.tiede",
+		"github:-serena",
+		"github:serena--tiede",
+		"gitlab:-serena",
+		"gitlab:serena.",
+		"gitlab:../serena",
+	})
+	assert.Equal(t, []string{
+		"https://github.com/LadySerena.keys",
+		"https://github.com/42bytes.keys",
+		"https://gitlab.com/serena.tiede.keys",
+		"https://gitlab.com/_bot.keys",
+	}, urls)
+}
+
+func TestInstallCloudInit(t *testing.T) {
+	shipped := &recordingChroot{}
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, InstallCloudInit(context.Background(), shipped, fs, distro.Ubuntu))
+	assert.Empty(t, shipped.commands)
+
+	installed := &recordingChroot{}
+	assert.NoError(t, InstallCloudInit(context.Background(), installed, fs, distro.RaspiOS))
+	assert.Equal(t, []string{"apt-get install -y cloud-init"}, installed.commands)
+	datasource, err := afero.ReadFile(fs, "/etc/cloud/cloud.cfg.d/05_datasource.cfg")
+	assert.NoError(t, err)
+	assert.Contains(t, string(datasource), "datasource_list: [NoCloud, None]")
+}
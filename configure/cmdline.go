@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+)
+
+// repeatableParams may appear more than once on the command line, every other key must be unique.
+var repeatableParams = map[string]bool{"console": true, "cgroup_enable": true, "cgroup_disable": true}
+
+// CommandLine is rendered into cmdline.txt. Nil lists keep the defaults, an empty list removes them. The root device
+// always comes from the volume group so it can't drift from the partitioning code, and the cgroup hierarchy from the
+// cgroup mode so it can't drift from containerd and the kubelet.
+type CommandLine struct {
+	Base   []string `yaml:"base"`
+	Cgroup []string `yaml:"cgroup"`
+	Extra  []string `yaml:"extra"`
+
+	mode   CgroupMode
+	serial SerialConfig
+}
+
+// WithCgroupMode returns the command line for booting in mode, the default cgroup parameters follow it.
+func (c CommandLine) WithCgroupMode(mode CgroupMode) CommandLine {
+	c.mode = mode
+	return c
+}
+
+// WithSerial returns the command line with its serial console parameters set by serial.
+func (c CommandLine) WithSerial(serial SerialConfig) CommandLine {
+	c.serial = serial
+	return c
+}
+
+func defaultBaseParams() []string {
+	return []string{"dwc_otg.lpm_enable=0", "console=serial0,115200", "net.ifnames=0", "console=tty1", "elevator=deadline", "fixrtc", "quiet", "splash"}
+}
+
+func rootParams() []string {
+	return []string{
+		fmt.Sprintf("root=/dev/%s/%s", utility.VolumeGroupName, utility.RootLogicalVolume),
+		"rootfstype=ext4",
+		"rootwait",
+	}
+}
+
+func (c CommandLine) params() []string {
+	base := c.Base
+	if base == nil {
+		base = defaultBaseParams()
+	}
+	base = c.serial.applyConsole(base)
+	cgroup := c.Cgroup
+	if cgroup == nil {
+		cgroup = c.mode.defaultParams()
+	}
+	params := append(append([]string{}, base...), rootParams()...)
+	params = append(params, c.mode.hierarchyParam())
+	params = append(params, cgroup...)
+	return append(params, c.Extra...)
+}
+
+func (c CommandLine) Validate() error {
+	if err := c.mode.Validate(); err != nil {
+		return err
+	}
+	if err := c.serial.Validate(); err != nil {
+		return err
+	}
+	if c.serial.Console != nil {
+		for _, param := range c.Extra {
+			if isSerialConsole(param) {
+				return fmt.Errorf("kernel parameter %s conflicts with the serial console setting", param)
+			}
+		}
+	}
+	seen := map[string]bool{}
+	for _, param := range c.params() {
+		if param == "" || strings.ContainsAny(param, " \t\n") {
+			return fmt.Errorf("invalid kernel parameter: %q", param)
+		}
+		key, _, _ := strings.Cut(param, "=")
+		if seen[param] || (seen[key] && !repeatableParams[key]) {
+			return fmt.Errorf("kernel parameter %s is set more than once", key)
+		}
+		seen[key] = true
+		seen[param] = true
+	}
+	return nil
+}
+
+// String renders the whole command line on one line, the firmware ignores anything after the first.
+func (c CommandLine) String() string {
+	return strings.Join(c.params(), " ") + "\n"
+}
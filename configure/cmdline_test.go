@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandLineDefaults(t *testing.T) {
+	cmdline := CommandLine{}
+	assert.NoError(t, cmdline.Validate())
+	assert.Equal(t, "dwc_otg.lpm_enable=0 console=serial0,115200 net.ifnames=0 console=tty1 elevator=deadline fixrtc quiet splash "+
+		"root=/dev/rootvg/rootlv rootfstype=ext4 rootwait "+
+		"systemd.unified_cgroup_hierarchy=1 cgroup_enable=memory cgroup_memory=1 cgroup_enable=cpuset\n", cmdline.String())
+}
+
+func TestCommandLineLegacyCgroups(t *testing.T) {
+	cmdline := CommandLine{}.WithCgroupMode(CgroupLegacy)
+	assert.NoError(t, cmdline.Validate())
+	assert.Equal(t, "dwc_otg.lpm_enable=0 console=serial0,115200 net.ifnames=0 console=tty1 elevator=deadline fixrtc quiet splash "+
+		"root=/dev/rootvg/rootlv rootfstype=ext4 rootwait "+
+		"systemd.unified_cgroup_hierarchy=0 cgroup_enable=memory swapaccount=1 cgroup_memory=1 cgroup_enable=cpuset\n", cmdline.String())
+}
+
+func TestCommandLineOverrides(t *testing.T) {
+	cmdline := CommandLine{
+		Base:   []string{"console=serial0,115200", "console=tty1"},
+		Cgroup: []string{},
+		Extra:  []string{"isolcpus=3"},
+	}
+	assert.NoError(t, cmdline.Validate())
+	assert.Equal(t, "console=serial0,115200 console=tty1 root=/dev/rootvg/rootlv rootfstype=ext4 rootwait systemd.unified_cgroup_hierarchy=1 isolcpus=3\n", cmdline.String())
+}
+
+func TestCommandLineSerialConsole(t *testing.T) {
+	enabled, disabled := true, false
+	cmdline := CommandLine{Cgroup: []string{}}.WithSerial(SerialConfig{Console: &disabled})
+	assert.NoError(t, cmdline.Validate())
+	assert.Equal(t, "dwc_otg.lpm_enable=0 net.ifnames=0 console=tty1 elevator=deadline fixrtc quiet splash "+
+		"root=/dev/rootvg/rootlv rootfstype=ext4 rootwait systemd.unified_cgroup_hierarchy=1\n", cmdline.String())
+
+	// the configured console takes the place of the stock one so tty1 stays the primary console
+	cmdline = CommandLine{Base: []string{"console=ttyAMA0,9600", "console=tty1"}, Cgroup: []string{}}.WithSerial(SerialConfig{Console: &enabled, Baud: 921600})
+	assert.NoError(t, cmdline.Validate())
+	assert.Equal(t, "console=serial0,921600 console=tty1 root=/dev/rootvg/rootlv rootfstype=ext4 rootwait systemd.unified_cgroup_hierarchy=1\n", cmdline.String())
+	cmdline = CommandLine{Base: []string{"console=tty1"}, Cgroup: []string{}}.WithSerial(SerialConfig{Console: &enabled})
+	assert.Equal(t, "console=serial0,115200 console=tty1 root=/dev/rootvg/rootlv rootfstype=ext4 rootwait systemd.unified_cgroup_hierarchy=1\n", cmdline.String())
+
+	// extra parameters can't put the console back on a uart behind the setting's back
+	assert.Error(t, CommandLine{Extra: []string{"console=ttyS0,115200"}}.WithSerial(SerialConfig{Console: &disabled}).Validate())
+	assert.Error(t, CommandLine{}.WithSerial(SerialConfig{DisableBluetooth: true}).Validate())
+}
+
+func TestCommandLineValidate(t *testing.T) {
+	assert.Error(t, CommandLine{Extra: []string{"root=/dev/mmcblk0p2"}}.Validate())
+	assert.Error(t, CommandLine{Extra: []string{"quiet"}}.Validate())
+	assert.Error(t, CommandLine{Extra: []string{"isolcpus=3 nohz_full=3"}}.Validate())
+	assert.Error(t, CommandLine{Extra: []string{"cgroup_enable=memory"}}.Validate())
+	assert.NoError(t, CommandLine{Extra: []string{"console=ttyAMA0"}}.Validate())
+	// the hierarchy only comes from the cgroup mode
+	assert.Error(t, CommandLine{Extra: []string{"systemd.unified_cgroup_hierarchy=0"}}.Validate())
+	assert.Error(t, CommandLine{Cgroup: []string{"systemd.unified_cgroup_hierarchy=1"}}.Validate())
+	assert.Error(t, CommandLine{}.WithCgroupMode("hybrid").Validate())
+}
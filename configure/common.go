@@ -18,14 +18,17 @@ package configure
 
 import (
 	"embed"
+	"io/fs"
 )
 
 //go:embed files/*
-var configFiles embed.FS
+var embeddedConfigFiles embed.FS
+
+// configFiles is where every file under files/ is read from, the embed unless UseOverrides layered a directory on top.
+var configFiles fs.FS = embeddedConfigFiles
 
 const (
-	commandLine = "dwc_otg.lpm_enable=0 console=serial0,115200 net.ifnames=0 console=tty1 root=/dev/rootvg/rootlv rootfstype=ext4 elevator=deadline rootwait fixrtc quiet splash cgroup_enable=memory swapaccount=1 cgroup_memory=1 cgroup_enable=cpuset"
-	postInvoke  = `DPkg::Post-Invoke {"/bin/bash /boot/auto_decompress_kernel"; };`
+	postInvoke = `DPkg::Post-Invoke {"/bin/bash /boot/auto_decompress_kernel"; };`
 
 	commandLinePath = "/boot/firmware/cmdline.txt"
 )
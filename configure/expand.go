@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const (
+	expandStamp = "/var/lib/pi-image-builder/expand-volume.done"
+	// expandMinimumFree is one lvm extent, anything less can't be handed to a volume.
+	expandMinimumFree = 4 * 1024 * 1024
+)
+
+// ExpandConfig grows a logical volume on first boot into the space left when an image is flashed onto a card bigger
+// than the one its layout was sized for. It covers cards flashed by other tools as well as the flash command.
+type ExpandConfig struct {
+	// Disabled leaves any extra space unallocated in the volume group.
+	Disabled bool `yaml:"disabled"`
+	// Volume defaults to the csi volume.
+	Volume string `yaml:"volume"`
+	// Percent of the newly free space given to Volume, defaults to 100.
+	Percent int `yaml:"percent"`
+}
+
+func (e ExpandConfig) withDefaults() ExpandConfig {
+	if e.Volume == "" {
+		e.Volume = utility.CSILogicalVolume
+	}
+	if e.Percent == 0 {
+		e.Percent = 100
+	}
+	return e
+}
+
+// ExpandScript is what the first boot script and its unit are rendered with.
+type ExpandScript struct {
+	VolumeGroup string
+	Volume      string
+	Percent     int
+	MinimumFree int
+	Device      string
+	// KeyFile and CryptName are only set for an encrypted volume, its mapping is grown before the filesystem.
+	KeyFile   string
+	CryptName string
+	Stamp     string
+}
+
+func (e ExpandConfig) script(layout partition.VolumeLayout) (ExpandScript, error) {
+	if e.Percent < 1 || e.Percent > 100 {
+		return ExpandScript{}, fmt.Errorf("expand percent must be between 1 and 100, got: %d", e.Percent)
+	}
+	for _, volume := range layout {
+		if volume.Name != e.Volume {
+			continue
+		}
+		if volume.FSType != "" && volume.FSType != "ext4" {
+			return ExpandScript{}, fmt.Errorf("only ext4 volumes can be expanded on first boot, %s is %s", volume.Name, volume.FSType)
+		}
+		script := ExpandScript{
+			VolumeGroup: utility.VolumeGroupName,
+			Volume:      volume.Name,
+			Percent:     e.Percent,
+			MinimumFree: expandMinimumFree,
+			Device:      volume.Device(),
+			Stamp:       expandStamp,
+		}
+		if volume.Encrypted {
+			script.KeyFile = partition.KeyFile(partition.KeyDir, volume)
+			script.CryptName = utility.CryptName(volume.Name)
+		}
+		return script, nil
+	}
+	return ExpandScript{}, fmt.Errorf("volume layout has no %s volume to expand", e.Volume)
+}
+
+// ExpandVolume installs a first boot oneshot that grows the card's lvm partition, its physical volume, and then the
+// configured volume and its filesystem. It marks itself done with a stamp file so it only runs once.
+func ExpandVolume(ctx context.Context, chroot ChrootRunner, fs afero.Fs, cfg ExpandConfig, layout partition.VolumeLayout) error {
+	if cfg.Disabled {
+		return nil
+	}
+
+	ctx, span := telemetry.Start(ctx, "configure volume expansion")
+	defer span.End()
+
+	script, scriptErr := cfg.withDefaults().script(layout)
+	if scriptErr != nil {
+		return scriptErr
+	}
+
+	// growpart comes from cloud-guest-utils, the lvm tools are already a base package
+	if err := chroot.Run(ctx, 20*time.Minute, "apt-get", "install", "--no-install-recommends", "-y", "cloud-guest-utils"); err != nil {
+		return err
+	}
+
+	rendered, renderErr := utility.RenderTemplate(ctx, configFiles, "files/expand-volume.bash.template", script)
+	if renderErr != nil {
+		return renderErr
+	}
+	if err := fs.MkdirAll("/usr/local/sbin", 0755); err != nil {
+		return err
+	}
+	if _, err := IdempotentWrite(ctx, fs, &rendered, "/usr/local/sbin/expand-volume", 0755); err != nil {
+		return err
+	}
+
+	unit, unitErr := utility.RenderTemplate(ctx, configFiles, "files/expand-volume.service.template", script)
+	if unitErr != nil {
+		return unitErr
+	}
+	if err := fs.MkdirAll("/etc/systemd/system", 0755); err != nil {
+		return err
+	}
+	if _, err := IdempotentWrite(ctx, fs, &unit, "/etc/systemd/system/expand-volume.service", 0644); err != nil {
+		return err
+	}
+
+	return enableUnit(ctx, chroot, fs, "expand-volume")
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandScriptGolden(t *testing.T) {
+	layout := partition.VolumeLayout{
+		{Name: utility.RootLogicalVolume, Size: "10GiB"},
+		{Name: utility.CSILogicalVolume, Size: partition.RestSize, Encrypted: true},
+	}
+	script, scriptErr := ExpandConfig{Percent: 80}.withDefaults().script(layout)
+	assert.NoError(t, scriptErr)
+	rendered, err := utility.RenderTemplate(context.Background(), configFiles, "files/expand-volume.bash.template", script)
+	assert.NoError(t, err)
+
+	if *updateGolden {
+		assert.NoError(t, os.WriteFile("testdata/expand-volume.bash.golden", rendered.Bytes(), 0644))
+	}
+	golden, goldenErr := os.ReadFile("testdata/expand-volume.bash.golden")
+	assert.NoError(t, goldenErr)
+	assert.Equal(t, string(golden), rendered.String())
+}
+
+func TestExpandScriptErrors(t *testing.T) {
+	layout := partition.DefaultVolumeLayout()
+	for _, cfg := range []ExpandConfig{
+		{Percent: 101},
+		{Percent: -5},
+		{Volume: "missing"},
+	} {
+		_, err := cfg.withDefaults().script(layout)
+		assert.Error(t, err, cfg)
+	}
+	xfs := partition.VolumeLayout{{Name: utility.CSILogicalVolume, Size: partition.RestSize, FSType: "xfs"}}
+	_, err := ExpandConfig{}.withDefaults().script(xfs)
+	assert.Error(t, err)
+}
+
+// the unit is enabled with a symlink, which MemMapFs can't hold
+func TestExpandVolume(t *testing.T) {
+	root := t.TempDir()
+	fs := afero.NewBasePathFs(afero.NewOsFs(), root)
+	chroot := &recordingChroot{}
+	assert.NoError(t, ExpandVolume(context.Background(), chroot, fs, ExpandConfig{}, partition.DefaultVolumeLayout()))
+
+	script, err := afero.ReadFile(fs, "/usr/local/sbin/expand-volume")
+	assert.NoError(t, err)
+	assert.Contains(t, string(script), "lvextend -l +100%FREE rootvg/csilv")
+	assert.NotContains(t, string(script), "cryptsetup")
+	info, statErr := fs.Stat("/usr/local/sbin/expand-volume")
+	assert.NoError(t, statErr)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	unit, unitErr := afero.ReadFile(fs, "/etc/systemd/system/expand-volume.service")
+	assert.NoError(t, unitErr)
+	assert.Contains(t, string(unit), "ConditionPathExists=!"+expandStamp)
+	target, linkErr := os.Readlink(filepath.Join(root, "etc/systemd/system/multi-user.target.wants/expand-volume.service"))
+	assert.NoError(t, linkErr)
+	assert.Equal(t, "/etc/systemd/system/expand-volume.service", target)
+	assert.Equal(t, []string{"apt-get install --no-install-recommends -y cloud-guest-utils"}, chroot.commands)
+}
+
+func TestExpandVolumeDisabled(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	chroot := &recordingChroot{}
+	assert.NoError(t, ExpandVolume(context.Background(), chroot, fs, ExpandConfig{Disabled: true}, partition.DefaultVolumeLayout()))
+	assert.Empty(t, chroot.commands)
+	exists, _ := afero.Exists(fs, "/usr/local/sbin/expand-volume")
+	assert.False(t, exists)
+}
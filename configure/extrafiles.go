@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/manifest"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/spf13/afero"
+)
+
+const defaultExtraFileMode = 0644
+
+// ownerPattern is a user, optionally followed by :group, as chown takes them. Names are looked up in the image, not
+// on the build host.
+var ownerPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*(:[A-Za-z0-9_][A-Za-z0-9_.-]*)?$`)
+
+// ExtraFile is a site specific file copied from the files dir into the image, e.g. a ca certificate or a udev rule.
+type ExtraFile struct {
+	// Source is relative to the files dir.
+	Source string `yaml:"source"`
+	// Dest is the absolute path in the image, missing directories are created.
+	Dest string `yaml:"dest"`
+	// Mode is the permission bits in octal, e.g. 0600, empty is 0644.
+	Mode string `yaml:"mode"`
+	// Owner is user or user:group as chown takes them, empty leaves the file owned by root.
+	Owner string `yaml:"owner"`
+}
+
+func (f ExtraFile) mode() (fs.FileMode, error) {
+	if f.Mode == "" {
+		return defaultExtraFileMode, nil
+	}
+	mode, err := strconv.ParseUint(f.Mode, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, fmt.Errorf("file %s has an invalid mode %q, use octal like 0644", f.Dest, f.Mode)
+	}
+	return fs.FileMode(mode), nil
+}
+
+// ExtraFilesConfig copies files from the build host into the image. The zero value copies nothing.
+type ExtraFilesConfig struct {
+	Files []ExtraFile `yaml:"files"`
+	// Commands run in the image with sh once every file is copied, e.g. update-ca-certificates.
+	Commands []string `yaml:"commands"`
+}
+
+// Enabled reports whether there's anything to copy or run.
+func (e ExtraFilesConfig) Enabled() bool {
+	return len(e.Files) != 0 || len(e.Commands) != 0
+}
+
+func (e ExtraFilesConfig) Validate() error {
+	for _, file := range e.Files {
+		if !filepath.IsLocal(file.Source) {
+			return fmt.Errorf("file source must be a path inside the files dir, got: %q", file.Source)
+		}
+		// the image is mounted under the build's workspace, a dest that isn't already clean could climb out of it
+		if !path.IsAbs(file.Dest) || path.Clean(file.Dest) != file.Dest || file.Dest == "/" {
+			return fmt.Errorf("file dest must be a clean absolute path in the image, got: %q", file.Dest)
+		}
+		if _, err := file.mode(); err != nil {
+			return err
+		}
+		if file.Owner != "" && !ownerPattern.MatchString(file.Owner) {
+			return fmt.Errorf("file %s has an invalid owner %q, use user or user:group", file.Dest, file.Owner)
+		}
+	}
+	for _, command := range e.Commands {
+		if command == "" {
+			return errors.New("extra files commands can't be empty")
+		}
+	}
+	return nil
+}
+
+// CheckSources makes sure every source is a regular file in dir on host, so a typo fails the build before anything
+// is downloaded.
+func (e ExtraFilesConfig) CheckSources(host afero.Fs, dir string) error {
+	if len(e.Files) == 0 {
+		return nil
+	}
+	if dir == "" {
+		return errors.New("extra files are configured but no files dir was given")
+	}
+	for _, file := range e.Files {
+		info, err := host.Stat(filepath.Join(dir, file.Source))
+		if err != nil {
+			return fmt.Errorf("source for %s is missing: %w", file.Dest, err)
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("source %s for %s is not a regular file", file.Source, file.Dest)
+		}
+	}
+	return nil
+}
+
+// ExtraFiles copies cfg's files from dir on host into the image and runs its commands, returning what was copied for
+// the manifest. Every source is read before anything is written, so a bad one doesn't leave the image half done.
+func ExtraFiles(ctx context.Context, chroot ChrootRunner, fs afero.Fs, host afero.Fs, dir string, cfg ExtraFilesConfig) ([]manifest.File, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+
+	ctx, span := telemetry.Start(ctx, "copy extra files")
+	defer span.End()
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.CheckSources(host, dir); err != nil {
+		return nil, err
+	}
+
+	contents := make([][]byte, 0, len(cfg.Files))
+	for _, file := range cfg.Files {
+		data, err := afero.ReadFile(host, filepath.Join(dir, file.Source))
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, data)
+	}
+
+	copied := make([]manifest.File, 0, len(cfg.Files))
+	for i, file := range cfg.Files {
+		mode, _ := file.mode()
+		if err := fs.MkdirAll(path.Dir(file.Dest), 0755); err != nil {
+			return nil, err
+		}
+		if _, err := IdempotentWrite(ctx, fs, bytes.NewReader(contents[i]), file.Dest, mode); err != nil {
+			return nil, err
+		}
+		// an existing file keeps its mode through IdempotentWrite and a new one is subject to the umask
+		if err := fs.Chmod(file.Dest, mode); err != nil {
+			return nil, err
+		}
+		if file.Owner != "" {
+			if err := chroot.Run(ctx, time.Minute, "chown", file.Owner, file.Dest); err != nil {
+				return nil, fmt.Errorf("could not set the owner of %s: %w", file.Dest, err)
+			}
+		}
+		sum := sha256.Sum256(contents[i])
+		copied = append(copied, manifest.File{Path: file.Dest, Source: file.Source, SHA256: hex.EncodeToString(sum[:])})
+	}
+
+	for _, command := range cfg.Commands {
+		if err := chroot.Stream(ctx, 10*time.Minute, "/bin/sh", "-c", command); err != nil {
+			return nil, fmt.Errorf("extra files command %q failed: %w", command, err)
+		}
+	}
+	return copied, nil
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtraFilesConfigValidate(t *testing.T) {
+	assert.NoError(t, ExtraFilesConfig{}.Validate())
+	assert.NoError(t, ExtraFilesConfig{
+		Files:    []ExtraFile{{Source: "certs/site-ca.crt", Dest: "/usr/local/share/ca-certificates/site-ca.crt", Mode: "0644", Owner: "root:root"}},
+		Commands: []string{"update-ca-certificates"},
+	}.Validate())
+	assert.Error(t, ExtraFilesConfig{Files: []ExtraFile{{Source: "../site-ca.crt", Dest: "/etc/site-ca.crt"}}}.Validate())
+	assert.Error(t, ExtraFilesConfig{Files: []ExtraFile{{Source: "/etc/chrony.conf", Dest: "/etc/chrony/chrony.conf"}}}.Validate())
+	assert.Error(t, ExtraFilesConfig{Files: []ExtraFile{{Source: "chrony.conf", Dest: "etc/chrony/chrony.conf"}}}.Validate())
+	assert.Error(t, ExtraFilesConfig{Files: []ExtraFile{{Source: "chrony.conf", Dest: "/etc/../../chrony.conf"}}}.Validate())
+	assert.Error(t, ExtraFilesConfig{Files: []ExtraFile{{Source: "chrony.conf", Dest: "/etc/chrony/chrony.conf", Mode: "644x"}}}.Validate())
+	assert.Error(t, ExtraFilesConfig{Files: []ExtraFile{{Source: "chrony.conf", Dest: "/etc/chrony/chrony.conf", Owner: "root; reboot"}}}.Validate())
+	assert.Error(t, ExtraFilesConfig{Commands: []string{""}}.Validate())
+}
+
+func TestExtraFilesCheckSources(t *testing.T) {
+	host := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(host, "/site/chrony.conf", []byte("pool time.example.com iburst\n"), 0644))
+	assert.NoError(t, host.MkdirAll("/site/rules.d", 0755))
+
+	cfg := ExtraFilesConfig{Files: []ExtraFile{{Source: "chrony.conf", Dest: "/etc/chrony/chrony.conf"}}}
+	assert.NoError(t, cfg.CheckSources(host, "/site"))
+	assert.Error(t, cfg.CheckSources(host, ""))
+	assert.Error(t, ExtraFilesConfig{Files: []ExtraFile{{Source: "missing.conf", Dest: "/etc/missing.conf"}}}.CheckSources(host, "/site"))
+	assert.Error(t, ExtraFilesConfig{Files: []ExtraFile{{Source: "rules.d", Dest: "/etc/udev/rules.d"}}}.CheckSources(host, "/site"))
+	assert.NoError(t, ExtraFilesConfig{Commands: []string{"true"}}.CheckSources(host, ""))
+}
+
+func TestExtraFiles(t *testing.T) {
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	host := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(host, "/site/certs/site-ca.crt", []byte("-----BEGIN CERTIFICATE-----\n"), 0600))
+	assert.NoError(t, afero.WriteFile(host, "/site/99-can.rules", []byte("SUBSYSTEM==\"net\"\n"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, "/etc/udev/rules.d/99-can.rules", []byte("old\n"), 0600))
+
+	cfg := ExtraFilesConfig{
+		Files: []ExtraFile{
+			{Source: "certs/site-ca.crt", Dest: "/usr/local/share/ca-certificates/site-ca.crt"},
+			{Source: "99-can.rules", Dest: "/etc/udev/rules.d/99-can.rules", Mode: "0640", Owner: "root:adm"},
+		},
+		Commands: []string{"update-ca-certificates"},
+	}
+	chroot := &recordingChroot{}
+	copied, err := ExtraFiles(ctx, chroot, fs, host, "/site", cfg)
+	assert.NoError(t, err)
+
+	contents, readErr := afero.ReadFile(fs, "/usr/local/share/ca-certificates/site-ca.crt")
+	assert.NoError(t, readErr)
+	assert.Equal(t, "-----BEGIN CERTIFICATE-----\n", string(contents))
+	info, statErr := fs.Stat("/usr/local/share/ca-certificates/site-ca.crt")
+	assert.NoError(t, statErr)
+	assert.Equal(t, "-rw-r--r--", info.Mode().String())
+	info, statErr = fs.Stat("/etc/udev/rules.d/99-can.rules")
+	assert.NoError(t, statErr)
+	assert.Equal(t, "-rw-r-----", info.Mode().String())
+
+	assert.Equal(t, []string{
+		"chown root:adm /etc/udev/rules.d/99-can.rules",
+		"/bin/sh -c update-ca-certificates",
+	}, chroot.commands)
+	assert.Len(t, copied, 2)
+	assert.Equal(t, "/usr/local/share/ca-certificates/site-ca.crt", copied[0].Path)
+	assert.Equal(t, "certs/site-ca.crt", copied[0].Source)
+	assert.Len(t, copied[0].SHA256, 64)
+}
+
+func TestExtraFilesMissingSourceWritesNothing(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	host := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(host, "/site/chrony.conf", []byte("pool time.example.com iburst\n"), 0644))
+
+	cfg := ExtraFilesConfig{Files: []ExtraFile{
+		{Source: "chrony.conf", Dest: "/etc/chrony/chrony.conf"},
+		{Source: "missing.rules", Dest: "/etc/udev/rules.d/99-missing.rules"},
+	}}
+	chroot := &recordingChroot{}
+	_, err := ExtraFiles(context.Background(), chroot, fs, host, "/site", cfg)
+	assert.Error(t, err)
+	exists, _ := afero.Exists(fs, "/etc/chrony/chrony.conf")
+	assert.False(t, exists)
+	assert.Empty(t, chroot.commands)
+}
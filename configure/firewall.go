@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const (
+	FirewallCNICilium = "cilium"
+	// FirewallCNINone opens no overlay ports, for a cni that's allowed through allowTCP and allowUDP instead.
+	FirewallCNINone = "none"
+)
+
+var (
+	portRangePattern = regexp.MustCompile(`^([0-9]+)-([0-9]+)$`)
+	// nftInterfacePattern is a kernel interface name with an optional trailing wildcard
+	nftInterfacePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}\*?$`)
+)
+
+// FirewallConfig is rendered into /etc/nftables.conf. Only the input chain filters, forwarding is left to the CNI.
+type FirewallConfig struct {
+	// Disabled skips the step for clusters behind a cloud or network firewall.
+	Disabled bool `yaml:"disabled"`
+	// SSHPort defaults to ssh.port.
+	SSHPort     int `yaml:"sshPort"`
+	KubeletPort int `yaml:"kubeletPort"`
+	// NodePortRanges are opened for tcp and udp, e.g. 30000-32767.
+	NodePortRanges []string `yaml:"nodePortRanges"`
+	AllowTCP       []int    `yaml:"allowTCP"`
+	AllowUDP       []int    `yaml:"allowUDP"`
+	// TrustedInterfaces accept all input, nft wildcards like lxc* are allowed.
+	TrustedInterfaces []string `yaml:"trustedInterfaces"`
+	// ControlPlane opens the api server and etcd ports, nil follows kubeadm.mode so only init nodes get them.
+	ControlPlane *bool `yaml:"controlPlane"`
+	// CNI opens the ports its overlay and health checks use between nodes, cilium unless set to none.
+	CNI string `yaml:"cni"`
+}
+
+type FirewallRules struct {
+	TrustedInterfaces string
+	TCP               string
+	UDP               string
+}
+
+func (f FirewallConfig) withDefaults() FirewallConfig {
+	if f.SSHPort == 0 {
+		f.SSHPort = 22
+	}
+	if f.KubeletPort == 0 {
+		f.KubeletPort = 10250
+	}
+	if f.NodePortRanges == nil {
+		f.NodePortRanges = []string{"30000-32767"}
+	}
+	if f.TrustedInterfaces == nil {
+		// cilium's host and pod interfaces, pods need to reach node local services
+		f.TrustedInterfaces = []string{"lo", "cilium_*", "lxc*"}
+	}
+	if f.ControlPlane == nil {
+		controlPlane := false
+		f.ControlPlane = &controlPlane
+	}
+	if f.CNI == "" {
+		f.CNI = FirewallCNICilium
+	}
+	return f
+}
+
+// ForKubeadmMode opens the control plane ports on an init node unless controlPlane was set explicitly.
+func (f FirewallConfig) ForKubeadmMode(mode string) FirewallConfig {
+	if f.ControlPlane == nil {
+		controlPlane := mode == KubeadmInit
+		f.ControlPlane = &controlPlane
+	}
+	return f
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+func (f FirewallConfig) Validate() error {
+	for _, port := range append([]int{f.SSHPort, f.KubeletPort}, append(append([]int{}, f.AllowTCP...), f.AllowUDP...)...) {
+		if !validPort(port) {
+			return fmt.Errorf("invalid firewall port: %d", port)
+		}
+	}
+	for _, portRange := range f.NodePortRanges {
+		bounds := portRangePattern.FindStringSubmatch(portRange)
+		if bounds == nil {
+			return fmt.Errorf("invalid node port range: %q", portRange)
+		}
+		low, _ := strconv.Atoi(bounds[1])
+		high, _ := strconv.Atoi(bounds[2])
+		if !validPort(low) || !validPort(high) || low > high {
+			return fmt.Errorf("invalid node port range: %q", portRange)
+		}
+	}
+	if f.CNI != FirewallCNICilium && f.CNI != FirewallCNINone {
+		return fmt.Errorf("firewall cni must be %s or %s, got: %q", FirewallCNICilium, FirewallCNINone, f.CNI)
+	}
+	for _, name := range f.TrustedInterfaces {
+		if !nftInterfacePattern.MatchString(name) {
+			return fmt.Errorf("invalid trusted interface: %q", name)
+		}
+	}
+	return nil
+}
+
+func (f FirewallConfig) rules() FirewallRules {
+	interfaces := []string{strconv.Quote("lo")}
+	for _, name := range f.TrustedInterfaces {
+		if name != "lo" {
+			interfaces = append(interfaces, strconv.Quote(name))
+		}
+	}
+
+	tcp := []string{strconv.Itoa(f.SSHPort), strconv.Itoa(f.KubeletPort)}
+	var udp []string
+	if f.CNI == FirewallCNICilium {
+		// cilium's health checks and its vxlan overlay between nodes
+		tcp = append(tcp, "4240")
+		udp = append(udp, "8472")
+	}
+	if f.ControlPlane != nil && *f.ControlPlane {
+		// the api server and etcd's client and peer ports
+		tcp = append(tcp, "6443", "2379-2380")
+	}
+	for _, port := range f.AllowTCP {
+		tcp = append(tcp, strconv.Itoa(port))
+	}
+	for _, port := range f.AllowUDP {
+		udp = append(udp, strconv.Itoa(port))
+	}
+	tcp = append(tcp, f.NodePortRanges...)
+	udp = append(udp, f.NodePortRanges...)
+
+	return FirewallRules{
+		TrustedInterfaces: strings.Join(interfaces, ", "),
+		TCP:               strings.Join(uniquePorts(tcp), ", "),
+		UDP:               strings.Join(uniquePorts(udp), ", "),
+	}
+}
+
+// uniquePorts drops repeated ports, nft refuses a set with the same element twice.
+func uniquePorts(ports []string) []string {
+	seen := make(map[string]bool, len(ports))
+	unique := make([]string, 0, len(ports))
+	for _, port := range ports {
+		if !seen[port] {
+			seen[port] = true
+			unique = append(unique, port)
+		}
+	}
+	return unique
+}
+
+// Firewall writes a default deny input ruleset and enables the nftables unit.
+func Firewall(ctx context.Context, chroot ChrootRunner, fs afero.Fs, cfg FirewallConfig) error {
+	if cfg.Disabled {
+		return nil
+	}
+
+	ctx, span := telemetry.Start(ctx, "configure firewall")
+	defer span.End()
+
+	if err := writeFirewall(ctx, fs, cfg.withDefaults()); err != nil {
+		return err
+	}
+
+	return enableUnit(ctx, chroot, fs, "nftables")
+}
+
+func writeFirewall(ctx context.Context, fs afero.Fs, cfg FirewallConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	ruleset, renderErr := utility.RenderTemplate(ctx, configFiles, "files/nftables.conf.template", cfg.rules())
+	if renderErr != nil {
+		return renderErr
+	}
+
+	if err := fs.MkdirAll("/etc", 0755); err != nil {
+		return err
+	}
+
+	_, writeErr := IdempotentWrite(ctx, fs, &ruleset, "/etc/nftables.conf", 0755)
+	return writeErr
+}
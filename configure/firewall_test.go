@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFirewallDefaults(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, writeFirewall(context.Background(), fs, FirewallConfig{}.withDefaults()))
+
+	ruleset, err := afero.ReadFile(fs, "/etc/nftables.conf")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(ruleset), "flush ruleset")
+	assert.Contains(t, string(ruleset), "delete table inet host-firewall\n")
+	assert.Contains(t, string(ruleset), "type filter hook input priority filter; policy drop;")
+	assert.Contains(t, string(ruleset), "type filter hook forward priority filter; policy accept;")
+	assert.Contains(t, string(ruleset), "ct state established,related accept")
+	assert.Contains(t, string(ruleset), `iifname { "lo", "cilium_*", "lxc*" } accept`)
+	assert.Contains(t, string(ruleset), "tcp dport { 22, 10250, 4240, 30000-32767 } accept")
+	assert.Contains(t, string(ruleset), "udp dport { 8472, 30000-32767 } accept")
+}
+
+func TestWriteFirewallControlPlane(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	cfg := FirewallConfig{AllowTCP: []int{6443}}.ForKubeadmMode(KubeadmInit).withDefaults()
+	assert.NoError(t, writeFirewall(context.Background(), fs, cfg))
+
+	ruleset, err := afero.ReadFile(fs, "/etc/nftables.conf")
+	assert.NoError(t, err)
+	assert.Contains(t, string(ruleset), "tcp dport { 22, 10250, 4240, 6443, 2379-2380, 30000-32767 } accept")
+}
+
+func TestFirewallForKubeadmMode(t *testing.T) {
+	assert.True(t, *FirewallConfig{}.ForKubeadmMode(KubeadmInit).ControlPlane)
+	assert.False(t, *FirewallConfig{}.ForKubeadmMode(KubeadmJoin).ControlPlane)
+	assert.False(t, *FirewallConfig{}.ForKubeadmMode("").ControlPlane)
+
+	explicit := false
+	assert.False(t, *FirewallConfig{ControlPlane: &explicit}.ForKubeadmMode(KubeadmInit).ControlPlane)
+}
+
+func TestWriteFirewallOverrides(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	cfg := FirewallConfig{
+		SSHPort:           2222,
+		NodePortRanges:    []string{},
+		AllowTCP:          []int{6443},
+		TrustedInterfaces: []string{},
+		CNI:               FirewallCNINone,
+	}.withDefaults()
+	assert.NoError(t, writeFirewall(context.Background(), fs, cfg))
+
+	ruleset, err := afero.ReadFile(fs, "/etc/nftables.conf")
+	assert.NoError(t, err)
+	assert.Contains(t, string(ruleset), `iifname { "lo" } accept`)
+	assert.Contains(t, string(ruleset), "tcp dport { 2222, 10250, 6443 } accept")
+	assert.NotContains(t, string(ruleset), "udp dport")
+}
+
+func TestFirewallDisabledIsNoop(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	chroot := &recordingChroot{}
+	assert.NoError(t, Firewall(context.Background(), chroot, fs, FirewallConfig{Disabled: true}))
+	exists, err := afero.Exists(fs, "/etc/nftables.conf")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Empty(t, chroot.commands)
+}
+
+func TestFirewallConfigValidate(t *testing.T) {
+	assert.NoError(t, FirewallConfig{}.withDefaults().Validate())
+	assert.Error(t, FirewallConfig{NodePortRanges: []string{"32767-30000"}}.withDefaults().Validate())
+	assert.Error(t, FirewallConfig{NodePortRanges: []string{"30000"}}.withDefaults().Validate())
+	assert.Error(t, FirewallConfig{AllowTCP: []int{0}}.withDefaults().Validate())
+	assert.Error(t, FirewallConfig{CNI: "flannel"}.withDefaults().Validate())
+	assert.Error(t, FirewallConfig{TrustedInterfaces: []string{`eth0" } accept`}}.withDefaults().Validate())
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	firmwareConfigPath = "/boot/firmware/usercfg.txt"
+	// firmwareBaseConfigPath is the image's own config.txt, only touched to include usercfg.txt
+	firmwareBaseConfigPath = "/boot/firmware/config.txt"
+	userConfigInclude      = "include usercfg.txt"
+	minimumGPUMem          = 16
+)
+
+var (
+	overlayNamePattern  = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	overlayParamPattern = regexp.MustCompile(`^[a-zA-Z0-9_]+(=[a-zA-Z0-9_.:-]+)?$`)
+)
+
+type Overlay struct {
+	Name   string   `yaml:"name"`
+	Params []string `yaml:"params"`
+}
+
+// FirmwareConfig is rendered into usercfg.txt under the [pi4] section. The zero value renders the stock config.
+type FirmwareConfig struct {
+	ArmBoost    *bool `yaml:"armBoost"`
+	ArmFreq     int   `yaml:"armFreq"`
+	OverVoltage int   `yaml:"overVoltage"`
+	GPUMem      int   `yaml:"gpuMem"`
+	// Overlays replace the default vc4-fkms-v3d overlay when set.
+	Overlays []Overlay `yaml:"overlays"`
+	// Extra lines are appended verbatim, e.g. dtparam=i2c_arm=on.
+	Extra []string `yaml:"extra"`
+
+	serial SerialConfig
+}
+
+func (f FirmwareConfig) withDefaults() FirmwareConfig {
+	if f.Overlays == nil {
+		f.Overlays = []Overlay{{Name: "vc4-fkms-v3d"}}
+	}
+	return f
+}
+
+// withSerial returns the config with the uart and bluetooth set by serial.
+func (f FirmwareConfig) withSerial(serial SerialConfig) FirmwareConfig {
+	f.serial = serial
+	return f
+}
+
+// EnableUARTValue is empty when the uart is left to the firmware default.
+func (f FirmwareConfig) EnableUARTValue() string {
+	if f.serial.Console == nil {
+		return ""
+	}
+	if *f.serial.Console {
+		return "1"
+	}
+	return "0"
+}
+
+func (f FirmwareConfig) DisableBluetooth() bool {
+	return f.serial.DisableBluetooth
+}
+
+// ArmBoostValue is empty when arm_boost is left to the firmware default.
+func (f FirmwareConfig) ArmBoostValue() string {
+	if f.ArmBoost == nil {
+		return ""
+	}
+	if *f.ArmBoost {
+		return "1"
+	}
+	return "0"
+}
+
+func (f FirmwareConfig) Validate() error {
+	if f.ArmFreq < 0 {
+		return fmt.Errorf("arm_freq can not be negative, got: %d", f.ArmFreq)
+	}
+	if f.OverVoltage < -16 || f.OverVoltage > 8 {
+		return fmt.Errorf("over_voltage must be between -16 and 8, got: %d", f.OverVoltage)
+	}
+	if f.GPUMem != 0 && f.GPUMem < minimumGPUMem {
+		return fmt.Errorf("gpu_mem must be at least %d, got: %d", minimumGPUMem, f.GPUMem)
+	}
+	for _, overlay := range f.Overlays {
+		if !overlayNamePattern.MatchString(overlay.Name) {
+			return fmt.Errorf("invalid dtoverlay name: %q", overlay.Name)
+		}
+		for _, param := range overlay.Params {
+			if !overlayParamPattern.MatchString(param) {
+				return fmt.Errorf("invalid parameter for dtoverlay %s: %q", overlay.Name, param)
+			}
+		}
+	}
+	for _, line := range f.Extra {
+		if strings.Contains(line, "\n") {
+			return fmt.Errorf("extra firmware config lines can not contain newlines: %q", line)
+		}
+	}
+	return nil
+}
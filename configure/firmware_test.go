@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/stretchr/testify/assert"
+)
+
+func renderFirmwareConfig(t *testing.T, cfg FirmwareConfig) string {
+	cfg = cfg.withDefaults()
+	assert.NoError(t, cfg.Validate())
+	rendered, err := utility.RenderTemplate(context.Background(), configFiles, "files/usercfg.txt.template", cfg)
+	assert.NoError(t, err)
+	return rendered.String()
+}
+
+func TestFirmwareConfigDefaults(t *testing.T) {
+	assert.Equal(t, "[pi4]\nmax_framebuffers=2\ndtoverlay=vc4-fkms-v3d\nboot_delay\nkernel=vmlinux\ninitramfs initrd.img followkernel\n",
+		renderFirmwareConfig(t, FirmwareConfig{}))
+}
+
+func TestFirmwareConfigOverrides(t *testing.T) {
+	armBoost := true
+	rendered := renderFirmwareConfig(t, FirmwareConfig{
+		ArmBoost:    &armBoost,
+		ArmFreq:     2000,
+		OverVoltage: 6,
+		GPUMem:      16,
+		Overlays: []Overlay{
+			{Name: "vc4-kms-v3d"},
+			{Name: "rpi-poe-plus", Params: []string{"poe_fan_temp0=50000", "poe_fan_temp1=60000"}},
+		},
+		Extra: []string{"dtparam=i2c_arm=on"},
+	})
+	assert.Contains(t, rendered, "dtoverlay=vc4-kms-v3d\ndtoverlay=rpi-poe-plus,poe_fan_temp0=50000,poe_fan_temp1=60000\n")
+	assert.NotContains(t, rendered, "vc4-fkms-v3d")
+	assert.Contains(t, rendered, "arm_boost=1\narm_freq=2000\nover_voltage=6\ngpu_mem=16\ndtparam=i2c_arm=on\n")
+}
+
+func TestFirmwareConfigSerial(t *testing.T) {
+	enabled, disabled := true, false
+	rendered := renderFirmwareConfig(t, FirmwareConfig{}.withSerial(SerialConfig{Console: &enabled, DisableBluetooth: true}))
+	assert.Contains(t, rendered, "dtoverlay=vc4-fkms-v3d\ndtoverlay=disable-bt\n")
+	assert.Contains(t, rendered, "enable_uart=1\n")
+
+	rendered = renderFirmwareConfig(t, FirmwareConfig{}.withSerial(SerialConfig{Console: &disabled}))
+	assert.Contains(t, rendered, "enable_uart=0\n")
+	assert.NotContains(t, rendered, "disable-bt")
+}
+
+func TestFirmwareConfigValidate(t *testing.T) {
+	assert.Error(t, FirmwareConfig{ArmFreq: -1}.Validate())
+	assert.Error(t, FirmwareConfig{GPUMem: 8}.Validate())
+	assert.Error(t, FirmwareConfig{OverVoltage: 9}.Validate())
+	assert.Error(t, FirmwareConfig{Overlays: []Overlay{{Name: "poe\ndtoverlay=x"}}}.Validate())
+	assert.Error(t, FirmwareConfig{Extra: []string{"a\nb"}}.Validate())
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+// Mount is one fstab entry. Device is used as is when set, otherwise Volume names a logical volume in the image's
+// volume group and resolves to its dm-crypt mapping when the volume is encrypted. FSType and Options default to the
+// volume's filesystem in the layout.
+type Mount struct {
+	Device     string `yaml:"device"`
+	Volume     string `yaml:"volume"`
+	MountPoint string `yaml:"mountPoint"`
+	FSType     string `yaml:"fsType"`
+	Options    string `yaml:"options"`
+	Dump       int    `yaml:"dump"`
+	Pass       int    `yaml:"pass"`
+}
+
+func DefaultMounts() []Mount {
+	return []Mount{
+		{Device: "LABEL=system-boot", MountPoint: "/boot/firmware", FSType: "vfat", Pass: 1},
+		{Volume: utility.RootLogicalVolume, MountPoint: "/", Pass: 1},
+		{Volume: utility.CSILogicalVolume, MountPoint: "/var/lib/longhorn", Pass: 1},
+		{Volume: utility.ContainerdVolume, MountPoint: "/var/lib/containerd", Pass: 1},
+	}
+}
+
+// resolve fills in the device, filesystem, and options from the volume layout.
+func (m Mount) resolve(layout partition.VolumeLayout) Mount {
+	if m.Device != "" {
+		if m.Options == "" {
+			m.Options = "defaults"
+		}
+		return m
+	}
+
+	volume, ok := layout.Find(m.Volume)
+	if !ok {
+		volume = partition.Volume{Name: m.Volume}
+	}
+	m.Device = volume.Device()
+	if m.FSType == "" {
+		m.FSType = volume.Filesystem()
+	}
+	if m.Options == "" {
+		m.Options = partition.MountOptions(m.FSType)
+	}
+	if !partition.Checkable(m.FSType) {
+		m.Pass = 0
+	}
+	return m
+}
+
+// ResolveMounts returns mounts with their devices, filesystems, and options filled in from layout, nil mounts use
+// DefaultMounts.
+func ResolveMounts(mounts []Mount, layout partition.VolumeLayout) []Mount {
+	if mounts == nil {
+		mounts = DefaultMounts()
+	}
+	resolved := make([]Mount, 0, len(mounts))
+	for _, mount := range mounts {
+		resolved = append(resolved, mount.resolve(layout))
+	}
+	return resolved
+}
+
+func (m Mount) Validate(layout partition.VolumeLayout) error {
+	if (m.Device == "") == (m.Volume == "") {
+		return fmt.Errorf("mount %s needs exactly one of device and volume", m.MountPoint)
+	}
+	if !strings.HasPrefix(m.MountPoint, "/") {
+		return fmt.Errorf("mount point must be absolute, got: %q", m.MountPoint)
+	}
+	resolved := m.resolve(layout)
+	for _, field := range []string{resolved.Device, resolved.MountPoint, resolved.FSType, resolved.Options} {
+		if field == "" || strings.ContainsAny(field, " \t\n") {
+			return fmt.Errorf("invalid fstab field for %s: %q", m.MountPoint, field)
+		}
+	}
+	if m.Pass < 0 || m.Pass > 2 {
+		return fmt.Errorf("fsck pass for %s must be 0, 1, or 2", m.MountPoint)
+	}
+	return nil
+}
+
+// RenderFstab renders mounts as an fstab, validating each entry against layout.
+func RenderFstab(mounts []Mount, layout partition.VolumeLayout) ([]byte, error) {
+	var rendered bytes.Buffer
+	writer := tabwriter.NewWriter(&rendered, 0, 0, 2, ' ', 0)
+	if _, err := fmt.Fprintln(writer, "# <device>\t<mount point>\t<type>\t<options>\t<dump>\t<pass>"); err != nil {
+		return nil, err
+	}
+	for _, mount := range mounts {
+		if err := mount.Validate(layout); err != nil {
+			return nil, err
+		}
+		resolved := mount.resolve(layout)
+		if _, err := fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%d\t%d\n", resolved.Device, resolved.MountPoint, resolved.FSType, resolved.Options, resolved.Dump, resolved.Pass); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	return rendered.Bytes(), nil
+}
+
+// Fstab writes /etc/fstab from mounts and creates each mount point, nil mounts use DefaultMounts. Encrypted volumes
+// in layout also get a crypttab entry so they're unlocked before they're mounted.
+func Fstab(ctx context.Context, fs afero.Fs, mounts []Mount, layout partition.VolumeLayout) error {
+	_, span := telemetry.Start(ctx, "configure fstab entries")
+	defer span.End()
+
+	if mounts == nil {
+		mounts = DefaultMounts()
+	}
+
+	fstab, renderErr := RenderFstab(mounts, layout)
+	if renderErr != nil {
+		return renderErr
+	}
+
+	for _, mount := range mounts {
+		if dirErr := fs.MkdirAll(mount.MountPoint, 0750); dirErr != nil {
+			return dirErr
+		}
+	}
+
+	if err := afero.WriteFile(fs, "/etc/fstab", fstab, 0644); err != nil {
+		return err
+	}
+
+	if len(layout.Encrypted()) == 0 {
+		return nil
+	}
+
+	return afero.WriteFile(fs, "/etc/crypttab", renderCrypttab(layout), 0644)
+}
+
+func renderCrypttab(layout partition.VolumeLayout) []byte {
+	var rendered bytes.Buffer
+	writer := tabwriter.NewWriter(&rendered, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(writer, "# <target name>\t<source device>\t<key file>\t<options>")
+	for _, volume := range layout.Encrypted() {
+		_, _ = fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", utility.CryptName(volume.Name), utility.MapperName(volume.Name), partition.KeyFile(partition.KeyDir, volume), "luks,discard")
+	}
+	_ = writer.Flush()
+	return rendered.Bytes()
+}
+
+// EncryptionPackages installs cryptsetup when the layout has encrypted volumes so crypttab can be processed at boot.
+func EncryptionPackages(ctx context.Context, chroot ChrootRunner, layout partition.VolumeLayout) error {
+	if len(layout.Encrypted()) == 0 {
+		return nil
+	}
+
+	ctx, span := telemetry.Start(ctx, "install encryption packages")
+	defer span.End()
+
+	return chroot.Run(ctx, 20*time.Minute, "apt-get", "install", "--no-install-recommends", "-y", "cryptsetup")
+}
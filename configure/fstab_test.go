@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+func TestFstabGolden(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mounts := append(DefaultMounts(), Mount{Volume: "loglv", MountPoint: "/var/log", Options: "defaults,noatime", Pass: 2})
+	assert.NoError(t, Fstab(context.Background(), fs, mounts, partition.DefaultVolumeLayout()))
+
+	fstab, err := afero.ReadFile(fs, "/etc/fstab")
+	assert.NoError(t, err)
+
+	if *updateGolden {
+		assert.NoError(t, os.WriteFile("testdata/fstab.golden", fstab, 0644))
+	}
+	golden, goldenErr := os.ReadFile("testdata/fstab.golden")
+	assert.NoError(t, goldenErr)
+	assert.Equal(t, string(golden), string(fstab))
+
+	for _, mount := range mounts {
+		exists, existsErr := afero.DirExists(fs, mount.MountPoint)
+		assert.NoError(t, existsErr)
+		assert.True(t, exists, mount.MountPoint)
+	}
+
+	crypttab, crypttabErr := afero.Exists(fs, "/etc/crypttab")
+	assert.NoError(t, crypttabErr)
+	assert.False(t, crypttab)
+}
+
+func TestFstabEncryptedVolumes(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	layout := partition.DefaultVolumeLayout()
+	layout[1].Encrypted = true
+	layout[2].Encrypted = true
+	assert.NoError(t, Fstab(context.Background(), fs, nil, layout))
+
+	fstab, err := afero.ReadFile(fs, "/etc/fstab")
+	assert.NoError(t, err)
+	assert.Contains(t, string(fstab), "/dev/mapper/rootvg-rootlv  ")
+	assert.Contains(t, string(fstab), "/dev/mapper/csilv_crypt  ")
+	assert.Contains(t, string(fstab), "/dev/mapper/containerdlv_crypt  ")
+
+	crypttab, crypttabErr := afero.ReadFile(fs, "/etc/crypttab")
+	assert.NoError(t, crypttabErr)
+	if *updateGolden {
+		assert.NoError(t, os.WriteFile("testdata/crypttab.golden", crypttab, 0644))
+	}
+	golden, goldenErr := os.ReadFile("testdata/crypttab.golden")
+	assert.NoError(t, goldenErr)
+	assert.Equal(t, string(golden), string(crypttab))
+}
+
+func TestMountValidate(t *testing.T) {
+	layout := partition.DefaultVolumeLayout()
+	assert.Error(t, Mount{MountPoint: "/", FSType: "ext4"}.Validate(layout))
+	assert.Error(t, Mount{Device: "/dev/sda1", Volume: "rootlv", MountPoint: "/", FSType: "ext4"}.Validate(layout))
+	assert.Error(t, Mount{Volume: "rootlv", MountPoint: "var", FSType: "ext4"}.Validate(layout))
+	assert.Error(t, Mount{Volume: "rootlv", MountPoint: "/", FSType: "ext4", Options: "defaults noatime"}.Validate(layout))
+}
+
+func TestFstabFilesystemFromLayout(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	layout := partition.DefaultVolumeLayout()
+	layout[0].FSType = "f2fs"
+	layout[2].FSType = "xfs"
+	assert.NoError(t, Fstab(context.Background(), fs, nil, layout))
+
+	fstab, err := afero.ReadFile(fs, "/etc/fstab")
+	assert.NoError(t, err)
+	assert.Regexp(t, `/dev/mapper/rootvg-rootlv +/ +f2fs +defaults,noatime +0 +1\n`, string(fstab))
+	assert.Regexp(t, `/dev/mapper/rootvg-csilv +/var/lib/longhorn +ext4 +defaults +0 +1\n`, string(fstab))
+	assert.Regexp(t, `/dev/mapper/rootvg-containerdlv +/var/lib/containerd +xfs +defaults,noatime +0 +0\n`, string(fstab))
+}
+
+func TestResolveMounts(t *testing.T) {
+	layout := partition.DefaultVolumeLayout()
+	layout[2].Encrypted = true
+
+	resolved := ResolveMounts(nil, layout)
+	assert.Len(t, resolved, len(DefaultMounts()))
+	assert.Equal(t, "LABEL=system-boot", resolved[0].Device)
+	assert.Equal(t, "/dev/mapper/rootvg-rootlv", resolved[1].Device)
+	assert.Equal(t, utility.ContainerdVolume, resolved[3].Volume)
+	assert.Equal(t, "/dev/mapper/containerdlv_crypt", resolved[3].Device)
+	assert.Equal(t, "ext4", resolved[3].FSType)
+}
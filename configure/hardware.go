@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/spf13/afero"
+)
+
+const (
+	overlayDir       = "/boot/firmware/overlays"
+	overlayExtension = ".dtbo"
+)
+
+// dtbMagic starts every flattened device tree blob, overlays included.
+var dtbMagic = []byte{0xd0, 0x0d, 0xfe, 0xed}
+
+// CustomOverlay is a compiled device tree overlay from the build host, e.g. one for a hat the kernel doesn't ship.
+type CustomOverlay struct {
+	// Path is the .dtbo on the build host, the overlay is named after the file.
+	Path   string   `yaml:"path"`
+	Params []string `yaml:"params"`
+}
+
+// Name is what dtoverlay= loads the overlay as.
+func (o CustomOverlay) Name() string {
+	return strings.TrimSuffix(path.Base(o.Path), overlayExtension)
+}
+
+// HardwareConfig adds support for hardware the image doesn't cover out of the box. The zero value changes nothing.
+type HardwareConfig struct {
+	Overlays []CustomOverlay `yaml:"overlays"`
+	// DKMS packages build out of tree kernel modules, they're built against the headers of the kernel the image
+	// boots.
+	DKMS []string `yaml:"dkms"`
+}
+
+// Enabled reports whether there's anything to install.
+func (h HardwareConfig) Enabled() bool {
+	return len(h.Overlays) != 0 || len(h.DKMS) != 0
+}
+
+func (h HardwareConfig) Validate() error {
+	for _, overlay := range h.Overlays {
+		if !strings.HasSuffix(overlay.Path, overlayExtension) {
+			return fmt.Errorf("overlay %s must be a compiled %s file", overlay.Path, overlayExtension)
+		}
+		if !overlayNamePattern.MatchString(overlay.Name()) {
+			return fmt.Errorf("invalid dtoverlay name: %q", overlay.Name())
+		}
+		for _, param := range overlay.Params {
+			if !overlayParamPattern.MatchString(param) {
+				return fmt.Errorf("invalid parameter for dtoverlay %s: %q", overlay.Name(), param)
+			}
+		}
+	}
+	for _, name := range h.DKMS {
+		if name == "" || strings.ContainsAny(name, " \t=") {
+			return fmt.Errorf("invalid dkms package name: %q", name)
+		}
+	}
+	return nil
+}
+
+// readOverlay reads an overlay from host, refusing anything that isn't a device tree blob. The firmware silently
+// skips an overlay it can't parse, so a bad file would only show up as hardware missing on the booted node.
+func readOverlay(host afero.Fs, overlay CustomOverlay) ([]byte, error) {
+	contents, readErr := afero.ReadFile(host, overlay.Path)
+	if readErr != nil {
+		return nil, readErr
+	}
+	if !bytes.HasPrefix(contents, dtbMagic) {
+		return nil, fmt.Errorf("%s is not a flattened device tree, compile it with dtc -@ -I dts -O dtb", overlay.Path)
+	}
+	return contents, nil
+}
+
+// Hardware copies the custom overlays from host onto the image's boot partition, loads them from usercfg.txt, and
+// builds the dkms packages' modules for the image's kernel. With the kernel pinned the headers are installed at the
+// pinned version and held with it.
+func Hardware(ctx context.Context, chroot ChrootRunner, fs afero.Fs, host afero.Fs, cfg HardwareConfig, pin KernelPin) error {
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	ctx, span := telemetry.Start(ctx, "install hardware support")
+	defer span.End()
+
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	// every overlay is checked before any is written, so a bad one doesn't leave the boot partition half done
+	overlays := make([][]byte, 0, len(cfg.Overlays))
+	for _, overlay := range cfg.Overlays {
+		contents, err := readOverlay(host, overlay)
+		if err != nil {
+			return err
+		}
+		overlays = append(overlays, contents)
+	}
+
+	if len(overlays) != 0 {
+		if err := fs.MkdirAll(overlayDir, 0755); err != nil {
+			return err
+		}
+		lines := make([]string, 0, len(cfg.Overlays))
+		for i, overlay := range cfg.Overlays {
+			if _, err := IdempotentWrite(ctx, fs, bytes.NewReader(overlays[i]), path.Join(overlayDir, overlay.Name()+overlayExtension), 0755); err != nil {
+				return err
+			}
+			lines = append(lines, "dtoverlay="+strings.Join(append([]string{overlay.Name()}, overlay.Params...), ","))
+		}
+		if err := appendConfigLines(fs, firmwareConfigPath, lines); err != nil {
+			return err
+		}
+	}
+
+	if len(cfg.DKMS) == 0 {
+		return nil
+	}
+	return installDKMS(ctx, chroot, fs, cfg.DKMS, pin)
+}
+
+// installDKMS installs the dkms packages and builds them for the image's kernel. Inside the container uname reports
+// the build host's kernel, so the release is named explicitly instead of leaving it to the packages' own hooks.
+func installDKMS(ctx context.Context, chroot ChrootRunner, fs afero.Fs, names []string, pin KernelPin) error {
+	release := pin.Release()
+	if release == "" {
+		found, err := KernelRelease(fs, KernelImagePath)
+		if err != nil {
+			return fmt.Errorf("could not find the kernel to build dkms modules for: %w", err)
+		}
+		release = found
+	}
+
+	headers := PackageSpec{Name: "linux-headers-" + release, Version: pin.Modules}
+	specs := []PackageSpec{{Name: "dkms"}, headers}
+	for _, name := range names {
+		specs = append(specs, PackageSpec{Name: name})
+	}
+	if err := chroot.Stream(ctx, 30*time.Minute, installArgs(specs, "--allow-change-held-packages")...); err != nil {
+		return fmt.Errorf("could not install dkms packages: %w", err)
+	}
+	if pin.Enabled() {
+		if err := chroot.Run(ctx, time.Minute, "apt-mark", "hold", headers.Name); err != nil {
+			return err
+		}
+	}
+	if err := chroot.Stream(ctx, 30*time.Minute, "dkms", "autoinstall", "-k", release); err != nil {
+		return fmt.Errorf("could not build dkms modules for kernel %s: %w", release, err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHardwareConfigValidate(t *testing.T) {
+	assert.NoError(t, HardwareConfig{}.Validate())
+	assert.NoError(t, HardwareConfig{
+		Overlays: []CustomOverlay{{Path: "/overlays/can-hat.dtbo", Params: []string{"oscillator=16000000"}}},
+		DKMS:     []string{"can-hat-dkms"},
+	}.Validate())
+	assert.Error(t, HardwareConfig{Overlays: []CustomOverlay{{Path: "/overlays/can-hat.dts"}}}.Validate())
+	assert.Error(t, HardwareConfig{Overlays: []CustomOverlay{{Path: "/overlays/can hat.dtbo"}}}.Validate())
+	assert.Error(t, HardwareConfig{Overlays: []CustomOverlay{{Path: "/overlays/can-hat.dtbo", Params: []string{"a b"}}}}.Validate())
+	assert.Error(t, HardwareConfig{DKMS: []string{""}}.Validate())
+}
+
+func TestHardwareOverlays(t *testing.T) {
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	host := afero.NewMemMapFs()
+	blob := append(append([]byte(nil), dtbMagic...), 0, 0, 0, 0x48)
+	assert.NoError(t, afero.WriteFile(host, "/overlays/can-hat.dtbo", blob, 0644))
+	assert.NoError(t, afero.WriteFile(host, "/overlays/broken.dtbo", []byte("/dts-v1/;"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, firmwareConfigPath, []byte("[pi4]\ndtoverlay=vc4-fkms-v3d"), 0755))
+
+	cfg := HardwareConfig{Overlays: []CustomOverlay{
+		{Path: "/overlays/can-hat.dtbo", Params: []string{"oscillator=16000000", "interrupt=25"}},
+	}}
+	chroot := &recordingChroot{}
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, Hardware(ctx, chroot, fs, host, cfg, KernelPin{}))
+	}
+	copied, readErr := afero.ReadFile(fs, "/boot/firmware/overlays/can-hat.dtbo")
+	assert.NoError(t, readErr)
+	assert.Equal(t, blob, copied)
+	firmware, readErr := afero.ReadFile(fs, firmwareConfigPath)
+	assert.NoError(t, readErr)
+	assert.Equal(t, "[pi4]\ndtoverlay=vc4-fkms-v3d\ndtoverlay=can-hat,oscillator=16000000,interrupt=25\n", string(firmware))
+	assert.Empty(t, chroot.commands)
+
+	// a blob that isn't a device tree stops the step before anything is written
+	broken := HardwareConfig{Overlays: []CustomOverlay{{Path: "/overlays/i2c-rtc.dtbo"}, {Path: "/overlays/broken.dtbo"}}}
+	assert.NoError(t, afero.WriteFile(host, "/overlays/i2c-rtc.dtbo", blob, 0644))
+	assert.ErrorContains(t, Hardware(ctx, chroot, fs, host, broken, KernelPin{}), "not a flattened device tree")
+	exists, _ := afero.Exists(fs, "/boot/firmware/overlays/i2c-rtc.dtbo")
+	assert.False(t, exists)
+}
+
+func TestHardwareDKMS(t *testing.T) {
+	ctx := context.Background()
+	chroot := &recordingChroot{}
+	cfg := HardwareConfig{DKMS: []string{"can-hat-dkms"}}
+
+	assert.NoError(t, Hardware(ctx, chroot, afero.NewMemMapFs(), afero.NewMemMapFs(), cfg, testKernelPin))
+	assert.Equal(t, []string{
+		"apt-get install --allow-change-held-packages --allow-downgrades -y dkms linux-headers-5.15.0-1034-raspi=5.15.0-1034.37 can-hat-dkms",
+		"apt-mark hold linux-headers-5.15.0-1034-raspi",
+		"dkms autoinstall -k 5.15.0-1034-raspi",
+	}, chroot.commands)
+
+	// nothing runs when there's nothing to install
+	empty := &recordingChroot{}
+	assert.NoError(t, Hardware(ctx, empty, afero.NewMemMapFs(), afero.NewMemMapFs(), HardwareConfig{}, testKernelPin))
+	assert.Empty(t, empty.commands)
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const (
+	helmBinaryDir = "/usr/local/bin"
+	// helmChartDir holds vendored charts so they can be installed right after kubeadm init without a network.
+	helmChartDir = "/var/lib/pi-image-builder/charts"
+)
+
+// helmReleaseURL is where helm release tarballs and their checksums are published.
+var helmReleaseURL = "https://get.helm.sh"
+
+// HelmConfig installs helm into the image, an empty version skips it.
+type HelmConfig struct {
+	Version string `yaml:"version"`
+	// Charts are pulled on the build host and vendored into the image, empty installs only the binary.
+	Charts []HelmChart `yaml:"charts"`
+}
+
+// HelmChart is a chart pulled with helm pull. Ref is a repo/chart reference, an oci:// reference, or a bare chart name
+// when Repo is set.
+type HelmChart struct {
+	Ref     string `yaml:"ref"`
+	Version string `yaml:"version"`
+	Repo    string `yaml:"repo"`
+}
+
+func (h HelmConfig) Validate() error {
+	if h.Version == "" {
+		if len(h.Charts) != 0 {
+			return errors.New("helm charts are vendored but no helm version is installed to use them")
+		}
+		return nil
+	}
+	if !releaseVersionPattern.MatchString(h.Version) {
+		return fmt.Errorf("invalid helm version: %q, expected vX.Y.Z", h.Version)
+	}
+	for _, chart := range h.Charts {
+		if chart.Ref == "" || chart.Version == "" {
+			return fmt.Errorf("helm chart %q must have a ref and a pinned version", chart.Ref)
+		}
+	}
+	return nil
+}
+
+func helmArtifact(version string) Artifact {
+	name := fmt.Sprintf("helm-%s-linux-%s.tar.gz", version, kubernetesArch)
+	url := fmt.Sprintf("%s/%s", helmReleaseURL, name)
+	return Artifact{Name: name, URL: url, ChecksumURL: url + ".sha256sum", Version: version}
+}
+
+// HelmArtifacts are everything InstallHelm downloads for cfg.
+func HelmArtifacts(cfg HelmConfig) []Artifact {
+	if cfg.Version == "" {
+		return nil
+	}
+	return []Artifact{helmArtifact(cfg.Version)}
+}
+
+// InstallHelm installs the helm binary from the verified release tarball, the rest of the tarball is discarded.
+func InstallHelm(ctx context.Context, fs afero.Fs, version string) error {
+
+	ctx, span := telemetry.Start(ctx, "install helm")
+	defer span.End()
+
+	if err := (HelmConfig{Version: version}).Validate(); err != nil {
+		return err
+	}
+
+	tempDir, tempErr := afero.TempDir(hostFs, "", "helm-")
+	if tempErr != nil {
+		return tempErr
+	}
+	defer func() {
+		_ = hostFs.RemoveAll(tempDir)
+	}()
+
+	artifact := helmArtifact(version)
+	if err := FetchArtifacts(ctx, hostFs, tempDir, []Artifact{artifact}); err != nil {
+		return err
+	}
+
+	// the tarball is small, unpacking it in memory keeps the license and readme out of the image
+	unpacked := afero.NewMemMapFs()
+	if err := extractArtifact(ctx, unpacked, tempDir, artifact); err != nil {
+		return err
+	}
+	binary, openErr := unpacked.Open(path.Join("/", "linux-"+kubernetesArch, "helm"))
+	if openErr != nil {
+		return fmt.Errorf("helm tarball has no helm binary: %w", openErr)
+	}
+	defer utility.WrappedClose(binary)
+
+	if err := fs.MkdirAll(helmBinaryDir, 0755); err != nil {
+		return err
+	}
+	_, writeErr := IdempotentWrite(ctx, fs, binary, path.Join(helmBinaryDir, "helm"), 0755)
+	return writeErr
+}
+
+// VendorHelmCharts pulls charts with the build host's helm and copies the chart tarballs into the image.
+func VendorHelmCharts(ctx context.Context, runner utility.Runner, fs afero.Fs, charts []HelmChart) error {
+	if len(charts) == 0 {
+		return nil
+	}
+
+	ctx, span := telemetry.Start(ctx, "vendor helm charts")
+	defer span.End()
+
+	pulled, tempErr := afero.TempDir(hostFs, "", "helm-charts-")
+	if tempErr != nil {
+		return tempErr
+	}
+	defer func() {
+		_ = hostFs.RemoveAll(pulled)
+	}()
+
+	for _, chart := range charts {
+		args := []string{"pull", chart.Ref, "--version", chart.Version, "--destination", pulled}
+		if chart.Repo != "" {
+			args = append(args, "--repo", chart.Repo)
+		}
+		if err := runner.Run(ctx, exec.CommandContext(ctx, "helm", args...)); err != nil {
+			return fmt.Errorf("could not pull helm chart %s %s: %w", chart.Ref, chart.Version, err)
+		}
+	}
+
+	if err := fs.MkdirAll(helmChartDir, 0755); err != nil {
+		return err
+	}
+	entries, readErr := afero.ReadDir(hostFs, pulled)
+	if readErr != nil {
+		return readErr
+	}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || !strings.HasSuffix(entry.Name(), ".tgz") {
+			continue
+		}
+		if err := vendorChart(ctx, fs, path.Join(pulled, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func vendorChart(ctx context.Context, fs afero.Fs, name string) error {
+	chart, openErr := hostFs.OpenFile(name, os.O_RDONLY, 0)
+	if openErr != nil {
+		return openErr
+	}
+	defer utility.WrappedClose(chart)
+
+	_, writeErr := IdempotentWrite(ctx, fs, chart, path.Join(helmChartDir, path.Base(name)), 0644)
+	return writeErr
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"archive/tar"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHelmConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     HelmConfig
+		wantErr bool
+	}{
+		{name: "disabled", cfg: HelmConfig{}},
+		{name: "binary only", cfg: HelmConfig{Version: "v3.13.2"}},
+		{name: "charts", cfg: HelmConfig{Version: "v3.13.2", Charts: []HelmChart{{Ref: "cilium/cilium", Version: "1.14.4"}}}},
+		{name: "bad version", cfg: HelmConfig{Version: "3.13"}, wantErr: true},
+		{name: "unpinned chart", cfg: HelmConfig{Version: "v3.13.2", Charts: []HelmChart{{Ref: "cilium/cilium"}}}, wantErr: true},
+		{name: "charts without helm", cfg: HelmConfig{Charts: []HelmChart{{Ref: "cilium/cilium", Version: "1.14.4"}}}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.cfg.Validate()
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestInstallHelm(t *testing.T) {
+	archive := string(tarball(t,
+		tarEntry{header: tar.Header{Name: "linux-arm64/", Typeflag: tar.TypeDir, Mode: 0755}},
+		tarEntry{header: tar.Header{Name: "linux-arm64/helm", Typeflag: tar.TypeReg, Mode: 0755}, body: "helm binary"},
+		tarEntry{header: tar.Header{Name: "linux-arm64/LICENSE", Typeflag: tar.TypeReg, Mode: 0644}, body: "license"},
+	))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/helm-v3.13.2-linux-arm64.tar.gz":
+			_, _ = w.Write([]byte(archive))
+		case "/helm-v3.13.2-linux-arm64.tar.gz.sha256sum":
+			_, _ = w.Write([]byte(sha256Hex(archive) + "  helm-v3.13.2-linux-arm64.tar.gz\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	previous := helmReleaseURL
+	helmReleaseURL = server.URL
+	t.Cleanup(func() { helmReleaseURL = previous })
+
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, InstallHelm(context.Background(), fs, "v3.13.2"))
+
+	binary, err := afero.ReadFile(fs, "/usr/local/bin/helm")
+	assert.NoError(t, err)
+	assert.Equal(t, "helm binary", string(binary))
+	info, statErr := fs.Stat("/usr/local/bin/helm")
+	assert.NoError(t, statErr)
+	assert.Equal(t, "-rwxr-xr-x", info.Mode().String())
+	license, _ := afero.Exists(fs, "/usr/local/bin/LICENSE")
+	assert.False(t, license, "only the binary is installed")
+
+	assert.Error(t, InstallHelm(context.Background(), afero.NewMemMapFs(), "v3.12.0"), "unpublished release")
+}
+
+func TestVendorHelmCharts(t *testing.T) {
+	runner := &utility.FakeRunner{}
+	fs := afero.NewMemMapFs()
+	charts := []HelmChart{
+		{Ref: "cilium/cilium", Version: "1.14.4"},
+		{Ref: "longhorn", Version: "1.5.3", Repo: "https://charts.longhorn.io"},
+	}
+	assert.NoError(t, VendorHelmCharts(context.Background(), runner, fs, charts))
+
+	assert.Len(t, runner.Commands, 2)
+	assert.True(t, strings.HasPrefix(runner.Commands[0], "helm pull cilium/cilium --version 1.14.4 --destination "), runner.Commands[0])
+	assert.True(t, strings.HasSuffix(runner.Commands[1], " --repo https://charts.longhorn.io"), runner.Commands[1])
+	exists, err := afero.DirExists(fs, "/var/lib/pi-image-builder/charts")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	assert.NoError(t, VendorHelmCharts(context.Background(), runner, fs, nil), "no charts is only the binary")
+	assert.Len(t, runner.Commands, 2)
+}
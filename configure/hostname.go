@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+var (
+	hostnamePattern    = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+	placeholderPattern = regexp.MustCompile(`\{[^}]*}`)
+	// hostnamePlaceholders maps pattern placeholders to the shell variables set-hostname computes on the device
+	hostnamePlaceholders = map[string]string{
+		"{serial}":  "${SERIAL}",
+		"{serial8}": "${SERIAL8}",
+		"{mac}":     "${MAC}",
+	}
+	// hostnameSamples stand in for the real values when validating a pattern at build time
+	hostnameSamples = map[string]string{
+		"{serial}":  "10000000abcdef12",
+		"{serial8}": "abcdef12",
+		"{mac}":     "dca632000000",
+	}
+)
+
+type HostnameScript struct {
+	Interface  string
+	Expression string
+}
+
+// hostnameExpression validates pattern and converts its placeholders into the shell expression set-hostname uses.
+func hostnameExpression(pattern string) (string, error) {
+	for _, placeholder := range placeholderPattern.FindAllString(pattern, -1) {
+		if _, ok := hostnamePlaceholders[placeholder]; !ok {
+			return "", fmt.Errorf("unknown hostname placeholder: %s", placeholder)
+		}
+	}
+
+	sample := pattern
+	expression := pattern
+	for placeholder, variable := range hostnamePlaceholders {
+		sample = strings.ReplaceAll(sample, placeholder, hostnameSamples[placeholder])
+		expression = strings.ReplaceAll(expression, placeholder, variable)
+	}
+	if !hostnamePattern.MatchString(sample) {
+		return "", fmt.Errorf("hostname pattern %q does not produce a valid hostname", pattern)
+	}
+
+	return expression, nil
+}
+
+// Hostname installs a first boot unit that names the device from pattern, {serial}, {serial8}, and {mac} expand to
+// the cpu serial, its last eight characters, and the eth0 mac address. An empty pattern skips the step.
+func Hostname(ctx context.Context, chroot ChrootRunner, fs afero.Fs, pattern string) error {
+	if pattern == "" {
+		return nil
+	}
+
+	ctx, span := telemetry.Start(ctx, "configure hostname")
+	defer span.End()
+
+	expression, expressionErr := hostnameExpression(pattern)
+	if expressionErr != nil {
+		return expressionErr
+	}
+
+	script, scriptErr := utility.RenderTemplate(ctx, configFiles, "files/set-hostname.bash.template", HostnameScript{
+		Interface:  "eth0",
+		Expression: expression,
+	})
+	if scriptErr != nil {
+		return scriptErr
+	}
+
+	if err := fs.MkdirAll("/usr/local/sbin", 0755); err != nil {
+		return err
+	}
+
+	if _, err := IdempotentWrite(ctx, fs, &script, "/usr/local/sbin/set-hostname", 0755); err != nil {
+		return err
+	}
+
+	unit, unitErr := configFiles.Open("files/set-hostname.service")
+	if unitErr != nil {
+		return unitErr
+	}
+	defer utility.WrappedClose(unit)
+
+	if _, err := IdempotentWrite(ctx, fs, unit, "/etc/systemd/system/set-hostname.service", 0644); err != nil {
+		return err
+	}
+
+	preserve, preserveErr := configFiles.Open("files/09_hostname.cfg.yml")
+	if preserveErr != nil {
+		return preserveErr
+	}
+	defer utility.WrappedClose(preserve)
+
+	if _, err := IdempotentWrite(ctx, fs, preserve, path.Join(cloudInitDropInDir, "09_hostname.cfg"), 0644); err != nil {
+		return err
+	}
+
+	return enableUnit(ctx, chroot, fs, "set-hostname")
+}
+
+// hostsLine replaces the 127.0.1.1 entry in hosts with name, appending one if the file doesn't have it.
+func hostsLine(hosts string, name string) string {
+	entry := "127.0.1.1 " + name
+	lines := strings.Split(strings.TrimRight(hosts, "\n"), "\n")
+	if hosts == "" {
+		lines = nil
+	}
+	for i, line := range lines {
+		if strings.HasPrefix(line, "127.0.1.1") {
+			lines[i] = entry
+			return strings.Join(lines, "\n") + "\n"
+		}
+	}
+	return strings.Join(append(lines, entry), "\n") + "\n"
+}
+
+// StaticHostname names a root that's already been built, like a freshly flashed card. set-hostname leaves devices
+// that don't have a stock hostname alone so this wins over any pattern.
+func StaticHostname(ctx context.Context, fs afero.Fs, name string) error {
+	ctx, span := telemetry.Start(ctx, "configure static hostname")
+	defer span.End()
+
+	if !hostnamePattern.MatchString(name) {
+		return fmt.Errorf("invalid hostname: %q", name)
+	}
+
+	if err := afero.WriteFile(fs, "/etc/hostname", []byte(name+"\n"), 0644); err != nil {
+		return err
+	}
+
+	hosts, hostsErr := afero.ReadFile(fs, "/etc/hosts")
+	if hostsErr != nil && !errors.Is(hostsErr, afero.ErrFileNotFound) {
+		return hostsErr
+	}
+	if err := afero.WriteFile(fs, "/etc/hosts", []byte(hostsLine(string(hosts), name)), 0644); err != nil {
+		return err
+	}
+
+	preserve, preserveErr := configFiles.Open("files/09_hostname.cfg.yml")
+	if preserveErr != nil {
+		return preserveErr
+	}
+	defer utility.WrappedClose(preserve)
+
+	if err := fs.MkdirAll(cloudInitDropInDir, 0755); err != nil {
+		return err
+	}
+
+	_, writeErr := IdempotentWrite(ctx, fs, preserve, path.Join(cloudInitDropInDir, "09_hostname.cfg"), 0644)
+	return writeErr
+}
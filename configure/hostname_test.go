@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostnameExpression(t *testing.T) {
+	cases := []struct {
+		pattern  string
+		expected string
+		valid    bool
+	}{
+		{pattern: "pi-{serial8}", expected: "pi-${SERIAL8}", valid: true},
+		{pattern: "k8s-node-{mac}", expected: "k8s-node-${MAC}", valid: true},
+		{pattern: "{serial}", expected: "${SERIAL}", valid: true},
+		{pattern: "static-name", expected: "static-name", valid: true},
+		{pattern: "pi-{uuid}", valid: false},
+		{pattern: "Pi_{serial8}", valid: false},
+		{pattern: "pi-{serial8}-", valid: false},
+		{pattern: "pi-$(reboot)", valid: false},
+	}
+	for _, tt := range cases {
+		expression, err := hostnameExpression(tt.pattern)
+		if tt.valid {
+			assert.NoError(t, err, tt.pattern)
+			assert.Equal(t, tt.expected, expression, tt.pattern)
+		} else {
+			assert.Error(t, err, tt.pattern)
+		}
+	}
+}
+
+func TestHostsLine(t *testing.T) {
+	assert.Equal(t, "127.0.0.1 localhost\n127.0.1.1 pi-1\n", hostsLine("127.0.0.1 localhost\n127.0.1.1 ubuntu\n", "pi-1"))
+	assert.Equal(t, "127.0.0.1 localhost\n127.0.1.1 pi-1\n", hostsLine("127.0.0.1 localhost\n", "pi-1"))
+	assert.Equal(t, "127.0.1.1 pi-1\n", hostsLine("", "pi-1"))
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const (
+	// preloadArchive lives on the root volume on purpose, /var/lib/containerd is mounted from containerdlv at boot
+	// so anything imported there during the build would be hidden. preload-images.service imports it on first boot.
+	preloadArchive = "/var/lib/pi-image-builder/images/preload.tar"
+)
+
+type PreloadScript struct {
+	Images  []string
+	Archive string
+}
+
+// PreloadImages pulls images for linux/arm64 using a temporary containerd inside the container and exports them to
+// preloadArchive. Image references must be fully qualified (docker.io/library/nginx:latest) since ctr does not
+// expand short names.
+func PreloadImages(ctx context.Context, chroot ChrootRunner, fs afero.Fs, images []string) error {
+	if len(images) == 0 {
+		return nil
+	}
+
+	ctx, span := telemetry.Start(ctx, "preload container images")
+	defer span.End()
+
+	script, scriptErr := utility.RenderTemplate(ctx, configFiles, "files/preload-images.bash.template", PreloadScript{
+		Images:  images,
+		Archive: preloadArchive,
+	})
+	if scriptErr != nil {
+		return scriptErr
+	}
+
+	if err := chroot.Run(ctx, 30*time.Minute, "/bin/bash", "-c", script.String()); err != nil {
+		return err
+	}
+
+	unit, unitErr := configFiles.Open("files/preload-images.service")
+	if unitErr != nil {
+		return unitErr
+	}
+	defer utility.WrappedClose(unit)
+
+	if _, err := IdempotentWrite(ctx, fs, unit, "/etc/systemd/system/preload-images.service", 0644); err != nil {
+		return err
+	}
+
+	return enableUnit(ctx, chroot, fs, "preload-images")
+}
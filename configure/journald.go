@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const (
+	journaldDropInPath   = "/etc/systemd/journald.conf.d/pi-image-builder.conf"
+	persistentJournal    = "persistent"
+	persistentJournalDir = "/var/log/journal"
+)
+
+var (
+	journalSizePattern     = regexp.MustCompile(`^[0-9]+[KMGT]?$`)
+	journalIntervalPattern = regexp.MustCompile(`^[0-9]+(us|ms|s|min|h)?$`)
+	journalStorageModes    = map[string]bool{"volatile": true, persistentJournal: true, "auto": true, "none": true}
+)
+
+// JournaldConfig bounds journal writes, volatile storage keeps logs off the sd card entirely.
+type JournaldConfig struct {
+	Storage           string `yaml:"storage"`
+	SystemMaxUse      string `yaml:"systemMaxUse"`
+	RuntimeMaxUse     string `yaml:"runtimeMaxUse"`
+	RateLimitInterval string `yaml:"rateLimitInterval"`
+	RateLimitBurst    int    `yaml:"rateLimitBurst"`
+}
+
+func (j JournaldConfig) withDefaults() JournaldConfig {
+	if j.Storage == "" {
+		j.Storage = "volatile"
+	}
+	if j.SystemMaxUse == "" {
+		j.SystemMaxUse = "200M"
+	}
+	if j.RuntimeMaxUse == "" {
+		j.RuntimeMaxUse = "200M"
+	}
+	if j.RateLimitInterval == "" {
+		j.RateLimitInterval = "30s"
+	}
+	if j.RateLimitBurst == 0 {
+		j.RateLimitBurst = 10000
+	}
+	return j
+}
+
+func (j JournaldConfig) Validate() error {
+	if !journalStorageModes[j.Storage] {
+		return fmt.Errorf("invalid journald storage: %q", j.Storage)
+	}
+	for _, size := range []string{j.SystemMaxUse, j.RuntimeMaxUse} {
+		if !journalSizePattern.MatchString(size) {
+			return fmt.Errorf("invalid journald size: %q", size)
+		}
+	}
+	if !journalIntervalPattern.MatchString(j.RateLimitInterval) {
+		return fmt.Errorf("invalid journald rate limit interval: %q", j.RateLimitInterval)
+	}
+	if j.RateLimitBurst < 0 {
+		return fmt.Errorf("invalid journald rate limit burst: %d", j.RateLimitBurst)
+	}
+	return nil
+}
+
+// Journald writes the journald drop in, the journal directory is only created for persistent storage.
+func Journald(ctx context.Context, fs afero.Fs, cfg JournaldConfig) error {
+
+	ctx, span := telemetry.Start(ctx, "configure journald")
+	defer span.End()
+
+	cfg = cfg.withDefaults()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	dropIn, renderErr := utility.RenderTemplate(ctx, configFiles, "files/journald.conf.template", cfg)
+	if renderErr != nil {
+		return renderErr
+	}
+
+	if err := fs.MkdirAll("/etc/systemd/journald.conf.d", 0755); err != nil {
+		return err
+	}
+
+	if _, err := IdempotentWrite(ctx, fs, &dropIn, journaldDropInPath, 0644); err != nil {
+		return err
+	}
+
+	if cfg.Storage != persistentJournal {
+		return nil
+	}
+
+	// systemd-tmpfiles fixes up the group and acls on first boot
+	return fs.MkdirAll(persistentJournalDir, 0755)
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournaldDefaults(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, Journald(context.Background(), fs, JournaldConfig{}))
+
+	dropIn, err := afero.ReadFile(fs, journaldDropInPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "# managed by pi-image-builder\n[Journal]\nStorage=volatile\nSystemMaxUse=200M\nRuntimeMaxUse=200M\nRateLimitIntervalSec=30s\nRateLimitBurst=10000\n", string(dropIn))
+
+	exists, existsErr := afero.DirExists(fs, persistentJournalDir)
+	assert.NoError(t, existsErr)
+	assert.False(t, exists)
+}
+
+func TestJournaldPersistent(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	cfg := JournaldConfig{Storage: "persistent", SystemMaxUse: "1G", RateLimitBurst: 500}
+	assert.NoError(t, Journald(context.Background(), fs, cfg))
+
+	dropIn, err := afero.ReadFile(fs, journaldDropInPath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(dropIn), "Storage=persistent\n")
+	assert.Contains(t, string(dropIn), "SystemMaxUse=1G\n")
+	assert.Contains(t, string(dropIn), "RateLimitBurst=500\n")
+
+	exists, existsErr := afero.DirExists(fs, persistentJournalDir)
+	assert.NoError(t, existsErr)
+	assert.True(t, exists)
+}
+
+func TestJournaldConfigValidate(t *testing.T) {
+	assert.Error(t, JournaldConfig{Storage: "disk"}.withDefaults().Validate())
+	assert.Error(t, JournaldConfig{SystemMaxUse: "200MB"}.withDefaults().Validate())
+	assert.Error(t, JournaldConfig{RateLimitInterval: "30 s"}.withDefaults().Validate())
+}
@@ -17,138 +17,252 @@
 package configure
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"regexp"
+	"sort"
 	"strings"
 
+	"github.com/LadySerena/pi-image-builder/distro"
 	"github.com/LadySerena/pi-image-builder/telemetry"
 	"github.com/LadySerena/pi-image-builder/utility"
 	"github.com/spf13/afero"
 )
 
-type Sysctl []struct {
-	key   string
-	value string
+var gzipMagic = []byte{0x1f, 0x8b}
+
+var sysctlKeyPattern = regexp.MustCompile(`^[a-z0-9_*-]+(\.[a-zA-Z0-9_*-]+)+$`)
+
+// Sysctl maps a key to its value, it renders sorted so the same settings always produce the same file.
+type Sysctl map[string]string
+
+func (s Sysctl) String() string {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var builder strings.Builder
+	builder.WriteString("# managed by pi-image-builder\n")
+	for _, key := range keys {
+		builder.WriteString(fmt.Sprintf("%s = %s\n", key, s[key]))
+	}
+	return builder.String()
 }
 
-func (s *Sysctl) String() string {
-	var returnValue []string
-	for _, entry := range *s {
-		returnValue = append(returnValue, fmt.Sprintf("%s = %s", entry.key, entry.value))
+// Merge returns a copy of s with overrides applied on top.
+func (s Sysctl) Merge(overrides Sysctl) Sysctl {
+	merged := make(Sysctl, len(s)+len(overrides))
+	for key, value := range s {
+		merged[key] = value
+	}
+	for key, value := range overrides {
+		merged[key] = value
 	}
-	return strings.Join(returnValue, "\n")
+	return merged
 }
 
-func KernelSettings(ctx context.Context, fs afero.Fs) error {
+func (s Sysctl) Validate() error {
+	for key, value := range s {
+		if !sysctlKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid sysctl key: %q", key)
+		}
+		if value == "" || strings.ContainsAny(value, "\n=") {
+			return fmt.Errorf("invalid value for sysctl %s: %q", key, value)
+		}
+	}
+	return nil
+}
 
-	ctx, span := telemetry.GetTracer().Start(ctx, "configure kernel")
+// KernelConfig covers the boot partition: the kernel command line and firmware config.
+type KernelConfig struct {
+	CommandLine CommandLine    `yaml:"commandLine"`
+	Firmware    FirmwareConfig `yaml:"firmware"`
+	// Serial sets the console parameters on the command line and the uart in usercfg.txt, the getty is set up by
+	// SerialConsole once packages are installed.
+	Serial SerialConfig `yaml:"serial"`
+	// Pin is installed by the packages step rather than here, the boot partition is configured before apt runs.
+	Pin KernelPin `yaml:"pin"`
+}
+
+// KernelSettings writes cmdline.txt, booting in the cgroup mode, and usercfg.txt. Images booting through u-boot also get their kernel
+// decompressed, along with an apt hook that does it again whenever the kernel is upgraded.
+func KernelSettings(ctx context.Context, fs afero.Fs, d distro.Distro, cfg KernelConfig, cgroup CgroupMode) (err error) {
+
+	ctx, span := telemetry.Start(ctx, "configure kernel")
 	defer span.End()
 
-	decompressKernel, decompressErr := configFiles.Open("files/decompressKernel.bash")
-	if decompressErr != nil {
-		return decompressErr
+	commandLine := cfg.CommandLine.WithCgroupMode(cgroup).WithSerial(cfg.Serial)
+	if err := commandLine.Validate(); err != nil {
+		return err
 	}
 
-	defer utility.WrappedClose(decompressKernel)
+	firmware := cfg.Firmware.withDefaults().withSerial(cfg.Serial)
+	if err := firmware.Validate(); err != nil {
+		return err
+	}
 
 	commandLineHandle, commandLineOpenErr := fs.OpenFile(commandLinePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
 	if commandLineOpenErr != nil {
 		return commandLineOpenErr
 	}
-	defer utility.WrappedClose(commandLineHandle)
+	defer utility.CloseWithErr(commandLineHandle, &err)
 
-	if _, err := commandLineHandle.WriteString(commandLine); err != nil {
+	if _, err := commandLineHandle.WriteString(commandLine.String()); err != nil {
 		return err
 	}
 
-	if err := IdempotentWrite(ctx, fs, decompressKernel, "/boot/auto_decompress_kernel", 0544); err != nil {
+	firmwareConfig, firmwareConfigErr := utility.RenderTemplate(ctx, configFiles, "files/usercfg.txt.template", firmware)
+	if firmwareConfigErr != nil {
+		return firmwareConfigErr
+	}
+
+	if _, err := IdempotentWrite(ctx, fs, &firmwareConfig, firmwareConfigPath, 0755); err != nil {
 		return err
 	}
 
-	firmwareConfigFile, firmwareConfigErr := configFiles.Open("files/firmwareConfig")
-	if firmwareConfigErr != nil {
-		return firmwareConfigErr
+	if d.IncludeUserConfig {
+		if err := includeUserConfig(fs); err != nil {
+			return err
+		}
+	}
+
+	if !d.UBoot {
+		return nil
+	}
+
+	decompressKernel, decompressErr := configFiles.Open("files/decompressKernel.bash")
+	if decompressErr != nil {
+		return decompressErr
+	}
+
+	defer utility.WrappedClose(decompressKernel)
+
+	if _, err := IdempotentWrite(ctx, fs, decompressKernel, "/boot/auto_decompress_kernel", 0544); err != nil {
+		return err
 	}
-	defer utility.WrappedClose(firmwareConfigFile)
 
-	if err := IdempotentWrite(ctx, fs, firmwareConfigFile, "/boot/firmware/usercfg.txt", 0755); err != nil {
+	if err := extractKernel(fs, "/boot/firmware/vmlinuz", "/boot/firmware/vmlinux"); err != nil {
 		return err
 	}
 
-	compressedKernelImage, fsOpenErr := fs.Open("/boot/firmware/vmlinuz")
+	if _, err := IdempotentWrite(ctx, fs, bytes.NewBufferString(postInvoke), "/etc/apt/apt.conf.d/999_decompress_rpi_kernel", 0644); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// includeUserConfig appends an include of usercfg.txt to config.txt unless it's already there.
+func includeUserConfig(fs afero.Fs) error {
+	return appendConfigLines(fs, firmwareBaseConfigPath, []string{userConfigInclude})
+}
+
+// appendConfigLines adds each line the firmware config at name doesn't already have to its end.
+func appendConfigLines(fs afero.Fs, name string, lines []string) error {
+	existing, readErr := afero.ReadFile(fs, name)
+	if readErr != nil {
+		return readErr
+	}
+	present := make(map[string]bool)
+	for _, line := range strings.Split(string(existing), "\n") {
+		present[strings.TrimSpace(line)] = true
+	}
+	updated := existing
+	for _, line := range lines {
+		if present[line] {
+			continue
+		}
+		if len(updated) != 0 && !bytes.HasSuffix(updated, []byte("\n")) {
+			updated = append(updated, '\n')
+		}
+		updated = append(updated, []byte(line+"\n")...)
+		present[line] = true
+	}
+	if len(updated) == len(existing) {
+		return nil
+	}
+	return afero.WriteFile(fs, name, updated, 0755)
+}
+
+// extractKernel streams source to destination, gunzipping it when it starts with the gzip magic. Some raspi kernels
+// ship uncompressed in which case it's copied as is.
+func extractKernel(fs afero.Fs, source string, destination string) (err error) {
+	compressedKernelImage, fsOpenErr := fs.Open(source)
 	if fsOpenErr != nil {
 		return fsOpenErr
 	}
 	defer utility.WrappedClose(compressedKernelImage)
 
-	decompressedKernelImage, openErr := fs.OpenFile("/boot/firmware/vmlinux", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	decompressedKernelImage, openErr := fs.OpenFile(destination, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 	if openErr != nil {
 		return openErr
 	}
-	defer utility.WrappedClose(decompressedKernelImage)
+	defer utility.CloseWithErr(decompressedKernelImage, &err)
 
-	reader, readerErr := gzip.NewReader(compressedKernelImage)
-	if readerErr != nil {
-		return readerErr
+	kernel := bufio.NewReader(compressedKernelImage)
+	magic, peekErr := kernel.Peek(len(gzipMagic))
+	if peekErr != nil && !errors.Is(peekErr, io.EOF) {
+		return peekErr
 	}
-	defer utility.WrappedClose(reader)
 
-	buffer, decompressErr := io.ReadAll(reader)
-	if decompressErr != nil {
-		return decompressErr
+	var reader io.Reader = kernel
+	if bytes.Equal(magic, gzipMagic) {
+		gzipReader, readerErr := gzip.NewReader(kernel)
+		if readerErr != nil {
+			return readerErr
+		}
+		defer utility.WrappedClose(gzipReader)
+		reader = gzipReader
 	}
 
-	_, writeErr := decompressedKernelImage.Write(buffer)
-	if writeErr != nil {
-		return writeErr
+	written, copyErr := io.Copy(decompressedKernelImage, reader)
+	if copyErr != nil {
+		return copyErr
 	}
-
-	if err := IdempotentWrite(ctx, fs, bytes.NewBufferString(postInvoke), "/etc/apt/apt.conf.d/999_decompress_rpi_kernel", 0644); err != nil {
-		return err
+	if written == 0 {
+		return fmt.Errorf("kernel %s decompressed to an empty file", source)
 	}
 
 	return nil
 }
 
-func KernelModules(ctx context.Context, fs afero.Fs) error {
+// KernelModules loads the modules kubernetes needs and writes its sysctls. Extra sysctls win over the defaults, keys
+// the cilium file sets are overridden there since it's applied last.
+func KernelModules(ctx context.Context, fs afero.Fs, extraSysctls Sysctl) error {
 
-	_, span := telemetry.GetTracer().Start(ctx, "configuring kernel modules")
+	_, span := telemetry.Start(ctx, "configuring kernel modules")
 	defer span.End()
 
 	modules := strings.Join([]string{"br_netfilter", "overlay"}, "\n")
 	kubernetesSysctlPath := "/etc/sysctl.d/10-kubernetes.conf"
 	ciliumSysctlPath := "/etc/sysctl.d/99-override_cilium_rp_filter.conf"
 
-	kubernetesSysctls := Sysctl{
-		{
-			"net.bridge.bridge-nf-call-ip6tables", "1",
-		},
-		{
-			"net.bridge.bridge-nf-call-iptables", "1",
-		},
-		{
-			"net.ipv4.ip_forward", "1",
-		},
+	if err := extraSysctls.Validate(); err != nil {
+		return err
 	}
 
-	// todo "net.ipv4.conf.lxc*.rp_filter" seems to break the systemd-sysctl.service ???
-	ciliumSysctls := Sysctl{
-		{
-			"net.ipv4.conf.all.rp_filter", "0",
-		},
-		{
-			"net.ipv4.conf.default.rp_filter", "0",
-		},
+	kubernetesSysctls, ciliumSysctls := kernelSysctls(extraSysctls)
+
+	if err := fs.MkdirAll("/etc/modules-load.d", 0755); err != nil {
+		return err
 	}
 
 	if err := afero.WriteFile(fs, "/etc/modules-load.d/k8s.conf", []byte(modules), 0644); err != nil {
 		return err
 	}
 
+	if err := fs.MkdirAll("/etc/sysctl.d", 0755); err != nil {
+		return err
+	}
+
 	if err := afero.WriteFile(fs, kubernetesSysctlPath, []byte(kubernetesSysctls.String()), 0644); err != nil {
 		return err
 	}
@@ -159,3 +273,29 @@ func KernelModules(ctx context.Context, fs afero.Fs) error {
 
 	return nil
 }
+
+func kernelSysctls(extraSysctls Sysctl) (Sysctl, Sysctl) {
+	kubernetesSysctls := Sysctl{
+		"net.bridge.bridge-nf-call-ip6tables": "1",
+		"net.bridge.bridge-nf-call-iptables":  "1",
+		"net.ipv4.ip_forward":                 "1",
+	}
+
+	// todo "net.ipv4.conf.lxc*.rp_filter" seems to break the systemd-sysctl.service ???
+	ciliumSysctls := Sysctl{
+		"net.ipv4.conf.all.rp_filter":     "0",
+		"net.ipv4.conf.default.rp_filter": "0",
+	}
+
+	kubernetesOverrides := Sysctl{}
+	ciliumOverrides := Sysctl{}
+	for key, value := range extraSysctls {
+		if _, ok := ciliumSysctls[key]; ok {
+			ciliumOverrides[key] = value
+		} else {
+			kubernetesOverrides[key] = value
+		}
+	}
+
+	return kubernetesSysctls.Merge(kubernetesOverrides), ciliumSysctls.Merge(ciliumOverrides)
+}
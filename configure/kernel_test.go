@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/distro"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSysctlStringIsStable(t *testing.T) {
+	sysctls := Sysctl{
+		"net.ipv4.ip_forward":                 "1",
+		"net.bridge.bridge-nf-call-iptables":  "1",
+		"vm.swappiness":                       "100",
+		"kernel.panic":                        "10",
+		"net.bridge.bridge-nf-call-ip6tables": "1",
+		"fs.inotify.max_user_instances":       "8192",
+	}
+	expected := "# managed by pi-image-builder\n" +
+		"fs.inotify.max_user_instances = 8192\n" +
+		"kernel.panic = 10\n" +
+		"net.bridge.bridge-nf-call-ip6tables = 1\n" +
+		"net.bridge.bridge-nf-call-iptables = 1\n" +
+		"net.ipv4.ip_forward = 1\n" +
+		"vm.swappiness = 100\n"
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, expected, sysctls.String())
+	}
+}
+
+func TestKernelModulesMergesSysctls(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	extra := Sysctl{
+		"net.ipv4.ip_forward":         "0",
+		"net.ipv4.conf.all.rp_filter": "2",
+		"fs.inotify.max_user_watches": "524288",
+	}
+	assert.NoError(t, KernelModules(context.Background(), fs, extra))
+
+	kubernetes, err := afero.ReadFile(fs, "/etc/sysctl.d/10-kubernetes.conf")
+	assert.NoError(t, err)
+	assert.Equal(t, "# managed by pi-image-builder\n"+
+		"fs.inotify.max_user_watches = 524288\n"+
+		"net.bridge.bridge-nf-call-ip6tables = 1\n"+
+		"net.bridge.bridge-nf-call-iptables = 1\n"+
+		"net.ipv4.ip_forward = 0\n", string(kubernetes))
+
+	cilium, ciliumErr := afero.ReadFile(fs, "/etc/sysctl.d/99-override_cilium_rp_filter.conf")
+	assert.NoError(t, ciliumErr)
+	assert.Equal(t, "# managed by pi-image-builder\n"+
+		"net.ipv4.conf.all.rp_filter = 2\n"+
+		"net.ipv4.conf.default.rp_filter = 0\n", string(cilium))
+}
+
+func TestSysctlValidate(t *testing.T) {
+	assert.NoError(t, Sysctl{"net.ipv4.conf.eth0.rp_filter": "1"}.Validate())
+	assert.Error(t, Sysctl{"swappiness": "1"}.Validate())
+	assert.Error(t, Sysctl{"vm.swappiness": "1\nkernel.panic = 0"}.Validate())
+	assert.Error(t, Sysctl{"vm.swappiness": ""}.Validate())
+}
+
+func TestExtractKernelGzip(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	payload := bytes.Repeat([]byte("ARMd kernel image "), 1024)
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, writeErr := writer.Write(payload)
+	assert.NoError(t, writeErr)
+	assert.NoError(t, writer.Close())
+	assert.NoError(t, afero.WriteFile(fs, "/boot/firmware/vmlinuz", compressed.Bytes(), 0644))
+
+	assert.NoError(t, extractKernel(fs, "/boot/firmware/vmlinuz", "/boot/firmware/vmlinux"))
+	kernel, err := afero.ReadFile(fs, "/boot/firmware/vmlinux")
+	assert.NoError(t, err)
+	assert.Equal(t, payload, kernel)
+}
+
+func TestExtractKernelUncompressed(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	payload := []byte("ARMd uncompressed kernel image")
+	assert.NoError(t, afero.WriteFile(fs, "/boot/firmware/vmlinuz", payload, 0644))
+	assert.NoError(t, afero.WriteFile(fs, "/boot/firmware/vmlinux", []byte("a previous, much longer kernel image"), 0644))
+
+	assert.NoError(t, extractKernel(fs, "/boot/firmware/vmlinuz", "/boot/firmware/vmlinux"))
+	kernel, err := afero.ReadFile(fs, "/boot/firmware/vmlinux")
+	assert.NoError(t, err)
+	assert.Equal(t, payload, kernel)
+}
+
+func TestExtractKernelEmpty(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "/boot/firmware/vmlinuz", []byte{}, 0644))
+	assert.Error(t, extractKernel(fs, "/boot/firmware/vmlinuz", "/boot/firmware/vmlinux"))
+}
+
+func TestKernelSettingsRaspiOS(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, fs.MkdirAll("/boot/firmware", 0755))
+	assert.NoError(t, afero.WriteFile(fs, firmwareBaseConfigPath, []byte("arm_64bit=1"), 0755))
+
+	assert.NoError(t, KernelSettings(context.Background(), fs, distro.RaspiOS, KernelConfig{}, CgroupUnified))
+	assert.NoError(t, KernelSettings(context.Background(), fs, distro.RaspiOS, KernelConfig{}, CgroupUnified))
+
+	config, err := afero.ReadFile(fs, firmwareBaseConfigPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "arm_64bit=1\ninclude usercfg.txt\n", string(config))
+
+	for _, name := range []string{"/boot/auto_decompress_kernel", "/boot/firmware/vmlinux", "/etc/apt/apt.conf.d/999_decompress_rpi_kernel"} {
+		exists, existsErr := afero.Exists(fs, name)
+		assert.NoError(t, existsErr)
+		assert.False(t, exists, name)
+	}
+}
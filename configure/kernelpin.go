@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/manifest"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const (
+	// kernelPreferencesPath keeps apt from moving the pinned packages, even during unattended upgrades on the node.
+	kernelPreferencesPath = "/etc/apt/preferences.d/pi-image-builder-kernel"
+	// KernelImagePath is the kernel the firmware boots.
+	KernelImagePath = "/boot/firmware/vmlinuz"
+	kernelFlavour   = "raspi"
+	// kernelPinPriority above 1000 lets apt downgrade to the pinned version when the base image shipped a newer one.
+	kernelPinPriority = 1001
+)
+
+// kernelModulesVersion is an ubuntu kernel's package version, e.g. 5.15.0-1034.37, whose abi is 5.15.0-1034.
+var kernelModulesVersion = regexp.MustCompile(`^(\d+\.\d+\.\d+-\d+)\.\d+`)
+
+// bootedRelease finds the release the kernel was built as in its banner, e.g. "Linux version 5.15.0-1034-raspi (".
+var bootedRelease = regexp.MustCompile(`Linux version (\S+) \(`)
+
+// KernelPin installs the raspi kernel and firmware at explicit versions and holds them there, so an upgrade during
+// the build can't pull in a kernel that doesn't boot. The zero value leaves the kernel to apt.
+type KernelPin struct {
+	// Image is the linux-image-raspi metapackage version, e.g. 5.15.0.1034.32.
+	Image string `yaml:"image"`
+	// Modules is the version of the kernel's linux-image-* and linux-modules-* packages, e.g. 5.15.0-1034.37. The
+	// booted kernel is checked against the release it names.
+	Modules string `yaml:"modules"`
+	// Firmware is the linux-firmware-raspi version.
+	Firmware string `yaml:"firmware"`
+}
+
+// Enabled reports whether anything is pinned.
+func (p KernelPin) Enabled() bool {
+	return p.Image != "" || p.Modules != "" || p.Firmware != ""
+}
+
+func (p KernelPin) Validate() error {
+	if !p.Enabled() {
+		return nil
+	}
+	if p.Modules == "" {
+		return errors.New("a kernel pin needs the modules version, the kernel in the image is checked against it")
+	}
+	if !kernelModulesVersion.MatchString(p.Modules) {
+		return fmt.Errorf("kernel modules version must look like 5.15.0-1034.37, got: %q", p.Modules)
+	}
+	return nil
+}
+
+// Release is the kernel release the pinned modules belong to, e.g. 5.15.0-1034-raspi, what uname -r prints once it's
+// booted.
+func (p KernelPin) Release() string {
+	match := kernelModulesVersion.FindStringSubmatch(p.Modules)
+	if match == nil {
+		return ""
+	}
+	return match[1] + "-" + kernelFlavour
+}
+
+// Specs are the pinned packages as apt-get install arguments.
+func (p KernelPin) Specs() []PackageSpec {
+	if !p.Enabled() {
+		return nil
+	}
+	specs := make([]PackageSpec, 0, 4)
+	if p.Image != "" {
+		specs = append(specs, PackageSpec{Name: "linux-image-" + kernelFlavour, Version: p.Image})
+	}
+	specs = append(specs,
+		PackageSpec{Name: "linux-image-" + p.Release(), Version: p.Modules},
+		PackageSpec{Name: "linux-modules-" + p.Release(), Version: p.Modules},
+	)
+	if p.Firmware != "" {
+		specs = append(specs, PackageSpec{Name: "linux-firmware-" + kernelFlavour, Version: p.Firmware})
+	}
+	return specs
+}
+
+// Versions maps each pinned package to its version.
+func (p KernelPin) Versions() map[string]string {
+	specs := p.Specs()
+	if len(specs) == 0 {
+		return nil
+	}
+	versions := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		versions[spec.Name] = spec.Version
+	}
+	return versions
+}
+
+// preferences renders the apt preferences pinning every package in Specs. The modules get a glob so the extra
+// modules packages some kernels split out are held at the same version.
+func (p KernelPin) preferences() string {
+	var builder strings.Builder
+	builder.WriteString("# managed by pi-image-builder\n")
+	for _, spec := range p.Specs() {
+		name := spec.Name
+		if strings.HasPrefix(name, "linux-modules-") {
+			name = "linux-modules-*"
+		}
+		builder.WriteString(fmt.Sprintf("\nPackage: %s\nPin: version %s\nPin-Priority: %d\n", name, spec.Version, kernelPinPriority))
+	}
+	return builder.String()
+}
+
+// writeKernelPreferences pins the kernel packages before apt touches anything, so not even the upgrade sees a newer
+// kernel.
+func writeKernelPreferences(ctx context.Context, fs afero.Fs, pin KernelPin) error {
+	if !pin.Enabled() {
+		return nil
+	}
+	_, err := IdempotentWrite(ctx, fs, strings.NewReader(pin.preferences()), kernelPreferencesPath, 0644)
+	return err
+}
+
+// installKernel installs the pinned kernel packages, downgrading them if need be, and marks them held.
+func installKernel(ctx context.Context, chroot ChrootRunner, pin KernelPin) error {
+	specs := pin.Specs()
+	if len(specs) == 0 {
+		return nil
+	}
+	// a rerun, e.g. updating a flashed card, finds the packages held from last time
+	if err := chroot.Stream(ctx, 20*time.Minute, installArgs(specs, "--allow-change-held-packages")...); err != nil {
+		return fmt.Errorf("could not install pinned kernel: %w", err)
+	}
+	hold := []string{"apt-mark", "hold"}
+	for _, spec := range specs {
+		hold = append(hold, spec.Name)
+	}
+	return chroot.Run(ctx, time.Minute, hold...)
+}
+
+// KernelPackages picks the pinned kernel packages out of what's installed, for the manifest.
+func KernelPackages(installed []manifest.Package, pin KernelPin) []manifest.Package {
+	versions := pin.Versions()
+	kernel := make([]manifest.Package, 0, len(versions))
+	for _, pkg := range installed {
+		if _, ok := versions[pkg.Name]; ok {
+			kernel = append(kernel, pkg)
+		}
+	}
+	return kernel
+}
+
+// ErrKernelMismatch is a kernel in the image other than the pinned one.
+type ErrKernelMismatch struct {
+	Path     string
+	Expected string
+	Found    string
+}
+
+func (e *ErrKernelMismatch) Error() string {
+	return fmt.Sprintf("%s is kernel %s, the pin expects %s", e.Path, e.Found, e.Expected)
+}
+
+// KernelRelease reads the release a kernel image was built as from its banner, decompressing it first if it's
+// gzipped.
+func KernelRelease(fs afero.Fs, name string) (string, error) {
+	file, openErr := fs.Open(name)
+	if openErr != nil {
+		return "", openErr
+	}
+	defer utility.WrappedClose(file)
+
+	kernel := bufio.NewReader(file)
+	magic, peekErr := kernel.Peek(len(gzipMagic))
+	if peekErr != nil && !errors.Is(peekErr, io.EOF) {
+		return "", peekErr
+	}
+	var reader io.Reader = kernel
+	if bytes.Equal(magic, gzipMagic) {
+		gzipReader, gzipErr := gzip.NewReader(kernel)
+		if gzipErr != nil {
+			return "", gzipErr
+		}
+		defer utility.WrappedClose(gzipReader)
+		reader = gzipReader
+	}
+
+	contents, readErr := io.ReadAll(reader)
+	if readErr != nil {
+		return "", readErr
+	}
+	match := bootedRelease.FindSubmatch(contents)
+	if match == nil {
+		return "", fmt.Errorf("no kernel version banner in %s", name)
+	}
+	return string(match[1]), nil
+}
+
+// VerifyKernel fails when the kernel the firmware boots isn't the pinned one, which happens when something outside
+// apt's view, like flash-kernel not running in the container, left the old kernel on the boot partition.
+func VerifyKernel(ctx context.Context, fs afero.Fs, pin KernelPin) error {
+	if !pin.Enabled() {
+		return nil
+	}
+	_, span := telemetry.Start(ctx, "verify kernel")
+	defer span.End()
+
+	found, releaseErr := KernelRelease(fs, KernelImagePath)
+	if releaseErr != nil {
+		return fmt.Errorf("could not read the kernel's version: %w", releaseErr)
+	}
+	if found != pin.Release() {
+		return &ErrKernelMismatch{Path: KernelImagePath, Expected: pin.Release(), Found: found}
+	}
+	return nil
+}
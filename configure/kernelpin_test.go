@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/manifest"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+var testKernelPin = KernelPin{Image: "5.15.0.1034.32", Modules: "5.15.0-1034.37", Firmware: "1.20230405-0ubuntu1~22.04"}
+
+func TestKernelPinValidate(t *testing.T) {
+	assert.NoError(t, KernelPin{}.Validate())
+	assert.NoError(t, testKernelPin.Validate())
+	assert.Error(t, KernelPin{Image: "5.15.0.1034.32"}.Validate())
+	assert.Error(t, KernelPin{Modules: "5.15.0.1034.32"}.Validate())
+}
+
+func TestKernelPinSpecs(t *testing.T) {
+	assert.Equal(t, "5.15.0-1034-raspi", testKernelPin.Release())
+	assert.Equal(t, []PackageSpec{
+		{Name: "linux-image-raspi", Version: "5.15.0.1034.32"},
+		{Name: "linux-image-5.15.0-1034-raspi", Version: "5.15.0-1034.37"},
+		{Name: "linux-modules-5.15.0-1034-raspi", Version: "5.15.0-1034.37"},
+		{Name: "linux-firmware-raspi", Version: "1.20230405-0ubuntu1~22.04"},
+	}, testKernelPin.Specs())
+	assert.Nil(t, KernelPin{}.Specs())
+	assert.Nil(t, KernelPin{}.Versions())
+
+	assert.Equal(t, "# managed by pi-image-builder\n"+
+		"\nPackage: linux-image-5.15.0-1034-raspi\nPin: version 5.15.0-1034.37\nPin-Priority: 1001\n"+
+		"\nPackage: linux-modules-*\nPin: version 5.15.0-1034.37\nPin-Priority: 1001\n",
+		KernelPin{Modules: "5.15.0-1034.37"}.preferences())
+}
+
+func TestInstallKernel(t *testing.T) {
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	chroot := &recordingChroot{}
+	pin := KernelPin{Modules: "5.15.0-1034.37"}
+
+	assert.NoError(t, writeKernelPreferences(ctx, fs, pin))
+	preferences, readErr := afero.ReadFile(fs, kernelPreferencesPath)
+	assert.NoError(t, readErr)
+	assert.Contains(t, string(preferences), "Package: linux-modules-*\n")
+
+	assert.NoError(t, installKernel(ctx, chroot, pin))
+	assert.Equal(t, []string{
+		"apt-get install --allow-change-held-packages --allow-downgrades -y linux-image-5.15.0-1034-raspi=5.15.0-1034.37 linux-modules-5.15.0-1034-raspi=5.15.0-1034.37",
+		"apt-mark hold linux-image-5.15.0-1034-raspi linux-modules-5.15.0-1034-raspi",
+	}, chroot.commands)
+
+	// nothing is written or installed without a pin
+	unpinned := &recordingChroot{}
+	assert.NoError(t, installKernel(ctx, unpinned, KernelPin{}))
+	assert.Empty(t, unpinned.commands)
+	assert.NoError(t, writeKernelPreferences(ctx, afero.NewMemMapFs(), KernelPin{}))
+}
+
+func TestKernelPackages(t *testing.T) {
+	installed := []manifest.Package{
+		{Name: "linux-image-5.15.0-1034-raspi", Version: "5.15.0-1034.37", Architecture: "arm64"},
+		{Name: "linux-modules-5.15.0-1034-raspi", Version: "5.15.0-1034.37", Architecture: "arm64"},
+		{Name: "openssh-server", Version: "1:8.9p1-3ubuntu0.6", Architecture: "arm64"},
+	}
+	assert.Equal(t, installed[:2], KernelPackages(installed, KernelPin{Modules: "5.15.0-1034.37"}))
+}
+
+func TestVerifyKernel(t *testing.T) {
+	ctx := context.Background()
+	banner := []byte("\x00\x00Linux version 5.15.0-1034-raspi (buildd@bos03-arm64-012) (gcc (Ubuntu 11.3.0-1ubuntu1~22.04.1) 11.3.0) #37-Ubuntu SMP PREEMPT\x00")
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, writeErr := writer.Write(banner)
+	assert.NoError(t, writeErr)
+	assert.NoError(t, writer.Close())
+
+	for name, kernel := range map[string][]byte{"gzipped": compressed.Bytes(), "uncompressed": banner} {
+		fs := afero.NewMemMapFs()
+		assert.NoError(t, afero.WriteFile(fs, KernelImagePath, kernel, 0644), name)
+		release, releaseErr := KernelRelease(fs, KernelImagePath)
+		assert.NoError(t, releaseErr, name)
+		assert.Equal(t, "5.15.0-1034-raspi", release, name)
+		assert.NoError(t, VerifyKernel(ctx, fs, testKernelPin), name)
+
+		mismatchErr := VerifyKernel(ctx, fs, KernelPin{Modules: "5.15.0-1040.43"})
+		var mismatch *ErrKernelMismatch
+		assert.True(t, errors.As(mismatchErr, &mismatch), name)
+		assert.Equal(t, "5.15.0-1034-raspi", mismatch.Found)
+		assert.Equal(t, "5.15.0-1040-raspi", mismatch.Expected)
+	}
+
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, KernelImagePath, []byte("not a kernel"), 0644))
+	assert.Error(t, VerifyKernel(ctx, fs, testKernelPin))
+	assert.NoError(t, VerifyKernel(ctx, fs, KernelPin{}))
+}
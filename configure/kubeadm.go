@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	KubeadmJoin = "join"
+	KubeadmInit = "init"
+
+	kubeadmConfigPath = "/etc/kubernetes/kubeadm.yaml"
+	// kubeadmTokenPath is on the fat boot partition so a token can be dropped in after flashing
+	kubeadmTokenPath = "/boot/firmware/kubeadm-token"
+)
+
+var bootstrapTokenPattern = regexp.MustCompile(`^[a-z0-9]{6}\.[a-z0-9]{16}$`)
+
+type Taint struct {
+	Key    string `yaml:"key"`
+	Value  string `yaml:"value"`
+	Effect string `yaml:"effect"`
+}
+
+type KubeadmConfig struct {
+	// Mode is either KubeadmJoin or KubeadmInit, empty disables the bootstrap step.
+	Mode              string `yaml:"mode"`
+	APIServerEndpoint string `yaml:"apiServerEndpoint"`
+	// Token may be left empty when it is provided at flash time through kubeadmTokenPath.
+	Token        string   `yaml:"token"`
+	CACertHashes []string `yaml:"caCertHashes"`
+	// UnsafeSkipCAVerification lets a join trust whichever api server answers, it's required when there are no
+	// caCertHashes.
+	UnsafeSkipCAVerification bool              `yaml:"unsafeSkipCAVerification"`
+	NodeLabels               map[string]string `yaml:"nodeLabels"`
+	Taints                   []Taint           `yaml:"taints"`
+	// AllowSwap skips the swap preflight check and stops the kubelet from refusing to start with swap on. It's set
+	// automatically when zram swap is enabled.
+	AllowSwap bool `yaml:"allowSwap"`
+}
+
+type KubeadmBootstrapScript struct {
+	Mode       string
+	ConfigPath string
+	TokenPath  string
+}
+
+// KubeadmToken drops a bootstrap token on an already built boot partition, kubeadm-bootstrap prefers it over the one
+// baked into the image.
+func KubeadmToken(ctx context.Context, fs afero.Fs, token string) error {
+	_, span := telemetry.Start(ctx, "configure kubeadm token")
+	defer span.End()
+
+	if !bootstrapTokenPattern.MatchString(token) {
+		return errors.New("kubeadm token must match [a-z0-9]{6}.[a-z0-9]{16}")
+	}
+
+	return afero.WriteFile(fs, kubeadmTokenPath, []byte(token+"\n"), 0600)
+}
+
+func (k KubeadmConfig) Enabled() bool {
+	return k.Mode != ""
+}
+
+func (k KubeadmConfig) Validate() error {
+	if k.Mode != KubeadmJoin && k.Mode != KubeadmInit {
+		return fmt.Errorf("kubeadm mode must be %s or %s, got: %q", KubeadmJoin, KubeadmInit, k.Mode)
+	}
+	if k.APIServerEndpoint == "" {
+		return errors.New("kubeadm api server endpoint must be set")
+	}
+	if k.Token != "" && !bootstrapTokenPattern.MatchString(k.Token) {
+		return errors.New("kubeadm token must match [a-z0-9]{6}.[a-z0-9]{16}")
+	}
+	if k.Mode == KubeadmJoin && len(k.CACertHashes) == 0 && !k.UnsafeSkipCAVerification {
+		return errors.New("kubeadm join needs caCertHashes, or unsafeSkipCAVerification to trust any api server")
+	}
+	for _, hash := range k.CACertHashes {
+		if !strings.HasPrefix(hash, "sha256:") {
+			return fmt.Errorf("kubeadm ca cert hash must start with sha256:, got: %q", hash)
+		}
+	}
+	for _, taint := range k.Taints {
+		switch taint.Effect {
+		case "NoSchedule", "PreferNoSchedule", "NoExecute":
+		default:
+			return fmt.Errorf("taint %s has invalid effect: %q", taint.Key, taint.Effect)
+		}
+	}
+	return nil
+}
+
+// NodeLabelArg renders NodeLabels in the key=value,key=value form the kubelet expects, sorted so the output is stable.
+func (k KubeadmConfig) NodeLabelArg() string {
+	labels := make([]string, 0, len(k.NodeLabels))
+	for key, value := range k.NodeLabels {
+		labels = append(labels, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
+
+// KubeadmBootstrap writes a kubeadm config and a oneshot unit that runs kubeadm on first boot then disables itself.
+func KubeadmBootstrap(ctx context.Context, chroot ChrootRunner, fs afero.Fs, cfg KubeadmConfig) error {
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	ctx, span := telemetry.Start(ctx, "configure kubeadm bootstrap")
+	defer span.End()
+
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	kubeadmConfig, configErr := utility.RenderTemplate(ctx, configFiles, "files/kubeadm.yaml.template", cfg)
+	if configErr != nil {
+		return configErr
+	}
+
+	if err := validateYAMLDocuments(kubeadmConfig.Bytes()); err != nil {
+		return fmt.Errorf("rendered kubeadm config is invalid: %w", err)
+	}
+
+	// the config always points kubeadm at the patch dir, it has to exist even when no kubelet patch was written
+	if err := fs.MkdirAll(kubeadmPatchDir, 0755); err != nil {
+		return err
+	}
+
+	if _, err := IdempotentWrite(ctx, fs, &kubeadmConfig, kubeadmConfigPath, 0600); err != nil {
+		return err
+	}
+
+	script, scriptErr := utility.RenderTemplate(ctx, configFiles, "files/kubeadm-bootstrap.bash.template", KubeadmBootstrapScript{
+		Mode:       cfg.Mode,
+		ConfigPath: kubeadmConfigPath,
+		TokenPath:  kubeadmTokenPath,
+	})
+	if scriptErr != nil {
+		return scriptErr
+	}
+
+	if err := fs.MkdirAll("/usr/local/sbin", 0755); err != nil {
+		return err
+	}
+
+	if _, err := IdempotentWrite(ctx, fs, &script, "/usr/local/sbin/kubeadm-bootstrap", 0755); err != nil {
+		return err
+	}
+
+	unit, unitErr := configFiles.Open("files/kubeadm-bootstrap.service")
+	if unitErr != nil {
+		return unitErr
+	}
+	defer utility.WrappedClose(unit)
+
+	if _, err := IdempotentWrite(ctx, fs, unit, "/etc/systemd/system/kubeadm-bootstrap.service", 0644); err != nil {
+		return err
+	}
+
+	return enableUnit(ctx, chroot, fs, "kubeadm-bootstrap")
+}
+
+func validateYAMLDocuments(data []byte) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var document map[string]any
+		err := decoder.Decode(&document)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func kubeadmBootstrap(t *testing.T, cfg KubeadmConfig) (string, string) {
+	fs, _ := unitFs(t)
+	assert.NoError(t, KubeadmBootstrap(context.Background(), &recordingChroot{}, fs, cfg))
+
+	config, readErr := afero.ReadFile(fs, kubeadmConfigPath)
+	assert.NoError(t, readErr)
+	script, readErr := afero.ReadFile(fs, "/usr/local/sbin/kubeadm-bootstrap")
+	assert.NoError(t, readErr)
+	return string(config), string(script)
+}
+
+func TestKubeadmBootstrapJoin(t *testing.T) {
+	config, script := kubeadmBootstrap(t, KubeadmConfig{
+		Mode:              KubeadmJoin,
+		APIServerEndpoint: "10.0.0.10:6443",
+		CACertHashes:      []string{"sha256:0123456789abcdef"},
+	})
+	assert.Contains(t, config, "    caCertHashes:\n      - \"sha256:0123456789abcdef\"\n")
+	assert.NotContains(t, config, "unsafeSkipCAVerification")
+	assert.Contains(t, script, "echo \"kubeadm join needs a bootstrap token, none was baked in or dropped at $TOKEN_FILE\" >&2\n  exit 1\n")
+
+	config, _ = kubeadmBootstrap(t, KubeadmConfig{
+		Mode:                     KubeadmJoin,
+		APIServerEndpoint:        "10.0.0.10:6443",
+		UnsafeSkipCAVerification: true,
+	})
+	assert.Contains(t, config, "    unsafeSkipCAVerification: true\n")
+	assert.NotContains(t, config, "caCertHashes")
+}
+
+func TestKubeadmBootstrapInitWithoutToken(t *testing.T) {
+	config, script := kubeadmBootstrap(t, KubeadmConfig{Mode: KubeadmInit, APIServerEndpoint: "10.0.0.10:6443"})
+	assert.Contains(t, config, "  - token: \"\"\n")
+	// without a token from the boot partition the empty one is dropped so kubeadm init generates its own
+	assert.Contains(t, script, "  sed -i -E '/^bootstrapTokens:/,/^\\s+ttl:/d' \"$CONFIG\"\n")
+	assert.NotContains(t, script, "exit 1")
+}
+
+func TestKubeadmConfigValidate(t *testing.T) {
+	join := KubeadmConfig{Mode: KubeadmJoin, APIServerEndpoint: "10.0.0.10:6443"}
+	assert.NoError(t, KubeadmConfig{Mode: KubeadmInit, APIServerEndpoint: "10.0.0.10:6443"}.Validate())
+
+	assert.Error(t, join.Validate())
+	join.UnsafeSkipCAVerification = true
+	assert.NoError(t, join.Validate())
+	join.UnsafeSkipCAVerification = false
+	join.CACertHashes = []string{"sha256:0123456789abcdef"}
+	assert.NoError(t, join.Validate())
+	join.CACertHashes = []string{"0123456789abcdef"}
+	assert.Error(t, join.Validate())
+
+	assert.Error(t, KubeadmConfig{Mode: "reset", APIServerEndpoint: "10.0.0.10:6443"}.Validate())
+	assert.Error(t, KubeadmConfig{Mode: KubeadmInit}.Validate())
+	assert.Error(t, KubeadmConfig{Mode: KubeadmInit, APIServerEndpoint: "10.0.0.10:6443", Token: "abc"}.Validate())
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const (
+	kubeletConfigPath = "/var/lib/kubelet/config.yaml"
+	// kubeadmPatchDir holds patches kubeadm applies on init and join. kubeadm rewrites kubeletConfigPath from the
+	// cluster's config, the kubeletconfiguration patch puts this node's settings back on top.
+	kubeadmPatchDir           = "/etc/kubernetes/patches"
+	kubeletConfigurationPatch = kubeadmPatchDir + "/kubeletconfiguration.yaml"
+)
+
+var (
+	quantityPattern    = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?(m|k|M|G|T|Ki|Mi|Gi|Ti)?$`)
+	percentPattern     = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?%$`)
+	featureGatePattern = regexp.MustCompile(`^[A-Z][A-Za-z0-9]+$`)
+
+	reservableResources = map[string]bool{"cpu": true, "memory": true, "ephemeral-storage": true, "pid": true}
+	evictionSignals     = map[string]bool{
+		"memory.available":   true,
+		"nodefs.available":   true,
+		"nodefs.inodesFree":  true,
+		"imagefs.available":  true,
+		"imagefs.inodesFree": true,
+		"pid.available":      true,
+	}
+)
+
+// KubeletConfig is rendered into a KubeletConfiguration. Unset fields get defaults sized for a 4GiB pi, an empty map
+// clears the default reservations or thresholds.
+type KubeletConfig struct {
+	MaxPods int `yaml:"maxPods"`
+	// SystemReserved holds back cpu, memory, ephemeral-storage, or pid for the os, e.g. memory: 256Mi.
+	SystemReserved map[string]string `yaml:"systemReserved"`
+	// EvictionHard maps eviction signals to a quantity or percentage, e.g. nodefs.available: 10%.
+	EvictionHard map[string]string `yaml:"evictionHard"`
+	// SerializeImagePulls defaults to true, parallel pulls thrash sd cards.
+	SerializeImagePulls *bool           `yaml:"serializeImagePulls"`
+	FeatureGates        map[string]bool `yaml:"featureGates"`
+}
+
+// KubeletConfigFile is what kubelet-config.yaml.template is rendered with.
+type KubeletConfigFile struct {
+	CgroupDriver        string
+	MaxPods             int
+	SerializeImagePulls bool
+	SystemReserved      map[string]string
+	EvictionHard        map[string]string
+	FeatureGates        map[string]bool
+}
+
+func (k KubeletConfig) withDefaults() KubeletConfig {
+	if k.MaxPods == 0 {
+		k.MaxPods = 64
+	}
+	if k.SystemReserved == nil {
+		k.SystemReserved = map[string]string{"cpu": "250m", "memory": "256Mi"}
+	}
+	if k.EvictionHard == nil {
+		k.EvictionHard = map[string]string{
+			"memory.available":  "200Mi",
+			"nodefs.available":  "10%",
+			"nodefs.inodesFree": "5%",
+			"imagefs.available": "15%",
+		}
+	}
+	if k.SerializeImagePulls == nil {
+		serialize := true
+		k.SerializeImagePulls = &serialize
+	}
+	return k
+}
+
+func (k KubeletConfig) Validate() error {
+	if k.MaxPods < 0 {
+		return fmt.Errorf("kubelet max pods must be positive, got: %d", k.MaxPods)
+	}
+	for resource, quantity := range k.SystemReserved {
+		if !reservableResources[resource] {
+			return fmt.Errorf("kubelet can't reserve %q", resource)
+		}
+		if !quantityPattern.MatchString(quantity) {
+			return fmt.Errorf("invalid quantity for reserved %s: %q", resource, quantity)
+		}
+	}
+	for signal, threshold := range k.EvictionHard {
+		if !evictionSignals[signal] {
+			return fmt.Errorf("unknown eviction signal: %q", signal)
+		}
+		if !quantityPattern.MatchString(threshold) && !percentPattern.MatchString(threshold) {
+			return fmt.Errorf("invalid threshold for eviction signal %s: %q", signal, threshold)
+		}
+	}
+	for gate := range k.FeatureGates {
+		if !featureGatePattern.MatchString(gate) {
+			return fmt.Errorf("invalid feature gate: %q", gate)
+		}
+	}
+	return nil
+}
+
+func renderKubeletConfig(ctx context.Context, cfg KubeletConfig, cgroup CgroupMode) ([]byte, error) {
+	cfg = cfg.withDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if err := cgroup.Validate(); err != nil {
+		return nil, err
+	}
+	rendered, err := utility.RenderTemplate(ctx, configFiles, "files/kubelet-config.yaml.template", KubeletConfigFile{
+		CgroupDriver:        cgroup.Driver(),
+		MaxPods:             cfg.MaxPods,
+		SerializeImagePulls: *cfg.SerializeImagePulls,
+		SystemReserved:      cfg.SystemReserved,
+		EvictionHard:        cfg.EvictionHard,
+		FeatureGates:        cfg.FeatureGates,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := validateYAMLDocuments(rendered.Bytes()); err != nil {
+		return nil, fmt.Errorf("rendered kubelet config is invalid: %w", err)
+	}
+	return rendered.Bytes(), nil
+}
+
+// KubeletConfiguration writes the kubelet's config file, which the kubeadm drop-in points it at, and the same settings
+// as a kubeadm patch so they survive kubeadm init and join rewriting it.
+func KubeletConfiguration(ctx context.Context, fs afero.Fs, cfg KubeletConfig, cgroup CgroupMode) error {
+	ctx, span := telemetry.Start(ctx, "configure kubelet")
+	defer span.End()
+
+	config, renderErr := renderKubeletConfig(ctx, cfg, cgroup)
+	if renderErr != nil {
+		return renderErr
+	}
+
+	for _, name := range []string{kubeletConfigPath, kubeletConfigurationPatch} {
+		if err := fs.MkdirAll(path.Dir(name), 0755); err != nil {
+			return err
+		}
+		if _, err := IdempotentWrite(ctx, fs, bytes.NewReader(config), name, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+// kubeletConfiguration mirrors the fields of kubelet.config.k8s.io/v1beta1 the template renders.
+type kubeletConfiguration struct {
+	APIVersion          string            `yaml:"apiVersion"`
+	Kind                string            `yaml:"kind"`
+	CgroupDriver        string            `yaml:"cgroupDriver"`
+	MaxPods             int               `yaml:"maxPods"`
+	SerializeImagePulls bool              `yaml:"serializeImagePulls"`
+	SystemReserved      map[string]string `yaml:"systemReserved"`
+	EvictionHard        map[string]string `yaml:"evictionHard"`
+	FeatureGates        map[string]bool   `yaml:"featureGates"`
+}
+
+func parseKubeletConfig(t *testing.T, rendered []byte) kubeletConfiguration {
+	var parsed kubeletConfiguration
+	decoder := yaml.NewDecoder(bytes.NewReader(rendered))
+	decoder.KnownFields(true)
+	assert.NoError(t, decoder.Decode(&parsed))
+	return parsed
+}
+
+func TestKubeletConfigDefaultsRoundTrip(t *testing.T) {
+	rendered, err := renderKubeletConfig(context.Background(), KubeletConfig{}, CgroupUnified)
+	assert.NoError(t, err)
+
+	assert.Equal(t, kubeletConfiguration{
+		APIVersion:          "kubelet.config.k8s.io/v1beta1",
+		Kind:                "KubeletConfiguration",
+		CgroupDriver:        "systemd",
+		MaxPods:             64,
+		SerializeImagePulls: true,
+		SystemReserved:      map[string]string{"cpu": "250m", "memory": "256Mi"},
+		EvictionHard: map[string]string{
+			"memory.available":  "200Mi",
+			"nodefs.available":  "10%",
+			"nodefs.inodesFree": "5%",
+			"imagefs.available": "15%",
+		},
+	}, parseKubeletConfig(t, rendered))
+}
+
+func TestKubeletConfigOverridesRoundTrip(t *testing.T) {
+	serialize := false
+	rendered, err := renderKubeletConfig(context.Background(), KubeletConfig{
+		MaxPods:             30,
+		SystemReserved:      map[string]string{},
+		EvictionHard:        map[string]string{"memory.available": "5%"},
+		SerializeImagePulls: &serialize,
+		FeatureGates:        map[string]bool{"NodeSwap": true, "GracefulNodeShutdown": false},
+	}, CgroupLegacy)
+	assert.NoError(t, err)
+
+	assert.Equal(t, kubeletConfiguration{
+		APIVersion:          "kubelet.config.k8s.io/v1beta1",
+		Kind:                "KubeletConfiguration",
+		CgroupDriver:        "cgroupfs",
+		MaxPods:             30,
+		SerializeImagePulls: false,
+		EvictionHard:        map[string]string{"memory.available": "5%"},
+		FeatureGates:        map[string]bool{"NodeSwap": true, "GracefulNodeShutdown": false},
+	}, parseKubeletConfig(t, rendered))
+}
+
+func TestKubeletConfigValidate(t *testing.T) {
+	assert.NoError(t, KubeletConfig{}.withDefaults().Validate())
+	for _, cfg := range []KubeletConfig{
+		{MaxPods: -1},
+		{SystemReserved: map[string]string{"gpu": "1"}},
+		{SystemReserved: map[string]string{"memory": "lots"}},
+		{EvictionHard: map[string]string{"memory.free": "100Mi"}},
+		{EvictionHard: map[string]string{"nodefs.available": "10 %"}},
+		{FeatureGates: map[string]bool{"node-swap": true}},
+	} {
+		assert.Error(t, cfg.Validate(), cfg)
+	}
+}
+
+func TestKubeletConfiguration(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, KubeletConfiguration(context.Background(), fs, KubeletConfig{MaxPods: 20}, CgroupUnified))
+
+	config, err := afero.ReadFile(fs, kubeletConfigPath)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, parseKubeletConfig(t, config).MaxPods)
+	patch, patchErr := afero.ReadFile(fs, kubeletConfigurationPatch)
+	assert.NoError(t, patchErr)
+	assert.Equal(t, config, patch)
+
+	assert.Error(t, KubeletConfiguration(context.Background(), afero.NewMemMapFs(), KubeletConfig{MaxPods: -1}, CgroupUnified))
+}
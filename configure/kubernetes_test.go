@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"archive/tar"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// kubernetesServer serves every file InstallKubernetes downloads for versions, each next to its .sha256, and points
+// the release urls at it.
+func kubernetesServer(t *testing.T, versions KubernetesVersions, tamper string) {
+	files := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, found := files[r.URL.Path]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(content))
+	}))
+	t.Cleanup(server.Close)
+
+	previousKubernetes, previousCNI, previousCriCtl := kubernetesReleaseURL, cniReleaseURL, criCtlReleaseURL
+	kubernetesReleaseURL, cniReleaseURL, criCtlReleaseURL = server.URL+"/release", server.URL+"/cni", server.URL+"/crictl"
+	t.Cleanup(func() {
+		kubernetesReleaseURL, cniReleaseURL, criCtlReleaseURL = previousKubernetes, previousCNI, previousCriCtl
+	})
+
+	contents := map[string]string{
+		"kubeadm": "kubeadm binary",
+		"kubelet": "kubelet binary",
+		"kubectl": "kubectl binary",
+		cniArtifact(versions).Name: string(tarball(t,
+			tarEntry{header: tar.Header{Name: "./bridge", Typeflag: tar.TypeReg, Mode: 0755}, body: "bridge plugin"},
+			tarEntry{header: tar.Header{Name: "./loopback", Typeflag: tar.TypeReg, Mode: 0755}, body: "loopback plugin"},
+		)),
+		criCtlArtifact(versions).Name: string(tarball(t,
+			tarEntry{header: tar.Header{Name: "crictl", Typeflag: tar.TypeReg, Mode: 0755}, body: "crictl binary"},
+		)),
+	}
+	for _, artifact := range KubernetesArtifacts(versions) {
+		path := strings.TrimPrefix(artifact.URL, server.URL)
+		content := contents[artifact.Name]
+		files[path+".sha256"] = sha256Hex(content)
+		if artifact.Name == tamper {
+			content = "tampered"
+		}
+		files[path] = content
+	}
+}
+
+// the kubelet unit is enabled with a symlink, which MemMapFs can't hold
+func TestInstallKubernetes(t *testing.T) {
+	versions := DefaultKubernetesVersions()
+	kubernetesServer(t, versions, "")
+	root := t.TempDir()
+	fs := afero.NewBasePathFs(afero.NewOsFs(), root)
+	chroot := &recordingChroot{}
+
+	assert.NoError(t, InstallKubernetes(context.Background(), chroot, fs, versions, CgroupUnified, t.TempDir()))
+
+	for name, content := range map[string]string{
+		"/usr/local/bin/kubeadm": "kubeadm binary",
+		"/usr/local/bin/kubelet": "kubelet binary",
+		"/usr/local/bin/kubectl": "kubectl binary",
+		"/usr/local/bin/crictl":  "crictl binary",
+		"/opt/cni/bin/bridge":    "bridge plugin",
+		"/opt/cni/bin/loopback":  "loopback plugin",
+	} {
+		installed, err := afero.ReadFile(fs, name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, content, string(installed), name)
+		info, statErr := fs.Stat(name)
+		assert.NoError(t, statErr)
+		assert.Equal(t, os.FileMode(0755), info.Mode().Perm(), name)
+	}
+
+	dropIn, dropInErr := afero.ReadFile(fs, "/etc/systemd/system/kubelet.service.d/10-kubeadm.conf")
+	assert.NoError(t, dropInErr)
+	assert.Contains(t, string(dropIn), "--cgroup-driver=systemd")
+	target, linkErr := os.Readlink(filepath.Join(root, "etc/systemd/system/multi-user.target.wants/kubelet.service"))
+	assert.NoError(t, linkErr)
+	assert.Equal(t, "/etc/systemd/system/kubelet.service", target)
+	assert.Empty(t, chroot.commands)
+}
+
+func TestInstallKubernetesChecksumMismatch(t *testing.T) {
+	versions := DefaultKubernetesVersions()
+	kubernetesServer(t, versions, criCtlArtifact(versions).Name)
+	fs := afero.NewMemMapFs()
+
+	err := InstallKubernetes(context.Background(), &recordingChroot{}, fs, versions, CgroupUnified, t.TempDir())
+	assert.ErrorContains(t, err, "checksum of "+criCtlArtifact(versions).Name)
+	// nothing is installed until every artifact is verified
+	exists, _ := afero.Exists(fs, "/usr/local/bin/kubeadm")
+	assert.False(t, exists)
+}
+
+func TestInstallKubernetesMissingArtifact(t *testing.T) {
+	versions := DefaultKubernetesVersions()
+	kubernetesServer(t, versions, "")
+	missing := versions
+	missing.CNI = "v9.9.9"
+
+	err := InstallKubernetes(context.Background(), &recordingChroot{}, afero.NewMemMapFs(), missing, CgroupUnified, t.TempDir())
+	assert.ErrorIs(t, err, &ErrStatusCode{URL: cniArtifact(missing).ChecksumURL, StatusCode: http.StatusNotFound})
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const (
+	// localRepoDir is where an offline build's deb pool is copied, nspawn can't see the host's artifact directory.
+	localRepoDir = "/var/lib/pi-image-builder/debs"
+	// localRepoSourcesDir replaces sources.list.d while the local repo is in use so apt never tries a mirror.
+	localRepoSourcesDir = "/etc/apt/pi-image-builder-offline.d"
+	localRepoConfPath   = "/etc/apt/apt.conf.d/00pi-image-builder-offline"
+)
+
+const localRepoConf = `Dir::Etc::SourceList "/dev/null";
+Dir::Etc::SourceParts "` + localRepoSourcesDir + `";
+`
+
+const localRepoSources = "deb [trusted=yes] file:" + localRepoDir + " ./\n"
+
+// LocalAptRepo copies pool, a flat apt repository with a Packages index, into the image and makes it the only place
+// apt installs from. Sanitize removes the repository and puts the image's own sources back.
+func LocalAptRepo(ctx context.Context, fs afero.Fs, pool afero.Fs) error {
+	ctx, span := telemetry.Start(ctx, "local apt repo")
+	defer span.End()
+
+	if err := fs.MkdirAll(localRepoDir, 0755); err != nil {
+		return err
+	}
+	walkErr := afero.Walk(pool, "/", func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		source, openErr := pool.Open(name)
+		if openErr != nil {
+			return openErr
+		}
+		defer utility.WrappedClose(source)
+		// the pool is flat, apt's file: source only reads the top level
+		_, writeErr := IdempotentWrite(ctx, fs, source, path.Join(localRepoDir, path.Base(name)), 0644)
+		return writeErr
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+
+	if err := fs.MkdirAll(localRepoSourcesDir, 0755); err != nil {
+		return err
+	}
+	if _, err := IdempotentWrite(ctx, fs, strings.NewReader(localRepoSources), path.Join(localRepoSourcesDir, "local.list"), 0644); err != nil {
+		return err
+	}
+	_, writeErr := IdempotentWrite(ctx, fs, strings.NewReader(localRepoConf), localRepoConfPath, 0644)
+	return writeErr
+}
+
+func removeLocalAptRepo(fs afero.Fs) error {
+	if err := fs.Remove(localRepoConfPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, dir := range []string{localRepoSourcesDir, localRepoDir} {
+		if err := fs.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalAptRepo(t *testing.T) {
+	pool := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(pool, "/Packages", []byte("Package: vim\n"), 0644))
+	assert.NoError(t, afero.WriteFile(pool, "/vim_8.2_arm64.deb", []byte("deb"), 0644))
+
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "/etc/apt/sources.list", []byte("deb http://ports.ubuntu.com/ubuntu-ports focal main\n"), 0644))
+	assert.NoError(t, LocalAptRepo(context.Background(), fs, pool))
+
+	deb, debErr := afero.ReadFile(fs, "/var/lib/pi-image-builder/debs/vim_8.2_arm64.deb")
+	assert.NoError(t, debErr)
+	assert.Equal(t, "deb", string(deb))
+	sources, sourcesErr := afero.ReadFile(fs, "/etc/apt/pi-image-builder-offline.d/local.list")
+	assert.NoError(t, sourcesErr)
+	assert.Equal(t, "deb [trusted=yes] file:/var/lib/pi-image-builder/debs ./\n", string(sources))
+	conf, confErr := afero.ReadFile(fs, localRepoConfPath)
+	assert.NoError(t, confErr)
+	assert.Contains(t, string(conf), `Dir::Etc::SourceList "/dev/null";`)
+
+	assert.NoError(t, Sanitize(context.Background(), fs, SanitizeConfig{KeepAptCache: true}))
+	for _, name := range []string{localRepoConfPath, localRepoSourcesDir, localRepoDir} {
+		exists, err := afero.Exists(fs, name)
+		assert.NoError(t, err)
+		assert.False(t, exists, name)
+	}
+	exists, err := afero.Exists(fs, "/etc/apt/sources.list")
+	assert.NoError(t, err)
+	assert.True(t, exists, "the image's own sources are untouched")
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/spf13/afero"
+)
+
+const (
+	longhornDataPath      = "/var/lib/longhorn"
+	longhornModulesPath   = "/etc/modules-load.d/longhorn.conf"
+	longhornMultipathPath = "/etc/multipath.conf"
+)
+
+// longhornMultipath keeps multipathd from claiming the scsi devices longhorn attaches over iscsi, see
+// https://longhorn.io/kb/troubleshooting-volume-with-multipath/
+const longhornMultipath = `blacklist {
+    devnode "^sd[a-z0-9]+"
+}
+`
+
+// LonghornModules are loaded at boot for longhorn's v1 iscsi and v2 nvme-tcp data engines.
+var LonghornModules = []string{"iscsi_tcp", "nvme_tcp"}
+
+// LonghornUnits are enabled so iscsiadm works the first time longhorn attaches a volume.
+var LonghornUnits = []string{"iscsid", "open-iscsi"}
+
+// Longhorn covers the node prerequisites longhorn checks for: its kernel modules, iscsid, a multipath blacklist, and
+// its data directory. The packages themselves are in BasePackages.
+func Longhorn(ctx context.Context, chroot ChrootRunner, fs afero.Fs) error {
+	ctx, span := telemetry.Start(ctx, "configure longhorn prerequisites")
+	defer span.End()
+
+	if err := fs.MkdirAll("/etc/modules-load.d", 0755); err != nil {
+		return err
+	}
+	if err := afero.WriteFile(fs, longhornModulesPath, []byte(strings.Join(LonghornModules, "\n")), 0644); err != nil {
+		return err
+	}
+
+	// the packages step masks multipathd by default, it's left enabled from its package once unmasked
+	for _, unit := range DefaultMaskedUnits {
+		if err := unmaskUnit(fs, unit); err != nil {
+			return err
+		}
+	}
+
+	// iscsid's install section pulls in its socket with Also=, so it's enabled through systemctl
+	for _, unit := range LonghornUnits {
+		if err := enableUnit(ctx, chroot, fs, unit); err != nil {
+			return err
+		}
+	}
+
+	if _, err := IdempotentWrite(ctx, fs, bytes.NewBufferString(longhornMultipath), longhornMultipathPath, 0644); err != nil {
+		return err
+	}
+
+	if err := fs.MkdirAll(longhornDataPath, 0700); err != nil {
+		return err
+	}
+	if err := fs.Chmod(longhornDataPath, 0700); err != nil {
+		return err
+	}
+	return fs.Chown(longhornDataPath, 0, 0)
+}
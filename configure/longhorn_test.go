@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// the units are enabled with symlinks, which MemMapFs can't hold
+func longhornFs(t *testing.T) (afero.Fs, string) {
+	root := t.TempDir()
+	fs := afero.NewBasePathFs(afero.NewOsFs(), root)
+	assert.NoError(t, fs.MkdirAll("/lib/systemd/system", 0755))
+	assert.NoError(t, afero.WriteFile(fs, "/lib/systemd/system/iscsid.service",
+		[]byte("[Install]\nWantedBy=multi-user.target\nAlso=iscsid.socket\n"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, "/lib/systemd/system/open-iscsi.service",
+		[]byte("[Install]\nWantedBy=sysinit.target\n"), 0644))
+	return fs, root
+}
+
+func TestLonghornModules(t *testing.T) {
+	fs, _ := longhornFs(t)
+	assert.NoError(t, Longhorn(context.Background(), &recordingChroot{}, fs))
+
+	modules, err := afero.ReadFile(fs, longhornModulesPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "iscsi_tcp\nnvme_tcp", string(modules))
+}
+
+func TestLonghornUnits(t *testing.T) {
+	fs, root := longhornFs(t)
+	chroot := &recordingChroot{}
+	assert.NoError(t, maskUnits(fs, DefaultMaskedUnits))
+	assert.NoError(t, Longhorn(context.Background(), chroot, fs))
+
+	assert.Equal(t, []string{"systemctl enable iscsid"}, chroot.commands)
+	for _, unit := range DefaultMaskedUnits {
+		assert.False(t, unitMasked(fs, unit), unit)
+	}
+	target, linkErr := os.Readlink(filepath.Join(root, "etc/systemd/system/sysinit.target.wants/open-iscsi.service"))
+	assert.NoError(t, linkErr)
+	assert.Equal(t, "/lib/systemd/system/open-iscsi.service", target)
+}
+
+func TestLonghornMultipath(t *testing.T) {
+	fs, _ := longhornFs(t)
+	assert.NoError(t, Longhorn(context.Background(), &recordingChroot{}, fs))
+	// rerunning leaves the blacklist as is
+	assert.NoError(t, Longhorn(context.Background(), &recordingChroot{}, fs))
+
+	multipath, err := afero.ReadFile(fs, longhornMultipathPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "blacklist {\n    devnode \"^sd[a-z0-9]+\"\n}\n", string(multipath))
+}
+
+func TestLonghornDataPath(t *testing.T) {
+	fs, _ := longhornFs(t)
+	assert.NoError(t, Longhorn(context.Background(), &recordingChroot{}, fs))
+
+	info, err := fs.Stat(longhornDataPath)
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(0), stat.Uid)
+	assert.Equal(t, uint32(0), stat.Gid)
+}
+
+func TestLonghornMissingUnit(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.Error(t, Longhorn(context.Background(), &recordingChroot{}, fs))
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+)
+
+const (
+	minimumMTU  = 576
+	maximumMTU  = 9000
+	maximumVLAN = 4094
+)
+
+var interfacePattern = regexp.MustCompile(`^[a-z0-9]{1,12}$`)
+
+// NetworkConfig drives the netplan drop in cloud-init writes on first boot.
+type NetworkConfig struct {
+	Interface string `yaml:"interface"`
+	DHCP4     bool   `yaml:"dhcp4"`
+	DHCP6     bool   `yaml:"dhcp6"`
+	// Addresses are static addresses in CIDR form, IPv4 and IPv6 can be mixed.
+	Addresses   []string `yaml:"addresses"`
+	Gateway4    string   `yaml:"gateway4"`
+	Gateway6    string   `yaml:"gateway6"`
+	Nameservers []string `yaml:"nameservers"`
+	Search      []string `yaml:"search"`
+	// VLAN moves the addressing onto a tagged <interface>.<id> vlan interface when set.
+	VLAN int `yaml:"vlan"`
+	MTU  int `yaml:"mtu"`
+}
+
+func DefaultNetworkConfig() NetworkConfig {
+	return NetworkConfig{
+		Interface:   "eth0",
+		DHCP4:       true,
+		Nameservers: []string{"8.8.8.8"},
+		Search:      []string{"internal.serenacodes.com"},
+	}
+}
+
+func (n NetworkConfig) Validate() error {
+	if !interfacePattern.MatchString(n.Interface) {
+		return fmt.Errorf("invalid interface name: %q", n.Interface)
+	}
+	if !n.DHCP4 && !n.DHCP6 && len(n.Addresses) == 0 {
+		return errors.New("static network config needs at least one address when dhcp is disabled")
+	}
+	for _, address := range n.Addresses {
+		if _, err := netip.ParsePrefix(address); err != nil {
+			return fmt.Errorf("invalid address: %w", err)
+		}
+	}
+	if n.Gateway4 != "" {
+		gateway, err := netip.ParseAddr(n.Gateway4)
+		if err != nil || !gateway.Is4() {
+			return fmt.Errorf("invalid ipv4 gateway: %q", n.Gateway4)
+		}
+	}
+	if n.Gateway6 != "" {
+		gateway, err := netip.ParseAddr(n.Gateway6)
+		if err != nil || !gateway.Is6() {
+			return fmt.Errorf("invalid ipv6 gateway: %q", n.Gateway6)
+		}
+	}
+	for _, nameserver := range n.Nameservers {
+		if _, err := netip.ParseAddr(nameserver); err != nil {
+			return fmt.Errorf("invalid nameserver: %w", err)
+		}
+	}
+	if n.VLAN < 0 || n.VLAN > maximumVLAN {
+		return fmt.Errorf("vlan id must be between 1 and %d, got: %d", maximumVLAN, n.VLAN)
+	}
+	if n.MTU != 0 && (n.MTU < minimumMTU || n.MTU > maximumMTU) {
+		return fmt.Errorf("mtu must be between %d and %d, got: %d", minimumMTU, maximumMTU, n.MTU)
+	}
+	return nil
+}
+
+// renderNetwork renders the netplan drop in, a nil config keeps the default dhcp on eth0 behavior.
+func renderNetwork(ctx context.Context, cfg *NetworkConfig) ([]byte, error) {
+	network := DefaultNetworkConfig()
+	if cfg != nil {
+		network = *cfg
+	}
+
+	if err := network.Validate(); err != nil {
+		return nil, err
+	}
+
+	rendered, renderErr := utility.RenderTemplate(ctx, configFiles, "files/07_network.cfg.yml.template", network)
+	if renderErr != nil {
+		return nil, renderErr
+	}
+
+	if err := validateYAMLDocuments(rendered.Bytes()); err != nil {
+		return nil, fmt.Errorf("rendered network config is invalid: %w", err)
+	}
+
+	return rendered.Bytes(), nil
+}
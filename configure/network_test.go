@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+type netplan struct {
+	Network struct {
+		Ethernets map[string]netplanInterface `yaml:"ethernets"`
+		Vlans     map[string]netplanInterface `yaml:"vlans"`
+		Version   int                         `yaml:"version"`
+	} `yaml:"network"`
+}
+
+type netplanInterface struct {
+	ID        int      `yaml:"id"`
+	Link      string   `yaml:"link"`
+	DHCP4     bool     `yaml:"dhcp4"`
+	MTU       int      `yaml:"mtu"`
+	Addresses []string `yaml:"addresses"`
+	Routes    []struct {
+		To  string `yaml:"to"`
+		Via string `yaml:"via"`
+	} `yaml:"routes"`
+	Nameservers struct {
+		Addresses []string `yaml:"addresses"`
+	} `yaml:"nameservers"`
+}
+
+func TestRenderNetworkDefault(t *testing.T) {
+	rendered, err := renderNetwork(context.Background(), nil)
+	assert.NoError(t, err)
+	var parsed netplan
+	assert.NoError(t, yaml.Unmarshal(rendered, &parsed))
+	assert.Equal(t, 2, parsed.Network.Version)
+	assert.True(t, parsed.Network.Ethernets["eth0"].DHCP4)
+	assert.Empty(t, parsed.Network.Vlans)
+}
+
+func TestRenderNetworkStaticVLAN(t *testing.T) {
+	cfg := NetworkConfig{
+		Interface:   "eth0",
+		Addresses:   []string{"10.0.20.5/24", "fd00:20::5/64"},
+		Gateway4:    "10.0.20.1",
+		Gateway6:    "fd00:20::1",
+		Nameservers: []string{"10.0.20.1"},
+		VLAN:        20,
+		MTU:         1500,
+	}
+	rendered, err := renderNetwork(context.Background(), &cfg)
+	assert.NoError(t, err)
+	var parsed netplan
+	assert.NoError(t, yaml.Unmarshal(rendered, &parsed))
+	assert.False(t, parsed.Network.Ethernets["eth0"].DHCP4)
+	vlan := parsed.Network.Vlans["eth0.20"]
+	assert.Equal(t, 20, vlan.ID)
+	assert.Equal(t, "eth0", vlan.Link)
+	assert.Equal(t, 1500, vlan.MTU)
+	assert.Equal(t, cfg.Addresses, vlan.Addresses)
+	assert.Len(t, vlan.Routes, 2)
+	assert.Equal(t, "10.0.20.1", vlan.Routes[0].Via)
+	assert.Equal(t, []string{"10.0.20.1"}, vlan.Nameservers.Addresses)
+}
+
+func TestNetworkValidate(t *testing.T) {
+	cases := []NetworkConfig{
+		{Interface: "eth0"},
+		{Interface: "eth0", Addresses: []string{"10.0.0.5"}},
+		{Interface: "eth0", Addresses: []string{"10.0.0.5/24"}, Gateway4: "fd00::1"},
+		{Interface: "eth0", DHCP4: true, Nameservers: []string{"dns.google"}},
+		{Interface: "eth0", DHCP4: true, VLAN: 5000},
+		{Interface: "eth0", DHCP4: true, MTU: 100},
+		{Interface: "eth0; rm", DHCP4: true},
+	}
+	for index, cfg := range cases {
+		assert.Error(t, cfg.Validate(), "case %d", index)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const (
+	nodeExporterUser   = "node_exporter"
+	nodeExporterBinary = "/usr/local/bin/node_exporter"
+)
+
+var collectorPattern = regexp.MustCompile(`^[a-z0-9_.]+$`)
+
+// nodeExporterReleaseURL is where node_exporter release tarballs and their sha256sums.txt are published.
+var nodeExporterReleaseURL = "https://github.com/prometheus/node_exporter/releases/download"
+
+// NodeExporterConfig runs prometheus' node_exporter on every node.
+type NodeExporterConfig struct {
+	// Disabled skips the step for fleets monitored some other way.
+	Disabled bool   `yaml:"disabled"`
+	Version  string `yaml:"version"`
+	// ListenAddress defaults to :9100, open its port with firewall.allowTCP when the firewall is enabled.
+	ListenAddress string `yaml:"listenAddress"`
+	// Collectors are enabled on top of node_exporter's defaults.
+	Collectors []string `yaml:"collectors"`
+}
+
+func (n NodeExporterConfig) withDefaults() NodeExporterConfig {
+	if n.Version == "" {
+		n.Version = "v1.7.0"
+	}
+	if n.ListenAddress == "" {
+		n.ListenAddress = ":9100"
+	}
+	if n.Collectors == nil {
+		n.Collectors = []string{"systemd", "processes"}
+	}
+	return n
+}
+
+func (n NodeExporterConfig) Validate() error {
+	if !releaseVersionPattern.MatchString(n.Version) {
+		return fmt.Errorf("invalid node_exporter version: %q, expected vX.Y.Z", n.Version)
+	}
+	if _, _, err := net.SplitHostPort(n.ListenAddress); err != nil {
+		return fmt.Errorf("invalid node_exporter listen address %q: %w", n.ListenAddress, err)
+	}
+	for _, collector := range n.Collectors {
+		if !collectorPattern.MatchString(collector) {
+			return fmt.Errorf("invalid node_exporter collector: %q", collector)
+		}
+	}
+	return nil
+}
+
+// NodeExporterUnit is what the systemd unit template is rendered with.
+type NodeExporterUnit struct {
+	User          string
+	Binary        string
+	ListenAddress string
+	Collectors    []string
+}
+
+func nodeExporterArtifact(version string) Artifact {
+	release := strings.TrimPrefix(version, "v")
+	name := fmt.Sprintf("node_exporter-%s.linux-%s.tar.gz", release, kubernetesArch)
+	base := fmt.Sprintf("%s/%s", nodeExporterReleaseURL, version)
+	return Artifact{Name: name, URL: base + "/" + name, ChecksumURL: base + "/sha256sums.txt", Version: version}
+}
+
+// NodeExporterArtifacts are everything NodeExporter downloads for cfg.
+func NodeExporterArtifacts(cfg NodeExporterConfig) []Artifact {
+	if cfg.Disabled {
+		return nil
+	}
+	return []Artifact{nodeExporterArtifact(cfg.withDefaults().Version)}
+}
+
+// NodeExporter installs node_exporter from its verified release tarball and runs it as an unprivileged system user.
+func NodeExporter(ctx context.Context, chroot ChrootRunner, fs afero.Fs, cfg NodeExporterConfig) error {
+	if cfg.Disabled {
+		return nil
+	}
+
+	ctx, span := telemetry.Start(ctx, "install node exporter")
+	defer span.End()
+
+	cfg = cfg.withDefaults()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	if err := installNodeExporter(ctx, fs, cfg.Version); err != nil {
+		return err
+	}
+
+	if err := addSystemUser(ctx, chroot, fs, nodeExporterUser); err != nil {
+		return err
+	}
+
+	unit, renderErr := renderNodeExporterUnit(ctx, cfg)
+	if renderErr != nil {
+		return renderErr
+	}
+	if err := fs.MkdirAll("/etc/systemd/system", 0755); err != nil {
+		return err
+	}
+	if _, err := IdempotentWrite(ctx, fs, strings.NewReader(unit), "/etc/systemd/system/node_exporter.service", 0644); err != nil {
+		return err
+	}
+
+	return enableUnit(ctx, chroot, fs, "node_exporter")
+}
+
+func renderNodeExporterUnit(ctx context.Context, cfg NodeExporterConfig) (string, error) {
+	unit, err := utility.RenderTemplate(ctx, configFiles, "files/node_exporter.service.template", NodeExporterUnit{
+		User:          nodeExporterUser,
+		Binary:        nodeExporterBinary,
+		ListenAddress: cfg.ListenAddress,
+		Collectors:    cfg.Collectors,
+	})
+	return unit.String(), err
+}
+
+func installNodeExporter(ctx context.Context, fs afero.Fs, version string) error {
+	tempDir, tempErr := afero.TempDir(hostFs, "", "node-exporter-")
+	if tempErr != nil {
+		return tempErr
+	}
+	defer func() {
+		_ = hostFs.RemoveAll(tempDir)
+	}()
+
+	artifact := nodeExporterArtifact(version)
+	if err := FetchArtifacts(ctx, hostFs, tempDir, []Artifact{artifact}); err != nil {
+		return err
+	}
+
+	unpacked := afero.NewMemMapFs()
+	if err := extractArtifact(ctx, unpacked, tempDir, artifact); err != nil {
+		return err
+	}
+	release := strings.TrimSuffix(artifact.Name, ".tar.gz")
+	binary, openErr := unpacked.Open(path.Join("/", release, "node_exporter"))
+	if openErr != nil {
+		return fmt.Errorf("node_exporter tarball has no node_exporter binary: %w", openErr)
+	}
+	defer utility.WrappedClose(binary)
+
+	if err := fs.MkdirAll(path.Dir(nodeExporterBinary), 0755); err != nil {
+		return err
+	}
+	_, writeErr := IdempotentWrite(ctx, fs, binary, nodeExporterBinary, 0755)
+	return writeErr
+}
+
+// addSystemUser creates a locked system user and matching group in the image unless one already exists.
+func addSystemUser(ctx context.Context, chroot ChrootRunner, fs afero.Fs, name string) error {
+	exists, lookupErr := userExists(fs, name)
+	if lookupErr != nil || exists {
+		return lookupErr
+	}
+	return chroot.Run(ctx, time.Minute, "useradd", "--system", "--user-group", "--no-create-home",
+		"--home-dir", "/nonexistent", "--shell", "/usr/sbin/nologin", name)
+}
+
+func userExists(fs afero.Fs, name string) (bool, error) {
+	passwd, openErr := fs.Open("/etc/passwd")
+	if errors.Is(openErr, os.ErrNotExist) {
+		return false, nil
+	}
+	if openErr != nil {
+		return false, openErr
+	}
+	defer utility.WrappedClose(passwd)
+
+	scanner := bufio.NewScanner(passwd)
+	for scanner.Scan() {
+		if user, _, _ := strings.Cut(scanner.Text(), ":"); user == name {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"archive/tar"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeExporterUnitGolden(t *testing.T) {
+	unit, err := renderNodeExporterUnit(context.Background(), NodeExporterConfig{}.withDefaults())
+	assert.NoError(t, err)
+
+	if *updateGolden {
+		assert.NoError(t, os.WriteFile("testdata/node_exporter.service.golden", []byte(unit), 0644))
+	}
+	golden, goldenErr := os.ReadFile("testdata/node_exporter.service.golden")
+	assert.NoError(t, goldenErr)
+	assert.Equal(t, string(golden), unit)
+}
+
+func TestNodeExporterConfigValidate(t *testing.T) {
+	assert.NoError(t, NodeExporterConfig{}.withDefaults().Validate())
+	for _, cfg := range []NodeExporterConfig{
+		{Version: "1.7.0", ListenAddress: ":9100"},
+		{Version: "v1.7.0", ListenAddress: "9100"},
+		{Version: "v1.7.0", ListenAddress: ":9100", Collectors: []string{"systemd --web.disable-exporter-metrics"}},
+	} {
+		assert.Error(t, cfg.Validate(), cfg)
+	}
+}
+
+func nodeExporterServer(t *testing.T) {
+	archive := string(tarball(t,
+		tarEntry{header: tar.Header{Name: "node_exporter-1.7.0.linux-arm64/", Typeflag: tar.TypeDir, Mode: 0755}},
+		tarEntry{header: tar.Header{Name: "node_exporter-1.7.0.linux-arm64/node_exporter", Typeflag: tar.TypeReg, Mode: 0755}, body: "node exporter binary"},
+		tarEntry{header: tar.Header{Name: "node_exporter-1.7.0.linux-arm64/NOTICE", Typeflag: tar.TypeReg, Mode: 0644}, body: "notice"},
+	))
+	sums := sha256Hex("amd64 build") + "  node_exporter-1.7.0.linux-amd64.tar.gz\n" +
+		sha256Hex(archive) + "  node_exporter-1.7.0.linux-arm64.tar.gz\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.7.0/node_exporter-1.7.0.linux-arm64.tar.gz":
+			_, _ = w.Write([]byte(archive))
+		case "/v1.7.0/sha256sums.txt":
+			_, _ = w.Write([]byte(sums))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	previous := nodeExporterReleaseURL
+	nodeExporterReleaseURL = server.URL
+	t.Cleanup(func() { nodeExporterReleaseURL = previous })
+}
+
+// the unit is enabled with a symlink, which MemMapFs can't hold
+func TestNodeExporter(t *testing.T) {
+	nodeExporterServer(t)
+	root := t.TempDir()
+	fs := afero.NewBasePathFs(afero.NewOsFs(), root)
+	assert.NoError(t, fs.MkdirAll("/etc", 0755))
+	assert.NoError(t, afero.WriteFile(fs, "/etc/passwd", []byte("root:x:0:0:root:/root:/bin/bash\n"), 0644))
+	chroot := &recordingChroot{}
+	assert.NoError(t, NodeExporter(context.Background(), chroot, fs, NodeExporterConfig{}))
+
+	binary, err := afero.ReadFile(fs, "/usr/local/bin/node_exporter")
+	assert.NoError(t, err)
+	assert.Equal(t, "node exporter binary", string(binary))
+	unit, unitErr := afero.ReadFile(fs, "/etc/systemd/system/node_exporter.service")
+	assert.NoError(t, unitErr)
+	assert.Contains(t, string(unit), "--web.listen-address=:9100 --collector.systemd --collector.processes")
+	target, linkErr := os.Readlink(filepath.Join(root, "etc/systemd/system/multi-user.target.wants/node_exporter.service"))
+	assert.NoError(t, linkErr)
+	assert.Equal(t, "/etc/systemd/system/node_exporter.service", target)
+	assert.Equal(t, []string{
+		"useradd --system --user-group --no-create-home --home-dir /nonexistent --shell /usr/sbin/nologin node_exporter",
+	}, chroot.commands)
+
+	// rerunning doesn't try to add the user again
+	assert.NoError(t, afero.WriteFile(fs, "/etc/passwd", []byte("node_exporter:x:999:999::/nonexistent:/usr/sbin/nologin\n"), 0644))
+	rerun := &recordingChroot{}
+	assert.NoError(t, NodeExporter(context.Background(), rerun, fs, NodeExporterConfig{}))
+	assert.Empty(t, rerun.commands)
+}
+
+func TestNodeExporterDisabled(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	chroot := &recordingChroot{}
+	assert.NoError(t, NodeExporter(context.Background(), chroot, fs, NodeExporterConfig{Disabled: true}))
+	assert.Empty(t, chroot.commands)
+	assert.Empty(t, NodeExporterArtifacts(NodeExporterConfig{Disabled: true}))
+	exists, _ := afero.Exists(fs, "/usr/local/bin/node_exporter")
+	assert.False(t, exists)
+}
+
+func TestNodeExporterUnlistedChecksum(t *testing.T) {
+	nodeExporterServer(t)
+	err := NodeExporter(context.Background(), &recordingChroot{}, afero.NewMemMapFs(), NodeExporterConfig{Version: "v1.6.1"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// overlayFS serves files/<name> from overrides when it has a regular file called name, and everything else, including
+// directory listings, from base.
+type overlayFS struct {
+	overrides fs.FS
+	base      fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if relative, found := strings.CutPrefix(name, "files/"); found {
+		info, err := fs.Stat(o.overrides, relative)
+		if err == nil && info.Mode().IsRegular() {
+			return o.overrides.Open(relative)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return o.base.Open(name)
+}
+
+// UseOverrides makes files in overrides win over the embedded files with the same name, the directory mirrors files/.
+// Overrides that don't match an embedded file would never be read, they're returned so typos can be reported.
+func UseOverrides(overrides fs.FS) ([]string, error) {
+	embedded := map[string]bool{}
+	entries, readErr := fs.ReadDir(embeddedConfigFiles, "files")
+	if readErr != nil {
+		return nil, readErr
+	}
+	for _, entry := range entries {
+		embedded[entry.Name()] = true
+	}
+
+	var unknown []string
+	walkErr := fs.WalkDir(overrides, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		if path.Dir(name) != "." || !embedded[name] {
+			unknown = append(unknown, name)
+		}
+		return nil
+	})
+	if walkErr != nil {
+		return nil, walkErr
+	}
+	sort.Strings(unknown)
+
+	configFiles = overlayFS{overrides: overrides, base: embeddedConfigFiles}
+	return unknown, nil
+}
+
+// OverrideHashes are the sha256 sums of the overrides UseOverrides layered over embedded files, keyed by file name.
+// The layer cache key includes them since the cached steps render some of those files, nil without overrides.
+func OverrideHashes() (map[string]string, error) {
+	overlay, ok := configFiles.(overlayFS)
+	if !ok {
+		return nil, nil
+	}
+	entries, readErr := fs.ReadDir(embeddedConfigFiles, "files")
+	if readErr != nil {
+		return nil, readErr
+	}
+	hashes := map[string]string{}
+	for _, entry := range entries {
+		info, statErr := fs.Stat(overlay.overrides, entry.Name())
+		if errors.Is(statErr, fs.ErrNotExist) || (statErr == nil && !info.Mode().IsRegular()) {
+			continue
+		}
+		if statErr != nil {
+			return nil, statErr
+		}
+		contents, contentsErr := fs.ReadFile(overlay.overrides, entry.Name())
+		if contentsErr != nil {
+			return nil, contentsErr
+		}
+		sum := sha256.Sum256(contents)
+		hashes[entry.Name()] = hex.EncodeToString(sum[:])
+	}
+	return hashes, nil
+}
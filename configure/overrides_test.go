@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"io"
+	"testing"
+	"testing/fstest"
+
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/stretchr/testify/assert"
+)
+
+func useOverrides(t *testing.T, overrides fstest.MapFS) []string {
+	t.Cleanup(func() { configFiles = embeddedConfigFiles })
+	unknown, err := UseOverrides(overrides)
+	assert.NoError(t, err)
+	return unknown
+}
+
+func TestUseOverrides(t *testing.T) {
+	unknown := useOverrides(t, fstest.MapFS{
+		"promisc.sh":                      {Data: []byte("#!/bin/sh\nip link set eth1 promisc on\n")},
+		"containerd-config.toml.template": {Data: []byte("version = 2\n# systemd: {{.SystemdCgroup}}\n")},
+	})
+	assert.Empty(t, unknown)
+
+	promisc, openErr := configFiles.Open("files/promisc.sh")
+	assert.NoError(t, openErr)
+	contents, readErr := io.ReadAll(promisc)
+	assert.NoError(t, readErr)
+	assert.Equal(t, "#!/bin/sh\nip link set eth1 promisc on\n", string(contents))
+
+	rendered, renderErr := utility.RenderTemplate(context.Background(), configFiles, "files/containerd-config.toml.template", CgroupUnified)
+	assert.NoError(t, renderErr)
+	assert.Equal(t, "version = 2\n# systemd: true\n", rendered.String())
+
+	// everything else still comes from the embed
+	unit, unitErr := configFiles.Open("files/set-hostname.service")
+	assert.NoError(t, unitErr)
+	assert.NoError(t, unit.Close())
+}
+
+func TestUseOverridesUnknownFiles(t *testing.T) {
+	unknown := useOverrides(t, fstest.MapFS{
+		"promsic.sh":               {Data: []byte("typo")},
+		"cloud/06_user.cfg.yml":    {Data: []byte("nested")},
+		"kubelet.service.template": {Data: []byte("[Unit]\n[Service]\n[Install]\n")},
+	})
+	assert.Equal(t, []string{"cloud/06_user.cfg.yml", "promsic.sh"}, unknown)
+}
+
+func TestOverrideHashes(t *testing.T) {
+	hashes, err := OverrideHashes()
+	assert.NoError(t, err)
+	assert.Nil(t, hashes)
+
+	useOverrides(t, fstest.MapFS{
+		"containerd-config.toml.template": {Data: []byte("version = 2\n")},
+		"promsic.sh":                      {Data: []byte("typo")},
+	})
+	hashes, err = OverrideHashes()
+	assert.NoError(t, err)
+	// sha256 of "version = 2\n", the typo is never read so it isn't part of the key
+	assert.Equal(t, map[string]string{"containerd-config.toml.template": "436f6de28726501973ddd9fb91fa92c6ec6225e5c28d8fbdb698dc1720e43714"}, hashes)
+}
+
+func TestValidateFilesCoversOverrides(t *testing.T) {
+	useOverrides(t, fstest.MapFS{
+		"kubelet.service.template": {Data: []byte("[Service]\nExecStart={{.KubeletPath}}\n")},
+		"09_hostname.cfg.yml":      {Data: []byte("preserve_hostname: [\n")},
+	})
+	err := ValidateFiles(context.Background(), nil, partition.DefaultVolumeLayout())
+	assert.ErrorContains(t, err, "kubelet.service.template: missing sections [Unit], [Install]")
+	assert.ErrorContains(t, err, "09_hostname.cfg.yml")
+}
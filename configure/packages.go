@@ -17,23 +17,23 @@
 package configure
 
 import (
-	"archive/tar"
+	"bufio"
 	"bytes"
-	"compress/gzip"
 	"context"
-	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"log/slog"
 	"os"
-	"os/exec"
 	"path"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/LadySerena/pi-image-builder/distro"
+	"github.com/LadySerena/pi-image-builder/manifest"
 	"github.com/LadySerena/pi-image-builder/telemetry"
 	"github.com/LadySerena/pi-image-builder/utility"
 	"github.com/spf13/afero"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 type Deb822Repo struct {
@@ -44,17 +44,41 @@ type Deb822Repo struct {
 	Arch       string
 }
 
-const (
-	mount = "./mnt"
-)
-
-type ErrStatusCode struct {
-	expectedCode int
-	statusCode   int
+// BasePackages are installed with --no-install-recommends before the docker repo is added.
+var BasePackages = []string{
+	"openssh-server",
+	"ca-certificates",
+	"curl",
+	"lsb-release",
+	"wget",
+	"gnupg",
+	"sudo",
+	"lm-sensors",
+	"perl",
+	"htop",
+	"apt-transport-https",
+	"nftables",
+	"conntrack",
+	"lvm2",
+	"bash",
+	"util-linux", // findmnt blkid and lsblk for longhorn
+	"grep",
+	"open-iscsi",
+	"nfs-common", // longhorn's rwx volumes are nfs exports
 }
 
-func NewErrStatusCode(expectedCode int, statusCode int) *ErrStatusCode {
-	return &ErrStatusCode{expectedCode: expectedCode, statusCode: statusCode}
+// ContainerdPackage is installed from DockerRepo.
+const ContainerdPackage = "containerd.io"
+
+// DockerRepo is where ContainerdPackage comes from on d.
+func DockerRepo(d distro.Distro) Deb822Repo {
+	return Deb822Repo{
+		Types:      "deb",
+		URIs:       d.DockerURI,
+		Suites:     d.DockerSuite,
+		Components: "stable",
+		Arch:       "arm64",
+	}
 }
 
 type KubernetesDownload struct {
@@ -64,7 +88,9 @@ type KubernetesDownload struct {
 }
 
 type KubernetesSystemd struct {
-	KubeletPath string
+	KubeletPath  string
+	ConfigPath   string
+	CgroupDriver string
 }
 
 func NewKubernetesDownload(name string, version string, arch string) *KubernetesDownload {
@@ -72,354 +98,444 @@ func NewKubernetesDownload(name string, version string, arch string) *Kubernetes
 }
 
 func (d KubernetesDownload) URL() string {
-	return fmt.Sprintf("https://storage.googleapis.com/kubernetes-release/release/%s/bin/linux/%s/%s", d.version, d.arch, d.name)
+	return fmt.Sprintf("%s/%s/bin/linux/%s/%s", kubernetesReleaseURL, d.version, d.arch, d.name)
 }
 
-func (e ErrStatusCode) Error() string {
-	return fmt.Sprintf("expected http code: %d, got %d instead", e.expectedCode, e.statusCode)
-}
+// dpkgQueryFormat prints one tab separated line per package dpkg knows about.
+const dpkgQueryFormat = "${Package}\t${Version}\t${Architecture}\t${db:Status-Status}\n"
 
-func NspawnCommand(ctx context.Context, mount string, timeout time.Duration, args ...string) (*exec.Cmd, context.CancelFunc) {
-	ctx, cancel := context.WithTimeout(ctx, timeout)
-	prepend := append([]string{"--setenv=DEBIAN_FRONTEND=noninteractive", "-D", mount}, args...)
-	command := exec.CommandContext(ctx, "systemd-nspawn", prepend...)
-	return command, cancel
+// PackageSpec is a package to install, pinned to Version when it's set.
+type PackageSpec struct {
+	Name    string
+	Version string
 }
 
-func Packages(ctx context.Context, fs afero.Fs) error {
+// String is the apt-get install argument for the package.
+func (p PackageSpec) String() string {
+	if p.Version == "" {
+		return p.Name
+	}
+	return p.Name + "=" + p.Version
+}
 
-	ctx, span := telemetry.GetTracer().Start(ctx, "install packages")
-	defer span.End()
+// PackagePins replays the package versions a previous build recorded in its manifest. The zero value pins nothing
+// and packages install at whatever version the archive has.
+type PackagePins struct {
+	Versions map[string]string
+	// Strict fails the build when a pinned version has left the archive instead of installing the current one.
+	Strict bool
+}
 
-	basePackages := []string{
-		"openssh-server",
-		"ca-certificates",
-		"curl",
-		"lsb-release",
-		"wget",
-		"gnupg",
-		"sudo",
-		"lm-sensors",
-		"perl",
-		"htop",
-		"apt-transport-https",
-		"nftables",
-		"conntrack",
-		"lvm2",
-		"bash",
-		"util-linux", // findmnt blkid and lsblk for longhorn
-		"grep",
-		"open-iscsi",
-	}
-
-	update, updateCancel := NspawnCommand(ctx, mount, 5*time.Minute, "apt-get", "update")
-	if err := utility.RunCommandWithOutput(ctx, update, updateCancel); err != nil {
-		return err
+// NewPackagePins pins every package in packages.
+func NewPackagePins(packages []manifest.Package, strict bool) PackagePins {
+	versions := make(map[string]string, len(packages))
+	for _, pkg := range packages {
+		versions[pkg.Name] = pkg.Version
 	}
+	return PackagePins{Versions: versions, Strict: strict}
+}
 
-	uninstall, uninstallCancel := NspawnCommand(ctx, mount, 20*time.Minute, "apt-get", "purge", "-y", "snapd")
-	if err := utility.RunCommandWithOutput(ctx, uninstall, uninstallCancel); err != nil {
-		return err
-	}
+// Enabled reports whether any package is pinned.
+func (p PackagePins) Enabled() bool {
+	return len(p.Versions) != 0
+}
 
-	install, installCancel := NspawnCommand(ctx, mount, 20*time.Minute, append([]string{"apt-get", "install", "--no-install-recommends", "-y"}, basePackages...)...)
-	if err := utility.RunCommandWithOutput(ctx, install, installCancel); err != nil {
-		return err
+// Resolve turns names into the specs to install. Pinned packages are checked against the archive first, a version
+// that's no longer available is an error with Strict set and otherwise installs unpinned with a warning.
+func (p PackagePins) Resolve(ctx context.Context, chroot ChrootRunner, names []string) ([]PackageSpec, error) {
+	specs := make([]PackageSpec, 0, len(names))
+	pinned := make([]string, 0, len(names))
+	for _, name := range names {
+		if _, ok := p.Versions[name]; ok {
+			pinned = append(pinned, name)
+		}
 	}
-
-	response, dockerKeyErr := otelhttp.Get(ctx, "https://download.docker.com/linux/ubuntu/gpg")
-	if dockerKeyErr != nil {
-		return dockerKeyErr
+	if len(pinned) == 0 {
+		for _, name := range names {
+			specs = append(specs, PackageSpec{Name: name})
+		}
+		return specs, nil
 	}
-	defer utility.WrappedClose(response.Body)
 
-	if err := IdempotentWrite(ctx, fs, response.Body, "/etc/apt/trusted.gpg.d/docker.asc", 0644); err != nil {
-		return err
+	output, madisonErr := chroot.Output(ctx, 5*time.Minute, append([]string{"apt-cache", "madison"}, pinned...)...)
+	if madisonErr != nil {
+		return nil, fmt.Errorf("could not list available package versions: %w", madisonErr)
 	}
+	available := parseMadison(output)
 
-	dockerRepo := Deb822Repo{
-		Types:      "deb",
-		URIs:       "https://download.docker.com/linux/ubuntu",
-		Suites:     "focal",
-		Components: "stable",
-		Arch:       "arm64",
+	missing := make([]string, 0)
+	for _, name := range names {
+		version, ok := p.Versions[name]
+		if !ok {
+			specs = append(specs, PackageSpec{Name: name})
+			continue
+		}
+		if available[name][version] {
+			specs = append(specs, PackageSpec{Name: name, Version: version})
+			continue
+		}
+		if p.Strict {
+			missing = append(missing, name+"="+version)
+			continue
+		}
+		slog.WarnContext(ctx, "pinned package version is no longer in the archive, installing the current version", "package", name, "version", version)
+		specs = append(specs, PackageSpec{Name: name})
 	}
-
-	dockerSources, dockerErr := utility.RenderTemplate(ctx, configFiles, "files/Deb822.template", dockerRepo)
-	if dockerErr != nil {
-		return dockerErr
+	if len(missing) != 0 {
+		return nil, fmt.Errorf("pinned package versions are no longer in the archive: %s", strings.Join(missing, ", "))
 	}
+	return specs, nil
+}
 
-	if err := IdempotentWrite(ctx, fs, &dockerSources, "/etc/apt/sources.list.d/docker.sources", 0644); err != nil {
-		return err
+// parseMadison collects the versions apt-cache madison lists for each package, its lines look like
+// "openssh-server | 1:8.9p1-3ubuntu0.6 | http://ports.ubuntu.com/ubuntu-ports jammy-updates/main arm64 Packages".
+func parseMadison(output []byte) map[string]map[string]bool {
+	available := make(map[string]map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "|")
+		if len(fields) < 2 {
+			continue
+		}
+		name, version := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])
+		if available[name] == nil {
+			available[name] = make(map[string]bool)
+		}
+		available[name][version] = true
 	}
+	return available
+}
 
-	preDockerUpdate, dockerUpdateCancel := NspawnCommand(ctx, mount, 5*time.Minute, "apt-get", "update")
-
-	if err := utility.RunCommandWithOutput(ctx, preDockerUpdate, dockerUpdateCancel); err != nil {
-		return err
+// InstalledPackages asks dpkg inside the image which packages are installed and at what version, sorted by name.
+func InstalledPackages(ctx context.Context, chroot ChrootRunner) ([]manifest.Package, error) {
+	output, err := chroot.Output(ctx, time.Minute, "dpkg-query", "-W", "-f="+dpkgQueryFormat)
+	if err != nil {
+		return nil, fmt.Errorf("could not query installed packages: %w", err)
+	}
+	packages := make([]manifest.Package, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		// removed packages whose config files are still around are listed too
+		if len(fields) != 4 || fields[3] != "installed" {
+			continue
+		}
+		packages = append(packages, manifest.Package{Name: fields[0], Version: fields[1], Architecture: fields[2]})
 	}
-	// todo feature flag this
-	upgrade, upgradeCancel := NspawnCommand(ctx, mount, 20*time.Minute, "apt-get", "upgrade", "-y")
+	sort.Slice(packages, func(i, j int) bool { return packages[i].Name < packages[j].Name })
+	return packages, scanner.Err()
+}
 
-	if err := utility.RunCommandWithOutput(ctx, upgrade, upgradeCancel); err != nil {
-		return err
+// installArgs is the apt-get install command for specs. Pinned versions can be older than what the base image
+// shipped, so downgrades are allowed once anything is pinned.
+func installArgs(specs []PackageSpec, flags ...string) []string {
+	args := append([]string{"apt-get", "install"}, flags...)
+	for _, spec := range specs {
+		if spec.Version != "" {
+			args = append(args, "--allow-downgrades")
+			break
+		}
 	}
-
-	dockerInstall, dockerCancel := NspawnCommand(ctx, mount, 20*time.Minute, "apt-get", "install", "-y", "containerd.io")
-
-	if err := utility.RunCommandWithOutput(ctx, dockerInstall, dockerCancel); err != nil {
-		return err
+	args = append(args, "-y")
+	for _, spec := range specs {
+		args = append(args, spec.String())
 	}
+	return args
+}
 
-	containerdConfig, containerdErr := configFiles.ReadFile("files/containerd-config.toml")
-	if containerdErr != nil {
-		return containerdErr
-	}
+// PackageSet is what the packages step installs on top of BasePackages.
+type PackageSet struct {
+	// Extra are installed alongside BasePackages.
+	Extra []string
+	// Containerd adds DockerRepo and installs ContainerdPackage, images without kubernetes leave it out.
+	Containerd bool
+	// Kernel pins and holds the kernel packages, the zero value leaves them to apt.
+	Kernel KernelPin
+	// Removal is purged before anything is installed, its units are masked once everything is.
+	Removal RemovalConfig
+}
 
-	if err := afero.WriteFile(fs, "/etc/containerd/config.toml", containerdConfig, 0644); err != nil {
-		return err
+// Required are the packages the set installs by name, they all have to survive the rest of the build.
+func (s PackageSet) Required() []string {
+	required := append(append([]string(nil), BasePackages...), s.Extra...)
+	if s.Containerd {
+		required = append(required, ContainerdPackage)
 	}
-
-	return nil
+	return required
 }
 
-func InstallKubernetes(ctx context.Context, fs afero.Fs, kubernetesVersion string, criCtlVersion string, cniVersion string) error {
+// Packages installs BasePackages, the set's extras, and containerd configured for the cgroup mode's driver. With pins
+// enabled the upgrade is replaced by reinstalling every installed package at its pinned version, so the image matches
+// the build the pins came from. A kernel pin is installed last and wins over both.
+func Packages(ctx context.Context, chroot ChrootRunner, fs afero.Fs, d distro.Distro, cgroup CgroupMode, set PackageSet, pins PackagePins) error {
 
-	ctx, span := telemetry.GetTracer().Start(ctx, "install kubernetes")
+	ctx, span := telemetry.Start(ctx, "install packages")
 	defer span.End()
 
-	const arch = "arm64"
-	const cniDir = "/opt/cni/bin/"
-	const downloadDir = "/usr/local/bin/"
-
-	if err := fs.MkdirAll(cniDir, 0775); err != nil {
+	if err := writeKernelPreferences(ctx, fs, set.Kernel); err != nil {
 		return err
 	}
 
-	if err := fs.MkdirAll(downloadDir, 0755); err != nil {
+	if err := chroot.Run(ctx, 5*time.Minute, "apt-get", "update"); err != nil {
 		return err
 	}
 
-	cniDownload, cniDownloadErr := otelhttp.Get(ctx, fmt.Sprintf("https://github.com/containernetworking/plugins/releases/download/%s/cni-plugins-linux-%s-%s.tgz", cniVersion, arch, cniVersion))
-	if cniDownloadErr != nil {
-		return cniDownloadErr
+	if err := set.Removal.Validate(); err != nil {
+		return err
 	}
-	if cniDownload.StatusCode != http.StatusOK {
-		return NewErrStatusCode(http.StatusOK, cniDownload.StatusCode)
+	if err := purgePackages(ctx, chroot, set.Removal.Packages()); err != nil {
+		return err
 	}
-	defer cniDownload.Body.Close()
 
-	cniFs := afero.NewBasePathFs(fs, cniDir)
-	if err := ExtractTarGz(ctx, cniFs, cniDownload.Body); err != nil {
+	base, baseErr := pins.Resolve(ctx, chroot, append(append([]string(nil), BasePackages...), set.Extra...))
+	if baseErr != nil {
+		return baseErr
+	}
+	if err := chroot.Stream(ctx, 20*time.Minute, installArgs(base, "--no-install-recommends")...); err != nil {
 		return err
 	}
 
-	criCtlDownload, criCtlDownloadErr := otelhttp.Get(ctx, fmt.Sprintf("https://github.com/kubernetes-sigs/cri-tools/releases/download/%s/crictl-%s-linux-%s.tar.gz", criCtlVersion, criCtlVersion, arch))
-	if criCtlDownloadErr != nil {
-		return criCtlDownloadErr
+	names := make([]string, 0)
+	if set.Containerd {
+		if err := addDockerRepo(ctx, chroot, fs, d); err != nil {
+			return err
+		}
+		names = append(names, ContainerdPackage)
 	}
-	if criCtlDownload.StatusCode != http.StatusOK {
-		return NewErrStatusCode(http.StatusOK, criCtlDownload.StatusCode)
+	if pins.Enabled() {
+		installed, installedErr := InstalledPackages(ctx, chroot)
+		if installedErr != nil {
+			return installedErr
+		}
+		for _, pkg := range installed {
+			if _, ok := pins.Versions[pkg.Name]; ok && pkg.Name != ContainerdPackage {
+				names = append(names, pkg.Name)
+			}
+		}
+	} else {
+		// todo feature flag this
+		if err := chroot.Stream(ctx, 20*time.Minute, "apt-get", "upgrade", "-y"); err != nil {
+			return err
+		}
 	}
-	defer cniDownload.Body.Close()
 
-	kubernetesFs := afero.NewBasePathFs(fs, downloadDir)
+	if len(names) != 0 {
+		resolved, resolveErr := pins.Resolve(ctx, chroot, names)
+		if resolveErr != nil {
+			return resolveErr
+		}
+		if err := chroot.Stream(ctx, 20*time.Minute, installArgs(resolved)...); err != nil {
+			return err
+		}
+	}
+
+	if err := installKernel(ctx, chroot, set.Kernel); err != nil {
+		return err
+	}
 
-	if err := ExtractTarGz(ctx, kubernetesFs, criCtlDownload.Body); err != nil {
+	if err := maskUnits(fs, set.Removal.Units()); err != nil {
 		return err
 	}
 
-	kubeadmDownload, kubeadmErr := otelhttp.Get(ctx, NewKubernetesDownload("kubeadm", kubernetesVersion, arch).URL())
-	if kubeadmErr != nil {
-		return kubeadmErr
+	if !set.Containerd {
+		return nil
 	}
-	if kubeadmDownload.StatusCode != http.StatusOK {
-		return NewErrStatusCode(http.StatusOK, kubeadmDownload.StatusCode)
+
+	containerdConfig, containerdErr := renderContainerdConfig(ctx, cgroup)
+	if containerdErr != nil {
+		return containerdErr
 	}
-	defer kubeadmDownload.Body.Close()
 
-	if err := IdempotentWrite(ctx, kubernetesFs, kubeadmDownload.Body, "kubeadm", 0755); err != nil {
+	if err := afero.WriteFile(fs, "/etc/containerd/config.toml", containerdConfig, 0644); err != nil {
 		return err
 	}
 
-	kubeletDownload, kubeletErr := otelhttp.Get(ctx, NewKubernetesDownload("kubelet", kubernetesVersion, arch).URL())
-	if kubeletErr != nil {
-		return kubeletErr
-	}
-	if kubeletDownload.StatusCode != http.StatusOK {
-		return NewErrStatusCode(http.StatusOK, kubeletDownload.StatusCode)
+	return nil
+}
+
+// addDockerRepo trusts docker's signing key and adds DockerRepo to the image's apt sources.
+func addDockerRepo(ctx context.Context, chroot ChrootRunner, fs afero.Fs, d distro.Distro) error {
+	response, dockerKeyErr := get(ctx, d.DockerKeyURL())
+	if dockerKeyErr != nil {
+		return dockerKeyErr
 	}
-	defer kubeletDownload.Body.Close()
+	defer utility.WrappedClose(response.Body)
 
-	if err := IdempotentWrite(ctx, kubernetesFs, kubeletDownload.Body, "kubelet", 0755); err != nil {
+	if _, err := IdempotentWrite(ctx, fs, response.Body, "/etc/apt/trusted.gpg.d/docker.asc", 0644); err != nil {
 		return err
 	}
 
-	kubectlDownload, kubectlErr := otelhttp.Get(ctx, NewKubernetesDownload("kubectl", kubernetesVersion, arch).URL())
-	if kubectlErr != nil {
-		return kubectlErr
-	}
-	if kubectlDownload.StatusCode != http.StatusOK {
-		return NewErrStatusCode(http.StatusOK, kubectlDownload.StatusCode)
+	dockerSources, dockerErr := utility.RenderTemplate(ctx, configFiles, "files/Deb822.template", DockerRepo(d))
+	if dockerErr != nil {
+		return dockerErr
 	}
-	defer kubectlDownload.Body.Close()
 
-	if err := IdempotentWrite(ctx, kubernetesFs, kubectlDownload.Body, "kubectl", 0755); err != nil {
+	if _, err := IdempotentWrite(ctx, fs, &dockerSources, "/etc/apt/sources.list.d/docker.sources", 0644); err != nil {
 		return err
 	}
 
-	kubeletPath := KubernetesSystemd{KubeletPath: path.Join(downloadDir, "kubelet")}
+	return chroot.Run(ctx, 5*time.Minute, "apt-get", "update")
+}
 
-	systemdUnit, systemdErr := utility.RenderTemplate(ctx, configFiles, "files/kubelet.service.template", kubeletPath)
-	if systemdErr != nil {
-		return systemdErr
+func renderContainerdConfig(ctx context.Context, cgroup CgroupMode) ([]byte, error) {
+	if err := cgroup.Validate(); err != nil {
+		return nil, err
 	}
+	rendered, err := utility.RenderTemplate(ctx, configFiles, "files/containerd-config.toml.template", cgroup)
+	return rendered.Bytes(), err
+}
+
+// InstallKubernetes installs the kubelet and its tooling. Artifacts are fetched into cacheDir on the host, or into a
+// temporary directory when cacheDir is empty, and only installed once every checksum has been verified. The kubelet
+// uses the cgroup mode's driver.
+func InstallKubernetes(ctx context.Context, chroot ChrootRunner, fs afero.Fs, versions KubernetesVersions, cgroup CgroupMode, cacheDir string) error {
 
-	if err := IdempotentWrite(ctx, fs, &systemdUnit, "/etc/systemd/system/kubelet.service", 0644); err != nil {
+	ctx, span := telemetry.Start(ctx, "install kubernetes")
+	defer span.End()
+	span.SetAttributes(telemetry.KubernetesVersionKey.String(versions.Kubernetes))
+
+	if err := versions.Validate(); err != nil {
 		return err
 	}
-
-	if err := fs.MkdirAll("/etc/systemd/system/kubelet.service.d", 0755); err != nil {
+	if err := cgroup.Validate(); err != nil {
 		return err
 	}
+	if releaseMarkerPattern.MatchString(versions.Kubernetes) {
+		return fmt.Errorf("kubernetes version %s must be resolved before installing", versions.Kubernetes)
+	}
 
-	dropIn, dropInErr := utility.RenderTemplate(ctx, configFiles, "files/kubeadm-drop-in.template", kubeletPath)
-	if dropInErr != nil {
-		return dropInErr
+	const cniDir = "/opt/cni/bin/"
+	const downloadDir = "/usr/local/bin/"
+
+	if cacheDir == "" {
+		tempDir, tempErr := afero.TempDir(hostFs, "", "kubernetes-artifacts-")
+		if tempErr != nil {
+			return tempErr
+		}
+		defer func() {
+			_ = hostFs.RemoveAll(tempDir)
+		}()
+		cacheDir = tempDir
 	}
 
-	if err := IdempotentWrite(ctx, fs, &dropIn, "/etc/systemd/system/kubelet.service.d/10-kubeadm.conf", 0644); err != nil {
+	if err := FetchArtifacts(ctx, hostFs, cacheDir, KubernetesArtifacts(versions)); err != nil {
 		return err
 	}
 
-	enableKubelet, kubeletCancel := NspawnCommand(ctx, mount, 5*time.Minute, "systemctl", "enable", "kubelet")
-
-	if err := utility.RunCommandWithOutput(ctx, enableKubelet, kubeletCancel); err != nil {
+	if err := fs.MkdirAll(cniDir, 0775); err != nil {
 		return err
 	}
 
-	return nil
-}
-
-func CloudInit(ctx context.Context, fs afero.Fs) error {
-
-	ctx, span := telemetry.GetTracer().Start(ctx, "configure cloudinit")
-	defer span.End()
-
-	cloudInitDropInDir := "/etc/cloud/cloud.cfg.d/"
-	user, userErr := configFiles.Open("files/06_user.cfg.yml")
-	if userErr != nil {
-		return userErr
+	if err := fs.MkdirAll(downloadDir, 0755); err != nil {
+		return err
 	}
 
-	if err := IdempotentWrite(ctx, fs, user, path.Join(cloudInitDropInDir, "06_user.cfg"), 0644); err != nil {
+	cniFs := afero.NewBasePathFs(fs, cniDir)
+	if err := extractArtifact(ctx, cniFs, cacheDir, cniArtifact(versions)); err != nil {
 		return err
 	}
 
-	network, networkErr := configFiles.Open("files/07_network.cfg.yml")
-	if networkErr != nil {
-		return networkErr
+	kubernetesFs := afero.NewBasePathFs(fs, downloadDir)
+	if err := extractArtifact(ctx, kubernetesFs, cacheDir, criCtlArtifact(versions)); err != nil {
+		return err
 	}
 
-	if err := IdempotentWrite(ctx, fs, network, path.Join(cloudInitDropInDir, "07_network.cfg"), 0644); err != nil {
-		return err
+	for _, binary := range []string{"kubeadm", "kubelet", "kubectl"} {
+		if err := installBinary(ctx, kubernetesFs, cacheDir, kubernetesBinary(binary, versions)); err != nil {
+			return err
+		}
 	}
 
-	promisc, promiscErr := configFiles.Open("files/promisc.sh")
-	if promiscErr != nil {
-		return promiscErr
+	kubeletPath := KubernetesSystemd{KubeletPath: path.Join(downloadDir, "kubelet"), ConfigPath: kubeletConfigPath, CgroupDriver: cgroup.Driver()}
+
+	systemdUnit, systemdErr := utility.RenderTemplate(ctx, configFiles, "files/kubelet.service.template", kubeletPath)
+	if systemdErr != nil {
+		return systemdErr
 	}
 
-	if err := IdempotentWrite(ctx, fs, promisc, "/etc/networkd-dispatcher/routable.d/promisc.sh", 0644); err != nil {
+	if err := fs.MkdirAll("/etc/systemd/system/kubelet.service.d", 0755); err != nil {
 		return err
 	}
 
-	return nil
-}
-
-func Fstab(ctx context.Context, fs afero.Fs) error {
-	_, span := telemetry.GetTracer().Start(ctx, "configure fstab entries")
-	defer span.End()
+	if _, err := IdempotentWrite(ctx, fs, &systemdUnit, "/etc/systemd/system/kubelet.service", 0644); err != nil {
+		return err
+	}
 
-	fstab, fstabErr := configFiles.ReadFile("files/fstab")
-	if fstabErr != nil {
-		return fstabErr
+	dropIn, dropInErr := utility.RenderTemplate(ctx, configFiles, "files/kubeadm-drop-in.template", kubeletPath)
+	if dropInErr != nil {
+		return dropInErr
 	}
 
-	if dirErr := fs.MkdirAll("/var/lib/longhorn", 0750); dirErr != nil {
-		return dirErr
+	if _, err := IdempotentWrite(ctx, fs, &dropIn, "/etc/systemd/system/kubelet.service.d/10-kubeadm.conf", 0644); err != nil {
+		return err
 	}
 
-	if dirErr := fs.MkdirAll("/var/lib/containerd", 0750); dirErr != nil {
-		return dirErr
+	if err := enableUnit(ctx, chroot, fs, "kubelet"); err != nil {
+		return err
 	}
 
-	return afero.WriteFile(fs, "/etc/fstab", fstab, 0644)
+	return nil
 }
 
-func ExtractTarGz(ctx context.Context, fs afero.Fs, r io.Reader) error {
+func extractArtifact(ctx context.Context, fs afero.Fs, cacheDir string, artifact Artifact) error {
+	archive, openErr := openArtifact(hostFs, cacheDir, artifact)
+	if openErr != nil {
+		return openErr
+	}
+	defer utility.WrappedClose(archive)
 
-	_, span := telemetry.GetTracer().Start(ctx, "Extract tar.gz")
-	defer span.End()
+	return ExtractTarGz(ctx, fs, archive, DefaultMaxArchiveSize)
+}
 
-	uncompressedStream, gzipErr := gzip.NewReader(r)
-	if gzipErr != nil {
-		return gzipErr
+func installBinary(ctx context.Context, fs afero.Fs, cacheDir string, artifact Artifact) error {
+	binary, openErr := openArtifact(hostFs, cacheDir, artifact)
+	if openErr != nil {
+		return openErr
 	}
-	defer utility.WrappedClose(uncompressedStream)
-	tarReader := tar.NewReader(uncompressedStream)
-	for {
-		header, headerErr := tarReader.Next()
-		if headerErr == io.EOF {
-			break
-		}
-		if headerErr != nil {
-			return headerErr
-		}
-		if header.FileInfo().IsDir() {
-			continue
-		}
-		span.AddEvent(fmt.Sprintf("writing file: %s", header.Name))
-		file, fileErr := fs.OpenFile(header.Name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, header.FileInfo().Mode())
-		if fileErr != nil {
-			return fileErr
-		}
-		if _, err := io.Copy(file, tarReader); err != nil { //nolint:gosec
-			return err
-		}
+	defer utility.WrappedClose(binary)
 
-	}
-	return nil
+	_, writeErr := IdempotentWrite(ctx, fs, binary, artifact.Name, 0755)
+	return writeErr
 }
 
-func IdempotentWrite(ctx context.Context, fs afero.Fs, reader io.Reader, path string, mode os.FileMode) error {
+// IdempotentWrite replaces the contents of path with reader's, leaving the file untouched when they already match,
+// and reports whether it wrote anything. A new file is created with mode, an existing one keeps its mode.
+func IdempotentWrite(ctx context.Context, fs afero.Fs, reader io.Reader, path string, mode os.FileMode) (_ bool, err error) {
 
 	_, span := telemetry.GetTracer().Start(ctx, fmt.Sprintf("writing: %s", path))
 	defer span.End()
 
 	incomingData, readErr := io.ReadAll(reader)
 	if readErr != nil {
-		return readErr
+		return false, readErr
 	}
 	file, fileOpenErr := fs.OpenFile(path, os.O_CREATE|os.O_RDWR, mode)
-	if fileOpenErr != nil && !errors.Is(fileOpenErr, os.ErrExist) {
-		return fileOpenErr
+	if fileOpenErr != nil {
+		return false, fileOpenErr
 	}
-	defer utility.WrappedClose(file)
+	defer utility.CloseWithErr(file, &err)
 
 	currentData, currentErr := io.ReadAll(file)
 	if currentErr != nil {
-		return currentErr
+		return false, currentErr
 	}
 
-	if bytes.Equal(incomingData, currentData) {
-		return nil
+	changed := !bytes.Equal(incomingData, currentData)
+	span.SetAttributes(telemetry.FileChangedKey.Bool(changed))
+	if !changed {
+		return false, nil
 	}
 
+	// the read left the offset at the end, start over so shorter content doesn't leave the old tail behind
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	if err := file.Truncate(0); err != nil {
+		return false, err
+	}
 	if _, err := file.Write(incomingData); err != nil {
-		return err
+		return false, err
 	}
 
-	return nil
+	return true, file.Sync()
 }
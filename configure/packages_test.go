@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/manifest"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotentWrite(t *testing.T) {
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	const path = "/etc/example.conf"
+
+	t.Run("new file", func(t *testing.T) {
+		changed, err := IdempotentWrite(ctx, fs, strings.NewReader("a long first version\n"), path, 0640)
+		assert.NoError(t, err)
+		assert.True(t, changed)
+		contents, readErr := afero.ReadFile(fs, path)
+		assert.NoError(t, readErr)
+		assert.Equal(t, "a long first version\n", string(contents))
+		info, statErr := fs.Stat(path)
+		assert.NoError(t, statErr)
+		assert.Equal(t, "-rw-r-----", info.Mode().String())
+	})
+
+	t.Run("identical content", func(t *testing.T) {
+		changed, err := IdempotentWrite(ctx, fs, strings.NewReader("a long first version\n"), path, 0640)
+		assert.NoError(t, err)
+		assert.False(t, changed)
+	})
+
+	t.Run("shrinking content", func(t *testing.T) {
+		changed, err := IdempotentWrite(ctx, fs, strings.NewReader("short\n"), path, 0640)
+		assert.NoError(t, err)
+		assert.True(t, changed)
+		contents, readErr := afero.ReadFile(fs, path)
+		assert.NoError(t, readErr)
+		assert.Equal(t, "short\n", string(contents))
+	})
+
+	t.Run("empty content", func(t *testing.T) {
+		changed, err := IdempotentWrite(ctx, fs, strings.NewReader(""), path, 0640)
+		assert.NoError(t, err)
+		assert.True(t, changed)
+		contents, readErr := afero.ReadFile(fs, path)
+		assert.NoError(t, readErr)
+		assert.Empty(t, contents)
+	})
+}
+
+func TestInstalledPackages(t *testing.T) {
+	chroot := &recordingChroot{outputs: map[string][]byte{
+		"dpkg-query -W -f=" + dpkgQueryFormat: []byte("openssh-server\t1:8.9p1-3ubuntu0.6\tarm64\tinstalled\n" +
+			"containerd.io\t1.6.28-1\tarm64\tinstalled\n" +
+			"snapd\t2.58+22.04\tarm64\tconfig-files\n"),
+	}}
+	packages, err := InstalledPackages(context.Background(), chroot)
+	assert.NoError(t, err)
+	assert.Equal(t, []manifest.Package{
+		{Name: "containerd.io", Version: "1.6.28-1", Architecture: "arm64"},
+		{Name: "openssh-server", Version: "1:8.9p1-3ubuntu0.6", Architecture: "arm64"},
+	}, packages)
+}
+
+func TestPackagePinsResolve(t *testing.T) {
+	madison := map[string][]byte{
+		"apt-cache madison openssh-server curl": []byte("openssh-server | 1:8.9p1-3ubuntu0.6 | http://ports.ubuntu.com/ubuntu-ports jammy-updates/main arm64 Packages\n" +
+			"openssh-server | 1:8.9p1-3 | http://ports.ubuntu.com/ubuntu-ports jammy/main arm64 Packages\n" +
+			"      curl | 7.81.0-1ubuntu1.16 | http://ports.ubuntu.com/ubuntu-ports jammy-updates/main arm64 Packages\n"),
+	}
+	packages := []manifest.Package{
+		{Name: "openssh-server", Version: "1:8.9p1-3", Architecture: "arm64"},
+		{Name: "curl", Version: "7.81.0-1ubuntu1.15", Architecture: "arm64"},
+	}
+	names := []string{"openssh-server", "curl", "sudo"}
+
+	specs, err := NewPackagePins(packages, false).Resolve(context.Background(), &recordingChroot{outputs: madison}, names)
+	assert.NoError(t, err)
+	assert.Equal(t, []PackageSpec{{Name: "openssh-server", Version: "1:8.9p1-3"}, {Name: "curl"}, {Name: "sudo"}}, specs)
+	assert.Equal(t, []string{"apt-get", "install", "--no-install-recommends", "--allow-downgrades", "-y", "openssh-server=1:8.9p1-3", "curl", "sudo"}, installArgs(specs, "--no-install-recommends"))
+
+	_, strictErr := NewPackagePins(packages, true).Resolve(context.Background(), &recordingChroot{outputs: madison}, names)
+	assert.ErrorContains(t, strictErr, "curl=7.81.0-1ubuntu1.15")
+
+	unpinned := &recordingChroot{}
+	latest, latestErr := PackagePins{}.Resolve(context.Background(), unpinned, names)
+	assert.NoError(t, latestErr)
+	assert.Equal(t, []string{"apt-get", "install", "-y", "openssh-server", "curl", "sudo"}, installArgs(latest))
+	assert.Empty(t, unpinned.commands, "nothing is looked up without pins")
+}
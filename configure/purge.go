@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	// DefaultPurgePackages are removed from the preinstalled image, none of them do anything useful on a node.
+	DefaultPurgePackages = []string{"snapd", "apport", "ubuntu-advantage-tools"}
+	// DefaultMaskedUnits can't be purged without taking packages that depend on them along. multipathd is unmasked
+	// again by the longhorn step.
+	DefaultMaskedUnits = []string{"multipathd.service", "multipathd.socket"}
+
+	debianPackagePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+$`)
+	unitNamePattern      = regexp.MustCompile(`^[a-zA-Z0-9:_.@-]+\.(service|socket|timer|path|mount)$`)
+)
+
+// RemovalConfig trims the preinstalled image. Nil lists keep the defaults, an empty list removes nothing.
+type RemovalConfig struct {
+	Purge []string `yaml:"purge"`
+	// Mask units that need to stay installed for something else but shouldn't run.
+	Mask []string `yaml:"mask"`
+}
+
+// Packages are the packages to purge.
+func (r RemovalConfig) Packages() []string {
+	if r.Purge == nil {
+		return DefaultPurgePackages
+	}
+	return r.Purge
+}
+
+// Units are the units to mask.
+func (r RemovalConfig) Units() []string {
+	if r.Mask == nil {
+		return DefaultMaskedUnits
+	}
+	return r.Mask
+}
+
+func (r RemovalConfig) Validate() error {
+	required := make(map[string]bool)
+	for _, name := range append(append([]string(nil), BasePackages...), ContainerdPackage) {
+		required[name] = true
+	}
+	for _, name := range r.Packages() {
+		if !debianPackagePattern.MatchString(name) {
+			return fmt.Errorf("invalid package name to purge: %q", name)
+		}
+		if required[name] {
+			return fmt.Errorf("package %s can not be purged, the image needs it", name)
+		}
+	}
+	for _, unit := range r.Units() {
+		if !unitNamePattern.MatchString(unit) {
+			return fmt.Errorf("invalid unit to mask, include the suffix like multipathd.service: %q", unit)
+		}
+	}
+	return nil
+}
+
+func purgePackages(ctx context.Context, chroot ChrootRunner, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	return chroot.Stream(ctx, 20*time.Minute, append([]string{"apt-get", "purge", "-y"}, names...)...)
+}
+
+func maskUnits(fs afero.Fs, units []string) error {
+	for _, unit := range units {
+		if err := MaskUnit(fs, unit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unitMasked reports whether MaskUnit masked unitName. Filesystems that can't read links never have masked units.
+func unitMasked(fs afero.Fs, unitName string) bool {
+	reader, ok := fs.(afero.LinkReader)
+	if !ok {
+		return false
+	}
+	target, err := reader.ReadlinkIfPossible(path.Join("/etc/systemd/system", unitName))
+	return err == nil && target == "/dev/null"
+}
+
+// Removals is what's actually been removed from the image at fs: the purge list as configured, and the units to mask
+// that are still masked once every step has run.
+func Removals(fs afero.Fs, cfg RemovalConfig) ([]string, []string) {
+	masked := make([]string, 0)
+	for _, unit := range cfg.Units() {
+		if unitMasked(fs, unit) {
+			masked = append(masked, unit)
+		}
+	}
+	return append([]string(nil), cfg.Packages()...), masked
+}
+
+// maskedButEnabled lists units linked into a target's .wants or .requires while masked, something enabled them and
+// the removal list took them away again.
+func maskedButEnabled(fs afero.Fs) []string {
+	var conflicts []string
+	for _, pattern := range []string{"/etc/systemd/system/*.wants/*", "/etc/systemd/system/*.requires/*"} {
+		links, _ := afero.Glob(fs, pattern)
+		for _, link := range links {
+			unit := path.Base(link)
+			if unitMasked(fs, unit) {
+				conflicts = append(conflicts, fmt.Sprintf("%s is enabled by %s but masked", unit, link))
+			}
+		}
+	}
+	return conflicts
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemovalConfigDefaults(t *testing.T) {
+	assert.Equal(t, []string{"snapd", "apport", "ubuntu-advantage-tools"}, RemovalConfig{}.Packages())
+	assert.Equal(t, []string{"multipathd.service", "multipathd.socket"}, RemovalConfig{}.Units())
+	// an empty list turns the defaults off
+	assert.Empty(t, RemovalConfig{Purge: []string{}, Mask: []string{}}.Packages())
+	assert.Empty(t, RemovalConfig{Purge: []string{}, Mask: []string{}}.Units())
+}
+
+func TestRemovalConfigValidate(t *testing.T) {
+	assert.NoError(t, RemovalConfig{}.Validate())
+	assert.NoError(t, RemovalConfig{Purge: []string{"snapd", "modemmanager"}, Mask: []string{"ModemManager.service"}}.Validate())
+	assert.Error(t, RemovalConfig{Purge: []string{"openssh-server"}}.Validate())
+	assert.Error(t, RemovalConfig{Purge: []string{"containerd.io"}}.Validate())
+	assert.Error(t, RemovalConfig{Purge: []string{"snapd apport"}}.Validate())
+	assert.Error(t, RemovalConfig{Mask: []string{"multipathd"}}.Validate())
+}
+
+func TestPurgePackages(t *testing.T) {
+	chroot := &recordingChroot{}
+	assert.NoError(t, purgePackages(context.Background(), chroot, RemovalConfig{}.Packages()))
+	assert.Equal(t, []string{"apt-get purge -y snapd apport ubuntu-advantage-tools"}, chroot.commands)
+
+	empty := &recordingChroot{}
+	assert.NoError(t, purgePackages(context.Background(), empty, nil))
+	assert.Empty(t, empty.commands)
+}
+
+func TestRemovals(t *testing.T) {
+	root := t.TempDir()
+	fs := afero.NewBasePathFs(afero.NewOsFs(), root)
+	cfg := RemovalConfig{Mask: []string{"multipathd.service", "ModemManager.service"}}
+
+	assert.NoError(t, maskUnits(fs, cfg.Units()))
+	assert.NoError(t, unmaskUnit(fs, "multipathd.service"))
+	purged, masked := Removals(fs, cfg)
+	assert.Equal(t, DefaultPurgePackages, purged)
+	assert.Equal(t, []string{"ModemManager.service"}, masked)
+}
+
+func TestMaskedButEnabled(t *testing.T) {
+	root := t.TempDir()
+	fs := afero.NewBasePathFs(afero.NewOsFs(), root)
+	assert.NoError(t, fs.MkdirAll("/etc/systemd/system/multi-user.target.wants", 0755))
+	assert.NoError(t, os.Symlink("/lib/systemd/system/iscsid.service", filepath.Join(root, "etc/systemd/system/multi-user.target.wants/iscsid.service")))
+	assert.Empty(t, maskedButEnabled(fs))
+
+	assert.NoError(t, MaskUnit(fs, "iscsid.service"))
+	assert.Equal(t, []string{"iscsid.service is enabled by /etc/systemd/system/multi-user.target.wants/iscsid.service but masked"}, maskedButEnabled(fs))
+}
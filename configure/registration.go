@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const (
+	// registrationTokenPath is on the fat boot partition so the token is provided at flash time instead of being
+	// baked into every image
+	registrationTokenPath = "/boot/firmware/registration-token"
+	registrationScript    = "/usr/local/sbin/register-node"
+)
+
+// RegistrationConfig has each node announce its serial, mac, address, and release to a provisioning api on first
+// boot. Nothing is installed without a URL.
+type RegistrationConfig struct {
+	URL string `yaml:"url"`
+	// Attempts is how many times the post is tried, backing off from 5s to 5m between tries, before giving up until
+	// the next boot.
+	Attempts int `yaml:"attempts"`
+}
+
+type RegistrationScript struct {
+	URL         string
+	TokenPath   string
+	ReleasePath string
+	ReleaseKeys []string
+	Attempts    int
+}
+
+func (r RegistrationConfig) Enabled() bool {
+	return r.URL != ""
+}
+
+func (r RegistrationConfig) withDefaults() RegistrationConfig {
+	if r.Attempts == 0 {
+		r.Attempts = 10
+	}
+	return r
+}
+
+func (r RegistrationConfig) Validate() error {
+	if !r.Enabled() {
+		return nil
+	}
+	parsed, err := url.Parse(r.URL)
+	if err != nil {
+		return fmt.Errorf("invalid registration url: %w", err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("registration url must be an absolute http or https url, got: %q", r.URL)
+	}
+	if strings.ContainsAny(r.URL, "\"$`\\ \n") {
+		return errors.New("registration url can not contain quotes, spaces, backslashes, or shell expansions")
+	}
+	if r.Attempts < 0 {
+		return fmt.Errorf("registration attempts can not be negative, got: %d", r.Attempts)
+	}
+	return nil
+}
+
+func releaseKeys() []string {
+	fields := Release{}.fields()
+	keys := make([]string, 0, len(fields))
+	for _, field := range fields {
+		keys = append(keys, field[0])
+	}
+	return keys
+}
+
+// Registration installs the register-node script and its first boot unit. The bearer token is read from the boot
+// partition when the node boots, see RegistrationToken.
+func Registration(ctx context.Context, chroot ChrootRunner, fs afero.Fs, cfg RegistrationConfig) error {
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	ctx, span := telemetry.Start(ctx, "configure node registration")
+	defer span.End()
+
+	cfg = cfg.withDefaults()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	script, scriptErr := utility.RenderTemplate(ctx, configFiles, "files/register-node.bash.template", RegistrationScript{
+		URL:         cfg.URL,
+		TokenPath:   registrationTokenPath,
+		ReleasePath: releasePath,
+		ReleaseKeys: releaseKeys(),
+		Attempts:    cfg.Attempts,
+	})
+	if scriptErr != nil {
+		return scriptErr
+	}
+
+	if err := fs.MkdirAll("/usr/local/sbin", 0755); err != nil {
+		return err
+	}
+
+	if _, err := IdempotentWrite(ctx, fs, &script, registrationScript, 0755); err != nil {
+		return err
+	}
+
+	unit, unitErr := configFiles.Open("files/register-node.service")
+	if unitErr != nil {
+		return unitErr
+	}
+	defer utility.WrappedClose(unit)
+
+	if _, err := IdempotentWrite(ctx, fs, unit, "/etc/systemd/system/register-node.service", 0644); err != nil {
+		return err
+	}
+
+	return enableUnit(ctx, chroot, fs, "register-node")
+}
+
+// RegistrationToken drops the registration bearer token on an already built boot partition, register-node removes it
+// once the node is registered.
+func RegistrationToken(ctx context.Context, fs afero.Fs, token string) error {
+	_, span := telemetry.Start(ctx, "configure registration token")
+	defer span.End()
+
+	if token == "" || strings.ContainsAny(token, " \t\r\n") {
+		return errors.New("registration token can not be empty or contain whitespace")
+	}
+
+	return afero.WriteFile(fs, registrationTokenPath, []byte(token+"\n"), 0600)
+}
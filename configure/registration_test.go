@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistrationDisabled(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	chroot := &recordingChroot{}
+	assert.NoError(t, Registration(context.Background(), chroot, fs, RegistrationConfig{}))
+
+	exists, _ := afero.Exists(fs, registrationScript)
+	assert.False(t, exists)
+	assert.Empty(t, chroot.commands)
+}
+
+func TestRegistration(t *testing.T) {
+	fs, root := unitFs(t)
+	chroot := &recordingChroot{}
+	assert.NoError(t, Registration(context.Background(), chroot, fs, RegistrationConfig{URL: "https://provision.lan/nodes"}))
+
+	script, readErr := afero.ReadFile(fs, registrationScript)
+	assert.NoError(t, readErr)
+	assert.Contains(t, string(script), "URL=\"https://provision.lan/nodes\"\n")
+	assert.Contains(t, string(script), "TOKEN_FILE=/boot/firmware/registration-token\n")
+	assert.Contains(t, string(script), "RELEASE_FILE=/etc/pi-image-builder-release\n")
+	assert.Contains(t, string(script), "ATTEMPTS=10\n")
+	assert.Contains(t, string(script), "for key in NAME VERSION COMMIT BUILD_DATE BASE_IMAGE BASE_IMAGE_SHA256 KUBERNETES_VERSION CHANNEL; do\n")
+
+	unit, readErr := afero.ReadFile(fs, "/etc/systemd/system/register-node.service")
+	assert.NoError(t, readErr)
+	assert.Contains(t, string(unit), "ExecStartPost=/bin/systemctl disable register-node.service\n")
+
+	target, linkErr := os.Readlink(filepath.Join(root, "etc/systemd/system/multi-user.target.wants/register-node.service"))
+	assert.NoError(t, linkErr)
+	assert.Equal(t, "/etc/systemd/system/register-node.service", target)
+
+	// the token is never baked into the image
+	exists, _ := afero.Exists(fs, registrationTokenPath)
+	assert.False(t, exists)
+}
+
+func TestRegistrationToken(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, RegistrationToken(context.Background(), fs, "s3cret"))
+	token, readErr := afero.ReadFile(fs, registrationTokenPath)
+	assert.NoError(t, readErr)
+	assert.Equal(t, "s3cret\n", string(token))
+
+	assert.Error(t, RegistrationToken(context.Background(), fs, ""))
+	assert.Error(t, RegistrationToken(context.Background(), fs, "s3cret\nX-Injected: true"))
+}
+
+func TestRegistrationConfigValidate(t *testing.T) {
+	assert.NoError(t, RegistrationConfig{}.Validate())
+	assert.NoError(t, RegistrationConfig{URL: "http://10.0.0.1:8080/register"}.Validate())
+	assert.Error(t, RegistrationConfig{URL: "provision.lan/nodes"}.Validate())
+	assert.Error(t, RegistrationConfig{URL: "ftp://provision.lan/nodes"}.Validate())
+	assert.Error(t, RegistrationConfig{URL: "https://provision.lan/$(reboot)"}.Validate())
+	assert.Error(t, RegistrationConfig{URL: "https://provision.lan/nodes", Attempts: -1}.Validate())
+}
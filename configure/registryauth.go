@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/spf13/afero"
+)
+
+// kubeletDockerConfigPath is one of the places the kubelet looks for pull credentials, it hands them to containerd
+// with each pull so they apply whichever mirror the pull is resolved through.
+const kubeletDockerConfigPath = "/var/lib/kubelet/config.json"
+
+var registryHostPattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?(:[0-9]+)?$`)
+
+// RegistryAuth is one registry's credentials, either a username and password or a token. A token is sent as the
+// password, with the username defaulting to "token".
+type RegistryAuth struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Token    string `yaml:"token"`
+}
+
+// RegistryCredentialsConfig holds credentials baked into the image for pulling from private registries. Entries in
+// Auths win over the ones read from DockerConfig.
+type RegistryCredentialsConfig struct {
+	// Auths maps a registry host, e.g. registry.lan:5000, to its credentials.
+	Auths map[string]RegistryAuth `yaml:"auths"`
+	// DockerConfig is a docker config.json on the build host, only entries with inline credentials can be used.
+	DockerConfig string `yaml:"dockerConfig"`
+}
+
+func (r RegistryCredentialsConfig) Enabled() bool {
+	return len(r.Auths) != 0 || r.DockerConfig != ""
+}
+
+func (a RegistryAuth) Validate() error {
+	if a.Token != "" && a.Password != "" {
+		return errors.New("registry auth takes a password or a token, not both")
+	}
+	if a.Token == "" && (a.Username == "" || a.Password == "") {
+		return errors.New("registry auth needs a username and password or a token")
+	}
+	return nil
+}
+
+// basic is the base64 user:password pair docker config files carry.
+func (a RegistryAuth) basic() string {
+	username, password := a.Username, a.Password
+	if a.Token != "" {
+		password = a.Token
+		if username == "" {
+			username = "token"
+		}
+	}
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+// Validate never includes credentials in its errors, only the registry they belong to.
+func (r RegistryCredentialsConfig) Validate() error {
+	for host, auth := range r.Auths {
+		if !registryHostPattern.MatchString(host) {
+			return fmt.Errorf("invalid registry host: %q", host)
+		}
+		if err := auth.Validate(); err != nil {
+			return fmt.Errorf("registry %s: %w", host, err)
+		}
+	}
+	return nil
+}
+
+type dockerConfigEntry struct {
+	Auth string `json:"auth,omitempty"`
+	// Username and Password are only read from the build host's file, the image always gets Auth.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+type dockerConfig struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+// readDockerConfig returns the auths of a docker config.json, keyed by registry host.
+func readDockerConfig(fs afero.Fs, name string) (map[string]dockerConfigEntry, error) {
+	raw, readErr := afero.ReadFile(fs, name)
+	if readErr != nil {
+		return nil, readErr
+	}
+	var parsed dockerConfig
+	if err := json.Unmarshal(raw, &parsed); err != nil {
+		return nil, fmt.Errorf("could not parse docker config %s: %w", name, err)
+	}
+	entries := make(map[string]dockerConfigEntry, len(parsed.Auths))
+	for key, entry := range parsed.Auths {
+		// docker login stores docker hub under its v1 url
+		host := strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+		host, _, _ = strings.Cut(host, "/")
+		if entry.Auth == "" && entry.Username != "" && entry.Password != "" {
+			entry.Auth = base64.StdEncoding.EncodeToString([]byte(entry.Username + ":" + entry.Password))
+		}
+		if entry.Auth == "" {
+			return nil, fmt.Errorf("docker config %s has no inline credentials for %s, credential helpers can't be baked into an image", name, host)
+		}
+		entries[host] = dockerConfigEntry{Auth: entry.Auth}
+	}
+	return entries, nil
+}
+
+func renderRegistryCredentials(cfg RegistryCredentialsConfig) ([]byte, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	auths := map[string]dockerConfigEntry{}
+	if cfg.DockerConfig != "" {
+		entries, readErr := readDockerConfig(hostFs, cfg.DockerConfig)
+		if readErr != nil {
+			return nil, readErr
+		}
+		auths = entries
+	}
+	for host, auth := range cfg.Auths {
+		auths[host] = dockerConfigEntry{Auth: auth.basic()}
+	}
+	if len(auths) == 0 {
+		return nil, nil
+	}
+	return json.MarshalIndent(dockerConfig{Auths: auths}, "", "  ")
+}
+
+// RegistryCredentials writes pull credentials where the kubelet picks them up, readable only by root. Nothing is
+// written without credentials. The credentials never go into logs or span attributes.
+func RegistryCredentials(ctx context.Context, fs afero.Fs, cfg RegistryCredentialsConfig) error {
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	ctx, span := telemetry.Start(ctx, "configure registry credentials")
+	defer span.End()
+
+	config, renderErr := renderRegistryCredentials(cfg)
+	if renderErr != nil {
+		return renderErr
+	}
+	if config == nil {
+		return nil
+	}
+
+	if err := fs.MkdirAll("/var/lib/kubelet", 0755); err != nil {
+		return err
+	}
+	if _, err := IdempotentWrite(ctx, fs, bytes.NewReader(config), kubeletDockerConfigPath, 0600); err != nil {
+		return err
+	}
+	// an existing file keeps its mode through IdempotentWrite
+	return fs.Chmod(kubeletDockerConfigPath, 0600)
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDockerConfigHost swaps the host filesystem for one holding a docker config.json.
+func fakeDockerConfigHost(t *testing.T, config string) {
+	host := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(host, "/home/builder/.docker/config.json", []byte(config), 0600))
+	originalFs := hostFs
+	hostFs = host
+	t.Cleanup(func() { hostFs = originalFs })
+}
+
+func readKubeletDockerConfig(t *testing.T, fs afero.Fs) map[string]dockerConfigEntry {
+	raw, err := afero.ReadFile(fs, kubeletDockerConfigPath)
+	assert.NoError(t, err)
+	var parsed dockerConfig
+	assert.NoError(t, json.Unmarshal(raw, &parsed))
+	return parsed.Auths
+}
+
+func TestRegistryCredentials(t *testing.T) {
+	fakeDockerConfigHost(t, `{"auths": {
+		"https://index.docker.io/v1/": {"auth": "aHViOnNlY3JldA=="},
+		"registry.lan:5000": {"username": "old", "password": "stale"}
+	}}`)
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, RegistryCredentials(context.Background(), fs, RegistryCredentialsConfig{
+		DockerConfig: "/home/builder/.docker/config.json",
+		Auths: map[string]RegistryAuth{
+			"registry.lan:5000": {Username: "serena", Password: "hunter2"},
+			"ghcr.io":           {Token: "ghp_token"},
+		},
+	}))
+
+	assert.Equal(t, map[string]dockerConfigEntry{
+		"index.docker.io":   {Auth: "aHViOnNlY3JldA=="},
+		"registry.lan:5000": {Auth: "c2VyZW5hOmh1bnRlcjI="},
+		"ghcr.io":           {Auth: "dG9rZW46Z2hwX3Rva2Vu"},
+	}, readKubeletDockerConfig(t, fs))
+	info, err := fs.Stat(kubeletDockerConfigPath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestRegistryCredentialsTightensMode(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, kubeletDockerConfigPath, []byte("{}"), 0644))
+	assert.NoError(t, RegistryCredentials(context.Background(), fs, RegistryCredentialsConfig{
+		Auths: map[string]RegistryAuth{"registry.lan": {Token: "abc"}},
+	}))
+	info, err := fs.Stat(kubeletDockerConfigPath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestRegistryCredentialsSkipped(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, RegistryCredentials(context.Background(), fs, RegistryCredentialsConfig{}))
+	exists, _ := afero.Exists(fs, kubeletDockerConfigPath)
+	assert.False(t, exists)
+}
+
+func TestRegistryCredentialsValidate(t *testing.T) {
+	for _, cfg := range []RegistryCredentialsConfig{
+		{Auths: map[string]RegistryAuth{"https://registry.lan": {Token: "abc"}}},
+		{Auths: map[string]RegistryAuth{"registry.lan": {Username: "serena"}}},
+		{Auths: map[string]RegistryAuth{"registry.lan": {Password: "hunter2", Token: "abc"}}},
+		{Auths: map[string]RegistryAuth{"registry.lan": {}}},
+	} {
+		err := cfg.Validate()
+		assert.Error(t, err)
+		// errors name the registry, never the secret
+		if err != nil {
+			assert.NotContains(t, err.Error(), "hunter2")
+			assert.NotContains(t, err.Error(), "abc")
+		}
+	}
+}
+
+func TestRegistryCredentialsHelperOnly(t *testing.T) {
+	fakeDockerConfigHost(t, `{"auths": {"ghcr.io": {}}, "credsStore": "desktop"}`)
+	err := RegistryCredentials(context.Background(), afero.NewMemMapFs(), RegistryCredentialsConfig{
+		DockerConfig: "/home/builder/.docker/config.json",
+	})
+	assert.ErrorContains(t, err, "credential helpers")
+}
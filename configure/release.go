@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/spf13/afero"
+)
+
+const (
+	releasePath = "/etc/pi-image-builder-release"
+	releaseMotd = "/etc/update-motd.d/99-pi-image-builder"
+	builderName = "pi-image-builder"
+)
+
+// osReleaseEscaper quotes values the way os-release(5) asks for, osReleaseUnescaper reverses it.
+var (
+	osReleaseEscaper   = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+	osReleaseUnescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\$`, "$", "\\`", "`")
+)
+
+// Release describes a built image, it's stamped into the image and set on the uploaded objects.
+type Release struct {
+	Version         string
+	Commit          string
+	BuiltAt         time.Time
+	BaseImage       string
+	BaseImageSHA256 string
+	Kubernetes      string
+	Channel         string
+}
+
+// BuilderVersion reads the builder's module version and vcs revision from its build info. A revision built from a
+// dirty tree is suffixed with -dirty.
+func BuilderVersion() (string, string) {
+	version, commit := "devel", "unknown"
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return version, commit
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+	modified := false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			commit = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if modified {
+		commit += "-dirty"
+	}
+	return version, commit
+}
+
+func (r Release) fields() [][2]string {
+	return [][2]string{
+		{"NAME", builderName},
+		{"VERSION", r.Version},
+		{"COMMIT", r.Commit},
+		{"BUILD_DATE", r.BuiltAt.UTC().Format(time.RFC3339)},
+		{"BASE_IMAGE", r.BaseImage},
+		{"BASE_IMAGE_SHA256", r.BaseImageSHA256},
+		{"KUBERNETES_VERSION", r.Kubernetes},
+		{"CHANNEL", r.Channel},
+	}
+}
+
+// Render formats the release as os-release style KEY="value" lines.
+func (r Release) Render() []byte {
+	var buffer bytes.Buffer
+	for _, field := range r.fields() {
+		fmt.Fprintf(&buffer, "%s=\"%s\"\n", field[0], osReleaseEscaper.Replace(field[1]))
+	}
+	return buffer.Bytes()
+}
+
+// Metadata is the release as object metadata, the same keys as the release file in lower case.
+func (r Release) Metadata() map[string]string {
+	metadata := make(map[string]string)
+	for _, field := range r.fields() {
+		metadata[strings.ToLower(field[0])] = field[1]
+	}
+	return metadata
+}
+
+// StampRelease writes the release file and an update-motd script announcing which build the node is running.
+func StampRelease(ctx context.Context, fs afero.Fs, release Release) error {
+	ctx, span := telemetry.Start(ctx, "stamp release")
+	defer span.End()
+
+	if _, err := IdempotentWrite(ctx, fs, bytes.NewReader(release.Render()), releasePath, 0644); err != nil {
+		return err
+	}
+	if err := fs.MkdirAll(path.Dir(releaseMotd), 0755); err != nil {
+		return err
+	}
+	motd := fmt.Sprintf("#!/bin/sh\n# written by %s, see %s\necho '# built by %s %s'\n", builderName, releasePath, builderName, release.Version)
+	_, writeErr := IdempotentWrite(ctx, fs, strings.NewReader(motd), releaseMotd, 0755)
+	return writeErr
+}
+
+// ReadRelease reads the release file StampRelease wrote into the image at fs as its KEY to value pairs, keys the
+// file doesn't have are left out.
+func ReadRelease(fs afero.Fs) (map[string]string, error) {
+	data, readErr := afero.ReadFile(fs, releasePath)
+	if readErr != nil {
+		return nil, readErr
+	}
+	fields := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, found := strings.Cut(line, "=")
+		if !found || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		if unquoted, quoted := strings.CutPrefix(value, `"`); quoted {
+			value = osReleaseUnescaper.Replace(strings.TrimSuffix(unquoted, `"`))
+		}
+		fields[strings.TrimSpace(key)] = value
+	}
+	return fields, nil
+}
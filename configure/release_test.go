@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRelease() Release {
+	return Release{
+		Version:         "v1.2.0",
+		Commit:          "0123abc",
+		BuiltAt:         time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC),
+		BaseImage:       "ubuntu-22.04.1-preinstalled-server-arm64+raspi.img.xz",
+		BaseImageSHA256: "5d4b",
+		Kubernetes:      "v1.25.3",
+		Channel:         `canary "east"`,
+	}
+}
+
+func TestStampRelease(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, StampRelease(context.Background(), fs, testRelease()))
+
+	release, readErr := afero.ReadFile(fs, releasePath)
+	assert.NoError(t, readErr)
+	assert.Equal(t, `NAME="pi-image-builder"
+VERSION="v1.2.0"
+COMMIT="0123abc"
+BUILD_DATE="2026-10-17T12:00:00Z"
+BASE_IMAGE="ubuntu-22.04.1-preinstalled-server-arm64+raspi.img.xz"
+BASE_IMAGE_SHA256="5d4b"
+KUBERNETES_VERSION="v1.25.3"
+CHANNEL="canary \"east\""
+`, string(release))
+
+	motd, motdErr := afero.ReadFile(fs, releaseMotd)
+	assert.NoError(t, motdErr)
+	assert.Contains(t, string(motd), "echo '# built by pi-image-builder v1.2.0'")
+	info, statErr := fs.Stat(releaseMotd)
+	assert.NoError(t, statErr)
+	assert.Equal(t, "-rwxr-xr-x", info.Mode().String())
+}
+
+func TestReadRelease(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, StampRelease(context.Background(), fs, testRelease()))
+
+	fields, err := ReadRelease(fs)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.2.0", fields["VERSION"])
+	assert.Equal(t, `canary "east"`, fields["CHANNEL"])
+	assert.Len(t, fields, 8)
+}
+
+func TestReleaseMetadata(t *testing.T) {
+	metadata := testRelease().Metadata()
+	assert.Equal(t, "v1.25.3", metadata["kubernetes_version"])
+	assert.Equal(t, "2026-10-17T12:00:00Z", metadata["build_date"])
+	assert.Equal(t, `canary "east"`, metadata["channel"])
+}
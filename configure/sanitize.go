@@ -0,0 +1,258 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/spf13/afero"
+)
+
+const (
+	machineIDPath     = "/etc/machine-id"
+	dbusMachineIDPath = "/var/lib/dbus/machine-id"
+	zeroFillPath      = "/zero-fill"
+)
+
+// SanitizeConfig turns off individual clean up actions, the zero value runs every one except zero filling.
+type SanitizeConfig struct {
+	KeepMachineID      bool `yaml:"keepMachineID"`
+	KeepAptCache       bool `yaml:"keepAptCache"`
+	KeepLogs           bool `yaml:"keepLogs"`
+	KeepSSHHostKeys    bool `yaml:"keepSSHHostKeys"`
+	KeepShellHistory   bool `yaml:"keepShellHistory"`
+	KeepCloudInitState bool `yaml:"keepCloudInitState"`
+	// ZeroFreeSpace fills the root filesystem's free space with zeros so the image compresses far better. It writes
+	// until the filesystem is full, so it takes a while.
+	ZeroFreeSpace bool `yaml:"zeroFreeSpace"`
+}
+
+// Sanitize removes build leftovers from the image so it's smaller and every flashed device comes up unique.
+func Sanitize(ctx context.Context, fs afero.Fs, cfg SanitizeConfig) error {
+
+	ctx, span := telemetry.Start(ctx, "sanitize image")
+	defer span.End()
+
+	actions := []struct {
+		skip bool
+		run  func(afero.Fs) error
+	}{
+		{skip: cfg.KeepMachineID, run: clearMachineID},
+		{skip: cfg.KeepAptCache, run: clearAptCache},
+		{skip: cfg.KeepLogs, run: clearLogs},
+		{skip: cfg.KeepSSHHostKeys, run: removeSSHHostKeys},
+		{skip: cfg.KeepShellHistory, run: removeShellHistory},
+		{skip: cfg.KeepCloudInitState, run: cleanCloudInit},
+	}
+	// the build machine's proxy is never kept, flashed nodes live on a different network
+	if err := removeAptProxy(fs); err != nil {
+		return err
+	}
+	// neither is an offline build's local repo, the image's own sources take over again
+	if err := removeLocalAptRepo(fs); err != nil {
+		return err
+	}
+	for _, action := range actions {
+		if action.skip {
+			continue
+		}
+		if err := action.run(fs); err != nil {
+			return err
+		}
+	}
+
+	if cfg.ZeroFreeSpace {
+		return ZeroFreeSpace(ctx, fs)
+	}
+	return nil
+}
+
+// clearMachineID empties machine-id so systemd generates a new one on first boot, removing it would make systemd
+// treat the first boot as a fresh install differently across releases.
+func clearMachineID(fs afero.Fs) error {
+	if err := truncateIfExists(fs, machineIDPath); err != nil {
+		return err
+	}
+	// dbus usually links to /etc/machine-id, only a real copy needs removing
+	if info, err := lstatIfPossible(fs, dbusMachineIDPath); err == nil && info.Mode().IsRegular() {
+		return fs.Remove(dbusMachineIDPath)
+	}
+	return nil
+}
+
+func clearAptCache(fs afero.Fs) error {
+	if err := removeMatching(fs, "/var/lib/apt/lists", func(name string, info os.FileInfo) bool {
+		return info.Mode().IsRegular() && name != "lock"
+	}); err != nil {
+		return err
+	}
+	if err := removeMatching(fs, "/var/cache/apt/archives", func(name string, _ os.FileInfo) bool {
+		return strings.HasSuffix(name, ".deb")
+	}); err != nil {
+		return err
+	}
+	return removeMatching(fs, "/var/cache/apt", func(name string, _ os.FileInfo) bool {
+		return strings.HasSuffix(name, ".bin")
+	})
+}
+
+// clearLogs empties log files in place so services keep their log files and permissions, rotated logs and the
+// journal are removed outright.
+func clearLogs(fs afero.Fs) error {
+	exists, existsErr := afero.DirExists(fs, "/var/log")
+	if existsErr != nil || !exists {
+		return existsErr
+	}
+	return afero.Walk(fs, "/var/log", func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if strings.HasPrefix(name, persistentJournalDir+"/") || rotatedLog(info.Name()) {
+			return fs.Remove(name)
+		}
+		return truncate(fs, name)
+	})
+}
+
+func rotatedLog(name string) bool {
+	if strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".old") {
+		return true
+	}
+	extension := path.Ext(name)
+	return len(extension) > 1 && strings.Trim(extension[1:], "0123456789") == ""
+}
+
+func removeSSHHostKeys(fs afero.Fs) error {
+	return removeMatching(fs, "/etc/ssh", func(name string, _ os.FileInfo) bool {
+		return strings.HasPrefix(name, "ssh_host_")
+	})
+}
+
+func removeShellHistory(fs afero.Fs) error {
+	homes := []string{"/root"}
+	users, err := afero.ReadDir(fs, "/home")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, user := range users {
+		if user.IsDir() {
+			homes = append(homes, path.Join("/home", user.Name()))
+		}
+	}
+	for _, home := range homes {
+		if err := removeMatching(fs, home, func(name string, _ os.FileInfo) bool {
+			return name == ".bash_history"
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanCloudInit does what cloud-init clean does: everything under /var/lib/cloud goes except the seed, so cloud-init
+// runs again on first boot.
+func cleanCloudInit(fs afero.Fs) error {
+	return removeMatching(fs, "/var/lib/cloud", func(name string, _ os.FileInfo) bool {
+		return name != "seed"
+	})
+}
+
+// ZeroFreeSpace writes zeros until the filesystem is full, then deletes them again, so deleted blocks compress away.
+func ZeroFreeSpace(ctx context.Context, fs afero.Fs) (err error) {
+	_, span := telemetry.Start(ctx, "zero free space")
+	defer span.End()
+
+	fill, createErr := fs.Create(zeroFillPath)
+	if createErr != nil {
+		return createErr
+	}
+	defer func() {
+		err = errors.Join(err, fs.Remove(zeroFillPath))
+	}()
+
+	_, copyErr := io.Copy(fill, zeroReader{})
+	closeErr := fill.Close()
+	if copyErr != nil && !errors.Is(copyErr, syscall.ENOSPC) {
+		return copyErr
+	}
+	if closeErr != nil && !errors.Is(closeErr, syscall.ENOSPC) {
+		return closeErr
+	}
+	return nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// removeMatching removes the entries directly in dir that match, dir not existing isn't an error.
+func removeMatching(fs afero.Fs, dir string, match func(name string, info os.FileInfo) bool) error {
+	entries, err := afero.ReadDir(fs, dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !match(entry.Name(), entry) {
+			continue
+		}
+		if err := fs.RemoveAll(path.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func truncate(fs afero.Fs, name string) error {
+	file, err := fs.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func truncateIfExists(fs afero.Fs, name string) error {
+	if err := truncate(fs, name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func lstatIfPossible(fs afero.Fs, name string) (os.FileInfo, error) {
+	if lstater, ok := fs.(afero.Lstater); ok {
+		info, _, err := lstater.LstatIfPossible(name)
+		return info, err
+	}
+	return fs.Stat(name)
+}
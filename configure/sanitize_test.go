@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func sanitizeFixture(t *testing.T) afero.Fs {
+	fs := afero.NewMemMapFs()
+	files := map[string]string{
+		"/etc/machine-id":                              "0123456789abcdef\n",
+		"/var/lib/dbus/machine-id":                     "0123456789abcdef\n",
+		"/var/lib/apt/lists/lock":                      "",
+		"/var/lib/apt/lists/ports_dists_focal_Release": "release",
+		"/var/cache/apt/archives/vim_8.2_arm64.deb":    "deb",
+		"/var/cache/apt/pkgcache.bin":                  "cache",
+		"/var/log/syslog":                              "build host noise",
+		"/var/log/syslog.1":                            "older noise",
+		"/var/log/apt/history.log.2.gz":                "gzip",
+		"/var/log/journal/abc/system.journal":          "journal",
+		"/etc/ssh/ssh_host_ed25519_key":                "private",
+		"/etc/ssh/ssh_host_ed25519_key.pub":            "public",
+		"/etc/ssh/sshd_config":                         "config",
+		"/root/.bash_history":                          "ls",
+		"/home/kat/.bash_history":                      "ls",
+		"/home/kat/.bashrc":                            "rc",
+		"/var/lib/cloud/instances/abc/boot-finished":   "done",
+		"/var/lib/cloud/seed/nocloud/user-data":        "seed",
+	}
+	for name, content := range files {
+		assert.NoError(t, afero.WriteFile(fs, name, []byte(content), 0644))
+	}
+	return fs
+}
+
+func TestSanitize(t *testing.T) {
+	fs := sanitizeFixture(t)
+	assert.NoError(t, Sanitize(context.Background(), fs, SanitizeConfig{}))
+
+	for _, name := range []string{"/etc/machine-id", "/var/log/syslog"} {
+		content, err := afero.ReadFile(fs, name)
+		assert.NoError(t, err, name)
+		assert.Empty(t, content, name)
+	}
+	for _, name := range []string{
+		"/var/lib/dbus/machine-id",
+		"/var/lib/apt/lists/ports_dists_focal_Release",
+		"/var/cache/apt/archives/vim_8.2_arm64.deb",
+		"/var/cache/apt/pkgcache.bin",
+		"/var/log/syslog.1",
+		"/var/log/apt/history.log.2.gz",
+		"/var/log/journal/abc/system.journal",
+		"/etc/ssh/ssh_host_ed25519_key",
+		"/etc/ssh/ssh_host_ed25519_key.pub",
+		"/root/.bash_history",
+		"/home/kat/.bash_history",
+		"/var/lib/cloud/instances",
+	} {
+		exists, err := afero.Exists(fs, name)
+		assert.NoError(t, err)
+		assert.False(t, exists, name)
+	}
+	for _, name := range []string{"/var/lib/apt/lists/lock", "/etc/ssh/sshd_config", "/home/kat/.bashrc", "/var/lib/cloud/seed/nocloud/user-data"} {
+		exists, err := afero.Exists(fs, name)
+		assert.NoError(t, err)
+		assert.True(t, exists, name)
+	}
+}
+
+func TestSanitizeKeep(t *testing.T) {
+	fs := sanitizeFixture(t)
+	keepAll := SanitizeConfig{
+		KeepMachineID:      true,
+		KeepAptCache:       true,
+		KeepLogs:           true,
+		KeepSSHHostKeys:    true,
+		KeepShellHistory:   true,
+		KeepCloudInitState: true,
+	}
+	assert.NoError(t, Sanitize(context.Background(), fs, keepAll))
+	expected := sanitizeFixture(t)
+	assert.NoError(t, afero.Walk(expected, "/", func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		want, _ := afero.ReadFile(expected, name)
+		got, readErr := afero.ReadFile(fs, name)
+		assert.NoError(t, readErr, name)
+		assert.Equal(t, want, got, name)
+		return nil
+	}))
+
+	assert.NoError(t, Sanitize(context.Background(), afero.NewMemMapFs(), SanitizeConfig{}), "a bare image has nothing to clean")
+}
+
+func TestRotatedLog(t *testing.T) {
+	assert.True(t, rotatedLog("syslog.1"))
+	assert.True(t, rotatedLog("dpkg.log.3.gz"))
+	assert.True(t, rotatedLog("dmesg.old"))
+	assert.False(t, rotatedLog("syslog"))
+	assert.False(t, rotatedLog("cloud-init.log"))
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/spf13/afero"
+)
+
+var (
+	serialBaudRates = map[int]bool{9600: true, 19200: true, 38400: true, 57600: true, 115200: true, 230400: true, 460800: true, 921600: true}
+	// serialDevices are every name the uarts go by, the gettys are masked on all of them when the console is off
+	serialDevices = []string{"ttyS0", "ttyAMA0"}
+)
+
+// SerialConfig controls the uart console. Leaving Console unset keeps the stock console=serial0 parameter and leaves
+// the uart and getty to the image's defaults.
+type SerialConfig struct {
+	// Console puts a kernel console and login getty on the uart when true. False takes the console off the command
+	// line, turns the uart off, and masks the gettys so nothing listens on the header pins.
+	Console *bool `yaml:"console"`
+	// Baud defaults to 115200.
+	Baud int `yaml:"baud"`
+	// DisableBluetooth frees the PL011 uart the radio holds on boards with bluetooth, which moves serial0 from the mini
+	// uart on ttyS0 to ttyAMA0.
+	DisableBluetooth bool `yaml:"disableBluetooth"`
+}
+
+func (s SerialConfig) enabled() bool {
+	return s.Console != nil && *s.Console
+}
+
+func (s SerialConfig) disabled() bool {
+	return s.Console != nil && !*s.Console
+}
+
+func (s SerialConfig) Validate() error {
+	if s.Baud != 0 && !s.enabled() {
+		return errors.New("serial baud only applies when the serial console is enabled")
+	}
+	if s.Baud != 0 && !serialBaudRates[s.Baud] {
+		return fmt.Errorf("unsupported serial baud rate: %d", s.Baud)
+	}
+	// the stock console=serial0 would silently land on a different uart, so the choice has to be made explicitly
+	if s.DisableBluetooth && s.Console == nil {
+		return errors.New("disabling bluetooth moves serial0 from ttyS0 to ttyAMA0, set serial.console to enable or disable the console with it")
+	}
+	return nil
+}
+
+func (s SerialConfig) consoleParam() string {
+	baud := s.Baud
+	if baud == 0 {
+		baud = 115200
+	}
+	return "console=serial0," + strconv.Itoa(baud)
+}
+
+// device is the tty serial0 points at.
+func (s SerialConfig) device() string {
+	if s.DisableBluetooth {
+		return "ttyAMA0"
+	}
+	return "ttyS0"
+}
+
+// isSerialConsole reports whether a kernel parameter puts the console on a uart.
+func isSerialConsole(param string) bool {
+	key, value, _ := strings.Cut(param, "=")
+	if key != "console" {
+		return false
+	}
+	for _, prefix := range append([]string{"serial"}, serialDevices...) {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyConsole replaces the serial console parameters in base with the configured one, the serial console goes where
+// the first one was so the last console= on the line stays the primary.
+func (s SerialConfig) applyConsole(base []string) []string {
+	if s.Console == nil {
+		return base
+	}
+	params := make([]string, 0, len(base)+1)
+	position := -1
+	for _, param := range base {
+		if isSerialConsole(param) {
+			if position == -1 {
+				position = len(params)
+			}
+			continue
+		}
+		params = append(params, param)
+	}
+	if !*s.Console {
+		return params
+	}
+	if position == -1 {
+		position = 0
+	}
+	return append(params[:position], append([]string{s.consoleParam()}, params[position:]...)...)
+}
+
+// SerialConsole enables the login getty on the serial console's uart or masks the gettys on every uart when the
+// console is disabled. Nothing changes when the console is left unset.
+func SerialConsole(ctx context.Context, chroot ChrootRunner, fs afero.Fs, cfg SerialConfig) error {
+	if cfg.Console == nil {
+		return nil
+	}
+
+	ctx, span := telemetry.Start(ctx, "configure serial console")
+	defer span.End()
+
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	if cfg.disabled() {
+		for _, device := range serialDevices {
+			if err := MaskUnit(fs, "serial-getty@"+device); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	unit := "serial-getty@" + cfg.device()
+	if err := unmaskUnit(fs, unit); err != nil {
+		return err
+	}
+	return enableUnit(ctx, chroot, fs, unit)
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSerialConsoleUnset(t *testing.T) {
+	chroot := &recordingChroot{}
+	assert.NoError(t, SerialConsole(context.Background(), chroot, afero.NewMemMapFs(), SerialConfig{}))
+	assert.Empty(t, chroot.commands)
+}
+
+func TestSerialConsoleEnabled(t *testing.T) {
+	root := t.TempDir()
+	fs := afero.NewBasePathFs(afero.NewOsFs(), root)
+	chroot := &recordingChroot{}
+	enabled := true
+
+	// a mask left by an earlier update is lifted before the getty is enabled
+	assert.NoError(t, MaskUnit(fs, "serial-getty@ttyAMA0"))
+	assert.NoError(t, SerialConsole(context.Background(), chroot, fs, SerialConfig{Console: &enabled, DisableBluetooth: true}))
+	assert.Equal(t, []string{"systemctl enable serial-getty@ttyAMA0"}, chroot.commands)
+	_, statErr := os.Lstat(filepath.Join(root, "etc/systemd/system/serial-getty@ttyAMA0.service"))
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+func TestSerialConsoleDisabled(t *testing.T) {
+	root := t.TempDir()
+	fs := afero.NewBasePathFs(afero.NewOsFs(), root)
+	chroot := &recordingChroot{}
+	disabled := false
+
+	assert.NoError(t, SerialConsole(context.Background(), chroot, fs, SerialConfig{Console: &disabled}))
+	assert.Empty(t, chroot.commands)
+	for _, device := range []string{"ttyS0", "ttyAMA0"} {
+		target, linkErr := os.Readlink(filepath.Join(root, "etc/systemd/system/serial-getty@"+device+".service"))
+		assert.NoError(t, linkErr)
+		assert.Equal(t, "/dev/null", target)
+	}
+}
+
+func TestSerialConfigValidate(t *testing.T) {
+	enabled, disabled := true, false
+	assert.NoError(t, SerialConfig{}.Validate())
+	assert.NoError(t, SerialConfig{Console: &enabled, Baud: 9600}.Validate())
+	assert.NoError(t, SerialConfig{Console: &disabled, DisableBluetooth: true}.Validate())
+	assert.Error(t, SerialConfig{Console: &enabled, Baud: 12345}.Validate())
+	assert.Error(t, SerialConfig{Console: &disabled, Baud: 115200}.Validate())
+	assert.Error(t, SerialConfig{DisableBluetooth: true}.Validate())
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const (
+	sshdHardeningPath = "/etc/ssh/sshd_config.d/10-hardening.conf"
+	sshHostKeyGlob    = "/etc/ssh/ssh_host_*"
+	// HostKeysRegenerate strips host keys from the image, every device creates its own on first boot.
+	HostKeysRegenerate = "regenerate"
+	// HostKeysPregenerate bakes keys into the image, every device flashed from it shares the same identity.
+	HostKeysPregenerate = "pregenerate"
+)
+
+// sshdCheckScript tests the config the way ssh.service does before starting. A regenerate image has no host keys of
+// its own yet and sshd -t refuses to run without one, so it's handed a throwaway key.
+const sshdCheckScript = `set -e
+mkdir -p /run/sshd
+key=$(mktemp -u /tmp/sshd-check.XXXXXX)
+trap 'rm -f "$key" "$key.pub"' EXIT
+ssh-keygen -q -t ed25519 -N "" -f "$key"
+/usr/sbin/sshd -t -h "$key"`
+
+var (
+	sshdTokenPattern = regexp.MustCompile(`^[A-Za-z0-9@._*?!%-]+$`)
+	rootLoginValues  = map[string]bool{"yes": true, "no": true, "prohibit-password": true, "forced-commands-only": true}
+)
+
+// SSHConfig is rendered into an sshd_config drop in. The zero value is key only auth with root login disabled.
+type SSHConfig struct {
+	// PasswordAuthentication defaults to cloudInit.passwordAuth when unset.
+	PasswordAuthentication *bool    `yaml:"passwordAuthentication"`
+	PermitRootLogin        string   `yaml:"permitRootLogin"`
+	AllowUsers             []string `yaml:"allowUsers"`
+	AllowGroups            []string `yaml:"allowGroups"`
+	Port                   int      `yaml:"port"`
+	KexAlgorithms          []string `yaml:"kexAlgorithms"`
+	Ciphers                []string `yaml:"ciphers"`
+	MACs                   []string `yaml:"macs"`
+	// HostKeys is either regenerate (default) or pregenerate.
+	HostKeys string `yaml:"hostKeys"`
+}
+
+type SSHDropIn struct {
+	SSHConfig
+	PasswordAuthentication bool
+}
+
+func (s SSHConfig) withDefaults() SSHConfig {
+	if s.PermitRootLogin == "" {
+		s.PermitRootLogin = "no"
+	}
+	if s.Port == 0 {
+		s.Port = 22
+	}
+	if len(s.KexAlgorithms) == 0 {
+		// sntrup761x25519 would be preferred, but it needs OpenSSH 8.5 and focal ships 8.2
+		s.KexAlgorithms = []string{"curve25519-sha256", "curve25519-sha256@libssh.org"}
+	}
+	if len(s.Ciphers) == 0 {
+		s.Ciphers = []string{"chacha20-poly1305@openssh.com", "aes256-gcm@openssh.com", "aes128-gcm@openssh.com"}
+	}
+	if len(s.MACs) == 0 {
+		s.MACs = []string{"hmac-sha2-512-etm@openssh.com", "hmac-sha2-256-etm@openssh.com"}
+	}
+	if s.HostKeys == "" {
+		s.HostKeys = HostKeysRegenerate
+	}
+	return s
+}
+
+func (s SSHConfig) Validate() error {
+	if !rootLoginValues[s.PermitRootLogin] {
+		return fmt.Errorf("invalid permitRootLogin: %q", s.PermitRootLogin)
+	}
+	if s.Port < 1 || s.Port > 65535 {
+		return fmt.Errorf("invalid ssh port: %d", s.Port)
+	}
+	if s.HostKeys != HostKeysRegenerate && s.HostKeys != HostKeysPregenerate {
+		return fmt.Errorf("hostKeys must be %s or %s, got: %q", HostKeysRegenerate, HostKeysPregenerate, s.HostKeys)
+	}
+	for _, list := range [][]string{s.AllowUsers, s.AllowGroups, s.KexAlgorithms, s.Ciphers, s.MACs} {
+		for _, token := range list {
+			if !sshdTokenPattern.MatchString(token) {
+				return fmt.Errorf("invalid sshd_config value: %q", token)
+			}
+		}
+	}
+	return nil
+}
+
+// SSHHardening writes the sshd drop in and makes sure flashed devices don't share host keys unless pregenerate was
+// asked for explicitly. The result is checked with sshd -t, a config sshd rejects would leave every node unreachable.
+func SSHHardening(ctx context.Context, chroot ChrootRunner, fs afero.Fs, cfg SSHConfig) error {
+	ctx, span := telemetry.Start(ctx, "harden sshd")
+	defer span.End()
+
+	cfg = cfg.withDefaults()
+
+	if err := writeSSHConfig(ctx, fs, cfg); err != nil {
+		return err
+	}
+
+	if cfg.HostKeys == HostKeysPregenerate {
+		if err := chroot.Run(ctx, 5*time.Minute, "ssh-keygen", "-A"); err != nil {
+			return err
+		}
+	}
+
+	if err := chroot.Run(ctx, time.Minute, "/bin/sh", "-c", sshdCheckScript); err != nil {
+		return fmt.Errorf("sshd rejected its config: %w", err)
+	}
+	return nil
+}
+
+func writeSSHConfig(ctx context.Context, fs afero.Fs, cfg SSHConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	passwordAuth := false
+	if cfg.PasswordAuthentication != nil {
+		passwordAuth = *cfg.PasswordAuthentication
+	}
+
+	dropIn, renderErr := utility.RenderTemplate(ctx, configFiles, "files/sshd-hardening.conf.template", SSHDropIn{
+		SSHConfig:              cfg,
+		PasswordAuthentication: passwordAuth,
+	})
+	if renderErr != nil {
+		return renderErr
+	}
+
+	if err := fs.MkdirAll(path.Dir(sshdHardeningPath), 0755); err != nil {
+		return err
+	}
+
+	if _, err := IdempotentWrite(ctx, fs, &dropIn, sshdHardeningPath, 0644); err != nil {
+		return err
+	}
+
+	hostKeys, globErr := afero.Glob(fs, sshHostKeyGlob)
+	if globErr != nil {
+		return globErr
+	}
+	for _, hostKey := range hostKeys {
+		if err := fs.Remove(hostKey); err != nil && !errors.Is(err, afero.ErrFileNotFound) {
+			return err
+		}
+	}
+
+	if cfg.HostKeys == HostKeysPregenerate {
+		// cloud-init deletes host keys on first boot by default which would undo pregeneration
+		if err := fs.MkdirAll(cloudInitDropInDir, 0755); err != nil {
+			return err
+		}
+		return afero.WriteFile(fs, path.Join(cloudInitDropInDir, "10_ssh_keys.cfg"), []byte("ssh_deletekeys: false\n"), 0644)
+	}
+
+	unit, unitErr := configFiles.Open("files/ssh-host-keys.conf")
+	if unitErr != nil {
+		return unitErr
+	}
+	defer utility.WrappedClose(unit)
+
+	if err := fs.MkdirAll("/etc/systemd/system/ssh.service.d", 0755); err != nil {
+		return err
+	}
+
+	_, writeErr := IdempotentWrite(ctx, fs, unit, "/etc/systemd/system/ssh.service.d/10-host-keys.conf", 0644)
+	return writeErr
+}
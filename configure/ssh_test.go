@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteSSHConfigDefaults(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "/etc/ssh/ssh_host_ed25519_key", []byte("private"), 0600))
+	assert.NoError(t, afero.WriteFile(fs, "/etc/ssh/ssh_host_ed25519_key.pub", []byte("public"), 0644))
+
+	assert.NoError(t, writeSSHConfig(context.Background(), fs, SSHConfig{}.withDefaults()))
+
+	dropIn, err := afero.ReadFile(fs, sshdHardeningPath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(dropIn), "PasswordAuthentication no\n")
+	assert.Contains(t, string(dropIn), "PermitRootLogin no\n")
+	assert.Contains(t, string(dropIn), "Port 22\n")
+	assert.Contains(t, string(dropIn), "Ciphers chacha20-poly1305@openssh.com,aes256-gcm@openssh.com,aes128-gcm@openssh.com\n")
+	assert.NotContains(t, string(dropIn), "AllowUsers")
+	// focal's OpenSSH 8.2 refuses to start with a kex algorithm it doesn't know
+	assert.Contains(t, string(dropIn), "KexAlgorithms curve25519-sha256,curve25519-sha256@libssh.org\n")
+
+	hostKeys, globErr := afero.Glob(fs, sshHostKeyGlob)
+	assert.NoError(t, globErr)
+	assert.Empty(t, hostKeys)
+
+	keygen, keygenErr := afero.Exists(fs, "/etc/systemd/system/ssh.service.d/10-host-keys.conf")
+	assert.NoError(t, keygenErr)
+	assert.True(t, keygen)
+}
+
+func TestWriteSSHConfigOverrides(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	passwordAuth := true
+	cfg := SSHConfig{
+		PasswordAuthentication: &passwordAuth,
+		PermitRootLogin:        "prohibit-password",
+		AllowUsers:             []string{"kat", "deploy"},
+		AllowGroups:            []string{"ssh-users"},
+		Port:                   2222,
+		HostKeys:               HostKeysPregenerate,
+	}.withDefaults()
+
+	assert.NoError(t, writeSSHConfig(context.Background(), fs, cfg))
+
+	dropIn, err := afero.ReadFile(fs, sshdHardeningPath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(dropIn), "PasswordAuthentication yes\n")
+	assert.Contains(t, string(dropIn), "PermitRootLogin prohibit-password\n")
+	assert.Contains(t, string(dropIn), "AllowUsers kat deploy\n")
+	assert.Contains(t, string(dropIn), "AllowGroups ssh-users\n")
+	assert.Contains(t, string(dropIn), "Port 2222\n")
+
+	cloudInit, cloudInitErr := afero.ReadFile(fs, "/etc/cloud/cloud.cfg.d/10_ssh_keys.cfg")
+	assert.NoError(t, cloudInitErr)
+	assert.Equal(t, "ssh_deletekeys: false\n", string(cloudInit))
+}
+
+func TestSSHHardeningChecksConfig(t *testing.T) {
+	chroot := &recordingChroot{}
+	assert.NoError(t, SSHHardening(context.Background(), chroot, afero.NewMemMapFs(), SSHConfig{}))
+	assert.Equal(t, []string{"/bin/sh -c " + sshdCheckScript}, chroot.commands)
+
+	chroot = &recordingChroot{}
+	assert.NoError(t, SSHHardening(context.Background(), chroot, afero.NewMemMapFs(), SSHConfig{HostKeys: HostKeysPregenerate}))
+	assert.Equal(t, []string{"ssh-keygen -A", "/bin/sh -c " + sshdCheckScript}, chroot.commands)
+}
+
+func TestSSHConfigValidate(t *testing.T) {
+	assert.NoError(t, SSHConfig{}.withDefaults().Validate())
+	assert.Error(t, SSHConfig{PermitRootLogin: "maybe"}.withDefaults().Validate())
+	assert.Error(t, SSHConfig{Port: 70000}.withDefaults().Validate())
+	assert.Error(t, SSHConfig{HostKeys: "shared"}.withDefaults().Validate())
+	assert.Error(t, SSHConfig{AllowUsers: []string{"kat\nPermitRootLogin yes"}}.withDefaults().Validate())
+}
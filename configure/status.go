@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+)
+
+// ErrUnexpectedStatus is what every *ErrStatusCode unwraps to, for callers that only care that a server said no.
+var ErrUnexpectedStatus = errors.New("unexpected http status")
+
+// ErrStatusCode is a response whose status wasn't the expected one.
+type ErrStatusCode struct {
+	Method       string
+	URL          string
+	ExpectedCode int
+	StatusCode   int
+}
+
+func NewErrStatusCode(method string, url string, expectedCode int, statusCode int) *ErrStatusCode {
+	return &ErrStatusCode{Method: method, URL: url, ExpectedCode: expectedCode, StatusCode: statusCode}
+}
+
+func (e *ErrStatusCode) Error() string {
+	return fmt.Sprintf("%s %s: expected http code: %d, got %d instead", e.Method, e.URL, e.ExpectedCode, e.StatusCode)
+}
+
+func (e *ErrStatusCode) Unwrap() error {
+	return ErrUnexpectedStatus
+}
+
+// Is matches a target *ErrStatusCode field by field, zero fields match anything so
+// errors.Is(err, &ErrStatusCode{StatusCode: http.StatusNotFound}) finds a 404 from any url.
+func (e *ErrStatusCode) Is(target error) bool {
+	var other *ErrStatusCode
+	if !errors.As(target, &other) {
+		return false
+	}
+	return (other.Method == "" || other.Method == e.Method) &&
+		(other.URL == "" || other.URL == e.URL) &&
+		(other.ExpectedCode == 0 || other.ExpectedCode == e.ExpectedCode) &&
+		(other.StatusCode == 0 || other.StatusCode == e.StatusCode)
+}
+
+// CheckResponse returns an *ErrStatusCode for anything but a 200 from url, closing the body since nobody reads it.
+// On success the body is left for the caller to read and close.
+func CheckResponse(response *http.Response, url string) error {
+	if response.StatusCode == http.StatusOK {
+		return nil
+	}
+	method := http.MethodGet
+	if response.Request != nil && response.Request.Method != "" {
+		method = response.Request.Method
+	}
+	utility.WrappedClose(response.Body)
+	return NewErrStatusCode(method, url, http.StatusOK, response.StatusCode)
+}
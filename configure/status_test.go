@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	found, err := get(context.Background(), server.URL+"/found")
+	assert.NoError(t, err)
+	assert.NoError(t, found.Body.Close())
+
+	_, missingErr := get(context.Background(), server.URL+"/missing")
+	assert.EqualError(t, missingErr, "GET "+server.URL+"/missing: expected http code: 200, got 404 instead")
+
+	var statusErr *ErrStatusCode
+	assert.True(t, errors.As(missingErr, &statusErr))
+	assert.Equal(t, server.URL+"/missing", statusErr.URL)
+	assert.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+	assert.ErrorIs(t, missingErr, ErrUnexpectedStatus)
+}
+
+func TestErrStatusCodeIs(t *testing.T) {
+	err := error(NewErrStatusCode(http.MethodGet, "https://dl.k8s.io/release/v1.28.4/bin/linux/arm64/kubelet", http.StatusOK, http.StatusNotFound))
+
+	assert.ErrorIs(t, err, &ErrStatusCode{StatusCode: http.StatusNotFound})
+	assert.ErrorIs(t, err, &ErrStatusCode{Method: http.MethodGet, StatusCode: http.StatusNotFound})
+	assert.ErrorIs(t, err, &ErrStatusCode{URL: "https://dl.k8s.io/release/v1.28.4/bin/linux/arm64/kubelet"})
+	assert.NotErrorIs(t, err, &ErrStatusCode{StatusCode: http.StatusForbidden})
+	assert.NotErrorIs(t, err, &ErrStatusCode{Method: http.MethodHead})
+	assert.NotErrorIs(t, err, errors.New("something else"))
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const (
+	zoneInfoDir = "/usr/share/zoneinfo"
+)
+
+var localePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(_[A-Z]{2})?(\.[A-Za-z0-9-]+)?(@[a-z]+)?$`)
+
+// SystemConfig holds the fleet baseline for time and language, every empty field is left at the distro default.
+type SystemConfig struct {
+	// Timezone is a zoneinfo name like America/Chicago.
+	Timezone string `yaml:"timezone"`
+	// Locale becomes LANG and is generated along with ExtraLocales.
+	Locale       string   `yaml:"locale"`
+	ExtraLocales []string `yaml:"extraLocales"`
+	NTP          []string `yaml:"ntp"`
+	FallbackNTP  []string `yaml:"fallbackNTP"`
+}
+
+func (s SystemConfig) locales() []string {
+	if s.Locale == "" {
+		return s.ExtraLocales
+	}
+	return append([]string{s.Locale}, s.ExtraLocales...)
+}
+
+func (s SystemConfig) Validate() error {
+	if strings.Contains(s.Timezone, "..") || strings.HasPrefix(s.Timezone, "/") {
+		return fmt.Errorf("invalid timezone: %q", s.Timezone)
+	}
+	for _, locale := range s.locales() {
+		if !localePattern.MatchString(locale) {
+			return fmt.Errorf("invalid locale: %q", locale)
+		}
+	}
+	if s.Locale == "" && len(s.ExtraLocales) != 0 {
+		return errors.New("extra locales require a primary locale")
+	}
+	for _, server := range append(append([]string{}, s.NTP...), s.FallbackNTP...) {
+		if server == "" || strings.ContainsAny(server, " \t\n") {
+			return fmt.Errorf("invalid ntp server: %q", server)
+		}
+	}
+	return nil
+}
+
+// SystemSettings configures timezone, locale, and timesyncd. Locales are generated inside the container.
+func SystemSettings(ctx context.Context, chroot ChrootRunner, fs afero.Fs, cfg SystemConfig) error {
+
+	ctx, span := telemetry.Start(ctx, "configure system settings")
+	defer span.End()
+
+	if err := writeSystemSettings(ctx, fs, cfg); err != nil {
+		return err
+	}
+
+	if len(cfg.locales()) == 0 {
+		return nil
+	}
+
+	return chroot.Run(ctx, 10*time.Minute, append([]string{"locale-gen"}, cfg.locales()...)...)
+}
+
+func writeSystemSettings(ctx context.Context, fs afero.Fs, cfg SystemConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	if cfg.Timezone != "" {
+		if err := writeTimezone(fs, cfg.Timezone); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Locale != "" {
+		locale := fmt.Sprintf("LANG=%s\n", cfg.Locale)
+		if err := afero.WriteFile(fs, "/etc/default/locale", []byte(locale), 0644); err != nil {
+			return err
+		}
+	}
+
+	if len(cfg.NTP) != 0 || len(cfg.FallbackNTP) != 0 {
+		timesyncd, renderErr := utility.RenderTemplate(ctx, configFiles, "files/timesyncd.conf.template", cfg)
+		if renderErr != nil {
+			return renderErr
+		}
+		if err := fs.MkdirAll("/etc/systemd", 0755); err != nil {
+			return err
+		}
+		if _, err := IdempotentWrite(ctx, fs, &timesyncd, "/etc/systemd/timesyncd.conf", 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeTimezone(fs afero.Fs, timezone string) error {
+	zoneFile := path.Join(zoneInfoDir, timezone)
+	if _, err := fs.Stat(zoneFile); err != nil {
+		return fmt.Errorf("timezone %s is not available in the image: %w", timezone, err)
+	}
+
+	if err := afero.WriteFile(fs, "/etc/timezone", []byte(timezone+"\n"), 0644); err != nil {
+		return err
+	}
+
+	if err := fs.Remove("/etc/localtime"); err != nil && !errors.Is(err, afero.ErrFileNotFound) {
+		return err
+	}
+	// relative like the one tzdata creates so it resolves inside and outside the container
+	return utility.Symlink(fs, path.Join("..", zoneFile), "/etc/localtime")
+}
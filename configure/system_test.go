@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemSettingsEmptyIsNoop(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, writeSystemSettings(context.Background(), fs, SystemConfig{}))
+	for _, name := range []string{"/etc/timezone", "/etc/default/locale", "/etc/systemd/timesyncd.conf"} {
+		exists, err := afero.Exists(fs, name)
+		assert.NoError(t, err)
+		assert.False(t, exists, name)
+	}
+}
+
+func TestSystemSettingsLocale(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	cfg := SystemConfig{Locale: "en_US.UTF-8", ExtraLocales: []string{"de_DE.UTF-8"}}
+	assert.NoError(t, writeSystemSettings(context.Background(), fs, cfg))
+	locale, err := afero.ReadFile(fs, "/etc/default/locale")
+	assert.NoError(t, err)
+	assert.Equal(t, "LANG=en_US.UTF-8\n", string(locale))
+	assert.Equal(t, []string{"en_US.UTF-8", "de_DE.UTF-8"}, cfg.locales())
+}
+
+func TestSystemSettingsTimesyncd(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	cfg := SystemConfig{NTP: []string{"time1.example.com", "time2.example.com"}, FallbackNTP: []string{"ntp.ubuntu.com"}}
+	assert.NoError(t, writeSystemSettings(context.Background(), fs, cfg))
+	timesyncd, err := afero.ReadFile(fs, "/etc/systemd/timesyncd.conf")
+	assert.NoError(t, err)
+	assert.Equal(t, "# managed by pi-image-builder\n[Time]\nNTP=time1.example.com time2.example.com\nFallbackNTP=ntp.ubuntu.com\n", string(timesyncd))
+
+	fallbackOnly := afero.NewMemMapFs()
+	assert.NoError(t, writeSystemSettings(context.Background(), fallbackOnly, SystemConfig{FallbackNTP: []string{"ntp.ubuntu.com"}}))
+	fallback, fallbackErr := afero.ReadFile(fallbackOnly, "/etc/systemd/timesyncd.conf")
+	assert.NoError(t, fallbackErr)
+	assert.Equal(t, "# managed by pi-image-builder\n[Time]\nFallbackNTP=ntp.ubuntu.com\n", string(fallback))
+}
+
+func TestSystemSettingsTimezone(t *testing.T) {
+	root := t.TempDir()
+	fs := afero.NewBasePathFs(afero.NewOsFs(), root)
+	assert.NoError(t, fs.MkdirAll("/usr/share/zoneinfo/America", 0755))
+	assert.NoError(t, afero.WriteFile(fs, "/usr/share/zoneinfo/America/Chicago", []byte("TZif"), 0644))
+	assert.NoError(t, fs.MkdirAll("/etc", 0755))
+	assert.NoError(t, afero.WriteFile(fs, "/etc/localtime", []byte("old"), 0644))
+
+	assert.NoError(t, writeSystemSettings(context.Background(), fs, SystemConfig{Timezone: "America/Chicago"}))
+
+	timezone, err := afero.ReadFile(fs, "/etc/timezone")
+	assert.NoError(t, err)
+	assert.Equal(t, "America/Chicago\n", string(timezone))
+
+	target, linkErr := os.Readlink(filepath.Join(root, "etc/localtime"))
+	assert.NoError(t, linkErr)
+	assert.Equal(t, "../usr/share/zoneinfo/America/Chicago", target)
+
+	assert.Error(t, writeSystemSettings(context.Background(), fs, SystemConfig{Timezone: "Mars/Olympus"}))
+	assert.Error(t, writeSystemSettings(context.Background(), fs, SystemConfig{Timezone: "../../etc/passwd"}))
+}
+
+func TestSystemSettingsValidate(t *testing.T) {
+	assert.Error(t, SystemConfig{Locale: "en US"}.Validate())
+	assert.Error(t, SystemConfig{ExtraLocales: []string{"de_DE.UTF-8"}}.Validate())
+	assert.Error(t, SystemConfig{NTP: []string{"a b"}}.Validate())
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"errors"
+	"path/filepath"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+// Target is a root filesystem being configured, whether it's a mounted image, a flashed device, or a directory another
+// tool produced. Fs and Chroot are both built from Root, so the files a step writes are the ones its commands see.
+// Steps still take the fs and chroot runner they use rather than the whole Target, callers pass Target.Fs and
+// Target.Chroot, so a step that only writes files can be run against an in memory fs.
+type Target struct {
+	Fs     afero.Fs
+	Root   string
+	Chroot ChrootRunner
+}
+
+// NewTarget roots Fs at root on host and runs commands in root the way chrootMode picks, see NewChrootRunner.
+func NewTarget(host afero.Fs, root string, chrootMode string, runner utility.Runner) (Target, error) {
+	if root == "" {
+		return Target{}, errors.New("the root to configure can't be empty")
+	}
+	// nspawn and chroot resolve root against the working directory, BasePathFs wants it absolute
+	absolute, absErr := filepath.Abs(root)
+	if absErr != nil {
+		return Target{}, absErr
+	}
+	chroot, chrootErr := NewChrootRunner(chrootMode, absolute, runner)
+	if chrootErr != nil {
+		return Target{}, chrootErr
+	}
+	return Target{Fs: afero.NewBasePathFs(host, absolute), Root: absolute, Chroot: chroot}, nil
+}
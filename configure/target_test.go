@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTarget(t *testing.T) {
+	root := t.TempDir()
+	runner := &utility.FakeRunner{}
+	target, err := NewTarget(afero.NewOsFs(), root, ChrootPlain, runner)
+	assert.NoError(t, err)
+	assert.Equal(t, root, target.Root)
+	assert.Equal(t, BindChrootRunner{Root: root, Runner: runner}, target.Chroot)
+
+	// what steps write through Fs lands in the directory commands run in
+	assert.NoError(t, target.Fs.MkdirAll("/etc", 0755))
+	assert.NoError(t, afero.WriteFile(target.Fs, "/etc/hostname", []byte("pi\n"), 0644))
+	contents, readErr := os.ReadFile(filepath.Join(root, "etc", "hostname"))
+	assert.NoError(t, readErr)
+	assert.Equal(t, "pi\n", string(contents))
+
+	relative, err := NewTarget(afero.NewOsFs(), "rootfs", ChrootNspawn, runner)
+	assert.NoError(t, err)
+	absolute, absErr := filepath.Abs("rootfs")
+	assert.NoError(t, absErr)
+	assert.Equal(t, absolute, relative.Root)
+	assert.Equal(t, NspawnRunner{Root: absolute}, relative.Chroot)
+
+	_, emptyErr := NewTarget(afero.NewOsFs(), "", ChrootPlain, runner)
+	assert.Error(t, emptyErr)
+	_, modeErr := NewTarget(afero.NewOsFs(), root, "docker", runner)
+	assert.Error(t, modeErr)
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+// ErrComplexInstall is returned by EnableUnit for units whose [Install] section needs systemctl to interpret.
+var ErrComplexInstall = errors.New("unit install section needs systemctl")
+
+// unitDirs are searched in systemd's order, the first match wins.
+var unitDirs = []string{"/etc/systemd/system", "/usr/lib/systemd/system", "/lib/systemd/system"}
+
+type unitInstall struct {
+	WantedBy   []string
+	RequiredBy []string
+	Alias      []string
+}
+
+// parseInstall reads a unit's [Install] section. Also=, DefaultInstance=, and specifiers pull in more units or
+// depend on the instance, those are left to systemctl.
+func parseInstall(unit io.Reader) (unitInstall, error) {
+	var install unitInstall
+	section := ""
+	scanner := bufio.NewScanner(unit)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line
+			continue
+		}
+		if section != "[Install]" {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return unitInstall{}, fmt.Errorf("invalid install line: %q", line)
+		}
+		key = strings.TrimSpace(key)
+		values := strings.Fields(value)
+		if strings.Contains(value, "%") || strings.HasSuffix(value, "\\") {
+			return unitInstall{}, fmt.Errorf("%w: %s", ErrComplexInstall, line)
+		}
+		switch key {
+		case "WantedBy":
+			install.WantedBy = append(install.WantedBy, values...)
+		case "RequiredBy":
+			install.RequiredBy = append(install.RequiredBy, values...)
+		case "Alias":
+			install.Alias = append(install.Alias, values...)
+		default:
+			return unitInstall{}, fmt.Errorf("%w: %s", ErrComplexInstall, key)
+		}
+	}
+	return install, scanner.Err()
+}
+
+// findUnit returns where unitName lives in the image.
+func findUnit(fs afero.Fs, unitName string) (string, error) {
+	for _, dir := range unitDirs {
+		candidate := path.Join(dir, unitName)
+		exists, err := afero.Exists(fs, candidate)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("unit %s not found in %s", unitName, strings.Join(unitDirs, ", "))
+}
+
+// replaceSymlink points name at target, replacing whatever was there so enabling twice is harmless.
+func replaceSymlink(fs afero.Fs, target string, name string) error {
+	if err := fs.MkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+	if err := fs.Remove(name); err != nil && !errors.Is(err, afero.ErrFileNotFound) {
+		return err
+	}
+	return utility.Symlink(fs, target, name)
+}
+
+// EnableUnit does what systemctl enable does for simple units: it links the unit into the .wants and .requires
+// directories of every target in its [Install] section and creates its aliases. Template units and install sections
+// it can't follow return ErrComplexInstall.
+func EnableUnit(fs afero.Fs, unitName string) error {
+	if !strings.Contains(unitName, ".") {
+		unitName += ".service"
+	}
+	if strings.Contains(unitName, "@") {
+		return fmt.Errorf("%w: %s is a template", ErrComplexInstall, unitName)
+	}
+
+	unitPath, findErr := findUnit(fs, unitName)
+	if findErr != nil {
+		return findErr
+	}
+
+	unit, openErr := fs.Open(unitPath)
+	if openErr != nil {
+		return openErr
+	}
+	defer utility.WrappedClose(unit)
+
+	install, parseErr := parseInstall(unit)
+	if parseErr != nil {
+		return fmt.Errorf("could not enable %s: %w", unitName, parseErr)
+	}
+	if len(install.WantedBy)+len(install.RequiredBy)+len(install.Alias) == 0 {
+		return fmt.Errorf("unit %s has no install section to enable", unitName)
+	}
+
+	links := make([]string, 0)
+	for _, target := range install.WantedBy {
+		links = append(links, path.Join("/etc/systemd/system", target+".wants", unitName))
+	}
+	for _, target := range install.RequiredBy {
+		links = append(links, path.Join("/etc/systemd/system", target+".requires", unitName))
+	}
+	for _, alias := range install.Alias {
+		links = append(links, path.Join("/etc/systemd/system", alias))
+	}
+	for _, link := range links {
+		if err := replaceSymlink(fs, unitPath, link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enableUnit links the unit directly and only runs systemctl in the image for units EnableUnit can't handle.
+func enableUnit(ctx context.Context, chroot ChrootRunner, fs afero.Fs, unitName string) error {
+	err := EnableUnit(fs, unitName)
+	if errors.Is(err, ErrComplexInstall) {
+		return chroot.Run(ctx, 5*time.Minute, "systemctl", "enable", unitName)
+	}
+	return err
+}
+
+// MaskUnit does what systemctl mask does, it points the unit's name in /etc/systemd/system at /dev/null so nothing
+// can start it, including generators and template instances.
+func MaskUnit(fs afero.Fs, unitName string) error {
+	if !strings.Contains(unitName, ".") {
+		unitName += ".service"
+	}
+	return replaceSymlink(fs, "/dev/null", path.Join("/etc/systemd/system", unitName))
+}
+
+// unmaskUnit removes a mask MaskUnit left behind, units that aren't masked are left alone.
+func unmaskUnit(fs afero.Fs, unitName string) error {
+	if !strings.Contains(unitName, ".") {
+		unitName += ".service"
+	}
+	name := path.Join("/etc/systemd/system", unitName)
+	lstater, ok := fs.(afero.Lstater)
+	if !ok {
+		return nil
+	}
+	info, _, err := lstater.LstatIfPossible(name)
+	if errors.Is(err, afero.ErrFileNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	return fs.Remove(name)
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+const kubeletUnit = `[Unit]
+Description=kubelet: The Kubernetes Node Agent
+
+[Service]
+ExecStart=/usr/bin/kubelet
+
+[Install]
+WantedBy=multi-user.target
+`
+
+func TestParseInstall(t *testing.T) {
+	install, err := parseInstall(strings.NewReader(`[Service]
+WantedBy=ignored.target
+
+[Install]
+# comment
+WantedBy=multi-user.target sysinit.target
+WantedBy=network-online.target
+RequiredBy=cryptsetup.target
+Alias=nft.service
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"multi-user.target", "sysinit.target", "network-online.target"}, install.WantedBy)
+	assert.Equal(t, []string{"cryptsetup.target"}, install.RequiredBy)
+	assert.Equal(t, []string{"nft.service"}, install.Alias)
+}
+
+func TestParseInstallComplex(t *testing.T) {
+	for _, section := range []string{
+		"[Install]\nAlso=other.socket\n",
+		"[Install]\nDefaultInstance=tty1\n",
+		"[Install]\nWantedBy=getty-%i.target\n",
+	} {
+		_, err := parseInstall(strings.NewReader(section))
+		assert.ErrorIs(t, err, ErrComplexInstall, section)
+	}
+}
+
+func TestFindUnit(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "/lib/systemd/system/kubelet.service", []byte(kubeletUnit), 0644))
+
+	found, err := findUnit(fs, "kubelet.service")
+	assert.NoError(t, err)
+	assert.Equal(t, "/lib/systemd/system/kubelet.service", found)
+
+	assert.NoError(t, afero.WriteFile(fs, "/etc/systemd/system/kubelet.service", []byte(kubeletUnit), 0644))
+	found, err = findUnit(fs, "kubelet.service")
+	assert.NoError(t, err)
+	assert.Equal(t, "/etc/systemd/system/kubelet.service", found)
+
+	_, err = findUnit(fs, "missing.service")
+	assert.Error(t, err)
+}
+
+// MemMapFs can't hold symlinks, so the link tests run against a temporary directory.
+func TestEnableUnit(t *testing.T) {
+	root := t.TempDir()
+	fs := afero.NewBasePathFs(afero.NewOsFs(), root)
+	assert.NoError(t, fs.MkdirAll("/lib/systemd/system", 0755))
+	assert.NoError(t, afero.WriteFile(fs, "/lib/systemd/system/nftables.service",
+		[]byte("[Install]\nWantedBy=sysinit.target\nRequiredBy=network-pre.target\nAlias=nft.service\n"), 0644))
+
+	assert.NoError(t, EnableUnit(fs, "nftables"))
+	// enabling twice must not fail on the existing links
+	assert.NoError(t, EnableUnit(fs, "nftables.service"))
+
+	for _, link := range []string{
+		"etc/systemd/system/sysinit.target.wants/nftables.service",
+		"etc/systemd/system/network-pre.target.requires/nftables.service",
+		"etc/systemd/system/nft.service",
+	} {
+		target, linkErr := os.Readlink(filepath.Join(root, link))
+		assert.NoError(t, linkErr, link)
+		assert.Equal(t, "/lib/systemd/system/nftables.service", target)
+	}
+}
+
+func TestMaskUnit(t *testing.T) {
+	root := t.TempDir()
+	fs := afero.NewBasePathFs(afero.NewOsFs(), root)
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, MaskUnit(fs, "serial-getty@ttyS0"))
+	}
+	target, linkErr := os.Readlink(filepath.Join(root, "etc/systemd/system/serial-getty@ttyS0.service"))
+	assert.NoError(t, linkErr)
+	assert.Equal(t, "/dev/null", target)
+
+	assert.NoError(t, unmaskUnit(fs, "serial-getty@ttyS0"))
+	assert.NoError(t, unmaskUnit(fs, "serial-getty@ttyS0"))
+	_, statErr := os.Lstat(filepath.Join(root, "etc/systemd/system/serial-getty@ttyS0.service"))
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+func TestEnableUnitErrors(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.ErrorIs(t, EnableUnit(fs, "getty@tty1.service"), ErrComplexInstall)
+	assert.Error(t, EnableUnit(fs, "missing.service"))
+
+	assert.NoError(t, afero.WriteFile(fs, "/lib/systemd/system/static.service", []byte("[Service]\n"), 0644))
+	err := EnableUnit(fs, "static.service")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrComplexInstall)
+}
+
+func TestEnableUnitFallsBackToSystemctl(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "/lib/systemd/system/docker.service",
+		[]byte("[Install]\nWantedBy=multi-user.target\nAlso=docker.socket\n"), 0644))
+	chroot := &recordingChroot{}
+
+	assert.NoError(t, enableUnit(context.Background(), chroot, fs, "docker"))
+	assert.Equal(t, []string{"systemctl enable docker"}, chroot.commands)
+}
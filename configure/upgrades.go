@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const aptConfDir = "/etc/apt/apt.conf.d"
+
+var rebootTimePattern = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+
+// UpgradesConfig drives unattended-upgrades. Blacklist entries are python regular expressions matched against the
+// start of the package name.
+type UpgradesConfig struct {
+	Enabled        bool     `yaml:"enabled"`
+	AllowedOrigins []string `yaml:"allowedOrigins"`
+	Blacklist      []string `yaml:"blacklist"`
+	// AutomaticReboot restarts the node at RebootTime (HH:MM local time) when an upgrade asks for it.
+	AutomaticReboot   bool   `yaml:"automaticReboot"`
+	RebootTime        string `yaml:"rebootTime"`
+	AutocleanInterval int    `yaml:"autocleanInterval"`
+}
+
+func DefaultUpgradesConfig() UpgradesConfig {
+	return UpgradesConfig{
+		Enabled: true,
+		AllowedOrigins: []string{
+			"${distro_id}:${distro_codename}",
+			"${distro_id}:${distro_codename}-security",
+			"${distro_id}ESMApps:${distro_codename}-apps-security",
+			"${distro_id}ESM:${distro_codename}-infra-security",
+		},
+		Blacklist:         []string{"linux-", ContainerdPackage},
+		RebootTime:        "04:00",
+		AutocleanInterval: 7,
+	}
+}
+
+func (u UpgradesConfig) Validate() error {
+	if len(u.AllowedOrigins) == 0 {
+		return errors.New("unattended upgrades need at least one allowed origin")
+	}
+	for _, entry := range append(append([]string{}, u.AllowedOrigins...), u.Blacklist...) {
+		if entry == "" || strings.ContainsAny(entry, "\"\n;") {
+			return fmt.Errorf("invalid unattended upgrades entry: %q", entry)
+		}
+	}
+	if u.AutomaticReboot && !rebootTimePattern.MatchString(u.RebootTime) {
+		return fmt.Errorf("reboot time must be HH:MM, got: %q", u.RebootTime)
+	}
+	if u.AutocleanInterval < 0 {
+		return fmt.Errorf("invalid autoclean interval: %d", u.AutocleanInterval)
+	}
+	return nil
+}
+
+// UnattendedUpgrades installs unattended-upgrades and writes the apt periodic and origin configuration.
+func UnattendedUpgrades(ctx context.Context, chroot ChrootRunner, fs afero.Fs, cfg UpgradesConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	ctx, span := telemetry.Start(ctx, "configure unattended upgrades")
+	defer span.End()
+
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	if err := chroot.Run(ctx, 20*time.Minute, "apt-get", "install", "--no-install-recommends", "-y", "unattended-upgrades"); err != nil {
+		return err
+	}
+
+	return writeUpgradesConfig(ctx, fs, cfg)
+}
+
+func writeUpgradesConfig(ctx context.Context, fs afero.Fs, cfg UpgradesConfig) error {
+	if err := fs.MkdirAll(aptConfDir, 0755); err != nil {
+		return err
+	}
+
+	for _, name := range []string{"20auto-upgrades", "50unattended-upgrades"} {
+		rendered, renderErr := utility.RenderTemplate(ctx, configFiles, "files/"+name+".template", cfg)
+		if renderErr != nil {
+			return renderErr
+		}
+		if _, err := IdempotentWrite(ctx, fs, &rendered, aptConfDir+"/"+name, 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteUpgradesConfigDefaults(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	cfg := DefaultUpgradesConfig()
+	assert.NoError(t, cfg.Validate())
+	assert.NoError(t, writeUpgradesConfig(context.Background(), fs, cfg))
+
+	periodic, err := afero.ReadFile(fs, "/etc/apt/apt.conf.d/20auto-upgrades")
+	assert.NoError(t, err)
+	assert.Contains(t, string(periodic), "APT::Periodic::Unattended-Upgrade \"1\";\n")
+	assert.Contains(t, string(periodic), "APT::Periodic::AutocleanInterval \"7\";\n")
+
+	upgrades, upgradesErr := afero.ReadFile(fs, "/etc/apt/apt.conf.d/50unattended-upgrades")
+	assert.NoError(t, upgradesErr)
+	assert.Contains(t, string(upgrades), "Unattended-Upgrade::Package-Blacklist {\n\t\"linux-\";\n\t\"containerd.io\";\n};\n")
+	assert.Contains(t, string(upgrades), "\t\"${distro_id}:${distro_codename}-security\";\n")
+	assert.Contains(t, string(upgrades), "Unattended-Upgrade::Automatic-Reboot \"false\";\n")
+	assert.NotContains(t, string(upgrades), "Automatic-Reboot-Time")
+}
+
+func TestWriteUpgradesConfigReboot(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	cfg := DefaultUpgradesConfig()
+	cfg.AutomaticReboot = true
+	cfg.RebootTime = "03:30"
+	cfg.Blacklist = append(cfg.Blacklist, "raspi-firmware$")
+	assert.NoError(t, writeUpgradesConfig(context.Background(), fs, cfg))
+
+	upgrades, err := afero.ReadFile(fs, "/etc/apt/apt.conf.d/50unattended-upgrades")
+	assert.NoError(t, err)
+	assert.Contains(t, string(upgrades), "\t\"raspi-firmware$\";\n")
+	assert.Contains(t, string(upgrades), "Unattended-Upgrade::Automatic-Reboot \"true\";\n")
+	assert.Contains(t, string(upgrades), "Unattended-Upgrade::Automatic-Reboot-Time \"03:30\";\n")
+}
+
+func TestUpgradesConfigValidate(t *testing.T) {
+	invalidEntry := DefaultUpgradesConfig()
+	invalidEntry.Blacklist = []string{`linux-"; "`}
+	assert.Error(t, invalidEntry.Validate())
+
+	invalidTime := DefaultUpgradesConfig()
+	invalidTime.AutomaticReboot = true
+	invalidTime.RebootTime = "25:00"
+	assert.Error(t, invalidTime.Validate())
+
+	noOrigins := DefaultUpgradesConfig()
+	noOrigins.AllowedOrigins = nil
+	assert.Error(t, noOrigins.Validate())
+}
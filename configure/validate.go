@@ -0,0 +1,353 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/distro"
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+)
+
+// fileCheck inspects a rendered embedded file beyond it rendering at all.
+type fileCheck func(rendered []byte) error
+
+// embeddedFile is how ValidateFiles exercises one file under files/. Templates are rendered once per sample, files
+// without samples are checked as they are.
+type embeddedFile struct {
+	samples []any
+	checks  []fileCheck
+}
+
+// embeddedFiles covers every file in the embed, ValidateFiles fails on a file missing from here so a new template
+// can't skip validation. Samples are picked to take every branch a template has.
+func embeddedFiles() map[string]embeddedFile {
+	staticNetwork := NetworkConfig{
+		Interface:   "eth0",
+		Addresses:   []string{"10.0.0.10/24", "fd00::10/64"},
+		Gateway4:    "10.0.0.1",
+		Gateway6:    "fd00::1",
+		Nameservers: []string{"10.0.0.1"},
+		Search:      []string{"lan"},
+		VLAN:        20,
+		MTU:         9000,
+	}
+	cloudInit := DefaultCloudInitConfig()
+	passwordCloudInit := DefaultCloudInitConfig()
+	passwordCloudInit.Hostname = "pi-01"
+	passwordCloudInit.PasswordAuth = true
+	passwordCloudInit.PasswordHash = "$6$rounds=4096$salt$hash"
+	passwordCloudInit.LockDefaultUser = false
+	kubeadm := KubeadmConfig{
+		Mode:              KubeadmInit,
+		APIServerEndpoint: "10.0.0.10:6443",
+		Token:             "abcdef.0123456789abcdef",
+		NodeLabels:        map[string]string{"node.kubernetes.io/pi": "true"},
+		Taints:            []Taint{{Key: "dedicated", Value: "storage", Effect: "NoSchedule"}},
+		AllowSwap:         true,
+	}
+	join := kubeadm
+	join.Mode = KubeadmJoin
+	join.CACertHashes = []string{"sha256:0123456789abcdef"}
+	expand := ExpandScript{
+		VolumeGroup: utility.VolumeGroupName,
+		Volume:      utility.CSILogicalVolume,
+		Percent:     100,
+		MinimumFree: expandMinimumFree,
+		Device:      "/dev/mapper/csilv_crypt",
+		KeyFile:     "/etc/cryptsetup-keys.d/csilv_crypt.key",
+		CryptName:   "csilv_crypt",
+		Stamp:       expandStamp,
+	}
+	kubelet := KubeletConfig{FeatureGates: map[string]bool{"NodeSwap": true}}.withDefaults()
+	systemd := KubernetesSystemd{KubeletPath: "/usr/local/bin/kubelet", ConfigPath: kubeletConfigPath, CgroupDriver: "systemd"}
+	upgrades := DefaultUpgradesConfig()
+	upgrades.Enabled = true
+	upgrades.AutomaticReboot = true
+	upgrades.RebootTime = "03:00"
+	upgrades.Blacklist = []string{"linux-raspi"}
+	system := SystemConfig{NTP: []string{"time.lan"}, FallbackNTP: []string{"ntp.ubuntu.com"}}
+	wifi := struct {
+		WiFiConfig
+		PSK string
+	}{WiFiConfig: WiFiConfig{Interface: "wlan0", SSID: "lab", Country: "US"}, PSK: "correct horse battery"}
+	docker := DockerRepo(distro.Ubuntu)
+	console := true
+	serial := SerialConfig{Console: &console, DisableBluetooth: true}
+	watchdog := WatchdogConfig{Enabled: true, Daemon: WatchdogDaemonConfig{Enabled: true, Ping: []string{"10.0.0.1"}, MaxLoad5: 18, MaxLoad15: 12}}.withDefaults()
+
+	script := []fileCheck{checkShebang}
+	service := []fileCheck{checkINI("[Unit]", "[Service]", "[Install]")}
+	yamlDocuments := []fileCheck{validateYAMLDocuments}
+
+	return map[string]embeddedFile{
+		"06_user.cfg.yml.template":        {samples: []any{cloudInit, passwordCloudInit}, checks: yamlDocuments},
+		"07_network.cfg.yml.template":     {samples: []any{DefaultNetworkConfig(), staticNetwork}, checks: yamlDocuments},
+		"08_wifi.cfg.yml.template":        {samples: []any{wifi}, checks: yamlDocuments},
+		"09_hostname.cfg.yml":             {checks: yamlDocuments},
+		"20auto-upgrades.template":        {samples: []any{DefaultUpgradesConfig(), upgrades}},
+		"50unattended-upgrades.template":  {samples: []any{DefaultUpgradesConfig(), upgrades}},
+		"Deb822.template":                 {samples: []any{docker}, checks: []fileCheck{checkDeb822(docker)}},
+		"cfg80211-regdom.conf.template":   {samples: []any{wifi.WiFiConfig}},
+		"containerd-config.toml.template": {samples: []any{CgroupUnified, CgroupLegacy}},
+		"decompressKernel.bash":           {checks: script},
+		"expand-volume.bash.template":     {samples: []any{expand, ExpandScript{VolumeGroup: utility.VolumeGroupName, Volume: "csilv", Percent: 50, Device: "/dev/rootvg/csilv", Stamp: expandStamp}}, checks: script},
+		"expand-volume.service.template":  {samples: []any{expand}, checks: []fileCheck{checkINI("[Unit]", "[Service]", "[Install]")}},
+		"journald.conf.template":          {samples: []any{JournaldConfig{}.withDefaults()}, checks: []fileCheck{checkINI("[Journal]")}},
+		"kubeadm-bootstrap.bash.template": {samples: []any{KubeadmBootstrapScript{Mode: KubeadmInit, ConfigPath: kubeadmConfigPath, TokenPath: kubeadmTokenPath}}, checks: script},
+		"kubeadm-bootstrap.service":       {checks: service},
+		"kubeadm-drop-in.template":        {samples: []any{systemd}, checks: []fileCheck{checkINI("[Service]")}},
+		"kubeadm.yaml.template":           {samples: []any{kubeadm, join, KubeadmConfig{Mode: KubeadmJoin, APIServerEndpoint: "10.0.0.10:6443"}}, checks: yamlDocuments},
+		"kubelet-config.yaml.template": {samples: []any{KubeletConfigFile{
+			CgroupDriver:        "systemd",
+			MaxPods:             kubelet.MaxPods,
+			SerializeImagePulls: *kubelet.SerializeImagePulls,
+			SystemReserved:      kubelet.SystemReserved,
+			EvictionHard:        kubelet.EvictionHard,
+			FeatureGates:        kubelet.FeatureGates,
+		}}, checks: yamlDocuments},
+		"kubelet.service.template":       {samples: []any{systemd}, checks: service},
+		"nftables.conf.template":         {samples: []any{FirewallConfig{}.withDefaults().rules()}},
+		"node_exporter.service.template": {samples: []any{NodeExporterUnit{User: nodeExporterUser, Binary: nodeExporterBinary, ListenAddress: ":9100", Collectors: []string{"systemd"}}}, checks: service},
+		"nut.conf":                       {},
+		"preload-images.bash.template":   {samples: []any{PreloadScript{Images: []string{"docker.io/library/nginx:latest"}, Archive: preloadArchive}}, checks: script},
+		"preload-images.service":         {checks: service},
+		"promisc.sh":                     {checks: script},
+		"register-node.bash.template":    {samples: []any{RegistrationScript{URL: "https://provision.lan/nodes", TokenPath: registrationTokenPath, ReleasePath: releasePath, ReleaseKeys: releaseKeys(), Attempts: 10}}, checks: script},
+		"register-node.service":          {checks: service},
+		"set-hostname.bash.template":     {samples: []any{HostnameScript{Interface: "eth0", Expression: `pi-$(cat /sys/class/net/eth0/address | tr -d :)`}}, checks: script},
+		"set-hostname.service":           {checks: service},
+		"ssh-host-keys.conf":             {checks: []fileCheck{checkINI("[Service]")}},
+		"sshd-hardening.conf.template":   {samples: []any{SSHDropIn{SSHConfig: SSHConfig{AllowUsers: []string{"kat"}}.withDefaults(), PasswordAuthentication: true}}},
+		"timesyncd.conf.template":        {samples: []any{system}, checks: []fileCheck{checkINI("[Time]")}},
+		"watchdog-system.conf.template":  {samples: []any{WatchdogConfig{}.withDefaults(), watchdog}, checks: []fileCheck{checkINI("[Manager]")}},
+		"watchdog.conf.template":         {samples: []any{watchdog.conf(), WatchdogConfig{RuntimeSec: "10s"}.withDefaults().conf()}},
+		"ups.conf":                       {},
+		"upsd.conf":                      {},
+		"usercfg.txt.template":           {samples: []any{FirmwareConfig{}.withDefaults(), FirmwareConfig{}.withDefaults().withSerial(serial)}},
+		"wifi-credentials.bash.template": {samples: []any{WiFiCredentialsScript{Interface: "wlan0", SSID: "lab", Country: "US", CredentialsPath: wifiCredentialsPath, DropInPath: wifiDropInPath}}, checks: script},
+		"wifi-credentials.service":       {checks: service},
+		"zramswap.template":              {samples: []any{ZramConfig{Enabled: true}.withDefaults()}},
+	}
+}
+
+// ValidateFiles renders every embedded template with representative data and checks what comes out: yaml parses,
+// units and systemd configs have their sections, scripts have a shebang, and the docker apt source round trips. It
+// also checks the fstab mounts and layout produce. Every bad file is reported, not just the first.
+func ValidateFiles(ctx context.Context, mounts []Mount, layout partition.VolumeLayout) error {
+	ctx, span := telemetry.Start(ctx, "validate embedded files")
+	defer span.End()
+
+	problems := validateFiles(ctx, configFiles, embeddedFiles())
+	if mounts == nil {
+		mounts = DefaultMounts()
+	}
+	if err := checkFstab(mounts, layout); err != nil {
+		problems = append(problems, fmt.Errorf("fstab: %w", err))
+	}
+	return errors.Join(problems...)
+}
+
+// validateFiles checks every file under files/ in fsys, returning one error per bad file.
+func validateFiles(ctx context.Context, fsys fs.FS, files map[string]embeddedFile) []error {
+	entries, readErr := fs.ReadDir(fsys, "files")
+	if readErr != nil {
+		return []error{readErr}
+	}
+
+	var problems []error
+	for _, entry := range entries {
+		name := entry.Name()
+		file, known := files[name]
+		if !known {
+			problems = append(problems, fmt.Errorf("%s: no representative data to validate it with", name))
+			continue
+		}
+		if err := validateFile(ctx, fsys, name, file); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return problems
+}
+
+func validateFile(ctx context.Context, fsys fs.FS, name string, file embeddedFile) error {
+	var rendered [][]byte
+	if len(file.samples) == 0 {
+		raw, err := fs.ReadFile(fsys, path.Join("files", name))
+		if err != nil {
+			return err
+		}
+		rendered = append(rendered, raw)
+	}
+	for _, sample := range file.samples {
+		buffer, err := utility.RenderTemplate(ctx, fsys, path.Join("files", name), sample)
+		if err != nil {
+			return err
+		}
+		rendered = append(rendered, buffer.Bytes())
+	}
+
+	var problems []error
+	for _, output := range rendered {
+		for _, check := range file.checks {
+			if err := check(output); err != nil {
+				problems = append(problems, err)
+			}
+		}
+	}
+	return errors.Join(problems...)
+}
+
+func checkShebang(rendered []byte) error {
+	if !bytes.HasPrefix(rendered, []byte("#!")) {
+		return errors.New("script doesn't start with a shebang")
+	}
+	return nil
+}
+
+// checkINI parses systemd's ini format, a section header, comment, or key=value per line, and requires sections.
+func checkINI(required ...string) fileCheck {
+	return func(rendered []byte) error {
+		sections := map[string]bool{}
+		continued := false
+		scanner := bufio.NewScanner(bytes.NewReader(rendered))
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			wasContinued := continued
+			continued = strings.HasSuffix(text, "\\")
+			switch {
+			case wasContinued, text == "", strings.HasPrefix(text, "#"), strings.HasPrefix(text, ";"):
+			case strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]"):
+				sections[text] = true
+			default:
+				key, _, found := strings.Cut(text, "=")
+				if !found || strings.TrimSpace(key) == "" || strings.ContainsAny(strings.TrimSpace(key), " \t") {
+					return fmt.Errorf("line %d isn't a section or key=value: %q", line, text)
+				}
+				if len(sections) == 0 {
+					return fmt.Errorf("line %d is outside any section", line)
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		var missing []string
+		for _, section := range required {
+			if !sections[section] {
+				missing = append(missing, section)
+			}
+		}
+		if len(missing) != 0 {
+			return fmt.Errorf("missing sections %s", strings.Join(missing, ", "))
+		}
+		return nil
+	}
+}
+
+// parseDeb822 splits a deb822 file into its paragraphs, continuation lines are joined onto their field.
+func parseDeb822(data []byte) ([]map[string]string, error) {
+	var paragraphs []map[string]string
+	var current map[string]string
+	last := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		switch {
+		case strings.TrimSpace(text) == "":
+			current = nil
+		case strings.HasPrefix(text, "#"):
+		case strings.HasPrefix(text, " ") || strings.HasPrefix(text, "\t"):
+			if current == nil || last == "" {
+				return nil, fmt.Errorf("line %d continues a field that doesn't exist", line)
+			}
+			current[last] += "\n" + strings.TrimSpace(text)
+		default:
+			key, value, found := strings.Cut(text, ":")
+			if !found || key == "" || strings.ContainsAny(key, " \t") {
+				return nil, fmt.Errorf("line %d isn't a field: %q", line, text)
+			}
+			if current == nil {
+				current = map[string]string{}
+				paragraphs = append(paragraphs, current)
+			}
+			if _, duplicate := current[key]; duplicate {
+				return nil, fmt.Errorf("line %d repeats field %s", line, key)
+			}
+			current[key] = strings.TrimSpace(value)
+			last = key
+		}
+	}
+	return paragraphs, scanner.Err()
+}
+
+func checkDeb822(repo Deb822Repo) fileCheck {
+	return func(rendered []byte) error {
+		paragraphs, err := parseDeb822(rendered)
+		if err != nil {
+			return err
+		}
+		if len(paragraphs) != 1 {
+			return fmt.Errorf("expected one source, got %d", len(paragraphs))
+		}
+		expected := map[string]string{
+			"Types":         repo.Types,
+			"URIs":          repo.URIs,
+			"Suites":        repo.Suites,
+			"Components":    repo.Components,
+			"Architectures": repo.Arch,
+		}
+		var mismatched []string
+		for key, value := range expected {
+			if paragraphs[0][key] != value {
+				mismatched = append(mismatched, key)
+			}
+		}
+		if len(mismatched) != 0 {
+			sort.Strings(mismatched)
+			return fmt.Errorf("fields don't round trip: %s", strings.Join(mismatched, ", "))
+		}
+		return nil
+	}
+}
+
+// checkFstab requires the six fstab columns on every entry.
+func checkFstab(mounts []Mount, layout partition.VolumeLayout) error {
+	rendered, err := RenderFstab(mounts, layout)
+	if err != nil {
+		return err
+	}
+	for number, line := range strings.Split(string(rendered), "\n") {
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if columns := len(strings.Fields(line)); columns != 6 {
+			return fmt.Errorf("line %d has %d columns instead of 6: %q", number+1, columns, line)
+		}
+	}
+	return nil
+}
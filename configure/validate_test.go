@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateFilesEmbedded(t *testing.T) {
+	assert.NoError(t, ValidateFiles(context.Background(), nil, partition.DefaultVolumeLayout()))
+}
+
+func TestValidateFilesReportsEveryBadFile(t *testing.T) {
+	fsys := fstest.MapFS{
+		"files/good.service":       {Data: []byte("[Unit]\nDescription=fine\n[Service]\nExecStart=/bin/true\n[Install]\nWantedBy=multi-user.target\n")},
+		"files/broken.template":    {Data: []byte("{{.Missing")},
+		"files/no-install.service": {Data: []byte("[Unit]\n[Service]\nExecStart=/bin/true\n")},
+		"files/user.cfg.yml":       {Data: []byte("users: [\n")},
+		"files/unknown.conf":       {Data: []byte("x")},
+	}
+	service := embeddedFile{checks: []fileCheck{checkINI("[Unit]", "[Service]", "[Install]")}}
+	problems := validateFiles(context.Background(), fsys, map[string]embeddedFile{
+		"good.service":       service,
+		"broken.template":    {samples: []any{struct{}{}}},
+		"no-install.service": service,
+		"user.cfg.yml":       {checks: []fileCheck{validateYAMLDocuments}},
+	})
+
+	assert.Len(t, problems, 4)
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, problem.Error())
+	}
+	assert.Contains(t, messages[0], "broken.template")
+	assert.Contains(t, messages[1], "no-install.service: missing sections [Install]")
+	assert.Contains(t, messages[2], "unknown.conf: no representative data")
+	assert.Contains(t, messages[3], "user.cfg.yml")
+}
+
+func TestCheckINI(t *testing.T) {
+	check := checkINI("[Service]")
+	assert.NoError(t, check([]byte("# comment\n[Service]\nExecStart=/bin/sh -c \\\n  'echo hi'\nEnvironment=\"A=b c\"\n")))
+	assert.ErrorContains(t, check([]byte("ExecStart=/bin/true\n[Service]\n")), "outside any section")
+	assert.ErrorContains(t, check([]byte("[Service]\nExecStart /bin/true\n")), "line 2")
+	assert.ErrorContains(t, check([]byte("[Unit]\n")), "missing sections [Service]")
+}
+
+func TestParseDeb822(t *testing.T) {
+	paragraphs, err := parseDeb822([]byte("# docker\nTypes: deb\nURIs: https://download.docker.com/linux/ubuntu\nSigned-By:\n key line one\n key line two\n\nTypes: deb-src\nSuites: jammy\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]string{
+		{"Types": "deb", "URIs": "https://download.docker.com/linux/ubuntu", "Signed-By": "\nkey line one\nkey line two"},
+		{"Types": "deb-src", "Suites": "jammy"},
+	}, paragraphs)
+
+	for _, bad := range []string{" continued\n", "Types deb\n", "Types: deb\nTypes: deb-src\n"} {
+		_, parseErr := parseDeb822([]byte(bad))
+		assert.Error(t, parseErr, bad)
+	}
+}
+
+func TestCheckDeb822(t *testing.T) {
+	repo := Deb822Repo{Types: "deb", URIs: "https://download.docker.com/linux/ubuntu", Suites: "jammy", Components: "stable", Arch: "arm64"}
+	check := checkDeb822(repo)
+	assert.NoError(t, check([]byte("Types: deb\nURIs: https://download.docker.com/linux/ubuntu\nSuites: jammy\nComponents: stable\nArchitectures: arm64\n")))
+	assert.ErrorContains(t, check([]byte("Types: deb\nURIs: https://download.docker.com/linux/ubuntu\nSuites: jammy jammy-updates\nComponents: stable\n")),
+		"Architectures, Suites")
+}
+
+func TestCheckFstab(t *testing.T) {
+	assert.NoError(t, checkFstab(DefaultMounts(), partition.DefaultVolumeLayout()))
+	assert.Error(t, checkFstab([]Mount{{Device: "/dev/sda1", MountPoint: "/mnt/my disk", FSType: "ext4", Options: "defaults"}}, partition.DefaultVolumeLayout()))
+}
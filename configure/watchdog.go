@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const (
+	watchdogDropInPath = "/etc/systemd/system.conf.d/pi-image-builder-watchdog.conf"
+	watchdogConfPath   = "/etc/watchdog.conf"
+	watchdogDevice     = "/dev/watchdog"
+	watchdogDTParam    = "dtparam=watchdog=on"
+	// maximumWatchdogTimeout is the longest the bcm2835 watchdog can count down, in seconds.
+	maximumWatchdogTimeout = 15
+)
+
+var watchdogTimeoutPattern = regexp.MustCompile(`^[0-9]+(s|min)?$`)
+
+// WatchdogConfig turns on the bcm2835 hardware watchdog so a hung node reboots itself instead of waiting for someone
+// to power cycle it. The zero value leaves the watchdog off.
+type WatchdogConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// RuntimeSec is how long systemd can go without petting the watchdog before the board resets. It defaults to 15s,
+	// the most the hardware supports, unless the daemon owns the device.
+	RuntimeSec string `yaml:"runtimeSec"`
+	// RebootSec bounds how long a reboot can hang before the watchdog forces it.
+	RebootSec string               `yaml:"rebootSec"`
+	Daemon    WatchdogDaemonConfig `yaml:"daemon"`
+}
+
+// WatchdogDaemonConfig installs the watchdog package, which reboots the node when its checks fail even though the
+// kernel is still scheduling.
+type WatchdogDaemonConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Ping addresses must answer or the node reboots, it defaults to the static ipv4 gateway when there is one.
+	Ping []string `yaml:"ping"`
+	// MaxLoad values of zero skip that load check.
+	MaxLoad1  int `yaml:"maxLoad1"`
+	MaxLoad5  int `yaml:"maxLoad5"`
+	MaxLoad15 int `yaml:"maxLoad15"`
+	// Interval is seconds between checks.
+	Interval int `yaml:"interval"`
+}
+
+// watchdogConf is rendered into watchdog.conf. Only one process can hold the device open, so the daemon only gets it
+// when systemd isn't using it and reboots through systemd otherwise.
+type watchdogConf struct {
+	WatchdogDaemonConfig
+	Device  string
+	Timeout int
+}
+
+func (w WatchdogConfig) withDefaults() WatchdogConfig {
+	if w.RuntimeSec == "" && !w.Daemon.Enabled {
+		w.RuntimeSec = "15s"
+	}
+	if w.RebootSec == "" {
+		w.RebootSec = "2min"
+	}
+	if w.Daemon.Interval == 0 {
+		w.Daemon.Interval = 10
+	}
+	if w.Daemon.MaxLoad1 == 0 {
+		w.Daemon.MaxLoad1 = 24
+	}
+	return w
+}
+
+func (w WatchdogConfig) Validate() error {
+	for _, timeout := range []string{w.RuntimeSec, w.RebootSec} {
+		if timeout != "" && !watchdogTimeoutPattern.MatchString(timeout) {
+			return fmt.Errorf("invalid watchdog timeout: %q", timeout)
+		}
+	}
+	if w.RuntimeSec != "" {
+		if runtime := timespan(w.RuntimeSec); runtime > maximumWatchdogTimeout*time.Second {
+			return fmt.Errorf("runtime watchdog can be at most %ds on the bcm2835, got: %s", maximumWatchdogTimeout, w.RuntimeSec)
+		}
+	}
+	for _, address := range w.Daemon.Ping {
+		if _, err := netip.ParseAddr(address); err != nil {
+			return fmt.Errorf("invalid watchdog ping address: %w", err)
+		}
+	}
+	for _, load := range []int{w.Daemon.MaxLoad1, w.Daemon.MaxLoad5, w.Daemon.MaxLoad15} {
+		if load < 0 {
+			return fmt.Errorf("watchdog max load can not be negative, got: %d", load)
+		}
+	}
+	// an interval of zero is left to the default
+	if w.Daemon.Interval < 0 || w.Daemon.Interval >= maximumWatchdogTimeout {
+		return fmt.Errorf("watchdog interval must be between 1 and %d, got: %d", maximumWatchdogTimeout-1, w.Daemon.Interval)
+	}
+	return nil
+}
+
+// timespan converts a timeout matching watchdogTimeoutPattern, systemd reads a bare number as seconds.
+func timespan(timeout string) time.Duration {
+	if strings.HasSuffix(timeout, "min") {
+		minutes, _ := strconv.Atoi(strings.TrimSuffix(timeout, "min"))
+		return time.Duration(minutes) * time.Minute
+	}
+	seconds, _ := strconv.Atoi(strings.TrimSuffix(timeout, "s"))
+	return time.Duration(seconds) * time.Second
+}
+
+func (w WatchdogConfig) conf() watchdogConf {
+	conf := watchdogConf{WatchdogDaemonConfig: w.Daemon, Timeout: maximumWatchdogTimeout}
+	if w.RuntimeSec == "" {
+		conf.Device = watchdogDevice
+	}
+	return conf
+}
+
+// Watchdog enables the hardware watchdog in usercfg.txt and has systemd pet it, optionally installing the watchdog
+// daemon for gateway and load checks. It does nothing when disabled and has to run after the firmware config is
+// rendered.
+func Watchdog(ctx context.Context, chroot ChrootRunner, fs afero.Fs, cfg WatchdogConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	ctx, span := telemetry.Start(ctx, "configure watchdog")
+	defer span.End()
+
+	cfg = cfg.withDefaults()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	if err := appendConfigLines(fs, firmwareConfigPath, []string{watchdogDTParam}); err != nil {
+		return err
+	}
+
+	dropIn, renderErr := utility.RenderTemplate(ctx, configFiles, "files/watchdog-system.conf.template", cfg)
+	if renderErr != nil {
+		return renderErr
+	}
+	if err := fs.MkdirAll("/etc/systemd/system.conf.d", 0755); err != nil {
+		return err
+	}
+	if _, err := IdempotentWrite(ctx, fs, &dropIn, watchdogDropInPath, 0644); err != nil {
+		return err
+	}
+
+	if !cfg.Daemon.Enabled {
+		return nil
+	}
+
+	if err := chroot.Run(ctx, 20*time.Minute, "apt-get", "install", "--no-install-recommends", "-y", "watchdog"); err != nil {
+		return err
+	}
+	conf, confErr := utility.RenderTemplate(ctx, configFiles, "files/watchdog.conf.template", cfg.conf())
+	if confErr != nil {
+		return confErr
+	}
+	if _, err := IdempotentWrite(ctx, fs, &conf, watchdogConfPath, 0644); err != nil {
+		return err
+	}
+	return enableUnit(ctx, chroot, fs, "watchdog")
+}
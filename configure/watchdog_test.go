@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchdogDisabled(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	chroot := &recordingChroot{}
+	assert.NoError(t, Watchdog(context.Background(), chroot, fs, WatchdogConfig{}))
+
+	exists, _ := afero.Exists(fs, watchdogDropInPath)
+	assert.False(t, exists)
+	assert.Empty(t, chroot.commands)
+}
+
+func TestWatchdogDefaults(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	chroot := &recordingChroot{}
+	assert.NoError(t, afero.WriteFile(fs, firmwareConfigPath, []byte("[pi4]\nmax_framebuffers=2\n"), 0755))
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, Watchdog(context.Background(), chroot, fs, WatchdogConfig{Enabled: true}))
+	}
+
+	firmware, readErr := afero.ReadFile(fs, firmwareConfigPath)
+	assert.NoError(t, readErr)
+	assert.Equal(t, "[pi4]\nmax_framebuffers=2\ndtparam=watchdog=on\n", string(firmware))
+
+	dropIn, readErr := afero.ReadFile(fs, watchdogDropInPath)
+	assert.NoError(t, readErr)
+	assert.Equal(t, "# managed by pi-image-builder\n[Manager]\nRuntimeWatchdogSec=15s\nRebootWatchdogSec=2min\n", string(dropIn))
+
+	exists, _ := afero.Exists(fs, watchdogConfPath)
+	assert.False(t, exists)
+	assert.Empty(t, chroot.commands)
+}
+
+func TestWatchdogDaemon(t *testing.T) {
+	fs, _ := unitFs(t)
+	chroot := &recordingChroot{}
+	assert.NoError(t, fs.MkdirAll("/boot/firmware", 0755))
+	assert.NoError(t, afero.WriteFile(fs, firmwareConfigPath, []byte("[pi4]\n"), 0755))
+	assert.NoError(t, fs.MkdirAll("/lib/systemd/system", 0755))
+	assert.NoError(t, afero.WriteFile(fs, "/lib/systemd/system/watchdog.service", []byte("[Install]\nWantedBy=multi-user.target\n"), 0644))
+	cfg := WatchdogConfig{Enabled: true, RebootSec: "5min", Daemon: WatchdogDaemonConfig{
+		Enabled:  true,
+		Ping:     []string{"10.0.0.1"},
+		MaxLoad5: 16,
+	}}
+	assert.NoError(t, Watchdog(context.Background(), chroot, fs, cfg))
+
+	// the daemon owns the device so systemd only guards reboots
+	dropIn, readErr := afero.ReadFile(fs, watchdogDropInPath)
+	assert.NoError(t, readErr)
+	assert.Equal(t, "# managed by pi-image-builder\n[Manager]\nRebootWatchdogSec=5min\n", string(dropIn))
+
+	conf, readErr := afero.ReadFile(fs, watchdogConfPath)
+	assert.NoError(t, readErr)
+	assert.Equal(t, "# managed by pi-image-builder\n"+
+		"ping = 10.0.0.1\n"+
+		"max-load-1 = 24\n"+
+		"max-load-5 = 16\n"+
+		"watchdog-device = /dev/watchdog\n"+
+		"watchdog-timeout = 15\n"+
+		"interval = 10\n"+
+		"realtime = yes\n"+
+		"priority = 1\n", string(conf))
+	assert.Equal(t, "apt-get install --no-install-recommends -y watchdog", chroot.commands[0])
+
+	// with systemd petting the watchdog the daemon leaves the device alone
+	cfg.RuntimeSec = "10s"
+	assert.NoError(t, Watchdog(context.Background(), chroot, fs, cfg))
+	conf, readErr = afero.ReadFile(fs, watchdogConfPath)
+	assert.NoError(t, readErr)
+	assert.NotContains(t, string(conf), "watchdog-device")
+}
+
+func TestWatchdogConfigValidate(t *testing.T) {
+	assert.NoError(t, WatchdogConfig{}.Validate())
+	assert.NoError(t, WatchdogConfig{RuntimeSec: "15"}.withDefaults().Validate())
+	assert.Error(t, WatchdogConfig{RuntimeSec: "1min"}.withDefaults().Validate())
+	assert.Error(t, WatchdogConfig{RebootSec: "2 min"}.withDefaults().Validate())
+	assert.Error(t, WatchdogConfig{Daemon: WatchdogDaemonConfig{Ping: []string{"gateway"}}}.withDefaults().Validate())
+	assert.Error(t, WatchdogConfig{Daemon: WatchdogDaemonConfig{Interval: 15}}.withDefaults().Validate())
+}
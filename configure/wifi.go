@@ -0,0 +1,200 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const (
+	// wifiCredentialsPath is on the fat boot partition so credentials can be provided after flashing
+	wifiCredentialsPath = "/boot/firmware/wifi-credentials"
+	wifiDropInPath      = "/etc/cloud/cloud.cfg.d/08_wifi.cfg"
+	maximumSSIDLength   = 32
+)
+
+var (
+	countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+	hexPSKPattern  = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+)
+
+// WiFiConfig enables WPA2 on a wireless interface. The PSK may be omitted and supplied at flash time by writing
+// ssid=<ssid> and psk=<psk> lines to wifi-credentials on the boot partition.
+type WiFiConfig struct {
+	Interface string `yaml:"interface"`
+	SSID      string `yaml:"ssid"`
+	PSK       string `yaml:"psk"`
+	// PSKFile is read on the build host, it's mutually exclusive with PSK.
+	PSKFile string `yaml:"pskFile"`
+	// Country is the ISO 3166 regulatory domain, the radio stays region blocked without it.
+	Country string `yaml:"country"`
+}
+
+type WiFiCredentialsScript struct {
+	Interface       string
+	SSID            string
+	Country         string
+	CredentialsPath string
+	DropInPath      string
+}
+
+func (w WiFiConfig) Enabled() bool {
+	return w.SSID != ""
+}
+
+func (w WiFiConfig) Validate() error {
+	if len(w.SSID) > maximumSSIDLength {
+		return fmt.Errorf("ssid can be at most %d bytes", maximumSSIDLength)
+	}
+	if w.PSK != "" && w.PSKFile != "" {
+		return errors.New("only one of psk and pskFile can be set")
+	}
+	if !countryPattern.MatchString(w.Country) {
+		return fmt.Errorf("wifi country must be a two letter ISO 3166 code, got: %q", w.Country)
+	}
+	if !interfacePattern.MatchString(w.Interface) {
+		return fmt.Errorf("invalid interface name: %q", w.Interface)
+	}
+	if strings.ContainsAny(w.SSID, "\"\n$`\\") {
+		return errors.New("ssid can not contain quotes, newlines, backslashes, or shell expansions")
+	}
+	return nil
+}
+
+func validatePSK(psk string) error {
+	if hexPSKPattern.MatchString(psk) {
+		return nil
+	}
+	if len(psk) < 8 || len(psk) > 63 {
+		return errors.New("wpa2 passphrase must be between 8 and 63 characters")
+	}
+	if strings.ContainsAny(psk, "\"\n\\") {
+		return errors.New("wpa2 passphrase can not contain quotes, newlines, or backslashes")
+	}
+	return nil
+}
+
+// WiFi writes the wireless network drop in and the first boot hook that merges flash time credentials. An empty
+// SSID leaves the wired only configuration untouched.
+func WiFi(ctx context.Context, chroot ChrootRunner, fs afero.Fs, cfg WiFiConfig) error {
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	ctx, span := telemetry.Start(ctx, "configure wifi")
+	defer span.End()
+
+	if cfg.Interface == "" {
+		cfg.Interface = "wlan0"
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	psk := cfg.PSK
+	if cfg.PSKFile != "" {
+		contents, readErr := os.ReadFile(cfg.PSKFile)
+		if readErr != nil {
+			return readErr
+		}
+		psk = strings.TrimSpace(string(contents))
+	}
+
+	if psk != "" {
+		if err := validatePSK(psk); err != nil {
+			return err
+		}
+
+		dropIn, dropInErr := utility.RenderTemplate(ctx, configFiles, "files/08_wifi.cfg.yml.template", struct {
+			WiFiConfig
+			PSK string
+		}{WiFiConfig: cfg, PSK: psk})
+		if dropInErr != nil {
+			return dropInErr
+		}
+
+		if err := validateYAMLDocuments(dropIn.Bytes()); err != nil {
+			return fmt.Errorf("rendered wifi config is invalid: %w", err)
+		}
+
+		if _, err := IdempotentWrite(ctx, fs, &dropIn, wifiDropInPath, 0600); err != nil {
+			return err
+		}
+	}
+
+	if err := writeRegulatoryDomain(ctx, fs, cfg); err != nil {
+		return err
+	}
+
+	script, scriptErr := utility.RenderTemplate(ctx, configFiles, "files/wifi-credentials.bash.template", WiFiCredentialsScript{
+		Interface:       cfg.Interface,
+		SSID:            cfg.SSID,
+		Country:         cfg.Country,
+		CredentialsPath: wifiCredentialsPath,
+		DropInPath:      wifiDropInPath,
+	})
+	if scriptErr != nil {
+		return scriptErr
+	}
+
+	if err := fs.MkdirAll("/usr/local/sbin", 0755); err != nil {
+		return err
+	}
+
+	if _, err := IdempotentWrite(ctx, fs, &script, "/usr/local/sbin/wifi-credentials", 0755); err != nil {
+		return err
+	}
+
+	unit, unitErr := configFiles.Open("files/wifi-credentials.service")
+	if unitErr != nil {
+		return unitErr
+	}
+	defer utility.WrappedClose(unit)
+
+	if _, err := IdempotentWrite(ctx, fs, unit, path.Join("/etc/systemd/system", "wifi-credentials.service"), 0644); err != nil {
+		return err
+	}
+
+	return enableUnit(ctx, chroot, fs, "wifi-credentials")
+}
+
+// writeRegulatoryDomain sets the country on the cfg80211 module as well, a fallback for when the netplan drop in's
+// regulatory-domain isn't applied, e.g. before flash time credentials are merged.
+func writeRegulatoryDomain(ctx context.Context, fs afero.Fs, cfg WiFiConfig) error {
+	rendered, renderErr := utility.RenderTemplate(ctx, configFiles, "files/cfg80211-regdom.conf.template", cfg)
+	if renderErr != nil {
+		return renderErr
+	}
+
+	if err := fs.MkdirAll("/etc/modprobe.d", 0755); err != nil {
+		return err
+	}
+
+	_, writeErr := IdempotentWrite(ctx, fs, &rendered, "/etc/modprobe.d/cfg80211-regdom.conf", 0644)
+	return writeErr
+}
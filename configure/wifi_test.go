@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWiFiRegulatoryDomain(t *testing.T) {
+	fs, _ := unitFs(t)
+	assert.NoError(t, fs.MkdirAll(cloudInitDropInDir, 0755))
+	cfg := WiFiConfig{SSID: "lab", PSK: "correct horse battery", Country: "DE"}
+	assert.NoError(t, WiFi(context.Background(), &recordingChroot{}, fs, cfg))
+
+	modprobe, readErr := afero.ReadFile(fs, "/etc/modprobe.d/cfg80211-regdom.conf")
+	assert.NoError(t, readErr)
+	assert.Contains(t, string(modprobe), "\noptions cfg80211 ieee80211_regdom=DE\n")
+
+	dropIn, readErr := afero.ReadFile(fs, wifiDropInPath)
+	assert.NoError(t, readErr)
+	assert.Contains(t, string(dropIn), "    wlan0:\n")
+	assert.Contains(t, string(dropIn), "      regulatory-domain: \"DE\"\n")
+	assert.Contains(t, string(dropIn), "          password: \"correct horse battery\"\n")
+	// credentials dropped on the boot partition replace the drop in, the country has to survive that
+	script, readErr := afero.ReadFile(fs, "/usr/local/sbin/wifi-credentials")
+	assert.NoError(t, readErr)
+	assert.Contains(t, string(script), "      regulatory-domain: \"DE\"\n")
+
+	// a second run with the same country leaves the files alone
+	info, statErr := fs.Stat(wifiDropInPath)
+	assert.NoError(t, statErr)
+	assert.NoError(t, WiFi(context.Background(), &recordingChroot{}, fs, cfg))
+	again, statErr := fs.Stat(wifiDropInPath)
+	assert.NoError(t, statErr)
+	assert.Equal(t, info.ModTime(), again.ModTime())
+}
+
+func TestWiFiConfigValidate(t *testing.T) {
+	valid := WiFiConfig{Interface: "wlan0", SSID: "lab", Country: "US"}
+	assert.NoError(t, valid.Validate())
+
+	noCountry := valid
+	noCountry.Country = ""
+	assert.Error(t, noCountry.Validate())
+
+	lowercase := valid
+	lowercase.Country = "us"
+	assert.Error(t, lowercase.Validate())
+
+	both := valid
+	both.PSK, both.PSKFile = "correct horse battery", "/tmp/psk"
+	assert.Error(t, both.Validate())
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const zramSysctlPath = "/etc/sysctl.d/90-zram.conf"
+
+var zramAlgorithms = map[string]bool{"zstd": true, "lz4": true, "lzo-rle": true, "lzo": true}
+
+// ZramConfig sets up compressed swap in memory with zram-tools. The kubelet keeps NodeSwap off so pods don't swap,
+// it just gives the node headroom during image pulls.
+type ZramConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Percent is the uncompressed swap size as a percentage of ram.
+	Percent   int    `yaml:"percent"`
+	Algorithm string `yaml:"algorithm"`
+	Priority  int    `yaml:"priority"`
+	// Swappiness defaults to 100, zram is cheap enough to swap to eagerly.
+	Swappiness  *int `yaml:"swappiness"`
+	PageCluster int  `yaml:"pageCluster"`
+}
+
+func (z ZramConfig) withDefaults() ZramConfig {
+	if z.Percent == 0 {
+		z.Percent = 50
+	}
+	if z.Algorithm == "" {
+		z.Algorithm = "zstd"
+	}
+	if z.Priority == 0 {
+		z.Priority = 100
+	}
+	if z.Swappiness == nil {
+		swappiness := 100
+		z.Swappiness = &swappiness
+	}
+	return z
+}
+
+func (z ZramConfig) Validate() error {
+	if z.Percent < 1 || z.Percent > 200 {
+		return fmt.Errorf("zram percent must be between 1 and 200, got: %d", z.Percent)
+	}
+	if !zramAlgorithms[z.Algorithm] {
+		return fmt.Errorf("unsupported zram algorithm: %q", z.Algorithm)
+	}
+	if z.Swappiness != nil && (*z.Swappiness < 0 || *z.Swappiness > 200) {
+		return fmt.Errorf("swappiness must be between 0 and 200, got: %d", *z.Swappiness)
+	}
+	if z.PageCluster < 0 || z.PageCluster > 10 {
+		return fmt.Errorf("page cluster must be between 0 and 10, got: %d", z.PageCluster)
+	}
+	return nil
+}
+
+func (z ZramConfig) sysctls() Sysctl {
+	return Sysctl{
+		"vm.swappiness":   strconv.Itoa(*z.Swappiness),
+		"vm.page-cluster": strconv.Itoa(z.PageCluster),
+	}
+}
+
+// Zram installs zram-tools and writes its config along with the matching vm sysctls. It does nothing when disabled.
+func Zram(ctx context.Context, chroot ChrootRunner, fs afero.Fs, cfg ZramConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	ctx, span := telemetry.Start(ctx, "configure zram")
+	defer span.End()
+
+	cfg = cfg.withDefaults()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	if err := chroot.Run(ctx, 20*time.Minute, "apt-get", "install", "--no-install-recommends", "-y", "zram-tools"); err != nil {
+		return err
+	}
+
+	if err := writeZramConfig(ctx, fs, cfg); err != nil {
+		return err
+	}
+
+	return enableUnit(ctx, chroot, fs, "zramswap")
+}
+
+func writeZramConfig(ctx context.Context, fs afero.Fs, cfg ZramConfig) error {
+	zramswap, renderErr := utility.RenderTemplate(ctx, configFiles, "files/zramswap.template", cfg)
+	if renderErr != nil {
+		return renderErr
+	}
+
+	if err := fs.MkdirAll("/etc/default", 0755); err != nil {
+		return err
+	}
+
+	if _, err := IdempotentWrite(ctx, fs, &zramswap, "/etc/default/zramswap", 0644); err != nil {
+		return err
+	}
+
+	if err := fs.MkdirAll("/etc/sysctl.d", 0755); err != nil {
+		return err
+	}
+
+	return afero.WriteFile(fs, zramSysctlPath, []byte(cfg.sysctls().String()), 0644)
+}
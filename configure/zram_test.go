@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZramDisabledIsNoop(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	chroot := &recordingChroot{}
+	assert.NoError(t, Zram(context.Background(), chroot, fs, ZramConfig{Percent: 500}))
+	assert.Empty(t, chroot.commands)
+
+	files, err := afero.Glob(fs, "/etc/*/*")
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestWriteZramConfig(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	cfg := ZramConfig{Enabled: true, Percent: 25}.withDefaults()
+	assert.NoError(t, cfg.Validate())
+	assert.NoError(t, writeZramConfig(context.Background(), fs, cfg))
+
+	zramswap, err := afero.ReadFile(fs, "/etc/default/zramswap")
+	assert.NoError(t, err)
+	assert.Equal(t, "# managed by pi-image-builder\nALGO=zstd\nPERCENT=25\nPRIORITY=100\n", string(zramswap))
+
+	sysctls, sysctlErr := afero.ReadFile(fs, zramSysctlPath)
+	assert.NoError(t, sysctlErr)
+	assert.Contains(t, string(sysctls), "vm.swappiness = 100")
+	assert.Contains(t, string(sysctls), "vm.page-cluster = 0")
+}
+
+func TestZramConfigValidate(t *testing.T) {
+	swappiness := 250
+	assert.Error(t, ZramConfig{Percent: 300}.withDefaults().Validate())
+	assert.Error(t, ZramConfig{Algorithm: "gzip"}.withDefaults().Validate())
+	assert.Error(t, ZramConfig{Swappiness: &swappiness}.withDefaults().Validate())
+}
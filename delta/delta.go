@@ -0,0 +1,269 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package delta builds and applies block level patches between two raw images, so a site that already has the
+// previous image only downloads what changed.
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// BlockSize matches the ext4 and vfat cluster size, files that didn't change between builds line up on it.
+	BlockSize = 4096
+	// maxLiteral bounds how much changed data one literal op carries.
+	maxLiteral = 1 << 20
+
+	opCopy    byte = 'C'
+	opLiteral byte = 'L'
+	opEnd     byte = 'E'
+)
+
+var patchMagic = []byte("PIDELTA1")
+
+var errCorruptPatch = errors.New("patch is corrupt")
+
+// Diff writes a patch to w that rebuilds target from source. Blocks of target found anywhere in source are copied
+// from it, everything else is carried in the patch. The patch is zstd compressed so zero filled and repetitive
+// changes stay small.
+func Diff(source io.ReaderAt, sourceSize int64, target io.Reader, w io.Writer) error {
+	index, indexErr := indexBlocks(source, sourceSize)
+	if indexErr != nil {
+		return fmt.Errorf("could not index source image: %w", indexErr)
+	}
+
+	compressor, compressorErr := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if compressorErr != nil {
+		return compressorErr
+	}
+	encoder := &opWriter{w: bufio.NewWriter(compressor)}
+	if _, err := encoder.w.Write(patchMagic); err != nil {
+		return err
+	}
+
+	block := make([]byte, BlockSize)
+	candidate := make([]byte, BlockSize)
+	reader := bufio.NewReaderSize(target, maxLiteral)
+	for position := int64(0); ; position++ {
+		n, readErr := io.ReadFull(reader, block)
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil && !errors.Is(readErr, io.ErrUnexpectedEOF) {
+			return readErr
+		}
+		if n == BlockSize {
+			found, matchErr := index.match(source, position, block, candidate)
+			if matchErr != nil {
+				return matchErr
+			}
+			if found >= 0 {
+				if err := encoder.copyBlock(uint64(found)); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if err := encoder.literal(block[:n]); err != nil {
+			return err
+		}
+	}
+
+	if err := encoder.finish(); err != nil {
+		return err
+	}
+	return compressor.Close()
+}
+
+// Apply rebuilds the target image into w from source and a patch written by Diff.
+func Apply(source io.ReaderAt, patch io.Reader, w io.Writer) error {
+	decompressor, decompressorErr := zstd.NewReader(patch)
+	if decompressorErr != nil {
+		return decompressorErr
+	}
+	defer decompressor.Close()
+	reader := bufio.NewReader(decompressor)
+
+	magic := make([]byte, len(patchMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || !bytes.Equal(magic, patchMagic) {
+		return errCorruptPatch
+	}
+
+	buffer := make([]byte, maxLiteral)
+	for {
+		op, opErr := reader.ReadByte()
+		if opErr != nil {
+			return fmt.Errorf("%w: %v", errCorruptPatch, opErr)
+		}
+		switch op {
+		case opEnd:
+			return nil
+		case opCopy:
+			var run [2]uint64
+			if err := binary.Read(reader, binary.BigEndian, &run); err != nil {
+				return fmt.Errorf("%w: %v", errCorruptPatch, err)
+			}
+			length := int64(run[1]) * BlockSize
+			copied, copyErr := io.CopyBuffer(w, io.NewSectionReader(source, int64(run[0])*BlockSize, length), buffer)
+			if copyErr != nil {
+				return copyErr
+			}
+			if copied != length {
+				return fmt.Errorf("%w: copy past the end of the source image", errCorruptPatch)
+			}
+		case opLiteral:
+			var length uint32
+			if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+				return fmt.Errorf("%w: %v", errCorruptPatch, err)
+			}
+			if length > maxLiteral {
+				return fmt.Errorf("%w: literal of %d bytes", errCorruptPatch, length)
+			}
+			if _, err := io.ReadFull(reader, buffer[:length]); err != nil {
+				return fmt.Errorf("%w: %v", errCorruptPatch, err)
+			}
+			if _, err := w.Write(buffer[:length]); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: unknown op %q", errCorruptPatch, op)
+		}
+	}
+}
+
+// blockIndex finds source blocks by content.
+type blockIndex struct {
+	seed   maphash.Seed
+	blocks map[uint64]uint64
+	count  int64
+}
+
+func indexBlocks(source io.ReaderAt, size int64) (*blockIndex, error) {
+	index := &blockIndex{seed: maphash.MakeSeed(), blocks: make(map[uint64]uint64), count: size / BlockSize}
+	reader := bufio.NewReaderSize(io.NewSectionReader(source, 0, index.count*BlockSize), maxLiteral)
+	block := make([]byte, BlockSize)
+	for position := int64(0); position < index.count; position++ {
+		if _, err := io.ReadFull(reader, block); err != nil {
+			return nil, err
+		}
+		sum := maphash.Bytes(index.seed, block)
+		// keep the first copy, later duplicates are usually zero blocks and any copy works
+		if _, seen := index.blocks[sum]; !seen {
+			index.blocks[sum] = uint64(position)
+		}
+	}
+	return index, nil
+}
+
+// match returns where block can be copied from in source, or -1. The block at the same position is preferred so
+// unchanged regions become long runs. candidate is scratch space for reading source blocks.
+func (b *blockIndex) match(source io.ReaderAt, position int64, block []byte, candidate []byte) (int64, error) {
+	if position < b.count {
+		if _, err := source.ReadAt(candidate, position*BlockSize); err != nil {
+			return -1, err
+		}
+		if bytes.Equal(candidate, block) {
+			return position, nil
+		}
+	}
+	found, ok := b.blocks[maphash.Bytes(b.seed, block)]
+	if !ok {
+		return -1, nil
+	}
+	// the hash is only 64 bits, make sure it's really the same block
+	if _, err := source.ReadAt(candidate, int64(found)*BlockSize); err != nil {
+		return -1, err
+	}
+	if !bytes.Equal(candidate, block) {
+		return -1, nil
+	}
+	return int64(found), nil
+}
+
+// opWriter coalesces consecutive copies and literals into as few ops as it can. Only one kind is ever pending so ops
+// are written in order.
+type opWriter struct {
+	w         *bufio.Writer
+	copyStart uint64
+	copyCount uint64
+	literals  []byte
+}
+
+func (o *opWriter) copyBlock(block uint64) error {
+	if o.copyCount > 0 && o.copyStart+o.copyCount == block {
+		o.copyCount++
+		return nil
+	}
+	if err := o.flush(); err != nil {
+		return err
+	}
+	o.copyStart, o.copyCount = block, 1
+	return nil
+}
+
+func (o *opWriter) literal(data []byte) error {
+	if o.copyCount > 0 || len(o.literals)+len(data) > maxLiteral {
+		if err := o.flush(); err != nil {
+			return err
+		}
+	}
+	o.literals = append(o.literals, data...)
+	return nil
+}
+
+func (o *opWriter) flush() error {
+	if o.copyCount > 0 {
+		if err := o.w.WriteByte(opCopy); err != nil {
+			return err
+		}
+		if err := binary.Write(o.w, binary.BigEndian, [2]uint64{o.copyStart, o.copyCount}); err != nil {
+			return err
+		}
+		o.copyCount = 0
+	}
+	if len(o.literals) > 0 {
+		if err := o.w.WriteByte(opLiteral); err != nil {
+			return err
+		}
+		if err := binary.Write(o.w, binary.BigEndian, uint32(len(o.literals))); err != nil {
+			return err
+		}
+		if _, err := o.w.Write(o.literals); err != nil {
+			return err
+		}
+		o.literals = o.literals[:0]
+	}
+	return nil
+}
+
+func (o *opWriter) finish() error {
+	if err := o.flush(); err != nil {
+		return err
+	}
+	if err := o.w.WriteByte(opEnd); err != nil {
+		return err
+	}
+	return o.w.Flush()
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// images returns a source image and a target that shares most of its blocks, some moved and some changed.
+func images() ([]byte, []byte) {
+	random := rand.New(rand.NewSource(1))
+	source := make([]byte, 64*BlockSize)
+	random.Read(source)
+
+	target := append([]byte{}, source...)
+	// a changed block, a block moved from elsewhere in the image, and a short tail
+	random.Read(target[3*BlockSize : 4*BlockSize])
+	copy(target[10*BlockSize:11*BlockSize], source[40*BlockSize:41*BlockSize])
+	target = append(target, []byte("tail")...)
+	return source, target
+}
+
+func TestDiffAndApply(t *testing.T) {
+	source, target := images()
+
+	var patch bytes.Buffer
+	assert.NoError(t, Diff(bytes.NewReader(source), int64(len(source)), bytes.NewReader(target), &patch))
+	// only the changed block and the tail should be carried
+	assert.Less(t, patch.Len(), 2*BlockSize)
+
+	var rebuilt bytes.Buffer
+	assert.NoError(t, Apply(bytes.NewReader(source), &patch, &rebuilt))
+	assert.Equal(t, target, rebuilt.Bytes())
+}
+
+func TestDiffWithoutCommonBlocks(t *testing.T) {
+	source, target := images()
+	target = bytes.Repeat([]byte{7}, 3*BlockSize+5)
+
+	var patch bytes.Buffer
+	assert.NoError(t, Diff(bytes.NewReader(source), int64(len(source)), bytes.NewReader(target), &patch))
+
+	var rebuilt bytes.Buffer
+	assert.NoError(t, Apply(bytes.NewReader(source), &patch, &rebuilt))
+	assert.Equal(t, target, rebuilt.Bytes())
+}
+
+func TestApplyRejectsGarbage(t *testing.T) {
+	var rebuilt bytes.Buffer
+	assert.Error(t, Apply(bytes.NewReader(nil), bytes.NewReader([]byte("not a patch")), &rebuilt))
+}
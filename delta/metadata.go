@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package delta
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const (
+	patchExtension    = ".delta"
+	metadataExtension = ".json"
+	partialExtension  = ".partial"
+)
+
+var (
+	// ErrBaseMissing means the image a patch applies to isn't on this machine.
+	ErrBaseMissing = errors.New("base image is missing")
+	// ErrBaseMismatch means the local base image isn't the one the patch was made from.
+	ErrBaseMismatch = errors.New("base image doesn't match the patch's source")
+)
+
+// Image identifies a raw, uncompressed image by name and content.
+type Image struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// Metadata links a patch to the images it goes between, it's uploaded next to the patch.
+type Metadata struct {
+	Source    Image     `json:"source"`
+	Target    Image     `json:"target"`
+	Patch     string    `json:"patch"`
+	BlockSize int       `json:"blockSize"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// PatchName is the patch going from the source image to the target image.
+func PatchName(sourceName string, targetName string) string {
+	return fmt.Sprintf("%s.from-%s%s", imageStem(targetName), imageStem(filepath.Base(sourceName)), patchExtension)
+}
+
+// MetadataName is the metadata file that accompanies patch.
+func MetadataName(patch string) string {
+	return patch + metadataExtension
+}
+
+func imageStem(name string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(name, ".zstd"), ".img")
+}
+
+// ReadMetadata decodes metadata written by Create.
+func ReadMetadata(r io.Reader) (Metadata, error) {
+	var metadata Metadata
+	if err := json.NewDecoder(r).Decode(&metadata); err != nil {
+		return Metadata{}, fmt.Errorf("could not parse delta metadata: %w", err)
+	}
+	if metadata.BlockSize != BlockSize {
+		return Metadata{}, fmt.Errorf("delta uses %d byte blocks, only %d is supported", metadata.BlockSize, BlockSize)
+	}
+	return metadata, nil
+}
+
+// Create diffs the raw images at sourcePath and targetPath, writing the patch and its metadata into the working
+// directory. The names are the published artifact names recorded in the metadata.
+func Create(ctx context.Context, fileSystem afero.Fs, sourcePath string, sourceName string, targetPath string, targetName string) (_ Metadata, err error) {
+	ctx, span := telemetry.Start(ctx, "create delta")
+	defer span.End()
+
+	sourceHash, sourceSize, hashErr := HashFile(ctx, fileSystem, sourcePath)
+	if hashErr != nil {
+		return Metadata{}, fmt.Errorf("could not hash source image: %w", hashErr)
+	}
+
+	source, sourceErr := fileSystem.Open(sourcePath)
+	if sourceErr != nil {
+		return Metadata{}, sourceErr
+	}
+	defer utility.WrappedClose(source)
+
+	target, targetErr := fileSystem.Open(targetPath)
+	if targetErr != nil {
+		return Metadata{}, targetErr
+	}
+	defer utility.WrappedClose(target)
+	info, statErr := target.Stat()
+	if statErr != nil {
+		return Metadata{}, statErr
+	}
+
+	metadata := Metadata{
+		Source:    Image{Name: sourceName, SHA256: sourceHash, Size: sourceSize},
+		Target:    Image{Name: targetName, Size: info.Size()},
+		Patch:     PatchName(sourceName, targetName),
+		BlockSize: BlockSize,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	patch, patchErr := fileSystem.Create(metadata.Patch)
+	if patchErr != nil {
+		return Metadata{}, patchErr
+	}
+	defer utility.CloseWithErr(patch, &err)
+
+	targetHash := sha256.New()
+	progress := utility.NewProgressReader(ctx, io.TeeReader(target, targetHash), "diff "+targetName, info.Size())
+	if err := Diff(source, sourceSize, progress, patch); err != nil {
+		return Metadata{}, fmt.Errorf("could not diff images: %w", err)
+	}
+	metadata.Target.SHA256 = hex.EncodeToString(targetHash.Sum(nil))
+
+	encoded, marshalErr := json.MarshalIndent(metadata, "", "  ")
+	if marshalErr != nil {
+		return Metadata{}, marshalErr
+	}
+	if err := afero.WriteFile(fileSystem, MetadataName(metadata.Patch), append(encoded, '\n'), 0644); err != nil {
+		return Metadata{}, err
+	}
+	return metadata, nil
+}
+
+// Reconstruct applies patch to the raw image at base and writes the target image to output. The base is checked
+// against the metadata first, ErrBaseMissing and ErrBaseMismatch tell the caller to fetch the full image instead.
+// The result is only moved to output once its hash matches the target, so base and output may be the same file.
+func Reconstruct(ctx context.Context, fileSystem afero.Fs, metadata Metadata, base string, patch io.Reader, output string) error {
+	ctx, span := telemetry.Start(ctx, "apply delta")
+	defer span.End()
+
+	baseHash, _, hashErr := HashFile(ctx, fileSystem, base)
+	if errors.Is(hashErr, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrBaseMissing, base)
+	}
+	if hashErr != nil {
+		return fmt.Errorf("could not hash base image: %w", hashErr)
+	}
+	if baseHash != metadata.Source.SHA256 {
+		return fmt.Errorf("%w: %s is %s, the patch wants %s (%s)", ErrBaseMismatch, base, baseHash, metadata.Source.Name, metadata.Source.SHA256)
+	}
+
+	source, sourceErr := fileSystem.Open(base)
+	if sourceErr != nil {
+		return sourceErr
+	}
+	defer utility.WrappedClose(source)
+
+	partial := output + partialExtension
+	rebuilt, createErr := fileSystem.Create(partial)
+	if createErr != nil {
+		return createErr
+	}
+
+	hash := sha256.New()
+	progress := utility.NewProgressWriter(ctx, io.MultiWriter(rebuilt, hash), "apply "+metadata.Patch, metadata.Target.Size)
+	applyErr := Apply(source, patch, progress)
+	// closed before the rename so a failed flush never makes it to output
+	closeErr := rebuilt.Close()
+	if applyErr != nil {
+		return errors.Join(fmt.Errorf("could not apply patch: %w", applyErr), fileSystem.Remove(partial))
+	}
+	if closeErr != nil {
+		return errors.Join(fmt.Errorf("could not write %s: %w", partial, closeErr), fileSystem.Remove(partial))
+	}
+	progress.Finish()
+
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != metadata.Target.SHA256 {
+		return errors.Join(fmt.Errorf("rebuilt image hash %s doesn't match %s", sum, metadata.Target.SHA256), fileSystem.Remove(partial))
+	}
+	return fileSystem.Rename(partial, output)
+}
+
+// HashFile returns the sha256 and size of name.
+func HashFile(ctx context.Context, fileSystem afero.Fs, name string) (string, int64, error) {
+	file, openErr := fileSystem.Open(name)
+	if openErr != nil {
+		return "", 0, openErr
+	}
+	defer utility.WrappedClose(file)
+	info, statErr := file.Stat()
+	if statErr != nil {
+		return "", 0, statErr
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, utility.NewProgressReader(ctx, file, "hash "+name, info.Size())); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), info.Size(), nil
+}
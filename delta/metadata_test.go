@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package delta
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPatchName(t *testing.T) {
+	assert.Equal(t, "ubuntu-2.from-ubuntu-1.delta", PatchName("/images/ubuntu-1.img.zstd", "ubuntu-2.img.zstd"))
+	assert.Equal(t, "ubuntu-2.from-ubuntu-1.delta.json", MetadataName(PatchName("ubuntu-1.img", "ubuntu-2.img")))
+}
+
+func TestCreateAndReconstruct(t *testing.T) {
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	source, target := images()
+	assert.NoError(t, afero.WriteFile(fs, "old.img", source, 0644))
+	assert.NoError(t, afero.WriteFile(fs, "new.img", target, 0644))
+
+	metadata, createErr := Create(ctx, fs, "old.img", "ubuntu-1.img.zstd", "new.img", "ubuntu-2.img.zstd")
+	assert.NoError(t, createErr)
+	assert.Equal(t, int64(len(target)), metadata.Target.Size)
+
+	encoded, readErr := afero.ReadFile(fs, MetadataName(metadata.Patch))
+	assert.NoError(t, readErr)
+	decoded, decodeErr := ReadMetadata(bytes.NewReader(encoded))
+	assert.NoError(t, decodeErr)
+	assert.Equal(t, metadata.Target, decoded.Target)
+
+	patch, patchErr := afero.ReadFile(fs, metadata.Patch)
+	assert.NoError(t, patchErr)
+
+	// rebuilding over the base image itself is how flash reuses its previous working image
+	assert.NoError(t, Reconstruct(ctx, fs, decoded, "old.img", bytes.NewReader(patch), "old.img"))
+	rebuilt, rebuiltErr := afero.ReadFile(fs, "old.img")
+	assert.NoError(t, rebuiltErr)
+	assert.Equal(t, target, rebuilt)
+
+	// the base has moved on, so the same patch no longer applies
+	assert.ErrorIs(t, Reconstruct(ctx, fs, decoded, "old.img", bytes.NewReader(patch), "out.img"), ErrBaseMismatch)
+	assert.ErrorIs(t, Reconstruct(ctx, fs, decoded, "missing.img", bytes.NewReader(patch), "out.img"), ErrBaseMissing)
+	exists, _ := afero.Exists(fs, "out.img")
+	assert.False(t, exists)
+}
+
+func TestReconstructRejectsWrongTarget(t *testing.T) {
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	source, target := images()
+	assert.NoError(t, afero.WriteFile(fs, "old.img", source, 0644))
+	assert.NoError(t, afero.WriteFile(fs, "new.img", target, 0644))
+
+	metadata, createErr := Create(ctx, fs, "old.img", "ubuntu-1.img.zstd", "new.img", "ubuntu-2.img.zstd")
+	assert.NoError(t, createErr)
+	patch, patchErr := afero.ReadFile(fs, metadata.Patch)
+	assert.NoError(t, patchErr)
+
+	metadata.Target.SHA256 = "0000"
+	assert.ErrorContains(t, Reconstruct(ctx, fs, metadata, "old.img", bytes.NewReader(patch), "out.img"), "doesn't match")
+	for _, name := range []string{"out.img", "out.img" + partialExtension} {
+		exists, _ := afero.Exists(fs, name)
+		assert.False(t, exists, name)
+	}
+}
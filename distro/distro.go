@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package distro
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Distro describes a base image and the parts of it the builder can't assume.
+type Distro struct {
+	// Name is how the distro is picked in the build config and prefixes built image names.
+	Name string
+	// ReleaseURL is the directory ImageName and ChecksumName are downloaded from.
+	ReleaseURL string
+	// ImageName is the xz compressed image.
+	ImageName string
+	// ChecksumName lists the sha256 of ImageName, either a combined SHA256SUMS or a per image .sha256 file.
+	ChecksumName string
+	// CloudInit is set when the image ships cloud-init, otherwise it's installed while configuring.
+	CloudInit bool
+	// UBoot is set when the image boots through u-boot, which needs an uncompressed kernel.
+	UBoot bool
+	// IncludeUserConfig is set when config.txt doesn't already include usercfg.txt.
+	IncludeUserConfig bool
+	// OutputPrefix starts the names of built images.
+	OutputPrefix string
+	// Bootstrap is how debootstrap builds the distro from scratch instead of starting from ImageName.
+	Bootstrap Bootstrap
+	// DockerURI and DockerSuite pick the docker apt repo matching the image's release.
+	DockerURI   string
+	DockerSuite string
+}
+
+// Bootstrap is the debootstrap suite and mirror a distro is built from, and the packages that make it boot on a pi.
+type Bootstrap struct {
+	Suite      string
+	Mirror     string
+	Components []string
+	Packages   []string
+}
+
+var Ubuntu = Distro{
+	Name:         "ubuntu",
+	ReleaseURL:   "https://cdimage.ubuntu.com/releases/20.04/release",
+	ImageName:    "ubuntu-20.04.5-preinstalled-server-arm64+raspi.img.xz",
+	ChecksumName: "SHA256SUMS",
+	CloudInit:    true,
+	UBoot:        true,
+	OutputPrefix: "ubuntu-20-04-arm64",
+	Bootstrap: Bootstrap{
+		Suite:      "focal",
+		Mirror:     "http://ports.ubuntu.com/ubuntu-ports",
+		Components: []string{"main", "restricted", "universe"},
+		Packages:   []string{"linux-raspi", "linux-firmware-raspi2", "u-boot-rpi", "flash-kernel", "cloud-init", "netplan.io"},
+	},
+	DockerURI:   "https://download.docker.com/linux/ubuntu",
+	DockerSuite: "focal",
+}
+
+// RaspiOS is Raspberry Pi OS Lite 64-bit on Debian bookworm.
+var RaspiOS = Distro{
+	Name:              "raspios",
+	ReleaseURL:        "https://downloads.raspberrypi.com/raspios_lite_arm64/images/raspios_lite_arm64-2023-12-11",
+	ImageName:         "2023-12-11-raspios-bookworm-arm64-lite.img.xz",
+	ChecksumName:      "2023-12-11-raspios-bookworm-arm64-lite.img.xz.sha256",
+	IncludeUserConfig: true,
+	OutputPrefix:      "raspios-bookworm-arm64",
+	Bootstrap: Bootstrap{
+		Suite:      "bookworm",
+		Mirror:     "http://deb.debian.org/debian",
+		Components: []string{"main", "contrib", "non-free-firmware"},
+		Packages:   []string{"raspi-firmware", "linux-image-arm64", "firmware-brcm80211"},
+	},
+	DockerURI:   "https://download.docker.com/linux/debian",
+	DockerSuite: "bookworm",
+}
+
+var known = map[string]Distro{
+	Ubuntu.Name:  Ubuntu,
+	RaspiOS.Name: RaspiOS,
+}
+
+// Lookup finds a distro by name, an empty name is Ubuntu.
+func Lookup(name string) (Distro, error) {
+	if name == "" {
+		return Ubuntu, nil
+	}
+	if d, ok := known[name]; ok {
+		return d, nil
+	}
+	names := make([]string, 0, len(known))
+	for knownName := range known {
+		names = append(names, knownName)
+	}
+	sort.Strings(names)
+	return Distro{}, fmt.Errorf("unknown distro %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// ExtractName is the image once it's decompressed.
+func (d Distro) ExtractName() string {
+	return strings.TrimSuffix(d.ImageName, ".xz")
+}
+
+func (d Distro) ImageURL() string {
+	return d.ReleaseURL + "/" + d.ImageName
+}
+
+func (d Distro) ChecksumURL() string {
+	return d.ReleaseURL + "/" + d.ChecksumName
+}
+
+// DockerKeyURL is the armored key the docker repo is signed with.
+func (d Distro) DockerKeyURL() string {
+	return d.DockerURI + "/gpg"
+}
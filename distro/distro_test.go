@@ -0,0 +1,43 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package distro
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookup(t *testing.T) {
+	defaulted, err := Lookup("")
+	assert.NoError(t, err)
+	assert.Equal(t, Ubuntu, defaulted)
+
+	raspios, raspiosErr := Lookup("raspios")
+	assert.NoError(t, raspiosErr)
+	assert.Equal(t, "2023-12-11-raspios-bookworm-arm64-lite.img", raspios.ExtractName())
+	assert.Equal(t, "https://download.docker.com/linux/debian/gpg", raspios.DockerKeyURL())
+
+	_, unknownErr := Lookup("arch")
+	assert.ErrorContains(t, unknownErr, "expected one of raspios, ubuntu")
+}
+
+func TestURLs(t *testing.T) {
+	assert.Equal(t, "https://cdimage.ubuntu.com/releases/20.04/release/SHA256SUMS", Ubuntu.ChecksumURL())
+	assert.Equal(t, "https://cdimage.ubuntu.com/releases/20.04/release/ubuntu-20.04.5-preinstalled-server-arm64+raspi.img.xz", Ubuntu.ImageURL())
+	assert.Equal(t, "ubuntu-20.04.5-preinstalled-server-arm64+raspi.img", Ubuntu.ExtractName())
+}
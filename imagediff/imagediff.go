@@ -0,0 +1,301 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package imagediff compares the contents of two built images: their packages, the files under the directories the
+// builder writes to, and the release file stamped into them.
+package imagediff
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/lockfile"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+// DefaultDirs are the trees compared file by file, everything the builder configures lives under them.
+var DefaultDirs = []string{"/etc", "/usr/local"}
+
+// File is one file under a compared directory.
+type File struct {
+	Mode fs.FileMode `json:"mode"`
+	// SHA256 is the contents' hash for regular files.
+	SHA256 string `json:"sha256,omitempty"`
+	// Link is a symlink's target.
+	Link string `json:"link,omitempty"`
+}
+
+// Contents is what's compared about one image.
+type Contents struct {
+	Packages map[string]lockfile.Package
+	Files    map[string]File
+	Release  map[string]string
+}
+
+// Read collects the contents of the image mounted at root, hashing every file under dirs.
+func Read(root afero.Fs, dirs []string) (Contents, error) {
+	contents := Contents{Packages: make(map[string]lockfile.Package), Files: make(map[string]File)}
+
+	packages, packagesErr := lockfile.InstalledPackages(root)
+	if packagesErr != nil {
+		return contents, fmt.Errorf("could not read installed packages: %w", packagesErr)
+	}
+	for _, installed := range packages {
+		contents.Packages[packageKey(installed)] = installed
+	}
+
+	for _, dir := range dirs {
+		if err := readFiles(root, dir, contents.Files); err != nil {
+			return contents, fmt.Errorf("could not read %s: %w", dir, err)
+		}
+	}
+
+	// images built before the release file existed just have nothing to compare
+	release, releaseErr := configure.ReadRelease(root)
+	if releaseErr != nil && !errors.Is(releaseErr, os.ErrNotExist) {
+		return contents, fmt.Errorf("could not read release file: %w", releaseErr)
+	}
+	contents.Release = release
+	return contents, nil
+}
+
+// packageKey keeps multiarch packages apart, e.g. libc6 for arm64 and armhf.
+func packageKey(installed lockfile.Package) string {
+	if installed.Architecture == "" || installed.Architecture == "all" || installed.Architecture == "arm64" {
+		return installed.Name
+	}
+	return installed.Name + ":" + installed.Architecture
+}
+
+func readFiles(root afero.Fs, dir string, files map[string]File) error {
+	if _, err := root.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return afero.Walk(root, dir, func(name string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		file := File{Mode: info.Mode()}
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			reader, ok := root.(afero.LinkReader)
+			if !ok {
+				return fmt.Errorf("cannot read symlink %s on this filesystem", name)
+			}
+			target, readErr := reader.ReadlinkIfPossible(name)
+			if readErr != nil {
+				return readErr
+			}
+			file.Link = target
+		case info.Mode().IsRegular():
+			sum, hashErr := hashFile(root, name)
+			if hashErr != nil {
+				return hashErr
+			}
+			file.SHA256 = sum
+		}
+		files[name] = file
+		return nil
+	})
+}
+
+func hashFile(root afero.Fs, name string) (string, error) {
+	file, openErr := root.Open(name)
+	if openErr != nil {
+		return "", openErr
+	}
+	defer utility.WrappedClose(file)
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// PackageChange is a package whose version differs, or that only one image has.
+type PackageChange struct {
+	Name string `json:"name"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+// FileChange is a file that differs, or that only one image has.
+type FileChange struct {
+	Path string `json:"path"`
+	Old  *File  `json:"old,omitempty"`
+	New  *File  `json:"new,omitempty"`
+}
+
+// ReleaseChange is a release file field that differs.
+type ReleaseChange struct {
+	Key string `json:"key"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// Report is everything that changed from the previous image to the current one, each list sorted by name.
+type Report struct {
+	PackagesAdded   []PackageChange `json:"packagesAdded"`
+	PackagesRemoved []PackageChange `json:"packagesRemoved"`
+	// PackagesChanged are upgrades, and downgrades when an older build is the current one.
+	PackagesChanged []PackageChange `json:"packagesChanged"`
+	FilesAdded      []FileChange    `json:"filesAdded"`
+	FilesRemoved    []FileChange    `json:"filesRemoved"`
+	FilesModified   []FileChange    `json:"filesModified"`
+	Release         []ReleaseChange `json:"release"`
+}
+
+// Empty reports whether the images are the same as far as the report can tell.
+func (r Report) Empty() bool {
+	return len(r.PackagesAdded)+len(r.PackagesRemoved)+len(r.PackagesChanged)+
+		len(r.FilesAdded)+len(r.FilesRemoved)+len(r.FilesModified)+len(r.Release) == 0
+}
+
+// Compare reports what changed from the previous image to the current one.
+func Compare(previous Contents, current Contents) Report {
+	report := Report{
+		PackagesAdded:   []PackageChange{},
+		PackagesRemoved: []PackageChange{},
+		PackagesChanged: []PackageChange{},
+		FilesAdded:      []FileChange{},
+		FilesRemoved:    []FileChange{},
+		FilesModified:   []FileChange{},
+		Release:         []ReleaseChange{},
+	}
+
+	for _, name := range unionKeys(previous.Packages, current.Packages) {
+		before, inOld := previous.Packages[name]
+		after, inNew := current.Packages[name]
+		switch {
+		case !inOld:
+			report.PackagesAdded = append(report.PackagesAdded, PackageChange{Name: name, New: after.Version})
+		case !inNew:
+			report.PackagesRemoved = append(report.PackagesRemoved, PackageChange{Name: name, Old: before.Version})
+		case before.Version != after.Version:
+			report.PackagesChanged = append(report.PackagesChanged, PackageChange{Name: name, Old: before.Version, New: after.Version})
+		}
+	}
+
+	for _, name := range unionKeys(previous.Files, current.Files) {
+		before, inOld := previous.Files[name]
+		after, inNew := current.Files[name]
+		switch {
+		case !inOld:
+			report.FilesAdded = append(report.FilesAdded, FileChange{Path: name, New: &after})
+		case !inNew:
+			report.FilesRemoved = append(report.FilesRemoved, FileChange{Path: name, Old: &before})
+		case before != after:
+			report.FilesModified = append(report.FilesModified, FileChange{Path: name, Old: &before, New: &after})
+		}
+	}
+
+	for _, key := range unionKeys(previous.Release, current.Release) {
+		if previous.Release[key] != current.Release[key] {
+			report.Release = append(report.Release, ReleaseChange{Key: key, Old: previous.Release[key], New: current.Release[key]})
+		}
+	}
+	return report
+}
+
+func unionKeys[V any](a map[string]V, b map[string]V) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, seen := a[key]; !seen {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// shortHash is how much of a hash the text report prints, plenty to tell two builds' files apart.
+const shortHash = 12
+
+func (f File) String() string {
+	switch {
+	case f.Link != "":
+		return fmt.Sprintf("%s -> %s", f.Mode, f.Link)
+	case f.SHA256 != "":
+		return fmt.Sprintf("%s sha256:%s", f.Mode, f.SHA256[:shortHash])
+	}
+	return f.Mode.String()
+}
+
+// WriteText writes the report for people, one change per line grouped into sections. Sections without changes are
+// left out.
+func (r Report) WriteText(w io.Writer) error {
+	var lines []string
+	section := func(title string, entries []string) {
+		if len(entries) == 0 {
+			return
+		}
+		lines = append(lines, title+":")
+		for _, entry := range entries {
+			lines = append(lines, "  "+entry)
+		}
+	}
+
+	var packages []string
+	for _, change := range r.PackagesAdded {
+		packages = append(packages, fmt.Sprintf("+ %s %s", change.Name, change.New))
+	}
+	for _, change := range r.PackagesRemoved {
+		packages = append(packages, fmt.Sprintf("- %s %s", change.Name, change.Old))
+	}
+	for _, change := range r.PackagesChanged {
+		packages = append(packages, fmt.Sprintf("~ %s %s -> %s", change.Name, change.Old, change.New))
+	}
+	section("packages", packages)
+
+	var files []string
+	for _, change := range r.FilesAdded {
+		files = append(files, fmt.Sprintf("+ %s (%s)", change.Path, change.New))
+	}
+	for _, change := range r.FilesRemoved {
+		files = append(files, fmt.Sprintf("- %s (%s)", change.Path, change.Old))
+	}
+	for _, change := range r.FilesModified {
+		files = append(files, fmt.Sprintf("~ %s (%s -> %s)", change.Path, change.Old, change.New))
+	}
+	section("files", files)
+
+	var release []string
+	for _, change := range r.Release {
+		release = append(release, fmt.Sprintf("~ %s %q -> %q", change.Key, change.Old, change.New))
+	}
+	section("release", release)
+
+	if len(lines) == 0 {
+		lines = append(lines, "no differences")
+	}
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
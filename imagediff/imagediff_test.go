@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package imagediff
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+const dpkgStatus = `Package: curl
+Status: install ok installed
+Architecture: arm64
+Version: 7.81.0-1ubuntu1.4
+
+Package: containerd.io
+Status: install ok installed
+Architecture: arm64
+Version: %s
+
+Package: %s
+Status: install ok installed
+Architecture: all
+Version: 1.0
+`
+
+func testImage(t *testing.T, containerd string, extra string, files map[string]string) afero.Fs {
+	t.Helper()
+	dir := t.TempDir()
+	root := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	files["/var/lib/dpkg/status"] = fmt.Sprintf(dpkgStatus, containerd, extra)
+	for name, content := range files {
+		assert.NoError(t, root.MkdirAll(filepath.Dir(name), 0755))
+		assert.NoError(t, afero.WriteFile(root, name, []byte(content), 0644))
+	}
+	return root
+}
+
+func TestCompare(t *testing.T) {
+	previous := testImage(t, "1.6.8-1", "nano", map[string]string{
+		"/etc/fstab":                    "LABEL=system-boot /boot/firmware vfat defaults 0 1\n",
+		"/etc/hostname":                 "pi\n",
+		"/etc/pi-image-builder-release": "NAME=\"pi-image-builder\"\nVERSION=\"v1.1.0\"\n",
+		"/usr/local/bin/kubelet":        "v1.25.3",
+	})
+	current := testImage(t, "1.6.9-1", "vim", map[string]string{
+		"/etc/fstab":                    "LABEL=system-boot /boot/firmware vfat defaults 0 1\n",
+		"/etc/containerd/config.toml":   "version = 2",
+		"/etc/pi-image-builder-release": "NAME=\"pi-image-builder\"\nVERSION=\"v1.2.0\"\n",
+		"/usr/local/bin/kubelet":        "v1.25.4",
+	})
+	newDir, _ := current.(*afero.BasePathFs).RealPath("/")
+	assert.NoError(t, os.Symlink("/run/systemd/resolve/stub-resolv.conf", filepath.Join(newDir, "etc/resolv.conf")))
+
+	oldContents, oldErr := Read(previous, DefaultDirs)
+	assert.NoError(t, oldErr)
+	newContents, newErr := Read(current, DefaultDirs)
+	assert.NoError(t, newErr)
+	report := Compare(oldContents, newContents)
+
+	assert.Equal(t, []PackageChange{{Name: "vim", New: "1.0"}}, report.PackagesAdded)
+	assert.Equal(t, []PackageChange{{Name: "nano", Old: "1.0"}}, report.PackagesRemoved)
+	assert.Equal(t, []PackageChange{{Name: "containerd.io", Old: "1.6.8-1", New: "1.6.9-1"}}, report.PackagesChanged)
+	assert.Equal(t, []string{"/etc/containerd/config.toml", "/etc/resolv.conf"}, paths(report.FilesAdded))
+	assert.Equal(t, "/run/systemd/resolve/stub-resolv.conf", report.FilesAdded[1].New.Link)
+	assert.Equal(t, []string{"/etc/hostname"}, paths(report.FilesRemoved))
+	assert.Equal(t, []string{"/etc/pi-image-builder-release", "/usr/local/bin/kubelet"}, paths(report.FilesModified))
+	assert.Equal(t, []ReleaseChange{{Key: "VERSION", Old: "v1.1.0", New: "v1.2.0"}}, report.Release)
+
+	var text bytes.Buffer
+	assert.NoError(t, report.WriteText(&text))
+	assert.Contains(t, text.String(), "packages:\n  + vim 1.0\n  - nano 1.0\n  ~ containerd.io 1.6.8-1 -> 1.6.9-1\n")
+	assert.Contains(t, text.String(), "  - /etc/hostname (-rw-r--r-- sha256:")
+	assert.Contains(t, text.String(), "release:\n  ~ VERSION \"v1.1.0\" -> \"v1.2.0\"\n")
+}
+
+func TestCompareSameImage(t *testing.T) {
+	image := testImage(t, "1.6.8-1", "nano", map[string]string{"/etc/hostname": "pi\n"})
+	contents, err := Read(image, DefaultDirs)
+	assert.NoError(t, err)
+	report := Compare(contents, contents)
+	assert.True(t, report.Empty())
+
+	var text bytes.Buffer
+	assert.NoError(t, report.WriteText(&text))
+	assert.Equal(t, "no differences\n", text.String())
+}
+
+func paths(changes []FileChange) []string {
+	names := make([]string, 0, len(changes))
+	for _, change := range changes {
+		names = append(names, change.Path)
+	}
+	return names
+}
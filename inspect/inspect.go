@@ -0,0 +1,304 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package inspect summarizes a built image mounted read only: what it was built from, the versions of the
+// kubernetes components actually in it, and how it's laid out. It also answers one off questions about files in it.
+package inspect
+
+import (
+	"debug/buildinfo"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/lockfile"
+	"github.com/LadySerena/pi-image-builder/manifest"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+// fstabPath is read as is, the summary shows what the image will mount rather than what the builder meant it to.
+const fstabPath = "/etc/fstab"
+
+// Component is a binary whose version is reported, Package is the deb it came from when it isn't a go binary built
+// with version ldflags.
+type Component struct {
+	Name    string
+	Path    string
+	Package string
+}
+
+// DefaultComponents are the binaries a kubernetes node image is judged by.
+var DefaultComponents = []Component{
+	{Name: "kubelet", Path: "/usr/local/bin/kubelet"},
+	{Name: "kubeadm", Path: "/usr/local/bin/kubeadm"},
+	{Name: "containerd", Path: "/usr/bin/containerd", Package: configure.ContainerdPackage},
+}
+
+// versionFlag matches the version go binaries have stamped in at link time, kubernetes sets gitVersion and
+// containerd sets Version.
+var versionFlag = regexp.MustCompile(`/version\.(?:gitVersion|Version)=([^\s'"]+)`)
+
+// ComponentVersion is what was found for a component, Version is empty when it isn't in the image.
+type ComponentVersion struct {
+	Name    string
+	Version string
+}
+
+// Summary describes an image.
+type Summary struct {
+	// Manifest is the manifest published with the image, nil when there wasn't one to read.
+	Manifest   *manifest.Manifest
+	Release    map[string]string
+	Components []ComponentVersion
+	// Fstab holds the entries of the image's fstab.
+	Fstab []string
+	// Layout is the image's partitions and volumes as DescribeLayout writes them.
+	Layout string
+}
+
+// Read summarizes the image mounted at root. The manifest and layout come from outside the image and are filled in
+// by the caller.
+func Read(root afero.Fs, components []Component) (Summary, error) {
+	var summary Summary
+
+	release, releaseErr := configure.ReadRelease(root)
+	if releaseErr != nil && !errors.Is(releaseErr, os.ErrNotExist) {
+		return summary, fmt.Errorf("could not read release file: %w", releaseErr)
+	}
+	summary.Release = release
+
+	packages, packagesErr := lockfile.InstalledPackages(root)
+	if packagesErr != nil && !errors.Is(packagesErr, os.ErrNotExist) {
+		return summary, fmt.Errorf("could not read installed packages: %w", packagesErr)
+	}
+	for _, component := range components {
+		version, versionErr := ComponentVersionOf(root, component, packages)
+		if versionErr != nil {
+			return summary, fmt.Errorf("could not find the version of %s: %w", component.Name, versionErr)
+		}
+		summary.Components = append(summary.Components, ComponentVersion{Name: component.Name, Version: version})
+	}
+
+	fstab, fstabErr := afero.ReadFile(root, fstabPath)
+	if fstabErr != nil && !errors.Is(fstabErr, os.ErrNotExist) {
+		return summary, fmt.Errorf("could not read fstab: %w", fstabErr)
+	}
+	for _, line := range strings.Split(string(fstab), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		summary.Fstab = append(summary.Fstab, strings.Join(strings.Fields(line), " "))
+	}
+	return summary, nil
+}
+
+// ComponentVersionOf reads the version linked into component's binary, falling back to the version of the package
+// it's installed from. An empty version means the component isn't in the image.
+func ComponentVersionOf(root afero.Fs, component Component, packages []lockfile.Package) (string, error) {
+	version, binaryErr := BinaryVersion(root, component.Path)
+	if binaryErr != nil && !errors.Is(binaryErr, os.ErrNotExist) {
+		return "", binaryErr
+	}
+	if version != "" || component.Package == "" {
+		return version, nil
+	}
+	for _, installed := range packages {
+		if installed.Name == component.Package {
+			return installed.Version, nil
+		}
+	}
+	return "", nil
+}
+
+// BinaryVersion reads the version stamped into a go binary with -X ldflags, or its module version when it was built
+// with go install. It's empty for binaries that aren't go or carry no version.
+func BinaryVersion(root afero.Fs, name string) (string, error) {
+	resolved, resolveErr := utility.ResolveInRoot(root, name)
+	if resolveErr != nil {
+		return "", resolveErr
+	}
+	file, openErr := root.Open(resolved)
+	if openErr != nil {
+		return "", openErr
+	}
+	defer utility.WrappedClose(file)
+
+	info, readErr := buildinfo.Read(file)
+	if readErr != nil {
+		// scripts and c binaries have no build info to read
+		return "", nil
+	}
+	return buildVersion(info), nil
+}
+
+func buildVersion(info *debug.BuildInfo) string {
+	for _, setting := range info.Settings {
+		if setting.Key != "-ldflags" {
+			continue
+		}
+		if match := versionFlag.FindStringSubmatch(setting.Value); match != nil {
+			return match[1]
+		}
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return ""
+}
+
+// Write prints the summary for people, sections the image has nothing for are left out.
+func (s Summary) Write(w io.Writer) error {
+	var lines []string
+	section := func(title string, entries []string) {
+		if len(entries) == 0 {
+			return
+		}
+		lines = append(lines, title+":")
+		for _, entry := range entries {
+			lines = append(lines, "  "+entry)
+		}
+	}
+
+	if s.Manifest != nil {
+		entries := []string{
+			fmt.Sprintf("built by %s at %s", s.Manifest.Builder, s.Manifest.CreatedAt.Format("2006-01-02 15:04:05 MST")),
+		}
+		if s.Manifest.Profile != "" {
+			entries = append(entries, "profile "+s.Manifest.Profile)
+		}
+		if s.Manifest.Kubernetes != "" {
+			entries = append(entries, "kubernetes "+s.Manifest.Kubernetes)
+		}
+		for _, step := range s.Manifest.Steps {
+			entry := fmt.Sprintf("step %s %s", step.Name, step.Status)
+			if step.Reason != "" {
+				entry += ": " + step.Reason
+			}
+			entries = append(entries, entry)
+		}
+		if s.Manifest.PartiallyConfigured {
+			entries = append(entries, "partially configured")
+		}
+		for _, warning := range s.Manifest.Warnings {
+			entries = append(entries, "warning: "+warning)
+		}
+		section("manifest", entries)
+	}
+
+	keys := make([]string, 0, len(s.Release))
+	for key := range s.Release {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	release := make([]string, 0, len(keys))
+	for _, key := range keys {
+		release = append(release, fmt.Sprintf("%s=%s", key, s.Release[key]))
+	}
+	section("release", release)
+
+	versions := make([]string, 0, len(s.Components))
+	for _, component := range s.Components {
+		version := component.Version
+		if version == "" {
+			version = "not found"
+		}
+		versions = append(versions, fmt.Sprintf("%s %s", component.Name, version))
+	}
+	section("components", versions)
+
+	section("fstab", s.Fstab)
+	if s.Layout != "" {
+		section("layout", strings.Split(strings.TrimSuffix(s.Layout, "\n"), "\n"))
+	}
+
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+// Cat copies the file name in the image mounted at root to w, following links inside the image.
+func Cat(root afero.Fs, name string, w io.Writer) error {
+	resolved, resolveErr := utility.ResolveInRoot(root, name)
+	if resolveErr != nil {
+		return resolveErr
+	}
+	file, openErr := root.Open(resolved)
+	if openErr != nil {
+		return openErr
+	}
+	defer utility.WrappedClose(file)
+
+	info, statErr := file.Stat()
+	if statErr != nil {
+		return statErr
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", name)
+	}
+	_, copyErr := io.Copy(w, file)
+	return copyErr
+}
+
+// List writes one line per entry of the directory name in the image mounted at root, or a line for name itself when
+// it isn't a directory.
+func List(root afero.Fs, name string, w io.Writer) error {
+	resolved, resolveErr := utility.ResolveInRoot(root, name)
+	if resolveErr != nil {
+		return resolveErr
+	}
+	info, statErr := root.Stat(resolved)
+	if statErr != nil {
+		return statErr
+	}
+	if !info.IsDir() {
+		_, err := io.WriteString(w, listEntry(root, resolved, info)+"\n")
+		return err
+	}
+
+	entries, readErr := afero.ReadDir(root, resolved)
+	if readErr != nil {
+		return readErr
+	}
+	for _, entry := range entries {
+		if _, err := io.WriteString(w, listEntry(root, path.Join(resolved, entry.Name()), entry)+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listEntry formats a file like ls -l without owners or times, which say nothing useful about a built image.
+func listEntry(root afero.Fs, name string, info fs.FileInfo) string {
+	entry := fmt.Sprintf("%s %10d %s", info.Mode(), info.Size(), info.Name())
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return entry
+	}
+	if reader, ok := root.(afero.LinkReader); ok {
+		if target, err := reader.ReadlinkIfPossible(name); err == nil {
+			entry += " -> " + target
+		}
+	}
+	return entry
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package inspect
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/lockfile"
+	"github.com/LadySerena/pi-image-builder/manifest"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildVersion(t *testing.T) {
+	kubelet := &debug.BuildInfo{Settings: []debug.BuildSetting{
+		{Key: "-buildmode", Value: "exe"},
+		{Key: "-ldflags", Value: "-s -w -X 'k8s.io/component-base/version.gitVersion=v1.28.2' -X 'k8s.io/component-base/version.gitMajor=1'"},
+	}}
+	assert.Equal(t, "v1.28.2", buildVersion(kubelet))
+
+	containerd := &debug.BuildInfo{Settings: []debug.BuildSetting{
+		{Key: "-ldflags", Value: "-X github.com/containerd/containerd/version.Version=1.7.2 -X github.com/containerd/containerd/version.Revision=0cae528"},
+	}}
+	assert.Equal(t, "1.7.2", buildVersion(containerd))
+
+	installed := &debug.BuildInfo{Main: debug.Module{Path: "github.com/prometheus/node_exporter", Version: "v1.6.1"}}
+	assert.Equal(t, "v1.6.1", buildVersion(installed))
+
+	assert.Empty(t, buildVersion(&debug.BuildInfo{Main: debug.Module{Version: "(devel)"}}))
+}
+
+func TestComponentVersionOf(t *testing.T) {
+	root := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(root, "/usr/bin/containerd", []byte("not a go binary"), 0755))
+	packages := []lockfile.Package{{Name: "containerd.io", Version: "1.6.21-1", Architecture: "arm64"}}
+
+	version, err := ComponentVersionOf(root, Component{Name: "containerd", Path: "/usr/bin/containerd", Package: "containerd.io"}, packages)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.6.21-1", version)
+
+	version, err = ComponentVersionOf(root, Component{Name: "kubelet", Path: "/usr/local/bin/kubelet"}, packages)
+	assert.NoError(t, err)
+	assert.Empty(t, version)
+}
+
+func TestRead(t *testing.T) {
+	root := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(root, "/etc/fstab", []byte("# managed by pi-image-builder\nLABEL=system-boot\t/boot/firmware  vfat  defaults  0 1\n\n/dev/rootvg/rootlv / ext4 defaults 0 1\n"), 0644))
+	assert.NoError(t, afero.WriteFile(root, "/etc/pi-image-builder-release", []byte("VERSION=\"2023-09-01\"\n"), 0644))
+
+	summary, err := Read(root, DefaultComponents)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"LABEL=system-boot /boot/firmware vfat defaults 0 1", "/dev/rootvg/rootlv / ext4 defaults 0 1"}, summary.Fstab)
+	assert.Equal(t, "2023-09-01", summary.Release["VERSION"])
+	assert.Equal(t, []ComponentVersion{{Name: "kubelet"}, {Name: "kubeadm"}, {Name: "containerd"}}, summary.Components)
+
+	summary.Manifest = &manifest.Manifest{Builder: manifest.BuilderName, CreatedAt: time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC), Profile: "worker",
+		Steps: []manifest.StepRecord{{Name: "packages", Status: manifest.StatusCompleted}}}
+	summary.Layout = "loop3: loop 4.0G\n  loop3p1: part 256.0M\n"
+	var out bytes.Buffer
+	assert.NoError(t, summary.Write(&out))
+	assert.Contains(t, out.String(), "manifest:\n  built by pi-image-builder at 2023-09-01 12:00:00 UTC\n  profile worker\n  step packages completed\n")
+	assert.Contains(t, out.String(), "components:\n  kubelet not found\n")
+	assert.True(t, strings.HasSuffix(out.String(), "layout:\n  loop3: loop 4.0G\n    loop3p1: part 256.0M\n"))
+}
+
+func TestCatAndList(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "usr", "lib"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "usr", "lib", "os-release"), []byte("ID=ubuntu\n"), 0644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "etc"), 0755))
+	// absolute links have to resolve inside the image, not on the host
+	assert.NoError(t, os.Symlink("/usr/lib/os-release", filepath.Join(dir, "etc", "os-release")))
+	root := afero.NewBasePathFs(afero.NewOsFs(), dir)
+
+	var contents bytes.Buffer
+	assert.NoError(t, Cat(root, "/etc/os-release", &contents))
+	assert.Equal(t, "ID=ubuntu\n", contents.String())
+	assert.Error(t, Cat(root, "/etc", &contents))
+	assert.Error(t, Cat(root, "/etc/missing", &contents))
+
+	var listing bytes.Buffer
+	assert.NoError(t, List(root, "/etc", &listing))
+	assert.Regexp(t, `^L.* os-release -> /usr/lib/os-release\n$`, listing.String())
+
+	listing.Reset()
+	assert.NoError(t, List(root, "/etc/os-release", &listing))
+	assert.Equal(t, "-rw-r--r--         10 os-release\n", listing.String())
+}
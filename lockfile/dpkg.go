@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lockfile
+
+import (
+	"bufio"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+// dpkgStatusPath is dpkg's database of installed packages inside the image.
+const dpkgStatusPath = "/var/lib/dpkg/status"
+
+// InstalledPackages reads the packages dpkg has installed in the image mounted at fs. The status file is read
+// directly, so it works without running anything in the image.
+func InstalledPackages(fs afero.Fs) ([]Package, error) {
+	status, openErr := fs.Open(dpkgStatusPath)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer utility.WrappedClose(status)
+
+	var packages []Package
+	var current Package
+	installed := false
+	flush := func() {
+		if installed && current.Name != "" {
+			packages = append(packages, current)
+		}
+		current, installed = Package{}, false
+	}
+
+	scanner := bufio.NewScanner(status)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		field, value, found := strings.Cut(line, ":")
+		// continuation lines of long fields like Description start with a space
+		if !found || strings.HasPrefix(line, " ") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch field {
+		case "Package":
+			current.Name = value
+		case "Version":
+			current.Version = value
+		case "Architecture":
+			current.Architecture = value
+		case "Status":
+			installed = strings.HasSuffix(value, " installed")
+		}
+	}
+	flush()
+	return packages, scanner.Err()
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package lockfile pins the exact bytes a build downloaded. A successful build writes pi-image.lock with the hash of
+// every remote artifact and the apt packages it ended up installing, and a build run with --locked fails if anything
+// it downloads no longer matches. Unlike the manifest, which describes one output, the lockfile constrains inputs.
+package lockfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/spf13/afero"
+)
+
+// DefaultPath is where setup reads and writes the lockfile.
+const DefaultPath = "pi-image.lock"
+
+// Artifact is one downloaded file.
+type Artifact struct {
+	URL string `json:"url"`
+	// Version is the release the artifact belongs to, when there is one.
+	Version string `json:"version,omitempty"`
+	SHA256  string `json:"sha256"`
+	Size    int64  `json:"size"`
+}
+
+// Package is a deb installed in the image. Package versions are recorded to explain a build, they aren't enforced
+// since apt mirrors drop old versions.
+type Package struct {
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Architecture string `json:"architecture"`
+}
+
+// Lock is the contents of a lockfile.
+type Lock struct {
+	Artifacts []Artifact `json:"artifacts"`
+	Packages  []Package  `json:"packages,omitempty"`
+}
+
+// Lookup finds the artifact downloaded from url.
+func (l Lock) Lookup(url string) (Artifact, bool) {
+	for _, artifact := range l.Artifacts {
+		if artifact.URL == url {
+			return artifact, true
+		}
+	}
+	return Artifact{}, false
+}
+
+// Read loads the lockfile at path.
+func Read(fs afero.Fs, path string) (Lock, error) {
+	var lock Lock
+	raw, readErr := afero.ReadFile(fs, path)
+	if readErr != nil {
+		return lock, readErr
+	}
+	if err := json.Unmarshal(raw, &lock); err != nil {
+		return lock, fmt.Errorf("could not parse lockfile %s: %w", path, err)
+	}
+	return lock, nil
+}
+
+// Write saves the lockfile to path, sorted so two builds of the same config produce the same file.
+func (l Lock) Write(fs afero.Fs, path string) error {
+	sort.Slice(l.Artifacts, func(i, j int) bool {
+		return l.Artifacts[i].URL < l.Artifacts[j].URL
+	})
+	sort.Slice(l.Packages, func(i, j int) bool {
+		return l.Packages[i].Name < l.Packages[j].Name
+	})
+	data, marshalErr := json.MarshalIndent(l, "", "  ")
+	if marshalErr != nil {
+		return marshalErr
+	}
+	return afero.WriteFile(fs, path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lockfile
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// kubeadmSum is the sha256 of what the test server returns for /kubeadm.
+const kubeadmSum = "d14a8f8a62b0f84604cebc9aa9d00ba01a939ff50ef9a178730df637374133d8"
+
+func server(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = io.WriteString(w, strings.TrimPrefix(r.URL.Path, "/")+" binary")
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func get(t *testing.T, client *http.Client, url string) error {
+	response, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		assert.NoError(t, response.Body.Close())
+	}()
+	_, err = io.ReadAll(response.Body)
+	return err
+}
+
+func TestRecorder(t *testing.T) {
+	server := server(t)
+	recorder := NewRecorder(http.DefaultTransport, nil)
+	client := &http.Client{Transport: recorder}
+
+	assert.NoError(t, get(t, client, server.URL+"/kubeadm"))
+	assert.NoError(t, get(t, client, server.URL+"/missing"))
+	response, err := client.Get(server.URL + "/kubectl")
+	assert.NoError(t, err)
+	assert.NoError(t, response.Body.Close(), "closed unread")
+	assert.NoError(t, recorder.RecordFile(server.URL+"/image.img.xz", strings.NewReader("image")))
+
+	assert.True(t, recorder.Recorded(server.URL+"/kubeadm"))
+	assert.False(t, recorder.Recorded(server.URL+"/missing"), "failed downloads aren't recorded")
+	assert.False(t, recorder.Recorded(server.URL+"/kubectl"), "partial downloads aren't recorded")
+
+	packages := []Package{{Name: "vim", Version: "2:8.1.2269-1ubuntu5", Architecture: "arm64"}}
+	lock := recorder.Lock(map[string]string{server.URL + "/kubeadm": "v1.25.3"}, packages)
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, lock.Write(fs, DefaultPath))
+	written, readErr := Read(fs, DefaultPath)
+	assert.NoError(t, readErr)
+	assert.Equal(t, packages, written.Packages)
+	assert.Equal(t, []Artifact{
+		{URL: server.URL + "/image.img.xz", SHA256: "6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d", Size: 5},
+		{URL: server.URL + "/kubeadm", Version: "v1.25.3", SHA256: kubeadmSum, Size: 14},
+	}, written.Artifacts, "sorted by url")
+}
+
+func TestRecorderLocked(t *testing.T) {
+	server := server(t)
+	unlocked := NewRecorder(http.DefaultTransport, nil)
+	assert.NoError(t, get(t, &http.Client{Transport: unlocked}, server.URL+"/kubeadm"))
+	pinned := unlocked.Lock(nil, nil)
+
+	locked := NewRecorder(http.DefaultTransport, &pinned)
+	client := &http.Client{Transport: locked}
+	assert.NoError(t, get(t, client, server.URL+"/kubeadm"), "matches the lockfile")
+	assert.NoError(t, get(t, client, server.URL+"/kubectl"), "downloads the lockfile doesn't know about are recorded")
+
+	pinned.Artifacts[0].SHA256 = "0000000000000000000000000000000000000000000000000000000000000000"
+	relocked := NewRecorder(http.DefaultTransport, &pinned)
+	var mismatch *ErrLockMismatch
+	assert.ErrorAs(t, get(t, &http.Client{Transport: relocked}, server.URL+"/kubeadm"), &mismatch)
+	assert.Equal(t, kubeadmSum, mismatch.Actual)
+	assert.False(t, relocked.Recorded(server.URL+"/kubeadm"))
+	assert.ErrorAs(t, relocked.RecordFile(server.URL+"/kubeadm", strings.NewReader("tampered")), &mismatch)
+}
+
+func TestInstalledPackages(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	status := `Package: vim
+Status: install ok installed
+Architecture: arm64
+Version: 2:8.1.2269-1ubuntu5
+Description: Vi IMproved - enhanced vi editor
+ Vim is an almost compatible version of the UNIX editor Vi.
+ .
+ Many new features have been added: multi level undo, syntax
+
+Package: snapd
+Status: deinstall ok config-files
+Architecture: arm64
+Version: 2.57.5+20.04
+
+Package: containerd.io
+Status: install ok installed
+Architecture: arm64
+Version: 1.6.9-1
+`
+	assert.NoError(t, afero.WriteFile(fs, dpkgStatusPath, []byte(status), 0644))
+
+	packages, err := InstalledPackages(fs)
+	assert.NoError(t, err)
+	assert.Equal(t, []Package{
+		{Name: "vim", Version: "2:8.1.2269-1ubuntu5", Architecture: "arm64"},
+		{Name: "containerd.io", Version: "1.6.9-1", Architecture: "arm64"},
+	}, packages)
+
+	_, missingErr := InstalledPackages(afero.NewMemMapFs())
+	assert.Error(t, missingErr)
+}
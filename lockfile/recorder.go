@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lockfile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// ErrLockMismatch is returned when a download doesn't match the hash pinned in the lockfile.
+type ErrLockMismatch struct {
+	URL      string
+	Expected string
+	Actual   string
+}
+
+func (e *ErrLockMismatch) Error() string {
+	return fmt.Sprintf("%s has sha256 %s, the lockfile pins %s", e.URL, e.Actual, e.Expected)
+}
+
+// Recorder hashes every file downloaded through it. With a lockfile to enforce, a download that doesn't match fails
+// once its body has been read, before whatever read it can act on it.
+type Recorder struct {
+	next      http.RoundTripper
+	locked    *Lock
+	mutex     sync.Mutex
+	artifacts map[string]Artifact
+}
+
+// NewRecorder wraps next. locked is nil unless the build runs with --locked.
+func NewRecorder(next http.RoundTripper, locked *Lock) *Recorder {
+	return &Recorder{next: next, locked: locked, artifacts: map[string]Artifact{}}
+}
+
+func (r *Recorder) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := r.next.RoundTrip(request)
+	if err != nil || request.Method != http.MethodGet || response.StatusCode != http.StatusOK {
+		return response, err
+	}
+	response.Body = &recordingBody{body: response.Body, hash: sha256.New(), url: request.URL.String(), recorder: r}
+	return response, nil
+}
+
+// Recorded reports whether url has been downloaded or recorded from disk.
+func (r *Recorder) Recorded(url string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, found := r.artifacts[url]
+	return found
+}
+
+// RecordFile records a copy of url that was reused from disk instead of downloaded, it's checked like a download.
+func (r *Recorder) RecordFile(url string, file io.Reader) error {
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	return r.record(url, hex.EncodeToString(hash.Sum(nil)), size)
+}
+
+func (r *Recorder) record(url string, sum string, size int64) error {
+	if r.locked != nil {
+		pinned, found := r.locked.Lookup(url)
+		if !found {
+			slog.Warn("download isn't pinned in the lockfile", "url", url)
+		} else if pinned.SHA256 != sum {
+			return &ErrLockMismatch{URL: url, Expected: pinned.SHA256, Actual: sum}
+		}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.artifacts[url] = Artifact{URL: url, SHA256: sum, Size: size}
+	return nil
+}
+
+// Lock is everything recorded so far. versions maps an artifact's url to its release.
+func (r *Recorder) Lock(versions map[string]string, packages []Package) Lock {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	lock := Lock{Packages: packages}
+	for url, artifact := range r.artifacts {
+		artifact.Version = versions[url]
+		lock.Artifacts = append(lock.Artifacts, artifact)
+	}
+	return lock
+}
+
+// recordingBody hashes a response as it's read and records it once it's read to the end. A body closed early is a
+// partial download and isn't recorded.
+type recordingBody struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	size     int64
+	url      string
+	recorder *Recorder
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.hash.Write(p[:n])
+	b.size += int64(n)
+	if errors.Is(err, io.EOF) {
+		if recordErr := b.recorder.record(b.url, hex.EncodeToString(b.hash.Sum(nil)), b.size); recordErr != nil {
+			return n, recordErr
+		}
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	return b.body.Close()
+}
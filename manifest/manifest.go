@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	StatusCompleted   = "completed"
+	StatusSkipped     = "skipped"
+	StatusForcedSkip  = "force-skipped"
+	StatusFailed      = "failed"
+	BuilderName       = "pi-image-builder"
+	manifestExtension = ".manifest.json"
+)
+
+// Manifest describes a single built image, it is written next to the compressed image and uploaded with it.
+type Manifest struct {
+	Builder   string    `json:"builder"`
+	CreatedAt time.Time `json:"createdAt"`
+	Image     string    `json:"image,omitempty"`
+	// Artifacts lists every file published from the image, Image is the first of them.
+	Artifacts []Artifact `json:"artifacts,omitempty"`
+	// Profile is the image variant that was built.
+	Profile string `json:"profile,omitempty"`
+	// HostArch is the architecture of the host that built the image, Emulated is set when its binaries ran through
+	// qemu.
+	HostArch string `json:"hostArch,omitempty"`
+	Emulated bool   `json:"emulated"`
+	// Kubernetes is the kubernetes release installed in the image.
+	Kubernetes string `json:"kubernetes,omitempty"`
+	// LayerCache is the layer cache key the image was built from or saved to.
+	LayerCache string `json:"layerCache,omitempty"`
+	// Packages are the debs installed once the packages step finished, a later build can pin them to replay the image.
+	Packages []Package `json:"packages,omitempty"`
+	// KernelPackages are the pinned kernel packages as installed, empty when the kernel wasn't pinned.
+	KernelPackages []Package `json:"kernelPackages,omitempty"`
+	// Purged are the packages purged from the base image and Masked the units still masked once it was configured.
+	Purged []string `json:"purged,omitempty"`
+	Masked []string `json:"masked,omitempty"`
+	// Files are the site specific files copied into the image from the build host.
+	Files []File       `json:"files,omitempty"`
+	Steps []StepRecord `json:"steps"`
+	// PartiallyConfigured is set whenever a step was force skipped so consumers can refuse the image.
+	PartiallyConfigured bool     `json:"partiallyConfigured"`
+	Warnings            []string `json:"warnings,omitempty"`
+}
+
+// Artifact is one published file and its format.
+type Artifact struct {
+	Name   string `json:"name"`
+	Format string `json:"format"`
+}
+
+// Package is a deb and the exact version installed in the image.
+type Package struct {
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Architecture string `json:"architecture"`
+}
+
+// File is a file copied into the image, Source is relative to the files dir it came from.
+type File struct {
+	Path   string `json:"path"`
+	Source string `json:"source"`
+	SHA256 string `json:"sha256"`
+}
+
+type StepRecord struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func New() *Manifest {
+	return &Manifest{Builder: BuilderName, CreatedAt: time.Now().UTC()}
+}
+
+func (m *Manifest) RecordStep(name string, status string, reason string) {
+	m.Steps = append(m.Steps, StepRecord{Name: name, Status: status, Reason: reason})
+	if status == StatusForcedSkip {
+		m.PartiallyConfigured = true
+		m.Warnings = append(m.Warnings, fmt.Sprintf("step %s was force skipped, the image may be partially configured", name))
+	}
+}
+
+func (m *Manifest) Warn(format string, a ...any) {
+	m.Warnings = append(m.Warnings, fmt.Sprintf(format, a...))
+}
+
+// AddArtifact records a published file, the first one becomes the manifest's Image.
+func (m *Manifest) AddArtifact(name string, format string) {
+	if m.Image == "" {
+		m.Image = name
+	}
+	m.Artifacts = append(m.Artifacts, Artifact{Name: name, Format: format})
+}
+
+// FileName is the manifest name that accompanies an image artifact.
+func FileName(imageName string) string {
+	return imageName + manifestExtension
+}
+
+// IsFileName reports whether name is a manifest written next to an image artifact.
+func IsFileName(name string) bool {
+	return strings.HasSuffix(name, manifestExtension)
+}
+
+// Read decodes a manifest written by Write.
+func Read(r io.Reader) (*Manifest, error) {
+	m := &Manifest{}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, fmt.Errorf("could not parse manifest: %w", err)
+	}
+	return m, nil
+}
+
+func (m *Manifest) Write(fs afero.Fs, path string) error {
+	data, marshalErr := json.MarshalIndent(m, "", "  ")
+	if marshalErr != nil {
+		return marshalErr
+	}
+	return afero.WriteFile(fs, path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,246 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const unmountAttempts = 5
+
+// unmountBackoff is multiplied by the attempt number between umount retries.
+var unmountBackoff = 500 * time.Millisecond
+
+// LazyUnmount falls back to umount --lazy once a busy mount runs out of retries. Commands set it from a flag, without
+// it a busy mount fails cleanup and the loop device stays attached.
+var LazyUnmount = true
+
+// procDir is where mountHolders looks for processes, tests point it at a fake tree.
+var procDir = "/proc"
+
+// MountHolder is a process with a file, working directory, or root under a busy mount.
+type MountHolder struct {
+	PID     int
+	Command string
+	Path    string
+}
+
+func (h MountHolder) String() string {
+	return fmt.Sprintf("%d (%s) %s", h.PID, h.Command, h.Path)
+}
+
+// ErrMountBusy is returned when a mount is still busy after every retry. Holders are the processes found keeping it
+// busy, which may be empty when /proc couldn't be read.
+type ErrMountBusy struct {
+	Target  string
+	Holders []MountHolder
+	Err     error
+}
+
+func (e *ErrMountBusy) Error() string {
+	if len(e.Holders) == 0 {
+		return fmt.Sprintf("could not unmount %s: %v", e.Target, e.Err)
+	}
+	holders := make([]string, 0, len(e.Holders))
+	for _, holder := range e.Holders {
+		holders = append(holders, holder.String())
+	}
+	return fmt.Sprintf("could not unmount %s: %v, held open by: %s", e.Target, e.Err, strings.Join(holders, ", "))
+}
+
+func (e *ErrMountBusy) Unwrap() error {
+	return e.Err
+}
+
+// mountHolders walks every process's open files, working directory, and root looking for anything under target, the
+// same thing fuser -vm reports but without needing psmisc on the host.
+func mountHolders(target string) ([]MountHolder, error) {
+	absolute, absErr := filepath.Abs(target)
+	if absErr != nil {
+		return nil, absErr
+	}
+	processes, readErr := os.ReadDir(procDir)
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	holders := make([]MountHolder, 0)
+	for _, process := range processes {
+		pid, parseErr := strconv.Atoi(process.Name())
+		if parseErr != nil {
+			continue
+		}
+		processDir := filepath.Join(procDir, process.Name())
+		links := []string{filepath.Join(processDir, "cwd"), filepath.Join(processDir, "root")}
+		// processes can exit or be off limits mid walk, whatever can't be read is skipped
+		if fds, err := os.ReadDir(filepath.Join(processDir, "fd")); err == nil {
+			for _, fd := range fds {
+				links = append(links, filepath.Join(processDir, "fd", fd.Name()))
+			}
+		}
+		comm, _ := os.ReadFile(filepath.Join(processDir, "comm"))
+		for _, link := range links {
+			held, err := os.Readlink(link)
+			if err != nil || (held != absolute && !strings.HasPrefix(held, absolute+"/")) {
+				continue
+			}
+			holders = append(holders, MountHolder{PID: pid, Command: strings.TrimSpace(string(comm)), Path: held})
+		}
+	}
+	return holders, nil
+}
+
+// MediaCleanup is what CleanupMedia tears down for one flashed device. Zero values are skipped so it's safe to run
+// after a partial flash.
+type MediaCleanup struct {
+	// Device is the flashed device, its volume group is deactivated.
+	Device string
+	// Volumes are the logical volumes MountMedia mounted under the workspace's MediaRoot.
+	Volumes []VolumeMount
+	// CryptNames are dm-crypt mappings opened on the media.
+	CryptNames []string
+}
+
+// notMounted matches the errors umount and lvm give when there's nothing to tear down.
+func notMounted(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "not mounted") || strings.Contains(message, "no mount point specified") || strings.Contains(message, "not found")
+}
+
+// unmount retries busy mounts with a short backoff and, when LazyUnmount is set, falls back to a lazy unmount. A
+// target that isn't mounted is already clean. Whatever is keeping a mount busy is logged, or returned in an
+// ErrMountBusy when it couldn't be unmounted at all.
+func unmount(ctx context.Context, runner utility.Runner, target string) error {
+	var lastErr error
+	for attempt := 1; attempt <= unmountAttempts; attempt++ {
+		lastErr = runner.Run(ctx, exec.Command("umount", target))
+		if lastErr == nil || notMounted(lastErr) {
+			return nil
+		}
+		telemetry.AddRetry(ctx, "unmount")
+		time.Sleep(unmountBackoff * time.Duration(attempt))
+	}
+
+	holders, holdersErr := mountHolders(target)
+	if holdersErr != nil {
+		telemetry.Logger(ctx).WarnContext(ctx, "could not find what is holding the mount", "target", target, "error", holdersErr)
+	}
+	if !LazyUnmount {
+		return &ErrMountBusy{Target: target, Holders: holders, Err: lastErr}
+	}
+
+	if err := runner.Run(ctx, exec.Command("umount", "--lazy", target)); err != nil {
+		return &ErrMountBusy{Target: target, Holders: holders, Err: errors.New(lastErr.Error() + ", lazy unmount failed too: " + err.Error())}
+	}
+	telemetry.Logger(ctx).WarnContext(ctx, "lazily unmounted a busy mount", "target", target, "holders", fmt.Sprint(holders))
+	return nil
+}
+
+// UnmountDevice unmounts everything mounted from device or its partitions and volumes so it can be wiped, deepest mount
+// first, retrying busy mounts the way CleanupMedia does. Swap is left alone, SafetyPolicy refuses a device with swap on
+// it as a system disk.
+func UnmountDevice(ctx context.Context, runner utility.Runner, device partition.BlockDevice) error {
+	targets := make([]string, 0)
+	for _, target := range device.MountPoints() {
+		if strings.HasPrefix(target, "/") {
+			targets = append(targets, target)
+		}
+	}
+	// a child's path sorts after its parent's, so reversed it's unmounted first
+	sort.Sort(sort.Reverse(sort.StringSlice(targets)))
+	for _, target := range targets {
+		if err := unmount(ctx, runner, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CleanupMedia unmounts the media and deactivates its volume group so the card can be pulled safely, or the next
+// card in a batch can create its own.
+func CleanupMedia(ctx context.Context, runner utility.Runner, w Workspace, cleanup MediaCleanup) error {
+	ctx, span := telemetry.Start(ctx, "clean up media")
+	defer span.End()
+	span.SetAttributes(telemetry.DevicePathKey.String(cleanup.Device))
+
+	// children before parents so nothing is left busy underneath
+	targets := make([]string, 0)
+	volumes := sortedVolumes(cleanup.Volumes)
+	for i := len(volumes) - 1; i >= 0; i-- {
+		targets = append(targets, w.mediaPath(volumes[i].MountPoint))
+	}
+	targets = append(targets, w.MediaBoot(), w.MediaRoot())
+	for _, target := range targets {
+		if err := unmount(ctx, runner, target); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range cleanup.CryptNames {
+		if err := runner.Run(ctx, exec.Command("cryptsetup", "close", name)); err != nil && !strings.Contains(err.Error(), "doesn't exist") { //nolint:gosec
+			return err
+		}
+	}
+
+	if cleanup.Device != "" {
+		if err := runner.Run(ctx, partition.LVMCommand(cleanup.Device, "vgchange", "-an", utility.VolumeGroupName)); err != nil && !notMounted(err) {
+			return err
+		}
+	}
+
+	return runner.Run(ctx, exec.Command("sync"))
+}
+
+// CleanupImage unmounts the image and detaches its loop device, workingImage is deleted when set.
+func CleanupImage(ctx context.Context, runner utility.Runner, fileSystem afero.Fs, w Workspace, image Entry, workingImage string) error {
+	ctx, span := telemetry.Start(ctx, "clean up image")
+	defer span.End()
+
+	for _, target := range []string{w.BootMount(), w.RootMount()} {
+		if err := unmount(ctx, runner, target); err != nil {
+			return err
+		}
+	}
+
+	if image.Name != "" {
+		if err := runner.Run(ctx, exec.Command("losetup", "--detach", image.Name)); err != nil { //nolint:gosec
+			return err
+		}
+	}
+
+	if workingImage != "" {
+		if err := fileSystem.Remove(workingImage); err != nil && !errors.Is(err, afero.ErrFileNotFound) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanupMedia(t *testing.T) {
+	unmountBackoff = 0
+	vgchange := strings.Join(partition.LVMCommand("/dev/sda", "vgchange", "-an", "rootvg").Args, " ")
+	runner := &utility.FakeRunner{Errors: map[string]error{
+		"umount /work/media-mnt/var/lib/longhorn": errors.New("umount: /work/media-mnt/var/lib/longhorn: not mounted."),
+		"cryptsetup close csi_crypt":              errors.New("Device csi_crypt doesn't exist or access denied."),
+	}}
+	cleanup := MediaCleanup{
+		Device:     "/dev/sda",
+		Volumes:    []VolumeMount{{Device: "/dev/mapper/rootvg-csilv", MountPoint: "/var/lib/longhorn"}, {Device: "/dev/mapper/containerd_crypt", MountPoint: "/var/lib/containerd"}},
+		CryptNames: []string{"csi_crypt", "containerd_crypt"},
+	}
+
+	assert.NoError(t, CleanupMedia(context.Background(), runner, testWorkspace, cleanup))
+	assert.Equal(t, []string{
+		"umount /work/media-mnt/var/lib/containerd",
+		"umount /work/media-mnt/var/lib/longhorn",
+		"umount /work/media-mnt/boot/firmware",
+		"umount /work/media-mnt",
+		"cryptsetup close csi_crypt",
+		"cryptsetup close containerd_crypt",
+		vgchange,
+		"sync",
+	}, runner.Commands)
+
+	// a flash that died before the volume group was created has nothing to deactivate
+	missing := &utility.FakeRunner{Errors: map[string]error{vgchange: errors.New(`Volume group "rootvg" not found`)}}
+	assert.NoError(t, CleanupMedia(context.Background(), missing, testWorkspace, MediaCleanup{Device: "/dev/sda"}))
+}
+
+func TestUnmountDevice(t *testing.T) {
+	unmountBackoff = 0
+	runner := &utility.FakeRunner{Errors: map[string]error{
+		"umount /media/kat/system-boot": errors.New("umount: /media/kat/system-boot: target is busy."),
+	}}
+	device := partition.BlockDevice{Name: "sdb", Children: []partition.BlockDevice{
+		{Name: "sdb1", MountPoint: "/media/kat/system-boot"},
+		{Name: "sdb2", Children: []partition.BlockDevice{
+			{Name: "rootvg-rootlv", MountPoint: "/media/kat/writable"},
+			{Name: "rootvg-csilv", MountPoint: "/media/kat/writable/var/lib/longhorn"},
+			{Name: "rootvg-swaplv", MountPoint: "[SWAP]"},
+		}},
+	}}
+
+	assert.NoError(t, UnmountDevice(context.Background(), runner, device))
+	expected := []string{"umount /media/kat/writable/var/lib/longhorn", "umount /media/kat/writable"}
+	for attempt := 0; attempt < unmountAttempts; attempt++ {
+		expected = append(expected, "umount /media/kat/system-boot")
+	}
+	assert.Equal(t, append(expected, "umount --lazy /media/kat/system-boot"), runner.Commands)
+}
+
+func TestCleanupImage(t *testing.T) {
+	unmountBackoff = 0
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "image-to-be-flashed.img", []byte("image"), 0o644))
+	runner := &utility.FakeRunner{Errors: map[string]error{
+		"umount /work/mnt/boot/firmware": errors.New("umount: /work/mnt/boot/firmware: not mounted."),
+	}}
+
+	assert.NoError(t, CleanupImage(context.Background(), runner, fs, testWorkspace, Entry{Name: "/dev/loop3"}, "image-to-be-flashed.img"))
+	assert.Equal(t, []string{
+		"umount /work/mnt/boot/firmware",
+		"umount /work/mnt",
+		"losetup --detach /dev/loop3",
+	}, runner.Commands)
+
+	exists, err := afero.Exists(fs, "image-to-be-flashed.img")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// nothing was attached yet, so there's no loop device to detach
+	partial := &utility.FakeRunner{}
+	assert.NoError(t, CleanupImage(context.Background(), partial, afero.NewMemMapFs(), testWorkspace, Entry{}, ""))
+	assert.Equal(t, []string{"umount /work/mnt/boot/firmware", "umount /work/mnt"}, partial.Commands)
+}
+
+func TestUnmountBusy(t *testing.T) {
+	unmountBackoff = 0
+	busy := errors.New("umount: /work/media-mnt: target is busy.")
+
+	lazy := &utility.FakeRunner{Errors: map[string]error{"umount /work/media-mnt": busy}}
+	assert.NoError(t, unmount(context.Background(), lazy, testWorkspace.MediaRoot()))
+	assert.Len(t, lazy.Commands, unmountAttempts+1)
+	assert.Equal(t, "umount --lazy /work/media-mnt", lazy.Commands[unmountAttempts])
+
+	stuck := &utility.FakeRunner{Errors: map[string]error{
+		"umount /work/media-mnt":        busy,
+		"umount --lazy /work/media-mnt": errors.New("umount: /work/media-mnt: permission denied"),
+	}}
+	err := unmount(context.Background(), stuck, testWorkspace.MediaRoot())
+	assert.ErrorContains(t, err, "target is busy")
+	assert.ErrorContains(t, err, "lazy unmount failed")
+}
+
+// fakeProcess lays out the parts of /proc/<pid> mountHolders reads.
+func fakeProcess(t *testing.T, proc string, pid string, comm string, cwd string, fds ...string) {
+	dir := filepath.Join(proc, pid)
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "fd"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "comm"), []byte(comm+"\n"), 0o644))
+	assert.NoError(t, os.Symlink(cwd, filepath.Join(dir, "cwd")))
+	assert.NoError(t, os.Symlink("/", filepath.Join(dir, "root")))
+	for i, fd := range fds {
+		assert.NoError(t, os.Symlink(fd, filepath.Join(dir, "fd", strconv.Itoa(i))))
+	}
+}
+
+func TestMountHolders(t *testing.T) {
+	proc := t.TempDir()
+	previous := procDir
+	procDir = proc
+	t.Cleanup(func() { procDir = previous })
+
+	mount, err := filepath.Abs(testWorkspace.RootMount())
+	assert.NoError(t, err)
+	fakeProcess(t, proc, "412", "systemd-journal", "/", "/dev/null", mount+"/var/log/journal/system.journal")
+	fakeProcess(t, proc, "977", "bash", mount+"/root")
+	fakeProcess(t, proc, "1003", "sleep", "/home", mount+"-other/file", "socket:[1234]")
+	assert.NoError(t, os.MkdirAll(filepath.Join(proc, "self"), 0o755))
+
+	holders, holdersErr := mountHolders(testWorkspace.RootMount())
+	assert.NoError(t, holdersErr)
+	assert.ElementsMatch(t, []MountHolder{
+		{PID: 412, Command: "systemd-journal", Path: mount + "/var/log/journal/system.journal"},
+		{PID: 977, Command: "bash", Path: mount + "/root"},
+	}, holders)
+}
+
+func TestUnmountBusyWithoutLazy(t *testing.T) {
+	unmountBackoff = 0
+	LazyUnmount = false
+	t.Cleanup(func() { LazyUnmount = true })
+	proc := t.TempDir()
+	previous := procDir
+	procDir = proc
+	t.Cleanup(func() { procDir = previous })
+	mount, err := filepath.Abs(testWorkspace.BootMount())
+	assert.NoError(t, err)
+	fakeProcess(t, proc, "412", "systemd-journal", "/", mount+"/config.txt")
+
+	busy := errors.New("umount: /work/mnt/boot/firmware: target is busy.")
+	runner := &utility.FakeRunner{Errors: map[string]error{"umount /work/mnt/boot/firmware": busy}}
+	unmountErr := unmount(context.Background(), runner, testWorkspace.BootMount())
+
+	var busyErr *ErrMountBusy
+	assert.ErrorAs(t, unmountErr, &busyErr)
+	assert.ErrorIs(t, unmountErr, busy)
+	assert.Equal(t, []MountHolder{{PID: 412, Command: "systemd-journal", Path: mount + "/config.txt"}}, busyErr.Holders)
+	assert.ErrorContains(t, unmountErr, "held open by: 412 (systemd-journal) "+mount+"/config.txt")
+	assert.Len(t, runner.Commands, unmountAttempts)
+	assert.NotContains(t, runner.Commands, "umount --lazy /work/mnt/boot/firmware")
+}
@@ -20,44 +20,143 @@ import (
 	"context"
 	"fmt"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
 
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/LadySerena/pi-image-builder/telemetry"
 	"github.com/LadySerena/pi-image-builder/utility"
 	"github.com/spf13/afero"
 )
 
-const (
-	mediaRoot = "./media-mnt"
-	mediaBoot = "./media-mnt/boot/firmware"
-)
+// VolumeMount is a logical volume that gets mounted under the workspace's MediaRoot so Flash copies its files onto the right
+// filesystem. MountPoint is where the volume lives on the running node, e.g. /var/lib/containerd.
+type VolumeMount struct {
+	Device     string
+	MountPoint string
+}
+
+// sortedVolumes orders volumes parents first and drops the root volume, which is always mounted first.
+func sortedVolumes(volumes []VolumeMount) []VolumeMount {
+	sorted := make([]VolumeMount, 0, len(volumes))
+	for _, volume := range volumes {
+		if filepath.Clean(volume.MountPoint) != "/" {
+			sorted = append(sorted, volume)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return strings.Count(filepath.Clean(sorted[i].MountPoint), "/") < strings.Count(filepath.Clean(sorted[j].MountPoint), "/")
+	})
+	return sorted
+}
+
+// VolumeMounts picks the logical volumes out of the configured fstab so they're mounted at the same paths under the
+// workspace's MediaRoot.
+func VolumeMounts(mounts []configure.Mount, layout partition.VolumeLayout) []VolumeMount {
+	volumes := make([]VolumeMount, 0)
+	for _, mount := range configure.ResolveMounts(mounts, layout) {
+		if mount.Volume == "" {
+			continue
+		}
+		volumes = append(volumes, VolumeMount{Device: mount.Device, MountPoint: mount.MountPoint})
+	}
+	return volumes
+}
 
-func MountMedia(ctx context.Context, fileSystem afero.Fs, device string) error {
+// MountMedia mounts the root volume, the boot partition, and every other volume at its fstab location under
+// the workspace's MediaRoot.
+func MountMedia(ctx context.Context, runner utility.Runner, fileSystem afero.Fs, w Workspace, device string, volumes []VolumeMount) error {
+	ctx, span := telemetry.Start(ctx, "mount media")
+	defer span.End()
+	span.SetAttributes(telemetry.DevicePathKey.String(device))
 
-	if err := fileSystem.MkdirAll(mediaRoot, 0751); err != nil {
+	if err := mountMediaRoot(ctx, runner, fileSystem, w); err != nil {
+		return err
+	}
+	return mountMediaVolumes(ctx, runner, fileSystem, w, device, volumes)
+}
+
+// MountFlashed mounts a device flashed earlier so it can be configured in place. Its volume group is activated, and
+// its encrypted volumes are opened with the keys InstallKeys left on its root volume, before everything is mounted
+// where MountMedia would mount it. CleanupMedia undoes it.
+func MountFlashed(ctx context.Context, runner utility.Runner, fileSystem afero.Fs, w Workspace, device string, layout partition.VolumeLayout, volumes []VolumeMount) error {
+	ctx, span := telemetry.Start(ctx, "mount flashed media")
+	defer span.End()
+	span.SetAttributes(telemetry.DevicePathKey.String(device))
+
+	if err := runner.Run(ctx, partition.LVMCommand(device, "vgchange", "-ay", utility.VolumeGroupName)); err != nil {
+		return fmt.Errorf("could not activate volume group on %s: %w", device, err)
+	}
+	if err := mountMediaRoot(ctx, runner, fileSystem, w); err != nil {
 		return err
 	}
 
-	if err := exec.Command("mount", utility.MapperName(utility.RootLogicalVolume), mediaRoot).Run(); err != nil { //nolint:gosec
+	keyDir := w.mediaPath(partition.KeyDir)
+	for _, volume := range layout.Encrypted() {
+		open := exec.Command("cryptsetup", "open", "--key-file", partition.KeyFile(keyDir, volume), utility.MapperName(volume.Name), utility.CryptName(volume.Name)) //nolint:gosec
+		if err := runner.Run(ctx, open); err != nil {
+			return fmt.Errorf("could not open encrypted volume %s: %w", volume.Name, err)
+		}
+	}
+
+	return mountMediaVolumes(ctx, runner, fileSystem, w, device, volumes)
+}
+
+// UseHostResolvConf lets commands run in the mounted media resolve names the same way the image's do while it's
+// configured, RestoreResolvConf undoes it before the media is cleaned up.
+func UseHostResolvConf(fileSystem afero.Fs, w Workspace) error {
+	return useHostResolvConf(fileSystem, w.mediaResolv(), w.mediaResolvBackup())
+}
+
+// RestoreResolvConf points the mounted media's resolv.conf back at systemd-resolved's stub.
+func RestoreResolvConf(fileSystem afero.Fs, w Workspace) error {
+	return restoreResolvConf(fileSystem, w.mediaResolv(), w.mediaResolvBackup())
+}
+
+func mountMediaRoot(ctx context.Context, runner utility.Runner, fileSystem afero.Fs, w Workspace) error {
+	if err := fileSystem.MkdirAll(w.MediaRoot(), 0751); err != nil {
 		return err
 	}
+	return runner.Run(ctx, exec.Command("mount", utility.MapperName(utility.RootLogicalVolume), w.MediaRoot())) //nolint:gosec
+}
 
-	if err := fileSystem.MkdirAll(mediaBoot, 0751); err != nil {
+// mountMediaVolumes mounts the boot partition and the volumes other than root, which has to be mounted already.
+func mountMediaVolumes(ctx context.Context, runner utility.Runner, fileSystem afero.Fs, w Workspace, device string, volumes []VolumeMount) error {
+	if err := fileSystem.MkdirAll(w.MediaBoot(), 0751); err != nil {
 		return err
 	}
 
-	if err := exec.Command("mount", fmt.Sprintf("%s1", device), mediaBoot).Run(); err != nil { //nolint:gosec
+	if err := runner.Run(ctx, exec.Command("mount", utility.PartitionName(device, 1), w.MediaBoot())); err != nil { //nolint:gosec
 		return err
 	}
 
+	for _, volume := range sortedVolumes(volumes) {
+		target := w.mediaPath(volume.MountPoint)
+		if err := fileSystem.MkdirAll(target, 0751); err != nil {
+			return err
+		}
+		if err := runner.Run(ctx, exec.Command("mount", volume.Device, target)); err != nil { //nolint:gosec
+			return err
+		}
+	}
+
 	return nil
 }
 
-func Flash(ctx context.Context, device string, entry Entry) error {
-	bootSync := exec.Command("rsync", "--progress", "-axv", utility.TrailingSlash(bootMountPoint), utility.TrailingSlash(mediaBoot)) //nolint:gosec
-	rootSync := exec.Command("rsync", "--progress", "-axv", utility.TrailingSlash(rootMountPoint), utility.TrailingSlash(mediaRoot)) //nolint:gosec
-
-	if err := utility.RunCommandWithOutput(ctx, bootSync, nil); err != nil {
+// Flash copies the mounted image onto the mounted media and verifies the copy.
+func Flash(ctx context.Context, runner utility.Runner, w Workspace, device string, entry Entry) error {
+	if err := CheckFreeSpace(ctx, w); err != nil {
 		return err
 	}
 
-	return utility.RunCommandWithOutput(ctx, rootSync, nil)
+	for _, pair := range flashPairs(w) {
+		sync := exec.Command("rsync", "--progress", "-axv", utility.TrailingSlash(pair.source), utility.TrailingSlash(pair.destination)) //nolint:gosec
+		if err := runner.Run(ctx, sync); err != nil {
+			return err
+		}
+	}
+
+	return VerifyFlash(ctx, runner, w)
 }
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountMedia(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	runner := &utility.FakeRunner{}
+	volumes := []VolumeMount{
+		{Device: "/dev/mapper/rootvg-rootlv", MountPoint: "/"},
+		{Device: "/dev/mapper/containerd_crypt", MountPoint: "/var/lib/containerd"},
+		{Device: "/dev/mapper/rootvg-csilv", MountPoint: "/var/lib/longhorn"},
+	}
+
+	assert.NoError(t, MountMedia(context.Background(), runner, fs, testWorkspace, "/dev/mmcblk0", volumes))
+	assert.Equal(t, []string{
+		"mount /dev/mapper/rootvg-rootlv /work/media-mnt",
+		"mount /dev/mmcblk0p1 /work/media-mnt/boot/firmware",
+		"mount /dev/mapper/containerd_crypt /work/media-mnt/var/lib/containerd",
+		"mount /dev/mapper/rootvg-csilv /work/media-mnt/var/lib/longhorn",
+	}, runner.Commands)
+
+	for _, dir := range []string{"/work/media-mnt/boot/firmware", "/work/media-mnt/var/lib/containerd", "/work/media-mnt/var/lib/longhorn"} {
+		exists, err := afero.DirExists(fs, dir)
+		assert.NoError(t, err)
+		assert.True(t, exists, dir)
+	}
+}
+
+func TestMountMediaNested(t *testing.T) {
+	// parents have to be mounted before anything underneath them or the child mount gets hidden
+	runner := &utility.FakeRunner{}
+	volumes := []VolumeMount{
+		{Device: "/dev/mapper/rootvg-imageslv", MountPoint: "/var/lib/containerd/images"},
+		{Device: "/dev/mapper/rootvg-containerdlv", MountPoint: "/var/lib/containerd"},
+	}
+
+	assert.NoError(t, MountMedia(context.Background(), runner, afero.NewMemMapFs(), testWorkspace, "/dev/sda", volumes))
+	assert.Equal(t, []string{
+		"mount /dev/mapper/rootvg-rootlv /work/media-mnt",
+		"mount /dev/sda1 /work/media-mnt/boot/firmware",
+		"mount /dev/mapper/rootvg-containerdlv /work/media-mnt/var/lib/containerd",
+		"mount /dev/mapper/rootvg-imageslv /work/media-mnt/var/lib/containerd/images",
+	}, runner.Commands)
+}
+
+func TestMountMediaError(t *testing.T) {
+	runner := &utility.FakeRunner{Errors: map[string]error{
+		"mount /dev/mmcblk0p1 /work/media-mnt/boot/firmware": errors.New("mount: wrong fs type"),
+	}}
+	volumes := []VolumeMount{{Device: "/dev/mapper/rootvg-csilv", MountPoint: "/var/lib/longhorn"}}
+
+	assert.Error(t, MountMedia(context.Background(), runner, afero.NewMemMapFs(), testWorkspace, "/dev/mmcblk0", volumes))
+	assert.Len(t, runner.Commands, 2)
+}
+
+func TestVolumeMounts(t *testing.T) {
+	layout := partition.DefaultVolumeLayout()
+	layout[2].Encrypted = true
+	assert.Equal(t, []VolumeMount{
+		{Device: "/dev/mapper/rootvg-rootlv", MountPoint: "/"},
+		{Device: "/dev/mapper/rootvg-csilv", MountPoint: "/var/lib/longhorn"},
+		{Device: "/dev/mapper/containerdlv_crypt", MountPoint: "/var/lib/containerd"},
+	}, VolumeMounts(nil, layout))
+}
+
+func TestMountFlashed(t *testing.T) {
+	runner := &utility.FakeRunner{}
+	layout := partition.DefaultVolumeLayout()
+	layout[2].Encrypted = true
+
+	assert.NoError(t, MountFlashed(context.Background(), runner, afero.NewMemMapFs(), testWorkspace, "/dev/sda", layout, VolumeMounts(nil, layout)))
+	assert.Equal(t, []string{
+		`vgchange --config devices { filter = [ "a|^/dev/sdap?[0-9]+$|", "r|.*|" ] } -ay rootvg`,
+		"mount /dev/mapper/rootvg-rootlv /work/media-mnt",
+		// the key was installed on the root volume when the card was flashed
+		"cryptsetup open --key-file /work/media-mnt/etc/cryptsetup-keys.d/containerdlv_crypt.key /dev/mapper/rootvg-containerdlv containerdlv_crypt",
+		"mount /dev/sda1 /work/media-mnt/boot/firmware",
+		"mount /dev/mapper/rootvg-csilv /work/media-mnt/var/lib/longhorn",
+		"mount /dev/mapper/containerdlv_crypt /work/media-mnt/var/lib/containerd",
+	}, runner.Commands)
+}
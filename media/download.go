@@ -26,10 +26,11 @@ import (
 	"io"
 	"io/fs"
 	"net/http"
-	"net/url"
 	"os"
-	"path"
+	"time"
 
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/distro"
 	"github.com/LadySerena/pi-image-builder/telemetry"
 	"github.com/LadySerena/pi-image-builder/utility"
 	"github.com/spf13/afero"
@@ -37,35 +38,45 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-func DownloadAndVerifyMedia(ctx context.Context, fileSystem afero.Fs, forceOverwrite bool) error {
+// partialDownloadExtension marks a download that hasn't finished.
+const partialDownloadExtension = ".part"
 
-	ctx, span := telemetry.GetTracer().Start(ctx, "download media")
-	defer span.End()
+// DownloadTimeout bounds each base image download, zero leaves only the http client's timeout. Commands set it from
+// --download-timeout.
+var DownloadTimeout time.Duration
 
-	releaseURL, parseErr := url.Parse("https://cdimage.ubuntu.com/releases/20.04/release")
-	if parseErr != nil {
-		return parseErr
-	}
+// ForceDownload fetches the base image again even when it's already on disk, and extracts it again too. Commands
+// set it from --force-download.
+var ForceDownload bool
+
+// MediaURLs are the base image and its checksum file DownloadAndVerifyMedia fetches.
+func MediaURLs(d distro.Distro) []string {
+	return []string{d.ImageURL(), d.ChecksumURL()}
+}
 
-	checksumName := "SHA256SUMS"
+// DownloadAndVerifyMedia fetches the distro's image and checksum file into the workspace and checks the image against
+// it. Files already there are reused unless forceOverwrite is set.
+func DownloadAndVerifyMedia(ctx context.Context, fileSystem afero.Fs, w Workspace, d distro.Distro, forceOverwrite bool) error {
 
-	_, mediaStatErr := fileSystem.Stat(utility.ImageName)
+	ctx, span := telemetry.Start(ctx, "download media")
+	defer span.End()
+	span.SetAttributes(telemetry.ImageNameKey.String(d.ImageName))
+
+	imageName := w.Path(d.ImageName)
+	checksumName := w.Path(d.ChecksumName)
+	_, mediaStatErr := fileSystem.Stat(imageName)
 	_, checksumStatErr := fileSystem.Stat(checksumName)
 
 	group := new(errgroup.Group)
 	group.Go(func() error {
 		if forceOverwrite || errors.Is(mediaStatErr, fs.ErrNotExist) {
-			mediaURL := *releaseURL
-			mediaURL.Path = path.Join(releaseURL.Path, utility.ImageName)
-			return DownloadFile(ctx, fileSystem, utility.ImageName, mediaURL.String())
+			return DownloadFile(ctx, fileSystem, imageName, d.ImageURL(), DownloadTimeout)
 		}
 		return nil
 	})
 	group.Go(func() error {
 		if forceOverwrite || errors.Is(checksumStatErr, fs.ErrNotExist) {
-			checksumURL := *releaseURL
-			checksumURL.Path = path.Join(releaseURL.Path, checksumName)
-			return DownloadFile(ctx, fileSystem, checksumName, checksumURL.String())
+			return DownloadFile(ctx, fileSystem, checksumName, d.ChecksumURL(), DownloadTimeout)
 		}
 		return nil
 	})
@@ -73,7 +84,7 @@ func DownloadAndVerifyMedia(ctx context.Context, fileSystem afero.Fs, forceOverw
 		return waitErr
 	}
 
-	media, mediaErr := afero.ReadFile(fileSystem, utility.ImageName)
+	media, mediaErr := afero.ReadFile(fileSystem, imageName)
 	if mediaErr != nil {
 		return mediaErr
 	}
@@ -82,38 +93,66 @@ func DownloadAndVerifyMedia(ctx context.Context, fileSystem afero.Fs, forceOverw
 		return checksumOpenErr
 	}
 
-	return ValidateHashes(ctx, utility.ImageName, media, checksum)
+	return ValidateHashes(ctx, d.ImageName, media, checksum)
 }
 
-func DownloadFile(ctx context.Context, fileSystem afero.Fs, fileName string, url string) error {
+// DownloadFile fetches url into fileName. The body is written to fileName.part and only renamed once it's complete, so
+// a cancelled or failed download never leaves a truncated fileName behind for the next run to trust. A timeout above
+// zero bounds this download on top of ctx's own deadline.
+func DownloadFile(ctx context.Context, fileSystem afero.Fs, fileName string, url string, timeout time.Duration) (err error) {
 
-	ctx, span := telemetry.GetTracer().Start(ctx, "Download")
+	ctx, span := telemetry.Start(ctx, "Download")
 	span.AddEvent(fmt.Sprintf("downloading: %s", fileName))
 	defer span.End()
-	media, mediaErr := fileSystem.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	partial := fileName + partialDownloadExtension
+	media, mediaErr := fileSystem.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if mediaErr != nil {
 		return mediaErr
 	}
-	defer utility.WrappedClose(media)
+	defer func() {
+		if closeErr := media.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = fileSystem.Rename(partial, fileName)
+			return
+		}
+		if removeErr := fileSystem.Remove(partial); removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+			err = errors.Join(err, removeErr)
+		}
+	}()
 
-	mediaResponse, mediaDownloadErr := otelhttp.Get(ctx, url)
+	request, requestErr := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if requestErr != nil {
+		return requestErr
+	}
+	mediaResponse, mediaDownloadErr := otelhttp.DefaultClient.Do(request)
 	if mediaDownloadErr != nil {
 		return mediaDownloadErr
 	}
-	defer utility.WrappedClose(mediaResponse.Body)
-	if mediaResponse.StatusCode != http.StatusOK {
-		return fmt.Errorf("received non 200 status code: %d", mediaResponse.StatusCode)
+	if err := configure.CheckResponse(mediaResponse, url); err != nil {
+		return err
 	}
+	defer utility.WrappedClose(mediaResponse.Body)
 
-	_, copyErr := io.Copy(media, mediaResponse.Body)
+	// ContentLength is -1 when the server doesn't send one, progress then only reports bytes and throughput
+	written, copyErr := io.Copy(media, utility.NewProgressReader(ctx, mediaResponse.Body, fileName, mediaResponse.ContentLength))
+	telemetry.AddBytesDownloaded(ctx, written)
 	if copyErr != nil {
 		return copyErr
 	}
-	return nil
+	return media.Sync()
 }
 
 func ValidateHashes(ctx context.Context, fileName string, mediaBytes []byte, checksumBytes []byte) error {
-	_, span := telemetry.GetTracer().Start(ctx, "hash validate")
+	_, span := telemetry.Start(ctx, "hash validate")
 	defer span.End()
 	hash := sha256.New()
 	hash.Write(mediaBytes)
@@ -128,6 +167,23 @@ func ValidateHashes(ctx context.Context, fileName string, mediaBytes []byte, che
 	return nil
 }
 
+// ImageChecksum returns the published sha256 of the base image from its downloaded checksum file.
+func ImageChecksum(fileSystem afero.Fs, w Workspace, d distro.Distro) (string, error) {
+	checksum, readErr := afero.ReadFile(fileSystem, w.Path(d.ChecksumName))
+	if readErr != nil {
+		return "", readErr
+	}
+	checksums, parseErr := extractChecksum(checksum)
+	if parseErr != nil {
+		return "", parseErr
+	}
+	sum, ok := checksums[d.ImageName]
+	if !ok {
+		return "", fmt.Errorf("no checksum for %s in %s", d.ImageName, d.ChecksumName)
+	}
+	return string(sum), nil
+}
+
 func extractChecksum(fileBytes []byte) (map[string][]byte, error) {
 	sums := make(map[string][]byte)
 	split := bytes.Split(fileBytes, []byte("\n"))
@@ -136,11 +192,12 @@ func extractChecksum(fileBytes []byte) (map[string][]byte, error) {
 		if len(line) == 0 {
 			break
 		}
-		lineSplit := bytes.Split(line, []byte(" *"))
+		// sha256sum writes "hash *name" in binary mode and "hash  name" in text mode
+		lineSplit := bytes.Fields(line)
 		if len(lineSplit) != 2 {
 			return sums, errors.New("length mismatch check file format")
 		}
-		sums[string(lineSplit[1])] = lineSplit[0]
+		sums[string(bytes.TrimPrefix(lineSplit[1], []byte("*")))] = lineSplit[0]
 	}
 	return sums, nil
 }
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/distro"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImageChecksum(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, testWorkspace.Path(distro.Ubuntu.ChecksumName), []byte("aaaa *ubuntu-20.04.5-preinstalled-server-arm64+raspi.img.xz\nbbbb *other.img.xz\n"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, testWorkspace.Path(distro.RaspiOS.ChecksumName), []byte("cccc  2023-12-11-raspios-bookworm-arm64-lite.img.xz\n"), 0644))
+
+	ubuntu, ubuntuErr := ImageChecksum(fs, testWorkspace, distro.Ubuntu)
+	assert.NoError(t, ubuntuErr)
+	assert.Equal(t, "aaaa", ubuntu)
+
+	raspios, raspiosErr := ImageChecksum(fs, testWorkspace, distro.RaspiOS)
+	assert.NoError(t, raspiosErr)
+	assert.Equal(t, "cccc", raspios)
+}
+
+func TestExtractChecksumRejectsMalformed(t *testing.T) {
+	_, err := extractChecksum([]byte("aaaa\n"))
+	assert.Error(t, err)
+}
+
+func TestDownloadFile(t *testing.T) {
+	stall := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.xz":
+			_, _ = w.Write([]byte("image"))
+		case "/stalled.xz":
+			// send part of the body then hang like a dead connection
+			w.Header().Set("Content-Length", "100")
+			_, _ = w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			select {
+			case <-stall:
+			case <-r.Context().Done():
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	defer close(stall)
+
+	fs := afero.NewMemMapFs()
+	ctx := context.Background()
+
+	assert.NoError(t, DownloadFile(ctx, fs, "image.xz", server.URL+"/image.xz", 0))
+	contents, readErr := afero.ReadFile(fs, "image.xz")
+	assert.NoError(t, readErr)
+	assert.Equal(t, "image", string(contents))
+
+	assert.ErrorIs(t, DownloadFile(ctx, fs, "stalled.xz", server.URL+"/stalled.xz", 50*time.Millisecond), context.DeadlineExceeded)
+	assert.Error(t, DownloadFile(ctx, fs, "missing.xz", server.URL+"/missing.xz", 0))
+
+	// nothing half written is left where the next run would trust it
+	for _, name := range []string{"stalled.xz", "stalled.xz.part", "missing.xz", "missing.xz.part", "image.xz.part"} {
+		exists, _ := afero.Exists(fs, name)
+		assert.False(t, exists, name)
+	}
+}
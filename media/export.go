@@ -0,0 +1,311 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/klauspost/compress/gzip"
+	"github.com/spf13/afero"
+)
+
+// ExportFormat is how the configured root filesystem is written out for running it as a container.
+type ExportFormat string
+
+const (
+	// ExportOCI is an OCI image layout tarball for the linux/arm64 platform, importable with `ctr images import` or
+	// `docker load`.
+	ExportOCI ExportFormat = "oci"
+	// ExportTar is a plain tarball of the root filesystem for `docker import --platform linux/arm64`.
+	ExportTar ExportFormat = "tar"
+)
+
+const (
+	ociLayoutVersion   = "1.0.0"
+	ociIndexMediaType  = "application/vnd.oci.image.index.v1+json"
+	ociManifestType    = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType  = "application/vnd.oci.image.layer.v1.tar+gzip"
+	// ociRefAnnotation names the image in the index, ctr uses it as the imported image's name
+	ociRefAnnotation = "org.opencontainers.image.ref.name"
+)
+
+// RootfsExcludes are left out of an exported root filesystem. They're mount points filled in at runtime, by the
+// container runtime or the pi's firmware, so only the empty directories are kept.
+var RootfsExcludes = []string{"/boot/firmware", "/proc", "/sys", "/dev"}
+
+// RootfsExport is where and how to export the root filesystem, the zero value exports nothing.
+type RootfsExport struct {
+	Path   string
+	Format ExportFormat
+	// Reference names the image in an OCI export, e.g. pi-image:1.2.0, empty leaves it unnamed
+	Reference string
+}
+
+// Enabled reports whether an export was asked for.
+func (e RootfsExport) Enabled() bool {
+	return e.Path != ""
+}
+
+// Validate rejects unknown formats.
+func (e RootfsExport) Validate() error {
+	switch e.Format {
+	case ExportOCI, ExportTar:
+		return nil
+	}
+	return fmt.Errorf("unknown export format %q, use %s or %s", e.Format, ExportOCI, ExportTar)
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type ociConfig struct {
+	Architecture string       `json:"architecture"`
+	OS           string       `json:"os"`
+	Variant      string       `json:"variant,omitempty"`
+	Config       ociRunConfig `json:"config"`
+	RootFS       ociRootFS    `json:"rootfs"`
+}
+
+type ociRunConfig struct {
+	Cmd []string `json:"Cmd,omitempty"`
+}
+
+type ociRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// armPlatform is the pi's platform, every export is for it no matter what architecture built it.
+var armPlatform = ociPlatform{Architecture: "arm64", OS: "linux", Variant: "v8"}
+
+// ExportRootfs tars up root, the configured image's root filesystem, to export.Path on fileSystem. Everything under
+// RootfsExcludes and the emulator copied in for configuring is left out.
+func ExportRootfs(ctx context.Context, fileSystem afero.Fs, root afero.Fs, export RootfsExport) error {
+	ctx, span := telemetry.Start(ctx, "export rootfs")
+	defer span.End()
+
+	if err := export.Validate(); err != nil {
+		return err
+	}
+	telemetry.Logger(ctx).Info("exporting root filesystem", "path", export.Path, "format", export.Format)
+
+	options := utility.TreeOptions{
+		Exclude: RootfsExcludes,
+		Skip:    configure.EmulationFiles(),
+		Skipped: func(name string) {
+			span.AddEvent(fmt.Sprintf("skipping special file: %s", name))
+		},
+	}
+	temporary := export.Path + ".tmp"
+	var exportErr error
+	switch export.Format {
+	case ExportTar:
+		exportErr = writeRootfsTar(fileSystem, root, temporary, options)
+	case ExportOCI:
+		exportErr = writeOCILayout(fileSystem, root, temporary, export.Reference, options)
+	}
+	if exportErr != nil {
+		_ = fileSystem.Remove(temporary)
+		return fmt.Errorf("could not export root filesystem to %s: %w", export.Path, exportErr)
+	}
+	return fileSystem.Rename(temporary, export.Path)
+}
+
+func writeRootfsTar(fileSystem afero.Fs, root afero.Fs, name string, options utility.TreeOptions) (err error) {
+	file, createErr := fileSystem.Create(name)
+	if createErr != nil {
+		return createErr
+	}
+	defer utility.CloseWithErr(file, &err)
+
+	tarWriter := tar.NewWriter(file)
+	if err := utility.WriteTree(root, tarWriter, options); err != nil {
+		return err
+	}
+	return tarWriter.Close()
+}
+
+// writeOCILayout writes an OCI image layout holding a single layer image to name. The layer is written to a file
+// next to it first since its digest has to be known before the manifest pointing at it can be written.
+func writeOCILayout(fileSystem afero.Fs, root afero.Fs, name string, reference string, options utility.TreeOptions) (err error) {
+	layerName := name + ".layer"
+	defer func() {
+		_ = fileSystem.Remove(layerName)
+	}()
+	layer, diffID, layerErr := writeLayer(fileSystem, root, layerName, options)
+	if layerErr != nil {
+		return layerErr
+	}
+
+	config, configErr := json.Marshal(ociConfig{
+		Architecture: armPlatform.Architecture,
+		OS:           armPlatform.OS,
+		Variant:      armPlatform.Variant,
+		Config:       ociRunConfig{Cmd: []string{"/bin/bash"}},
+		RootFS:       ociRootFS{Type: "layers", DiffIDs: []string{diffID}},
+	})
+	if configErr != nil {
+		return configErr
+	}
+	configDescriptor := blobDescriptor(ociConfigMediaType, config)
+	manifest, manifestErr := json.Marshal(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		Config:        configDescriptor,
+		Layers:        []ociDescriptor{layer},
+	})
+	if manifestErr != nil {
+		return manifestErr
+	}
+	manifestDescriptor := blobDescriptor(ociManifestType, manifest)
+	platform := armPlatform
+	manifestDescriptor.Platform = &platform
+	if reference != "" {
+		manifestDescriptor.Annotations = map[string]string{ociRefAnnotation: reference}
+	}
+	index, indexErr := json.Marshal(ociIndex{SchemaVersion: 2, MediaType: ociIndexMediaType, Manifests: []ociDescriptor{manifestDescriptor}})
+	if indexErr != nil {
+		return indexErr
+	}
+
+	file, createErr := fileSystem.Create(name)
+	if createErr != nil {
+		return createErr
+	}
+	defer utility.CloseWithErr(file, &err)
+	tarWriter := tar.NewWriter(file)
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{name: "oci-layout", content: []byte(fmt.Sprintf(`{"imageLayoutVersion":%q}`, ociLayoutVersion))},
+		{name: "index.json", content: index},
+		{name: blobPath(configDescriptor.Digest), content: config},
+		{name: blobPath(manifestDescriptor.Digest), content: manifest},
+	}
+	for _, entry := range files {
+		if err := writeTarFile(tarWriter, entry.name, int64(len(entry.content)), bytes.NewReader(entry.content)); err != nil {
+			return err
+		}
+	}
+
+	layerFile, openErr := fileSystem.Open(layerName)
+	if openErr != nil {
+		return openErr
+	}
+	defer utility.WrappedClose(layerFile)
+	if err := writeTarFile(tarWriter, blobPath(layer.Digest), layer.Size, layerFile); err != nil {
+		return err
+	}
+	return tarWriter.Close()
+}
+
+// writeLayer writes root to name as a gzip compressed tar layer, returning its descriptor and the digest of the
+// uncompressed tar the image config refers to it by.
+func writeLayer(fileSystem afero.Fs, root afero.Fs, name string, options utility.TreeOptions) (_ ociDescriptor, _ string, err error) {
+	file, createErr := fileSystem.Create(name)
+	if createErr != nil {
+		return ociDescriptor{}, "", createErr
+	}
+	defer utility.CloseWithErr(file, &err)
+
+	compressed := &countingHash{hash: sha256.New()}
+	compressor := gzip.NewWriter(io.MultiWriter(file, compressed))
+	uncompressed := sha256.New()
+	tarWriter := tar.NewWriter(io.MultiWriter(compressor, uncompressed))
+	if err := utility.WriteTree(root, tarWriter, options); err != nil {
+		return ociDescriptor{}, "", err
+	}
+	if err := errors.Join(tarWriter.Close(), compressor.Close()); err != nil {
+		return ociDescriptor{}, "", err
+	}
+
+	layer := ociDescriptor{MediaType: ociLayerMediaType, Digest: digest(compressed.hash), Size: compressed.size}
+	return layer, digest(uncompressed), nil
+}
+
+func blobDescriptor(mediaType string, content []byte) ociDescriptor {
+	sum := sha256.Sum256(content)
+	return ociDescriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(content))}
+}
+
+func blobPath(digest string) string {
+	return path.Join("blobs", "sha256", digest[len("sha256:"):])
+}
+
+func digest(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+func writeTarFile(w *tar.Writer, name string, size int64, content io.Reader) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: time.Unix(0, 0), Typeflag: tar.TypeReg}
+	if err := w.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, content)
+	return err
+}
+
+// countingHash hashes what's written to it and counts the bytes.
+type countingHash struct {
+	hash hash.Hash
+	size int64
+}
+
+func (c *countingHash) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+	return c.hash.Write(p)
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func readExport(t *testing.T, fileSystem afero.Fs, name string) map[string][]byte {
+	t.Helper()
+	file, err := fileSystem.Open(name)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	contents := make(map[string][]byte)
+	reader := tar.NewReader(file)
+	for {
+		header, nextErr := reader.Next()
+		if errors.Is(nextErr, io.EOF) {
+			return contents
+		}
+		assert.NoError(t, nextErr)
+		content, readErr := io.ReadAll(reader)
+		assert.NoError(t, readErr)
+		contents[header.Name] = content
+	}
+}
+
+func exportRoot(t *testing.T) afero.Fs {
+	t.Helper()
+	root := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(root, "/etc/hostname", []byte("pi"), 0644))
+	assert.NoError(t, afero.WriteFile(root, "/boot/firmware/config.txt", []byte("arm_64bit=1"), 0755))
+	assert.NoError(t, afero.WriteFile(root, "/sys/kernel/uevent_seqnum", []byte("1"), 0644))
+	return root
+}
+
+func TestExportRootfsTar(t *testing.T) {
+	fileSystem := afero.NewMemMapFs()
+	export := RootfsExport{Path: "/out/rootfs.tar", Format: ExportTar}
+	assert.NoError(t, ExportRootfs(context.Background(), fileSystem, exportRoot(t), export))
+
+	contents := readExport(t, fileSystem, "/out/rootfs.tar")
+	assert.Equal(t, []byte("pi"), contents["etc/hostname"])
+	assert.Contains(t, contents, "boot/firmware/")
+	assert.NotContains(t, contents, "boot/firmware/config.txt")
+	assert.Contains(t, contents, "sys/")
+	assert.NotContains(t, contents, "sys/kernel/")
+
+	leftover, err := afero.Exists(fileSystem, "/out/rootfs.tar.tmp")
+	assert.NoError(t, err)
+	assert.False(t, leftover)
+}
+
+func TestExportRootfsOCI(t *testing.T) {
+	fileSystem := afero.NewMemMapFs()
+	export := RootfsExport{Path: "/out/rootfs.tar", Format: ExportOCI, Reference: "pi-image:v1.2.0"}
+	assert.NoError(t, ExportRootfs(context.Background(), fileSystem, exportRoot(t), export))
+
+	contents := readExport(t, fileSystem, "/out/rootfs.tar")
+	assert.JSONEq(t, `{"imageLayoutVersion":"1.0.0"}`, string(contents["oci-layout"]))
+
+	var index ociIndex
+	assert.NoError(t, json.Unmarshal(contents["index.json"], &index))
+	assert.Len(t, index.Manifests, 1)
+	assert.Equal(t, &ociPlatform{Architecture: "arm64", OS: "linux", Variant: "v8"}, index.Manifests[0].Platform)
+	assert.Equal(t, "pi-image:v1.2.0", index.Manifests[0].Annotations[ociRefAnnotation])
+
+	var manifest ociManifest
+	assert.NoError(t, json.Unmarshal(contents[blobPath(index.Manifests[0].Digest)], &manifest))
+	assert.Len(t, manifest.Layers, 1)
+	layer := contents[blobPath(manifest.Layers[0].Digest)]
+	assert.Len(t, layer, int(manifest.Layers[0].Size))
+	assert.Equal(t, blobDescriptor(ociLayerMediaType, layer).Digest, manifest.Layers[0].Digest)
+
+	var config ociConfig
+	assert.NoError(t, json.Unmarshal(contents[blobPath(manifest.Config.Digest)], &config))
+	assert.Equal(t, "arm64", config.Architecture)
+	assert.Len(t, config.RootFS.DiffIDs, 1)
+
+	leftover, err := afero.Glob(fileSystem, "/out/rootfs.tar.*")
+	assert.NoError(t, err)
+	assert.Empty(t, leftover)
+}
+
+func TestRootfsExportValidate(t *testing.T) {
+	assert.NoError(t, RootfsExport{Path: "rootfs.tar", Format: ExportOCI}.Validate())
+	assert.ErrorContains(t, RootfsExport{Path: "rootfs.tar", Format: "docker"}.Validate(), `unknown export format "docker"`)
+}
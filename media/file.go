@@ -17,32 +17,37 @@
 package media
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
-	"cloud.google.com/go/storage"
+	"github.com/LadySerena/pi-image-builder/distro"
+	"github.com/LadySerena/pi-image-builder/store"
 	"github.com/LadySerena/pi-image-builder/telemetry"
 	"github.com/LadySerena/pi-image-builder/utility"
 	"github.com/c2h5oh/datasize"
 	"github.com/klauspost/compress/zstd"
 	"github.com/spf13/afero"
+	"github.com/ulikunitz/xz"
 )
 
 const (
-	expectedSize        = 4 * datasize.GB
-	resolvConf          = "/etc/resolv.conf"
-	rootMountPoint      = "./mnt"
-	bootMountPoint      = "./mnt/boot/firmware"
-	mountedResolv       = "./mnt/etc/resolv.conf"
-	mountedResolvBackup = "./mnt/etc/resolve.conf.bak"
+	expectedSize = 4 * datasize.GB
+	resolvConf   = "/etc/resolv.conf"
+	// stubResolvConf is where an ubuntu image's resolv.conf points, relative to its /etc
+	stubResolvConf = "../run/systemd/resolve/stub-resolv.conf"
 )
 
 type DeviceOutput struct {
@@ -121,34 +126,97 @@ func parsePartedOutput(output []byte) (PartitionEntry, error) {
 	return PartitionEntry{}, nil
 }
 
-func ExtractImage(ctx context.Context) (string, error) {
+// extractedSourceExtension names the sidecar next to an extracted image that records the sha256 of the xz it came
+// from.
+const extractedSourceExtension = ".source-sha256"
 
-	_, span := telemetry.GetTracer().Start(ctx, "Extract Image")
+// ExtractImage decompresses the distro's xz image next to it in the workspace. An extracted image is reused only when its sidecar says
+// it came from the xz that's there now, so a newer download is never masked by last month's image. force always
+// extracts again.
+func ExtractImage(ctx context.Context, w Workspace, d distro.Distro, force bool) (string, error) {
+
+	ctx, span := telemetry.Start(ctx, "Extract Image")
 	defer span.End()
+	span.SetAttributes(telemetry.ImageNameKey.String(d.ImageName))
+
+	extracted := w.Path(d.ExtractName())
+	return extracted, extractImage(ctx, afero.NewOsFs(), w.Path(d.ImageName), extracted, force)
+}
 
-	_, alreadyExtracted := os.Stat(utility.ExtractName)
-	if alreadyExtracted == nil {
-		return utility.ExtractName, nil
+func extractImage(ctx context.Context, fileSystem afero.Fs, source string, destination string, force bool) (err error) {
+	sum, hashErr := hashFile(fileSystem, source)
+	if hashErr != nil {
+		return hashErr
+	}
+	sidecar := destination + extractedSourceExtension
+	if !force {
+		recorded, readErr := afero.ReadFile(fileSystem, sidecar)
+		_, statErr := fileSystem.Stat(destination)
+		if readErr == nil && statErr == nil && strings.TrimSpace(string(recorded)) == sum {
+			return nil
+		}
 	}
 
-	filePath, err := filepath.Abs(utility.ImageName)
-	if err != nil {
-		return "", err
+	// the sidecar goes first, an interrupted extract must not leave a record vouching for the old image
+	if err := fileSystem.Remove(sidecar); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
 	}
-	_, statErr := os.Stat(filePath)
+
+	compressed, openErr := fileSystem.Open(source)
+	if openErr != nil {
+		return openErr
+	}
+	defer utility.WrappedClose(compressed)
+	info, statErr := compressed.Stat()
 	if statErr != nil {
-		return "", statErr
+		return statErr
 	}
 
-	command := exec.Command("xz", "-d", "-k", filePath)
-	return utility.ExtractName, command.Run()
+	decompressor, xzErr := xz.NewReader(bufio.NewReader(utility.NewProgressReader(ctx, compressed, "extract "+source, info.Size())))
+	if xzErr != nil {
+		return fmt.Errorf("%s isn't an xz archive: %w", source, xzErr)
+	}
+
+	partial := destination + partialDownloadExtension
+	if err := writeExtracted(fileSystem, partial, decompressor); err != nil {
+		return errors.Join(fmt.Errorf("could not extract %s: %w", source, err), fileSystem.Remove(partial))
+	}
+	if err := fileSystem.Rename(partial, destination); err != nil {
+		return err
+	}
+	return afero.WriteFile(fileSystem, sidecar, []byte(sum+"\n"), 0644)
+}
+
+func writeExtracted(fileSystem afero.Fs, name string, r io.Reader) (err error) {
+	file, createErr := fileSystem.Create(name)
+	if createErr != nil {
+		return createErr
+	}
+	defer utility.CloseWithErr(file, &err)
+	_, err = io.Copy(file, r)
+	return err
+}
+
+// hashFile returns name's sha256.
+func hashFile(fileSystem afero.Fs, name string) (string, error) {
+	file, openErr := fileSystem.Open(name)
+	if openErr != nil {
+		return "", openErr
+	}
+	defer utility.WrappedClose(file)
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-func ExpandSize(ctx context.Context) error {
-	_, span := telemetry.GetTracer().Start(ctx, "Expand image file")
+// ExpandSize grows imageFile so there's room to configure it, images already big enough are left alone.
+func ExpandSize(ctx context.Context, imageFile string) error {
+	_, span := telemetry.Start(ctx, "Expand image file")
 	defer span.End()
 
-	path, pathErr := filepath.Abs(utility.ExtractName)
+	path, pathErr := filepath.Abs(imageFile)
 	if pathErr != nil {
 		return pathErr
 	}
@@ -170,35 +238,38 @@ func ExpandSize(ctx context.Context) error {
 }
 
 func MountImageToDevice(ctx context.Context, imageFile string) (Entry, error) {
+	return attachLoopDevice(ctx, imageFile, false)
+}
+
+// MountImageReadOnly maps imageFile to a read only loop device, nothing mounted from it can change the image.
+func MountImageReadOnly(ctx context.Context, imageFile string) (Entry, error) {
+	return attachLoopDevice(ctx, imageFile, true)
+}
+
+func attachLoopDevice(ctx context.Context, imageFile string, readOnly bool) (Entry, error) {
 
-	_, span := telemetry.GetTracer().Start(ctx, "map image to loop device")
+	ctx, span := telemetry.Start(ctx, "map image to loop device")
 	defer span.End()
+	span.SetAttributes(telemetry.ImageNameKey.String(imageFile))
 
 	path, pathErr := filepath.Abs(imageFile)
 	if pathErr != nil {
 		return Entry{}, pathErr
 	}
-	loopCreateCommand := exec.Command("losetup", "-Pf", path)
-	loopErr := loopCreateCommand.Run()
-	if loopErr != nil {
-		return Entry{}, loopErr
+	flags := "-Pf"
+	if readOnly {
+		flags += "r"
 	}
-
-	loopDeviceCommand := exec.Command("losetup", "-lJ")
-	output, pipeErr := loopDeviceCommand.StdoutPipe()
-	if pipeErr != nil {
-		return Entry{}, pipeErr
+	if _, err := utility.Run(ctx, utility.RunOptions{Timeout: time.Minute}, "losetup", flags, path); err != nil {
+		return Entry{}, err
 	}
-	listErr := loopDeviceCommand.Start()
+
+	output, listErr := utility.ExecRunner{}.Output(ctx, exec.Command("losetup", "-lJ"))
 	if listErr != nil {
 		return Entry{}, listErr
 	}
 	parsedOutput := DeviceOutput{}
-	marshalErr := json.NewDecoder(output).Decode(&parsedOutput)
-	if marshalErr != nil {
-		return Entry{}, marshalErr
-	}
-	if err := loopDeviceCommand.Wait(); err != nil {
+	if err := json.Unmarshal(output, &parsedOutput); err != nil {
 		return Entry{}, err
 	}
 	devices := parsedOutput.ToMap()
@@ -209,23 +280,13 @@ func MountImageToDevice(ctx context.Context, imageFile string) (Entry, error) {
 
 func FileSystemExpansion(ctx context.Context, device Entry) error {
 
-	ctx, span := telemetry.GetTracer().Start(ctx, "expand partition and filesystem")
+	ctx, span := telemetry.Start(ctx, "expand partition and filesystem")
 	defer span.End()
+	span.SetAttributes(telemetry.DevicePathKey.String(device.Name))
 
-	partitionCommand := exec.Command("parted", "-s", "-m", device.Name, "--", "unit", "B", "print") //nolint:gosec
-	output, pipeCreateErr := partitionCommand.StdoutPipe()
-	if pipeCreateErr != nil {
-		return nil
-	}
-	if err := partitionCommand.Start(); err != nil {
-		return nil
-	}
-	partitions, readErr := io.ReadAll(output)
-	if readErr != nil {
-		return nil
-	}
-	if err := partitionCommand.Wait(); err != nil {
-		return nil
+	partitions, printErr := utility.ExecRunner{}.Output(ctx, exec.Command("parted", "-s", "-m", device.Name, "--", "unit", "B", "print")) //nolint:gosec
+	if printErr != nil {
+		return printErr
 	}
 	partition, parseErr := parsePartedOutput(partitions)
 	if parseErr != nil {
@@ -234,145 +295,240 @@ func FileSystemExpansion(ctx context.Context, device Entry) error {
 
 	end := fmt.Sprintf("%dB", partition.End.Bytes())
 
-	resizePartition := exec.Command("parted", device.Name, "resizepart", strconv.FormatUint(partition.Number, 10), end, "-s") //nolint:gosec
-	if err := utility.RunCommandWithOutput(ctx, resizePartition, nil); err != nil {
+	if _, err := utility.Run(ctx, utility.RunOptions{}, "parted", device.Name, "resizepart", strconv.FormatUint(partition.Number, 10), end, "-s"); err != nil {
+		return err
+	}
+
+	partitionName := utility.PartitionName(device.Name, int(partition.Number))
+
+	if _, err := utility.Run(ctx, utility.RunOptions{}, "e2fsck", "-pf", partitionName); err != nil {
 		return err
 	}
 
-	partitionName := fmt.Sprintf("%sp%d", device.Name, partition.Number)
+	_, err := utility.Run(ctx, utility.RunOptions{}, "resize2fs", partitionName)
+	return err
+}
+
+// AttachToMountPoint mounts the attached image at the workspace's RootMount and BootMount.
+func AttachToMountPoint(ctx context.Context, fileSystem afero.Fs, w Workspace, device Entry, configureResolvConf bool) error {
 
-	fsCheck := exec.Command("e2fsck", "-pf", partitionName) //nolint:gosec
-	if err := utility.RunCommandWithOutput(ctx, fsCheck, nil); err != nil {
+	ctx, span := telemetry.Start(ctx, "mount loop device")
+	defer span.End()
+	span.SetAttributes(telemetry.DevicePathKey.String(device.Name))
+	if err := fileSystem.MkdirAll(w.BootMount(), 0751); err != nil {
 		return err
 	}
 
-	resizeFS := exec.Command("resize2fs", partitionName) //nolint:gosec
-	if err := utility.RunCommandWithOutput(ctx, resizeFS, nil); err != nil {
+	if err := mountPartitions(ctx, w, device, "", ""); err != nil {
 		return err
 	}
+
+	if configureResolvConf {
+		return useHostResolvConf(fileSystem, w.mountedResolv(), w.mountedResolvBackup())
+	}
+
 	return nil
 }
 
-func AttachToMountPoint(ctx context.Context, fileSystem afero.Fs, device Entry, configureResolvConf bool) error {
+// useHostResolvConf swaps the resolv.conf at resolv for a copy of the host's, so commands run inside the mounted root
+// can resolve names. The symlink left at backup is what restoreResolvConf puts back.
+func useHostResolvConf(fileSystem afero.Fs, resolv string, backup string) error {
+	if err := os.Symlink(stubResolvConf, backup); err != nil {
+		return err
+	}
 
-	_, span := telemetry.GetTracer().Start(ctx, "mount loop device")
-	defer span.End()
-	if err := fileSystem.MkdirAll(bootMountPoint, 0751); err != nil {
+	fileInfo, err := fileSystem.Stat(resolvConf)
+	if err != nil {
 		return err
 	}
 
-	// todo get more info about the partition layout instead of hard coding
-	// todo fix above because of copy pasta in device.go
-	// specifically write a function that will give you the appropriate device names for partitions / logical volumes
-	if err := exec.Command("mount", fmt.Sprintf("%sp2", device.Name), rootMountPoint).Run(); err != nil { //nolint:gosec
+	if err := fileSystem.Remove(resolv); err != nil {
+		return err
+	}
+
+	resolve, readErr := afero.ReadFile(fileSystem, resolvConf)
+	if readErr != nil {
+		return readErr
+	}
+
+	return afero.WriteFile(fileSystem, resolv, resolve, fileInfo.Mode())
+}
+
+// restoreResolvConf points resolv back at systemd-resolved's stub and drops the backup useHostResolvConf left.
+func restoreResolvConf(fileSystem afero.Fs, resolv string, backup string) error {
+	if err := fileSystem.Remove(resolv); err != nil {
 		return err
 	}
 
-	if err := exec.Command("mount", fmt.Sprintf("%sp1", device.Name), bootMountPoint).Run(); err != nil { //nolint:gosec
+	if err := os.Symlink(stubResolvConf, resolv); err != nil {
 		return err
 	}
 
-	if configureResolvConf {
-		if err := os.Symlink("../run/systemd/resolve/stub-resolv.conf", mountedResolvBackup); err != nil {
-			return err
-		}
+	return os.Remove(backup)
+}
 
-		fileInfo, err := fileSystem.Stat(resolvConf)
-		if err != nil {
-			return err
-		}
+// AttachReadOnly mounts the attached image at the workspace's RootMount and BootMount without writing to either
+// partition, not even to replay the root filesystem's journal. Clean up with CleanupImage.
+func AttachReadOnly(ctx context.Context, fileSystem afero.Fs, w Workspace, device Entry) error {
 
-		if err := fileSystem.Remove(mountedResolv); err != nil {
-			return err
-		}
+	ctx, span := telemetry.Start(ctx, "mount loop device read only")
+	defer span.End()
+	span.SetAttributes(telemetry.DevicePathKey.String(device.Name))
+	if err := fileSystem.MkdirAll(w.RootMount(), 0751); err != nil {
+		return err
+	}
 
-		resolve, readErr := afero.ReadFile(fileSystem, resolvConf)
-		if readErr != nil {
-			return readErr
-		}
+	return mountPartitions(ctx, w, device, "ro,noload", "ro")
+}
 
-		if err := afero.WriteFile(fileSystem, mountedResolv, resolve, fileInfo.Mode()); err != nil {
+// mountPartitions mounts the image's root partition and then its boot partition inside it, each with its mount
+// options when they're set.
+func mountPartitions(ctx context.Context, w Workspace, device Entry, rootOptions string, bootOptions string) error {
+	// todo get more info about the partition layout instead of hard coding
+	// todo fix above because of copy pasta in device.go
+	// specifically write a function that will give you the appropriate device names for partitions / logical volumes
+	mounts := []struct {
+		partition int
+		target    string
+		options   string
+	}{
+		{partition: 2, target: w.RootMount(), options: rootOptions},
+		{partition: 1, target: w.BootMount(), options: bootOptions},
+	}
+	for _, mount := range mounts {
+		args := []string{utility.PartitionName(device.Name, mount.partition), mount.target}
+		if mount.options != "" {
+			args = append([]string{"-o", mount.options}, args...)
+		}
+		if _, err := utility.Run(ctx, utility.RunOptions{Timeout: time.Minute}, "mount", args...); err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
 
-func CleanUp(ctx context.Context, fileSystem afero.Fs, device Entry) error {
+// CleanUp unmounts the image and detaches its loop device.
+func CleanUp(ctx context.Context, fileSystem afero.Fs, w Workspace, device Entry) error {
 
-	_, span := telemetry.GetTracer().Start(ctx, "clean up resources")
+	ctx, span := telemetry.Start(ctx, "clean up resources")
 	defer span.End()
+	span.SetAttributes(telemetry.DevicePathKey.String(device.Name))
 
-	if err := fileSystem.Remove(mountedResolv); err != nil {
+	if err := Unmount(ctx, fileSystem, w); err != nil {
 		return err
 	}
 
-	if err := os.Symlink("../run/systemd/resolve/stub-resolv.conf", mountedResolv); err != nil {
-		return err
-	}
+	return Detach(ctx, device)
+}
 
-	if err := os.Remove(mountedResolvBackup); err != nil {
-		return err
-	}
+// Unmount restores the image's resolv.conf and unmounts it, leaving the loop device attached.
+func Unmount(ctx context.Context, fileSystem afero.Fs, w Workspace) error {
 
-	if err := exec.Command("umount", bootMountPoint).Run(); err != nil {
-		return err
-	}
+	ctx, span := telemetry.Start(ctx, "unmount image")
+	defer span.End()
 
-	if err := exec.Command("umount", rootMountPoint).Run(); err != nil {
+	if err := restoreResolvConf(fileSystem, w.mountedResolv(), w.mountedResolvBackup()); err != nil {
 		return err
 	}
 
-	if err := exec.Command("losetup", "--detach", device.Name).Run(); err != nil { //nolint:gosec
-		return err
+	// the firmware partition is mounted inside root, it has to go first
+	for _, target := range []string{w.BootMount(), w.RootMount()} {
+		if err := unmount(ctx, utility.ExecRunner{}, target); err != nil {
+			return err
+		}
 	}
-
 	return nil
 }
 
-func CompressImage(ctx context.Context, fileSystem afero.Fs, client *storage.Client) (string, error) {
+// Detach releases the image's loop device.
+func Detach(ctx context.Context, device Entry) error {
 
-	_, span := telemetry.GetTracer().Start(ctx, "compress image")
+	ctx, span := telemetry.Start(ctx, "detach loop device")
 	defer span.End()
+	span.SetAttributes(telemetry.DevicePathKey.String(device.Name))
+
+	_, err := utility.Run(ctx, utility.RunOptions{Timeout: time.Minute}, "losetup", "--detach", device.Name)
+	return err
+}
 
-	now := time.Now()
+// CompressImage compresses imageFile with zstd next to it, returning the compressed file's name.
+func CompressImage(ctx context.Context, fileSystem afero.Fs, imageFile string) (_ string, err error) {
 
-	newImageName := fmt.Sprintf("ubuntu-20-04-arm64-%s-%d.img", now.Format("01-02-2006"), now.UnixMilli())
+	ctx, span := telemetry.Start(ctx, "compress image")
+	defer span.End()
+	span.SetAttributes(telemetry.ImageNameKey.String(imageFile))
 
-	if err := fileSystem.Rename(utility.ExtractName, newImageName); err != nil {
-		return "", err
-	}
-	file, fileErr := fileSystem.Open(newImageName)
+	file, fileErr := fileSystem.Open(imageFile)
 	if fileErr != nil {
 		return "", fileErr
 	}
 
 	defer utility.WrappedClose(file)
 
-	compressedFileName := fmt.Sprintf("%s.zstd", newImageName)
+	compressedFileName := fmt.Sprintf("%s.zstd", imageFile)
 	compressedFile, fileOpenErr := fileSystem.Create(compressedFileName)
 	if fileOpenErr != nil {
 		return "", fileOpenErr
 	}
-	defer utility.WrappedClose(compressedFile)
+	defer utility.CloseWithErr(compressedFile, &err)
 
 	compressor, compressorErr := zstd.NewWriter(compressedFile, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
 	if compressorErr != nil {
 		return "", compressorErr
 	}
-	defer utility.WrappedClose(compressor)
+	// closing the compressor writes the final frame, it has to happen before the file is closed
+	defer utility.CloseWithErr(compressor, &err)
 
-	if _, err := io.Copy(compressor, file); err != nil {
+	info, statErr := file.Stat()
+	if statErr != nil {
+		return "", statErr
+	}
+	if _, err := io.Copy(compressor, utility.NewProgressReader(ctx, file, "compress "+imageFile, info.Size())); err != nil {
 		return "", err
 	}
 
 	return compressedFileName, nil
 }
 
-func UploadImage(ctx context.Context, fileSystem afero.Fs, fileName string, client *storage.Client) error {
-	_, span := telemetry.GetTracer().Start(ctx, "upload image")
+// DecompressImage writes the raw image held in the zstd compressed artifact compressedFile to imageFile.
+func DecompressImage(ctx context.Context, fileSystem afero.Fs, compressedFile string, imageFile string) (err error) {
+
+	ctx, span := telemetry.Start(ctx, "decompress image")
+	defer span.End()
+	span.SetAttributes(telemetry.ImageNameKey.String(compressedFile))
+
+	file, fileErr := fileSystem.Open(compressedFile)
+	if fileErr != nil {
+		return fileErr
+	}
+	defer utility.WrappedClose(file)
+
+	decompressor, decompressorErr := zstd.NewReader(file)
+	if decompressorErr != nil {
+		return decompressorErr
+	}
+	defer decompressor.Close()
+
+	output, createErr := fileSystem.Create(imageFile)
+	if createErr != nil {
+		return createErr
+	}
+	defer utility.CloseWithErr(output, &err)
+
+	// the decompressed size isn't known up front, progress only reports bytes written
+	progress := utility.NewProgressWriter(ctx, output, "decompress "+compressedFile, 0)
+	if _, err := decompressor.WriteTo(progress); err != nil {
+		return err
+	}
+	progress.Finish()
+	return nil
+}
+
+// UploadImage uploads fileName to objects under its base name with metadata attached.
+func UploadImage(ctx context.Context, fileSystem afero.Fs, fileName string, objects store.ObjectStore, metadata map[string]string) error {
+	ctx, span := telemetry.Start(ctx, "upload image")
 	defer span.End()
+	span.SetAttributes(telemetry.ImageNameKey.String(fileName))
 
 	compressedFile, openErr := fileSystem.Open(fileName)
 	if openErr != nil {
@@ -380,12 +536,15 @@ func UploadImage(ctx context.Context, fileSystem afero.Fs, fileName string, clie
 	}
 	defer utility.WrappedClose(compressedFile)
 
-	objectWriter := client.Bucket(utility.BucketName).Object(compressedFile.Name()).NewWriter(ctx)
-	defer utility.WrappedClose(objectWriter)
-
-	if _, err := io.Copy(objectWriter, compressedFile); err != nil {
+	info, statErr := compressedFile.Stat()
+	if statErr != nil {
+		return statErr
+	}
+	progress := utility.NewProgressReader(ctx, compressedFile, "upload "+fileName, info.Size())
+	if err := objects.Upload(ctx, filepath.Base(fileName), progress, metadata); err != nil {
 		return err
 	}
+	telemetry.AddBytesUploaded(ctx, info.Size())
 
 	return nil
 }
@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
+)
+
+func compressXz(t *testing.T, contents string) []byte {
+	var buffer bytes.Buffer
+	writer, err := xz.NewWriter(&buffer)
+	assert.NoError(t, err)
+	_, err = writer.Write([]byte(contents))
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	return buffer.Bytes()
+}
+
+func TestExtractImage(t *testing.T) {
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "base.img.xz", compressXz(t, "september"), 0o644))
+
+	assert.NoError(t, extractImage(ctx, fs, "base.img.xz", "base.img", false))
+	extracted, err := afero.ReadFile(fs, "base.img")
+	assert.NoError(t, err)
+	assert.Equal(t, "september", string(extracted))
+	sum, err := hashFile(fs, "base.img.xz")
+	assert.NoError(t, err)
+	sidecar, err := afero.ReadFile(fs, "base.img"+extractedSourceExtension)
+	assert.NoError(t, err)
+	assert.Equal(t, sum+"\n", string(sidecar))
+	partial, err := afero.Exists(fs, "base.img"+partialDownloadExtension)
+	assert.NoError(t, err)
+	assert.False(t, partial)
+
+	// the same xz keeps the extracted image, configuring it in place is the point
+	assert.NoError(t, afero.WriteFile(fs, "base.img", []byte("configured"), 0o644))
+	assert.NoError(t, extractImage(ctx, fs, "base.img.xz", "base.img", false))
+	extracted, err = afero.ReadFile(fs, "base.img")
+	assert.NoError(t, err)
+	assert.Equal(t, "configured", string(extracted))
+
+	// forcing extracts again
+	assert.NoError(t, extractImage(ctx, fs, "base.img.xz", "base.img", true))
+	extracted, err = afero.ReadFile(fs, "base.img")
+	assert.NoError(t, err)
+	assert.Equal(t, "september", string(extracted))
+
+	// a newer download replaces the stale image
+	assert.NoError(t, afero.WriteFile(fs, "base.img.xz", compressXz(t, "october"), 0o644))
+	assert.NoError(t, extractImage(ctx, fs, "base.img.xz", "base.img", false))
+	extracted, err = afero.ReadFile(fs, "base.img")
+	assert.NoError(t, err)
+	assert.Equal(t, "october", string(extracted))
+}
+
+func TestExtractImageWithoutSidecar(t *testing.T) {
+	// images extracted before the sidecar existed can't be trusted, they're extracted again
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "base.img.xz", compressXz(t, "fresh"), 0o644))
+	assert.NoError(t, afero.WriteFile(fs, "base.img", []byte("stale"), 0o644))
+
+	assert.NoError(t, extractImage(context.Background(), fs, "base.img.xz", "base.img", false))
+	extracted, err := afero.ReadFile(fs, "base.img")
+	assert.NoError(t, err)
+	assert.Equal(t, "fresh", string(extracted))
+}
+
+func TestExtractImageCorrupt(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "base.img.xz", []byte("not xz at all"), 0o644))
+
+	assert.ErrorContains(t, extractImage(context.Background(), fs, "base.img.xz", "base.img", false), "isn't an xz archive")
+	for _, name := range []string{"base.img", "base.img" + partialDownloadExtension, "base.img" + extractedSourceExtension} {
+		exists, err := afero.Exists(fs, name)
+		assert.NoError(t, err)
+		assert.False(t, exists, name)
+	}
+
+	truncated := compressXz(t, "september")
+	assert.NoError(t, afero.WriteFile(fs, "base.img.xz", truncated[:len(truncated)-8], 0o644))
+	assert.ErrorContains(t, extractImage(context.Background(), fs, "base.img.xz", "base.img", false), "could not extract base.img.xz")
+	exists, err := afero.Exists(fs, "base.img"+partialDownloadExtension)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestDecompressImage(t *testing.T) {
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "/work/built.img", []byte("image contents"), 0644))
+
+	compressed, compressErr := CompressImage(ctx, fs, "/work/built.img")
+	assert.NoError(t, compressErr)
+	assert.Equal(t, "/work/built.img.zstd", compressed)
+
+	assert.NoError(t, DecompressImage(ctx, fs, compressed, "/work/restored.img"))
+	restored, readErr := afero.ReadFile(fs, "/work/restored.img")
+	assert.NoError(t, readErr)
+	assert.Equal(t, []byte("image contents"), restored)
+}
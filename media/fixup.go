@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+// BootLabel is the filesystem label the firmware partition is mounted by.
+const BootLabel = "system-boot"
+
+// rootCommandLine replaces the root device and filesystem in a cmdline.txt, appending them if the image didn't set
+// them. Every other parameter is left alone.
+func rootCommandLine(cmdline string, rootFSType string) string {
+	wanted := map[string]string{
+		"root":       fmt.Sprintf("/dev/%s/%s", utility.VolumeGroupName, utility.RootLogicalVolume),
+		"rootfstype": rootFSType,
+	}
+	params := strings.Fields(cmdline)
+	for i, param := range params {
+		key, _, _ := strings.Cut(param, "=")
+		if value, ok := wanted[key]; ok {
+			params[i] = key + "=" + value
+			delete(wanted, key)
+		}
+	}
+	for _, key := range []string{"root", "rootfstype"} {
+		if value, ok := wanted[key]; ok {
+			params = append(params, key+"="+value)
+		}
+	}
+	return strings.Join(params, " ") + "\n"
+}
+
+// blockUUID asks blkid for the filesystem uuid on device.
+func blockUUID(ctx context.Context, runner utility.Runner, device string) (string, error) {
+	output, err := runner.Output(ctx, exec.Command("blkid", "-s", "UUID", "-o", "value", device)) //nolint:gosec
+	if err != nil {
+		return "", fmt.Errorf("could not read uuid of %s: %w", device, err)
+	}
+	uuid := strings.TrimSpace(string(output))
+	if uuid == "" {
+		return "", fmt.Errorf("%s has no filesystem uuid", device)
+	}
+	return uuid, nil
+}
+
+// uuidMounts pins every volume backed mount to the uuid of its freshly created filesystem.
+func uuidMounts(ctx context.Context, runner utility.Runner, mounts []configure.Mount, layout partition.VolumeLayout) ([]configure.Mount, error) {
+	pinned := make([]configure.Mount, 0, len(mounts))
+	for _, mount := range configure.ResolveMounts(mounts, layout) {
+		if mount.Volume != "" {
+			uuid, err := blockUUID(ctx, runner, mount.Device)
+			if err != nil {
+				return nil, err
+			}
+			mount.Device = "UUID=" + uuid
+			mount.Volume = ""
+		}
+		pinned = append(pinned, mount)
+	}
+	return pinned, nil
+}
+
+// labelBoot makes sure the firmware partition carries BootLabel, images built elsewhere don't always use it.
+func labelBoot(ctx context.Context, runner utility.Runner, bootPartition string) error {
+	current, err := runner.Output(ctx, exec.Command("fatlabel", bootPartition)) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(current)) == BootLabel {
+		return nil
+	}
+	return runner.Run(ctx, exec.Command("fatlabel", bootPartition, BootLabel)) //nolint:gosec
+}
+
+// FixupBoot points the flashed media at its new layout. The image's cmdline.txt and fstab describe the partitions it
+// was built on, so the kernel would otherwise hang waiting for a root PARTUUID that no longer exists.
+func FixupBoot(ctx context.Context, runner utility.Runner, fileSystem afero.Fs, w Workspace, device string, mounts []configure.Mount, layout partition.VolumeLayout) error {
+	ctx, span := telemetry.Start(ctx, "fix up boot configuration")
+	defer span.End()
+	span.SetAttributes(telemetry.DevicePathKey.String(device))
+
+	if err := labelBoot(ctx, runner, utility.PartitionName(device, 1)); err != nil {
+		return err
+	}
+
+	cmdlinePath := filepath.Join(w.MediaBoot(), "cmdline.txt")
+	cmdline, readErr := afero.ReadFile(fileSystem, cmdlinePath)
+	if readErr != nil {
+		return readErr
+	}
+	root, ok := layout.Find(utility.RootLogicalVolume)
+	if !ok {
+		root = partition.Volume{Name: utility.RootLogicalVolume}
+	}
+	if err := afero.WriteFile(fileSystem, cmdlinePath, []byte(rootCommandLine(string(cmdline), root.Filesystem())), 0644); err != nil {
+		return err
+	}
+
+	pinned, pinErr := uuidMounts(ctx, runner, mounts, layout)
+	if pinErr != nil {
+		return pinErr
+	}
+	fstab, renderErr := configure.RenderFstab(pinned, layout)
+	if renderErr != nil {
+		return renderErr
+	}
+	return afero.WriteFile(fileSystem, filepath.Join(w.MediaRoot(), "etc", "fstab"), fstab, 0644)
+}
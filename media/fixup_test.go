@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"context"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRootCommandLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		cmdline  string
+		expected string
+	}{
+		{
+			name:     "partuuid root",
+			cmdline:  "console=serial0,115200 console=tty1 root=PARTUUID=738a4d67-02 rootfstype=ext4 fsck.repair=yes rootwait\n",
+			expected: "console=serial0,115200 console=tty1 root=/dev/rootvg/rootlv rootfstype=xfs fsck.repair=yes rootwait\n",
+		},
+		{
+			name:     "missing root",
+			cmdline:  "console=tty1 rootwait",
+			expected: "console=tty1 rootwait root=/dev/rootvg/rootlv rootfstype=xfs\n",
+		},
+		{
+			name:     "already matches",
+			cmdline:  "root=/dev/rootvg/rootlv rootfstype=xfs rootwait\n",
+			expected: "root=/dev/rootvg/rootlv rootfstype=xfs rootwait\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, rootCommandLine(tt.cmdline, "xfs"))
+		})
+	}
+}
+
+func TestFixupBoot(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "/work/media-mnt/boot/firmware/cmdline.txt", []byte("console=tty1 root=LABEL=writable rootfstype=ext4 rootwait\n"), 0644))
+	assert.NoError(t, fs.MkdirAll("/work/media-mnt/etc", 0755))
+
+	runner := &utility.FakeRunner{Outputs: map[string][]byte{
+		"fatlabel /dev/mmcblk0p1":                                []byte("RASPIFIRM\n"),
+		"blkid -s UUID -o value /dev/mapper/rootvg-rootlv":       []byte("0b7f5c1e-root\n"),
+		"blkid -s UUID -o value /dev/mapper/rootvg-csilv":        []byte("4d2a9e10-csi\n"),
+		"blkid -s UUID -o value /dev/mapper/rootvg-containerdlv": []byte("9c13bb52-containerd\n"),
+	}}
+
+	assert.NoError(t, FixupBoot(context.Background(), runner, fs, testWorkspace, "/dev/mmcblk0", nil, partition.DefaultVolumeLayout()))
+	assert.Contains(t, runner.Commands, "fatlabel /dev/mmcblk0p1 system-boot")
+
+	cmdline, err := afero.ReadFile(fs, "/work/media-mnt/boot/firmware/cmdline.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "console=tty1 root=/dev/rootvg/rootlv rootfstype=ext4 rootwait\n", string(cmdline))
+
+	fstab, err := afero.ReadFile(fs, "/work/media-mnt/etc/fstab")
+	assert.NoError(t, err)
+	assert.Regexp(t, `LABEL=system-boot +/boot/firmware +vfat`, string(fstab))
+	assert.Regexp(t, `UUID=0b7f5c1e-root +/ +ext4`, string(fstab))
+	assert.Regexp(t, `UUID=4d2a9e10-csi +/var/lib/longhorn +ext4`, string(fstab))
+	assert.Regexp(t, `UUID=9c13bb52-containerd +/var/lib/containerd +ext4`, string(fstab))
+}
+
+func TestFixupBootMissingUUID(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "/work/media-mnt/boot/firmware/cmdline.txt", []byte("rootwait\n"), 0644))
+	runner := &utility.FakeRunner{Outputs: map[string][]byte{"fatlabel /dev/sda1": []byte("system-boot\n")}}
+
+	err := FixupBoot(context.Background(), runner, fs, testWorkspace, "/dev/sda", nil, partition.DefaultVolumeLayout())
+	assert.ErrorContains(t, err, "has no filesystem uuid")
+	assert.NotContains(t, runner.Commands, "fatlabel /dev/sda1 system-boot")
+}
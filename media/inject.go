@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/spf13/afero"
+)
+
+// IndexPlaceholder in an injected value is replaced with the device's position in the batch, counting from 1.
+const IndexPlaceholder = "{index}"
+
+// Injection is written onto each card after flashing so a batch of nodes doesn't need editing by hand. Empty fields
+// are skipped.
+type Injection struct {
+	Hostname     string
+	KubeadmToken string
+	// RegistrationToken is the bearer token register-node posts with.
+	RegistrationToken string
+	// NodeConfig is a path to a NodeConfig file.
+	NodeConfig string
+}
+
+// ForDevice expands IndexPlaceholder for the device at index.
+func (i Injection) ForDevice(index int) Injection {
+	return Injection{
+		Hostname:          strings.ReplaceAll(i.Hostname, IndexPlaceholder, strconv.Itoa(index)),
+		KubeadmToken:      strings.ReplaceAll(i.KubeadmToken, IndexPlaceholder, strconv.Itoa(index)),
+		RegistrationToken: strings.ReplaceAll(i.RegistrationToken, IndexPlaceholder, strconv.Itoa(index)),
+		NodeConfig:        strings.ReplaceAll(i.NodeConfig, IndexPlaceholder, strconv.Itoa(index)),
+	}
+}
+
+// Validate refuses a hostname that would be the same on every card of a batch of count devices, and parses every
+// device's node config up front so a bad file doesn't stop the batch halfway.
+func (i Injection) Validate(fileSystem afero.Fs, count int) error {
+	if count > 1 && i.Hostname != "" && !strings.Contains(i.Hostname, IndexPlaceholder) {
+		return errors.New("flashing more than one device needs " + IndexPlaceholder + " in the hostname")
+	}
+	if i.NodeConfig == "" {
+		return nil
+	}
+	for index := 1; index <= count; index++ {
+		if _, err := LoadNodeConfig(fileSystem, i.ForDevice(index).NodeConfig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Inject writes the hostname, kubeadm and registration tokens, and node config onto the mounted media.
+func Inject(ctx context.Context, fileSystem afero.Fs, w Workspace, injection Injection) error {
+	ctx, span := telemetry.Start(ctx, "inject device settings")
+	defer span.End()
+
+	media := afero.NewBasePathFs(fileSystem, w.MediaRoot())
+
+	if injection.Hostname != "" {
+		if err := configure.StaticHostname(ctx, media, injection.Hostname); err != nil {
+			return err
+		}
+	}
+
+	if injection.KubeadmToken != "" {
+		if err := configure.KubeadmToken(ctx, media, injection.KubeadmToken); err != nil {
+			return err
+		}
+	}
+
+	if injection.RegistrationToken != "" {
+		if err := configure.RegistrationToken(ctx, media, injection.RegistrationToken); err != nil {
+			return err
+		}
+	}
+
+	if injection.NodeConfig != "" {
+		nodeConfig, loadErr := LoadNodeConfig(fileSystem, injection.NodeConfig)
+		if loadErr != nil {
+			return loadErr
+		}
+		if err := WriteNodeConfig(ctx, fileSystem, w, nodeConfig); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInjectionForDevice(t *testing.T) {
+	injection := Injection{Hostname: "pi-node-{index}", KubeadmToken: "abcde{index}.0123456789abcdef"}
+	assert.Equal(t, Injection{Hostname: "pi-node-3", KubeadmToken: "abcde3.0123456789abcdef"}, injection.ForDevice(3))
+
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, injection.Validate(fs, 6))
+	assert.NoError(t, Injection{Hostname: "lonely-pi"}.Validate(fs, 1))
+	assert.Error(t, Injection{Hostname: "lonely-pi"}.Validate(fs, 2))
+
+	// every card's node config is checked before anything is flashed
+	assert.NoError(t, afero.WriteFile(fs, "nodes/node-1.yaml", []byte("userData:\n  hostname: node-1\n"), 0644))
+	perNode := Injection{NodeConfig: "nodes/node-{index}.yaml"}
+	assert.NoError(t, perNode.Validate(fs, 1))
+	assert.ErrorContains(t, perNode.Validate(fs, 2), "node-2.yaml")
+}
+
+func TestInject(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "/work/media-mnt/etc/hosts", []byte("127.0.0.1 localhost\n127.0.1.1 ubuntu\n"), 0644))
+	assert.NoError(t, fs.MkdirAll("/work/media-mnt/boot/firmware", 0755))
+
+	injection := Injection{Hostname: "pi-node-{index}", KubeadmToken: "abcde{index}.0123456789abcdef", RegistrationToken: "node-{index}-secret"}
+	assert.NoError(t, Inject(context.Background(), fs, testWorkspace, injection.ForDevice(2)))
+
+	hostname, err := afero.ReadFile(fs, "/work/media-mnt/etc/hostname")
+	assert.NoError(t, err)
+	assert.Equal(t, "pi-node-2\n", string(hostname))
+
+	hosts, err := afero.ReadFile(fs, "/work/media-mnt/etc/hosts")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1 localhost\n127.0.1.1 pi-node-2\n", string(hosts))
+
+	token, err := afero.ReadFile(fs, "/work/media-mnt/boot/firmware/kubeadm-token")
+	assert.NoError(t, err)
+	assert.Equal(t, "abcde2.0123456789abcdef\n", string(token))
+
+	registrationToken, err := afero.ReadFile(fs, "/work/media-mnt/boot/firmware/registration-token")
+	assert.NoError(t, err)
+	assert.Equal(t, "node-2-secret\n", string(registrationToken))
+
+	preserve, err := afero.Exists(fs, "/work/media-mnt/etc/cloud/cloud.cfg.d/09_hostname.cfg")
+	assert.NoError(t, err)
+	assert.True(t, preserve)
+
+	assert.Error(t, Inject(context.Background(), fs, testWorkspace, Injection{Hostname: "Pi_Node"}))
+	assert.Error(t, Inject(context.Background(), fs, testWorkspace, Injection{KubeadmToken: "not-a-token"}))
+	assert.Error(t, Inject(context.Background(), fs, testWorkspace, Injection{RegistrationToken: "two words"}))
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v3"
+)
+
+// NodeConfig is a node's cloud-init NoCloud seed. It's written onto the boot partition, which cloud-init finds by its
+// system-boot label, the same way Raspberry Pi Imager customizes a card.
+type NodeConfig struct {
+	UserData      map[string]any `yaml:"userData"`
+	MetaData      map[string]any `yaml:"metaData"`
+	NetworkConfig map[string]any `yaml:"networkConfig"`
+}
+
+// LoadNodeConfig reads a node config, unknown keys are rejected so a typo doesn't silently drop a section. The
+// instance id defaults to the file's name since cloud-init won't use a seed without one.
+func LoadNodeConfig(fileSystem afero.Fs, path string) (NodeConfig, error) {
+	contents, readErr := afero.ReadFile(fileSystem, path)
+	if readErr != nil {
+		return NodeConfig{}, readErr
+	}
+
+	var cfg NodeConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil {
+		return NodeConfig{}, fmt.Errorf("could not parse node config %s: %w", path, err)
+	}
+	if len(cfg.UserData) == 0 {
+		return NodeConfig{}, fmt.Errorf("node config %s has no userData", path)
+	}
+
+	if cfg.MetaData == nil {
+		cfg.MetaData = map[string]any{}
+	}
+	if _, ok := cfg.MetaData["instance-id"]; !ok {
+		cfg.MetaData["instance-id"] = "iid-" + strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	return cfg, nil
+}
+
+// seedFiles renders the NoCloud files, network-config is left out when it isn't set so the image's own network
+// config applies.
+func (n NodeConfig) seedFiles() (map[string][]byte, error) {
+	files := map[string][]byte{}
+	userData, userErr := yaml.Marshal(n.UserData)
+	if userErr != nil {
+		return nil, userErr
+	}
+	files["user-data"] = append([]byte("#cloud-config\n"), userData...)
+
+	metaData, metaErr := yaml.Marshal(n.MetaData)
+	if metaErr != nil {
+		return nil, metaErr
+	}
+	files["meta-data"] = metaData
+
+	if len(n.NetworkConfig) != 0 {
+		network, networkErr := yaml.Marshal(n.NetworkConfig)
+		if networkErr != nil {
+			return nil, networkErr
+		}
+		files["network-config"] = network
+	}
+	return files, nil
+}
+
+// WriteNodeConfig writes the seed onto the mounted media's boot partition.
+func WriteNodeConfig(ctx context.Context, fileSystem afero.Fs, w Workspace, cfg NodeConfig) error {
+	_, span := telemetry.Start(ctx, "write node config")
+	defer span.End()
+
+	if len(cfg.UserData) == 0 {
+		return errors.New("node config has no userData")
+	}
+
+	files, renderErr := cfg.seedFiles()
+	if renderErr != nil {
+		return renderErr
+	}
+
+	for name, contents := range files {
+		if err := afero.WriteFile(fileSystem, filepath.Join(w.MediaBoot(), name), contents, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
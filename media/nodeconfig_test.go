@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+const nodeConfig = `userData:
+  hostname: pi-node-1
+  ssh_authorized_keys:
+    - ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHRGGe84zs3TxJ8BTbsiVDAsctSf2JF5AS6g/5CyGD2l kat@local-pis
+networkConfig:
+  version: 2
+  ethernets:
+    eth0:
+      dhcp4: true
+`
+
+func TestLoadNodeConfig(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "node-1.yaml", []byte(nodeConfig), 0644))
+
+	cfg, err := LoadNodeConfig(fs, "node-1.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, "pi-node-1", cfg.UserData["hostname"])
+	assert.Equal(t, "iid-node-1", cfg.MetaData["instance-id"])
+
+	invalid := map[string]string{
+		"not yaml":      "userData: [",
+		"unknown key":   "userdata:\n  hostname: typo\n",
+		"no user data":  "metaData:\n  instance-id: iid-empty\n",
+		"wrong section": "userData: just a string\n",
+	}
+	for name, contents := range invalid {
+		assert.NoError(t, afero.WriteFile(fs, "invalid.yaml", []byte(contents), 0644))
+		_, err := LoadNodeConfig(fs, "invalid.yaml")
+		assert.Error(t, err, name)
+	}
+}
+
+func TestWriteNodeConfig(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "nodes/node-1.yaml", []byte(nodeConfig), 0644))
+
+	injection := Injection{NodeConfig: "nodes/node-{index}.yaml"}
+	assert.NoError(t, Inject(context.Background(), fs, testWorkspace, injection.ForDevice(1)))
+
+	userData, err := afero.ReadFile(fs, "/work/media-mnt/boot/firmware/user-data")
+	assert.NoError(t, err)
+	assert.Contains(t, string(userData), "#cloud-config\n")
+	assert.Contains(t, string(userData), "hostname: pi-node-1\n")
+
+	metaData, err := afero.ReadFile(fs, "/work/media-mnt/boot/firmware/meta-data")
+	assert.NoError(t, err)
+	assert.Equal(t, "instance-id: iid-node-1\n", string(metaData))
+
+	network, err := afero.Exists(fs, "/work/media-mnt/boot/firmware/network-config")
+	assert.NoError(t, err)
+	assert.True(t, network)
+
+	second := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(second, "nodes/node-2.yaml", []byte("userData:\n  hostname: pi-node-2\nmetaData:\n  instance-id: custom\n"), 0644))
+	assert.NoError(t, Inject(context.Background(), second, testWorkspace, injection.ForDevice(2)))
+	metaData, err = afero.ReadFile(second, "/work/media-mnt/boot/firmware/meta-data")
+	assert.NoError(t, err)
+	assert.Equal(t, "instance-id: custom\n", string(metaData))
+	network, err = afero.Exists(second, "/work/media-mnt/boot/firmware/network-config")
+	assert.NoError(t, err)
+	assert.False(t, network)
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+// OutputFormat is a kind of artifact published from the finished image.
+type OutputFormat string
+
+const (
+	// OutputRaw is the raw disk image compressed with zstd, it's what cmd/flash writes to cards.
+	OutputRaw OutputFormat = "raw"
+	// OutputQcow2 is a compressed qcow2 image for booting in libvirt or qemu.
+	OutputQcow2 OutputFormat = "qcow2"
+)
+
+const qcow2Extension = ".qcow2"
+
+// Artifact is a file built from the image that gets uploaded.
+type Artifact struct {
+	Name   string
+	Format OutputFormat
+}
+
+// ValidateOutputFormats rejects unknown and repeated formats, an empty list publishes nothing so it's rejected too.
+func ValidateOutputFormats(formats []OutputFormat) error {
+	if len(formats) == 0 {
+		return fmt.Errorf("at least one output format is required, use %s or %s", OutputRaw, OutputQcow2)
+	}
+	seen := make(map[OutputFormat]bool)
+	for _, format := range formats {
+		switch format {
+		case OutputRaw, OutputQcow2:
+		default:
+			return fmt.Errorf("unknown output format %q, use %s or %s", format, OutputRaw, OutputQcow2)
+		}
+		if seen[format] {
+			return fmt.Errorf("output format %s is listed twice", format)
+		}
+		seen[format] = true
+	}
+	return nil
+}
+
+// IsQcow2 reports whether name is a qcow2 artifact.
+func IsQcow2(name string) bool {
+	return strings.HasSuffix(name, qcow2Extension)
+}
+
+// PackageImage renames imageFile to a dated name starting with prefix and builds an artifact from it in each format.
+func PackageImage(ctx context.Context, fileSystem afero.Fs, runner utility.Runner, imageFile string, prefix string, formats []OutputFormat) ([]Artifact, error) {
+
+	ctx, span := telemetry.Start(ctx, "package image")
+	defer span.End()
+
+	now := time.Now()
+	newImageName := fmt.Sprintf("%s-%s-%d.img", prefix, now.Format("01-02-2006"), now.UnixMilli())
+	span.SetAttributes(telemetry.ImageNameKey.String(newImageName))
+
+	if err := fileSystem.Rename(imageFile, newImageName); err != nil {
+		return nil, err
+	}
+
+	artifacts := make([]Artifact, 0, len(formats))
+	for _, format := range formats {
+		var name string
+		var err error
+		switch format {
+		case OutputRaw:
+			name, err = CompressImage(ctx, fileSystem, newImageName)
+		case OutputQcow2:
+			name, err = ConvertQcow2(ctx, runner, newImageName)
+		default:
+			err = fmt.Errorf("unknown output format %q", format)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not build %s artifact: %w", format, err)
+		}
+		artifacts = append(artifacts, Artifact{Name: name, Format: format})
+	}
+	return artifacts, nil
+}
+
+// ConvertQcow2 writes a compressed qcow2 copy of imageFile next to it, returning the copy's name.
+func ConvertQcow2(ctx context.Context, runner utility.Runner, imageFile string) (string, error) {
+
+	ctx, span := telemetry.Start(ctx, "convert image to qcow2")
+	defer span.End()
+	span.SetAttributes(telemetry.ImageNameKey.String(imageFile))
+
+	converted := strings.TrimSuffix(imageFile, ".img") + qcow2Extension
+	if err := runner.Stream(ctx, exec.Command("qemu-img", "convert", "-c", "-f", "raw", "-O", "qcow2", imageFile, converted)); err != nil { //nolint:gosec
+		return "", err
+	}
+	return converted, nil
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateOutputFormats(t *testing.T) {
+	assert.NoError(t, ValidateOutputFormats([]OutputFormat{OutputRaw}))
+	assert.NoError(t, ValidateOutputFormats([]OutputFormat{OutputQcow2, OutputRaw}))
+	assert.Error(t, ValidateOutputFormats(nil))
+	assert.ErrorContains(t, ValidateOutputFormats([]OutputFormat{"vmdk"}), `unknown output format "vmdk"`)
+	assert.ErrorContains(t, ValidateOutputFormats([]OutputFormat{OutputRaw, OutputRaw}), "listed twice")
+}
+
+func TestPackageImage(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "built.img", []byte("image contents"), 0644))
+	runner := &utility.FakeRunner{}
+
+	artifacts, err := PackageImage(context.Background(), fs, runner, "built.img", "ubuntu-22.04", []OutputFormat{OutputRaw, OutputQcow2})
+	assert.NoError(t, err)
+	assert.Len(t, artifacts, 2)
+
+	raw := artifacts[0]
+	assert.Equal(t, OutputRaw, raw.Format)
+	assert.True(t, strings.HasPrefix(raw.Name, "ubuntu-22.04-"))
+	assert.True(t, strings.HasSuffix(raw.Name, ".img.zstd"))
+	compressed, openErr := fs.Open(raw.Name)
+	assert.NoError(t, openErr)
+	decoder, decoderErr := zstd.NewReader(compressed)
+	assert.NoError(t, decoderErr)
+	defer decoder.Close()
+	var contents strings.Builder
+	_, copyErr := decoder.WriteTo(&contents)
+	assert.NoError(t, copyErr)
+	assert.Equal(t, "image contents", contents.String())
+
+	qcow2 := artifacts[1]
+	assert.Equal(t, OutputQcow2, qcow2.Format)
+	assert.True(t, IsQcow2(qcow2.Name))
+	image := strings.TrimSuffix(raw.Name, ".zstd")
+	assert.Equal(t, []string{"qemu-img convert -c -f raw -O qcow2 " + image + " " + strings.TrimSuffix(image, ".img") + ".qcow2"}, runner.Commands)
+}
+
+func TestIsQcow2(t *testing.T) {
+	assert.True(t, IsQcow2("ubuntu-22.04-10-17-2026-1.qcow2"))
+	assert.False(t, IsQcow2("ubuntu-22.04-10-17-2026-1.img.zstd"))
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/store"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+// BucketScheme marks an artifact that's downloaded from a bucket instead of read from disk, e.g. gs://bucket/name.
+const BucketScheme = "gs://"
+
+// readOnlyCleanupTimeout bounds unmounting and detaching a read only image, it runs on a context of its own so an
+// interrupted command still cleans up after itself.
+const readOnlyCleanupTimeout = 5 * time.Minute
+
+// BucketOpener returns the object store for a bucket named in an artifact uri.
+type BucketOpener func(ctx context.Context, bucket string) (store.ObjectStore, error)
+
+// ParseBucketURI splits a gs://bucket/name uri, ok is false for anything else.
+func ParseBucketURI(artifact string) (bucket string, object string, ok bool) {
+	bucketObject, remote := strings.CutPrefix(artifact, BucketScheme)
+	if !remote {
+		return "", "", false
+	}
+	bucket, object, _ = strings.Cut(bucketObject, "/")
+	return bucket, object, true
+}
+
+// FetchArtifact returns the path of artifact's raw image. Bucket uris are downloaded into w, and zstd compressed
+// artifacts are decompressed into it, local raw images are used where they are.
+func FetchArtifact(ctx context.Context, fileSystem afero.Fs, w Workspace, artifact string, openBucket BucketOpener) (string, error) {
+	ctx, span := telemetry.Start(ctx, "fetch artifact")
+	defer span.End()
+	span.SetAttributes(telemetry.ImageNameKey.String(artifact))
+
+	if IsQcow2(artifact) {
+		return "", fmt.Errorf("%s is a qcow2 image, use the raw .img.zstd artifact from the same build instead", artifact)
+	}
+
+	local := artifact
+	if bucket, object, remote := ParseBucketURI(artifact); remote {
+		if bucket == "" || object == "" {
+			return "", fmt.Errorf("bucket uri %s needs a bucket and an object name", artifact)
+		}
+		local = w.Path(path.Base(object))
+		if err := downloadObject(ctx, fileSystem, openBucket, bucket, object, local); err != nil {
+			return "", fmt.Errorf("could not download %s: %w", artifact, err)
+		}
+	}
+
+	if !strings.HasSuffix(local, ".zstd") {
+		return local, nil
+	}
+	image := w.Path(strings.TrimSuffix(path.Base(local), ".zstd"))
+	if err := DecompressImage(ctx, fileSystem, local, image); err != nil {
+		return "", fmt.Errorf("could not decompress image: %w", err)
+	}
+	return image, nil
+}
+
+// FetchObject downloads the object named by a gs:// uri to destination.
+func FetchObject(ctx context.Context, fileSystem afero.Fs, uri string, destination string, openBucket BucketOpener) error {
+	bucket, object, remote := ParseBucketURI(uri)
+	if !remote || bucket == "" || object == "" {
+		return fmt.Errorf("%s isn't a bucket uri", uri)
+	}
+	return downloadObject(ctx, fileSystem, openBucket, bucket, object, destination)
+}
+
+func downloadObject(ctx context.Context, fileSystem afero.Fs, openBucket BucketOpener, bucket string, object string, destination string) (err error) {
+	objects, openErr := openBucket(ctx, bucket)
+	if openErr != nil {
+		return openErr
+	}
+	reader, readErr := objects.Open(ctx, object)
+	if readErr != nil {
+		return readErr
+	}
+	defer utility.WrappedClose(reader)
+
+	file, createErr := fileSystem.Create(destination)
+	if createErr != nil {
+		return createErr
+	}
+	defer utility.CloseWithErr(file, &err)
+
+	written, copyErr := io.Copy(file, utility.NewProgressReader(ctx, reader, "download "+object, 0))
+	if copyErr != nil {
+		return copyErr
+	}
+	telemetry.AddBytesDownloaded(ctx, written)
+	return nil
+}
+
+// ReadOnlyImage is an image on a read only loop device with its partitions mounted read only in a workspace.
+type ReadOnlyImage struct {
+	Workspace Workspace
+	Device    Entry
+}
+
+// Root is the image's root filesystem, with the boot partition mounted at /boot/firmware.
+func (i ReadOnlyImage) Root(fileSystem afero.Fs) afero.Fs {
+	return afero.NewBasePathFs(fileSystem, i.Workspace.RootMount())
+}
+
+// MountReadOnly attaches imageFile to a read only loop device and mounts it in w. When mounting fails whatever was
+// set up is torn down again.
+func MountReadOnly(ctx context.Context, fileSystem afero.Fs, w Workspace, imageFile string) (ReadOnlyImage, error) {
+	ctx, span := telemetry.Start(ctx, "mount image read only")
+	defer span.End()
+
+	device, loopErr := MountImageReadOnly(ctx, imageFile)
+	image := ReadOnlyImage{Workspace: w, Device: device}
+	if loopErr != nil {
+		return image, fmt.Errorf("could not create loop device for image: %w", loopErr)
+	}
+	if device.Name == "" {
+		return image, fmt.Errorf("losetup didn't list a loop device for %s", imageFile)
+	}
+	if err := AttachReadOnly(ctx, fileSystem, w, device); err != nil {
+		return image, errors.Join(fmt.Errorf("could not mount image read only: %w", err), image.Close(ctx, fileSystem))
+	}
+	return image, nil
+}
+
+// Close unmounts the image and detaches its loop device. It keeps going after ctx is cancelled, e.g. by an
+// interrupt, since a mounted image left behind would hold its loop device until someone cleans it up by hand.
+func (i ReadOnlyImage) Close(ctx context.Context, fileSystem afero.Fs) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), readOnlyCleanupTimeout)
+	defer cancel()
+	if err := CleanupImage(ctx, utility.ExecRunner{}, fileSystem, i.Workspace, i.Device, ""); err != nil {
+		return fmt.Errorf("could not clean up, unmount %s and detach %s by hand: %w", i.Workspace.RootMount(), i.Device.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/store"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBucketURI(t *testing.T) {
+	bucket, object, ok := ParseBucketURI("gs://images/builds/image.img.zstd")
+	assert.True(t, ok)
+	assert.Equal(t, "images", bucket)
+	assert.Equal(t, "builds/image.img.zstd", object)
+
+	_, _, ok = ParseBucketURI("/tmp/image.img")
+	assert.False(t, ok)
+}
+
+func TestFetchArtifact(t *testing.T) {
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	w := Workspace{Dir: "/work"}
+	assert.NoError(t, afero.WriteFile(fs, "/build/image.img", []byte("image contents"), 0644))
+	compressed, compressErr := CompressImage(ctx, fs, "/build/image.img")
+	assert.NoError(t, compressErr)
+	contents, readErr := afero.ReadFile(fs, compressed)
+	assert.NoError(t, readErr)
+
+	objects := store.NewMemory()
+	assert.NoError(t, objects.Upload(ctx, "builds/image.img.zstd", bytes.NewReader(contents), nil))
+	var opened string
+	openBucket := func(_ context.Context, bucket string) (store.ObjectStore, error) {
+		opened = bucket
+		return objects, nil
+	}
+	unusable := func(context.Context, string) (store.ObjectStore, error) {
+		return nil, errors.New("no buckets for local artifacts")
+	}
+
+	local, localErr := FetchArtifact(ctx, fs, w, "/build/image.img", unusable)
+	assert.NoError(t, localErr)
+	assert.Equal(t, "/build/image.img", local)
+
+	decompressed, decompressErr := FetchArtifact(ctx, fs, w, compressed, unusable)
+	assert.NoError(t, decompressErr)
+	assert.Equal(t, "/work/image.img", decompressed)
+
+	downloaded, downloadErr := FetchArtifact(ctx, fs, Workspace{Dir: "/remote"}, "gs://images/builds/image.img.zstd", openBucket)
+	assert.NoError(t, downloadErr)
+	assert.Equal(t, "images", opened)
+	assert.Equal(t, "/remote/image.img", downloaded)
+	image, imageErr := afero.ReadFile(fs, downloaded)
+	assert.NoError(t, imageErr)
+	assert.Equal(t, []byte("image contents"), image)
+
+	_, qcowErr := FetchArtifact(ctx, fs, w, "/build/image.qcow2", unusable)
+	assert.Error(t, qcowErr)
+	_, uriErr := FetchArtifact(ctx, fs, w, "gs://images", openBucket)
+	assert.Error(t, uriErr)
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+)
+
+// partitionAlignment is where parted and the stock images start and end partitions.
+const partitionAlignment = 1 << 20
+
+var errNoRootPartition = errors.New("no ext4 partition found on device")
+
+// ShrinkImage shrinks the root filesystem to its minimum size, shrinks its partition to match, and returns how many
+// bytes of the image file are still in use. It must run after Unmount and before Detach, the filesystem can't be
+// resized while it's mounted and the partition is only reachable through the loop device. The filesystem is checked
+// first and a filesystem with errors isn't touched. Only the last partition of an msdos table is shrunk, so the image
+// can be truncated to the returned size.
+func ShrinkImage(ctx context.Context, runner utility.Runner, device Entry) (int64, error) {
+	ctx, span := telemetry.Start(ctx, "shrink image")
+	defer span.End()
+	span.SetAttributes(telemetry.DevicePathKey.String(device.Name))
+
+	layout, printErr := runner.Output(ctx, exec.Command("parted", "-s", "-m", device.Name, "--", "unit", "B", "print")) //nolint:gosec
+	if printErr != nil {
+		return 0, fmt.Errorf("could not read partition table: %w", printErr)
+	}
+	partition, parseErr := parsePartedOutput(layout)
+	if parseErr != nil {
+		return 0, parseErr
+	}
+	if partition.Number == 0 {
+		return 0, errNoRootPartition
+	}
+	partitionName := utility.PartitionName(device.Name, int(partition.Number))
+
+	// -n keeps e2fsck read only so a damaged filesystem is left exactly as it was for someone to look at
+	if err := runner.Run(ctx, exec.Command("e2fsck", "-f", "-n", partitionName)); err != nil { //nolint:gosec
+		return 0, fmt.Errorf("refusing to shrink %s, e2fsck reported errors: %w", partitionName, err)
+	}
+
+	// the read only check doesn't record itself, -f skips resize2fs asking for the check that just ran
+	if err := runner.Run(ctx, exec.Command("resize2fs", "-f", "-M", partitionName)); err != nil { //nolint:gosec
+		return 0, fmt.Errorf("could not shrink filesystem on %s: %w", partitionName, err)
+	}
+
+	superblock, dumpErr := runner.Output(ctx, exec.Command("dumpe2fs", "-h", partitionName)) //nolint:gosec
+	if dumpErr != nil {
+		return 0, fmt.Errorf("could not read filesystem size: %w", dumpErr)
+	}
+	fsSize, sizeErr := filesystemSize(superblock)
+	if sizeErr != nil {
+		return 0, sizeErr
+	}
+
+	end := alignUp(int64(partition.Start.Bytes())+fsSize, partitionAlignment) - 1
+	// parted asks before shrinking a partition even with -s, so answer it on a pretend terminal
+	resize := exec.Command("parted", "---pretend-input-tty", device.Name, "unit", "B", "resizepart", //nolint:gosec
+		strconv.FormatUint(partition.Number, 10), fmt.Sprintf("%dB", end))
+	resize.Stdin = strings.NewReader("Yes\n")
+	if err := runner.Run(ctx, resize); err != nil {
+		return 0, fmt.Errorf("could not shrink partition %d: %w", partition.Number, err)
+	}
+
+	telemetry.Logger(ctx).Info("shrank root partition", "filesystem_bytes", fsSize, "partition_end", end,
+		"previous_partition_end", partition.End.Bytes())
+	return end + 1, nil
+}
+
+// filesystemSize reads the block count and block size from dumpe2fs -h output.
+func filesystemSize(superblock []byte) (int64, error) {
+	var count, size int64
+	scanner := bufio.NewScanner(bytes.NewReader(superblock))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		var target *int64
+		switch key {
+		case "Block count":
+			target = &count
+		case "Block size":
+			target = &size
+		default:
+			continue
+		}
+		parsed, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("could not parse %s: %w", strings.ToLower(key), err)
+		}
+		*target = parsed
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if count == 0 || size == 0 {
+		return 0, errors.New("dumpe2fs output is missing the block count or block size")
+	}
+	return count * size, nil
+}
+
+func alignUp(value int64, alignment int64) int64 {
+	return (value + alignment - 1) / alignment * alignment
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	shrinkLayout = "BYT;\n/dev/loop0:4294967296B:loopback:512:512:msdos:Loopback device:;\n" +
+		"1:1048576B:269484031B:268435456B:fat32::lba;\n2:269484032B:4294967295B:4025483264B:ext4::;\n"
+	shrinkSuperblock = "Filesystem volume name:   writable\nBlock count:              524289\nBlock size:               4096\n"
+)
+
+func shrinkRunner() *utility.FakeRunner {
+	return &utility.FakeRunner{
+		Outputs: map[string][]byte{
+			"parted -s -m /dev/loop0 -- unit B print": []byte(shrinkLayout),
+			"dumpe2fs -h /dev/loop0p2":                []byte(shrinkSuperblock),
+		},
+		Errors: map[string]error{},
+	}
+}
+
+func TestShrinkImage(t *testing.T) {
+	runner := shrinkRunner()
+	size, err := ShrinkImage(context.Background(), runner, Entry{Name: "/dev/loop0"})
+	assert.NoError(t, err)
+	// the filesystem ends 4KiB past 2GiB so the partition rounds up to the next MiB boundary
+	assert.Equal(t, int64(2418016256), size)
+	assert.Equal(t, []string{
+		"parted -s -m /dev/loop0 -- unit B print",
+		"e2fsck -f -n /dev/loop0p2",
+		"resize2fs -f -M /dev/loop0p2",
+		"dumpe2fs -h /dev/loop0p2",
+		"parted ---pretend-input-tty /dev/loop0 unit B resizepart 2 2418016255B",
+	}, runner.Commands)
+}
+
+func TestShrinkImageRefusesDamagedFilesystem(t *testing.T) {
+	runner := shrinkRunner()
+	runner.Errors["e2fsck -f -n /dev/loop0p2"] = errors.New("exit status 4")
+	_, err := ShrinkImage(context.Background(), runner, Entry{Name: "/dev/loop0"})
+	assert.ErrorContains(t, err, "e2fsck reported errors")
+	assert.Equal(t, []string{
+		"parted -s -m /dev/loop0 -- unit B print",
+		"e2fsck -f -n /dev/loop0p2",
+	}, runner.Commands)
+}
+
+func TestFilesystemSize(t *testing.T) {
+	size, err := filesystemSize([]byte(shrinkSuperblock))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(524289*4096), size)
+
+	_, missingErr := filesystemSize([]byte("Block size: 4096\n"))
+	assert.Error(t, missingErr)
+}
@@ -0,0 +1,309 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/distro"
+	"github.com/LadySerena/pi-image-builder/partition"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/c2h5oh/datasize"
+	"github.com/spf13/afero"
+	"golang.org/x/net/http/httpproxy"
+)
+
+const (
+	SourceImage       = "image"
+	SourceDebootstrap = "debootstrap"
+)
+
+const defaultBootstrapSize = "6GB"
+
+// SourceConfig picks where the image cmd/setup configures comes from.
+type SourceConfig struct {
+	// Type is image to remix the distro's published image, or debootstrap to build it from scratch. Empty is image.
+	Type string `yaml:"type"`
+	// Size of a debootstrapped image, e.g. 8GB. Empty is 6GB.
+	Size string `yaml:"size"`
+	// Mirror replaces the distro's debootstrap mirror.
+	Mirror string `yaml:"mirror"`
+	// ExtraPackages are installed alongside the distro's boot packages when debootstrapping.
+	ExtraPackages []string `yaml:"extraPackages"`
+}
+
+// Source produces the raw image cmd/setup attaches and configures. Its methods back the download, extract, expand,
+// and grow steps, in that order.
+type Source interface {
+	// Fetch downloads whatever the image is built from.
+	Fetch(ctx context.Context, fileSystem afero.Fs) error
+	// Extract leaves the raw image at ImageFile.
+	Extract(ctx context.Context) error
+	// Expand makes room in ImageFile for configuring.
+	Expand(ctx context.Context) error
+	// Prepare readies the image's filesystems once ImageFile is attached to device.
+	Prepare(ctx context.Context, device Entry) error
+	// ImageFile is the raw image on the host.
+	ImageFile() string
+	// URLs are what the source downloads from, checked before a build starts.
+	URLs() []string
+	// Checksum identifies what the image is built from, it keys checkpoints and the layer cache.
+	Checksum(fileSystem afero.Fs) (string, error)
+	// Name is a human readable name for what the image is built from.
+	Name() string
+}
+
+// NewSource builds the source cfg asks for, keeping its files in w. runner, chroot, and proxies are only used to
+// debootstrap, chroot must be rooted at w's RootMount.
+func NewSource(cfg SourceConfig, d distro.Distro, w Workspace, runner utility.Runner, chroot configure.ChrootRunner, proxies httpproxy.Config) (Source, error) {
+	switch cfg.Type {
+	case "", SourceImage:
+		return VendorImage{Distro: d, Workspace: w}, nil
+	case SourceDebootstrap:
+		size := cfg.Size
+		if size == "" {
+			size = defaultBootstrapSize
+		}
+		var parsed datasize.ByteSize
+		if err := parsed.UnmarshalText([]byte(size)); err != nil {
+			return nil, fmt.Errorf("invalid debootstrap image size %q: %w", cfg.Size, err)
+		}
+		bootstrap := d.Bootstrap
+		if cfg.Mirror != "" {
+			bootstrap.Mirror = cfg.Mirror
+		}
+		bootstrap.Packages = append(append([]string{}, bootstrap.Packages...), cfg.ExtraPackages...)
+		return Debootstrap{
+			Distro:    d,
+			Workspace: w,
+			Bootstrap: bootstrap,
+			Size:      parsed,
+			Runner:    runner,
+			Chroot:    chroot,
+			Proxies:   proxies,
+			Emulate:   configure.EnsureBinfmt,
+		}, nil
+	default:
+		return nil, fmt.Errorf("source must be %s or %s, got: %q", SourceImage, SourceDebootstrap, cfg.Type)
+	}
+}
+
+// VendorImage remixes the distro's published image.
+type VendorImage struct {
+	Distro    distro.Distro
+	Workspace Workspace
+}
+
+func (v VendorImage) Fetch(ctx context.Context, fileSystem afero.Fs) error {
+	return DownloadAndVerifyMedia(ctx, fileSystem, v.Workspace, v.Distro, ForceDownload)
+}
+
+func (v VendorImage) Extract(ctx context.Context) error {
+	_, err := ExtractImage(ctx, v.Workspace, v.Distro, ForceDownload)
+	return err
+}
+
+func (v VendorImage) Expand(ctx context.Context) error {
+	return ExpandSize(ctx, v.ImageFile())
+}
+
+func (v VendorImage) Prepare(ctx context.Context, device Entry) error {
+	return FileSystemExpansion(ctx, device)
+}
+
+func (v VendorImage) ImageFile() string {
+	return v.Workspace.Path(v.Distro.ExtractName())
+}
+
+func (v VendorImage) URLs() []string {
+	return MediaURLs(v.Distro)
+}
+
+func (v VendorImage) Name() string {
+	return v.Distro.ImageName
+}
+
+func (v VendorImage) Checksum(fileSystem afero.Fs) (string, error) {
+	return ImageChecksum(fileSystem, v.Workspace, v.Distro)
+}
+
+// ImageCopy is one profile's copy of a vendor image another build already fetched and extracted, so a batch of
+// profiles shares one download. Everything but the image file itself comes from Base.
+type ImageCopy struct {
+	VendorImage
+	// Base is the shared image, fetched and extracted into its own workspace.
+	Base VendorImage
+}
+
+// NewImageCopy copies base's image into w.
+func NewImageCopy(base VendorImage, w Workspace) ImageCopy {
+	return ImageCopy{VendorImage: VendorImage{Distro: base.Distro, Workspace: w}, Base: base}
+}
+
+// Fetch does nothing, the base image was already downloaded.
+func (c ImageCopy) Fetch(context.Context, afero.Fs) error {
+	return nil
+}
+
+// Extract copies the base's extracted image, a reflink where the filesystem supports it and a sparse copy where it
+// doesn't.
+func (c ImageCopy) Extract(ctx context.Context) error {
+	return CopyImage(ctx, c.Base.ImageFile(), c.ImageFile())
+}
+
+func (c ImageCopy) Checksum(fileSystem afero.Fs) (string, error) {
+	return c.Base.Checksum(fileSystem)
+}
+
+// CopyImage copies source to destination without writing the zeroed blocks of either out in full.
+func CopyImage(ctx context.Context, source string, destination string) error {
+	ctx, span := telemetry.Start(ctx, "copy image")
+	defer span.End()
+	span.SetAttributes(telemetry.ImageNameKey.String(destination))
+
+	if _, err := utility.Run(ctx, utility.RunOptions{}, "cp", "--reflink=auto", "--sparse=always", source, destination); err != nil {
+		return fmt.Errorf("could not copy %s to %s: %w", source, destination, err)
+	}
+	return nil
+}
+
+// Debootstrap builds the distro from scratch into a blank image, so nothing from a vendor image needs purging.
+type Debootstrap struct {
+	Distro    distro.Distro
+	Workspace Workspace
+	Bootstrap distro.Bootstrap
+	Size      datasize.ByteSize
+	Runner    utility.Runner
+	Chroot    configure.ChrootRunner
+	// Proxies are handed to apt inside the image, debootstrap itself runs on the host and reads them from the
+	// environment.
+	Proxies httpproxy.Config
+	// Emulate lets the host run the image's binaries, configure.EnsureBinfmt outside of tests.
+	Emulate func(ctx context.Context, fs afero.Fs) error
+}
+
+// Fetch does nothing, debootstrap downloads packages while preparing.
+func (b Debootstrap) Fetch(context.Context, afero.Fs) error {
+	return nil
+}
+
+// Extract creates a sparse image file of the configured size.
+func (b Debootstrap) Extract(ctx context.Context) (err error) {
+	_, span := telemetry.Start(ctx, "create blank image")
+	defer span.End()
+	span.SetAttributes(telemetry.ImageNameKey.String(b.ImageFile()))
+
+	image, err := os.Create(b.ImageFile())
+	if err != nil {
+		return err
+	}
+	defer utility.CloseWithErr(image, &err)
+	return image.Truncate(int64(b.Size.Bytes()))
+}
+
+// Expand does nothing, Extract already sizes the image.
+func (b Debootstrap) Expand(context.Context) error {
+	return nil
+}
+
+// Prepare partitions and formats the image, then debootstraps the root filesystem and installs the packages that
+// make it boot. Everything is unmounted again before it returns so the mount step attaches it like a vendor image.
+func (b Debootstrap) Prepare(ctx context.Context, device Entry) (err error) {
+	ctx, span := telemetry.Start(ctx, "debootstrap image")
+	defer span.End()
+	span.SetAttributes(telemetry.DevicePathKey.String(device.Name))
+
+	if err := partition.PartitionImage(ctx, b.Runner, device.Name); err != nil {
+		return err
+	}
+
+	if err := b.Runner.Run(ctx, exec.Command("mount", utility.PartitionName(device.Name, 2), b.Workspace.RootMount())); err != nil { //nolint:gosec
+		return err
+	}
+	defer func() {
+		if unmountErr := b.Runner.Run(ctx, exec.Command("umount", b.Workspace.RootMount())); unmountErr != nil {
+			err = errors.Join(err, unmountErr)
+		}
+	}()
+
+	if err := os.MkdirAll(b.Workspace.BootMount(), 0755); err != nil {
+		return err
+	}
+	if err := b.Runner.Run(ctx, exec.Command("mount", utility.PartitionName(device.Name, 1), b.Workspace.BootMount())); err != nil { //nolint:gosec
+		return err
+	}
+	defer func() {
+		if unmountErr := b.Runner.Run(ctx, exec.Command("umount", b.Workspace.BootMount())); unmountErr != nil {
+			err = errors.Join(err, unmountErr)
+		}
+	}()
+
+	if err := b.Emulate(ctx, afero.NewBasePathFs(afero.NewOsFs(), b.Workspace.RootMount())); err != nil {
+		return err
+	}
+
+	if err := b.Runner.Stream(ctx, b.debootstrapCommand()); err != nil {
+		return fmt.Errorf("debootstrap failed: %w", err)
+	}
+
+	if err := configure.AptProxy(ctx, afero.NewBasePathFs(afero.NewOsFs(), b.Workspace.RootMount()), b.Proxies); err != nil {
+		return err
+	}
+	install := append([]string{"apt-get", "install", "-y", "--no-install-recommends"}, b.Bootstrap.Packages...)
+	return b.Chroot.Stream(ctx, 30*time.Minute, install...)
+}
+
+func (b Debootstrap) debootstrapCommand() *exec.Cmd {
+	args := []string{"--arch", "arm64"}
+	if len(b.Bootstrap.Components) != 0 {
+		args = append(args, "--components", strings.Join(b.Bootstrap.Components, ","))
+	}
+	args = append(args, b.Bootstrap.Suite, b.Workspace.RootMount(), b.Bootstrap.Mirror)
+	return exec.Command("debootstrap", args...) //nolint:gosec
+}
+
+func (b Debootstrap) Name() string {
+	return fmt.Sprintf("debootstrap %s from %s", b.Bootstrap.Suite, b.Bootstrap.Mirror)
+}
+
+func (b Debootstrap) ImageFile() string {
+	return b.Workspace.Path(b.Distro.OutputPrefix + "-debootstrap.img")
+}
+
+// URLs is the suite's Release file, which debootstrap reads first.
+func (b Debootstrap) URLs() []string {
+	return []string{strings.TrimSuffix(b.Bootstrap.Mirror, "/") + "/dists/" + b.Bootstrap.Suite + "/Release"}
+}
+
+// Checksum hashes the suite, mirror, and packages, the closest thing a from scratch build has to a base image.
+func (b Debootstrap) Checksum(afero.Fs) (string, error) {
+	hash := sha256.New()
+	for _, part := range [][]string{{b.Bootstrap.Suite, b.Bootstrap.Mirror}, b.Bootstrap.Components, b.Bootstrap.Packages} {
+		hash.Write([]byte(strings.Join(part, ",") + "\n"))
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
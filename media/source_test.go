@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/distro"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/c2h5oh/datasize"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http/httpproxy"
+)
+
+func TestNewSource(t *testing.T) {
+	vendor, vendorErr := NewSource(SourceConfig{}, distro.Ubuntu, testWorkspace, &utility.FakeRunner{}, nil, httpproxy.Config{})
+	assert.NoError(t, vendorErr)
+	assert.Equal(t, VendorImage{Distro: distro.Ubuntu, Workspace: testWorkspace}, vendor)
+	assert.Equal(t, "/work/ubuntu-20.04.5-preinstalled-server-arm64+raspi.img", vendor.ImageFile())
+
+	bootstrap, bootstrapErr := NewSource(SourceConfig{Type: SourceDebootstrap, Size: "8GB", Mirror: "http://mirror.local/debian", ExtraPackages: []string{"vim"}}, distro.RaspiOS, testWorkspace, &utility.FakeRunner{}, nil, httpproxy.Config{})
+	assert.NoError(t, bootstrapErr)
+	debootstrap := bootstrap.(Debootstrap)
+	assert.Equal(t, 8*datasize.GB, debootstrap.Size)
+	assert.Equal(t, "http://mirror.local/debian", debootstrap.Bootstrap.Mirror)
+	assert.Equal(t, []string{"raspi-firmware", "linux-image-arm64", "firmware-brcm80211", "vim"}, debootstrap.Bootstrap.Packages)
+	assert.Equal(t, []string{"raspi-firmware", "linux-image-arm64", "firmware-brcm80211"}, distro.RaspiOS.Bootstrap.Packages, "distro defaults aren't modified")
+	assert.Equal(t, "/work/raspios-bookworm-arm64-debootstrap.img", bootstrap.ImageFile())
+	assert.Equal(t, []string{"http://mirror.local/debian/dists/bookworm/Release"}, bootstrap.URLs())
+
+	_, sizeErr := NewSource(SourceConfig{Type: SourceDebootstrap, Size: "lots"}, distro.Ubuntu, testWorkspace, nil, nil, httpproxy.Config{})
+	assert.Error(t, sizeErr)
+	_, typeErr := NewSource(SourceConfig{Type: "netboot"}, distro.Ubuntu, testWorkspace, nil, nil, httpproxy.Config{})
+	assert.Error(t, typeErr)
+}
+
+func TestDebootstrapCommand(t *testing.T) {
+	source, err := NewSource(SourceConfig{Type: SourceDebootstrap}, distro.Ubuntu, testWorkspace, nil, nil, httpproxy.Config{})
+	assert.NoError(t, err)
+	debootstrap := source.(Debootstrap)
+	assert.Equal(t, 6*datasize.GB, debootstrap.Size)
+	assert.Equal(t, []string{"debootstrap", "--arch", "arm64", "--components", "main,restricted,universe", "focal", "/work/mnt", "http://ports.ubuntu.com/ubuntu-ports"}, debootstrap.debootstrapCommand().Args)
+}
+
+func TestDebootstrapChecksum(t *testing.T) {
+	source, _ := NewSource(SourceConfig{Type: SourceDebootstrap}, distro.Ubuntu, testWorkspace, nil, nil, httpproxy.Config{})
+	first, firstErr := source.Checksum(nil)
+	assert.NoError(t, firstErr)
+	again, _ := source.Checksum(nil)
+	assert.Equal(t, first, again)
+
+	extra, _ := NewSource(SourceConfig{Type: SourceDebootstrap, ExtraPackages: []string{"vim"}}, distro.Ubuntu, testWorkspace, nil, nil, httpproxy.Config{})
+	changed, _ := extra.Checksum(nil)
+	assert.NotEqual(t, first, changed)
+}
+
+func TestImageCopy(t *testing.T) {
+	dir := t.TempDir()
+	base := VendorImage{Distro: distro.Ubuntu, Workspace: Workspace{Dir: dir}}
+	copied := NewImageCopy(base, Workspace{Dir: filepath.Join(dir, "k8s-worker")})
+	assert.Equal(t, filepath.Join(dir, "k8s-worker", "ubuntu-20.04.5-preinstalled-server-arm64+raspi.img"), copied.ImageFile())
+
+	fs := afero.NewOsFs()
+	assert.NoError(t, afero.WriteFile(fs, filepath.Join(dir, distro.Ubuntu.ChecksumName), []byte("aaaa *ubuntu-20.04.5-preinstalled-server-arm64+raspi.img.xz\n"), 0644))
+	checksum, checksumErr := copied.Checksum(fs)
+	assert.NoError(t, checksumErr)
+	assert.Equal(t, "aaaa", checksum, "the checksum is the shared download's")
+
+	assert.NoError(t, copied.Fetch(context.Background(), fs))
+	assert.NoError(t, afero.WriteFile(fs, base.ImageFile(), []byte("raw image"), 0644))
+	assert.NoError(t, fs.MkdirAll(copied.Workspace.Dir, 0755))
+	assert.NoError(t, copied.Extract(context.Background()))
+	contents, readErr := afero.ReadFile(fs, copied.ImageFile())
+	assert.NoError(t, readErr)
+	assert.Equal(t, "raw image", string(contents))
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+// ImageSize is how big an image file claims to be and how much disk it really takes.
+type ImageSize struct {
+	Logical   int64
+	Allocated int64
+}
+
+// StatImage reads the logical and allocated size of name.
+func StatImage(name string) (ImageSize, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return ImageSize{}, err
+	}
+	size := ImageSize{Logical: info.Size(), Allocated: info.Size()}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		// st_blocks is always in 512 byte units regardless of the filesystem's block size
+		size.Allocated = stat.Blocks * 512
+	}
+	return size, nil
+}
+
+// TrimFilesystems discards the mounted image's unused blocks, which the loop device turns into holes in the image
+// file. A filesystem that can't be trimmed is zero filled instead so its free space still compresses away.
+func TrimFilesystems(ctx context.Context, runner utility.Runner, w Workspace) error {
+	ctx, span := telemetry.Start(ctx, "trim filesystems")
+	defer span.End()
+
+	for _, mountPoint := range []string{w.BootMount(), w.RootMount()} {
+		trimErr := runner.Run(ctx, exec.Command("fstrim", "-v", mountPoint))
+		if trimErr == nil {
+			continue
+		}
+		telemetry.Logger(ctx).Warn("could not trim filesystem, zero filling it instead", "mount", mountPoint, "error", trimErr)
+		if err := configure.ZeroFreeSpace(ctx, afero.NewBasePathFs(afero.NewOsFs(), mountPoint)); err != nil {
+			return fmt.Errorf("could not zero fill %s: %w", mountPoint, err)
+		}
+	}
+	return nil
+}
+
+// DigHoles turns runs of zeros in the detached image file into holes, so zero filled space takes no disk.
+func DigHoles(ctx context.Context, runner utility.Runner, imageFile string) error {
+	ctx, span := telemetry.Start(ctx, "dig holes")
+	defer span.End()
+	span.SetAttributes(telemetry.ImageNameKey.String(imageFile))
+
+	return runner.Run(ctx, exec.Command("fallocate", "--dig-holes", imageFile))
+}
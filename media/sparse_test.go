@@ -0,0 +1,51 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrimAndDigHoles(t *testing.T) {
+	runner := &utility.FakeRunner{}
+	assert.NoError(t, TrimFilesystems(context.Background(), runner, testWorkspace))
+	assert.NoError(t, DigHoles(context.Background(), runner, "image.img"))
+	assert.Equal(t, []string{
+		"fstrim -v /work/mnt/boot/firmware",
+		"fstrim -v /work/mnt",
+		"fallocate --dig-holes image.img",
+	}, runner.Commands)
+}
+
+func TestStatImage(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "sparse.img")
+	file, err := os.Create(name)
+	assert.NoError(t, err)
+	assert.NoError(t, file.Truncate(64<<20))
+	assert.NoError(t, file.Close())
+
+	size, statErr := StatImage(name)
+	assert.NoError(t, statErr)
+	assert.Equal(t, int64(64<<20), size.Logical)
+	assert.Less(t, size.Allocated, size.Logical)
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+)
+
+// blockSize is what file sizes are rounded up to when estimating how much space a tree takes on the destination.
+const blockSize = 4096
+
+type syncPair struct {
+	source      string
+	destination string
+}
+
+func flashPairs(w Workspace) []syncPair {
+	return []syncPair{
+		{source: w.BootMount(), destination: w.MediaBoot()},
+		{source: w.RootMount(), destination: w.MediaRoot()},
+	}
+}
+
+// treeSize sums the regular files under root on root's filesystem, like rsync -x sees them.
+func treeSize(root string) (uint64, error) {
+	rootInfo, statErr := lstat(root)
+	if statErr != nil {
+		return 0, statErr
+	}
+
+	var total uint64
+	walkErr := filepath.WalkDir(root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, infoErr := entry.Info()
+		if infoErr != nil {
+			return infoErr
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if ok && stat.Dev != rootInfo.Dev {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() {
+			total += (uint64(info.Size()) + blockSize - 1) / blockSize * blockSize
+		}
+		return nil
+	})
+	return total, walkErr
+}
+
+func lstat(filePath string) (*syscall.Stat_t, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Lstat(filePath, &stat); err != nil {
+		return nil, err
+	}
+	return &stat, nil
+}
+
+func freeSpace(filePath string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(filePath, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// CheckFreeSpace fails before anything is copied when a destination can't hold its source.
+func CheckFreeSpace(ctx context.Context, w Workspace) error {
+	_, span := telemetry.Start(ctx, "check media free space")
+	defer span.End()
+
+	for _, pair := range flashPairs(w) {
+		needed, sizeErr := treeSize(pair.source)
+		if sizeErr != nil {
+			return sizeErr
+		}
+		available, freeErr := freeSpace(pair.destination)
+		if freeErr != nil {
+			return freeErr
+		}
+		if needed > available {
+			return fmt.Errorf("%s needs %d bytes but %s only has %d free, short by %d bytes", pair.source, needed, pair.destination, available, needed-available)
+		}
+	}
+	return nil
+}
+
+// changedPaths pulls the paths out of rsync --itemize-changes output.
+func changedPaths(output []byte) []string {
+	var paths []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		_, changed, found := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if found && changed != "" {
+			paths = append(paths, changed)
+		}
+	}
+	return paths
+}
+
+// VerifyFlash checksums the image against the media with a dry run rsync. Anything rsync would still copy is a file
+// that didn't land intact.
+func VerifyFlash(ctx context.Context, runner utility.Runner, w Workspace) error {
+	ctx, span := telemetry.Start(ctx, "verify flash")
+	defer span.End()
+
+	for _, pair := range flashPairs(w) {
+		verify := exec.Command("rsync", "--dry-run", "--checksum", "--recursive", "--links", "--one-file-system", "--itemize-changes", utility.TrailingSlash(pair.source), utility.TrailingSlash(pair.destination)) //nolint:gosec
+		output, verifyErr := runner.Output(ctx, verify)
+		if verifyErr != nil {
+			return verifyErr
+		}
+		if differing := changedPaths(output); len(differing) != 0 {
+			return fmt.Errorf("%d files differ between %s and %s: %s", len(differing), pair.source, pair.destination, strings.Join(differing, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyFlash(t *testing.T) {
+	clean := &utility.FakeRunner{}
+	assert.NoError(t, VerifyFlash(context.Background(), clean, testWorkspace))
+	assert.Equal(t, []string{
+		"rsync --dry-run --checksum --recursive --links --one-file-system --itemize-changes /work/mnt/boot/firmware/ /work/media-mnt/boot/firmware/",
+		"rsync --dry-run --checksum --recursive --links --one-file-system --itemize-changes /work/mnt/ /work/media-mnt/",
+	}, clean.Commands)
+
+	corrupt := &utility.FakeRunner{Outputs: map[string][]byte{
+		"rsync --dry-run --checksum --recursive --links --one-file-system --itemize-changes /work/mnt/ /work/media-mnt/": []byte(">fc.T...... usr/bin/kubelet\ncL+++++++++ etc/localtime -> ../usr/share/zoneinfo/UTC\n"),
+	}}
+	err := VerifyFlash(context.Background(), corrupt, testWorkspace)
+	assert.ErrorContains(t, err, "usr/bin/kubelet")
+	assert.ErrorContains(t, err, "etc/localtime")
+}
+
+func TestTreeSize(t *testing.T) {
+	root := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "etc"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "etc", "hostname"), []byte("pi\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "kernel"), make([]byte, blockSize+1), 0644))
+	assert.NoError(t, os.Symlink("kernel", filepath.Join(root, "vmlinux")))
+
+	size, err := treeSize(root)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3*blockSize), size)
+}
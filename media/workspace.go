@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+)
+
+// WorkspaceRoot holds the default per build workspaces.
+const WorkspaceRoot = "/var/tmp/pi-image-builder"
+
+// workspaceLockFile is flocked by the build using the workspace.
+const workspaceLockFile = "build.lock"
+
+// Workspace is the directory one build keeps its downloads, images, and mount points in, so builds sharing a checkout
+// or a host don't trip over each other's files.
+type Workspace struct {
+	Dir string
+}
+
+// NewWorkspace is a fresh timestamped workspace under WorkspaceRoot.
+func NewWorkspace(now time.Time) Workspace {
+	return Workspace{Dir: filepath.Join(WorkspaceRoot, now.UTC().Format("20060102T150405Z"))}
+}
+
+// Create makes the workspace directory.
+func (w Workspace) Create() error {
+	if err := os.MkdirAll(w.Dir, 0755); err != nil {
+		return fmt.Errorf("could not create workspace %s: %w", w.Dir, err)
+	}
+	return nil
+}
+
+// Remove deletes the workspace and everything left in it. Nothing may still be mounted inside it.
+func (w Workspace) Remove() error {
+	return os.RemoveAll(w.Dir)
+}
+
+// Lock keeps a second build from using the workspace until the returned lock is released. With wait set it blocks
+// until the other build is done instead of failing.
+func (w Workspace) Lock(ctx context.Context, wait bool) (*utility.Lock, error) {
+	return utility.AcquireLock(ctx, w.Path(workspaceLockFile), wait)
+}
+
+// Path is name inside the workspace.
+func (w Workspace) Path(name string) string {
+	return filepath.Join(w.Dir, name)
+}
+
+// RootMount is where the image's root partition is mounted while it's configured.
+func (w Workspace) RootMount() string {
+	return w.Path("mnt")
+}
+
+// BootMount is where the image's boot partition is mounted, inside RootMount.
+func (w Workspace) BootMount() string {
+	return w.Path("mnt/boot/firmware")
+}
+
+// MediaRoot is where the target device's root volume is mounted while flashing.
+func (w Workspace) MediaRoot() string {
+	return w.Path("media-mnt")
+}
+
+// MediaBoot is where the target device's boot partition is mounted, inside MediaRoot.
+func (w Workspace) MediaBoot() string {
+	return w.Path("media-mnt/boot/firmware")
+}
+
+// mediaPath maps an absolute path on the node to where it's mounted while flashing.
+func (w Workspace) mediaPath(mountPoint string) string {
+	return w.MediaRoot() + filepath.Clean("/"+mountPoint)
+}
+
+func (w Workspace) mountedResolv() string {
+	return w.Path("mnt/etc/resolv.conf")
+}
+
+func (w Workspace) mountedResolvBackup() string {
+	return w.Path("mnt/etc/resolve.conf.bak")
+}
+
+func (w Workspace) mediaResolv() string {
+	return w.Path("media-mnt/etc/resolv.conf")
+}
+
+func (w Workspace) mediaResolvBackup() string {
+	return w.Path("media-mnt/etc/resolve.conf.bak")
+}
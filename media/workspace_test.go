@@ -0,0 +1,36 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testWorkspace is the workspace the package's tests mount and write under.
+var testWorkspace = Workspace{Dir: "/work"}
+
+func TestWorkspacePaths(t *testing.T) {
+	w := NewWorkspace(time.Date(2024, 3, 9, 17, 4, 5, 0, time.FixedZone("PST", -8*60*60)))
+
+	assert.Equal(t, "/var/tmp/pi-image-builder/20240310T010405Z", w.Dir)
+	assert.Equal(t, "/var/tmp/pi-image-builder/20240310T010405Z/mnt/boot/firmware", w.BootMount())
+	assert.Equal(t, "/work/media-mnt/var/lib/longhorn", testWorkspace.mediaPath("var/lib/longhorn"))
+	assert.Equal(t, "/work/ubuntu.img.xz", testWorkspace.Path("ubuntu.img.xz"))
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package offline builds without a network from an artifact directory populated on a connected machine by
+// cmd/prefetch. Every file in it is recorded with its url and sha256 in a lockfile and checked before it's used.
+package offline
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	// LockName is the lockfile at the root of an artifact directory.
+	LockName = "artifacts.lock.json"
+	// PoolDir holds the deb pool, a flat apt repository with a Packages index.
+	PoolDir = "debs"
+)
+
+// Entry is one file in the artifact directory.
+type Entry struct {
+	// URL is what the file stands in for, deb pool files have none.
+	URL string `json:"url,omitempty"`
+	// Path is relative to the artifact directory.
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// Lock records everything in an artifact directory.
+type Lock struct {
+	Artifacts []Entry `json:"artifacts"`
+	Packages  []Entry `json:"packages,omitempty"`
+}
+
+// Lookup finds the artifact downloaded from url.
+func (l Lock) Lookup(url string) (Entry, bool) {
+	for _, entry := range l.Artifacts {
+		if entry.URL == url {
+			return entry, true
+		}
+	}
+	return Entry{}, false
+}
+
+// Record adds entry, replacing any artifact already recorded for its url.
+func (l *Lock) Record(entry Entry) {
+	for i, existing := range l.Artifacts {
+		if existing.URL == entry.URL {
+			l.Artifacts[i] = entry
+			return
+		}
+	}
+	l.Artifacts = append(l.Artifacts, entry)
+}
+
+// ReadLock reads the lockfile in dir.
+func ReadLock(fs afero.Fs, dir string) (Lock, error) {
+	var lock Lock
+	raw, readErr := afero.ReadFile(fs, path.Join(dir, LockName))
+	if readErr != nil {
+		return lock, readErr
+	}
+	if err := json.Unmarshal(raw, &lock); err != nil {
+		return lock, fmt.Errorf("could not parse %s: %w", LockName, err)
+	}
+	return lock, nil
+}
+
+// Write saves the lockfile into dir, sorted so rerunning prefetch only changes what changed.
+func (l Lock) Write(fs afero.Fs, dir string) error {
+	for _, entries := range [][]Entry{l.Artifacts, l.Packages} {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Path < entries[j].Path
+		})
+	}
+	data, marshalErr := json.MarshalIndent(l, "", "  ")
+	if marshalErr != nil {
+		return marshalErr
+	}
+	return afero.WriteFile(fs, path.Join(dir, LockName), append(data, '\n'), 0644)
+}
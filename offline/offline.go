@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package offline
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/LadySerena/pi-image-builder/config"
+	"github.com/LadySerena/pi-image-builder/media"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+// ErrArtifactMissing is returned for anything an offline build needs that isn't in the artifact directory.
+type ErrArtifactMissing struct {
+	Artifact string
+}
+
+func (e *ErrArtifactMissing) Error() string {
+	return fmt.Sprintf("offline mode but artifact %s missing", e.Artifact)
+}
+
+// ErrArtifactChanged is returned when a file no longer matches the hash recorded for it.
+type ErrArtifactChanged struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (e *ErrArtifactChanged) Error() string {
+	return fmt.Sprintf("artifact %s has sha256 %s, the lockfile recorded %s", e.Path, e.Actual, e.Expected)
+}
+
+// Dir is an artifact directory opened for an offline build.
+type Dir struct {
+	fs   afero.Fs
+	root string
+	lock Lock
+}
+
+// Open reads the lockfile of the artifact directory at root.
+func Open(fs afero.Fs, root string) (*Dir, error) {
+	lock, err := ReadLock(fs, root)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s has no %s, populate it with prefetch first", root, LockName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Dir{fs: fs, root: root, lock: lock}, nil
+}
+
+// Pool is the deb pool to hand to configure.LocalAptRepo.
+func (d *Dir) Pool() afero.Fs {
+	return afero.NewReadOnlyFs(afero.NewBasePathFs(d.fs, path.Join(d.root, PoolDir)))
+}
+
+// Verify checks every url is in the lockfile and every recorded file, including the deb pool, still has its hash.
+// It's run before the image is touched so a missing or corrupt artifact fails the build while it can still be fixed.
+// Every problem is returned, not just the first.
+func (d *Dir) Verify(ctx context.Context, urls []string) error {
+	ctx, span := telemetry.Start(ctx, "verify artifacts")
+	defer span.End()
+
+	var problems []error
+	for _, url := range urls {
+		entry, found := d.lock.Lookup(url)
+		if !found {
+			problems = append(problems, &ErrArtifactMissing{Artifact: url})
+			continue
+		}
+		problems = append(problems, d.verify(entry))
+	}
+	if len(d.lock.Packages) == 0 {
+		problems = append(problems, &ErrArtifactMissing{Artifact: PoolDir})
+	}
+	for _, entry := range d.lock.Packages {
+		problems = append(problems, d.verify(entry))
+	}
+	return errors.Join(problems...)
+}
+
+func (d *Dir) verify(entry Entry) error {
+	file, openErr := d.fs.Open(path.Join(d.root, entry.Path))
+	if errors.Is(openErr, os.ErrNotExist) {
+		return &ErrArtifactMissing{Artifact: entry.Path}
+	}
+	if openErr != nil {
+		return openErr
+	}
+	defer utility.WrappedClose(file)
+
+	actual, hashErr := hashReader(file)
+	if hashErr != nil {
+		return hashErr
+	}
+	if actual != entry.SHA256 {
+		return &ErrArtifactChanged{Path: entry.Path, Expected: entry.SHA256, Actual: actual}
+	}
+	return nil
+}
+
+// Supported rejects builds that can't run offline, the check happens before anything is downloaded or mounted.
+func Supported(cfg config.Config, source media.Source) error {
+	var problems []error
+	if _, bootstrapping := source.(media.Debootstrap); bootstrapping {
+		problems = append(problems, errors.New("offline mode builds from a vendor image, debootstrap needs a mirror"))
+	}
+	if len(cfg.PreloadImages) != 0 {
+		problems = append(problems, errors.New("offline mode can't preload container images, they're pulled from their registry"))
+	}
+	if len(cfg.Helm.Charts) != 0 {
+		problems = append(problems, errors.New("offline mode can't vendor helm charts, they're pulled from their repository"))
+	}
+	return errors.Join(problems...)
+}
+
+// ArtifactPath is where the file downloaded from rawURL lives in the artifact directory, its host followed by its
+// path.
+func ArtifactPath(rawURL string) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+		return "", fmt.Errorf("can't store %s in an artifact directory, only http and https urls are supported", rawURL)
+	}
+	name := path.Clean("/" + parsed.Path)
+	if name == "/" {
+		return "", fmt.Errorf("can't store %s in an artifact directory, it has no file name", rawURL)
+	}
+	return path.Join(parsed.Host, name), nil
+}
+
+func hashReader(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package offline
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func prefetched(t *testing.T) (afero.Fs, string, []string) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "contents of "+r.URL.Path)
+	}))
+	t.Cleanup(server.Close)
+
+	fs := afero.NewOsFs()
+	root := t.TempDir()
+	pool := t.TempDir()
+	assert.NoError(t, afero.WriteFile(fs, path.Join(pool, "Packages"), []byte("Package: vim\n"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, path.Join(pool, "vim_8.2_arm64.deb"), []byte("deb"), 0644))
+
+	urls := []string{server.URL + "/ubuntu/SHA256SUMS", server.URL + "/kubernetes/kubeadm"}
+	assert.NoError(t, Prefetch(context.Background(), fs, root, urls, pool, &utility.FakeRunner{}))
+	return fs, root, urls
+}
+
+func TestPrefetch(t *testing.T) {
+	fs, root, urls := prefetched(t)
+
+	lock, err := ReadLock(fs, root)
+	assert.NoError(t, err)
+	assert.Len(t, lock.Artifacts, 2)
+	assert.Len(t, lock.Packages, 2)
+	entry, found := lock.Lookup(urls[1])
+	assert.True(t, found)
+	name, _ := ArtifactPath(urls[1])
+	assert.Equal(t, name, entry.Path)
+	content, readErr := afero.ReadFile(fs, path.Join(root, entry.Path))
+	assert.NoError(t, readErr)
+	assert.Equal(t, "contents of /kubernetes/kubeadm", string(content))
+	assert.Equal(t, int64(len(content)), entry.Size)
+
+	dir, openErr := Open(fs, root)
+	assert.NoError(t, openErr)
+	assert.NoError(t, dir.Verify(context.Background(), urls))
+	packages, poolErr := afero.ReadFile(dir.Pool(), "Packages")
+	assert.NoError(t, poolErr)
+	assert.Equal(t, "Package: vim\n", string(packages))
+
+	// a rerun without a pool keeps the one already copied in
+	assert.NoError(t, Prefetch(context.Background(), fs, root, urls, "", &utility.FakeRunner{}))
+	rerun, rerunErr := ReadLock(fs, root)
+	assert.NoError(t, rerunErr)
+	assert.Equal(t, lock, rerun)
+}
+
+func TestVerify(t *testing.T) {
+	fs, root, urls := prefetched(t)
+	dir, err := Open(fs, root)
+	assert.NoError(t, err)
+
+	var missing *ErrArtifactMissing
+	verifyErr := dir.Verify(context.Background(), append(urls, "https://github.com/kat.keys"))
+	assert.ErrorAs(t, verifyErr, &missing)
+	assert.Equal(t, "offline mode but artifact https://github.com/kat.keys missing", missing.Error())
+
+	entry, _ := dir.lock.Lookup(urls[0])
+	assert.NoError(t, afero.WriteFile(fs, path.Join(root, entry.Path), []byte("tampered"), 0644))
+	var changed *ErrArtifactChanged
+	assert.ErrorAs(t, dir.Verify(context.Background(), urls), &changed)
+	assert.Equal(t, entry.Path, changed.Path)
+
+	_, noLockErr := Open(fs, t.TempDir())
+	assert.Error(t, noLockErr)
+}
+
+func TestTransport(t *testing.T) {
+	fs, root, urls := prefetched(t)
+	dir, err := Open(fs, root)
+	assert.NoError(t, err)
+	client := &http.Client{Transport: dir.Transport()}
+
+	response, getErr := client.Get(urls[0])
+	assert.NoError(t, getErr)
+	body, readErr := io.ReadAll(response.Body)
+	assert.NoError(t, readErr)
+	assert.NoError(t, response.Body.Close())
+	assert.Equal(t, "contents of /ubuntu/SHA256SUMS", string(body))
+	assert.Equal(t, int64(len(body)), response.ContentLength)
+
+	head, headErr := client.Head(urls[1])
+	assert.NoError(t, headErr)
+	assert.Equal(t, http.StatusOK, head.StatusCode)
+
+	var missing *ErrArtifactMissing
+	_, missingErr := client.Get("https://dl.k8s.io/release/stable-1.25.txt")
+	assert.ErrorAs(t, missingErr, &missing)
+
+	_, postErr := client.Post(urls[0], "text/plain", nil)
+	assert.Error(t, postErr)
+
+	entry, _ := dir.lock.Lookup(urls[0])
+	assert.NoError(t, afero.WriteFile(fs, path.Join(root, entry.Path), []byte("contents of /ubuntu/SHA256SUMX"), 0644))
+	tampered, tamperedErr := client.Get(urls[0])
+	assert.NoError(t, tamperedErr)
+	_, tamperedReadErr := io.ReadAll(tampered.Body)
+	var changed *ErrArtifactChanged
+	assert.True(t, errors.As(tamperedReadErr, &changed), "a body that doesn't match fails once it's read")
+	assert.NoError(t, tampered.Body.Close())
+}
+
+func TestPrefetchIndexesPool(t *testing.T) {
+	fs := afero.NewOsFs()
+	root := t.TempDir()
+	pool := t.TempDir()
+	assert.NoError(t, afero.WriteFile(fs, path.Join(pool, "vim_8.2_arm64.deb"), []byte("deb"), 0644))
+
+	runner := &utility.FakeRunner{Outputs: map[string][]byte{"dpkg-scanpackages --multiversion .": []byte("Package: vim\n")}}
+	assert.NoError(t, Prefetch(context.Background(), fs, root, nil, pool, runner))
+	assert.Equal(t, []string{"dpkg-scanpackages --multiversion ."}, runner.Commands)
+
+	index, err := afero.ReadFile(fs, path.Join(root, PoolDir, "Packages"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Package: vim\n", string(index))
+}
+
+func TestArtifactPath(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string
+		wantErr  bool
+	}{
+		{url: "https://dl.k8s.io/release/v1.25.3/bin/linux/arm64/kubeadm", expected: "dl.k8s.io/release/v1.25.3/bin/linux/arm64/kubeadm"},
+		{url: "https://github.com/../../etc/passwd", expected: "github.com/etc/passwd"},
+		{url: "http://127.0.0.1:8080/SHA256SUMS", expected: "127.0.0.1:8080/SHA256SUMS"},
+		{url: "file:///srv/mirror/Release", wantErr: true},
+		{url: "https://github.com/", wantErr: true},
+	}
+	for _, test := range tests {
+		name, err := ArtifactPath(test.url)
+		if test.wantErr {
+			assert.Error(t, err, test.url)
+			continue
+		}
+		assert.NoError(t, err, test.url)
+		assert.Equal(t, test.expected, name)
+	}
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package offline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/LadySerena/pi-image-builder/media"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+	"golang.org/x/sync/errgroup"
+)
+
+// maxConcurrentPrefetches bounds how many artifacts are downloaded at once.
+const maxConcurrentPrefetches = 4
+
+// packagesIndex is the flat repository index apt reads from the pool.
+const packagesIndex = "Packages"
+
+// Prefetch downloads urls into the artifact directory at root and records them in its lockfile. Artifacts already
+// recorded that still match their hash aren't downloaded again. When pool is set it's copied in as the deb pool, a
+// flat apt repository such as a directory of apt-get download output, and indexed with dpkg-scanpackages if it has
+// no Packages file. The lockfile is written even when a download fails so the next run picks up where this stopped.
+func Prefetch(ctx context.Context, fs afero.Fs, root string, urls []string, pool string, runner utility.Runner) (err error) {
+	ctx, span := telemetry.Start(ctx, "prefetch")
+	defer span.End()
+
+	lock, lockErr := ReadLock(fs, root)
+	if lockErr != nil && !errors.Is(lockErr, os.ErrNotExist) {
+		return lockErr
+	}
+	dir := &Dir{fs: fs, root: root, lock: lock}
+	defer func() {
+		if writeErr := dir.lock.Write(fs, root); writeErr != nil {
+			err = errors.Join(err, writeErr)
+		}
+	}()
+
+	var mutex sync.Mutex
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(maxConcurrentPrefetches)
+	for _, url := range urls {
+		url := url
+		group.Go(func() error {
+			mutex.Lock()
+			existing, found := dir.lock.Lookup(url)
+			mutex.Unlock()
+			if found && dir.verify(existing) == nil {
+				return nil
+			}
+			entry, fetchErr := dir.fetch(groupCtx, url)
+			if fetchErr != nil {
+				return fmt.Errorf("could not prefetch %s: %w", url, fetchErr)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			dir.lock.Record(entry)
+			return nil
+		})
+	}
+	if waitErr := group.Wait(); waitErr != nil {
+		return waitErr
+	}
+
+	if pool != "" {
+		if copyErr := dir.copyPool(ctx, pool, runner); copyErr != nil {
+			return copyErr
+		}
+	}
+	packages, hashErr := dir.hashPool()
+	if hashErr != nil {
+		return hashErr
+	}
+	dir.lock.Packages = packages
+	return nil
+}
+
+func (d *Dir) fetch(ctx context.Context, url string) (Entry, error) {
+	name, nameErr := ArtifactPath(url)
+	if nameErr != nil {
+		return Entry{}, nameErr
+	}
+	destination := path.Join(d.root, name)
+	if err := d.fs.MkdirAll(path.Dir(destination), 0755); err != nil {
+		return Entry{}, err
+	}
+	if err := media.DownloadFile(ctx, d.fs, destination, url, media.DownloadTimeout); err != nil {
+		return Entry{}, err
+	}
+	return d.entry(name, url)
+}
+
+func (d *Dir) entry(name string, url string) (Entry, error) {
+	file, openErr := d.fs.Open(path.Join(d.root, name))
+	if openErr != nil {
+		return Entry{}, openErr
+	}
+	defer utility.WrappedClose(file)
+
+	info, statErr := file.Stat()
+	if statErr != nil {
+		return Entry{}, statErr
+	}
+	sum, hashErr := hashReader(file)
+	if hashErr != nil {
+		return Entry{}, hashErr
+	}
+	return Entry{URL: url, Path: name, SHA256: sum, Size: info.Size()}, nil
+}
+
+// copyPool copies the top level of source into the pool, which is all a flat repository has.
+func (d *Dir) copyPool(ctx context.Context, source string, runner utility.Runner) error {
+	poolPath := path.Join(d.root, PoolDir)
+	if err := d.fs.MkdirAll(poolPath, 0755); err != nil {
+		return err
+	}
+	entries, readErr := afero.ReadDir(d.fs, source)
+	if readErr != nil {
+		return readErr
+	}
+	indexed := false
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		indexed = indexed || strings.HasPrefix(entry.Name(), packagesIndex)
+		if err := copyFile(d.fs, path.Join(source, entry.Name()), path.Join(poolPath, entry.Name())); err != nil {
+			return err
+		}
+	}
+	if indexed {
+		return nil
+	}
+
+	scan := exec.CommandContext(ctx, "dpkg-scanpackages", "--multiversion", ".")
+	scan.Dir = poolPath
+	index, scanErr := runner.Output(ctx, scan)
+	if scanErr != nil {
+		return fmt.Errorf("could not index the deb pool: %w", scanErr)
+	}
+	return afero.WriteFile(d.fs, path.Join(poolPath, packagesIndex), index, 0644)
+}
+
+func (d *Dir) hashPool() ([]Entry, error) {
+	entries, readErr := afero.ReadDir(d.fs, path.Join(d.root, PoolDir))
+	if errors.Is(readErr, os.ErrNotExist) {
+		return nil, nil
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	var packages []Entry
+	for _, info := range entries {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		entry, entryErr := d.entry(path.Join(PoolDir, info.Name()), "")
+		if entryErr != nil {
+			return nil, entryErr
+		}
+		packages = append(packages, entry)
+	}
+	return packages, nil
+}
+
+func copyFile(fs afero.Fs, source string, destination string) (err error) {
+	in, openErr := fs.Open(source)
+	if openErr != nil {
+		return openErr
+	}
+	defer utility.WrappedClose(in)
+
+	out, createErr := fs.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if createErr != nil {
+		return createErr
+	}
+	defer func() {
+		if closeErr := out.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package partition
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+)
+
+// lsblkColumns are requested from lsblk, keep them in sync with BlockDevice's fields.
+const lsblkColumns = "NAME,MODEL,RM,SIZE,MOUNTPOINT,TYPE,TRAN"
+
+// lsblkSize is a byte count. lsblk --bytes prints a number on newer util-linux and a string on older ones.
+type lsblkSize uint64
+
+func (s *lsblkSize) UnmarshalJSON(data []byte) error {
+	unquoted := strings.Trim(string(data), `"`)
+	if unquoted == "null" || unquoted == "" {
+		*s = 0
+		return nil
+	}
+	size, err := strconv.ParseUint(unquoted, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid lsblk size %s: %w", data, err)
+	}
+	*s = lsblkSize(size)
+	return nil
+}
+
+// lsblkBool is a flag column. Newer util-linux prints a json bool, older releases print "0" or "1".
+type lsblkBool bool
+
+func (b *lsblkBool) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true", "1":
+		*b = true
+	case "false", "0", "null", "":
+		*b = false
+	default:
+		return fmt.Errorf("invalid lsblk flag %s", data)
+	}
+	return nil
+}
+
+// BlockDevice is one device from lsblk --json, partitions are its children.
+type BlockDevice struct {
+	Name       string        `json:"name"`
+	Model      string        `json:"model"`
+	Removable  lsblkBool     `json:"rm"`
+	Size       lsblkSize     `json:"size"`
+	MountPoint string        `json:"mountpoint"`
+	Type       string        `json:"type"`
+	Transport  string        `json:"tran"`
+	Children   []BlockDevice `json:"children"`
+}
+
+type lsblkOutput struct {
+	BlockDevices []BlockDevice `json:"blockdevices"`
+}
+
+// ParseBlockDevice reads lsblk --json output for a single device.
+func ParseBlockDevice(output []byte) (BlockDevice, error) {
+	var parsed lsblkOutput
+	if err := json.Unmarshal(output, &parsed); err != nil {
+		return BlockDevice{}, err
+	}
+	if len(parsed.BlockDevices) != 1 {
+		return BlockDevice{}, fmt.Errorf("expected one block device from lsblk, got %d", len(parsed.BlockDevices))
+	}
+	return parsed.BlockDevices[0], nil
+}
+
+// InspectDevice asks lsblk about device and its partitions.
+func InspectDevice(ctx context.Context, runner utility.Runner, device string) (BlockDevice, error) {
+	output, err := runner.Output(ctx, exec.Command("lsblk", "--json", "--bytes", "--output", lsblkColumns, device)) //nolint:gosec
+	if err != nil {
+		return BlockDevice{}, fmt.Errorf("could not inspect %s: %w", device, err)
+	}
+	return ParseBlockDevice(output)
+}
+
+// MountPoints lists everything mounted from the device or any of its partitions and volumes.
+func (d BlockDevice) MountPoints() []string {
+	mounted := make([]string, 0)
+	if d.MountPoint != "" {
+		mounted = append(mounted, d.MountPoint)
+	}
+	for _, child := range d.Children {
+		mounted = append(mounted, child.MountPoints()...)
+	}
+	return mounted
+}
+
+// humanSize formats bytes the way lsblk does without --bytes.
+func humanSize(size lsblkSize) string {
+	units := []string{"B", "K", "M", "G", "T", "P"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%dB", size)
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
+
+// DescribeDevice summarizes a device for confirmation prompts so it can be told apart from the host's own disks.
+func DescribeDevice(device BlockDevice) string {
+	var builder strings.Builder
+	model := strings.TrimSpace(device.Model)
+	if model == "" {
+		model = "unknown model"
+	}
+	if device.Transport != "" {
+		model = fmt.Sprintf("%s (%s)", model, device.Transport)
+	}
+	builder.WriteString(fmt.Sprintf("/dev/%s: %s, %s\n", device.Name, model, humanSize(device.Size)))
+	if len(device.Children) == 0 {
+		builder.WriteString("  no partitions\n")
+	}
+	for _, child := range device.Children {
+		mountPoint := child.MountPoint
+		if mountPoint == "" {
+			mountPoint = "not mounted"
+		}
+		builder.WriteString(fmt.Sprintf("  %s: %s %s (%s)\n", child.Name, child.Type, humanSize(child.Size), mountPoint))
+	}
+	return builder.String()
+}
+
+// DescribeLayout lists every partition and logical volume under the device, nested the way lsblk nests them.
+func DescribeLayout(device BlockDevice) string {
+	var builder strings.Builder
+	describeLayout(&builder, device, 0)
+	return builder.String()
+}
+
+func describeLayout(builder *strings.Builder, device BlockDevice, depth int) {
+	line := fmt.Sprintf("%s%s: %s %s", strings.Repeat("  ", depth), device.Name, device.Type, humanSize(device.Size))
+	if device.MountPoint != "" {
+		line += " at " + device.MountPoint
+	}
+	builder.WriteString(line + "\n")
+	for _, child := range device.Children {
+		describeLayout(builder, child, depth+1)
+	}
+}
+
+// DefaultMaxDeviceSize is the largest device flashed without an explicit override, nothing a pi boots from should be
+// bigger and plenty of workstation disks are.
+const DefaultMaxDeviceSize = 2 * 1000 * 1000 * 1000 * 1000
+
+// systemMountPoints mean the device is the host's own disk.
+var systemMountPoints = map[string]bool{"/": true, "/boot": true, "/boot/efi": true, "/usr": true, "/var": true, "/home": true, "[SWAP]": true}
+
+// SafetyPolicy decides which devices are too risky to flash. The zero value refuses everything suspicious except size,
+// set MaxSize to DefaultMaxDeviceSize for the usual limit.
+type SafetyPolicy struct {
+	AllowFixed      bool
+	AllowSystemDisk bool
+	AllowMounted    bool
+	// MaxSize in bytes, 0 disables the check.
+	MaxSize uint64
+}
+
+// Check returns an error naming every check device fails.
+func (p SafetyPolicy) Check(device BlockDevice) error {
+	failed := make([]string, 0)
+	if device.Type != "" && device.Type != "disk" {
+		failed = append(failed, fmt.Sprintf("it is a %s, not a whole disk", device.Type))
+	}
+	if !bool(device.Removable) && !p.AllowFixed {
+		failed = append(failed, "it is not removable (--allow-fixed)")
+	}
+	if p.MaxSize != 0 && uint64(device.Size) > p.MaxSize {
+		failed = append(failed, fmt.Sprintf("it is %s which is larger than %s (--max-size-gb)", humanSize(device.Size), humanSize(lsblkSize(p.MaxSize))))
+	}
+	mounted := device.MountPoints()
+	system := make([]string, 0)
+	for _, mountPoint := range mounted {
+		if systemMountPoints[mountPoint] {
+			system = append(system, mountPoint)
+		}
+	}
+	if len(system) != 0 && !p.AllowSystemDisk {
+		failed = append(failed, fmt.Sprintf("it hosts the system's %s (--allow-system-disk)", strings.Join(system, ", ")))
+	}
+	if len(mounted) != 0 && !p.AllowMounted {
+		failed = append(failed, fmt.Sprintf("it has mounted partitions %s (--force)", strings.Join(mounted, ", ")))
+	}
+
+	if len(failed) != 0 {
+		return fmt.Errorf("refusing to flash /dev/%s: %s", device.Name, strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package partition
+
+import (
+	"context"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/stretchr/testify/assert"
+)
+
+// sdCard is lsblk --json --bytes output from util-linux 2.37, newer releases print sizes as numbers.
+const sdCard = `{
+   "blockdevices": [
+      {"name":"sda", "model":"SD/MMC Reader  ", "rm":"1", "size":"63864569856", "mountpoint":null, "type":"disk", "tran":"usb",
+         "children": [
+            {"name":"sda1", "model":null, "size":"268435456", "mountpoint":"/media/serena/system-boot", "type":"part"},
+            {"name":"sda2", "model":null, "size":63594037248, "mountpoint":null, "type":"part",
+               "children": [
+                  {"name":"rootvg-rootlv", "model":null, "size":10737418240, "mountpoint":"/media/serena/root", "type":"lvm"}
+               ]
+            }
+         ]
+      }
+   ]
+}`
+
+func TestInspectDevice(t *testing.T) {
+	runner := &utility.FakeRunner{Outputs: map[string][]byte{
+		"lsblk --json --bytes --output NAME,MODEL,RM,SIZE,MOUNTPOINT,TYPE,TRAN /dev/sda": []byte(sdCard),
+	}}
+
+	device, err := InspectDevice(context.Background(), runner, "/dev/sda")
+	assert.NoError(t, err)
+	assert.Equal(t, "sda", device.Name)
+	assert.True(t, bool(device.Removable))
+	assert.Equal(t, lsblkSize(63864569856), device.Size)
+	assert.Len(t, device.Children, 2)
+	assert.Equal(t, []string{"/media/serena/system-boot", "/media/serena/root"}, device.MountPoints())
+	assert.Equal(t, "/dev/sda: SD/MMC Reader (usb), 59.5G\n"+
+		"  sda1: part 256.0M (/media/serena/system-boot)\n"+
+		"  sda2: part 59.2G (not mounted)\n", DescribeDevice(device))
+}
+
+func TestParseBlockDevice(t *testing.T) {
+	blank, err := ParseBlockDevice([]byte(`{"blockdevices": [{"name":"mmcblk0", "size":0, "type":"disk"}]}`))
+	assert.NoError(t, err)
+	assert.Empty(t, blank.MountPoints())
+	assert.Equal(t, "/dev/mmcblk0: unknown model, 0B\n  no partitions\n", DescribeDevice(blank))
+
+	_, err = ParseBlockDevice([]byte(`{"blockdevices": []}`))
+	assert.Error(t, err)
+
+	_, err = ParseBlockDevice([]byte(`{"blockdevices": [{"name":"sda", "size":"lots"}]}`))
+	assert.ErrorContains(t, err, "invalid lsblk size")
+}
+
+func TestDescribeLayout(t *testing.T) {
+	device := BlockDevice{Name: "loop3", Size: 4 * 1024 * 1024 * 1024, Type: "loop", Children: []BlockDevice{
+		{Name: "loop3p1", Size: 256 * 1024 * 1024, Type: "part", MountPoint: "/work/mnt/boot/firmware"},
+		{Name: "loop3p2", Size: 3 * 1024 * 1024 * 1024, Type: "part", Children: []BlockDevice{
+			{Name: "rootvg-rootlv", Size: 2 * 1024 * 1024 * 1024, Type: "lvm", MountPoint: "/work/mnt"},
+		}},
+	}}
+	assert.Equal(t, "loop3: loop 4.0G\n"+
+		"  loop3p1: part 256.0M at /work/mnt/boot/firmware\n"+
+		"  loop3p2: part 3.0G\n"+
+		"    rootvg-rootlv: lvm 2.0G at /work/mnt\n", DescribeLayout(device))
+}
+
+func TestSafetyPolicy(t *testing.T) {
+	card := BlockDevice{Name: "mmcblk0", Removable: true, Size: 64 * 1000 * 1000 * 1000, Type: "disk", Transport: "mmc"}
+	nvme := BlockDevice{Name: "nvme0n1", Size: 4 * 1000 * 1000 * 1000 * 1000, Type: "disk", Transport: "nvme", Children: []BlockDevice{
+		{Name: "nvme0n1p1", MountPoint: "/boot/efi", Type: "part"},
+		{Name: "nvme0n1p2", MountPoint: "/", Type: "part"},
+	}}
+	mountedCard := card
+	mountedCard.Children = []BlockDevice{{Name: "mmcblk0p1", MountPoint: "/media/serena/system-boot", Type: "part"}}
+	usbSSD := BlockDevice{Name: "sda", Size: 500 * 1000 * 1000 * 1000, Type: "disk", Transport: "usb"}
+
+	tests := []struct {
+		name   string
+		policy SafetyPolicy
+		device BlockDevice
+		failed []string
+	}{
+		{name: "sd card", policy: SafetyPolicy{MaxSize: DefaultMaxDeviceSize}, device: card},
+		{name: "mounted card", policy: SafetyPolicy{MaxSize: DefaultMaxDeviceSize}, device: mountedCard, failed: []string{"mounted partitions /media/serena/system-boot"}},
+		{name: "mounted card forced", policy: SafetyPolicy{AllowMounted: true}, device: mountedCard},
+		{name: "fixed usb ssd", policy: SafetyPolicy{MaxSize: DefaultMaxDeviceSize}, device: usbSSD, failed: []string{"not removable"}},
+		{name: "fixed usb ssd allowed", policy: SafetyPolicy{AllowFixed: true, MaxSize: DefaultMaxDeviceSize}, device: usbSSD},
+		{name: "partition", policy: SafetyPolicy{}, device: BlockDevice{Name: "mmcblk0p2", Removable: true, Type: "part"}, failed: []string{"not a whole disk"}},
+		{
+			name:   "workstation disk",
+			policy: SafetyPolicy{MaxSize: DefaultMaxDeviceSize},
+			device: nvme,
+			failed: []string{"not removable", "larger than", "system's /boot/efi, /", "mounted partitions"},
+		},
+		{
+			name:   "workstation disk only size allowed",
+			policy: SafetyPolicy{AllowFixed: true, AllowMounted: true},
+			device: nvme,
+			failed: []string{"system's /boot/efi, /"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Check(tt.device)
+			if len(tt.failed) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			for _, check := range tt.failed {
+				assert.ErrorContains(t, err, check)
+			}
+		})
+	}
+
+	err := SafetyPolicy{AllowFixed: true, AllowMounted: true}.Check(nvme)
+	assert.NotContains(t, err.Error(), "not removable")
+	assert.NotContains(t, err.Error(), "larger than")
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package partition
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+const defaultFilesystem = "ext4"
+
+type filesystem struct {
+	// mkfs builds the mkfs argv for device, force flags are included since the volume was just created
+	mkfs         func(device string, label string) []string
+	labelLimit   int
+	mountOptions string
+	// fsck is false for filesystems whose fsck is a no-op so the fstab pass is 0
+	fsck bool
+}
+
+var filesystems = map[string]filesystem{
+	"ext4": {
+		mkfs: func(device string, label string) []string {
+			return []string{"mkfs.ext4", "-F", "-L", label, device}
+		},
+		labelLimit:   16,
+		mountOptions: "defaults",
+		fsck:         true,
+	},
+	"xfs": {
+		mkfs: func(device string, label string) []string {
+			return []string{"mkfs.xfs", "-f", "-L", label, device}
+		},
+		labelLimit:   12,
+		mountOptions: "defaults,noatime",
+	},
+	"f2fs": {
+		mkfs: func(device string, label string) []string {
+			return []string{"mkfs.f2fs", "-f", "-l", label, device}
+		},
+		labelLimit:   512,
+		mountOptions: "defaults,noatime",
+		fsck:         true,
+	},
+	"btrfs": {
+		mkfs: func(device string, label string) []string {
+			return []string{"mkfs.btrfs", "-f", "-L", label, device}
+		},
+		labelLimit:   255,
+		mountOptions: "defaults,noatime",
+	},
+}
+
+// lookPath is swapped out in tests so tool checks don't depend on the host.
+var lookPath = exec.LookPath
+
+// Filesystem is the volume's filesystem type, ext4 when unset.
+func (v Volume) Filesystem() string {
+	if v.FSType == "" {
+		return defaultFilesystem
+	}
+	return v.FSType
+}
+
+func (v Volume) mkfsCommand() *exec.Cmd {
+	fs := filesystems[v.Filesystem()]
+	label := v.Name
+	if len(label) > fs.labelLimit {
+		label = label[:fs.labelLimit]
+	}
+	args := fs.mkfs(v.Device(), label)
+	return exec.Command(args[0], args[1:]...) //nolint:gosec
+}
+
+// MountOptions are the default fstab options for fsType.
+func MountOptions(fsType string) string {
+	if fs, ok := filesystems[fsType]; ok {
+		return fs.mountOptions
+	}
+	return "defaults"
+}
+
+// Checkable reports whether fsck does anything for fsType, xfs and btrfs want a 0 fstab pass.
+func Checkable(fsType string) bool {
+	if fs, ok := filesystems[fsType]; ok {
+		return fs.fsck
+	}
+	return true
+}
+
+// CheckFilesystemTools makes sure every mkfs the layout needs is installed, it runs before the device is touched.
+func CheckFilesystemTools(layout VolumeLayout) error {
+	tools := []string{"mkfs.vfat"}
+	for _, volume := range layout {
+		if fs, ok := filesystems[volume.Filesystem()]; ok {
+			tools = append(tools, fs.mkfs("", "")[0])
+		}
+	}
+	if len(layout.Encrypted()) != 0 {
+		tools = append(tools, "cryptsetup")
+	}
+
+	var missing []string
+	for _, tool := range tools {
+		if _, err := lookPath(tool); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("missing tools on the host, install them before flashing: %v", missing)
+	}
+	return nil
+}
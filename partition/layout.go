@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package partition
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+)
+
+const (
+	// RestSize gives a volume whatever is left once every other volume is sized.
+	RestSize = "rest"
+	// extentSize is the lvm default physical extent, sizes are rounded down to it so lvcreate never rounds up past
+	// the free space.
+	extentSize = 4 * byteToMebibyteFactor
+	// metadataReserve is held back from the volume group free space for lvm metadata.
+	metadataReserve = 2 * 256 * byteToMebibyteFactor
+)
+
+var (
+	sizePattern       = regexp.MustCompile(`^([0-9]+)(B|KiB|MiB|GiB|TiB)?$`)
+	percentPattern    = regexp.MustCompile(`^([0-9]{1,3})%$`)
+	volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]*$`)
+	unitFactors       = map[string]int{
+		"":    1,
+		"B":   1,
+		"KiB": 1024,
+		"MiB": byteToMebibyteFactor,
+		"GiB": byteToGibibyteFactor,
+		"TiB": byteToGibibyteFactor * 1024,
+	}
+)
+
+// Volume is one logical volume. Size is absolute (10GiB, 512MiB, or plain bytes), a percentage of the volume
+// group's free space (25%), or RestSize. Minimum uses the absolute form.
+type Volume struct {
+	Name    string `yaml:"name"`
+	Size    string `yaml:"size"`
+	Minimum string `yaml:"minimum"`
+	// Encrypted luks2 formats the volume with a per device keyfile, the root volume can't be encrypted.
+	Encrypted bool `yaml:"encrypted"`
+	// FSType is one of ext4 (default), xfs, f2fs, or btrfs.
+	FSType string `yaml:"fsType"`
+}
+
+// Device is the block device the filesystem lives on, the dm-crypt mapping for encrypted volumes.
+func (v Volume) Device() string {
+	if v.Encrypted {
+		return path.Join("/dev/mapper", utility.CryptName(v.Name))
+	}
+	return utility.MapperName(v.Name)
+}
+
+// VolumeLayout is the ordered list of logical volumes created in the volume group, exactly one may use RestSize.
+type VolumeLayout []Volume
+
+type VolumeSize struct {
+	Name string
+	Size int
+}
+
+// DefaultVolumeLayout is 10GiB root, 30GiB containerd, and the remainder (at least 5GiB) for csi storage.
+func DefaultVolumeLayout() VolumeLayout {
+	return VolumeLayout{
+		{Name: utility.RootLogicalVolume, Size: "10GiB"},
+		{Name: utility.CSILogicalVolume, Size: RestSize, Minimum: "5GiB"},
+		{Name: utility.ContainerdVolume, Size: "30GiB"},
+	}
+}
+
+func parseSize(size string) (int, error) {
+	parts := sizePattern.FindStringSubmatch(size)
+	if parts == nil {
+		return 0, fmt.Errorf("invalid size: %q", size)
+	}
+	value, conversionErr := strconv.Atoi(parts[1])
+	if conversionErr != nil {
+		return 0, conversionErr
+	}
+	return value * unitFactors[parts[2]], nil
+}
+
+func (l VolumeLayout) Validate() error {
+	if len(l) == 0 {
+		return errors.New("volume layout needs at least one volume")
+	}
+	names := map[string]bool{}
+	rest := 0
+	percent := 0
+	for _, volume := range l {
+		if !volumeNamePattern.MatchString(volume.Name) {
+			return fmt.Errorf("invalid logical volume name: %q", volume.Name)
+		}
+		if names[volume.Name] {
+			return fmt.Errorf("logical volume %s is declared more than once", volume.Name)
+		}
+		names[volume.Name] = true
+
+		if _, ok := filesystems[volume.Filesystem()]; !ok {
+			return fmt.Errorf("logical volume %s has unsupported filesystem: %q", volume.Name, volume.FSType)
+		}
+
+		if volume.Encrypted && volume.Name == utility.RootLogicalVolume {
+			return errors.New("the root logical volume can not be encrypted")
+		}
+
+		if volume.Minimum != "" {
+			if _, err := parseSize(volume.Minimum); err != nil {
+				return fmt.Errorf("logical volume %s: %w", volume.Name, err)
+			}
+		}
+
+		if volume.Size == RestSize {
+			rest++
+			continue
+		}
+		if parts := percentPattern.FindStringSubmatch(volume.Size); parts != nil {
+			value, _ := strconv.Atoi(parts[1])
+			if value == 0 {
+				return fmt.Errorf("logical volume %s can not be 0%%", volume.Name)
+			}
+			percent += value
+			continue
+		}
+		if _, err := parseSize(volume.Size); err != nil {
+			return fmt.Errorf("logical volume %s: %w", volume.Name, err)
+		}
+	}
+	if rest > 1 {
+		return errors.New("only one logical volume can use the rest of the volume group")
+	}
+	if percent > 100 {
+		return fmt.Errorf("logical volume percentages add up to %d%%", percent)
+	}
+	return nil
+}
+
+// Sizes slices free bytes between the volumes. Absolute sizes are taken first, percentages are of free, and the
+// rest volume gets what's left.
+func (l VolumeLayout) Sizes(vgName string, free int) ([]VolumeSize, error) {
+	if err := l.Validate(); err != nil {
+		return nil, err
+	}
+
+	sizes := make([]VolumeSize, len(l))
+	remaining := free
+	restIndex := -1
+	for index, volume := range l {
+		size := 0
+		switch parts := percentPattern.FindStringSubmatch(volume.Size); {
+		case volume.Size == RestSize:
+			restIndex = index
+			sizes[index] = VolumeSize{Name: volume.Name}
+			continue
+		case parts != nil:
+			value, _ := strconv.Atoi(parts[1])
+			size = free / 100 * value
+		default:
+			size, _ = parseSize(volume.Size)
+		}
+		size -= size % extentSize
+		sizes[index] = VolumeSize{Name: volume.Name, Size: size}
+		remaining -= size
+	}
+
+	if remaining < 0 {
+		return nil, fmt.Errorf("volumegroups: %s is %d bytes short of the requested layout", vgName, -remaining)
+	}
+
+	if restIndex != -1 {
+		sizes[restIndex].Size = remaining - remaining%extentSize
+	}
+
+	for index, volume := range l {
+		if volume.Minimum == "" {
+			continue
+		}
+		minimum, _ := parseSize(volume.Minimum)
+		if sizes[index].Size < minimum {
+			return nil, fmt.Errorf("volumegroups: %s does not have enough capacity for %s, it needs %s but only gets %d bytes", vgName, volume.Name, volume.Minimum, sizes[index].Size)
+		}
+	}
+
+	return sizes, nil
+}
+
+// Encrypted returns the volumes that are luks formatted.
+func (l VolumeLayout) Encrypted() VolumeLayout {
+	var encrypted VolumeLayout
+	for _, volume := range l {
+		if volume.Encrypted {
+			encrypted = append(encrypted, volume)
+		}
+	}
+	return encrypted
+}
+
+// Find returns the volume called name.
+func (l VolumeLayout) Find(name string) (Volume, bool) {
+	for _, volume := range l {
+		if volume.Name == name {
+			return volume, true
+		}
+	}
+	return Volume{}, false
+}
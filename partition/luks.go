@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package partition
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"os/exec"
+	"path"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
+)
+
+const (
+	// KeyDir is where the image expects volume keyfiles, systemd-cryptsetup also looks here by default.
+	KeyDir     = "/etc/cryptsetup-keys.d"
+	keyFileLen = 512
+)
+
+// KeyFile is the path of the keyfile for an encrypted volume relative to keyDir.
+func KeyFile(keyDir string, volume Volume) string {
+	return path.Join(keyDir, utility.CryptName(volume.Name)+".key")
+}
+
+// EncryptVolumes luks2 formats every encrypted volume in layout with a fresh random keyfile written to keyDir on the
+// host, then opens it so CreateFileSystems can build on the mapping. InstallKeys copies the keys into the image once
+// the root filesystem is populated.
+func EncryptVolumes(ctx context.Context, runner utility.Runner, fileSystem afero.Fs, layout VolumeLayout, keyDir string) error {
+	encrypted := layout.Encrypted()
+	if len(encrypted) == 0 {
+		return nil
+	}
+
+	if err := fileSystem.MkdirAll(keyDir, 0700); err != nil {
+		return err
+	}
+
+	for _, volume := range encrypted {
+		key := make([]byte, keyFileLen)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return err
+		}
+
+		keyFile := KeyFile(keyDir, volume)
+		if err := afero.WriteFile(fileSystem, keyFile, key, 0400); err != nil {
+			return err
+		}
+
+		format := exec.Command("cryptsetup", "luksFormat", "--type", "luks2", "--batch-mode", "--key-file", keyFile, utility.MapperName(volume.Name)) //nolint:gosec
+		if err := runner.Run(ctx, format); err != nil {
+			return err
+		}
+
+		open := exec.Command("cryptsetup", "open", "--key-file", keyFile, utility.MapperName(volume.Name), utility.CryptName(volume.Name)) //nolint:gosec
+		if err := runner.Run(ctx, open); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// InstallKeys moves the keyfiles from keyDir on the host into KeyDir under root and removes the host copies.
+func InstallKeys(fileSystem afero.Fs, layout VolumeLayout, keyDir string, root string) error {
+	encrypted := layout.Encrypted()
+	if len(encrypted) == 0 {
+		return nil
+	}
+
+	if err := fileSystem.MkdirAll(path.Join(root, KeyDir), 0700); err != nil {
+		return err
+	}
+
+	for _, volume := range encrypted {
+		key, readErr := afero.ReadFile(fileSystem, KeyFile(keyDir, volume))
+		if readErr != nil {
+			return readErr
+		}
+		if err := afero.WriteFile(fileSystem, KeyFile(path.Join(root, KeyDir), volume), key, 0400); err != nil {
+			return err
+		}
+	}
+
+	return fileSystem.RemoveAll(keyDir)
+}
@@ -20,8 +20,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -37,6 +37,14 @@ const (
 	byteToGibibyteFactor = byteToMebibyteFactor * 1024
 )
 
+// TableType is the partition table label written by CreateTable.
+type TableType string
+
+const (
+	TableMSDOS TableType = "msdos"
+	TableGPT   TableType = "gpt"
+)
+
 type PrintOutput struct {
 	Disk struct {
 		Label              string `json:"label"`
@@ -81,26 +89,10 @@ func ToLvmArgument(s int) string {
 	return fmt.Sprintf("%dB", s)
 }
 
-type SlicedVolumeGroup struct {
-	RootVolumeSize int
-	CSIVolumeSize  int
-}
-
-func GetPartitionTable(device string) (PrintOutput, error) {
-	existing := exec.Command("parted", "-j", device, "unit", "MiB", "print")
-	outputReader, pipeCreateErr := existing.StdoutPipe()
-	if pipeCreateErr != nil {
-		return PrintOutput{}, pipeCreateErr
-	}
-	if err := existing.Start(); err != nil {
-		return PrintOutput{}, err
-	}
-	jsonBlob, readErr := io.ReadAll(outputReader)
-	if readErr != nil {
-		return PrintOutput{}, readErr
-	}
-	if err := existing.Wait(); err != nil {
-		return PrintOutput{}, err
+func GetPartitionTable(ctx context.Context, runner utility.Runner, device string) (PrintOutput, error) {
+	jsonBlob, printErr := runner.Output(ctx, exec.Command("parted", "-j", device, "unit", "MiB", "print"))
+	if printErr != nil {
+		return PrintOutput{}, printErr
 	}
 	parsedOutput := PrintOutput{}
 	if err := json.Unmarshal(jsonBlob, &parsedOutput); err != nil {
@@ -115,57 +107,81 @@ func partedCommand(device string, options ...string) *exec.Cmd {
 	return exec.Command("parted", args...)
 }
 
-func CreateTable(device string) error {
-
-	currentTable, tableErr := GetPartitionTable(device)
-	if tableErr != nil {
-		return tableErr
+// tableCommands are the parted invocations that lay out the boot and lvm partitions for a table type. gpt names the
+// partitions and marks boot as the esp so usb and nvme boot can find it.
+func tableCommands(table TableType) ([][]string, error) {
+	switch table {
+	case TableMSDOS:
+		return [][]string{
+			{"mktable", "msdos"},
+			{"mkpart", "primary", "fat32", "2048s", "257MiB"},
+			{"mkpart", "primary", "ext4", "257MiB", "100%"},
+			{"set", "2", "lvm", "on"},
+		}, nil
+	case TableGPT:
+		return [][]string{
+			{"mktable", "gpt"},
+			{"mkpart", "system-boot", "fat32", "2048s", "257MiB"},
+			{"mkpart", "system-root", "ext4", "257MiB", "100%"},
+			{"set", "1", "esp", "on"},
+			{"set", "1", "boot", "on"},
+			{"set", "2", "lvm", "on"},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported partition table type: %q", table)
 	}
+}
 
-	if len(currentTable.Disk.Partitions) != 0 {
-		return fmt.Errorf("device: %s does not have an empty partition table", device)
-	}
+func CreateTable(ctx context.Context, runner utility.Runner, device string, table TableType) error {
 
-	table := partedCommand(device, "mktable", "msdos")
-	if err := table.Run(); err != nil {
-		return err
+	commands, commandsErr := tableCommands(table)
+	if commandsErr != nil {
+		return commandsErr
 	}
 
-	boot := partedCommand(device, "mkpart", "primary", "fat32", "2048s", "257MiB")
-	if err := boot.Run(); err != nil {
-		return err
+	currentTable, tableErr := GetPartitionTable(ctx, runner, device)
+	if tableErr != nil {
+		return tableErr
 	}
 
-	root := partedCommand(device, "mkpart", "primary", "ext4", "257MiB", "100%")
-	if err := root.Run(); err != nil {
-		return err
+	if len(currentTable.Disk.Partitions) != 0 {
+		return fmt.Errorf("device: %s does not have an empty partition table", device)
 	}
 
-	lvmEnable := partedCommand(device, "set", "2", "lvm", "on")
-	if err := lvmEnable.Run(); err != nil {
-		return err
+	for _, options := range commands {
+		if err := runner.Run(ctx, partedCommand(device, options...)); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func CreateLogicalVolumes(device string) error {
+// LVMCommand builds an lvm command that can only see device's partitions. Every flashed card gets the same volume
+// group name, so without the filter another card left in the hub, or a host volume group named the same, would clash
+// with the one being created.
+func LVMCommand(device string, tool string, args ...string) *exec.Cmd {
+	filter := fmt.Sprintf(`devices { filter = [ "a|^%sp?[0-9]+$|", "r|.*|" ] }`, regexp.QuoteMeta(device))
+	return exec.Command(tool, append([]string{"--config", filter}, args...)...) //nolint:gosec
+}
+
+func CreateLogicalVolumes(ctx context.Context, runner utility.Runner, device string, layout VolumeLayout) error {
 
-	rootPartition := fmt.Sprintf("%s2", device)
+	rootPartition := utility.PartitionName(device, 2)
 
-	physicalVolume := exec.Command("pvcreate", rootPartition)
+	physicalVolume := LVMCommand(device, "pvcreate", rootPartition)
 
-	if err := utility.RunCommandWithOutput(context.TODO(), physicalVolume, nil); err != nil {
+	if err := runner.Run(ctx, physicalVolume); err != nil {
 		return err
 	}
 
-	volumeGroup := exec.Command("vgcreate", utility.VolumeGroupName, rootPartition) //nolint:gosec
-	if err := utility.RunCommandWithOutput(context.TODO(), volumeGroup, nil); err != nil {
+	volumeGroup := LVMCommand(device, "vgcreate", utility.VolumeGroupName, rootPartition)
+	if err := runner.Run(ctx, volumeGroup); err != nil {
 		return err
 	}
 
-	vgReport := exec.Command("vgs", utility.VolumeGroupName, "--reportformat", "json", "--units", lvmBytes) //nolint:gosec
-	output, reportErr := vgReport.CombinedOutput()
+	vgReport := LVMCommand(device, "vgs", utility.VolumeGroupName, "--reportformat", "json", "--units", lvmBytes)
+	output, reportErr := runner.Output(ctx, vgReport)
 	if reportErr != nil {
 		return reportErr
 	}
@@ -177,78 +193,72 @@ func CreateLogicalVolumes(device string) error {
 	}
 
 	vgSize := parsedReport.Report[0].VG[0]
-	root, csi, containerd, logicalSliceErr := GetLogicalVolumeSizes(vgSize)
+	sizes, logicalSliceErr := GetLogicalVolumeSizes(vgSize, layout)
 	if logicalSliceErr != nil {
 		return logicalSliceErr
 	}
 
-	rootLogicalVolume := exec.Command("lvcreate", "--size", ToLvmArgument(root), utility.VolumeGroupName, "-n", utility.RootLogicalVolume, "--wipesignatures", "y") //nolint:gosec
-	if err := utility.RunCommandWithOutput(context.TODO(), rootLogicalVolume, nil); err != nil {
-		return err
-	}
-
-	csiLogicalVolume := exec.Command("lvcreate", "--size", ToLvmArgument(csi), utility.VolumeGroupName, "-n", utility.CSILogicalVolume, "--wipesignatures", "y") //nolint:gosec
-	if err := utility.RunCommandWithOutput(context.TODO(), csiLogicalVolume, nil); err != nil {
-		return err
-	}
-
-	containerdlogicalVolume := exec.Command("lvcreate", "--size", ToLvmArgument(containerd), utility.VolumeGroupName, "-n", utility.ContainerdVolume, "--wipesignatures", "y") //nolint:gosec
-	if err := utility.RunCommandWithOutput(context.TODO(), containerdlogicalVolume, nil); err != nil {
-		return err
+	for _, volume := range sizes {
+		logicalVolume := LVMCommand(device, "lvcreate", "--size", ToLvmArgument(volume.Size), utility.VolumeGroupName, "-n", volume.Name, "--wipesignatures", "y")
+		if err := runner.Run(ctx, logicalVolume); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func CreateFileSystems(device string) error {
-	// assume sd* for device
-
-	// TODO sort out different block devices (loop, nvme append p$NUM) others just have the number at the end
-	bootPartition := fmt.Sprintf("%s1", device)
-
-	bootFS := exec.Command("mkfs.vfat", "-F", "32", "-n", "system-boot", bootPartition)
-	if err := bootFS.Run(); err != nil {
+func CreateFileSystems(ctx context.Context, runner utility.Runner, device string, layout VolumeLayout) error {
+	if err := layout.Validate(); err != nil {
 		return err
 	}
 
-	rootFS := exec.Command("mkfs.ext4", utility.MapperName(utility.RootLogicalVolume)) //nolint:gosec
-	if err := rootFS.Run(); err != nil {
-		return err
-	}
+	bootPartition := utility.PartitionName(device, 1)
 
-	csiFS := exec.Command("mkfs.ext4", utility.MapperName(utility.CSILogicalVolume)) //nolint:gosec
-	if err := csiFS.Run(); err != nil {
+	bootFS := exec.Command("mkfs.vfat", "-F", "32", "-n", "system-boot", bootPartition)
+	if err := runner.Run(ctx, bootFS); err != nil {
 		return err
 	}
 
-	containerdFS := exec.Command("mkfs.ext4", utility.MapperName(utility.ContainerdVolume)) //nolint:gosec
-	if err := containerdFS.Run(); err != nil {
-		return err
+	for _, volume := range layout {
+		if err := runner.Run(ctx, volume.mkfsCommand()); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func GetLogicalVolumeSizes(entry VolumeGroupEntry) (rootSize int, CSISize int, containerdSize int, err error) {
-
-	initialSize := entry.VGFree
-	initialSize = strings.TrimSuffix(initialSize, lvmBytes)
-	parsedSize, conversionErr := strconv.Atoi(initialSize)
-	if conversionErr != nil {
-		return rootSize, CSISize, containerdSize, conversionErr
+// PartitionImage lays out a blank build image with an msdos table, formatting the boot partition as vfat and the
+// second as a plain ext4 root. The volume layout only applies once the image is flashed. Unlike CreateTable there's
+// no existing table to check, parted can't print a device without one.
+func PartitionImage(ctx context.Context, runner utility.Runner, device string) error {
+	commands := [][]string{
+		{"mktable", "msdos"},
+		{"mkpart", "primary", "fat32", "2048s", "257MiB"},
+		{"mkpart", "primary", "ext4", "257MiB", "100%"},
+	}
+	for _, options := range commands {
+		if err := runner.Run(ctx, partedCommand(device, options...)); err != nil {
+			return err
+		}
 	}
 
-	availableSize := parsedSize - (2 * 256 * byteToMebibyteFactor)
-
-	rootSize = 10 * byteToGibibyteFactor
-
-	containerdSize = 30 * byteToGibibyteFactor
+	bootFS := exec.Command("mkfs.vfat", "-F", "32", "-n", "system-boot", utility.PartitionName(device, 1))
+	if err := runner.Run(ctx, bootFS); err != nil {
+		return err
+	}
 
-	CSISize = availableSize - rootSize - containerdSize
+	rootFS := exec.Command("mkfs.ext4", "-F", "-L", "writable", utility.PartitionName(device, 2))
+	return runner.Run(ctx, rootFS)
+}
 
-	if CSISize < (5 * byteToGibibyteFactor) {
-		return rootSize, CSISize, containerdSize, fmt.Errorf("volumegroups: %s does not have enough capacity for csi storage", entry.Name)
+// GetLogicalVolumeSizes slices the volume group's free space according to layout.
+func GetLogicalVolumeSizes(entry VolumeGroupEntry, layout VolumeLayout) ([]VolumeSize, error) {
+	parsedSize, conversionErr := strconv.Atoi(strings.TrimSuffix(entry.VGFree, lvmBytes))
+	if conversionErr != nil {
+		return nil, conversionErr
 	}
 
-	return rootSize, CSISize, containerdSize, nil
+	return layout.Sizes(entry.Name, parsedSize-metadataReserve)
 }
@@ -17,9 +17,14 @@
 package partition
 
 import (
+	"context"
+	"os/exec"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/LadySerena/pi-image-builder/utility"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -42,22 +47,263 @@ func TestPartedCommand(t *testing.T) {
 	}
 }
 
-func TestGetLogicalVolumeSizes(t *testing.T) {
-	foo := VolumeGroupEntry{
+func volumeGroup(free string) VolumeGroupEntry {
+	return VolumeGroupEntry{
 		Name:        "rootvg",
 		PvCount:     "1",
 		LvCount:     "0",
 		SnapCount:   "0",
 		VGAttribute: "wz--n-",
-		VGSize:      "31394365440B",
-		VGFree:      "31394365440B",
+		VGSize:      free,
+		VGFree:      free,
+	}
+}
+
+func TestGetLogicalVolumeSizes(t *testing.T) {
+	cases := []struct {
+		name     string
+		entry    VolumeGroupEntry
+		layout   VolumeLayout
+		expected []VolumeSize
+	}{
+		{
+			name:   "64GB default layout",
+			entry:  volumeGroup("63585648640B"),
+			layout: DefaultVolumeLayout(),
+			expected: []VolumeSize{
+				{Name: "rootlv", Size: 10737418240},
+				{Name: "csilv", Size: 20099104768},
+				{Name: "containerdlv", Size: 32212254720},
+			},
+		},
+		{
+			name:  "32GB percentage layout",
+			entry: volumeGroup("31394365440B"),
+			layout: VolumeLayout{
+				{Name: "rootlv", Size: "10GiB"},
+				{Name: "csilv", Size: RestSize, Minimum: "5GiB"},
+				{Name: "containerdlv", Size: "40%"},
+			},
+			expected: []VolumeSize{
+				{Name: "rootlv", Size: 10737418240},
+				{Name: "csilv", Size: 7780433920},
+				{Name: "containerdlv", Size: 12339642368},
+			},
+		},
+		{
+			name:  "1TB layout with a log volume",
+			entry: volumeGroup("999934353408B"),
+			layout: VolumeLayout{
+				{Name: "rootlv", Size: "10%"},
+				{Name: "csilv", Size: RestSize, Minimum: "5GiB"},
+				{Name: "containerdlv", Size: "20%"},
+				{Name: "loglv", Size: "50GiB"},
+			},
+			expected: []VolumeSize{
+				{Name: "rootlv", Size: 99937681408},
+				{Name: "csilv", Size: 645893455872},
+				{Name: "containerdlv", Size: 199875362816},
+				{Name: "loglv", Size: 53687091200},
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := GetLogicalVolumeSizes(tt.entry, tt.layout)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
+
+func TestGetLogicalVolumeSizesTooSmall(t *testing.T) {
+	// the default layout needs 45GiB so it can't fit a 32GB card
+	_, err := GetLogicalVolumeSizes(volumeGroup("31394365440B"), DefaultVolumeLayout())
+	assert.Error(t, err)
+
+	_, minimumErr := GetLogicalVolumeSizes(volumeGroup("31394365440B"), VolumeLayout{
+		{Name: "rootlv", Size: "25GiB"},
+		{Name: "csilv", Size: RestSize, Minimum: "5GiB"},
+	})
+	assert.ErrorContains(t, minimumErr, "csilv")
+}
+
+func TestVolumeLayoutValidate(t *testing.T) {
+	assert.NoError(t, DefaultVolumeLayout().Validate())
+	assert.Error(t, VolumeLayout{}.Validate())
+	assert.Error(t, VolumeLayout{{Name: "a", Size: RestSize}, {Name: "b", Size: RestSize}}.Validate())
+	assert.Error(t, VolumeLayout{{Name: "a", Size: "60%"}, {Name: "b", Size: "50%"}}.Validate())
+	assert.Error(t, VolumeLayout{{Name: "a", Size: "10GB"}}.Validate())
+	assert.Error(t, VolumeLayout{{Name: "a", Size: "1GiB"}, {Name: "a", Size: "1GiB"}}.Validate())
+	assert.Error(t, VolumeLayout{{Name: "a", Size: "1GiB", Minimum: "lots"}}.Validate())
+}
+
+const emptyTable = `{"disk": {"path": "/dev/sda", "size": "30436MiB", "label": "unknown", "partitions": []}}`
+
+func TestCreateTable(t *testing.T) {
+	cases := []struct {
+		table    TableType
+		expected []string
+	}{
+		{
+			table: TableMSDOS,
+			expected: []string{
+				"parted -j /dev/sda unit MiB print",
+				"parted -s /dev/sda mktable msdos",
+				"parted -s /dev/sda mkpart primary fat32 2048s 257MiB",
+				"parted -s /dev/sda mkpart primary ext4 257MiB 100%",
+				"parted -s /dev/sda set 2 lvm on",
+			},
+		},
+		{
+			table: TableGPT,
+			expected: []string{
+				"parted -j /dev/sda unit MiB print",
+				"parted -s /dev/sda mktable gpt",
+				"parted -s /dev/sda mkpart system-boot fat32 2048s 257MiB",
+				"parted -s /dev/sda mkpart system-root ext4 257MiB 100%",
+				"parted -s /dev/sda set 1 esp on",
+				"parted -s /dev/sda set 1 boot on",
+				"parted -s /dev/sda set 2 lvm on",
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(string(tt.table), func(t *testing.T) {
+			runner := &utility.FakeRunner{Outputs: map[string][]byte{"parted -j /dev/sda unit MiB print": []byte(emptyTable)}}
+			assert.NoError(t, CreateTable(context.Background(), runner, "/dev/sda", tt.table))
+			assert.Equal(t, tt.expected, runner.Commands)
+		})
 	}
-	expected := SlicedVolumeGroup{
-		RootVolumeSize: 10737418240,
-		CSIVolumeSize:  20120076288,
+}
+
+func TestCreateTableRefusesExistingPartitions(t *testing.T) {
+	existing := `{"disk": {"path": "/dev/sda", "label": "gpt", "partitions": [{"number": 1, "start": "1.00MiB", "end": "257MiB", "size": "256MiB", "type": "primary"}]}}`
+	runner := &utility.FakeRunner{Outputs: map[string][]byte{"parted -j /dev/sda unit MiB print": []byte(existing)}}
+	assert.Error(t, CreateTable(context.Background(), runner, "/dev/sda", TableGPT))
+	assert.Equal(t, []string{"parted -j /dev/sda unit MiB print"}, runner.Commands)
+
+	assert.Error(t, CreateTable(context.Background(), &utility.FakeRunner{}, "/dev/sda", "apm"))
+}
+
+func TestWipeDevice(t *testing.T) {
+	table := PrintOutput{}
+	table.Disk.Partitions = []PartitionEntry{
+		{Number: 1, Size: "256MiB", Filesystem: "fat32", Start: "1.00MiB", End: "257MiB"},
+		{Number: 2, Size: "30179MiB", Flags: []string{"lvm"}, Start: "257MiB", End: "30436MiB"},
 	}
-	rootSize, csiSize, _, err := GetLogicalVolumeSizes(foo)
+	assert.Equal(t, "  1: 256MiB fat32 (1.00MiB - 257MiB)\n  2: 30179MiB unknown filesystem (257MiB - 30436MiB)\n", DescribeTable(table))
+
+	runner := &utility.FakeRunner{}
+	assert.NoError(t, WipeDevice(context.Background(), runner, "/dev/mmcblk0", table))
+	assert.Equal(t, []string{
+		lvmLine("/dev/mmcblk0", "vgs", "rootvg"),
+		lvmLine("/dev/mmcblk0", "vgchange", "-an", "rootvg"),
+		lvmLine("/dev/mmcblk0", "vgremove", "-f", "rootvg"),
+		"wipefs -a /dev/mmcblk0p1",
+		lvmLine("/dev/mmcblk0", "pvremove", "-ff", "-y", "/dev/mmcblk0p2"),
+		"wipefs -a /dev/mmcblk0p2",
+		"wipefs -a /dev/mmcblk0",
+	}, runner.Commands)
+
+	missingVolumeGroup := &utility.FakeRunner{Errors: map[string]error{lvmLine("/dev/sda", "vgs", "rootvg"): assert.AnError}}
+	assert.NoError(t, WipeDevice(context.Background(), missingVolumeGroup, "/dev/sda", PrintOutput{}))
+	assert.Equal(t, []string{lvmLine("/dev/sda", "vgs", "rootvg"), "wipefs -a /dev/sda"}, missingVolumeGroup.Commands)
+}
+
+func TestEncryptVolumes(t *testing.T) {
+	layout := DefaultVolumeLayout()
+	layout[1].Encrypted = true
+	fs := afero.NewMemMapFs()
+	runner := &utility.FakeRunner{}
+
+	assert.NoError(t, EncryptVolumes(context.Background(), runner, fs, layout, "/keys"))
+	assert.Equal(t, []string{
+		"cryptsetup luksFormat --type luks2 --batch-mode --key-file /keys/csilv_crypt.key /dev/mapper/rootvg-csilv",
+		"cryptsetup open --key-file /keys/csilv_crypt.key /dev/mapper/rootvg-csilv csilv_crypt",
+	}, runner.Commands)
+
+	key, err := afero.ReadFile(fs, "/keys/csilv_crypt.key")
 	assert.NoError(t, err)
-	assert.Equal(t, expected.RootVolumeSize, rootSize)
-	assert.Equal(t, expected.CSIVolumeSize, csiSize)
+	assert.Len(t, key, keyFileLen)
+
+	assert.NoError(t, CreateFileSystems(context.Background(), runner, "/dev/sda", layout))
+	assert.Contains(t, runner.Commands, "mkfs.ext4 -F -L csilv /dev/mapper/csilv_crypt")
+	assert.Contains(t, runner.Commands, "mkfs.ext4 -F -L containerdlv /dev/mapper/rootvg-containerdlv")
+
+	assert.NoError(t, InstallKeys(fs, layout, "/keys", "/media-mnt"))
+	installed, installedErr := afero.ReadFile(fs, "/media-mnt/etc/cryptsetup-keys.d/csilv_crypt.key")
+	assert.NoError(t, installedErr)
+	assert.Equal(t, key, installed)
+	hostKeys, hostErr := afero.DirExists(fs, "/keys")
+	assert.NoError(t, hostErr)
+	assert.False(t, hostKeys)
+}
+
+func TestEncryptVolumesDefaultIsNoop(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	runner := &utility.FakeRunner{}
+	assert.NoError(t, EncryptVolumes(context.Background(), runner, fs, DefaultVolumeLayout(), "/keys"))
+	assert.Empty(t, runner.Commands)
+
+	rootEncrypted := DefaultVolumeLayout()
+	rootEncrypted[0].Encrypted = true
+	assert.Error(t, rootEncrypted.Validate())
+}
+
+func TestCreateFileSystemsPerVolume(t *testing.T) {
+	layout := VolumeLayout{
+		{Name: "rootlv", Size: "10GiB", FSType: "f2fs"},
+		{Name: "csilv", Size: RestSize},
+		{Name: "containerdlv", Size: "30GiB", FSType: "xfs"},
+		{Name: "snapshotslv", Size: "10GiB", FSType: "btrfs"},
+	}
+	runner := &utility.FakeRunner{}
+	assert.NoError(t, CreateFileSystems(context.Background(), runner, "/dev/nvme0n1", layout))
+	assert.Equal(t, []string{
+		"mkfs.vfat -F 32 -n system-boot /dev/nvme0n1p1",
+		"mkfs.f2fs -f -l rootlv /dev/mapper/rootvg-rootlv",
+		"mkfs.ext4 -F -L csilv /dev/mapper/rootvg-csilv",
+		"mkfs.xfs -f -L containerdlv /dev/mapper/rootvg-containerdlv",
+		"mkfs.btrfs -f -L snapshotslv /dev/mapper/rootvg-snapshotslv",
+	}, runner.Commands)
+
+	assert.Error(t, VolumeLayout{{Name: "rootlv", Size: "10GiB", FSType: "zfs"}}.Validate())
+}
+
+func TestPartitionImage(t *testing.T) {
+	runner := &utility.FakeRunner{}
+	assert.NoError(t, PartitionImage(context.Background(), runner, "/dev/loop3"))
+	assert.Equal(t, []string{
+		"parted -s /dev/loop3 mktable msdos",
+		"parted -s /dev/loop3 mkpart primary fat32 2048s 257MiB",
+		"parted -s /dev/loop3 mkpart primary ext4 257MiB 100%",
+		"mkfs.vfat -F 32 -n system-boot /dev/loop3p1",
+		"mkfs.ext4 -F -L writable /dev/loop3p2",
+	}, runner.Commands)
+}
+
+func TestCheckFilesystemTools(t *testing.T) {
+	defer func() { lookPath = exec.LookPath }()
+	lookPath = func(file string) (string, error) {
+		if file == "mkfs.xfs" {
+			return "", exec.ErrNotFound
+		}
+		return "/usr/sbin/" + file, nil
+	}
+
+	assert.NoError(t, CheckFilesystemTools(DefaultVolumeLayout()))
+	withXFS := DefaultVolumeLayout()
+	withXFS[2].FSType = "xfs"
+	assert.ErrorContains(t, CheckFilesystemTools(withXFS), "mkfs.xfs")
+}
+
+// lvmLine is how a FakeRunner records an LVMCommand.
+func lvmLine(device string, tool string, args ...string) string {
+	return strings.Join(LVMCommand(device, tool, args...).Args, " ")
+}
+
+func TestLVMCommand(t *testing.T) {
+	command := LVMCommand("/dev/mmcblk0", "vgs", "rootvg")
+	assert.Equal(t, []string{"vgs", "--config", `devices { filter = [ "a|^/dev/mmcblk0p?[0-9]+$|", "r|.*|" ] }`, "rootvg"}, command.Args)
 }
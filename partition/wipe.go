@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package partition
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/LadySerena/pi-image-builder/utility"
+)
+
+// DescribeTable summarizes existing partitions for the confirmation prompt.
+func DescribeTable(table PrintOutput) string {
+	var builder strings.Builder
+	for _, partition := range table.Disk.Partitions {
+		filesystem := partition.Filesystem
+		if filesystem == "" {
+			filesystem = "unknown filesystem"
+		}
+		builder.WriteString(fmt.Sprintf("  %d: %s %s (%s - %s)\n", partition.Number, partition.Size, filesystem, partition.Start, partition.End))
+	}
+	return builder.String()
+}
+
+// WipeDevice tears down the image volume group and clears every signature on device so CreateTable can run again.
+// It's destructive, callers must confirm with the user first.
+func WipeDevice(ctx context.Context, runner utility.Runner, device string, table PrintOutput) error {
+
+	// a missing volume group is fine, the card may never have been flashed by us
+	if err := runner.Run(ctx, LVMCommand(device, "vgs", utility.VolumeGroupName)); err == nil {
+		if err := runner.Run(ctx, LVMCommand(device, "vgchange", "-an", utility.VolumeGroupName)); err != nil {
+			return err
+		}
+		if err := runner.Run(ctx, LVMCommand(device, "vgremove", "-f", utility.VolumeGroupName)); err != nil {
+			return err
+		}
+	}
+
+	for _, partition := range table.Disk.Partitions {
+		partitionName := utility.PartitionName(device, partition.Number)
+		if hasFlag(partition, "lvm") {
+			if err := runner.Run(ctx, LVMCommand(device, "pvremove", "-ff", "-y", partitionName)); err != nil {
+				return err
+			}
+		}
+		if err := runner.Run(ctx, exec.Command("wipefs", "-a", partitionName)); err != nil { //nolint:gosec
+			return err
+		}
+	}
+
+	return runner.Run(ctx, exec.Command("wipefs", "-a", device)) //nolint:gosec
+}
+
+func hasFlag(partition PartitionEntry, flag string) bool {
+	for _, existing := range partition.Flags {
+		if existing == flag {
+			return true
+		}
+	}
+	return false
+}
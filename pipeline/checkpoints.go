@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// StateFile is where checkpoints are kept between builds.
+const StateFile = ".pi-image-builder-state.json"
+
+// buildProgress is what the state file keeps for one base image.
+type buildProgress struct {
+	Completed []string  `json:"completed"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Checkpoints persist which steps completed for a base image so a failed build can pick up where it stopped. The
+// key usually isn't known until the base image is downloaded, so it's resolved lazily and steps finished before then
+// are recorded with the first step after.
+type Checkpoints struct {
+	fs        afero.Fs
+	path      string
+	key       func() (string, error)
+	completed []string
+}
+
+func readState(fs afero.Fs, path string) (map[string]buildProgress, error) {
+	state := make(map[string]buildProgress)
+	data, readErr := afero.ReadFile(fs, path)
+	if errors.Is(readErr, afero.ErrFileNotFound) {
+		return state, nil
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// OpenCheckpoints tracks progress in the state file at path. With resume the steps a previous build completed for
+// the same key are loaded, without it the build starts over and its progress replaces theirs.
+func OpenCheckpoints(fs afero.Fs, path string, key func() (string, error), resume bool) (*Checkpoints, error) {
+	checkpoints := &Checkpoints{fs: fs, path: path, key: key}
+	if !resume {
+		return checkpoints, nil
+	}
+
+	// nothing to resume if the key can't be worked out yet
+	resolved, keyErr := key()
+	if keyErr != nil {
+		return checkpoints, nil
+	}
+	state, readErr := readState(fs, path)
+	if readErr != nil {
+		return nil, readErr
+	}
+	checkpoints.completed = append(checkpoints.completed, state[resolved].Completed...)
+	return checkpoints, nil
+}
+
+// Completed returns the steps finished so far.
+func (c *Checkpoints) Completed() map[string]bool {
+	completed := make(map[string]bool, len(c.completed))
+	for _, step := range c.completed {
+		completed[step] = true
+	}
+	return completed
+}
+
+// Record marks step as finished and saves the state file once the key can be resolved.
+func (c *Checkpoints) Record(step string) error {
+	if !c.Completed()[step] {
+		c.completed = append(c.completed, step)
+	}
+	resolved, keyErr := c.key()
+	if keyErr != nil {
+		return nil
+	}
+	return c.update(func(state map[string]buildProgress) {
+		state[resolved] = buildProgress{Completed: c.completed, UpdatedAt: time.Now().UTC()}
+	})
+}
+
+// Clear forgets the build once it's finished so the next one starts fresh.
+func (c *Checkpoints) Clear() error {
+	c.completed = nil
+	resolved, keyErr := c.key()
+	if keyErr != nil {
+		return nil
+	}
+	return c.update(func(state map[string]buildProgress) {
+		delete(state, resolved)
+	})
+}
+
+func (c *Checkpoints) update(change func(state map[string]buildProgress)) error {
+	state, readErr := readState(c.fs, c.path)
+	if readErr != nil {
+		return readErr
+	}
+	change(state)
+	data, marshalErr := json.MarshalIndent(state, "", "  ")
+	if marshalErr != nil {
+		return marshalErr
+	}
+	return afero.WriteFile(c.fs, c.path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/manifest"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func fixedKey(key string) func() (string, error) {
+	return func() (string, error) {
+		return key, nil
+	}
+}
+
+func TestCheckpointsResume(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	first, err := OpenCheckpoints(fs, StateFile, fixedKey("abc"), false)
+	assert.NoError(t, err)
+	assert.NoError(t, first.Record("download"))
+	assert.NoError(t, first.Record("extract"))
+
+	other, err := OpenCheckpoints(fs, StateFile, fixedKey("def"), false)
+	assert.NoError(t, err)
+	assert.NoError(t, other.Record("download"))
+
+	resumed, err := OpenCheckpoints(fs, StateFile, fixedKey("abc"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"download": true, "extract": true}, resumed.Completed())
+
+	fresh, err := OpenCheckpoints(fs, StateFile, fixedKey("abc"), false)
+	assert.NoError(t, err)
+	assert.Empty(t, fresh.Completed())
+	assert.NoError(t, fresh.Record("download"))
+
+	resumed, err = OpenCheckpoints(fs, StateFile, fixedKey("abc"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"download": true}, resumed.Completed(), "a fresh build replaces the old progress")
+
+	assert.NoError(t, resumed.Clear())
+	resumed, err = OpenCheckpoints(fs, StateFile, fixedKey("abc"), true)
+	assert.NoError(t, err)
+	assert.Empty(t, resumed.Completed())
+
+	untouched, err := OpenCheckpoints(fs, StateFile, fixedKey("def"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"download": true}, untouched.Completed())
+}
+
+func TestCheckpointsWaitForKey(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	known := false
+	key := func() (string, error) {
+		if !known {
+			return "", errors.New("base image not downloaded yet")
+		}
+		return "abc", nil
+	}
+
+	checkpoints, err := OpenCheckpoints(fs, StateFile, key, true)
+	assert.NoError(t, err)
+	assert.NoError(t, checkpoints.Record("download"))
+	exists, _ := afero.Exists(fs, StateFile)
+	assert.False(t, exists)
+
+	known = true
+	assert.NoError(t, checkpoints.Record("extract"))
+	resumed, err := OpenCheckpoints(fs, StateFile, key, true)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"download": true, "extract": true}, resumed.Completed())
+}
+
+func TestRunResumesFromCheckpoints(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	failing := true
+	var ran []string
+	steps := recordingSteps(&ran, "download", "kernel")
+	steps = append(steps, Func{StepName: "packages", Fn: func(ctx context.Context, _ *BuildState) error {
+		ran = append(ran, "packages")
+		if failing {
+			return errors.New("mirror down")
+		}
+		return nil
+	}})
+
+	checkpoints, err := OpenCheckpoints(fs, StateFile, fixedKey("abc"), false)
+	assert.NoError(t, err)
+	assert.Error(t, Run(context.Background(), steps, Selection{}, &BuildState{Manifest: manifest.New(), Checkpoints: checkpoints}))
+	assert.Equal(t, []string{"download", "kernel", "packages"}, ran)
+
+	failing = false
+	ran = nil
+	resumed, err := OpenCheckpoints(fs, StateFile, fixedKey("abc"), true)
+	assert.NoError(t, err)
+	assert.NoError(t, Run(context.Background(), steps, Selection{Completed: resumed.Completed()},
+		&BuildState{Manifest: manifest.New(), Checkpoints: resumed}))
+	assert.Equal(t, []string{"packages"}, ran)
+}
@@ -0,0 +1,372 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/LadySerena/pi-image-builder/manifest"
+	"github.com/LadySerena/pi-image-builder/report"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	flag "github.com/spf13/pflag"
+)
+
+// Step is one named phase of a build.
+type Step interface {
+	Name() string
+	Run(ctx context.Context, state *BuildState) error
+}
+
+// cacheable is implemented by steps covered by the layer cache, they don't run when a layer was restored.
+type cacheable interface {
+	IsCacheable() bool
+}
+
+// hostStep is implemented by steps that set up state outside the image file, like loop devices and mounts. A failed
+// build tears that state down, so these run again on resume even when they completed.
+type hostStep interface {
+	IsHost() bool
+}
+
+// chrootStep is implemented by steps that run commands inside the image, like apt and systemctl, rather than only
+// writing files into it. Steps that set up running commands in the image only run when one of these does.
+type chrootStep interface {
+	NeedsChroot() bool
+	IsChrootSetup() bool
+}
+
+func isCacheable(step Step) bool {
+	typed, ok := step.(cacheable)
+	return ok && typed.IsCacheable()
+}
+
+func isHost(step Step) bool {
+	typed, ok := step.(hostStep)
+	return ok && typed.IsHost()
+}
+
+func needsChroot(step Step) bool {
+	typed, ok := step.(chrootStep)
+	return ok && typed.NeedsChroot()
+}
+
+func isChrootSetup(step Step) bool {
+	typed, ok := step.(chrootStep)
+	return ok && typed.IsChrootSetup()
+}
+
+// NeedsChroot reports whether any of steps runs commands inside the image.
+func NeedsChroot(steps []Step) bool {
+	for _, step := range steps {
+		if needsChroot(step) {
+			return true
+		}
+	}
+	return false
+}
+
+// LastCacheable is the index of the last of steps the layer cache covers, -1 when it covers none.
+func LastCacheable(steps []Step) int {
+	last := -1
+	for i, step := range steps {
+		if isCacheable(step) {
+			last = i
+		}
+	}
+	return last
+}
+
+// Func adapts a function to Step, the step registries are lists of these.
+type Func struct {
+	StepName  string
+	Cacheable bool
+	Host      bool
+	// Chroot is set on steps that run commands inside the image, the rest only write files into it.
+	Chroot bool
+	// ChrootSetup is set on steps that prepare the host to run the image's binaries, they're skipped when no step
+	// that runs needs the chroot.
+	ChrootSetup bool
+	Fn          func(ctx context.Context, state *BuildState) error
+}
+
+func (f Func) Name() string {
+	return f.StepName
+}
+
+func (f Func) Run(ctx context.Context, state *BuildState) error {
+	return f.Fn(ctx, state)
+}
+
+func (f Func) IsCacheable() bool {
+	return f.Cacheable
+}
+
+func (f Func) IsHost() bool {
+	return f.Host
+}
+
+func (f Func) NeedsChroot() bool {
+	return f.Chroot
+}
+
+func (f Func) IsChrootSetup() bool {
+	return f.ChrootSetup
+}
+
+// BuildState is shared by every step of a build.
+type BuildState struct {
+	Manifest *manifest.Manifest
+	// RestoredLayer is the layer cache key restored into the image, set by the step that restores it.
+	RestoredLayer string
+	// Checkpoints records completed steps so the build can resume, nil when progress isn't persisted.
+	Checkpoints *Checkpoints
+	// Report times every step that runs, nil when nothing is reported.
+	Report *report.Report
+}
+
+// Selection narrows which steps execute. Skip is applied after From/Until and always wins.
+type Selection struct {
+	From  string
+	Until string
+	Skip  map[string]bool
+	// Completed are steps a previous run of this build finished, they're skipped when resuming.
+	Completed map[string]bool
+}
+
+// Full reports whether every step will run, only then is it safe to snapshot the result into the layer cache.
+func (s Selection) Full() bool {
+	return s.From == "" && s.Until == "" && len(s.Skip) == 0
+}
+
+type Decision struct {
+	Step   string
+	Run    bool
+	Forced bool
+	Reason string
+}
+
+// SkipFlags registers a --skip-<name> flag for every step so new steps get one for free.
+func SkipFlags(flagSet *flag.FlagSet, steps []Step) map[string]*bool {
+	skips := make(map[string]*bool, len(steps))
+	for _, step := range steps {
+		skips[step.Name()] = flagSet.Bool(fmt.Sprintf("skip-%s", step.Name()), false,
+			fmt.Sprintf("force skip the %s step, the image may be partially configured", step.Name()))
+	}
+	return skips
+}
+
+// SkipSet flattens the parsed flags from SkipFlags.
+func SkipSet(flags map[string]*bool) map[string]bool {
+	skip := make(map[string]bool)
+	for name, value := range flags {
+		if *value {
+			skip[name] = true
+		}
+	}
+	return skip
+}
+
+func indexOf(steps []Step, name string) (int, error) {
+	for index, step := range steps {
+		if step.Name() == name {
+			return index, nil
+		}
+	}
+	return -1, fmt.Errorf("unknown step: %s", name)
+}
+
+// Without drops the named steps and keeps the rest in order. Naming a step that isn't there is an error, so a typo
+// in a profile doesn't quietly build the wrong image.
+func Without(steps []Step, names map[string]bool) ([]Step, error) {
+	for name := range names {
+		if _, err := indexOf(steps, name); err != nil {
+			return nil, err
+		}
+	}
+	kept := make([]Step, 0, len(steps))
+	for _, step := range steps {
+		if !names[step.Name()] {
+			kept = append(kept, step)
+		}
+	}
+	return kept, nil
+}
+
+// Only keeps the named steps in registry order, whatever order they're named in. Naming no steps or a step that isn't
+// there is an error, so nothing runs that wasn't asked for by name.
+func Only(steps []Step, names []string) ([]Step, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no steps were named")
+	}
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		if _, err := indexOf(steps, name); err != nil {
+			return nil, err
+		}
+		wanted[name] = true
+	}
+	kept := make([]Step, 0, len(wanted))
+	for _, step := range steps {
+		if wanted[step.Name()] {
+			kept = append(kept, step)
+		}
+	}
+	return kept, nil
+}
+
+// Decide works out which steps run. Host steps are only skipped by their --skip flag, every step after them needs
+// the image attached. Chroot setup steps are skipped as well when none of the steps that run need the chroot.
+func (s Selection) Decide(steps []Step) ([]Decision, error) {
+	from := 0
+	until := len(steps) - 1
+	if s.From != "" {
+		index, err := indexOf(steps, s.From)
+		if err != nil {
+			return nil, err
+		}
+		from = index
+	}
+	if s.Until != "" {
+		index, err := indexOf(steps, s.Until)
+		if err != nil {
+			return nil, err
+		}
+		until = index
+	}
+	if from > until {
+		return nil, fmt.Errorf("step %s comes after %s", s.From, s.Until)
+	}
+	for name := range s.Skip {
+		if _, err := indexOf(steps, name); err != nil {
+			return nil, err
+		}
+	}
+
+	decisions := make([]Decision, 0, len(steps))
+	for index, step := range steps {
+		name := step.Name()
+		decision := Decision{Step: name, Run: true}
+		switch {
+		case s.Skip[name]:
+			decision.Run = false
+			decision.Forced = true
+			decision.Reason = fmt.Sprintf("--skip-%s", name)
+		case isHost(step):
+			if s.Completed[name] {
+				decision.Reason = "re-attaching after resume"
+			}
+		case index < from:
+			decision.Run = false
+			decision.Reason = fmt.Sprintf("before --from-step %s", s.From)
+		case index > until:
+			decision.Run = false
+			decision.Reason = fmt.Sprintf("after --until-step %s", s.Until)
+		case s.Completed[name]:
+			decision.Run = false
+			decision.Reason = "completed by a previous run"
+		}
+		decisions = append(decisions, decision)
+	}
+
+	chroot := false
+	for index, step := range steps {
+		chroot = chroot || (decisions[index].Run && needsChroot(step))
+	}
+	if !chroot {
+		for index, step := range steps {
+			if decisions[index].Run && isChrootSetup(step) {
+				decisions[index].Run = false
+				decisions[index].Reason = "no step that runs needs the chroot"
+			}
+		}
+	}
+	return decisions, nil
+}
+
+// Run executes steps according to selection, records every outcome in the manifest, and checkpoints each step that
+// finished.
+func Run(ctx context.Context, steps []Step, selection Selection, state *BuildState) error {
+	decisions, decideErr := selection.Decide(steps)
+	if decideErr != nil {
+		return decideErr
+	}
+
+	total := 0
+	for _, decision := range decisions {
+		if decision.Run {
+			total++
+		}
+	}
+
+	position := 0
+	for index, step := range steps {
+		decision := decisions[index]
+		name := step.Name()
+		// steps log through the context so everything they do is tagged with the step name
+		logger := telemetry.Logger(ctx).With("step", name)
+		if !decision.Run {
+			if decision.Forced {
+				logger.Warn("force skipping step, the image may be partially configured")
+				state.Manifest.RecordStep(name, manifest.StatusForcedSkip, decision.Reason)
+			} else {
+				state.Manifest.RecordStep(name, manifest.StatusSkipped, decision.Reason)
+			}
+			continue
+		}
+		position++
+
+		// the layer is restored by an earlier step, so this can't be decided up front
+		if isCacheable(step) && state.RestoredLayer != "" {
+			reason := fmt.Sprintf("restored from layer cache %s", state.RestoredLayer)
+			logger.Info(fmt.Sprintf("skipping step %d of %d", position, total), "reason", reason)
+			state.Manifest.RecordStep(name, manifest.StatusSkipped, reason)
+			// the restored layer is in the image now, a resumed build mustn't run these either
+			if err := state.checkpoint(name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		logger.Info(fmt.Sprintf("running step %d of %d", position, total))
+		if err := state.Report.Time(name, func() error {
+			return telemetry.Timed(telemetry.WithLogger(ctx, logger), name, func(ctx context.Context) error {
+				return step.Run(ctx, state)
+			})
+		}); err != nil {
+			state.Manifest.RecordStep(name, manifest.StatusFailed, err.Error())
+			return fmt.Errorf("step %s failed: %w", name, err)
+		}
+		state.Manifest.RecordStep(name, manifest.StatusCompleted, decision.Reason)
+		if err := state.checkpoint(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *BuildState) checkpoint(step string) error {
+	if b.Checkpoints == nil {
+		return nil
+	}
+	if err := b.Checkpoints.Record(step); err != nil {
+		return fmt.Errorf("could not checkpoint step %s: %w", step, err)
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/manifest"
+	"github.com/LadySerena/pi-image-builder/report"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	flag "github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+)
+
+func recordingSteps(ran *[]string, names ...string) []Step {
+	steps := make([]Step, 0, len(names))
+	for _, name := range names {
+		stepName := name
+		steps = append(steps, Func{StepName: stepName, Fn: func(ctx context.Context, _ *BuildState) error {
+			*ran = append(*ran, stepName)
+			return nil
+		}})
+	}
+	return steps
+}
+
+func TestSkipOverridesRange(t *testing.T) {
+	cases := []struct {
+		selection Selection
+		expected  []string
+	}{
+		{
+			selection: Selection{},
+			expected:  []string{"kernel", "packages", "kubernetes", "cloudinit", "fstab"},
+		},
+		{
+			selection: Selection{Skip: map[string]bool{"packages": true}},
+			expected:  []string{"kernel", "kubernetes", "cloudinit", "fstab"},
+		},
+		{
+			selection: Selection{From: "packages", Until: "cloudinit"},
+			expected:  []string{"packages", "kubernetes", "cloudinit"},
+		},
+		{
+			selection: Selection{From: "packages", Until: "cloudinit", Skip: map[string]bool{"packages": true, "kubernetes": true}},
+			expected:  []string{"cloudinit"},
+		},
+	}
+	for index, tt := range cases {
+		var ran []string
+		steps := recordingSteps(&ran, "kernel", "packages", "kubernetes", "cloudinit", "fstab")
+		err := Run(context.Background(), steps, tt.selection, &BuildState{Manifest: manifest.New()})
+		assert.NoError(t, err, "case %d", index)
+		assert.Equal(t, tt.expected, ran, "case %d", index)
+	}
+}
+
+func TestDecideForcedOnlyForSkipFlags(t *testing.T) {
+	var ran []string
+	steps := recordingSteps(&ran, "kernel", "packages", "fstab")
+	decisions, err := Selection{From: "packages", Skip: map[string]bool{"fstab": true}}.Decide(steps)
+	assert.NoError(t, err)
+	assert.Equal(t, []Decision{
+		{Step: "kernel", Run: false, Forced: false, Reason: "before --from-step packages"},
+		{Step: "packages", Run: true},
+		{Step: "fstab", Run: false, Forced: true, Reason: "--skip-fstab"},
+	}, decisions)
+}
+
+func TestDecideRejectsUnknownSteps(t *testing.T) {
+	var ran []string
+	steps := recordingSteps(&ran, "kernel", "packages")
+	_, fromErr := Selection{From: "nope"}.Decide(steps)
+	assert.Error(t, fromErr)
+	_, skipErr := Selection{Skip: map[string]bool{"nope": true}}.Decide(steps)
+	assert.Error(t, skipErr)
+	_, orderErr := Selection{From: "packages", Until: "kernel"}.Decide(steps)
+	assert.Error(t, orderErr)
+}
+
+func TestWithout(t *testing.T) {
+	var ran []string
+	steps := recordingSteps(&ran, "kernel", "packages", "kubernetes", "cloudinit")
+
+	kept, err := Without(steps, map[string]bool{"kubernetes": true, "kernel": true})
+	assert.NoError(t, err)
+	names := make([]string, 0, len(kept))
+	for _, step := range kept {
+		names = append(names, step.Name())
+	}
+	assert.Equal(t, []string{"packages", "cloudinit"}, names)
+
+	_, unknownErr := Without(steps, map[string]bool{"kubernets": true})
+	assert.ErrorContains(t, unknownErr, "unknown step: kubernets")
+}
+
+func TestOnly(t *testing.T) {
+	var ran []string
+	steps := recordingSteps(&ran, "kernel", "modules", "packages", "kubernetes")
+
+	kept, err := Only(steps, []string{"kubernetes", "modules", "kubernetes"})
+	assert.NoError(t, err)
+	assert.NoError(t, Run(context.Background(), kept, Selection{}, &BuildState{Manifest: manifest.New()}))
+	assert.Equal(t, []string{"modules", "kubernetes"}, ran)
+
+	_, unknownErr := Only(steps, []string{"kubernets"})
+	assert.ErrorContains(t, unknownErr, "unknown step: kubernets")
+	_, emptyErr := Only(steps, nil)
+	assert.Error(t, emptyErr)
+}
+
+func TestRestoredLayerSkipsCacheableSteps(t *testing.T) {
+	var ran []string
+	steps := recordingSteps(&ran, "kernel", "packages", "kubernetes", "fstab")
+	steps[0] = Func{StepName: "kernel", Fn: func(ctx context.Context, state *BuildState) error {
+		ran = append(ran, "kernel")
+		state.RestoredLayer = "abc"
+		return nil
+	}}
+	for _, index := range []int{1, 2} {
+		cached := steps[index].(Func)
+		cached.Cacheable = true
+		steps[index] = cached
+	}
+	selection := Selection{Skip: map[string]bool{"fstab": true}}
+	assert.False(t, selection.Full())
+	state := &BuildState{Manifest: manifest.New()}
+	assert.NoError(t, Run(context.Background(), steps, selection, state))
+	assert.Equal(t, []string{"kernel"}, ran)
+	assert.Equal(t, manifest.StatusSkipped, state.Manifest.Steps[1].Status)
+	assert.Equal(t, "restored from layer cache abc", state.Manifest.Steps[1].Reason)
+	assert.Equal(t, manifest.StatusForcedSkip, state.Manifest.Steps[3].Status)
+}
+
+func TestManifestNotation(t *testing.T) {
+	var ran []string
+	steps := recordingSteps(&ran, "kernel", "packages", "fstab")
+	buildManifest := manifest.New()
+	err := Run(context.Background(), steps, Selection{Until: "packages", Skip: map[string]bool{"kernel": true}}, &BuildState{Manifest: buildManifest})
+	assert.NoError(t, err)
+	assert.True(t, buildManifest.PartiallyConfigured)
+	assert.Equal(t, []manifest.StepRecord{
+		{Name: "kernel", Status: manifest.StatusForcedSkip, Reason: "--skip-kernel"},
+		{Name: "packages", Status: manifest.StatusCompleted},
+		{Name: "fstab", Status: manifest.StatusSkipped, Reason: "after --until-step packages"},
+	}, buildManifest.Steps)
+	assert.Len(t, buildManifest.Warnings, 1)
+	assert.Contains(t, buildManifest.Warnings[0], "kernel")
+}
+
+func TestRunStopsOnFailure(t *testing.T) {
+	ran := false
+	steps := []Step{
+		Func{StepName: "broken", Fn: func(ctx context.Context, _ *BuildState) error { return errors.New("boom") }},
+		Func{StepName: "after", Fn: func(ctx context.Context, _ *BuildState) error { ran = true; return nil }},
+	}
+	buildManifest := manifest.New()
+	err := Run(context.Background(), steps, Selection{}, &BuildState{Manifest: buildManifest})
+	assert.Error(t, err)
+	assert.False(t, ran)
+	assert.Equal(t, manifest.StatusFailed, buildManifest.Steps[0].Status)
+	assert.False(t, buildManifest.PartiallyConfigured)
+}
+
+func TestRunReportsSteps(t *testing.T) {
+	steps := []Step{
+		Func{StepName: "download", Fn: func(ctx context.Context, _ *BuildState) error { return nil }},
+		Func{StepName: "kernel", Fn: func(ctx context.Context, _ *BuildState) error { return nil }},
+		Func{StepName: "packages", Fn: func(ctx context.Context, _ *BuildState) error { return errors.New("boom") }},
+	}
+	buildReport := report.New("default")
+	err := Run(context.Background(), steps, Selection{Skip: map[string]bool{"kernel": true}}, &BuildState{Manifest: manifest.New(), Report: buildReport})
+	assert.Error(t, err)
+
+	// skipped steps didn't take any time, so only the ones that ran are reported
+	assert.Len(t, buildReport.Phases, 2)
+	assert.Equal(t, "download", buildReport.Phases[0].Name)
+	assert.Equal(t, manifest.StatusCompleted, buildReport.Phases[0].Status)
+	assert.Equal(t, "packages", buildReport.Phases[1].Name)
+	assert.Equal(t, manifest.StatusFailed, buildReport.Phases[1].Status)
+	assert.Equal(t, "boom", buildReport.Phases[1].Error)
+}
+
+func TestRunTagsStepLogger(t *testing.T) {
+	var output bytes.Buffer
+	logger, err := telemetry.LogOptions{Level: "info", Format: telemetry.LogFormatText}.NewLogger(&output)
+	assert.NoError(t, err)
+	steps := []Step{
+		Func{StepName: "kernel", Fn: func(ctx context.Context, _ *BuildState) error {
+			telemetry.Logger(ctx).Info("inside step")
+			return nil
+		}},
+	}
+
+	assert.NoError(t, Run(telemetry.WithLogger(context.Background(), logger), steps, Selection{}, &BuildState{Manifest: manifest.New()}))
+	assert.Contains(t, output.String(), "msg=\"running step 1 of 1\" step=kernel")
+	assert.Contains(t, output.String(), "msg=\"inside step\" step=kernel")
+}
+
+func TestSkipFlags(t *testing.T) {
+	var ran []string
+	steps := recordingSteps(&ran, "kernel", "cloudinit")
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	skips := SkipFlags(flagSet, steps)
+	assert.NoError(t, flagSet.Parse([]string{"--skip-cloudinit"}))
+	assert.Equal(t, map[string]bool{"cloudinit": true}, SkipSet(skips))
+}
+
+func TestDecideResume(t *testing.T) {
+	var ran []string
+	steps := recordingSteps(&ran, "download", "mount", "kernel", "packages")
+	mount := steps[1].(Func)
+	mount.Host = true
+	steps[1] = mount
+
+	selection := Selection{Completed: map[string]bool{"download": true, "mount": true, "kernel": true}}
+	decisions, err := selection.Decide(steps)
+	assert.NoError(t, err)
+	assert.Equal(t, []Decision{
+		{Step: "download", Run: false, Reason: "completed by a previous run"},
+		{Step: "mount", Run: true, Reason: "re-attaching after resume"},
+		{Step: "kernel", Run: false, Reason: "completed by a previous run"},
+		{Step: "packages", Run: true},
+	}, decisions)
+}
+
+func TestHostStepsIgnoreRange(t *testing.T) {
+	var ran []string
+	steps := recordingSteps(&ran, "download", "mount", "kernel", "packages")
+	mount := steps[1].(Func)
+	mount.Host = true
+	steps[1] = mount
+
+	assert.NoError(t, Run(context.Background(), steps, Selection{From: "packages"}, &BuildState{Manifest: manifest.New()}))
+	assert.Equal(t, []string{"mount", "packages"}, ran)
+
+	ran = nil
+	assert.NoError(t, Run(context.Background(), steps, Selection{From: "packages", Skip: map[string]bool{"mount": true}},
+		&BuildState{Manifest: manifest.New()}))
+	assert.Equal(t, []string{"packages"}, ran)
+}
+
+func TestChrootSetupOnlyWhenNeeded(t *testing.T) {
+	var ran []string
+	steps := recordingSteps(&ran, "mount", "emulation", "kernel", "packages")
+	emulation := steps[1].(Func)
+	emulation.Host, emulation.ChrootSetup = true, true
+	steps[1] = emulation
+	packages := steps[3].(Func)
+	packages.Chroot = true
+	steps[3] = packages
+	assert.True(t, NeedsChroot(steps))
+	assert.False(t, NeedsChroot(steps[:3]))
+
+	assert.NoError(t, Run(context.Background(), steps, Selection{}, &BuildState{Manifest: manifest.New()}))
+	assert.Equal(t, []string{"mount", "emulation", "kernel", "packages"}, ran)
+
+	decisions, err := Selection{Until: "kernel"}.Decide(steps)
+	assert.NoError(t, err)
+	assert.Equal(t, Decision{Step: "emulation", Run: false, Reason: "no step that runs needs the chroot"}, decisions[1])
+
+	ran = nil
+	assert.NoError(t, Run(context.Background(), steps, Selection{Skip: map[string]bool{"packages": true}}, &BuildState{Manifest: manifest.New()}))
+	assert.Equal(t, []string{"mount", "kernel"}, ran)
+}
+
+func TestLastCacheable(t *testing.T) {
+	var ran []string
+	steps := recordingSteps(&ran, "kernel", "packages", "kubernetes", "kubeadm")
+	assert.Equal(t, -1, LastCacheable(steps))
+	for _, i := range []int{1, 2} {
+		step := steps[i].(Func)
+		step.Cacheable = true
+		steps[i] = step
+	}
+	assert.Equal(t, 2, LastCacheable(steps))
+}
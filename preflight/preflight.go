@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package preflight
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/LadySerena/pi-image-builder/config"
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/distro"
+	"github.com/LadySerena/pi-image-builder/media"
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/LadySerena/pi-image-builder/utility"
+	"golang.org/x/sync/errgroup"
+)
+
+// maxConcurrentChecks bounds how many urls are checked at once.
+const maxConcurrentChecks = 8
+
+// URLs are everything a build from source on d downloads from the network.
+func URLs(source media.Source, d distro.Distro, versions configure.KubernetesVersions) []string {
+	urls := append([]string{}, source.URLs()...)
+	for _, artifact := range configure.KubernetesArtifacts(versions) {
+		urls = append(urls, artifact.URL, artifact.ChecksumURL)
+	}
+	return append(urls, d.DockerKeyURL())
+}
+
+// ConfigURLs are everything a build from cfg downloads, URLs plus what optional parts of the config fetch. The
+// kubernetes version must already be resolved.
+func ConfigURLs(cfg config.Config, source media.Source, d distro.Distro) []string {
+	urls := URLs(source, d, cfg.Kubernetes)
+	for _, artifact := range append(configure.HelmArtifacts(cfg.Helm), configure.NodeExporterArtifacts(cfg.NodeExporter)...) {
+		urls = append(urls, artifact.URL, artifact.ChecksumURL)
+	}
+	return append(urls, configure.AuthorizedKeyURLs(cfg.CloudInit.SSHAuthorizedKeys)...)
+}
+
+// Check makes sure every url exists and the kubernetes versions fit together, before hours are spent on media work.
+// Every problem found is returned, not just the first.
+func Check(ctx context.Context, client *http.Client, versions configure.KubernetesVersions, urls []string) error {
+	ctx, span := telemetry.Start(ctx, "preflight")
+	defer span.End()
+
+	var versionErr error
+	if err := versions.Validate(); err != nil {
+		versionErr = err
+	} else if err := versions.Compatible(); err != nil {
+		versionErr = err
+	}
+
+	problems := make([]error, len(urls))
+	group := new(errgroup.Group)
+	group.SetLimit(maxConcurrentChecks)
+	for i, url := range urls {
+		i, url := i, url
+		group.Go(func() error {
+			problems[i] = reachable(ctx, client, url)
+			return nil
+		})
+	}
+	_ = group.Wait()
+
+	return errors.Join(append([]error{versionErr}, problems...)...)
+}
+
+// reachable sends a HEAD request, falling back to a GET that's closed unread for servers that don't allow HEAD.
+func reachable(ctx context.Context, client *http.Client, url string) error {
+	response, err := send(ctx, client, http.MethodHead, url)
+	if err == nil && response.StatusCode == http.StatusMethodNotAllowed {
+		response, err = send(ctx, client, http.MethodGet, url)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", url, err)
+	}
+	// send already closed the body, so this can't go through configure.CheckResponse
+	if response.StatusCode != http.StatusOK {
+		return configure.NewErrStatusCode(response.Request.Method, url, http.StatusOK, response.StatusCode)
+	}
+	return nil
+}
+
+func send(ctx context.Context, client *http.Client, method string, url string) (*http.Response, error) {
+	request, requestErr := http.NewRequestWithContext(ctx, method, url, nil)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	utility.WrappedClose(response.Body)
+	return response, nil
+}
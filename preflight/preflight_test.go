@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package preflight
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/config"
+	"github.com/LadySerena/pi-image-builder/configure"
+	"github.com/LadySerena/pi-image-builder/distro"
+	"github.com/LadySerena/pi-image-builder/media"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/head":
+			assert.Equal(t, http.MethodHead, r.Method)
+		case "/get-only":
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	versions := configure.DefaultKubernetesVersions()
+	assert.NoError(t, Check(context.TODO(), server.Client(), versions, []string{server.URL + "/head", server.URL + "/get-only"}))
+
+	versions.CriCtl = "v1.24.0"
+	err := Check(context.TODO(), server.Client(), versions, []string{server.URL + "/head", server.URL + "/missing", server.URL + "/gone"})
+	assert.ErrorContains(t, err, "crictl v1.24.0 doesn't match kubernetes")
+	assert.ErrorContains(t, err, server.URL+"/missing")
+	assert.ErrorContains(t, err, server.URL+"/gone")
+	assert.NotContains(t, err.Error(), server.URL+"/head:")
+}
+
+func TestURLs(t *testing.T) {
+	urls := URLs(media.VendorImage{Distro: distro.Ubuntu}, distro.Ubuntu, configure.DefaultKubernetesVersions())
+	assert.Contains(t, urls, "https://download.docker.com/linux/ubuntu/gpg")
+	assert.Contains(t, urls, "https://storage.googleapis.com/kubernetes-release/release/v1.25.3/bin/linux/arm64/kubeadm.sha256")
+	assert.Contains(t, urls, "https://github.com/kubernetes-sigs/cri-tools/releases/download/v1.25.0/crictl-v1.25.0-linux-arm64.tar.gz")
+	assert.Contains(t, urls, "https://cdimage.ubuntu.com/releases/20.04/release/SHA256SUMS")
+}
+
+func TestConfigURLs(t *testing.T) {
+	cfg := config.Default()
+	cfg.Helm.Version = "v3.13.2"
+	cfg.CloudInit.SSHAuthorizedKeys = []string{"github:kat", "ssh-ed25519 AAAA literal"}
+	urls := ConfigURLs(cfg, media.VendorImage{Distro: distro.Ubuntu}, distro.Ubuntu)
+	assert.Contains(t, urls, "https://get.helm.sh/helm-v3.13.2-linux-arm64.tar.gz.sha256sum")
+	assert.Contains(t, urls, "https://github.com/kat.keys")
+	assert.Subset(t, urls, URLs(media.VendorImage{Distro: distro.Ubuntu}, distro.Ubuntu, cfg.Kubernetes))
+}
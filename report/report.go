@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package report times the phases of a build for a summary table and a json report CI can archive.
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/manifest"
+	"github.com/spf13/afero"
+)
+
+// DefaultPath is where a build writes its report unless told otherwise.
+const DefaultPath = "build-report.json"
+
+// Phase is one timed part of a build, a pipeline step or a part of publishing.
+type Phase struct {
+	Name            string    `json:"name"`
+	Status          string    `json:"status"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Error           string    `json:"error,omitempty"`
+}
+
+func (p Phase) duration() time.Duration {
+	return p.End.Sub(p.Start)
+}
+
+// Artifact is a published file and its size in bytes.
+type Artifact struct {
+	Name   string `json:"name"`
+	Format string `json:"format"`
+	Size   int64  `json:"size"`
+}
+
+// Report collects a build's phases in the order they ran. Every method is safe to call on a nil report, which records
+// nothing, so callers that don't report don't need to check.
+type Report struct {
+	Profile         string     `json:"profile,omitempty"`
+	Status          string     `json:"status"`
+	Start           time.Time  `json:"start"`
+	End             time.Time  `json:"end"`
+	DurationSeconds float64    `json:"durationSeconds"`
+	Phases          []Phase    `json:"phases"`
+	Artifacts       []Artifact `json:"artifacts,omitempty"`
+	// Error is what stopped a failed build.
+	Error string `json:"error,omitempty"`
+
+	now func() time.Time
+}
+
+func New(profile string) *Report {
+	return newReport(profile, time.Now)
+}
+
+func newReport(profile string, now func() time.Time) *Report {
+	return &Report{Profile: profile, Start: now().UTC(), Phases: make([]Phase, 0), now: now}
+}
+
+// Time runs fn as the phase name and records how long it took and whether it failed.
+func (r *Report) Time(name string, fn func() error) error {
+	if r == nil {
+		return fn()
+	}
+	phase := Phase{Name: name, Status: manifest.StatusCompleted, Start: r.now().UTC()}
+	err := fn()
+	phase.End = r.now().UTC()
+	phase.DurationSeconds = phase.duration().Seconds()
+	if err != nil {
+		phase.Status = manifest.StatusFailed
+		phase.Error = err.Error()
+	}
+	r.Phases = append(r.Phases, phase)
+	return err
+}
+
+func (r *Report) AddArtifact(name string, format string, size int64) {
+	if r == nil {
+		return
+	}
+	r.Artifacts = append(r.Artifacts, Artifact{Name: name, Format: format, Size: size})
+}
+
+// Finish stamps the end of the build, err is what failed it or nil.
+func (r *Report) Finish(err error) {
+	if r == nil {
+		return
+	}
+	r.End = r.now().UTC()
+	r.DurationSeconds = r.End.Sub(r.Start).Seconds()
+	r.Status = manifest.StatusCompleted
+	if err != nil {
+		r.Status = manifest.StatusFailed
+		r.Error = err.Error()
+	}
+}
+
+// WriteSummary prints a table of every phase with its duration, and the total.
+func (r *Report) WriteSummary(w io.Writer) error {
+	if r == nil {
+		return nil
+	}
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "PHASE\tSTATUS\tDURATION")
+	for _, phase := range r.Phases {
+		fmt.Fprintf(table, "%s\t%s\t%s\n", phase.Name, phase.Status, round(phase.duration()))
+	}
+	fmt.Fprintf(table, "total\t%s\t%s\n", r.Status, round(r.End.Sub(r.Start)))
+	return table.Flush()
+}
+
+// round keeps sub second phases readable, everything else is shown to the second.
+func round(duration time.Duration) time.Duration {
+	if duration < time.Second {
+		return duration.Round(time.Millisecond)
+	}
+	return duration.Round(time.Second)
+}
+
+func (r *Report) Write(fs afero.Fs, path string) error {
+	if r == nil {
+		return nil
+	}
+	data, marshalErr := json.MarshalIndent(r, "", "  ")
+	if marshalErr != nil {
+		return marshalErr
+	}
+	return afero.WriteFile(fs, path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock advances by each of steps in turn every time it's read.
+func fakeClock(steps ...time.Duration) func() time.Time {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	index := 0
+	return func() time.Time {
+		if index < len(steps) {
+			now = now.Add(steps[index])
+			index++
+		}
+		return now
+	}
+}
+
+func TestReport(t *testing.T) {
+	r := newReport("default", fakeClock(0, 0, 4*time.Minute+12*time.Second, 0, 18*time.Minute+44*time.Second, 0, 250*time.Millisecond, time.Second))
+	assert.NoError(t, r.Time("download", func() error { return nil }))
+	assert.NoError(t, r.Time("packages", func() error { return nil }))
+	assert.EqualError(t, r.Time("upload", func() error { return errors.New("bucket is gone") }), "bucket is gone")
+	r.AddArtifact("ubuntu-22.04-pi.img.xz", "raw", 1024)
+	r.Finish(errors.New("error uploading raw image: bucket is gone"))
+
+	var summary bytes.Buffer
+	assert.NoError(t, r.WriteSummary(&summary))
+	assert.Equal(t, "PHASE     STATUS     DURATION\n"+
+		"download  completed  4m12s\n"+
+		"packages  completed  18m44s\n"+
+		"upload    failed     250ms\n"+
+		"total     failed     22m57s\n", summary.String())
+
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, r.Write(fs, DefaultPath))
+	data, readErr := afero.ReadFile(fs, DefaultPath)
+	assert.NoError(t, readErr)
+	var decoded Report
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, "failed", decoded.Status)
+	assert.Equal(t, "error uploading raw image: bucket is gone", decoded.Error)
+	assert.Equal(t, 252.0, decoded.Phases[0].DurationSeconds)
+	assert.Equal(t, "bucket is gone", decoded.Phases[2].Error)
+	assert.Equal(t, []Artifact{{Name: "ubuntu-22.04-pi.img.xz", Format: "raw", Size: 1024}}, decoded.Artifacts)
+}
+
+func TestNilReport(t *testing.T) {
+	var r *Report
+	ran := false
+	assert.NoError(t, r.Time("kernel", func() error { ran = true; return nil }))
+	assert.True(t, ran)
+	r.AddArtifact("image.img.xz", "raw", 1)
+	r.Finish(nil)
+	assert.NoError(t, r.WriteSummary(&bytes.Buffer{}))
+	assert.NoError(t, r.Write(afero.NewMemMapFs(), DefaultPath))
+}
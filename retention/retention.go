@@ -0,0 +1,202 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package retention groups the objects in the image bucket into builds and decides which old builds to prune.
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/manifest"
+	"github.com/LadySerena/pi-image-builder/store"
+	"github.com/LadySerena/pi-image-builder/utility"
+)
+
+// stemPattern matches the dated name every object from one build starts with, prefix-mm-dd-yyyy-unixmilli. It's
+// lazy so a delta is grouped with the build it produces, not the one it starts from.
+var stemPattern = regexp.MustCompile(`^(.+?)-\d{2}-\d{2}-\d{4}-(\d+)(\.|$)`)
+
+// Build is every published object from one image build: its artifacts, manifest, and the deltas producing it.
+type Build struct {
+	// Stem is the dated name shared by the build's objects.
+	Stem string
+	// Prefix is the distro's output prefix, builds are only compared to others with the same prefix.
+	Prefix  string
+	Created time.Time
+	Objects []store.Object
+	// Manifest is nil when the build has no readable manifest.
+	Manifest *manifest.Manifest
+}
+
+// Size is the total size of the build's objects.
+func (b Build) Size() int64 {
+	var size int64
+	for _, object := range b.Objects {
+		size += object.Size
+	}
+	return size
+}
+
+// Successful reports whether the build published its manifest and image and wasn't partially configured.
+func (b Build) Successful() bool {
+	if b.Manifest == nil || b.Manifest.PartiallyConfigured || b.Manifest.Image == "" {
+		return false
+	}
+	for _, object := range b.Objects {
+		if object.Name == b.Manifest.Image {
+			return true
+		}
+	}
+	return false
+}
+
+// List groups every object under prefix into builds, newest first. Objects that don't follow the build naming are
+// left out so they're never pruned.
+func List(ctx context.Context, objects store.ObjectStore, prefix string) ([]Build, error) {
+	listed, listErr := objects.List(ctx, prefix)
+	if listErr != nil {
+		return nil, fmt.Errorf("could not list images: %w", listErr)
+	}
+
+	byStem := make(map[string]*Build)
+	for _, object := range listed {
+		match := stemPattern.FindStringSubmatch(object.Name)
+		if match == nil {
+			continue
+		}
+		stem := strings.TrimSuffix(match[0], match[3])
+		build, ok := byStem[stem]
+		if !ok {
+			millis, parseErr := strconv.ParseInt(match[2], 10, 64)
+			if parseErr != nil {
+				continue
+			}
+			build = &Build{Stem: stem, Prefix: match[1], Created: time.UnixMilli(millis).UTC()}
+			byStem[stem] = build
+		}
+		build.Objects = append(build.Objects, object)
+	}
+
+	builds := make([]Build, 0, len(byStem))
+	for _, build := range byStem {
+		manifestErr := readManifest(ctx, objects, build)
+		if manifestErr != nil {
+			return nil, manifestErr
+		}
+		builds = append(builds, *build)
+	}
+	sort.Slice(builds, func(i, j int) bool {
+		if builds[i].Created.Equal(builds[j].Created) {
+			return builds[i].Stem > builds[j].Stem
+		}
+		return builds[i].Created.After(builds[j].Created)
+	})
+	return builds, nil
+}
+
+func readManifest(ctx context.Context, objects store.ObjectStore, build *Build) error {
+	for _, object := range build.Objects {
+		if !manifest.IsFileName(object.Name) {
+			continue
+		}
+		reader, openErr := objects.Open(ctx, object.Name)
+		if openErr != nil {
+			return fmt.Errorf("could not read manifest %s: %w", object.Name, openErr)
+		}
+		parsed, parseErr := manifest.Read(reader)
+		utility.WrappedClose(reader)
+		// a manifest that can't be parsed leaves the build looking unsuccessful, which only makes it easier to prune
+		if parseErr == nil {
+			build.Manifest = parsed
+		}
+		return nil
+	}
+	return nil
+}
+
+// Policy picks which builds are pruned. When both limits are set a build is only pruned when it's past both.
+type Policy struct {
+	// Keep is how many of the newest builds of each prefix are kept.
+	Keep int
+	// OlderThan prunes builds created longer ago than this.
+	OlderThan time.Duration
+	Now       time.Time
+}
+
+// Plan returns the builds policy prunes. The newest successful build of each prefix is always kept, whatever the
+// policy says. builds must be sorted newest first as List returns them.
+func Plan(builds []Build, policy Policy) ([]Build, error) {
+	if policy.Keep <= 0 && policy.OlderThan <= 0 {
+		return nil, errors.New("a number of builds to keep or a maximum age is required")
+	}
+
+	newestSuccessful := make(map[string]string)
+	for _, build := range builds {
+		if _, found := newestSuccessful[build.Prefix]; !found && build.Successful() {
+			newestSuccessful[build.Prefix] = build.Stem
+		}
+	}
+
+	seen := make(map[string]int)
+	pruned := make([]Build, 0)
+	for _, build := range builds {
+		position := seen[build.Prefix]
+		seen[build.Prefix]++
+		if newestSuccessful[build.Prefix] == build.Stem {
+			continue
+		}
+		if policy.Keep > 0 && position < policy.Keep {
+			continue
+		}
+		if policy.OlderThan > 0 && policy.Now.Sub(build.Created) <= policy.OlderThan {
+			continue
+		}
+		pruned = append(pruned, build)
+	}
+	return pruned, nil
+}
+
+// Prune deletes every object of each build, carrying on past failures so one stuck object doesn't block the rest.
+func Prune(ctx context.Context, objects store.ObjectStore, builds []Build) error {
+	var errs []error
+	for _, build := range builds {
+		for _, object := range build.Objects {
+			if err := objects.Delete(ctx, object.Name); err != nil {
+				errs = append(errs, fmt.Errorf("could not delete %s: %w", object.Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ParseAge is time.ParseDuration that also takes whole days, like 90d.
+func ParseAge(age string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(age, "d"); found {
+		count, err := strconv.Atoi(days)
+		if err != nil || count < 0 {
+			return 0, fmt.Errorf("invalid age %q", age)
+		}
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(age)
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package retention
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/manifest"
+	"github.com/LadySerena/pi-image-builder/store"
+	"github.com/stretchr/testify/assert"
+)
+
+var now = time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)
+
+// publish stores a build the way setup names its objects, daysAgo days before now.
+func publish(t *testing.T, objects *store.Memory, prefix string, daysAgo int, successful bool) string {
+	created := now.Add(-time.Duration(daysAgo) * 24 * time.Hour)
+	stem := fmt.Sprintf("%s-%s-%d", prefix, created.Format("01-02-2006"), created.UnixMilli())
+	image := stem + ".img.zstd"
+	ctx := context.Background()
+	assert.NoError(t, objects.Upload(ctx, image, bytes.NewReader(make([]byte, 10)), nil))
+	if successful {
+		encoded := fmt.Sprintf(`{"image": %q, "kubernetes": "v1.25.3"}`, image)
+		assert.NoError(t, objects.Upload(ctx, manifest.FileName(image), bytes.NewReader([]byte(encoded)), nil))
+	}
+	return stem
+}
+
+func TestList(t *testing.T) {
+	objects := store.NewMemory()
+	older := publish(t, objects, "ubuntu-22.04", 10, true)
+	newer := publish(t, objects, "ubuntu-22.04", 1, true)
+	// a delta belongs to the build it produces
+	assert.NoError(t, objects.Upload(context.Background(), newer+".from-"+older+".delta", bytes.NewReader(nil), nil))
+	assert.NoError(t, objects.Upload(context.Background(), "README.txt", bytes.NewReader(nil), nil))
+
+	builds, err := List(context.Background(), objects, "")
+	assert.NoError(t, err)
+	assert.Len(t, builds, 2)
+	assert.Equal(t, newer, builds[0].Stem)
+	assert.Equal(t, "ubuntu-22.04", builds[0].Prefix)
+	assert.Len(t, builds[0].Objects, 3)
+	assert.Equal(t, "v1.25.3", builds[0].Manifest.Kubernetes)
+	assert.True(t, builds[0].Successful())
+	assert.Equal(t, older, builds[1].Stem)
+	assert.Len(t, builds[1].Objects, 2)
+}
+
+func TestPlan(t *testing.T) {
+	objects := store.NewMemory()
+	failedNewest := publish(t, objects, "ubuntu-22.04", 1, false)
+	newestSuccessful := publish(t, objects, "ubuntu-22.04", 100, true)
+	oldest := publish(t, objects, "ubuntu-22.04", 200, true)
+	raspios := publish(t, objects, "raspios-bookworm", 150, true)
+
+	builds, err := List(context.Background(), objects, "")
+	assert.NoError(t, err)
+
+	stems := func(builds []Build) []string {
+		names := make([]string, 0)
+		for _, build := range builds {
+			names = append(names, build.Stem)
+		}
+		return names
+	}
+
+	keepOne, keepErr := Plan(builds, Policy{Keep: 1, Now: now})
+	assert.NoError(t, keepErr)
+	// keeping one would only keep the failed build, the newest successful one survives anyway
+	assert.Equal(t, []string{oldest}, stems(keepOne))
+
+	aged, agedErr := Plan(builds, Policy{OlderThan: 90 * 24 * time.Hour, Now: now})
+	assert.NoError(t, agedErr)
+	assert.Equal(t, []string{oldest}, stems(aged))
+
+	both, bothErr := Plan(builds, Policy{Keep: 1, OlderThan: 24 * time.Hour, Now: now})
+	assert.NoError(t, bothErr)
+	assert.Equal(t, []string{oldest}, stems(both))
+	assert.NotContains(t, stems(both), failedNewest)
+	assert.NotContains(t, stems(both), newestSuccessful)
+	assert.NotContains(t, stems(both), raspios)
+
+	_, emptyErr := Plan(builds, Policy{Now: now})
+	assert.Error(t, emptyErr)
+
+	assert.NoError(t, Prune(context.Background(), objects, keepOne))
+	remaining, listErr := List(context.Background(), objects, "")
+	assert.NoError(t, listErr)
+	assert.NotContains(t, stems(remaining), oldest)
+	assert.Len(t, remaining, 3)
+}
+
+func TestParseAge(t *testing.T) {
+	age, err := ParseAge("90d")
+	assert.NoError(t, err)
+	assert.Equal(t, 90*24*time.Hour, age)
+
+	hours, hoursErr := ParseAge("72h")
+	assert.NoError(t, hoursErr)
+	assert.Equal(t, 72*time.Hour, hours)
+
+	_, badErr := ParseAge("ninety days")
+	assert.Error(t, badErr)
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package smoke
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Marker is a console line Watch waits for.
+type Marker struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+// DefaultMarkers are what a healthy node prints on the serial console once it's ready for kubeadm.
+func DefaultMarkers() []Marker {
+	return []Marker{
+		{Name: "cloud-init finished", Pattern: regexp.MustCompile(`Cloud-init v\. \S+ finished at`)},
+		{Name: "kubelet started", Pattern: regexp.MustCompile(`Started (kubelet\.service|kubelet: The Kubernetes Node Agent)`)},
+	}
+}
+
+// DefaultFailures end the boot early, there's no point waiting out the timeout after any of these.
+func DefaultFailures() []Marker {
+	return []Marker{
+		{Name: "kernel panic", Pattern: regexp.MustCompile(`Kernel panic`)},
+		{Name: "root device missing", Pattern: regexp.MustCompile(`Gave up waiting for root|ALERT! .* does not exist`)},
+		{Name: "unit failed", Pattern: regexp.MustCompile(`Failed to start (kubelet|cloud-init|containerd)`)},
+		{Name: "emergency mode", Pattern: regexp.MustCompile(`You are in emergency mode`)},
+	}
+}
+
+// Result is what Watch saw on the console.
+type Result struct {
+	Passed bool
+	// Reason says which failure matched or which markers never showed up.
+	Reason string
+	// Line is the console line that failed the boot, if any.
+	Line string
+}
+
+// Watch reads console output until every marker has been seen, a failure matches, the console closes, or ctx is done.
+// Everything read is copied to log so the full console can be kept alongside the result.
+func Watch(ctx context.Context, console io.Reader, log io.Writer, markers []Marker, failures []Marker) Result {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(console)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	seen := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			return Result{Reason: "timed out waiting for " + missing(markers, seen)}
+		case line, open := <-lines:
+			if !open {
+				return Result{Reason: "console closed before " + missing(markers, seen)}
+			}
+			_, _ = fmt.Fprintln(log, line)
+			for _, failure := range failures {
+				if failure.Pattern.MatchString(line) {
+					return Result{Reason: failure.Name, Line: line}
+				}
+			}
+			for _, marker := range markers {
+				if marker.Pattern.MatchString(line) {
+					seen[marker.Name] = true
+				}
+			}
+			if len(seen) == len(markers) {
+				return Result{Passed: true}
+			}
+		}
+	}
+}
+
+func missing(markers []Marker, seen map[string]bool) string {
+	names := make([]string, 0)
+	for _, marker := range markers {
+		if !seen[marker.Name] {
+			names = append(names, marker.Name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package smoke
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch(t *testing.T) {
+	healthy := `[    2.104512] Run /init as init process
+[  OK  ] Started containerd.service - containerd container runtime.
+[  OK  ] Started kubelet.service - kubelet: The Kubernetes Node Agent.
+[   48.911036] cloud-init[1062]: Cloud-init v. 23.1.2-0ubuntu0~22.04.1 finished at Sat, 17 Oct 2026 04:12:51 +0000. Datasource DataSourceNoCloud.  Up 48.86 seconds
+[   49.000000] this line is never read
+`
+	var log bytes.Buffer
+	result := Watch(context.Background(), strings.NewReader(healthy), &log, DefaultMarkers(), DefaultFailures())
+	assert.True(t, result.Passed)
+	assert.Contains(t, log.String(), "Cloud-init v. 23.1.2")
+	assert.NotContains(t, log.String(), "never read")
+
+	broken := `[  OK  ] Started kubelet.service - kubelet: The Kubernetes Node Agent.
+[    9.120001] ALERT!  /dev/rootvg/rootlv does not exist.  Dropping to a shell!
+`
+	result = Watch(context.Background(), strings.NewReader(broken), io.Discard, DefaultMarkers(), DefaultFailures())
+	assert.False(t, result.Passed)
+	assert.Equal(t, "root device missing", result.Reason)
+	assert.Contains(t, result.Line, "/dev/rootvg/rootlv")
+
+	result = Watch(context.Background(), strings.NewReader("[  OK  ] Started kubelet.service\n"), io.Discard, DefaultMarkers(), DefaultFailures())
+	assert.False(t, result.Passed)
+	assert.Equal(t, "console closed before cloud-init finished", result.Reason)
+}
+
+func TestWatchTimeout(t *testing.T) {
+	console, writer := io.Pipe()
+	defer writer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result := Watch(ctx, console, io.Discard, DefaultMarkers(), DefaultFailures())
+	assert.False(t, result.Passed)
+	assert.Equal(t, "timed out waiting for cloud-init finished, kubelet started", result.Reason)
+}
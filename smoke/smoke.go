@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package smoke
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Config describes the emulated board. QEMU has no model of a pi 4, the pi 3 model boots the same arm64 kernel.
+type Config struct {
+	Binary  string
+	Machine string
+	// DTB is the device tree file name on the image's boot partition.
+	DTB     string
+	Memory  string
+	CPUs    int
+	Timeout time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Binary:  "qemu-system-aarch64",
+		Machine: "raspi3b",
+		DTB:     "bcm2710-rpi-3-b-plus.dtb",
+		Memory:  "1G",
+		CPUs:    4,
+		Timeout: 15 * time.Minute,
+	}
+}
+
+// BootFiles are copied off the image's boot partition so the image can be unmounted before qemu opens it.
+type BootFiles struct {
+	Kernel      string
+	Initrd      string
+	DTB         string
+	CommandLine string
+}
+
+// kernelFile is the uncompressed kernel configure.KernelSettings leaves next to vmlinuz, qemu can't boot a gzipped
+// arm64 kernel.
+const (
+	kernelFile = "vmlinux"
+	initrdFile = "initrd.img"
+)
+
+// consoleParams are dropped from the image's command line, the emulated uart is the only console qemu captures.
+var consoleParams = []string{"console=", "quiet", "splash"}
+
+// serialCommandLine points the console at the first uart and turns on the status output Watch looks for.
+func serialCommandLine(cmdline string) string {
+	kept := make([]string, 0)
+	for _, param := range strings.Fields(cmdline) {
+		drop := false
+		for _, prefix := range consoleParams {
+			if strings.HasPrefix(param, prefix) {
+				drop = true
+			}
+		}
+		if !drop {
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(append(kept, "console=ttyAMA0,115200", "systemd.show_status=1", "dwc_otg.fiq_fsm_enable=0"), " ")
+}
+
+func copyFile(fileSystem afero.Fs, source string, destination string) error {
+	input, openErr := fileSystem.Open(source)
+	if openErr != nil {
+		return openErr
+	}
+	defer input.Close()
+
+	output, createErr := fileSystem.Create(destination)
+	if createErr != nil {
+		return createErr
+	}
+	if _, err := io.Copy(output, input); err != nil {
+		_ = output.Close()
+		return err
+	}
+	return output.Close()
+}
+
+// ExtractBootFiles copies the kernel, initrd, and device tree from the mounted boot partition at bootDir into workDir.
+func ExtractBootFiles(fileSystem afero.Fs, bootDir string, workDir string, cfg Config) (BootFiles, error) {
+	if err := fileSystem.MkdirAll(workDir, 0750); err != nil {
+		return BootFiles{}, err
+	}
+
+	files := BootFiles{
+		Kernel: filepath.Join(workDir, kernelFile),
+		Initrd: filepath.Join(workDir, initrdFile),
+		DTB:    filepath.Join(workDir, cfg.DTB),
+	}
+	pairs := map[string]string{kernelFile: files.Kernel, initrdFile: files.Initrd, cfg.DTB: files.DTB}
+	for name, destination := range pairs {
+		if err := copyFile(fileSystem, filepath.Join(bootDir, name), destination); err != nil {
+			return BootFiles{}, fmt.Errorf("could not extract %s from the boot partition: %w", name, err)
+		}
+	}
+
+	cmdline, readErr := afero.ReadFile(fileSystem, filepath.Join(bootDir, "cmdline.txt"))
+	if readErr != nil {
+		return BootFiles{}, readErr
+	}
+	files.CommandLine = serialCommandLine(string(cmdline))
+
+	return files, nil
+}
+
+// OverlaySize is the smallest power of two at least as large as size, qemu's sd card model refuses anything else.
+func OverlaySize(size int64) int64 {
+	overlay := int64(1)
+	for overlay < size {
+		overlay <<= 1
+	}
+	return overlay
+}
+
+// OverlayArgs creates a qcow2 overlay over image so the smoke boot never writes to the image itself.
+func OverlayArgs(image string, overlay string, imageSize int64) []string {
+	return []string{"create", "-f", "qcow2", "-b", image, "-F", "raw", overlay, fmt.Sprintf("%d", OverlaySize(imageSize))}
+}
+
+// Args builds the qemu argv that boots files with disk as the sd card and the serial console on stdout.
+func Args(cfg Config, files BootFiles, disk string) []string {
+	return []string{
+		"-M", cfg.Machine,
+		"-m", cfg.Memory,
+		"-smp", fmt.Sprintf("%d", cfg.CPUs),
+		"-kernel", files.Kernel,
+		"-initrd", files.Initrd,
+		"-dtb", files.DTB,
+		"-append", files.CommandLine,
+		"-drive", fmt.Sprintf("if=sd,format=qcow2,file=%s", disk),
+		"-netdev", "user,id=net0",
+		"-device", "usb-net,netdev=net0",
+		"-display", "none",
+		"-monitor", "none",
+		"-serial", "stdio",
+	}
+}
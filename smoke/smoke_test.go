@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package smoke
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractBootFiles(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	cfg := DefaultConfig()
+	for _, name := range []string{"vmlinux", "initrd.img", "bcm2710-rpi-3-b-plus.dtb"} {
+		assert.NoError(t, afero.WriteFile(fs, "mnt/boot/firmware/"+name, []byte(name), 0644))
+	}
+	assert.NoError(t, afero.WriteFile(fs, "mnt/boot/firmware/cmdline.txt", []byte("console=serial0,115200 console=tty1 root=/dev/rootvg/rootlv rootfstype=ext4 rootwait quiet splash\n"), 0644))
+
+	files, err := ExtractBootFiles(fs, "mnt/boot/firmware", "work", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "root=/dev/rootvg/rootlv rootfstype=ext4 rootwait console=ttyAMA0,115200 systemd.show_status=1 dwc_otg.fiq_fsm_enable=0", files.CommandLine)
+
+	kernel, err := afero.ReadFile(fs, files.Kernel)
+	assert.NoError(t, err)
+	assert.Equal(t, "vmlinux", string(kernel))
+
+	assert.Equal(t, []string{
+		"-M", "raspi3b",
+		"-m", "1G",
+		"-smp", "4",
+		"-kernel", "work/vmlinux",
+		"-initrd", "work/initrd.img",
+		"-dtb", "work/bcm2710-rpi-3-b-plus.dtb",
+		"-append", files.CommandLine,
+		"-drive", "if=sd,format=qcow2,file=work/overlay.qcow2",
+		"-netdev", "user,id=net0",
+		"-device", "usb-net,netdev=net0",
+		"-display", "none",
+		"-monitor", "none",
+		"-serial", "stdio",
+	}, Args(cfg, files, "work/overlay.qcow2"))
+
+	cfg.DTB = "bcm2711-rpi-4-b.dtb"
+	_, err = ExtractBootFiles(fs, "mnt/boot/firmware", "work", cfg)
+	assert.ErrorContains(t, err, "bcm2711-rpi-4-b.dtb")
+}
+
+func TestOverlaySize(t *testing.T) {
+	assert.Equal(t, int64(4*1024*1024*1024), OverlaySize(4*1024*1024*1024))
+	assert.Equal(t, int64(8*1024*1024*1024), OverlaySize(4*1024*1024*1024+1))
+	assert.Equal(t, []string{"create", "-f", "qcow2", "-b", "/images/pi.img", "-F", "raw", "work/overlay.qcow2", "4294967296"}, OverlayArgs("/images/pi.img", "work/overlay.qcow2", 3500000000))
+}
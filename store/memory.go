@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory keeps objects in memory, for tests.
+type Memory struct {
+	mutex    sync.Mutex
+	Objects  map[string][]byte
+	Created  map[string]time.Time
+	Metadata map[string]map[string]string
+}
+
+func NewMemory() *Memory {
+	return &Memory{Objects: make(map[string][]byte), Created: make(map[string]time.Time), Metadata: make(map[string]map[string]string)}
+}
+
+func (m *Memory) Upload(_ context.Context, name string, r io.Reader, metadata map[string]string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Objects[name] = data
+	m.Metadata[name] = metadata
+	if _, ok := m.Created[name]; !ok {
+		m.Created[name] = time.Now()
+	}
+	return nil
+}
+
+func (m *Memory) Open(_ context.Context, name string) (io.ReadCloser, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	data, ok := m.Objects[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *Memory) List(_ context.Context, prefix string) ([]Object, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	objects := make([]Object, 0)
+	for name, data := range m.Objects {
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, Object{Name: name, Size: int64(len(data)), Created: m.Created[name], Metadata: m.Metadata[name]})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+func (m *Memory) Delete(_ context.Context, name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.Objects[name]; !ok {
+		return fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	delete(m.Objects, name)
+	delete(m.Metadata, name)
+	return nil
+}
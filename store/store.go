@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package store abstracts the bucket images are published to, so uploads and retention don't care which object
+// storage is behind it.
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Object describes a stored object.
+type Object struct {
+	Name    string
+	Size    int64
+	Created time.Time
+	// Metadata is the custom metadata set when the object was uploaded.
+	Metadata map[string]string
+}
+
+// ObjectStore is a flat bucket of named objects.
+type ObjectStore interface {
+	// Upload writes r to name with metadata attached, replacing any existing object.
+	Upload(ctx context.Context, name string, r io.Reader, metadata map[string]string) error
+	// Open reads name.
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns every object whose name starts with prefix.
+	List(ctx context.Context, prefix string) ([]Object, error)
+	// Delete removes name.
+	Delete(ctx context.Context, name string) error
+}
+
+// GCS stores objects in a Google Cloud Storage bucket.
+type GCS struct {
+	bucket *storage.BucketHandle
+}
+
+func NewGCS(client *storage.Client, bucket string) GCS {
+	return GCS{bucket: client.Bucket(bucket)}
+}
+
+func (g GCS) Upload(ctx context.Context, name string, r io.Reader, metadata map[string]string) error {
+	writer := g.bucket.Object(name).NewWriter(ctx)
+	writer.Metadata = metadata
+	if _, err := io.Copy(writer, r); err != nil {
+		return errors.Join(err, writer.Close())
+	}
+	return writer.Close()
+}
+
+func (g GCS) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return g.bucket.Object(name).NewReader(ctx)
+}
+
+func (g GCS) List(ctx context.Context, prefix string) ([]Object, error) {
+	objects := make([]Object, 0)
+	it := g.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, Object{Name: attrs.Name, Size: attrs.Size, Created: attrs.Created, Metadata: attrs.Metadata})
+	}
+}
+
+func (g GCS) Delete(ctx context.Context, name string) error {
+	return g.bucket.Object(name).Delete(ctx)
+}
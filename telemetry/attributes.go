@@ -0,0 +1,33 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import "go.opentelemetry.io/otel/attribute"
+
+// Span attributes set across packages, kept here so the same thing is always recorded under the same key.
+const (
+	ImageNameKey         = attribute.Key("image.name")
+	DevicePathKey        = attribute.Key("device.path")
+	KubernetesVersionKey = attribute.Key("kubernetes.version")
+	BytesTransferredKey  = attribute.Key("bytes.transferred")
+	CommandExitCodeKey   = attribute.Key("command.exit_code")
+	CommandArgvKey       = attribute.Key("command.argv")
+	CommandDurationKey   = attribute.Key("command.duration_ms")
+	FileChangedKey       = attribute.Key("file.changed")
+	HostArchKey          = attribute.Key("host.arch")
+	EmulatedKey          = attribute.Key("build.emulated")
+)
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// LogOptions hold the logging flags every command shares.
+type LogOptions struct {
+	Level  string
+	Format string
+}
+
+// LogFlags registers --log-level and --log-format on flagSet.
+func LogFlags(flagSet *flag.FlagSet) *LogOptions {
+	options := &LogOptions{}
+	flagSet.StringVar(&options.Level, "log-level", "info", "minimum level to log: debug, info, warn, or error")
+	flagSet.StringVar(&options.Format, "log-format", LogFormatText, "log output format: text or json")
+	return options
+}
+
+// NewLogger builds a logger writing to w in the chosen format.
+func (o LogOptions) NewLogger(w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(o.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", o.Level, err)
+	}
+	handlerOptions := &slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(o.Format) {
+	case LogFormatText:
+		return slog.New(slog.NewTextHandler(w, handlerOptions)), nil
+	case LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, handlerOptions)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q, must be %s or %s", o.Format, LogFormatText, LogFormatJSON)
+	}
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a context carrying logger, used to hand steps a logger tagged with their name.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// Logger returns the logger carried by ctx, or the default logger when there isn't one.
+func Logger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
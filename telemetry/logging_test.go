@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	flag "github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogFlags(t *testing.T) {
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	options := LogFlags(flagSet)
+	assert.NoError(t, flagSet.Parse([]string{"--log-level", "debug", "--log-format", "json"}))
+	assert.Equal(t, LogOptions{Level: "debug", Format: LogFormatJSON}, *options)
+}
+
+func TestNewLoggerJSON(t *testing.T) {
+	var output bytes.Buffer
+	logger, err := LogOptions{Level: "warn", Format: LogFormatJSON}.NewLogger(&output)
+	assert.NoError(t, err)
+
+	logger.Info("dropped")
+	logger.Warn("kept", "step", "kernel")
+
+	record := map[string]any{}
+	assert.NoError(t, json.Unmarshal(output.Bytes(), &record))
+	assert.Equal(t, "kept", record["msg"])
+	assert.Equal(t, "kernel", record["step"])
+}
+
+func TestNewLoggerRejectsBadOptions(t *testing.T) {
+	_, levelErr := LogOptions{Level: "loud", Format: LogFormatText}.NewLogger(&bytes.Buffer{})
+	assert.Error(t, levelErr)
+	_, formatErr := LogOptions{Level: "info", Format: "xml"}.NewLogger(&bytes.Buffer{})
+	assert.Error(t, formatErr)
+}
+
+func TestLoggerFromContext(t *testing.T) {
+	var output bytes.Buffer
+	logger, err := LogOptions{Level: "info", Format: LogFormatText}.NewLogger(&output)
+	assert.NoError(t, err)
+
+	assert.NotNil(t, Logger(context.Background()))
+	Logger(WithLogger(context.Background(), logger.With("step", "ssh"))).Info("hello")
+	assert.Contains(t, output.String(), "step=ssh")
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/metric/unit"
+	controller "go.opentelemetry.io/otel/sdk/metric/controller/basic"
+	processor "go.opentelemetry.io/otel/sdk/metric/processor/basic"
+	selector "go.opentelemetry.io/otel/sdk/metric/selector/simple"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	StepDurationMetric    = "pi_image_builder.step.duration"
+	BytesDownloadedMetric = "pi_image_builder.bytes.downloaded"
+	BytesUploadedMetric   = "pi_image_builder.bytes.uploaded"
+	RetriesMetric         = "pi_image_builder.retries"
+	CommandFailuresMetric = "pi_image_builder.command.failures"
+
+	stepKey      = attribute.Key("step")
+	operationKey = attribute.Key("operation")
+	commandKey   = attribute.Key("command")
+	successKey   = attribute.Key("success")
+)
+
+func GetMeter() metric.Meter {
+	return global.MeterProvider().Meter(TracerName)
+}
+
+// StartMetrics exports metrics to the same OTLP endpoint as traces. Jaeger has no metrics, so without an OTLP endpoint
+// nothing is exported and the returned shutdown does nothing.
+func StartMetrics(ctx context.Context, options TraceOptions) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+	if !options.useOTLP(os.Getenv) {
+		return noop, nil
+	}
+
+	target, targetErr := options.otlpTarget()
+	if targetErr != nil {
+		return noop, targetErr
+	}
+
+	var exporter *otlpmetric.Exporter
+	var exporterErr error
+	if target.protocol == ProtocolHTTP {
+		exportOptions := make([]otlpmetrichttp.Option, 0)
+		if target.host != "" {
+			exportOptions = append(exportOptions, otlpmetrichttp.WithEndpoint(target.host))
+			if target.urlPath != "" {
+				exportOptions = append(exportOptions, otlpmetrichttp.WithURLPath(target.urlPath+"/v1/metrics"))
+			}
+			if target.insecure {
+				exportOptions = append(exportOptions, otlpmetrichttp.WithInsecure())
+			}
+		}
+		exporter, exporterErr = otlpmetrichttp.New(ctx, exportOptions...)
+	} else {
+		exportOptions := make([]otlpmetricgrpc.Option, 0)
+		if target.host != "" {
+			exportOptions = append(exportOptions, otlpmetricgrpc.WithEndpoint(target.host))
+			if target.insecure {
+				exportOptions = append(exportOptions, otlpmetricgrpc.WithInsecure())
+			}
+		}
+		exporter, exporterErr = otlpmetricgrpc.New(ctx, exportOptions...)
+	}
+	if exporterErr != nil {
+		return noop, exporterErr
+	}
+
+	provider := controller.New(
+		processor.NewFactory(selector.NewWithHistogramDistribution(), exporter),
+		controller.WithExporter(exporter),
+		controller.WithResource(serviceResource()),
+	)
+	if err := provider.Start(ctx); err != nil {
+		return noop, err
+	}
+	global.SetMeterProvider(provider)
+
+	// stopping the controller pushes whatever was recorded since the last collection
+	return provider.Stop, nil
+}
+
+// RecordDuration adds one observation to the step duration histogram.
+func RecordDuration(ctx context.Context, step string, duration time.Duration, success bool) {
+	histogram, err := GetMeter().SyncFloat64().Histogram(StepDurationMetric,
+		instrument.WithUnit(unit.Unit("s")), instrument.WithDescription("how long each build step took"))
+	if err != nil {
+		otel.Handle(err)
+		return
+	}
+	histogram.Record(ctx, duration.Seconds(), stepKey.String(step), successKey.Bool(success))
+}
+
+func addCount(ctx context.Context, name string, description string, amount int64, attributes ...attribute.KeyValue) {
+	counter, err := GetMeter().SyncInt64().Counter(name, instrument.WithDescription(description))
+	if err != nil {
+		otel.Handle(err)
+		return
+	}
+	counter.Add(ctx, amount, attributes...)
+}
+
+func AddBytesDownloaded(ctx context.Context, bytes int64) {
+	addCount(ctx, BytesDownloadedMetric, "bytes downloaded from the internet and the image bucket", bytes)
+}
+
+func AddBytesUploaded(ctx context.Context, bytes int64) {
+	addCount(ctx, BytesUploadedMetric, "bytes uploaded to the image bucket", bytes)
+}
+
+// AddRetry counts one retry of operation, like an unmount or a key fetch.
+func AddRetry(ctx context.Context, operation string) {
+	addCount(ctx, RetriesMetric, "operations retried after a failure", 1, operationKey.String(operation))
+}
+
+// AddCommandFailure counts an external command exiting non zero, only the binary name is recorded to keep the
+// attribute set small.
+func AddCommandFailure(ctx context.Context, command string) {
+	addCount(ctx, CommandFailuresMetric, "external commands that failed", 1, commandKey.String(command))
+}
+
+// timedSpan records how long it was open in the step duration histogram when it ends.
+type timedSpan struct {
+	trace.Span
+	ctx     context.Context
+	name    string
+	started time.Time
+	failed  bool
+}
+
+func (s *timedSpan) SetStatus(code codes.Code, description string) {
+	s.failed = code == codes.Error
+	s.Span.SetStatus(code, description)
+}
+
+func (s *timedSpan) End(options ...trace.SpanEndOption) {
+	RecordDuration(s.ctx, s.name, time.Since(s.started), !s.failed)
+	s.Span.End(options...)
+}
+
+// Start begins a span like GetTracer().Start and also times it, use it for the fixed set of build phases. Spans named
+// after paths or commands should keep using the tracer so the histogram doesn't grow an attribute per file.
+func Start(ctx context.Context, name string) (context.Context, trace.Span) {
+	ctx, span := GetTracer().Start(ctx, name)
+	return ctx, &timedSpan{Span: span, ctx: ctx, name: name, started: time.Now()}
+}
+
+// Timed runs fn inside a timed span, failures are recorded on the span and in the histogram.
+func Timed(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	ctx, span := Start(ctx, name)
+	defer span.End()
+	err := fn(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/sdk/metric/metrictest"
+)
+
+func testMeter(t *testing.T) *metrictest.Exporter {
+	provider, exporter := metrictest.NewTestMeterProvider()
+	previous := global.MeterProvider()
+	global.SetMeterProvider(provider)
+	t.Cleanup(func() { global.SetMeterProvider(previous) })
+	return exporter
+}
+
+func TestTimedRecordsDuration(t *testing.T) {
+	exporter := testMeter(t)
+	ctx := context.Background()
+
+	assert.NoError(t, Timed(ctx, "packages", func(ctx context.Context) error { return nil }))
+	assert.Error(t, Timed(ctx, "kubernetes", func(ctx context.Context) error { return errors.New("boom") }))
+
+	assert.NoError(t, exporter.Collect(ctx))
+	passed, passedErr := exporter.GetByNameAndAttributes(StepDurationMetric,
+		[]attribute.KeyValue{stepKey.String("packages"), successKey.Bool(true)})
+	assert.NoError(t, passedErr)
+	assert.Equal(t, uint64(1), passed.Count)
+
+	failed, failedErr := exporter.GetByNameAndAttributes(StepDurationMetric,
+		[]attribute.KeyValue{stepKey.String("kubernetes"), successKey.Bool(false)})
+	assert.NoError(t, failedErr)
+	assert.Equal(t, uint64(1), failed.Count)
+}
+
+func TestStartTimesSpan(t *testing.T) {
+	exporter := testMeter(t)
+	ctx := context.Background()
+
+	_, span := Start(ctx, "compress image")
+	span.End()
+
+	assert.NoError(t, exporter.Collect(ctx))
+	record, err := exporter.GetByNameAndAttributes(StepDurationMetric, []attribute.KeyValue{stepKey.String("compress image")})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), record.Count)
+}
+
+func TestCounters(t *testing.T) {
+	exporter := testMeter(t)
+	ctx := context.Background()
+
+	AddBytesDownloaded(ctx, 100)
+	AddBytesDownloaded(ctx, 23)
+	AddBytesUploaded(ctx, 7)
+	AddRetry(ctx, "unmount")
+	AddCommandFailure(ctx, "umount")
+	AddCommandFailure(ctx, "umount")
+
+	assert.NoError(t, exporter.Collect(ctx))
+	downloaded, downloadedErr := exporter.GetByName(BytesDownloadedMetric)
+	assert.NoError(t, downloadedErr)
+	assert.Equal(t, int64(123), downloaded.Sum.AsInt64())
+
+	uploaded, uploadedErr := exporter.GetByName(BytesUploadedMetric)
+	assert.NoError(t, uploadedErr)
+	assert.Equal(t, int64(7), uploaded.Sum.AsInt64())
+
+	retries, retriesErr := exporter.GetByNameAndAttributes(RetriesMetric, []attribute.KeyValue{operationKey.String("unmount")})
+	assert.NoError(t, retriesErr)
+	assert.Equal(t, int64(1), retries.Sum.AsInt64())
+
+	failures, failuresErr := exporter.GetByNameAndAttributes(CommandFailuresMetric, []attribute.KeyValue{commandKey.String("umount")})
+	assert.NoError(t, failuresErr)
+	assert.Equal(t, int64(2), failures.Sum.AsInt64())
+}
+
+func TestStartMetricsWithoutOTLPIsNoop(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	stop, err := StartMetrics(context.Background(), TraceOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, stop(context.Background()))
+}
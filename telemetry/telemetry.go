@@ -17,8 +17,18 @@
 package telemetry
 
 import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+
+	flag "github.com/spf13/pflag"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/jaeger"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 	"go.opentelemetry.io/otel/sdk/resource"
 	tracesdk "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
@@ -27,20 +37,178 @@ import (
 
 const (
 	TracerName = "main"
+
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http/protobuf"
+
+	DefaultJaegerEndpoint = "http://localhost:14268/api/traces"
 )
 
-func NewExporter(url string) (*tracesdk.TracerProvider, error) {
-	exp, err := jaeger.New(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(url)))
+// TraceOptions pick where spans are exported. An OTLP endpoint from the flag or the standard OTEL_EXPORTER_OTLP_*
+// variables wins, otherwise spans go to Jaeger.
+type TraceOptions struct {
+	OTLPEndpoint   string
+	OTLPProtocol   string
+	JaegerEndpoint string
+}
+
+// TraceFlags registers --otlp-endpoint, --otlp-protocol, and --jaeger-endpoint on flagSet.
+func TraceFlags(flagSet *flag.FlagSet) *TraceOptions {
+	options := &TraceOptions{}
+	flagSet.StringVar(&options.OTLPEndpoint, "otlp-endpoint", "", "otlp collector url, defaults to OTEL_EXPORTER_OTLP_ENDPOINT")
+	flagSet.StringVar(&options.OTLPProtocol, "otlp-protocol", "", "otlp protocol, grpc or http/protobuf, defaults to OTEL_EXPORTER_OTLP_PROTOCOL then grpc")
+	flagSet.StringVar(&options.JaegerEndpoint, "jaeger-endpoint", DefaultJaegerEndpoint, "jaeger collector used when no otlp endpoint is configured")
+	return options
+}
+
+// useOTLP reports whether an OTLP endpoint was configured by flag or environment.
+func (o TraceOptions) useOTLP(getenv func(string) string) bool {
+	return o.OTLPEndpoint != "" || getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" || getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != ""
+}
+
+// protocol resolves the OTLP protocol the same way the OTel SDKs do, the flag beats the environment.
+func (o TraceOptions) protocol(getenv func(string) string) (string, error) {
+	protocol := o.OTLPProtocol
+	for _, variable := range []string{"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "OTEL_EXPORTER_OTLP_PROTOCOL"} {
+		if protocol == "" {
+			protocol = getenv(variable)
+		}
+	}
+	switch protocol {
+	case "", ProtocolGRPC:
+		return ProtocolGRPC, nil
+	case ProtocolHTTP, "http":
+		return ProtocolHTTP, nil
+	default:
+		return "", fmt.Errorf("otlp protocol must be %s or %s, got: %q", ProtocolGRPC, ProtocolHTTP, protocol)
+	}
+}
+
+// otlpEndpoint splits a collector url into the host the exporters take and whether it's plain text.
+func otlpEndpoint(raw string) (host string, urlPath string, insecure bool, err error) {
+	parsed, parseErr := url.Parse(raw)
+	if parseErr != nil || parsed.Host == "" {
+		return "", "", false, fmt.Errorf("otlp endpoint must be a url like http://localhost:4317, got: %q", raw)
+	}
+	switch parsed.Scheme {
+	case "http":
+		insecure = true
+	case "https":
+	default:
+		return "", "", false, fmt.Errorf("otlp endpoint must use http or https, got: %q", raw)
+	}
+	return parsed.Host, strings.TrimSuffix(parsed.Path, "/"), insecure, nil
+}
+
+// otlpTarget is where OTLP traces and metrics go. An empty host leaves the exporters to read the OTEL_EXPORTER_OTLP_*
+// variables themselves.
+type otlpTarget struct {
+	protocol string
+	host     string
+	urlPath  string
+	insecure bool
+}
+
+func (o TraceOptions) otlpTarget() (otlpTarget, error) {
+	protocol, protocolErr := o.protocol(os.Getenv)
+	if protocolErr != nil {
+		return otlpTarget{}, protocolErr
+	}
+	target := otlpTarget{protocol: protocol}
+	if o.OTLPEndpoint != "" {
+		var endpointErr error
+		target.host, target.urlPath, target.insecure, endpointErr = otlpEndpoint(o.OTLPEndpoint)
+		if endpointErr != nil {
+			return otlpTarget{}, endpointErr
+		}
+	}
+	return target, nil
+}
+
+func (o TraceOptions) exporter(ctx context.Context) (tracesdk.SpanExporter, error) {
+	if !o.useOTLP(os.Getenv) {
+		return jaeger.New(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(o.JaegerEndpoint)))
+	}
+
+	target, targetErr := o.otlpTarget()
+	if targetErr != nil {
+		return nil, targetErr
+	}
+
+	if target.protocol == ProtocolHTTP {
+		options := make([]otlptracehttp.Option, 0)
+		if target.host != "" {
+			options = append(options, otlptracehttp.WithEndpoint(target.host))
+			if target.urlPath != "" {
+				options = append(options, otlptracehttp.WithURLPath(target.urlPath+"/v1/traces"))
+			}
+			if target.insecure {
+				options = append(options, otlptracehttp.WithInsecure())
+			}
+		}
+		return otlptracehttp.New(ctx, options...)
+	}
+
+	options := make([]otlptracegrpc.Option, 0)
+	if target.host != "" {
+		options = append(options, otlptracegrpc.WithEndpoint(target.host))
+		if target.insecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+	}
+	return otlptracegrpc.New(ctx, options...)
+}
+
+// ServiceVersion is the builder's module version, or its vcs revision for development builds.
+func ServiceVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	return buildVersion(info)
+}
+
+func buildVersion(info *debug.BuildInfo) string {
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	revision := ""
+	modified := false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "(devel)"
+	}
+	if modified {
+		return revision + "-dirty"
+	}
+	return revision
+}
+
+func serviceResource() *resource.Resource {
+	return resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceNameKey.String("pi-image-builder"),
+		semconv.ServiceVersionKey.String(ServiceVersion()),
+	)
+}
+
+// NewTracerProvider builds a provider exporting to the endpoint picked by options.
+func NewTracerProvider(ctx context.Context, options TraceOptions) (*tracesdk.TracerProvider, error) {
+	exp, err := options.exporter(ctx)
 	if err != nil {
 		return nil, err
 	}
 	tp := tracesdk.NewTracerProvider(
 		tracesdk.WithBatcher(exp),
 		tracesdk.WithSampler(tracesdk.AlwaysSample()),
-		tracesdk.WithResource(resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceNameKey.String("pi-image-builder"),
-		)),
+		tracesdk.WithResource(serviceResource()),
 	)
 
 	return tp, nil
@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"runtime/debug"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fakeEnv(values map[string]string) func(string) string {
+	return func(key string) string {
+		return values[key]
+	}
+}
+
+func TestUseOTLP(t *testing.T) {
+	assert.False(t, TraceOptions{}.useOTLP(fakeEnv(nil)))
+	assert.True(t, TraceOptions{OTLPEndpoint: "http://collector:4317"}.useOTLP(fakeEnv(nil)))
+	assert.True(t, TraceOptions{}.useOTLP(fakeEnv(map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4317"})))
+	assert.True(t, TraceOptions{}.useOTLP(fakeEnv(map[string]string{"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://collector:4317"})))
+}
+
+func TestProtocol(t *testing.T) {
+	protocol, err := TraceOptions{}.protocol(fakeEnv(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolGRPC, protocol)
+
+	protocol, err = TraceOptions{}.protocol(fakeEnv(map[string]string{
+		"OTEL_EXPORTER_OTLP_PROTOCOL":        "grpc",
+		"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL": "http/protobuf",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolHTTP, protocol, "the traces variable beats the general one")
+
+	protocol, err = TraceOptions{OTLPProtocol: "grpc"}.protocol(fakeEnv(map[string]string{"OTEL_EXPORTER_OTLP_PROTOCOL": "http/protobuf"}))
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolGRPC, protocol, "the flag beats the environment")
+
+	_, err = TraceOptions{OTLPProtocol: "http/json"}.protocol(fakeEnv(nil))
+	assert.Error(t, err)
+}
+
+func TestOTLPEndpoint(t *testing.T) {
+	host, urlPath, insecure, err := otlpEndpoint("http://localhost:4318/collector/")
+	assert.NoError(t, err)
+	assert.Equal(t, "localhost:4318", host)
+	assert.Equal(t, "/collector", urlPath)
+	assert.True(t, insecure)
+
+	host, _, insecure, err = otlpEndpoint("https://otel.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "otel.example.com", host)
+	assert.False(t, insecure)
+
+	for _, bad := range []string{"localhost:4317", "grpc://localhost:4317", ""} {
+		_, _, _, err = otlpEndpoint(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestBuildVersion(t *testing.T) {
+	assert.Equal(t, "v1.2.0", buildVersion(&debug.BuildInfo{Main: debug.Module{Version: "v1.2.0"}}))
+	assert.Equal(t, "(devel)", buildVersion(&debug.BuildInfo{Main: debug.Module{Version: "(devel)"}}))
+	assert.Equal(t, "abc123-dirty", buildVersion(&debug.BuildInfo{
+		Main: debug.Module{Version: "(devel)"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs.revision", Value: "abc123"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}))
+}
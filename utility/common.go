@@ -19,21 +19,25 @@ package utility
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
-	"log"
+	"log/slog"
+	"os"
 	"os/exec"
 	"path"
 	"strings"
 	"text/template"
+	"time"
+	"unicode"
 
 	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/spf13/afero"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	ExtractName       = "ubuntu-20.04.5-preinstalled-server-arm64+raspi.img"
-	ImageName         = "ubuntu-20.04.5-preinstalled-server-arm64+raspi.img.xz"
 	BucketName        = "pi-images.serenacodes.com"
 	VolumeGroupName   = "rootvg"
 	RootLogicalVolume = "rootlv"
@@ -41,31 +45,170 @@ const (
 	ContainerdVolume  = "containerdlv"
 )
 
+// templateFuncs are available to every template rendered through RenderTemplate.
+var templateFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// WrappedClose closes a read only handle, logging a failure since nothing was lost. Anything that was written to
+// should use CloseWithErr so a failed flush isn't mistaken for success.
 func WrappedClose(closer io.Closer) {
 	if err := closer.Close(); err != nil {
-		log.Panicf("could not close closer properly: %v", err)
+		slog.Warn("could not close closer properly", "error", err)
 	}
 }
 
-func RunCommandWithOutput(ctx context.Context, cmd *exec.Cmd, cancel context.CancelFunc) error {
+// CloseWithErr closes closer and joins its error into err, meant to be deferred against a named return.
+func CloseWithErr(closer io.Closer, err *error) {
+	*err = errors.Join(*err, closer.Close())
+}
 
-	_, span := telemetry.GetTracer().Start(ctx, fmt.Sprintf("running command: %s", cmd.String()))
-	defer span.End()
-	if cancel != nil {
-		defer cancel()
+// Link creates a hard link newname to oldname, both relative to fileSystem. Filesystems that can't hard link get a
+// copy of oldname instead.
+func Link(fileSystem afero.Fs, oldname string, newname string) error {
+	switch typed := fileSystem.(type) {
+	case *afero.BasePathFs:
+		realOld, oldErr := typed.RealPath(oldname)
+		if oldErr != nil {
+			return oldErr
+		}
+		realNew, newErr := typed.RealPath(newname)
+		if newErr != nil {
+			return newErr
+		}
+		return os.Link(realOld, realNew)
+	case *afero.OsFs:
+		return os.Link(oldname, newname)
 	}
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("non zero exit code exit code: %v, output: %s", err, string(output))
+	source, openErr := fileSystem.Open(oldname)
+	if openErr != nil {
+		return openErr
+	}
+	defer WrappedClose(source)
+	info, statErr := source.Stat()
+	if statErr != nil {
+		return statErr
+	}
+	destination, createErr := fileSystem.OpenFile(newname, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode())
+	if createErr != nil {
+		return createErr
+	}
+	if _, err := io.Copy(destination, source); err != nil {
+		return errors.Join(err, destination.Close())
 	}
+	return destination.Close()
+}
 
-	return nil
+// Symlink creates name pointing at target exactly as given. afero's BasePathFs resolves link targets against the
+// host, which breaks links inside a mounted image, so it's unwrapped to write through the os directly.
+func Symlink(fileSystem afero.Fs, target string, name string) error {
+	switch typed := fileSystem.(type) {
+	case *afero.BasePathFs:
+		realName, err := typed.RealPath(name)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, realName)
+	case *afero.OsFs:
+		return os.Symlink(target, name)
+	}
+	if linker, ok := fileSystem.(afero.Linker); ok {
+		return linker.SymlinkIfPossible(target, name)
+	}
+	return &os.LinkError{Op: "symlink", Old: target, New: name, Err: afero.ErrNoSymlink}
+}
+
+// maxSymlinks bounds resolving links inside an image, the same limit the kernel uses.
+const maxSymlinks = 40
+
+// ResolveInRoot follows symlinks in name against fileSystem's root rather than the host's, so an image's absolute
+// links like /bin pointing at /usr/bin stay inside it. The result is the path of the file itself.
+func ResolveInRoot(fileSystem afero.Fs, name string) (string, error) {
+	resolved := "/"
+	remaining := strings.Split(name, "/")
+	hops := 0
+	for len(remaining) != 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, component)
+		info, statErr := lstatIfPossible(fileSystem, next)
+		if statErr != nil {
+			return "", statErr
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symlinks resolving %s", name)
+		}
+		reader, ok := fileSystem.(afero.LinkReader)
+		if !ok {
+			return "", fmt.Errorf("cannot read symlink %s on this filesystem", next)
+		}
+		target, readErr := reader.ReadlinkIfPossible(next)
+		if readErr != nil {
+			return "", readErr
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+	return resolved, nil
+}
+
+func lstatIfPossible(fileSystem afero.Fs, name string) (fs.FileInfo, error) {
+	if lstater, ok := fileSystem.(afero.Lstater); ok {
+		info, _, err := lstater.LstatIfPossible(name)
+		return info, err
+	}
+	return fileSystem.Stat(name)
+}
+
+// logCommand records a finished command at debug level and its exit code on the command's span. Commands that never
+// started report exit code -1.
+func logCommand(ctx context.Context, cmd *exec.Cmd, started time.Time) {
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	trace.SpanFromContext(ctx).SetAttributes(telemetry.CommandExitCodeKey.Int(exitCode))
+	if exitCode != 0 {
+		telemetry.AddCommandFailure(ctx, path.Base(cmd.Path))
+	}
+	telemetry.Logger(ctx).DebugContext(ctx, "ran command", "argv", cmd.Args, "duration", time.Since(started),
+		"exit_code", exitCode)
+}
+
+// PartitionName returns the node for partition number on device. Devices whose name ends in a digit (loop, nvme,
+// mmcblk) separate the partition number with a p, the rest just append it.
+func PartitionName(device string, number int) string {
+	if device != "" && unicode.IsDigit(rune(device[len(device)-1])) {
+		return fmt.Sprintf("%sp%d", device, number)
+	}
+	return fmt.Sprintf("%s%d", device, number)
 }
 
 func MapperName(volumeName string) string {
 	return fmt.Sprintf("/dev/mapper/%s-%s", VolumeGroupName, volumeName)
 }
 
+// CryptName is the dm-crypt mapping for an encrypted logical volume.
+func CryptName(volumeName string) string {
+	return fmt.Sprintf("%s_crypt", volumeName)
+}
+
 func TrailingSlash(inputPath string) string {
 	if strings.HasSuffix(inputPath, "/") {
 		return inputPath
@@ -81,7 +224,7 @@ func RenderTemplate(ctx context.Context, fs fs.FS, templatePath string, data any
 
 	name := path.Base(templatePath)
 
-	parsedTemplate, templateErr := template.New(name).ParseFS(fs, templatePath)
+	parsedTemplate, templateErr := template.New(name).Funcs(templateFuncs).ParseFS(fs, templatePath)
 	if templateErr != nil {
 		return buffer, templateErr
 	}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utility
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionName(t *testing.T) {
+	cases := []struct {
+		device   string
+		number   int
+		expected string
+	}{
+		{device: "/dev/sda", number: 1, expected: "/dev/sda1"},
+		{device: "/dev/nvme0n1", number: 2, expected: "/dev/nvme0n1p2"},
+		{device: "/dev/mmcblk0", number: 1, expected: "/dev/mmcblk0p1"},
+		{device: "/dev/loop12", number: 2, expected: "/dev/loop12p2"},
+	}
+	for _, tt := range cases {
+		assert.Equal(t, tt.expected, PartitionName(tt.device, tt.number))
+	}
+}
+
+func TestRunLogsCommand(t *testing.T) {
+	var output bytes.Buffer
+	logger, err := telemetry.LogOptions{Level: "debug", Format: telemetry.LogFormatText}.NewLogger(&output)
+	assert.NoError(t, err)
+	ctx := telemetry.WithLogger(context.Background(), logger)
+
+	_, runErr := Run(ctx, RunOptions{}, "sh", "-c", "echo broken; exit 3")
+	assert.Error(t, runErr)
+	assert.Contains(t, output.String(), "msg=\"ran command\"")
+	assert.Contains(t, output.String(), "exit_code=3")
+	assert.Contains(t, output.String(), "duration=")
+}
+
+type failingCloser struct{ err error }
+
+func (f failingCloser) Close() error {
+	return f.err
+}
+
+func TestWrappedCloseLogsFailure(t *testing.T) {
+	var output bytes.Buffer
+	logger, err := telemetry.LogOptions{Level: "info", Format: telemetry.LogFormatText}.NewLogger(&output)
+	assert.NoError(t, err)
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	assert.NotPanics(t, func() { WrappedClose(failingCloser{err: errors.New("stale handle")}) })
+	assert.Contains(t, output.String(), "stale handle")
+}
+
+func TestCloseWithErr(t *testing.T) {
+	closeErr := errors.New("disk full")
+	cases := []struct {
+		name     string
+		returned error
+		closer   failingCloser
+		expected []error
+	}{
+		{name: "both succeed", closer: failingCloser{}},
+		{name: "close fails", closer: failingCloser{err: closeErr}, expected: []error{closeErr}},
+		{name: "body fails", returned: io.ErrUnexpectedEOF, closer: failingCloser{}, expected: []error{io.ErrUnexpectedEOF}},
+		{name: "both fail", returned: io.ErrUnexpectedEOF, closer: failingCloser{err: closeErr}, expected: []error{io.ErrUnexpectedEOF, closeErr}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := func() (err error) {
+				defer CloseWithErr(tt.closer, &err)
+				return tt.returned
+			}()
+			if len(tt.expected) == 0 {
+				assert.NoError(t, err)
+			}
+			for _, expected := range tt.expected {
+				assert.ErrorIs(t, err, expected)
+			}
+		})
+	}
+}
+
+func TestResolveInRoot(t *testing.T) {
+	dir := t.TempDir()
+	fs := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	assert.NoError(t, fs.MkdirAll("/usr/bin", 0755))
+	assert.NoError(t, afero.WriteFile(fs, "/usr/bin/bash", []byte("bash"), 0755))
+	assert.NoError(t, os.Symlink("usr/bin", filepath.Join(dir, "bin")))
+	assert.NoError(t, os.Symlink("/bin/bash", filepath.Join(dir, "usr/bin/sh")))
+	assert.NoError(t, os.Symlink("loop", filepath.Join(dir, "loop")))
+
+	resolved, err := ResolveInRoot(fs, "/bin/sh")
+	assert.NoError(t, err)
+	assert.Equal(t, "/usr/bin/bash", resolved)
+
+	_, loopErr := ResolveInRoot(fs, "/loop")
+	assert.ErrorContains(t, loopErr, "too many levels of symlinks")
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utility
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// capSysAdmin is CAP_SYS_ADMIN's bit in the capability sets.
+const capSysAdmin = 21
+
+// hostPackages is the debian/ubuntu package providing each command the builder runs.
+var hostPackages = map[string]string{
+	"blkid":          "util-linux",
+	"chroot":         "coreutils",
+	"cp":             "coreutils",
+	"cryptsetup":     "cryptsetup",
+	"debootstrap":    "debootstrap",
+	"dumpe2fs":       "e2fsprogs",
+	"e2fsck":         "e2fsprogs",
+	"fallocate":      "util-linux",
+	"fatlabel":       "dosfstools",
+	"fstrim":         "util-linux",
+	"helm":           "helm",
+	"losetup":        "util-linux",
+	"lsblk":          "util-linux",
+	"lvcreate":       "lvm2",
+	"mkfs.btrfs":     "btrfs-progs",
+	"mkfs.ext4":      "e2fsprogs",
+	"mkfs.f2fs":      "f2fs-tools",
+	"mkfs.vfat":      "dosfstools",
+	"mkfs.xfs":       "xfsprogs",
+	"mount":          "mount",
+	"parted":         "parted",
+	"pvcreate":       "lvm2",
+	"qemu-img":       "qemu-utils",
+	"resize2fs":      "e2fsprogs",
+	"rsync":          "rsync",
+	"sync":           "coreutils",
+	"systemd-nspawn": "systemd-container",
+	"umount":         "mount",
+	"vgchange":       "lvm2",
+	"vgcreate":       "lvm2",
+	"wipefs":         "util-linux",
+	"xz":             "xz-utils",
+}
+
+// SetupCommands are run on the host while building an image.
+var SetupCommands = []string{"losetup", "parted", "e2fsck", "resize2fs", "mount", "umount", "sync", "chroot"}
+
+// BatchCommands are also needed when setup builds several profiles from one base image.
+var BatchCommands = []string{"cp"}
+
+// DebootstrapCommands are also needed when setup builds the root filesystem from scratch.
+var DebootstrapCommands = []string{"debootstrap", "mkfs.vfat", "mkfs.ext4"}
+
+// CompactCommands are also needed when setup compacts the image before compressing it.
+var CompactCommands = []string{"fstrim", "fallocate"}
+
+// ShrinkCommands are also needed when setup shrinks the image to its minimal size before compressing it.
+var ShrinkCommands = []string{"e2fsck", "resize2fs", "dumpe2fs", "parted"}
+
+// HelmCommands are also needed when setup vendors helm charts into the image.
+var HelmCommands = []string{"helm"}
+
+// Qcow2Commands are also needed when setup publishes a qcow2 image.
+var Qcow2Commands = []string{"qemu-img"}
+
+// DiffCommands are run on the host while comparing two built images.
+var DiffCommands = []string{"losetup", "mount", "umount"}
+
+// InspectCommands are run on the host while inspecting a built image.
+var InspectCommands = []string{"losetup", "mount", "umount", "lsblk"}
+
+// UpdateCommands are run on the host while configuring a flashed device in place, cryptsetup is checked separately
+// when the volume layout has encrypted volumes.
+var UpdateCommands = []string{"lsblk", "vgchange", "blkid", "fatlabel", "mount", "umount", "sync", "chroot"}
+
+// FlashCommands are run on the host while flashing, filesystem specific mkfs tools are checked against the volume
+// layout separately.
+var FlashCommands = []string{
+	"losetup", "lsblk", "parted", "wipefs", "pvcreate", "vgcreate", "lvcreate", "vgchange", "mkfs.vfat", "mkfs.ext4",
+	"blkid", "fatlabel", "mount", "umount", "rsync", "sync",
+}
+
+// these are swapped out in tests so checks don't depend on the host running them.
+var (
+	hostLookPath    = exec.LookPath
+	hostEffectiveID = os.Geteuid
+	procStatus      = "/proc/self/status"
+	loopControl     = "/dev/loop-control"
+)
+
+// CheckHostDependencies makes sure every command is installed, the process can manage mounts and loop devices, and
+// the kernel supports loop devices. Every problem is reported at once, with the package providing missing commands.
+func CheckHostDependencies(commands []string) error {
+	var problems []error
+
+	missing := map[string][]string{}
+	for _, command := range commands {
+		if _, err := hostLookPath(command); err != nil {
+			pkg, ok := hostPackages[command]
+			if !ok {
+				pkg = "unknown package"
+			}
+			missing[pkg] = append(missing[pkg], command)
+		}
+	}
+	packages := make([]string, 0, len(missing))
+	for pkg := range missing {
+		packages = append(packages, pkg)
+	}
+	sort.Strings(packages)
+	for _, pkg := range packages {
+		problems = append(problems, fmt.Errorf("missing %s, install %s", strings.Join(missing[pkg], ", "), pkg))
+	}
+
+	if err := checkSysAdmin(); err != nil {
+		problems = append(problems, err)
+	}
+
+	if _, err := os.Stat(loopControl); err != nil {
+		problems = append(problems, fmt.Errorf("loop devices aren't available, load the loop kernel module: %w", err))
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("host is missing dependencies: %w", errors.Join(problems...))
+	}
+	return nil
+}
+
+func checkSysAdmin() error {
+	if hostEffectiveID() == 0 {
+		return nil
+	}
+	capabilities, err := effectiveCapabilities()
+	if err != nil {
+		return fmt.Errorf("must run as root: %w", err)
+	}
+	if capabilities&(1<<capSysAdmin) == 0 {
+		return errors.New("must run as root or with CAP_SYS_ADMIN")
+	}
+	return nil
+}
+
+// effectiveCapabilities reads the CapEff mask from procStatus.
+func effectiveCapabilities() (uint64, error) {
+	status, err := os.Open(procStatus)
+	if err != nil {
+		return 0, err
+	}
+	defer WrappedClose(status)
+
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		if value, found := strings.CutPrefix(scanner.Text(), "CapEff:"); found {
+			return strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("no effective capabilities in " + procStatus)
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utility
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fakeHost(t *testing.T, installed []string, euid int, capEff string) {
+	originalLookPath, originalID, originalStatus, originalLoop := hostLookPath, hostEffectiveID, procStatus, loopControl
+	t.Cleanup(func() {
+		hostLookPath, hostEffectiveID, procStatus, loopControl = originalLookPath, originalID, originalStatus, originalLoop
+	})
+
+	hostLookPath = func(file string) (string, error) {
+		for _, command := range installed {
+			if command == file {
+				return "/usr/bin/" + file, nil
+			}
+		}
+		return "", exec.ErrNotFound
+	}
+	hostEffectiveID = func() int { return euid }
+
+	dir := t.TempDir()
+	procStatus = filepath.Join(dir, "status")
+	assert.NoError(t, os.WriteFile(procStatus, []byte("Name:\ttest\nCapEff:\t"+capEff+"\n"), 0644))
+	loopControl = filepath.Join(dir, "loop-control")
+	assert.NoError(t, os.WriteFile(loopControl, nil, 0644))
+}
+
+func TestCheckHostDependencies(t *testing.T) {
+	fakeHost(t, []string{"xz", "mount"}, 0, "0000000000000000")
+	assert.NoError(t, CheckHostDependencies([]string{"xz", "mount"}))
+}
+
+func TestCheckHostDependenciesListsEverything(t *testing.T) {
+	fakeHost(t, []string{"mount"}, 1000, "0000000000000000")
+	assert.NoError(t, os.Remove(loopControl))
+
+	err := CheckHostDependencies([]string{"xz", "mount", "pvcreate", "lvcreate", "frobnicate"})
+	assert.ErrorContains(t, err, "missing pvcreate, lvcreate, install lvm2")
+	assert.ErrorContains(t, err, "missing xz, install xz-utils")
+	assert.ErrorContains(t, err, "missing frobnicate, install unknown package")
+	assert.ErrorContains(t, err, "CAP_SYS_ADMIN")
+	assert.ErrorContains(t, err, "loop devices aren't available")
+}
+
+func TestCheckHostDependenciesCapability(t *testing.T) {
+	fakeHost(t, nil, 1000, "0000000000200000")
+	assert.NoError(t, CheckHostDependencies(nil))
+
+	procStatus = filepath.Join(t.TempDir(), "missing")
+	err := CheckHostDependencies(nil)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
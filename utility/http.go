@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utility
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/net/http/httpproxy"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// HTTPConfig is how the builder reaches the network. Proxies left empty come from HTTP_PROXY, HTTPS_PROXY, and
+// NO_PROXY.
+type HTTPConfig struct {
+	HTTPProxy  string `yaml:"httpProxy"`
+	HTTPSProxy string `yaml:"httpsProxy"`
+	NoProxy    string `yaml:"noProxy"`
+	// CABundle is a pem file of extra certificate authorities trusted alongside the system's, for tls intercepting
+	// proxies.
+	CABundle string `yaml:"caBundle"`
+	// TLSMinVersion is the oldest tls version accepted, 1.2 or 1.3. Empty keeps Go's default.
+	TLSMinVersion string `yaml:"tlsMinVersion"`
+}
+
+// Proxies resolves the proxy settings, falling back to the environment for anything the config leaves empty.
+func (h HTTPConfig) Proxies() httpproxy.Config {
+	proxies := *httpproxy.FromEnvironment()
+	if h.HTTPProxy != "" {
+		proxies.HTTPProxy = h.HTTPProxy
+	}
+	if h.HTTPSProxy != "" {
+		proxies.HTTPSProxy = h.HTTPSProxy
+	}
+	if h.NoProxy != "" {
+		proxies.NoProxy = h.NoProxy
+	}
+	return proxies
+}
+
+// NewHTTPClient builds the traced client every download goes through.
+func NewHTTPClient(cfg HTTPConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{} //nolint:gosec
+	if cfg.TLSMinVersion != "" {
+		version, ok := tlsVersions[cfg.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported tls min version %q, use 1.2 or 1.3", cfg.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if cfg.CABundle != "" {
+		pool, poolErr := x509.SystemCertPool()
+		if poolErr != nil {
+			return nil, fmt.Errorf("could not load system certificates: %w", poolErr)
+		}
+		bundle, readErr := os.ReadFile(cfg.CABundle)
+		if readErr != nil {
+			return nil, fmt.Errorf("could not read ca bundle: %w", readErr)
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in ca bundle %s", cfg.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	proxies := cfg.Proxies()
+	proxyFunc := proxies.ProxyFunc()
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(request *http.Request) (*url.URL, error) {
+		return proxyFunc(request.URL)
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: otelhttp.NewTransport(transport)}, nil
+}
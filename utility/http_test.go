@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utility
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxies(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "http://env-proxy:3128")
+	t.Setenv("HTTPS_PROXY", "http://env-proxy:3128")
+	t.Setenv("NO_PROXY", "")
+
+	proxies := HTTPConfig{HTTPSProxy: "http://config-proxy:3128", NoProxy: "deb.debian.org"}.Proxies()
+	assert.Equal(t, "http://env-proxy:3128", proxies.HTTPProxy, "empty fields come from the environment")
+	assert.Equal(t, "http://config-proxy:3128", proxies.HTTPSProxy, "the config wins over the environment")
+
+	proxyFunc := proxies.ProxyFunc()
+	direct, directErr := proxyFunc(&url.URL{Scheme: "https", Host: "deb.debian.org"})
+	assert.NoError(t, directErr)
+	assert.Nil(t, direct, "no proxy hosts are reached directly")
+	proxied, proxiedErr := proxyFunc(&url.URL{Scheme: "https", Host: "github.com"})
+	assert.NoError(t, proxiedErr)
+	assert.Equal(t, "config-proxy:3128", proxied.Host)
+}
+
+func TestNewHTTPClientProxy(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "")
+	t.Setenv("NO_PROXY", "")
+	var requested string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.String()
+		_, _ = io.WriteString(w, "via proxy")
+	}))
+	t.Cleanup(proxy.Close)
+
+	client, err := NewHTTPClient(HTTPConfig{HTTPProxy: proxy.URL})
+	assert.NoError(t, err)
+	response, getErr := client.Get("http://mirror.example/ubuntu/dists/focal/Release")
+	assert.NoError(t, getErr)
+	body, _ := io.ReadAll(response.Body)
+	assert.NoError(t, response.Body.Close())
+	assert.Equal(t, "via proxy", string(body))
+	assert.Equal(t, "http://mirror.example/ubuntu/dists/focal/Release", requested)
+}
+
+func TestNewHTTPClientCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "trusted")
+	}))
+	t.Cleanup(server.Close)
+
+	untrusted, err := NewHTTPClient(HTTPConfig{})
+	assert.NoError(t, err)
+	_, untrustedErr := untrusted.Get(server.URL)
+	assert.Error(t, untrustedErr, "the test server's certificate isn't in the system pool")
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.NoError(t, os.WriteFile(bundle, certificate, 0600))
+	trusted, err := NewHTTPClient(HTTPConfig{CABundle: bundle, TLSMinVersion: "1.2"})
+	assert.NoError(t, err)
+	response, getErr := trusted.Get(server.URL)
+	assert.NoError(t, getErr)
+	body, _ := io.ReadAll(response.Body)
+	assert.NoError(t, response.Body.Close())
+	assert.Equal(t, "trusted", string(body))
+}
+
+func TestNewHTTPClientInvalid(t *testing.T) {
+	_, versionErr := NewHTTPClient(HTTPConfig{TLSMinVersion: "1.0"})
+	assert.Error(t, versionErr)
+
+	_, missingErr := NewHTTPClient(HTTPConfig{CABundle: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.Error(t, missingErr)
+
+	garbage := filepath.Join(t.TempDir(), "garbage.pem")
+	assert.NoError(t, os.WriteFile(garbage, []byte("not a certificate"), 0600))
+	_, garbageErr := NewHTTPClient(HTTPConfig{CABundle: garbage})
+	assert.Error(t, garbageErr)
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utility
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DeviceLockDir holds the lockfiles guarding each flash target.
+const DeviceLockDir = "/run/lock"
+
+// lockPollInterval is how often a waiting lock retries.
+var lockPollInterval = time.Second
+
+// ErrLocked is returned when another process holds a lock and we weren't asked to wait for it.
+type ErrLocked struct {
+	Path    string
+	PID     int
+	Started time.Time
+}
+
+func (e *ErrLocked) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("another build is running, %s is locked", e.Path)
+	}
+	return fmt.Sprintf("another build (pid %d, started at %s) is running, %s is locked", e.PID, e.Started.Format(time.RFC3339), e.Path)
+}
+
+// Lock is an advisory flock on a lockfile, held until Release. The kernel drops it if the process dies.
+type Lock struct {
+	file *os.File
+}
+
+// AcquireLock takes an exclusive lock on path, creating it if needed. When another process holds it AcquireLock
+// returns ErrLocked naming the holder, or with wait set keeps trying until the lock is free or ctx is done.
+func AcquireLock(ctx context.Context, path string, wait bool) (*Lock, error) {
+	file, openErr := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if openErr != nil {
+		return nil, fmt.Errorf("could not open lockfile: %w", openErr)
+	}
+
+	logged := false
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			WrappedClose(file)
+			return nil, fmt.Errorf("could not lock %s: %w", path, err)
+		}
+		locked := lockHolder(file, path)
+		if !wait {
+			WrappedClose(file)
+			return nil, locked
+		}
+		if !logged {
+			slog.Info("waiting for lock", "path", path, "holder", locked.PID)
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			WrappedClose(file)
+			return nil, fmt.Errorf("gave up waiting: %w", errors.Join(locked, ctx.Err()))
+		case <-time.After(lockPollInterval):
+		}
+	}
+
+	// the holder is only informational, a failure to record it doesn't make the lock any less held
+	if err := file.Truncate(0); err == nil {
+		_, _ = file.WriteAt([]byte(fmt.Sprintf("%d\n%s\n", os.Getpid(), time.Now().UTC().Format(time.RFC3339))), 0)
+	}
+	return &Lock{file: file}, nil
+}
+
+// lockHolder reads the pid and start time the holder wrote into the lockfile.
+func lockHolder(file *os.File, path string) *ErrLocked {
+	locked := &ErrLocked{Path: path}
+	contents, err := io.ReadAll(io.NewSectionReader(file, 0, 1024))
+	if err != nil {
+		return locked
+	}
+	fields := strings.Fields(string(contents))
+	if len(fields) != 2 {
+		return locked
+	}
+	pid, pidErr := strconv.Atoi(fields[0])
+	started, startedErr := time.Parse(time.RFC3339, fields[1])
+	if pidErr != nil || startedErr != nil {
+		return locked
+	}
+	locked.PID = pid
+	locked.Started = started
+	return locked
+}
+
+// Release unlocks and closes the lockfile. The file is left in place, removing it would let a waiting process lock
+// a file nobody else can see.
+func (l *Lock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	unlockErr := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	closeErr := l.file.Close()
+	l.file = nil
+	return errors.Join(unlockErr, closeErr)
+}
+
+// DeviceLockPath is the lockfile guarding device. Symlinks like /dev/disk/by-id are resolved first so every name for
+// the same card shares one lock.
+func DeviceLockPath(device string) string {
+	if resolved, err := filepath.EvalSymlinks(device); err == nil {
+		device = resolved
+	}
+	name := strings.ReplaceAll(strings.Trim(filepath.Clean(device), "/"), "/", "-")
+	return filepath.Join(DeviceLockDir, "pi-image-builder-flash-"+name+".lock")
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utility
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcquireLockContended(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "build.lock")
+	held, err := AcquireLock(context.Background(), path, false)
+	assert.NoError(t, err)
+
+	_, contendedErr := AcquireLock(context.Background(), path, false)
+	var locked *ErrLocked
+	assert.ErrorAs(t, contendedErr, &locked)
+	assert.Equal(t, os.Getpid(), locked.PID)
+	assert.WithinDuration(t, time.Now(), locked.Started, time.Minute)
+	assert.ErrorContains(t, contendedErr, "another build (pid ")
+
+	assert.NoError(t, held.Release())
+	again, againErr := AcquireLock(context.Background(), path, false)
+	assert.NoError(t, againErr)
+	assert.NoError(t, again.Release())
+}
+
+func TestAcquireLockWaits(t *testing.T) {
+	previous := lockPollInterval
+	lockPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { lockPollInterval = previous })
+
+	path := filepath.Join(t.TempDir(), "build.lock")
+	held, err := AcquireLock(context.Background(), path, false)
+	assert.NoError(t, err)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		assert.NoError(t, held.Release())
+	}()
+	waited, waitErr := AcquireLock(context.Background(), path, true)
+	assert.NoError(t, waitErr)
+	assert.NoError(t, waited.Release())
+
+	blocker, blockErr := AcquireLock(context.Background(), path, false)
+	assert.NoError(t, blockErr)
+	defer blocker.Release() //nolint:errcheck
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, timeoutErr := AcquireLock(ctx, path, true)
+	assert.ErrorIs(t, timeoutErr, context.DeadlineExceeded)
+	var locked *ErrLocked
+	assert.ErrorAs(t, timeoutErr, &locked)
+}
+
+func TestDeviceLockPath(t *testing.T) {
+	dir := t.TempDir()
+	device := filepath.Join(dir, "sda")
+	assert.NoError(t, os.WriteFile(device, nil, 0644))
+	link := filepath.Join(dir, "usb-card")
+	assert.NoError(t, os.Symlink(device, link))
+
+	assert.Equal(t, DeviceLockPath(device), DeviceLockPath(link))
+	assert.Equal(t, "/run/lock/pi-image-builder-flash-dev-mmcblk0.lock", DeviceLockPath("/dev/mmcblk0"))
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utility
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ProgressInterval is how often long copies report progress, commands set it from --progress-interval.
+var ProgressInterval = 10 * time.Second
+
+// progress counts bytes through a copy and reports at most once per interval. A total of zero or less means the size
+// isn't known, then only bytes and throughput are reported.
+type progress struct {
+	mutex      sync.Mutex
+	ctx        context.Context
+	label      string
+	total      int64
+	interval   time.Duration
+	now        func() time.Time
+	started    time.Time
+	lastReport time.Time
+	done       int64
+	finished   bool
+}
+
+func newProgress(ctx context.Context, label string, total int64) *progress {
+	started := time.Now()
+	return &progress{
+		ctx:        ctx,
+		label:      label,
+		total:      total,
+		interval:   ProgressInterval,
+		now:        time.Now,
+		started:    started,
+		lastReport: started,
+	}
+}
+
+func (p *progress) add(n int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.done += int64(n)
+	now := p.now()
+	if now.Sub(p.lastReport) >= p.interval {
+		p.lastReport = now
+		p.report("copy progress", now)
+	}
+}
+
+func (p *progress) finish() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.finished {
+		return
+	}
+	p.finished = true
+	p.report("copy finished", p.now())
+	trace.SpanFromContext(p.ctx).SetAttributes(telemetry.BytesTransferredKey.Int64(p.done))
+}
+
+// report logs and records a span event, callers hold mutex.
+func (p *progress) report(message string, now time.Time) {
+	elapsed := now.Sub(p.started)
+	throughput := int64(0)
+	if elapsed > 0 {
+		throughput = int64(float64(p.done) / elapsed.Seconds())
+	}
+
+	attributes := []attribute.KeyValue{
+		attribute.String("label", p.label),
+		attribute.Int64("bytes", p.done),
+		attribute.Int64("bytes_per_second", throughput),
+	}
+	logArgs := []any{"label", p.label, "bytes", p.done, "bytes_per_second", throughput}
+	if p.total > 0 {
+		percent := float64(p.done) / float64(p.total) * 100
+		attributes = append(attributes, attribute.Int64("total", p.total), attribute.Float64("percent", percent))
+		logArgs = append(logArgs, "total", p.total, "percent", float64(int(percent*10))/10)
+	}
+
+	telemetry.Logger(p.ctx).InfoContext(p.ctx, message, logArgs...)
+	trace.SpanFromContext(p.ctx).AddEvent(message, trace.WithAttributes(attributes...))
+}
+
+// ProgressReader reports how much has been read from the wrapped reader. It reports once more when the reader is
+// exhausted.
+type ProgressReader struct {
+	reader   io.Reader
+	progress *progress
+}
+
+// NewProgressReader wraps reader, total is the expected size or zero when it isn't known.
+func NewProgressReader(ctx context.Context, reader io.Reader, label string, total int64) *ProgressReader {
+	return &ProgressReader{reader: reader, progress: newProgress(ctx, label, total)}
+}
+
+func (r *ProgressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.progress.add(n)
+	if err == io.EOF {
+		r.progress.finish()
+	}
+	return n, err
+}
+
+// ProgressWriter reports how much has been written to the wrapped writer. Writers can't tell when a copy is done, so
+// call Finish for the final report.
+type ProgressWriter struct {
+	writer   io.Writer
+	progress *progress
+}
+
+// NewProgressWriter wraps writer, total is the expected size or zero when it isn't known.
+func NewProgressWriter(ctx context.Context, writer io.Writer, label string, total int64) *ProgressWriter {
+	return &ProgressWriter{writer: writer, progress: newProgress(ctx, label, total)}
+}
+
+func (w *ProgressWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.progress.add(n)
+	return n, err
+}
+
+// Finish logs the final byte count and throughput.
+func (w *ProgressWriter) Finish() {
+	w.progress.finish()
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utility
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// steppingClock advances by step every time it's read.
+func steppingClock(step time.Duration) func() time.Time {
+	current := time.Unix(0, 0)
+	return func() time.Time {
+		current = current.Add(step)
+		return current
+	}
+}
+
+func TestProgressReaderKnownTotal(t *testing.T) {
+	var output bytes.Buffer
+	ctx := streamingContext(t, &output)
+
+	reader := NewProgressReader(ctx, strings.NewReader(strings.Repeat("a", 100)), "base image", 100)
+	reader.progress.started = time.Unix(0, 0)
+	reader.progress.lastReport = time.Unix(0, 0)
+	reader.progress.interval = time.Second
+	reader.progress.now = steppingClock(time.Second)
+
+	buffer := make([]byte, 25)
+	_, err := reader.Read(buffer)
+	assert.NoError(t, err)
+	assert.Contains(t, output.String(), `msg="copy progress" label="base image" bytes=25 bytes_per_second=25 total=100 percent=25`)
+
+	_, err = io.Copy(io.Discard, reader)
+	assert.NoError(t, err)
+	assert.Contains(t, output.String(), `msg="copy finished" label="base image" bytes=100`)
+	assert.Equal(t, 1, strings.Count(output.String(), "copy finished"))
+}
+
+func TestProgressWriterUnknownTotal(t *testing.T) {
+	var output bytes.Buffer
+	ctx := streamingContext(t, &output)
+
+	var sink bytes.Buffer
+	writer := NewProgressWriter(ctx, &sink, "decompress", 0)
+	writer.progress.interval = time.Hour
+
+	_, err := writer.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Empty(t, output.String(), "nothing is reported before the interval passes")
+
+	writer.Finish()
+	assert.Equal(t, "hello", sink.String())
+	assert.Contains(t, output.String(), `msg="copy finished" label=decompress bytes=5`)
+	assert.NotContains(t, output.String(), "percent")
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utility
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultCommandTimeout bounds every external command that doesn't ask for its own timeout. It's generous because
+// debootstrap, rsync and qemu-img all run under it, the point is that nothing hangs a build forever.
+const DefaultCommandTimeout = 30 * time.Minute
+
+// RunOptions tunes a single Run. The zero value runs with DefaultCommandTimeout in the current directory.
+type RunOptions struct {
+	// Timeout overrides DefaultCommandTimeout.
+	Timeout time.Duration
+	Dir     string
+	Env     []string
+	Stdin   io.Reader
+	// Stream logs output line by line as it's printed instead of buffering it, for long commands like apt-get
+	// install. Only the last lines are kept for the error and Run returns no output.
+	Stream bool
+}
+
+func (o RunOptions) timeout() time.Duration {
+	if o.Timeout == 0 {
+		return DefaultCommandTimeout
+	}
+	return o.Timeout
+}
+
+// Run runs name with a deadline of the options' timeout and returns its combined output. The argv, duration and exit
+// code are recorded on the command's span and a failure's output is folded into the error.
+func Run(ctx context.Context, opts RunOptions, name string, args ...string) ([]byte, error) {
+	if opts.Stream {
+		return nil, stream(ctx, opts, name, args)
+	}
+	var output bytes.Buffer
+	if err := execute(ctx, "running command", opts, name, args, &output, &output, nil); err != nil {
+		return output.Bytes(), fmt.Errorf("non zero exit code exit code: %v, output: %s", err, output.String())
+	}
+	return output.Bytes(), nil
+}
+
+// execute is the part every command shares: the child context, the span and the log line. finished runs once the
+// command exits, while its span is still open.
+func execute(ctx context.Context, verb string, opts RunOptions, name string, args []string, stdout io.Writer, stderr io.Writer, finished func(trace.Span)) error {
+	timeout := opts.timeout()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = opts.Dir
+	cmd.Env = opts.Env
+	cmd.Stdin = opts.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	ctx, span := telemetry.GetTracer().Start(ctx, verb+": "+cmd.String())
+	defer span.End()
+	span.SetAttributes(telemetry.CommandArgvKey.StringSlice(cmd.Args))
+
+	started := time.Now()
+	err := cmd.Run()
+	if finished != nil {
+		finished(span)
+	}
+	logCommand(ctx, cmd, started)
+	span.SetAttributes(telemetry.CommandDurationKey.Int64(time.Since(started).Milliseconds()))
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s: %w", timeout, err)
+	}
+	return err
+}
+
+// optionsFor carries over what callers of the Runner interface set on their command. The command itself is rebuilt by
+// Run so it gets a deadline.
+func optionsFor(cmd *exec.Cmd) RunOptions {
+	return RunOptions{Dir: cmd.Dir, Env: cmd.Env, Stdin: cmd.Stdin}
+}
+
+// Runner executes external commands. Code that shells out takes one so tests can swap in a FakeRunner.
+type Runner interface {
+	// Run waits for cmd and folds its output into the error when it fails.
+	Run(ctx context.Context, cmd *exec.Cmd) error
+	// Stream is Run for long commands, output is logged line by line as it's printed.
+	Stream(ctx context.Context, cmd *exec.Cmd) error
+	// Output returns cmd's stdout.
+	Output(ctx context.Context, cmd *exec.Cmd) ([]byte, error)
+}
+
+// ExecRunner runs commands on the host.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(ctx context.Context, cmd *exec.Cmd) error {
+	_, err := Run(ctx, optionsFor(cmd), cmd.Args[0], cmd.Args[1:]...)
+	return err
+}
+
+func (ExecRunner) Stream(ctx context.Context, cmd *exec.Cmd) error {
+	opts := optionsFor(cmd)
+	opts.Stream = true
+	_, err := Run(ctx, opts, cmd.Args[0], cmd.Args[1:]...)
+	return err
+}
+
+func (ExecRunner) Output(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	if err := execute(ctx, "running command", optionsFor(cmd), cmd.Args[0], cmd.Args[1:], &stdout, &stderr, nil); err != nil {
+		return stdout.Bytes(), fmt.Errorf("non zero exit code exit code: %v, output: %s", err, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+// FakeRunner records commands instead of running them. Outputs and Errors are keyed by the space joined argv.
+type FakeRunner struct {
+	mutex    sync.Mutex
+	Commands []string
+	Outputs  map[string][]byte
+	Errors   map[string]error
+}
+
+func (f *FakeRunner) record(cmd *exec.Cmd) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	line := strings.Join(cmd.Args, " ")
+	f.Commands = append(f.Commands, line)
+	return line
+}
+
+func (f *FakeRunner) Run(_ context.Context, cmd *exec.Cmd) error {
+	return f.Errors[f.record(cmd)]
+}
+
+func (f *FakeRunner) Stream(ctx context.Context, cmd *exec.Cmd) error {
+	return f.Run(ctx, cmd)
+}
+
+func (f *FakeRunner) Output(_ context.Context, cmd *exec.Cmd) ([]byte, error) {
+	line := f.record(cmd)
+	return f.Outputs[line], f.Errors[line]
+}
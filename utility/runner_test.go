@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utility
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunReturnsCombinedOutput(t *testing.T) {
+	output, err := Run(context.Background(), RunOptions{}, "sh", "-c", "echo out; echo err >&2")
+	assert.NoError(t, err)
+	assert.Equal(t, "out\nerr\n", string(output))
+}
+
+func TestRunFoldsOutputIntoError(t *testing.T) {
+	_, err := Run(context.Background(), RunOptions{}, "sh", "-c", "echo broken; exit 3")
+	assert.ErrorContains(t, err, "exit status 3")
+	assert.ErrorContains(t, err, "output: broken")
+}
+
+func TestRunTimesOut(t *testing.T) {
+	started := time.Now()
+	_, err := Run(context.Background(), RunOptions{Timeout: 50 * time.Millisecond}, "sleep", "10")
+	assert.ErrorContains(t, err, "timed out after 50ms")
+	assert.Less(t, time.Since(started), 5*time.Second)
+}
+
+func TestRunUsesOptions(t *testing.T) {
+	dir := t.TempDir()
+	output, err := Run(context.Background(), RunOptions{Dir: dir, Env: []string{"GREETING=hello"}, Stdin: strings.NewReader("piped")},
+		"sh", "-c", `pwd; echo "$GREETING"; cat`)
+	assert.NoError(t, err)
+	assert.Equal(t, dir+"\nhello\npiped", string(output))
+}
+
+func TestExecRunnerOutputKeepsStderrOut(t *testing.T) {
+	output, err := ExecRunner{}.Output(context.Background(), exec.Command("sh", "-c", "echo out; echo err >&2"))
+	assert.NoError(t, err)
+	assert.Equal(t, "out\n", string(output))
+
+	_, failErr := ExecRunner{}.Output(context.Background(), exec.Command("sh", "-c", "echo why >&2; exit 1"))
+	assert.ErrorContains(t, failErr, "output: why")
+}
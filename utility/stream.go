@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utility
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// streamTailLines is how much output a failed streaming command keeps for its error.
+const streamTailLines = 20
+
+// streamOutput collects the lines of a streaming command. stdout and stderr are copied on their own goroutines so
+// everything is guarded by mutex.
+type streamOutput struct {
+	mutex  sync.Mutex
+	ctx    context.Context
+	logger *slog.Logger
+	lines  int
+	tail   []string
+}
+
+func (s *streamOutput) line(stream string, text string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lines++
+	s.tail = append(s.tail, text)
+	if len(s.tail) > streamTailLines {
+		s.tail = s.tail[len(s.tail)-streamTailLines:]
+	}
+	s.logger.InfoContext(s.ctx, text, "stream", stream)
+}
+
+func (s *streamOutput) lastLines() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return strings.Join(s.tail, "\n")
+}
+
+// streamWriter splits what a command writes into lines, holding back a trailing partial line until it's finished.
+type streamWriter struct {
+	output  *streamOutput
+	stream  string
+	partial []byte
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		index := bytes.IndexByte(w.partial, '\n')
+		if index < 0 {
+			break
+		}
+		w.output.line(w.stream, strings.TrimRight(string(w.partial[:index]), "\r"))
+		w.partial = w.partial[index+1:]
+	}
+	return len(p), nil
+}
+
+func (w *streamWriter) flush() {
+	if len(w.partial) != 0 {
+		w.output.line(w.stream, string(w.partial))
+		w.partial = nil
+	}
+}
+
+// stream is Run for long commands: every line of output is logged as it's printed and only the last lines are kept for
+// the error.
+func stream(ctx context.Context, opts RunOptions, name string, args []string) error {
+	output := &streamOutput{ctx: ctx, logger: telemetry.Logger(ctx).With("command", name)}
+	stdout := &streamWriter{output: output, stream: "stdout"}
+	stderr := &streamWriter{output: output, stream: "stderr"}
+
+	err := execute(ctx, "streaming command", opts, name, args, stdout, stderr, func(span trace.Span) {
+		stdout.flush()
+		stderr.flush()
+		span.SetAttributes(attribute.Int("command.output_lines", output.lines))
+	})
+	if err != nil {
+		return fmt.Errorf("non zero exit code exit code: %v, last output: %s", err, output.lastLines())
+	}
+	return nil
+}
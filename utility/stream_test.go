@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utility
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/LadySerena/pi-image-builder/telemetry"
+	"github.com/stretchr/testify/assert"
+)
+
+func streamingContext(t *testing.T, output *bytes.Buffer) context.Context {
+	logger, err := telemetry.LogOptions{Level: "info", Format: telemetry.LogFormatText}.NewLogger(output)
+	assert.NoError(t, err)
+	return telemetry.WithLogger(context.Background(), logger)
+}
+
+func TestRunStreamLogsLines(t *testing.T) {
+	var output bytes.Buffer
+	ctx := streamingContext(t, &output)
+
+	_, err := Run(ctx, RunOptions{Stream: true}, "sh", "-c", "echo one; echo two >&2; printf three")
+	assert.NoError(t, err)
+	logged := output.String()
+	assert.Contains(t, logged, "msg=one command=sh stream=stdout")
+	assert.Contains(t, logged, "msg=two command=sh stream=stderr")
+	assert.Contains(t, logged, "msg=three command=sh stream=stdout")
+}
+
+func TestRunStreamKeepsTail(t *testing.T) {
+	var output bytes.Buffer
+	ctx := streamingContext(t, &output)
+
+	_, err := Run(ctx, RunOptions{Stream: true}, "sh", "-c", "seq 1 50; exit 2")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "exit status 2")
+	assert.True(t, strings.HasSuffix(err.Error(), "\n50"))
+	assert.Contains(t, err.Error(), fmt.Sprintf("last output: %d\n", 50-streamTailLines+1))
+	assert.NotContains(t, err.Error(), fmt.Sprintf("\n%d\n", 50-streamTailLines))
+}
+
+func TestStreamWriterSplitsPartialWrites(t *testing.T) {
+	var logged bytes.Buffer
+	output := &streamOutput{ctx: context.Background()}
+	logger, err := telemetry.LogOptions{Level: "info", Format: telemetry.LogFormatText}.NewLogger(&logged)
+	assert.NoError(t, err)
+	output.logger = logger
+	writer := &streamWriter{output: output, stream: "stdout"}
+
+	_, _ = writer.Write([]byte("Get:1 http://ports"))
+	assert.Equal(t, 0, output.lines)
+	_, _ = writer.Write([]byte(".ubuntu.com focal InRelease\r\nGet:2"))
+	assert.Equal(t, 1, output.lines)
+	writer.flush()
+	assert.Equal(t, "Get:1 http://ports.ubuntu.com focal InRelease\nGet:2", output.lastLines())
+}
@@ -0,0 +1,247 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utility
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/afero"
+	"golang.org/x/sys/unix"
+)
+
+// xattrPrefix is how tar's pax format stores extended attributes, the same prefix GNU tar and the OCI layer spec use.
+const xattrPrefix = "SCHILY.xattr."
+
+// TreeOptions changes what WriteTree puts in the archive.
+type TreeOptions struct {
+	// Exclude are absolute paths whose contents are left out, the directories themselves are kept so they can still
+	// be mounted over.
+	Exclude []string
+	// Skip are absolute paths left out entirely.
+	Skip []string
+	// Skipped is told about every special file (devices, sockets, fifos) that isn't archived, it may be nil.
+	Skipped func(name string)
+}
+
+func (o TreeOptions) excluded(name string) bool {
+	for _, excluded := range o.Exclude {
+		if strings.HasPrefix(name, cleanTreePath(excluded)+"/") {
+			return true
+		}
+	}
+	for _, skipped := range o.Skip {
+		if name == cleanTreePath(skipped) {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteTree writes every directory, regular file, and symlink under root to w with the owner, mode, and modification
+// time it has on disk. Files linked more than once are written as hard links to their first path, and extended
+// attributes (file capabilities in particular) are kept when root is backed by the os. Owners are written as numeric
+// ids only, the host's user names mean nothing inside an image.
+func WriteTree(root afero.Fs, w *tar.Writer, opts TreeOptions) error {
+	links := make(map[inode]string)
+	return afero.Walk(root, "/", func(name string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "/" {
+			return nil
+		}
+		if opts.excluded(name) {
+			if info.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			reader, ok := root.(afero.LinkReader)
+			if !ok {
+				return fmt.Errorf("cannot read symlink %s on this filesystem", name)
+			}
+			target, readErr := reader.ReadlinkIfPossible(name)
+			if readErr != nil {
+				return readErr
+			}
+			link = target
+		} else if !info.IsDir() && !info.Mode().IsRegular() {
+			if opts.Skipped != nil {
+				opts.Skipped(name)
+			}
+			return nil
+		}
+
+		header, headerErr := tar.FileInfoHeader(info, link)
+		if headerErr != nil {
+			return headerErr
+		}
+		header.Name = name[1:]
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		header.Uname = ""
+		header.Gname = ""
+
+		if id, ok := hardLinked(info); ok {
+			if first, seen := links[id]; seen {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+				return w.WriteHeader(header)
+			}
+			links[id] = header.Name
+		}
+
+		if info.Mode()&fs.ModeSymlink == 0 {
+			xattrs, xattrErr := readXattrs(root, name)
+			if xattrErr != nil {
+				return fmt.Errorf("could not read extended attributes of %s: %w", name, xattrErr)
+			}
+			for key, value := range xattrs {
+				if header.PAXRecords == nil {
+					header.PAXRecords = make(map[string]string)
+				}
+				header.PAXRecords[xattrPrefix+key] = value
+			}
+			if len(header.PAXRecords) != 0 {
+				header.Format = tar.FormatPAX
+			}
+		}
+
+		if err := w.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, openErr := root.Open(name)
+		if openErr != nil {
+			return openErr
+		}
+		defer WrappedClose(file)
+		_, copyErr := io.Copy(w, file)
+		return copyErr
+	})
+}
+
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// hardLinked reports the inode of a regular file with more than one link to it.
+func hardLinked(info fs.FileInfo) (inode, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || !info.Mode().IsRegular() || stat.Nlink < 2 {
+		return inode{}, false
+	}
+	return inode{dev: uint64(stat.Dev), ino: stat.Ino}, true //nolint:unconvert
+}
+
+// realPath is name's path on the host, empty when root isn't backed by the os.
+func realPath(root afero.Fs, name string) (string, error) {
+	switch typed := root.(type) {
+	case *afero.BasePathFs:
+		return typed.RealPath(name)
+	case *afero.OsFs:
+		return name, nil
+	default:
+		return "", nil
+	}
+}
+
+// readXattrs returns the extended attributes of name, filesystems that aren't backed by the os have none.
+func readXattrs(root afero.Fs, name string) (map[string]string, error) {
+	realName, realErr := realPath(root, name)
+	if realErr != nil || realName == "" {
+		return nil, realErr
+	}
+
+	size, listErr := syscall.Listxattr(realName, nil)
+	if listErr != nil || size == 0 {
+		return nil, ignoreUnsupported(listErr)
+	}
+	buffer := make([]byte, size)
+	size, listErr = syscall.Listxattr(realName, buffer)
+	if listErr != nil {
+		return nil, ignoreUnsupported(listErr)
+	}
+
+	xattrs := make(map[string]string)
+	for _, key := range strings.Split(strings.TrimRight(string(buffer[:size]), "\x00"), "\x00") {
+		valueSize, getErr := syscall.Getxattr(realName, key, nil)
+		if getErr != nil {
+			return nil, getErr
+		}
+		value := make([]byte, valueSize)
+		valueSize, getErr = syscall.Getxattr(realName, key, value)
+		if getErr != nil {
+			return nil, getErr
+		}
+		xattrs[key] = string(value[:valueSize])
+	}
+	return xattrs, nil
+}
+
+// ignoreUnsupported drops ENOTSUP, vfat and some tmpfs mounts have no extended attributes at all.
+// ApplyXattrs sets the extended attributes WriteTree stored in header on name, without following a symlink there. Set
+// them after chown, which clears file capabilities. Filesystems that aren't backed by the os get none, and attributes
+// the filesystem doesn't support or only root may set are skipped.
+func ApplyXattrs(root afero.Fs, name string, header *tar.Header) error {
+	realName, realErr := realPath(root, name)
+	if realErr != nil || realName == "" {
+		return realErr
+	}
+	for record, value := range header.PAXRecords {
+		key, ok := strings.CutPrefix(record, xattrPrefix)
+		if !ok {
+			continue
+		}
+		err := unix.Lsetxattr(realName, key, []byte(value), 0)
+		if errors.Is(err, fs.ErrPermission) {
+			continue
+		}
+		if err := ignoreUnsupported(err); err != nil {
+			return fmt.Errorf("could not set %s on %s: %w", key, name, err)
+		}
+	}
+	return nil
+}
+
+func ignoreUnsupported(err error) error {
+	if err == syscall.ENOTSUP {
+		return nil
+	}
+	return err
+}
+
+// cleanTreePath makes name absolute and clean so it compares against the paths WriteTree walks.
+func cleanTreePath(name string) string {
+	return path.Join("/", name)
+}
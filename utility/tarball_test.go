@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2022 Serena Tiede
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utility
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func readTree(t *testing.T, r io.Reader) map[string]*tar.Header {
+	t.Helper()
+	headers := make(map[string]*tar.Header)
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return headers
+		}
+		assert.NoError(t, err)
+		headers[header.Name] = header
+	}
+}
+
+func TestWriteTree(t *testing.T) {
+	dir := t.TempDir()
+	root := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	assert.NoError(t, root.MkdirAll("/usr/bin", 0755))
+	assert.NoError(t, afero.WriteFile(root, "/usr/bin/ping", []byte("binary"), 0755))
+	assert.NoError(t, os.Link(filepath.Join(dir, "usr/bin/ping"), filepath.Join(dir, "usr/bin/ping6")))
+	assert.NoError(t, os.Symlink("ping", filepath.Join(dir, "usr/bin/ping4")))
+	assert.NoError(t, root.MkdirAll("/proc", 0755))
+	assert.NoError(t, afero.WriteFile(root, "/proc/cpuinfo", []byte("processor: 0"), 0644))
+	assert.NoError(t, afero.WriteFile(root, "/usr/bin/qemu-aarch64-static", []byte("emulator"), 0755))
+	assert.NoError(t, syscall.Mkfifo(filepath.Join(dir, "fifo"), 0644))
+
+	var skipped []string
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	assert.NoError(t, WriteTree(root, writer, TreeOptions{
+		Exclude: []string{"/proc"},
+		Skip:    []string{"/usr/bin/qemu-aarch64-static"},
+		Skipped: func(name string) { skipped = append(skipped, name) },
+	}))
+	assert.NoError(t, writer.Close())
+
+	headers := readTree(t, &buffer)
+	assert.Contains(t, headers, "proc/")
+	assert.NotContains(t, headers, "proc/cpuinfo")
+	assert.NotContains(t, headers, "usr/bin/qemu-aarch64-static")
+	assert.NotContains(t, headers, "fifo")
+	assert.Equal(t, []string{"/fifo"}, skipped)
+
+	assert.Equal(t, byte(tar.TypeReg), headers["usr/bin/ping"].Typeflag)
+	assert.Equal(t, int64(0755), headers["usr/bin/ping"].Mode&0777)
+	assert.Equal(t, os.Getuid(), headers["usr/bin/ping"].Uid)
+	assert.Empty(t, headers["usr/bin/ping"].Uname)
+	assert.Equal(t, byte(tar.TypeLink), headers["usr/bin/ping6"].Typeflag)
+	assert.Equal(t, "usr/bin/ping", headers["usr/bin/ping6"].Linkname)
+	assert.Equal(t, byte(tar.TypeSymlink), headers["usr/bin/ping4"].Typeflag)
+	assert.Equal(t, "ping", headers["usr/bin/ping4"].Linkname)
+}
+
+func TestWriteTreeXattrs(t *testing.T) {
+	dir := t.TempDir()
+	root := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	assert.NoError(t, root.MkdirAll("/usr/bin", 0755))
+	assert.NoError(t, afero.WriteFile(root, "/usr/bin/ping", []byte("binary"), 0755))
+	if err := syscall.Setxattr(filepath.Join(dir, "usr/bin/ping"), "user.comment", []byte("pinged"), 0); err != nil {
+		t.Skipf("temp dir doesn't support extended attributes: %v", err)
+	}
+
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	assert.NoError(t, WriteTree(root, writer, TreeOptions{}))
+	assert.NoError(t, writer.Close())
+
+	headers := readTree(t, &buffer)
+	assert.Equal(t, "pinged", headers["usr/bin/ping"].PAXRecords["SCHILY.xattr.user.comment"])
+}